@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// checkCommand is the name of the command that verifies
+// the data files of the stopped database.
+const checkCommand = "check"
+
+// check verifies the data files and exits with 1 if any is corrupted:
+//
+//	gosqldb check <db directory>
+func check(args []string) {
+	flags := flag.NewFlagSet(checkCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s <db directory>\n", os.Args[0], checkCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := os.Stat(flags.Arg(0)); err != nil {
+		logging.Fatalf("failed to open db directory: %s", err)
+	}
+
+	db, dirLock := openOffline(flags.Arg(0), "")
+	result, err := db.Check()
+	closeOffline(db, dirLock)
+	if err != nil {
+		logging.Fatalf("failed to check database: %s", err)
+	}
+
+	for _, corrupted := range result.Corrupted {
+		logging.Errorf("CORRUPTION: %s", corrupted)
+	}
+
+	if len(result.Corrupted) > 0 {
+		logging.Fatalf("%d of %d data files are corrupted", len(result.Corrupted), result.FilesChecked)
+	}
+
+	logging.Infof("%d data files are intact", result.FilesChecked)
+}
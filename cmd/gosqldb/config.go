@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The settings are the command-line flags. The flags that are not set
+// on the command line are taken from the environment variables and then
+// from the config file. The config file has a "key = value" line per
+// flag, the keys are the flag names, strings and durations are quoted:
+//
+//	# gosqldb.toml
+//	data-dir = "/var/lib/gosqldb"
+//	listen = ":8080"
+//	fsync = "interval"
+//	fsync-interval = "500ms"
+//	max-row-size = 65536
+//
+// The environment variables are the flag names in upper case with
+// the GOSQLDB_ prefix and underscores instead of dashes, for example
+// GOSQLDB_FSYNC_INTERVAL=500ms.
+
+// envPrefix is the prefix of the environment variables with the settings.
+const envPrefix = "GOSQLDB_"
+
+// configFlags are not read from the config file and the environment.
+var configFlags = map[string]bool{"config": true, "print-config": true, "force-unlock": true}
+
+// secretFlags are not printed with the rest of the settings.
+var secretFlags = map[string]bool{"replication-password": true, "witness-secret": true, "cluster-secret": true, "encryption-keys": true}
+
+// configEnvName returns the name of the environment
+// variable of the flag.
+func configEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig sets the flags that have not been set on the command
+// line from the environment variables and the config file, the path
+// is empty if there is no config file.
+func loadConfig(flags *flag.FlagSet, configPath string) error {
+	fileValues := make(map[string]string)
+	if configPath != "" {
+		var err error
+		fileValues, err = readConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+
+		for name := range fileValues {
+			if flags.Lookup(name) == nil || configFlags[name] {
+				return fmt.Errorf("unknown setting %s in config file %s", name, configPath)
+			}
+		}
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || configFlags[f.Name] {
+			return
+		}
+
+		if value, exists := os.LookupEnv(configEnvName(f.Name)); exists {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value of %s: %w", configEnvName(f.Name), setErr)
+			}
+
+			return
+		}
+
+		if value, exists := fileValues[f.Name]; exists {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value of %s in config file %s: %w", f.Name, configPath, setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+// readConfigFile reads the values by the flag names.
+func readConfigFile(configPath string) (map[string]string, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file %s: %w", configPath, err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logging.Errorf("failed to close config file %s: %s", configPath, err)
+		}
+	}()
+
+	values, err := parseConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", configPath, err)
+	}
+
+	return values, nil
+}
+
+// parseConfig parses "key = value" lines, the empty lines and
+// the lines starting with # are skipped.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key = value at line %d", line)
+		}
+
+		key := strings.ReplaceAll(strings.TrimSpace(parts[0]), "_", "-")
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("%s is repeated at line %d", key, line)
+		}
+
+		value := strings.TrimSpace(parts[1])
+		comment := strings.Index(value, "#")
+		if strings.HasPrefix(value, `"`) {
+			end := 1
+			for ; end < len(value) && value[end] != '"'; end++ {
+				if value[end] == '\\' {
+					end++
+				}
+			}
+
+			if end >= len(value) {
+				return nil, fmt.Errorf("unterminated string at line %d", line)
+			}
+
+			rest := strings.TrimSpace(value[end+1:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("unexpected %s after string at line %d", rest, line)
+			}
+
+			unquoted, err := strconv.Unquote(value[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at line %d: %w", line, err)
+			}
+			value, comment = unquoted, -1
+		}
+
+		if comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+
+		values[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// validateConfig checks the values that are not checked when
+// the settings are parsed, the numbers and durations can not be
+// negative.
+func validateConfig(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		getter, ok := f.Value.(flag.Getter)
+		if err != nil || !ok {
+			return
+		}
+
+		negative := false
+		switch v := getter.Get().(type) {
+		case int:
+			negative = v < 0
+		case int64:
+			negative = v < 0
+		case float64:
+			negative = v < 0
+		case time.Duration:
+			negative = v < 0
+		}
+
+		if negative {
+			err = fmt.Errorf("%s can not be negative", f.Name)
+		}
+	})
+
+	return err
+}
+
+// printConfig writes the settings in the config file format.
+func printConfig(w io.Writer, flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || configFlags[f.Name] {
+			return
+		}
+
+		if secretFlags[f.Name] && f.Value.String() != "" {
+			_, err = fmt.Fprintf(w, "# %s is set, but not printed\n", f.Name)
+			return
+		}
+
+		value := f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch v := getter.Get().(type) {
+			case string:
+				value = strconv.Quote(v)
+			case time.Duration:
+				value = strconv.Quote(v.String())
+			}
+		}
+
+		_, err = fmt.Fprintf(w, "%s = %s\n", f.Name, value)
+	})
+
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// dumpCommand and importCommand are the names of the commands that
+// dump the tables of the stopped database and import the dump into it.
+const (
+	dumpCommand   = "dump"
+	importCommand = "import"
+)
+
+// openOffline locks the db directory and opens the database that is
+// not served by another process, the encryption keys are taken from
+// the environment variable of the -encryption-keys flag.
+func openOffline(dbDir string, archiveDir string) (*engine.Database, *engine.DirLock) {
+	dirLock, err := engine.LockDir(dbDir, false)
+	if err != nil {
+		logging.Fatalf("failed to lock db directory: %s", err)
+	}
+
+	options := engine.Options{ArchiveDir: archiveDir, Encryption: keyProvider(os.Getenv(configEnvName("encryption-keys")))}
+	db, err := engine.NewDatabase(dbDir, options)
+	if err != nil {
+		releaseDirLock(dirLock)
+		logging.Fatalf("failed to open database: %s", err)
+	}
+
+	return db, dirLock
+}
+
+// closeOffline closes the database opened by openOffline.
+func closeOffline(db *engine.Database, dirLock *engine.DirLock) {
+	if err := db.Close(); err != nil {
+		logging.Errorf("failed to close database: %s", err)
+	}
+	releaseDirLock(dirLock)
+}
+
+// dump writes the statements that recreate the tables of the stopped
+// database or, through the server, of the running one:
+//
+//	gosqldb dump [-tables a,b] [-output file] <db directory|server address>
+func dump(args []string) {
+	flags := flag.NewFlagSet(dumpCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <db directory|server address>\n", os.Args[0], dumpCommand)
+		flags.PrintDefaults()
+	}
+	tables := flags.String("tables", "", "comma-separated tables to dump, empty means all the tables")
+	output := flags.String("output", "", "file the dump is written to, empty means the standard output")
+	user := flags.String("user", "", "superuser of the server, empty if the server does not require the authentication")
+	password := flags.String("password", os.Getenv(configEnvName("password")), "password or token of the user")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var names []string
+	if *tables != "" {
+		names = strings.Split(*tables, ",")
+	}
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *output != "" {
+		var err error
+		file, err = os.Create(*output)
+		if err != nil {
+			logging.Fatalf("failed to create dump file: %s", err)
+		}
+		w = file
+	}
+
+	var err error
+	if info, statErr := os.Stat(flags.Arg(0)); statErr == nil && info.IsDir() {
+		db, dirLock := openOffline(flags.Arg(0), "")
+		err = db.Dump(context.Background(), w, names)
+		closeOffline(db, dirLock)
+	} else {
+		err = dumpRemote(flags.Arg(0), *user, *password, names, w)
+	}
+	if err != nil {
+		logging.Fatalf("failed to dump database: %s", err)
+	}
+
+	if file != nil {
+		if err := file.Sync(); err != nil {
+			logging.Fatalf("failed to flush dump file: %s", err)
+		}
+		if err := file.Close(); err != nil {
+			logging.Fatalf("failed to close dump file: %s", err)
+		}
+	}
+}
+
+// dumpRemote writes the dump of the tables of the running server,
+// the server reads them within a single snapshot.
+func dumpRemote(target string, user string, password string, tables []string, w io.Writer) error {
+	address, err := serverAddress(target)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"table": tables}
+	backend := &remoteBackend{address: address, user: user, password: password}
+	response, err := backend.request(http.MethodGet, "/admin/dump?"+query.Encode(), "")
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		return backend.decode(response, nil)
+	}
+	defer response.Body.Close()
+
+	if _, err := io.Copy(w, response.Body); err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+
+	return nil
+}
+
+// importDump executes the statements of the dump:
+//
+//	gosqldb import [-input file] [-archive-dir dir] <db directory>
+func importDump(args []string) {
+	flags := flag.NewFlagSet(importCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <db directory>\n", os.Args[0], importCommand)
+		flags.PrintDefaults()
+	}
+	input := flags.String("input", "", "file the dump is read from, empty means the standard input")
+	archiveDir := flags.String("archive-dir", "", "archive of the database, the imported changes are archived if the database is archived")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			logging.Fatalf("failed to open dump file: %s", err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				logging.Errorf("failed to close dump file: %s", err)
+			}
+		}()
+		r = file
+	}
+
+	db, dirLock := openOffline(flags.Arg(0), *archiveDir)
+	result, err := db.Import(context.Background(), r)
+	closeOffline(db, dirLock)
+	if err != nil {
+		logging.Fatalf("failed to import dump after %d statements: %s", result.Statements, err)
+	}
+
+	logging.Infof("imported %d statements, %d rows", result.Statements, result.Rows)
+}
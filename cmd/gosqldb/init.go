@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// initCommand is the name of the command that creates a new database.
+const initCommand = "init"
+
+// initDatabase creates the empty database with the optional superuser:
+//
+//	gosqldb init [-superuser name -password password] <db directory>
+func initDatabase(args []string) {
+	flags := flag.NewFlagSet(initCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <db directory>\n", os.Args[0], initCommand)
+		flags.PrintDefaults()
+	}
+	superuser := flags.String("superuser", "", "superuser created in the database, the clients must authenticate once there is a user")
+	password := flags.String("password", os.Getenv(configEnvName("password")), "password of the superuser, prefer the GOSQLDB_PASSWORD environment variable")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *superuser != "" && *password == "" {
+		logging.Fatalf("-superuser requires -password")
+	}
+
+	dbDir := flags.Arg(0)
+	entries, err := ioutil.ReadDir(dbDir)
+	if err != nil && !os.IsNotExist(err) {
+		logging.Fatalf("failed to read db directory: %s", err)
+	}
+	if len(entries) > 0 {
+		logging.Fatalf("db directory %s is not empty", dbDir)
+	}
+
+	if err := os.MkdirAll(dbDir, 0700); err != nil {
+		logging.Fatalf("failed to create db directory: %s", err)
+	}
+
+	db, dirLock := openOffline(dbDir, "")
+	if *superuser != "" {
+		err = db.CreateUser(&engine.CreateUser{Name: *superuser, Password: *password, Superuser: true})
+	}
+	closeOffline(db, dirLock)
+	if err != nil {
+		logging.Fatalf("failed to create superuser: %s", err)
+	}
+
+	logging.Infof("database has been initialized in %s", dbDir)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	"github.com/krasun/gosqldb/internal/tracing"
+	"github.com/krasun/gosqldb/server"
+	"google.golang.org/grpc"
+)
+
+func releaseDirLock(l *engine.DirLock) {
+	if err := l.Release(); err != nil {
+		logging.Fatalf("failed to release lock: %s", err)
+	}
+}
+
+// commands are the subcommands by their names.
+var commands = map[string]func(args []string){
+	serveCommand:   serve,
+	initCommand:    initDatabase,
+	checkCommand:   check,
+	dumpCommand:    dump,
+	importCommand:  importDump,
+	restoreCommand: restore,
+	witnessCommand: witness,
+	shellCommand:   shell,
+	migrateCommand: migrate,
+}
+
+// commandNames lists the subcommands in the usage.
+const commandNames = "serve, init, check, dump, import, restore, witness, shell and migrate"
+
+func main() {
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	// the database is served without the subcommand
+	// as before the subcommands were introduced
+	serve(os.Args[1:])
+}
+
+// keyProvider returns the provider of the encryption keys,
+// nil if the specification is empty.
+func keyProvider(spec string) engine.KeyProvider {
+	if spec == "" {
+		return nil
+	}
+
+	provider, err := engine.NewKeyProvider(spec)
+	if err != nil {
+		logging.Fatalf("failed to load encryption keys: %s", err)
+	}
+
+	return provider
+}
+
+// serveCommand is the name of the command that serves the database.
+const serveCommand = "serve"
+
+// serve serves the database until the process is interrupted:
+//
+//	gosqldb [serve] [flags] [db directory]
+func serve(args []string) {
+	flags := flag.NewFlagSet(serveCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [serve] [flags] [db directory]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s <command> [flags] ..., the commands are %s\n", os.Args[0], commandNames)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", os.Getenv(configEnvName("config")), "path to the config file with the settings that are not set by the flags or the environment")
+	printConfigOnly := flags.Bool("print-config", false, "print the effective settings in the config file format and exit")
+	dataDir := flags.String("data-dir", "", "path to the db directory, can be passed as the argument")
+	listen := flags.String("listen", ":8080", "address the HTTP API listens on")
+	tlsCert := flags.String("tls-cert", "", "path to the PEM-encoded certificate of the HTTP API, enables TLS together with -tls-key")
+	tlsKey := flags.String("tls-key", "", "path to the PEM-encoded private key of the -tls-cert certificate")
+	tlsMinVersion := flags.String("tls-min-version", "1.2", "minimum TLS version of the HTTP API: 1.0, 1.1, 1.2 or 1.3")
+	tlsCipherSuites := flags.String("tls-cipher-suites", "", "comma-separated cipher suites enabled for TLS 1.2 and older, empty means the Go defaults")
+	tlsClientCA := flags.String("tls-client-ca", "", "path to the PEM-encoded CA certificates, if set the HTTP API clients must present a certificate signed by them")
+	pgListen := flags.String("pg-listen", "", "address the PostgreSQL wire protocol listens on, empty disables the protocol")
+	grpcListen := flags.String("grpc-listen", "", "address the gRPC API listens on, empty disables the API")
+	logLevelName := flags.String("log-level", string(logging.Info), "log level: debug logs every executed statement, info, warn or error")
+	logFormatName := flags.String("log-format", string(logging.Text), "log format: text, logfmt or json")
+	otlpEndpoint := flags.String("otlp-endpoint", "", "OTLP/HTTP endpoint the spans of the query requests are exported to, like http://localhost:4318/v1/traces, empty disables the tracing")
+	slowQueryThreshold := flags.Duration("slow-query-threshold", 0, "statements running longer are logged with their plans as slow queries, 0 disables the log")
+	fsync := flags.String("fsync", string(engine.FsyncAlways), "when to flush written files: always, interval or never")
+	fsyncInterval := flags.Duration("fsync-interval", engine.DefaultFsyncInterval, "flush period for the interval fsync policy")
+	segmentRows := flags.Int("segment-rows", 10000, "number of rows of a table or partition data file after which the new rows go to the next segment file, so updates and deletes rewrite only the changed segments, 0 keeps a single file")
+	mmapThreshold := flags.Int64("mmap-threshold", 0, "table file size in bytes starting from which the table is scanned through a memory-mapped file instead of being loaded into memory, 0 disables")
+	maxRowSize := flags.Int("max-row-size", 0, "maximum size of the encoded row in bytes, 0 means no limit")
+	maxValueSize := flags.Int("max-value-size", 0, "maximum size of a single value in bytes, 0 means no limit")
+	maxTableRows := flags.Int("max-table-rows", 0, "maximum number of the rows of a table, 0 means no limit")
+	maxDatabaseSize := flags.Int64("max-database-size", 0, "maximum size in bytes of the data files of the tables, the inserts and the updates over it are rejected, 0 means no limit")
+	scrubInterval := flags.Duration("scrub-interval", 0, "pause between background integrity checks of the data files, 0 disables the checks")
+	vacuumInterval := flags.Duration("vacuum-interval", time.Minute, "pause between background removals of obsolete row versions, 0 disables the removal")
+	archiveDir := flags.String("archive-dir", "", "directory where every version of the changed files is archived for the point-in-time recovery, empty disables the archive")
+	replicationListen := flags.String("replication-listen", "", "address the replicas connect to for the archive records, requires -archive-dir, empty disables the replication")
+	replicateFrom := flags.String("replicate-from", "", "replication address of the primary, the database is a read-only replica that copies the primary snapshot into the empty db directory on the first start")
+	replicationUser := flags.String("replication-user", "", "superuser the replica authenticates with at the primary")
+	replicationPassword := flags.String("replication-password", "", "password or token the replica authenticates with at the primary, prefer the GOSQLDB_REPLICATION_PASSWORD environment variable")
+	witnessURL := flags.String("witness", "", "URL of the witness that grants the leader lease, enables the automatic failover of the primary and the replica, requires -node-name and -advertise-url")
+	witnessSecret := flags.String("witness-secret", "", "secret sent to the witness, prefer the GOSQLDB_WITNESS_SECRET environment variable")
+	nodeName := flags.String("node-name", "", "name of the node in the failover pair, unique within the pair")
+	advertiseURL := flags.String("advertise-url", "", "URL of the HTTP API of the node the clients of the other node are redirected to")
+	leaseDuration := flags.Duration("lease-duration", 10*time.Second, "how long the leader lease is valid without renewals, the replica is promoted when the primary has been gone for it")
+	clusterListen := flags.String("cluster-listen", "", "address the cluster endpoints listen on, enables the cluster of the nodes that elect the leader, requires -archive-dir, -replication-listen, -node-name, -advertise-url, -cluster-advertise-url and -replication-advertise")
+	clusterAdvertiseURL := flags.String("cluster-advertise-url", "", "URL of the cluster endpoints of the node the other nodes send the votes and the heartbeats to")
+	replicationAdvertise := flags.String("replication-advertise", "", "replication address of the node the followers connect to when it leads the cluster")
+	clusterBootstrap := flags.Bool("cluster-bootstrap", false, "start the new cluster with the node as its only member, the other nodes join it")
+	clusterJoin := flags.String("cluster-join", "", "URL of the cluster endpoints of a member the node asks to add it to the cluster")
+	clusterSecret := flags.String("cluster-secret", "", "secret the cluster nodes authenticate each other with, prefer the GOSQLDB_CLUSTER_SECRET environment variable")
+	clusterReads := flags.String("cluster-reads", "follower", "where the reads of the cluster are served: leader, or follower that may be behind the leader")
+	historyRetention := flags.Duration("history-retention", 0, "how long executed queries are kept in the query history, 0 disables the history")
+	changefeedRetention := flags.Duration("changefeed-retention", 0, "how long committed row changes are kept for the /changes stream, 0 disables the changefeed")
+	auditLog := flags.Bool("audit-log", false, "record every executed statement in the append-only audit log, queried with information_schema.audit")
+	auditMaxSize := flags.Int64("audit-max-size", 64<<20, "size in bytes the audit log file is rotated at, 0 disables the rotation")
+	auditMaxFiles := flags.Int("audit-max-files", 10, "number of rotated audit log files kept, 0 keeps all of them")
+	scanWorkers := flags.Int("scan-workers", 0, "number of workers scanning large in-memory tables at once, 0 means the number of CPUs, 1 disables parallel scans")
+	groupCommitSize := flags.Int("group-commit-size", 64, "maximum number of concurrent inserts written with a single write and sync, 0 or 1 disables group commit")
+	groupCommitWindow := flags.Duration("group-commit-window", time.Millisecond, "how long concurrent inserts wait for each other to be written together, 0 writes only the inserts that are already waiting")
+	readOnly := flags.Bool("read-only", false, "reject the statements that change the data, the schema, the users or the tokens, switched at runtime with SET DATABASE READ WRITE")
+	statementCacheSize := flags.Int("statement-cache-size", 1000, "number of parsed statements cached by their text, 0 disables the cache")
+	resultCacheSize := flags.Int64("result-cache-size", 0, "estimated size in bytes of the rows of repeated SELECTs kept in memory, 0 disables the result cache")
+	resultCacheTTL := flags.Duration("result-cache-ttl", 0, "how long the cached rows of the SELECTs are served, 0 keeps them until the tables change")
+	workMem := flags.Int64("work-mem", 64<<20, "estimated size in bytes of the rows a query sorts or aggregates in memory before it writes them to temporary files, 0 keeps all the rows in memory")
+	tempDir := flags.String("temp-dir", "", "directory of the temporary files of the queries, empty means the system one")
+	minFreeDisk := flags.Int64("min-free-disk", 0, "free space in bytes of the file system of the database below which the changes are rejected and /healthz reports the degraded state, 0 disables the checks")
+	memoryLimit := flags.Int64("memory-limit", 0, "estimated size in bytes of the loaded tables, the cached results and the rows of the running queries, the queries spill their rows or are rejected over the limit, 0 means no limit")
+	encryptionKeys := flags.String("encryption-keys", "", "keys the files are encrypted with at rest: file:path with a key per line or id=base64 keys separated by commas, the last key is the current one, prefer the GOSQLDB_ENCRYPTION_KEYS environment variable, empty disables the encryption")
+	encryptPlaintext := flags.Bool("encrypt-plaintext", false, "encrypt the files that have not been encrypted yet on start to enable the encryption of an existing database, such files are rejected otherwise")
+	dictionaryMaxSize := flags.Int("dictionary-max-size", 0, "maximum number of distinct values of the dictionary-encoded string columns of new tables, 0 disables the encoding")
+	collation := flags.String("collation", engine.CollationBinary, "collation of the string columns of the new tables in WHERE and ORDER BY: binary, case_insensitive or a language tag like de")
+	storageModes := flags.String("storage-mode", "", "per-table storage mode overrides: table=auto|memory|disk, comma-separated")
+	lockTimeout := flags.Duration("lock-timeout", 5*time.Second, "how long a statement waits for the table locks held by others, 0 means no timeout")
+	statementTimeout := flags.Duration("statement-timeout", 0, "how long a statement can run before it is canceled, 0 means no timeout")
+	isolation := flags.String("isolation-level", string(engine.RepeatableRead), "default transaction isolation level: read committed, repeatable read or serializable")
+	transactionTimeout := flags.Duration("transaction-timeout", time.Minute, "how long a transaction can stay unused before it is rolled back, 0 means no timeout")
+	sessionTimeout := flags.Duration("session-timeout", 10*time.Minute, "how long a session can stay unused before it is closed, 0 means no timeout")
+	idempotencyWindow := flags.Duration("idempotency-window", 24*time.Hour, "how long the results of the statements sent with the Idempotency-Key header are returned to the retries, 0 disables the keys")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 30*time.Second, "how long the queries in progress are waited for on shutdown, 0 means no timeout")
+	rateLimit := flags.Float64("rate-limit", 0, "queries per second a client can execute, the clients are the users or the IP addresses, 0 means no limit")
+	rateBurst := flags.Int("rate-burst", 0, "queries a client can execute at once over -rate-limit, 0 means the rate rounded up")
+	maxConcurrentQueries := flags.Int("max-concurrent-queries", 0, "number of queries executed at once, the rest wait in the queue, 0 means no limit")
+	maxQueuedQueries := flags.Int("max-queued-queries", 100, "number of queries waiting for -max-concurrent-queries, the rest are rejected")
+	queueTimeout := flags.Duration("queue-timeout", 5*time.Second, "how long a query waits in the queue before it is rejected, 0 means no timeout")
+	migrationsDir := flags.String("migrations-dir", "", "directory of the <version>_<name>.sql schema migrations applied with POST /admin/migrations, empty disables the endpoint")
+	migrateOnStart := flags.Bool("migrate-on-start", false, "apply the pending migrations of -migrations-dir before serving the requests")
+	forceUnlock := flags.Bool("force-unlock", false, "break the lock of the db directory held by another process, use only if the process does not run")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() > 1 {
+		logging.Fatalf("expected a single argument with the path to the db directory, got %d", flags.NArg())
+	}
+
+	if flags.NArg() == 1 {
+		if err := flags.Set("data-dir", flags.Arg(0)); err != nil {
+			logging.Fatalf("invalid db directory path: %s", err)
+		}
+	}
+
+	err := loadConfig(flags, *configPath)
+	if err != nil {
+		logging.Fatalf("failed to load config: %s", err)
+	}
+
+	err = validateConfig(flags)
+	if err != nil {
+		logging.Fatalf("invalid config: %s", err)
+	}
+
+	if *dataDir == "" {
+		logging.Fatalf("path to the db directory is required")
+	}
+
+	if *listen == "" {
+		logging.Fatalf("listen address is required")
+	}
+
+	if *witnessURL != "" && (*nodeName == "" || *advertiseURL == "") {
+		logging.Fatalf("-witness requires -node-name and -advertise-url")
+	}
+
+	cluster := *clusterListen != ""
+	if cluster && (*archiveDir == "" || *replicationListen == "" || *nodeName == "" || *advertiseURL == "" ||
+		*clusterAdvertiseURL == "" || *replicationAdvertise == "") {
+		logging.Fatalf("-cluster-listen requires -archive-dir, -replication-listen, -node-name, -advertise-url, -cluster-advertise-url and -replication-advertise")
+	}
+
+	if cluster && (*witnessURL != "" || *replicateFrom != "") {
+		logging.Fatalf("-cluster-listen can not be combined with -witness and -replicate-from")
+	}
+
+	if *clusterReads != "leader" && *clusterReads != "follower" {
+		logging.Fatalf("-cluster-reads must be leader or follower")
+	}
+
+	if *witnessURL != "" && *leaseDuration <= 0 {
+		logging.Fatalf("-lease-duration must be positive")
+	}
+
+	if *migrateOnStart && *migrationsDir == "" {
+		logging.Fatalf("-migrate-on-start requires -migrations-dir")
+	}
+
+	if *migrateOnStart && (*replicateFrom != "" || cluster) {
+		logging.Fatalf("-migrate-on-start can not be combined with -replicate-from and -cluster-listen, the migrations are applied by the primary")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logging.Fatalf("both -tls-cert and -tls-key are required to enable TLS")
+	}
+
+	if *tlsClientCA != "" && *tlsCert == "" {
+		logging.Fatalf("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	logLevel, err := logging.ParseLevel(*logLevelName)
+	if err != nil {
+		logging.Fatalf("invalid log level: %s", err)
+	}
+	logging.SetLevel(logLevel)
+
+	logFormat, err := logging.ParseFormat(*logFormatName)
+	if err != nil {
+		logging.Fatalf("invalid log format: %s", err)
+	}
+	logging.SetFormat(logFormat)
+
+	if *otlpEndpoint != "" {
+		tracing.SetEndpoint(*otlpEndpoint)
+	}
+
+	fsyncPolicy, err := engine.ParseFsyncPolicy(*fsync)
+	if err != nil {
+		logging.Fatalf("invalid fsync policy: %s", err)
+	}
+
+	isolationLevel, err := engine.ParseIsolationLevel(*isolation)
+	if err != nil {
+		logging.Fatalf("invalid isolation level: %s", err)
+	}
+
+	modes, err := engine.ParseStorageModes(*storageModes)
+	if err != nil {
+		logging.Fatalf("invalid storage modes: %s", err)
+	}
+
+	if *printConfigOnly {
+		if err := printConfig(os.Stdout, flags); err != nil {
+			logging.Fatalf("failed to print config: %s", err)
+		}
+
+		return
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		var cipherSuites []string
+		if *tlsCipherSuites != "" {
+			cipherSuites = strings.Split(*tlsCipherSuites, ",")
+		}
+
+		tlsConfig, err = server.TLSConfig(server.TLSOptions{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			MinVersion:   *tlsMinVersion,
+			CipherSuites: cipherSuites,
+			ClientCAFile: *tlsClientCA,
+		})
+		if err != nil {
+			logging.Fatalf("invalid TLS configuration: %s", err)
+		}
+	}
+
+	dbDir := *dataDir
+	logging.Infof("db directory path: %s", dbDir)
+
+	dirLock, err := engine.LockDir(dbDir, *forceUnlock)
+	if err != nil {
+		logging.Fatalf("failed to lock db directory: %s", err)
+	}
+	logging.Infof("lock file %s locked", dirLock.Path())
+
+	replica := *replicateFrom != ""
+	if replica {
+		promoted, err := engine.ReplicaPromoted(dbDir)
+		if err != nil {
+			logging.Fatalf("failed to read replica state: %s", err)
+		}
+
+		if promoted {
+			logging.Warnf("the replica has been promoted to the primary, -replicate-from %s is ignored", *replicateFrom)
+			replica = false
+		}
+	}
+
+	replication := server.ReplicationOptions{Addr: *replicateFrom, User: *replicationUser, Password: *replicationPassword}
+	if replica {
+		if err := server.BootstrapReplica(context.Background(), dbDir, replication); err != nil {
+			logging.Fatalf("failed to bootstrap replica: %s", err)
+		}
+	}
+
+	db, err := engine.NewDatabase(dbDir, engine.Options{
+		Fsync:               fsyncPolicy,
+		FsyncInterval:       *fsyncInterval,
+		MmapThreshold:       *mmapThreshold,
+		SegmentRows:         *segmentRows,
+		StorageModes:        modes,
+		LockTimeout:         *lockTimeout,
+		StatementTimeout:    *statementTimeout,
+		SlowQueryThreshold:  *slowQueryThreshold,
+		Isolation:           isolationLevel,
+		TransactionTimeout:  *transactionTimeout,
+		SessionTimeout:      *sessionTimeout,
+		IdempotencyWindow:   *idempotencyWindow,
+		MaxRowSize:          *maxRowSize,
+		MaxValueSize:        *maxValueSize,
+		MaxTableRows:        *maxTableRows,
+		MaxDatabaseSize:     *maxDatabaseSize,
+		ScrubInterval:       *scrubInterval,
+		VacuumInterval:      *vacuumInterval,
+		HistoryRetention:    *historyRetention,
+		ChangefeedRetention: *changefeedRetention,
+		AuditLog:            *auditLog,
+		AuditMaxSize:        *auditMaxSize,
+		AuditMaxFiles:       *auditMaxFiles,
+		DictionaryMaxSize:   *dictionaryMaxSize,
+		Collation:           *collation,
+		StatementCacheSize:  *statementCacheSize,
+		ResultCacheSize:     *resultCacheSize,
+		ResultCacheTTL:      *resultCacheTTL,
+		WorkMem:             *workMem,
+		TempDir:             *tempDir,
+		MemoryLimit:         *memoryLimit,
+		MinFreeDisk:         *minFreeDisk,
+		Encryption:          keyProvider(*encryptionKeys),
+		EncryptPlaintext:    *encryptPlaintext,
+		ScanWorkers:         *scanWorkers,
+		GroupCommitSize:     *groupCommitSize,
+		GroupCommitWindow:   *groupCommitWindow,
+		ReadOnly:            *readOnly,
+		MigrationsDir:       *migrationsDir,
+		ArchiveDir:          *archiveDir,
+		Replica:             replica || cluster,
+		Failover:            *witnessURL != "",
+		LeaderReads:         cluster && *clusterReads == "leader",
+	})
+	if err != nil {
+		logging.Fatalf("failed to instantiate database: %s", err)
+	}
+
+	if *migrateOnStart {
+		applied, err := db.Migrate(context.Background(), *migrationsDir)
+		for _, m := range applied {
+			logging.Infof("applied migration %d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			logging.Fatalf("failed to migrate database: %s", err)
+		}
+	}
+
+	catalog, err := engine.OpenCatalog(db)
+	if err != nil {
+		logging.Fatalf("failed to open databases: %s", err)
+	}
+
+	admission := server.NewAdmission(server.AdmissionOptions{
+		Rate:          *rateLimit,
+		Burst:         *rateBurst,
+		MaxConcurrent: *maxConcurrentQueries,
+		MaxQueued:     *maxQueuedQueries,
+		QueueTimeout:  *queueTimeout,
+	})
+
+	var replicationServer *server.ReplicationServer
+	if *replicationListen != "" {
+		replicationServer, err = server.ListenReplication(db, *replicationListen)
+		if err != nil {
+			logging.Fatalf("failed to start replication listener: %s", err)
+		}
+		logging.Infof("listening replica connections at %s", *replicationListen)
+	}
+
+	replicationCtx, stopReplication := context.WithCancel(context.Background())
+	replicated := make(chan struct{})
+	if replica {
+		go func() {
+			server.Replicate(replicationCtx, db, replication)
+			close(replicated)
+		}()
+	} else {
+		close(replicated)
+	}
+
+	failoverCtx, stopFailover := context.WithCancel(context.Background())
+	failedOver := make(chan struct{})
+	if *witnessURL != "" {
+		go func() {
+			server.Failover(failoverCtx, db, server.FailoverOptions{
+				Witness:       *witnessURL,
+				Secret:        *witnessSecret,
+				Node:          *nodeName,
+				Address:       *advertiseURL,
+				LeaseDuration: *leaseDuration,
+			})
+			close(failedOver)
+		}()
+	} else {
+		close(failedOver)
+	}
+
+	clusterCtx, stopCluster := context.WithCancel(context.Background())
+	clustered := make(chan struct{})
+	var clusterServer *http.Server
+	if cluster {
+		node, err := server.NewCluster(db, server.ClusterOptions{
+			Node:        *nodeName,
+			Address:     *clusterAdvertiseURL,
+			HTTP:        *advertiseURL,
+			Replication: *replicationAdvertise,
+			Secret:      *clusterSecret,
+			Bootstrap:   *clusterBootstrap,
+			User:        *replicationUser,
+			Password:    *replicationPassword,
+			Replicas:    replicationServer,
+		})
+		if err != nil {
+			logging.Fatalf("failed to start cluster node: %s", err)
+		}
+
+		clusterServer = &http.Server{Addr: *clusterListen, Handler: node.Handler(), TLSConfig: tlsConfig}
+		go func() {
+			var err error
+			if clusterServer.TLSConfig != nil {
+				err = clusterServer.ListenAndServeTLS("", "")
+			} else {
+				err = clusterServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				logging.Fatalf("cluster listener failed: %s", err)
+			}
+		}()
+		logging.Infof("listening cluster requests at %s", *clusterListen)
+
+		go func() {
+			if *clusterJoin != "" {
+				node.Join(clusterCtx, *clusterJoin)
+			}
+			node.Run(clusterCtx)
+			close(clustered)
+		}()
+	} else {
+		close(clustered)
+	}
+
+	var pg *server.PostgresServer
+	if *pgListen != "" {
+		pg, err = server.ListenPostgres(db, *pgListen, admission)
+		if err != nil {
+			logging.Fatalf("failed to start PostgreSQL listener: %s", err)
+		}
+		logging.Infof("listening PostgreSQL connections at %s", *pgListen)
+	}
+
+	var grpcServer *grpc.Server
+	if *grpcListen != "" {
+		grpcServer, err = server.ListenGRPC(db, *grpcListen, admission)
+		if err != nil {
+			logging.Fatalf("failed to start gRPC server: %s", err)
+		}
+		logging.Infof("listening gRPC requests at %s", *grpcListen)
+	}
+
+	httpServer := &http.Server{Addr: *listen, Handler: server.Handler(db, admission), TLSConfig: tlsConfig}
+	// the change streams do not end by themselves
+	httpServer.RegisterOnShutdown(db.CloseChangeStreams)
+	drained := make(chan bool, 1)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		logging.Infof("received %s, shutting down", sig)
+		// the next signal kills the process
+		signal.Stop(c)
+
+		ctx := context.Background()
+		if *shutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *shutdownTimeout)
+			defer cancel()
+		}
+
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			logging.Errorf("failed to wait for the queries in progress: %s", err)
+		}
+		if grpcServer != nil {
+			server.StopGRPC(ctx, grpcServer)
+		}
+		if pg != nil {
+			if err := pg.Close(); err != nil {
+				logging.Errorf("failed to close PostgreSQL listener: %s", err)
+			}
+		}
+		if clusterServer != nil {
+			if err := clusterServer.Shutdown(ctx); err != nil {
+				logging.Errorf("failed to close cluster listener: %s", err)
+			}
+		}
+		if replicationServer != nil {
+			if err := replicationServer.Close(); err != nil {
+				logging.Errorf("failed to close replication listener: %s", err)
+			}
+		}
+		if err := tracing.Flush(ctx); err != nil {
+			logging.Errorf("%s", err)
+		}
+		drained <- err == nil
+	}()
+
+	if httpServer.TLSConfig != nil {
+		logging.Infof("listening incoming TLS requests at %s", *listen)
+		// the certificates are already loaded into the config
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		logging.Infof("listening incoming requests at %s", *listen)
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logging.Fatalf("server failed: %s", err)
+	}
+
+	exitCode := 0
+	if !<-drained {
+		exitCode = 1
+	}
+
+	stopCluster()
+	<-clustered
+	stopFailover()
+	<-failedOver
+	stopReplication()
+	<-replicated
+
+	if err := catalog.Close(); err != nil {
+		logging.Errorf("failed to close databases: %s", err)
+		exitCode = 1
+	}
+	if err := db.Close(); err != nil {
+		logging.Errorf("failed to close database: %s", err)
+		exitCode = 1
+	}
+	releaseDirLock(dirLock)
+	logging.Infof("database is closed")
+
+	os.Exit(exitCode)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// migrateCommand is the name of the command that applies
+// the schema migrations to the stopped database.
+const migrateCommand = "migrate"
+
+// migrate applies the pending migrations of the directory or, with
+// -status, lists the migrations with their state:
+//
+//	gosqldb migrate -dir migrations [-status] <db directory>
+func migrate(args []string) {
+	flags := flag.NewFlagSet(migrateCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s -dir <migrations directory> [flags] <db directory>\n", os.Args[0], migrateCommand)
+		flags.PrintDefaults()
+	}
+	dir := flags.String("dir", os.Getenv(configEnvName("migrations-dir")), "directory of the <version>_<name>.sql migration files")
+	status := flags.Bool("status", false, "list the migrations with their state instead of applying them")
+	archiveDir := flags.String("archive-dir", "", "archive of the database, the applied changes are archived if the database is archived")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 1 || *dir == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, dirLock := openOffline(flags.Arg(0), *archiveDir)
+	if *status {
+		migrations, err := db.Migrations(context.Background(), *dir)
+		closeOffline(db, dirLock)
+		if err != nil {
+			logging.Fatalf("failed to read migrations: %s", err)
+		}
+
+		for _, m := range migrations {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			switch {
+			case m.Missing:
+				state += ", the file is missing"
+			case m.Changed:
+				state += ", the file is changed"
+			}
+			fmt.Printf("%d_%s: %s\n", m.Version, m.Name, state)
+		}
+
+		return
+	}
+
+	applied, err := db.Migrate(context.Background(), *dir)
+	closeOffline(db, dirLock)
+	for _, m := range applied {
+		logging.Infof("applied migration %d_%s", m.Version, m.Name)
+	}
+	if err != nil {
+		logging.Fatalf("failed to migrate database: %s", err)
+	}
+
+	logging.Infof("applied %d migrations", len(applied))
+}
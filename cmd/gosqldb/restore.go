@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// restoreCommand is the name of the command that restores
+// the database from a backup instead of serving it.
+const restoreCommand = "restore"
+
+// restore restores the backup into the db directory:
+//
+//	gosqldb restore [-archive-dir dir] [-until-time time | -until-sequence n] <backup> <db directory>
+func restore(args []string) {
+	flags := flag.NewFlagSet(restoreCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <backup directory> <db directory>\n", os.Args[0], restoreCommand)
+		flags.PrintDefaults()
+	}
+	archiveDir := flags.String("archive-dir", "", "archive of the database, the changes archived after the backup are applied")
+	untilTime := flags.String("until-time", "", "last moment to restore in RFC 3339 format, empty means the end of the archive")
+	untilSequence := flags.Uint64("until-sequence", 0, "last archive record to restore, 0 means the end of the archive")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	options := engine.RestoreOptions{ArchiveDir: *archiveDir, UntilSequence: *untilSequence}
+	if *untilTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, *untilTime)
+		if err != nil {
+			logging.Fatalf("invalid -until-time: %s", err)
+		}
+		options.UntilTime = t
+	}
+
+	result, err := engine.Restore(flags.Arg(0), flags.Arg(1), options)
+	if err != nil {
+		logging.Fatalf("failed to restore: %s", err)
+	}
+
+	logging.Infof("%s", result)
+}
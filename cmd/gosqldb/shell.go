@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+	"golang.org/x/term"
+)
+
+// shellCommand is the name of the command that runs the interactive
+// client of the server or of the stopped database.
+const shellCommand = "shell"
+
+// the prompts of the first and of the continuation lines of the statement
+const (
+	shellPrompt             = "gosqldb> "
+	shellContinuationPrompt = "gosqldb-> "
+)
+
+const shellHelp = `Statements end with ; and may span several lines.
+  \d          list tables
+  \d <table>  describe table
+  \?          show this help
+  \q          quit
+`
+
+// shellResult is the result of the statement executed by the shell.
+type shellResult struct {
+	columns []string
+	rows    [][]interface{}
+	// message describes the result of the statement without rows.
+	message string
+}
+
+// shellColumn describes the column of the table.
+type shellColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// shellBackend executes the statements of the shell.
+type shellBackend interface {
+	execute(query string) (shellResult, error)
+	tables() ([]string, error)
+	columns(table string) ([]shellColumn, error)
+	close()
+}
+
+// shell runs the statements typed in the terminal or read from
+// the standard input:
+//
+//	gosqldb shell [-user name -password password] <address|db directory>
+func shell(args []string) {
+	flags := flag.NewFlagSet(shellCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <server address|db directory>\n", os.Args[0], shellCommand)
+		flags.PrintDefaults()
+	}
+	user := flags.String("user", "", "user of the server, empty if the server does not require the authentication")
+	password := flags.String("password", os.Getenv(configEnvName("password")), "password or token of the user")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// the shell output is not mixed with the database messages
+	logging.SetLevel(logging.Warn)
+
+	backend, err := openShellBackend(flags.Arg(0), *user, *password)
+	if err != nil {
+		logging.Fatalf("failed to open %s: %s", flags.Arg(0), err)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		err = runShellScript(backend, os.Stdin, os.Stdout)
+		backend.close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		logging.Fatalf("failed to set up terminal: %s", err)
+	}
+	runShell(backend, term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, shellPrompt))
+	if err := term.Restore(fd, state); err != nil {
+		logging.Errorf("failed to restore terminal: %s", err)
+	}
+	backend.close()
+}
+
+// openShellBackend opens the db directory if it exists,
+// otherwise the target is the address of the server.
+func openShellBackend(target string, user string, password string) (shellBackend, error) {
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		db, dirLock := openOffline(target, "")
+		session, err := db.OpenSession()
+		if err != nil {
+			closeOffline(db, dirLock)
+			return nil, err
+		}
+
+		return &localBackend{db, dirLock, session}, nil
+	}
+
+	address, err := serverAddress(target)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &remoteBackend{address: address, user: user, password: password}
+	if err := backend.openSession(); err != nil {
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+// serverAddress returns the URL of the server address
+// that is not a db directory.
+func serverAddress(target string) (string, error) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		if !strings.Contains(target, ":") {
+			return "", fmt.Errorf("%s is neither a db directory nor a server address", target)
+		}
+		target = "http://" + target
+	}
+
+	return strings.TrimSuffix(target, "/"), nil
+}
+
+// runShell reads the statements from the terminal until \q or Ctrl-D.
+func runShell(backend shellBackend, t *term.Terminal) {
+	fmt.Fprintf(t, "Type \\? for help.\n")
+
+	var buffer strings.Builder
+	for {
+		line, err := t.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(t, err)
+			}
+			return
+		}
+
+		if buffer.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+			if quit := shellMetaCommand(backend, t, strings.TrimSpace(line)); quit {
+				return
+			}
+			continue
+		}
+
+		buffer.WriteString(line)
+		buffer.WriteString("\n")
+		statements, rest := engine.SplitStatements(buffer.String())
+		for _, statement := range statements {
+			if err := executeShellStatement(backend, t, statement); err != nil {
+				fmt.Fprintf(t, "ERROR: %s\n", err)
+			}
+		}
+
+		buffer.Reset()
+		if strings.TrimSpace(rest) != "" {
+			buffer.WriteString(rest)
+		}
+
+		if buffer.Len() > 0 {
+			t.SetPrompt(shellContinuationPrompt)
+		} else {
+			t.SetPrompt(shellPrompt)
+		}
+	}
+}
+
+// runShellScript executes the statements read from r and stops at the
+// first failed one, the last statement may go without the semicolon.
+func runShellScript(backend shellBackend, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var buffer strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if buffer.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+			if quit := shellMetaCommand(backend, w, strings.TrimSpace(line)); quit {
+				return nil
+			}
+			continue
+		}
+
+		buffer.WriteString(line)
+		buffer.WriteString("\n")
+		statements, rest := engine.SplitStatements(buffer.String())
+		for _, statement := range statements {
+			if err := executeShellStatement(backend, w, statement); err != nil {
+				return fmt.Errorf("ERROR: %s", err)
+			}
+		}
+		buffer.Reset()
+		if strings.TrimSpace(rest) != "" {
+			buffer.WriteString(rest)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read statements: %w", err)
+	}
+
+	if statement := strings.TrimSpace(buffer.String()); statement != "" {
+		if err := executeShellStatement(backend, w, statement); err != nil {
+			return fmt.Errorf("ERROR: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// executeShellStatement executes the statement and prints its result.
+func executeShellStatement(backend shellBackend, w io.Writer, statement string) error {
+	result, err := backend.execute(statement)
+	if err != nil {
+		return err
+	}
+
+	if result.columns == nil {
+		fmt.Fprintln(w, result.message)
+		return nil
+	}
+
+	printShellTable(w, result.columns, result.rows)
+	fmt.Fprintf(w, "(%s)\n\n", rowCount(len(result.rows)))
+
+	return nil
+}
+
+// shellMetaCommand executes the backslash command,
+// it reports whether the shell quits.
+func shellMetaCommand(backend shellBackend, w io.Writer, command string) bool {
+	fields := strings.Fields(command)
+	switch {
+	case fields[0] == `\q`:
+		return true
+	case fields[0] == `\?`:
+		fmt.Fprint(w, shellHelp)
+	case (fields[0] == `\d` || fields[0] == `\dt`) && len(fields) == 1:
+		tables, err := backend.tables()
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %s\n", err)
+			return false
+		}
+
+		rows := make([][]interface{}, len(tables))
+		for i, table := range tables {
+			rows[i] = []interface{}{table}
+		}
+		printShellTable(w, []string{"table"}, rows)
+	case fields[0] == `\d` && len(fields) == 2:
+		columns, err := backend.columns(fields[1])
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %s\n", err)
+			return false
+		}
+
+		rows := make([][]interface{}, len(columns))
+		for i, column := range columns {
+			rows[i] = []interface{}{column.Name, column.Type}
+		}
+		printShellTable(w, []string{"column", "type"}, rows)
+	default:
+		fmt.Fprintf(w, "invalid command %s, try \\?\n", command)
+	}
+
+	return false
+}
+
+// printShellTable prints the rows aligned by the columns.
+func printShellTable(w io.Writer, columns []string, rows [][]interface{}) {
+	cells := make([][]string, len(rows))
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		widths[i] = utf8.RuneCountInString(column)
+	}
+
+	for i, row := range rows {
+		cells[i] = make([]string, len(columns))
+		for j := range columns {
+			if j < len(row) {
+				cells[i][j] = fmt.Sprint(row[j])
+			}
+			if width := utf8.RuneCountInString(cells[i][j]); width > widths[j] {
+				widths[j] = width
+			}
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	for i, column := range columns {
+		if i > 0 {
+			b.WriteString(" | ")
+		}
+		b.WriteString(column)
+		if i < len(columns)-1 {
+			b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(column)))
+		}
+	}
+	b.WriteString("\n")
+
+	for i, width := range widths {
+		if i > 0 {
+			b.WriteString("-+-")
+		}
+		b.WriteString(strings.Repeat("-", width))
+	}
+	b.WriteString("\n")
+
+	for i, row := range cells {
+		for j, cell := range row {
+			if j > 0 {
+				b.WriteString(" | ")
+			}
+
+			padding := strings.Repeat(" ", widths[j]-utf8.RuneCountInString(cell))
+			if j < len(rows[i]) && numeric(rows[i][j]) {
+				b.WriteString(padding + cell)
+			} else if j < len(row)-1 {
+				b.WriteString(cell + padding)
+			} else {
+				b.WriteString(cell)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	if err := b.Flush(); err != nil {
+		logging.Errorf("failed to print rows: %s", err)
+	}
+}
+
+// rowCount describes the number of the rows.
+func rowCount(n int) string {
+	if n == 1 {
+		return "1 row"
+	}
+
+	return fmt.Sprintf("%d rows", n)
+}
+
+// numeric reports whether the value is a number, the numbers are
+// aligned to the right.
+func numeric(value interface{}) bool {
+	switch value.(type) {
+	case int, json.Number:
+		return true
+	default:
+		return false
+	}
+}
+
+// localBackend executes the statements in the stopped database.
+type localBackend struct {
+	db      *engine.Database
+	dirLock *engine.DirLock
+	session *engine.Session
+}
+
+func (b *localBackend) execute(query string) (shellResult, error) {
+	statement, err := engine.Parse(query)
+	if err != nil {
+		return shellResult{}, err
+	}
+
+	result, err := b.session.ExecuteContext(context.Background(), b.session.Transaction(), statement)
+	if err != nil {
+		return shellResult{}, err
+	}
+
+	switch q := statement.(type) {
+	case *sql.Select:
+		columns, err := b.db.Columns(q.Table)
+		if err != nil {
+			return shellResult{}, err
+		}
+
+		names := make([]string, len(columns))
+		for i, column := range columns {
+			names[i] = column.Name
+		}
+
+		return shellResult{columns: names, rows: result.([][]interface{})}, nil
+	}
+
+	switch r := result.(type) {
+	case nil:
+		return shellResult{message: "OK"}, nil
+	case int:
+		return shellResult{message: rowCount(r) + " affected"}, nil
+	default:
+		return shellResult{message: strings.TrimSuffix(fmt.Sprint(r), "\n")}, nil
+	}
+}
+
+func (b *localBackend) tables() ([]string, error) {
+	return b.db.TableNames(), nil
+}
+
+func (b *localBackend) columns(table string) ([]shellColumn, error) {
+	columns, err := b.db.Columns(table)
+	if err != nil {
+		return nil, err
+	}
+
+	described := make([]shellColumn, len(columns))
+	for i, column := range columns {
+		described[i] = shellColumn{Name: column.Name, Type: "string"}
+		if column.Type == sql.TypeInteger {
+			described[i].Type = "integer"
+		}
+	}
+
+	return described, nil
+}
+
+func (b *localBackend) close() {
+	if err := b.db.CloseSession(b.session.ID); err != nil {
+		logging.Errorf("failed to close session: %s", err)
+	}
+	closeOffline(b.db, b.dirLock)
+}
+
+// remoteBackend executes the statements on the server within
+// the session, so the transactions span the statements.
+type remoteBackend struct {
+	address  string
+	user     string
+	password string
+	session  string
+}
+
+func (b *remoteBackend) request(method string, path string, body string) (*http.Response, error) {
+	request, err := http.NewRequest(method, b.address+path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("X-API-Version", "3")
+	if b.session != "" {
+		request.Header.Set("X-Session-ID", b.session)
+	}
+	if b.user != "" || b.password != "" {
+		request.SetBasicAuth(b.user, b.password)
+	}
+
+	return http.DefaultClient.Do(request)
+}
+
+// decode decodes the JSON response or returns its error.
+func (b *remoteBackend) decode(response *http.Response, v interface{}) error {
+	defer response.Body.Close()
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var failed struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		if json.Unmarshal(content, &failed) != nil || len(failed.Error) == 0 {
+			return errors.New(strings.TrimSpace(string(content)))
+		}
+
+		var detail struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(failed.Error, &detail) == nil && detail.Message != "" {
+			return errors.New(detail.Message)
+		}
+
+		var message string
+		if json.Unmarshal(failed.Error, &message) == nil {
+			return errors.New(message)
+		}
+
+		return errors.New(string(failed.Error))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+func (b *remoteBackend) openSession() error {
+	response, err := b.request(http.MethodPost, "/session", "")
+	if err != nil {
+		return err
+	}
+
+	var session struct {
+		ID string `json:"id"`
+	}
+	if err := b.decode(response, &session); err != nil {
+		return err
+	}
+	b.session = session.ID
+
+	return nil
+}
+
+func (b *remoteBackend) execute(query string) (shellResult, error) {
+	response, err := b.request(http.MethodPost, "/", query)
+	if err != nil {
+		return shellResult{}, err
+	}
+
+	var result struct {
+		Columns      []shellColumn   `json:"columns"`
+		Rows         [][]interface{} `json:"rows"`
+		AffectedRows *int            `json:"affected_rows"`
+		Result       interface{}     `json:"result"`
+	}
+	if err := b.decode(response, &result); err != nil {
+		return shellResult{}, err
+	}
+
+	switch {
+	case result.Columns != nil:
+		names := make([]string, len(result.Columns))
+		for i, column := range result.Columns {
+			names[i] = column.Name
+		}
+
+		return shellResult{columns: names, rows: result.Rows}, nil
+	case result.AffectedRows != nil:
+		return shellResult{message: rowCount(*result.AffectedRows) + " affected"}, nil
+	case result.Result == nil:
+		return shellResult{message: "OK"}, nil
+	default:
+		return shellResult{message: strings.TrimSuffix(fmt.Sprint(result.Result), "\n")}, nil
+	}
+}
+
+func (b *remoteBackend) tables() ([]string, error) {
+	response, err := b.request(http.MethodGet, "/tables", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var tables struct {
+		Tables []string `json:"tables"`
+	}
+	if err := b.decode(response, &tables); err != nil {
+		return nil, err
+	}
+
+	return tables.Tables, nil
+}
+
+func (b *remoteBackend) columns(table string) ([]shellColumn, error) {
+	response, err := b.request(http.MethodGet, "/tables/"+url.PathEscape(table)+"/schema", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var schema struct {
+		Columns []shellColumn `json:"columns"`
+	}
+	if err := b.decode(response, &schema); err != nil {
+		return nil, err
+	}
+
+	return schema.Columns, nil
+}
+
+func (b *remoteBackend) close() {
+	response, err := b.request(http.MethodDelete, "/session", "")
+	if err != nil {
+		logging.Errorf("failed to close session: %s", err)
+		return
+	}
+	response.Body.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	"github.com/krasun/gosqldb/server"
+)
+
+// witnessCommand is the name of the command that runs the witness
+// granting the leader lease to the nodes of the failover pair.
+const witnessCommand = "witness"
+
+// witness serves the leader lease, the lease is stored in the directory:
+//
+//	gosqldb witness [-listen addr] [-secret secret] <directory>
+func witness(args []string) {
+	flags := flag.NewFlagSet(witnessCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <directory>\n", os.Args[0], witnessCommand)
+		flags.PrintDefaults()
+	}
+	listen := flags.String("listen", ":8090", "address the witness listens on")
+	secret := flags.String("secret", os.Getenv(configEnvName("witness-secret")), "secret the nodes send as the Bearer token, prefer the GOSQLDB_WITNESS_SECRET environment variable")
+	if err := flags.Parse(args); err != nil {
+		logging.Fatalf("invalid arguments: %s", err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := os.MkdirAll(flags.Arg(0), 0700); err != nil {
+		logging.Fatalf("failed to create witness directory: %s", err)
+	}
+
+	w, err := server.NewWitness(flags.Arg(0), *secret)
+	if err != nil {
+		logging.Fatalf("failed to open witness: %s", err)
+	}
+
+	httpServer := &http.Server{Addr: *listen, Handler: w.Handler()}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		logging.Infof("received %s, shutting down", sig)
+		if err := httpServer.Shutdown(context.Background()); err != nil {
+			logging.Errorf("failed to shut down witness: %s", err)
+		}
+	}()
+
+	logging.Infof("witness is listening lease requests at %s", *listen)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		logging.Fatalf("witness failed: %s", err)
+	}
+}
@@ -0,0 +1,412 @@
+// Package driver is the database/sql driver of gosqldb, it connects
+// to the server through the HTTP API:
+//
+//	import _ "github.com/krasun/gosqldb/driver"
+//
+//	db, err := sql.Open("gosqldb", "http://localhost:8080")
+//
+// Every connection is a server session, so the transactions and the
+// prepared statements live as long as the connection. The parameters
+// are passed with the $1, $2, ... placeholders and can be integers or
+// strings.
+package driver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Headers of the HTTP API.
+const (
+	apiVersionHeader = "X-API-Version"
+	sessionHeader    = "X-Session-ID"
+)
+
+// apiVersion is the structured JSON format of the results.
+const apiVersion = "3"
+
+func init() {
+	sql.Register("gosqldb", &Driver{})
+}
+
+// Driver opens the connections to the server. The zero value
+// uses http.DefaultClient.
+type Driver struct {
+	Client *http.Client
+}
+
+// Error is the error returned by the server, the code is
+// the stable code of the error kind, for example syntax_error.
+type Error struct {
+	Code string `json:"code"`
+	// Category and SQLState classify the query errors,
+	// for example syntax and 42601.
+	Category string `json:"category,omitempty"`
+	SQLState string `json:"sqlstate,omitempty"`
+	Message  string `json:"message"`
+	// Position is the byte offset in the query of the syntax error.
+	Position *int `json:"position,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Open opens the connection to the server by its URL.
+func (d *Driver) Open(dsn string) (sqldriver.Conn, error) {
+	return d.open(context.Background(), dsn)
+}
+
+func (d *Driver) open(ctx context.Context, dsn string) (*conn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data source name: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported data source name %s, expected the server URL", dsn)
+	}
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	c := &conn{url: strings.TrimSuffix(u.String(), "/"), client: client}
+	var session struct {
+		ID string `json:"id"`
+	}
+	err = c.call(ctx, http.MethodPost, "/session", nil, &session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session: %w", err)
+	}
+	c.session = session.ID
+
+	return c, nil
+}
+
+// conn is the server session.
+type conn struct {
+	url     string
+	client  *http.Client
+	session string
+}
+
+// Prepare registers the prepared statement in the session.
+func (c *conn) Prepare(query string) (sqldriver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext registers the prepared statement in the session.
+func (c *conn) PrepareContext(ctx context.Context, query string) (sqldriver.Stmt, error) {
+	var prepared struct {
+		ID     string `json:"id"`
+		Params int    `json:"params"`
+	}
+	err := c.call(ctx, http.MethodPost, "/prepare", strings.NewReader(query), &prepared)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stmt{c, prepared.ID, prepared.Params}, nil
+}
+
+// Close closes the session, its transaction is rolled back.
+func (c *conn) Close() error {
+	return c.call(context.Background(), http.MethodDelete, "/session", nil, nil)
+}
+
+// Begin starts the transaction of the session.
+func (c *conn) Begin() (sqldriver.Tx, error) {
+	return c.BeginTx(context.Background(), sqldriver.TxOptions{})
+}
+
+// BeginTx starts the transaction of the session, the read-only
+// transactions are not supported.
+func (c *conn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
+	if opts.ReadOnly {
+		return nil, errors.New("read-only transactions are not supported")
+	}
+
+	begin := "BEGIN"
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault:
+	case sql.LevelReadCommitted:
+		begin += " ISOLATION LEVEL READ COMMITTED"
+	case sql.LevelRepeatableRead, sql.LevelSnapshot:
+		begin += " ISOLATION LEVEL REPEATABLE READ"
+	case sql.LevelSerializable:
+		begin += " ISOLATION LEVEL SERIALIZABLE"
+	default:
+		return nil, fmt.Errorf("isolation level %s is not supported", sql.IsolationLevel(opts.Isolation))
+	}
+
+	if _, err := c.query(ctx, begin); err != nil {
+		return nil, err
+	}
+
+	return &tx{c}, nil
+}
+
+// ExecContext executes the query, the arguments are bound
+// to the placeholders by the server.
+func (c *conn) ExecContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	r, err := c.queryArgs(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return result(r.AffectedRows), nil
+}
+
+// QueryContext executes the query, the arguments are bound
+// to the placeholders by the server.
+func (c *conn) QueryContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	r, err := c.queryArgs(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRows(r)
+}
+
+func (c *conn) queryArgs(ctx context.Context, query string, args []sqldriver.NamedValue) (*response, error) {
+	if len(args) == 0 {
+		return c.query(ctx, query)
+	}
+
+	params, err := parameters(args)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(struct {
+		SQL    string        `json:"sql"`
+		Params []interface{} `json:"params"`
+	}{query, params})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode parameters: %w", err)
+	}
+
+	r := &response{}
+	err = c.callContent(ctx, http.MethodPost, "/", "application/json", bytes.NewReader(body), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// query executes the query and decodes the response.
+func (c *conn) query(ctx context.Context, query string) (*response, error) {
+	r := &response{}
+	err := c.call(ctx, http.MethodPost, "/", strings.NewReader(query), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// call sends the request within the session and decodes the JSON
+// response into v if it is not nil.
+func (c *conn) call(ctx context.Context, method, path string, body io.Reader, v interface{}) error {
+	return c.callContent(ctx, method, path, "", body, v)
+}
+
+// callContent sends the request body of the content type,
+// the empty one is not set.
+func (c *conn) callContent(ctx context.Context, method, path, contentType string, body io.Reader, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, method, c.url+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(apiVersionHeader, apiVersion)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if c.session != "" {
+		request.Header.Set(sessionHeader, c.session)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		var e struct {
+			Error *Error `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != nil {
+			return e.Error
+		}
+
+		code := strings.ToLower(strings.ReplaceAll(http.StatusText(response.StatusCode), " ", "_"))
+		return &Error{Code: code, Message: strings.TrimSpace(string(data))}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+// response is the result of the query in the API version 3 format.
+type response struct {
+	Columns      []column        `json:"columns"`
+	Rows         [][]interface{} `json:"rows"`
+	AffectedRows int64           `json:"affected_rows"`
+	Result       interface{}     `json:"result"`
+}
+
+type column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// stmt is the prepared statement registered in the session.
+type stmt struct {
+	c      *conn
+	id     string
+	params int
+}
+
+// Close removes the prepared statement from the session.
+func (s *stmt) Close() error {
+	return s.c.call(context.Background(), http.MethodDelete, "/prepare?id="+url.QueryEscape(s.id), nil, nil)
+}
+
+// NumInput returns the number of the placeholders.
+func (s *stmt) NumInput() int {
+	return s.params
+}
+
+// Exec executes the statement with the arguments.
+func (s *stmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+// ExecContext executes the statement with the arguments.
+func (s *stmt) ExecContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	r, err := s.execute(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return result(r.AffectedRows), nil
+}
+
+// Query executes the statement with the arguments.
+func (s *stmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+// QueryContext executes the statement with the arguments.
+func (s *stmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	r, err := s.execute(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRows(r)
+}
+
+func (s *stmt) execute(ctx context.Context, args []sqldriver.NamedValue) (*response, error) {
+	params, err := parameters(args)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(struct {
+		ID     string        `json:"id"`
+		Params []interface{} `json:"params"`
+	}{s.id, params})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode parameters: %w", err)
+	}
+
+	r := &response{}
+	err = s.c.call(ctx, http.MethodPost, "/execute", bytes.NewReader(body), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// parameters returns the values of the positional arguments.
+func parameters(args []sqldriver.NamedValue) ([]interface{}, error) {
+	params := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("named parameter %s is not supported, use $%d", arg.Name, arg.Ordinal)
+		}
+		params[i] = arg.Value
+	}
+
+	return params, nil
+}
+
+func namedValues(args []sqldriver.Value) []sqldriver.NamedValue {
+	named := make([]sqldriver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = sqldriver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+
+	return named
+}
+
+// tx is the transaction of the session.
+type tx struct {
+	c *conn
+}
+
+// Commit commits the transaction of the session.
+func (t *tx) Commit() error {
+	_, err := t.c.query(context.Background(), "COMMIT")
+	return err
+}
+
+// Rollback rolls back the transaction of the session.
+func (t *tx) Rollback() error {
+	_, err := t.c.query(context.Background(), "ROLLBACK")
+	return err
+}
+
+// result is the number of the affected rows, the database
+// has no generated identifiers.
+type result int64
+
+// LastInsertId is not supported.
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported")
+}
+
+// RowsAffected returns the number of the affected rows.
+func (r result) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// resultColumn is the column of the statements that
+// return a text result instead of rows, such as EXPLAIN.
+const resultColumn = "result"
+
+// rows are the rows of the response, they are
+// converted by the column types.
+type rows struct {
+	columns []column
+	rows    [][]interface{}
+	next    int
+}
+
+func newRows(r *response) (*rows, error) {
+	if r.Columns == nil {
+		if r.Result == nil {
+			return &rows{columns: []column{}}, nil
+		}
+
+		return &rows{columns: []column{{resultColumn, "string"}}, rows: [][]interface{}{{fmt.Sprint(r.Result)}}}, nil
+	}
+
+	for _, row := range r.Rows {
+		if len(row) != len(r.Columns) {
+			return nil, fmt.Errorf("expected %d values in row, got %d", len(r.Columns), len(row))
+		}
+
+		for i, value := range row {
+			n, ok := value.(json.Number)
+			if !ok {
+				continue
+			}
+
+			integer, err := n.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer of column %s: %w", r.Columns[i].Name, err)
+			}
+			row[i] = integer
+		}
+	}
+
+	return &rows{columns: r.Columns, rows: r.Rows}, nil
+}
+
+// Columns returns the column names.
+func (r *rows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for i, c := range r.columns {
+		names[i] = c.Name
+	}
+
+	return names
+}
+
+// Close releases the rows, they are already read.
+func (r *rows) Close() error {
+	r.rows = nil
+	return nil
+}
+
+// Next copies the next row to dest.
+func (r *rows) Next(dest []sqldriver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+
+	for i, value := range r.rows[r.next] {
+		dest[i] = value
+	}
+	r.next++
+
+	return nil
+}
+
+// ColumnTypeDatabaseTypeName returns the type of the column
+// as in CREATE TABLE.
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	return strings.ToUpper(r.columns[index].Type)
+}
+
+// ColumnTypeScanType returns the Go type of the column values.
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	if r.columns[index].Type == "integer" {
+		return reflect.TypeOf(int64(0))
+	}
+
+	return reflect.TypeOf("")
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"sync"
+)
+
+// The sorts and the aggregations account the memory of the rows they
+// hold with the memory accountant of the database. Every query has the
+// budget of the work memory, the operator that would exceed it writes
+// the rows to temporary files and releases their memory instead.
+//
+// The accountant also tracks the loaded tables and the result cache
+// against the memory limit of the database. The operators spill when
+// the limit would be exceeded even within their budget, the result
+// cache evicts the entries and the queries that can not spill anymore
+// are rejected with the limit error.
+
+// memoryAccountant tracks the memory held by the running queries.
+type memoryAccountant struct {
+	mu sync.Mutex
+	// limit is zero if the memory is not limited
+	limit int64
+	// tables is the memory of the loaded tables
+	tables int64
+	// caches is the memory of the cached results
+	caches int64
+	inUse  int64
+	peak   int64
+}
+
+// queryMemory is the memory of the query within its budget,
+// it is used by a single goroutine.
+type queryMemory struct {
+	accountant *memoryAccountant
+	// budget is zero for the queries without a limit
+	budget int64
+	used   int64
+}
+
+// query starts accounting the memory of the query with the budget,
+// zero budget means no limit.
+func (a *memoryAccountant) query(budget int64) *queryMemory {
+	return &queryMemory{accountant: a, budget: budget}
+}
+
+// total returns the accounted memory, it must be called
+// with the accountant locked.
+func (a *memoryAccountant) total() int64 {
+	return a.tables + a.caches + a.inUse
+}
+
+// reserve accounts the query bytes, it returns false without
+// accounting them if they exceed the memory limit.
+func (a *memoryAccountant) reserve(n int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.limit > 0 && a.total()+n > a.limit {
+		return false
+	}
+	a.add(n)
+
+	return true
+}
+
+// add accounts the query bytes regardless of the limit,
+// it must be called with the accountant locked.
+func (a *memoryAccountant) add(n int64) {
+	a.inUse += n
+	if a.inUse > a.peak {
+		a.peak = a.inUse
+	}
+}
+
+// grow accounts the query bytes that can not be spilled,
+// the error is returned if they exceed the memory limit.
+func (a *memoryAccountant) grow(n int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.limit > 0 && a.total()+n > a.limit {
+		return newError(CodeLimit, "memory limit exceeded: the query needs %d more bytes, %d of %d bytes are in use", n, a.total(), a.limit)
+	}
+	a.add(n)
+
+	return nil
+}
+
+// force accounts the query bytes over the limit.
+func (a *memoryAccountant) force(n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.add(n)
+}
+
+// release returns the query bytes.
+func (a *memoryAccountant) release(n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inUse -= n
+}
+
+// setTables accounts the memory of the loaded tables.
+func (a *memoryAccountant) setTables(n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tables = n
+}
+
+// addCache accounts the memory of the cached results and reports
+// whether the accounted memory is within the limit.
+func (a *memoryAccountant) addCache(n int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.caches += n
+
+	return a.limit <= 0 || a.total() <= a.limit
+}
+
+// usage sets the accounted memory in the stats.
+func (a *memoryAccountant) usage(stats *MemoryStats) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats.LimitBytes, stats.AccountedBytes = a.limit, a.total()
+	stats.CacheBytes, stats.QueryBytes, stats.QueryPeakBytes = a.caches, a.inUse, a.peak
+}
+
+// reserve accounts the bytes, it returns false without accounting
+// them if they exceed the budget of the query or the memory limit.
+func (m *queryMemory) reserve(n int64) bool {
+	if m.budget > 0 && m.used+n > m.budget {
+		return false
+	}
+
+	if !m.accountant.reserve(n) {
+		return false
+	}
+	m.used += n
+
+	return true
+}
+
+// grow accounts the bytes over the budget, it is used by the
+// operators that can not spill the rows. The error is returned
+// if the bytes exceed the memory limit.
+func (m *queryMemory) grow(n int64) error {
+	if err := m.accountant.grow(n); err != nil {
+		return err
+	}
+	m.used += n
+
+	return nil
+}
+
+// force accounts the bytes over the budget and the memory limit, it is
+// used for the few rows the operators need to make progress.
+func (m *queryMemory) force(n int64) {
+	m.accountant.force(n)
+	m.used += n
+}
+
+// release returns the reserved bytes.
+func (m *queryMemory) release(n int64) {
+	m.used -= n
+	m.accountant.release(n)
+}
+
+// close releases all the memory of the query.
+func (m *queryMemory) close() {
+	m.release(m.used)
+}
+
+// accountTables accounts the memory of the loaded tables, the sizes of
+// the data files approximate the memory of their rows. It must be called
+// with the database locked.
+func (db *Database) accountTables() error {
+	size := int64(0)
+	for _, schema := range db.tables {
+		for _, name := range schema.storageNames() {
+			if db.mapped[name] {
+				continue
+			}
+
+			if schema.InMemory {
+				// the memory tables have no files, the rows are
+				// estimated without the lengths of the strings
+				size += int64(len(db.data[name])) * rowSize(make([]interface{}, len(schema.Columns)))
+				continue
+			}
+
+			n, err := fileSize(tableFilePath(db.dbDir, name))
+			if err != nil {
+				return err
+			}
+			size += n
+		}
+	}
+	db.memory.setTables(size)
+
+	return nil
+}
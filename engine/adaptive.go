@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// StorageMode defines whether the rows of the table are kept
+// in memory or read from the memory-mapped data files.
+type StorageMode string
+
+const (
+	// StorageAuto keeps small tables in memory and reads large ones
+	// from disk according to the mmap threshold.
+	StorageAuto StorageMode = "auto"
+	// StorageMemory always keeps the table in memory.
+	StorageMemory StorageMode = "memory"
+	// StorageDisk always reads the table from disk.
+	StorageDisk StorageMode = "disk"
+)
+
+// ParseStorageModes parses the per-table storage mode overrides
+// in the "table=mode,table=mode" format.
+func ParseStorageModes(s string) (map[string]StorageMode, error) {
+	modes := make(map[string]StorageMode)
+	if s == "" {
+		return modes, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid storage mode %q, expected table=mode", pair)
+		}
+
+		switch mode := StorageMode(parts[1]); mode {
+		case StorageAuto, StorageMemory, StorageDisk:
+			modes[strings.ToLower(parts[0])] = mode
+		default:
+			return nil, fmt.Errorf("unknown storage mode %s, expected one of: %s, %s, %s", parts[1], StorageAuto, StorageMemory, StorageDisk)
+		}
+	}
+
+	return modes, nil
+}
+
+// isMappedStorage decides whether the table or partition data file of
+// the given size is read through the memory-mapped path. A mapped file
+// is loaded back into memory only when it shrinks below the half of
+// the threshold, so the file that is about the threshold in size is
+// not loaded and unloaded on every change.
+func isMappedStorage(options Options, tableName string, size int64, mapped bool) bool {
+	switch options.StorageModes[tableName] {
+	case StorageMemory:
+		return false
+	case StorageDisk:
+		return true
+	}
+
+	if options.MmapThreshold <= 0 {
+		return false
+	}
+
+	if mapped {
+		return size >= options.MmapThreshold/2
+	}
+
+	return size >= options.MmapThreshold
+}
+
+// fileSize returns the size of the file, zero if it does not exist.
+func fileSize(filePath string) (int64, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("failed to stat file %s: %w", filePath, err)
+	}
+
+	return stat.Size(), nil
+}
+
+// adaptStorage moves the table or partition rows between memory and
+// disk if the data file size has crossed the threshold.
+func (db *Database) adaptStorage(name string, schema Schema, size int64) error {
+	mapped := db.mapped[name]
+	if isMappedStorage(db.options, schema.Name, size, mapped) == mapped {
+		return nil
+	}
+
+	if mapped {
+		rows, err := readStorage(tableFilePath(db.dbDir, name), schema, db.encryption)
+		if err != nil {
+			return err
+		}
+
+		db.data[name] = newVersions(rows, loadedRecord)
+		delete(db.mapped, name)
+		logging.Infof("%s has %d bytes and is loaded into memory", name, size)
+
+		return nil
+	}
+
+	delete(db.data, name)
+	db.mapped[name] = true
+	logging.Infof("%s has %d bytes and is memory-mapped, not kept in memory", name, size)
+
+	return nil
+}
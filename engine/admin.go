@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"sort"
+	"time"
+)
+
+// TableInfo describes the table for the operators.
+type TableInfo struct {
+	Name string `json:"name"`
+	// Columns are in the position order.
+	Columns      []ColumnInfo  `json:"columns"`
+	Partitioning *Partitioning `json:"partitioning,omitempty"`
+	RowVersion   bool          `json:"row_version,omitempty"`
+	// DictionaryColumns are the dictionary-encoded string columns.
+	DictionaryColumns []string `json:"dictionary_columns,omitempty"`
+	RowCount          int      `json:"row_count"`
+	SizeBytes         int64    `json:"size_bytes"`
+	// Storage is memory, disk or mixed for the partitioned tables.
+	Storage string `json:"storage"`
+}
+
+// ColumnInfo describes the table column.
+type ColumnInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// MemoryStats describes the table data kept in memory and
+// the data read through the memory-mapped files.
+type MemoryStats struct {
+	// LoadedStorages is the number of the tables and
+	// the partitions loaded into memory.
+	LoadedStorages int `json:"loaded_storages"`
+	// LoadedBytes is the size of the data files loaded into memory.
+	LoadedBytes int64 `json:"loaded_bytes"`
+	// RowVersions is the number of the row versions in memory,
+	// including the ones not yet removed by the vacuum.
+	RowVersions int `json:"row_versions"`
+	// MappedStorages is the number of the memory-mapped tables and partitions.
+	MappedStorages int `json:"mapped_storages"`
+	// MappedBytes is the size of the memory-mapped data files.
+	MappedBytes int64 `json:"mapped_bytes"`
+	// QueryBytes is the memory held by the sorts and the aggregations
+	// of the running queries and QueryPeakBytes is its maximum.
+	QueryBytes     int64 `json:"query_bytes"`
+	QueryPeakBytes int64 `json:"query_peak_bytes"`
+	// CacheBytes is the memory of the cached results.
+	CacheBytes int64 `json:"cache_bytes"`
+	// AccountedBytes is the memory of the loaded tables, the caches
+	// and the queries accounted against LimitBytes, zero LimitBytes
+	// means the memory is not limited.
+	AccountedBytes int64 `json:"accounted_bytes"`
+	LimitBytes     int64 `json:"limit_bytes"`
+}
+
+// RuntimeStats describes the state of the running database.
+type RuntimeStats struct {
+	// Started is when the database has been opened.
+	Started time.Time `json:"started"`
+	// CommitSequence is the sequence number of the last commit,
+	// it grows with every change of the data.
+	CommitSequence uint64 `json:"commit_sequence"`
+	// Transactions is the number of the active transactions, each
+	// has a journal that is replayed on start if it is unfinished.
+	Transactions int `json:"transactions"`
+	// Snapshots is the number of the active reader snapshots.
+	Snapshots      int         `json:"snapshots"`
+	Sessions       int         `json:"sessions"`
+	RunningQueries int         `json:"running_queries"`
+	Memory         MemoryStats `json:"memory"`
+	// StatementCache counts the lookups of the parsed statements
+	// and their plans.
+	StatementCache StatementCacheStats `json:"statement_cache"`
+	// ResultCache counts the SELECTs served from memory.
+	ResultCache ResultCacheStats `json:"result_cache"`
+	// GroupCommit counts the concurrent inserts written at once.
+	GroupCommit GroupCommitStats `json:"group_commit"`
+	// Sort counts the ORDER BY sorts and the rows written
+	// to the temporary files.
+	Sort SortStats `json:"sort"`
+	// Aggregate counts the GROUP BY aggregations and the rows
+	// written to the temporary files.
+	Aggregate AggregateStats `json:"aggregate"`
+	// ReadOnly is true while the changes are rejected.
+	ReadOnly bool `json:"read_only"`
+	// ArchiveSequence is the sequence number of the last archive
+	// record, zero if the archive is disabled.
+	ArchiveSequence uint64 `json:"archive_sequence"`
+	// Replica is nil if the database is not a replica.
+	Replica *ReplicaStatus `json:"replica,omitempty"`
+	// Failover is nil if the failover is disabled.
+	Failover *FailoverStatus `json:"failover,omitempty"`
+}
+
+// Started returns when the database has been opened.
+func (db *Database) Started() time.Time {
+	return db.started
+}
+
+// TableInfos describes the tables in the name order.
+func (db *Database) TableInfos() []TableInfo {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	infos := make([]TableInfo, 0, len(db.tables))
+	for _, schema := range sortedTables(db.tables) {
+		dictionaryColumns := make([]string, 0, len(schema.Dictionaries))
+		for name := range schema.Dictionaries {
+			dictionaryColumns = append(dictionaryColumns, name)
+		}
+		sort.Strings(dictionaryColumns)
+
+		columns := make([]ColumnInfo, 0, len(schema.Columns))
+		for _, column := range sortedColumns(schema) {
+			columns = append(columns, ColumnInfo{column.Name, column.Type.Name()})
+		}
+
+		infos = append(infos, TableInfo{
+			Name:              schema.Name,
+			Columns:           columns,
+			Partitioning:      schema.Partitioning,
+			RowVersion:        schema.RowVersion,
+			DictionaryColumns: dictionaryColumns,
+			RowCount:          schema.Stats.RowCount,
+			SizeBytes:         schema.Stats.SizeBytes,
+			Storage:           db.storageLocation(schema),
+		})
+	}
+
+	return infos
+}
+
+// RuntimeStats returns the state of the running database.
+func (db *Database) RuntimeStats() (RuntimeStats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stats := RuntimeStats{
+		Started:        db.started,
+		CommitSequence: db.csn,
+		Transactions:   len(db.transactions),
+		Snapshots:      len(db.snapshots),
+		StatementCache: db.StatementCacheStats(),
+		ResultCache:    db.ResultCacheStats(),
+		GroupCommit:    db.GroupCommitStats(),
+		Sort:           db.SortStats(),
+		Aggregate:      db.AggregateStats(),
+		ReadOnly:       db.ReadOnly(),
+	}
+
+	if db.archiver != nil {
+		stats.ArchiveSequence = db.archiver.sequence
+	}
+
+	if db.replica != nil {
+		status := db.replica.currentStatus()
+		stats.Replica = &status
+	}
+
+	if db.options.Failover || db.options.Replica {
+		status := db.FailoverStatus()
+		stats.Failover = &status
+	}
+
+	for _, schema := range db.tables {
+		for _, name := range schema.storageNames() {
+			if schema.InMemory {
+				stats.Memory.LoadedStorages++
+				stats.Memory.RowVersions += len(db.data[name])
+				continue
+			}
+
+			size, err := fileSize(tableFilePath(db.dbDir, name))
+			if err != nil {
+				return RuntimeStats{}, err
+			}
+
+			if db.mapped[name] {
+				stats.Memory.MappedStorages++
+				stats.Memory.MappedBytes += size
+				continue
+			}
+
+			stats.Memory.LoadedStorages++
+			stats.Memory.LoadedBytes += size
+			stats.Memory.RowVersions += len(db.data[name])
+		}
+	}
+
+	db.memory.usage(&stats.Memory)
+
+	db.sessions.mu.Lock()
+	stats.Sessions = len(db.sessions.sessions)
+	db.sessions.mu.Unlock()
+
+	db.processes.mu.Lock()
+	stats.RunningQueries = len(db.processes.queries)
+	db.processes.mu.Unlock()
+
+	return stats, nil
+}
+
+// SessionInfo describes the open session for the operators.
+type SessionInfo struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user,omitempty"`
+	Opened   time.Time `json:"opened"`
+	LastUsed time.Time `json:"last_used"`
+	// Transaction is the identifier of the transaction
+	// started in the session, empty if there is none.
+	Transaction string `json:"transaction,omitempty"`
+	Prepared    int    `json:"prepared"`
+}
+
+// SessionInfos describes the open sessions in the order they were opened.
+func (db *Database) SessionInfos() []SessionInfo {
+	db.sessions.mu.Lock()
+	sessions := make([]*Session, 0, len(db.sessions.sessions))
+	for _, s := range db.sessions.sessions {
+		sessions = append(sessions, s)
+	}
+	db.sessions.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		s.mu.Lock()
+		info := SessionInfo{ID: s.ID, User: s.User, Opened: s.opened, LastUsed: s.lastUsed, Prepared: len(s.prepared)}
+		if tx := s.transaction(); tx != nil {
+			info.Transaction = tx.ID
+		}
+		s.mu.Unlock()
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Opened.Before(infos[j].Opened)
+	})
+
+	return infos
+}
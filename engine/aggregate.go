@@ -0,0 +1,733 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The rows of GROUP BY are aggregated in a hash table of the groups
+// while the query has the memory for them. When the work memory is
+// exhausted, the rows of the groups that are not in the table yet are
+// written to the temporary partition files by the hash of their group
+// key, the groups of the table keep aggregating their rows. After the
+// scan the partitions are aggregated one by one the same way with a
+// different hash, so every group is aggregated from all its rows in
+// memory once. The partitions of the last level are aggregated over
+// the budget, the query is rejected if they exceed the memory limit.
+
+const (
+	// aggregatePartitions is the number of the partition files
+	// of the rows spilled at every level.
+	aggregatePartitions = 16
+	// aggregateMaxDepth is the last level of the partitions.
+	aggregateMaxDepth = 4
+)
+
+// aggregateFunctions are the supported aggregate functions.
+var aggregateFunctions = map[string]struct{}{
+	"COUNT": {},
+	"SUM":   {},
+	"MIN":   {},
+	"MAX":   {},
+}
+
+// GroupedSelect represents SELECT column, COUNT(*), SUM(column), ...
+// FROM ... [WHERE ...] GROUP BY column, ... [ORDER BY name [ASC|DESC],
+// ...] [LIMIT ...] statement. ORDER BY refers to the selected items.
+type GroupedSelect struct {
+	*sql.Select
+	Items   []SelectItem
+	GroupBy []string
+	OrderBy []OrderTerm
+}
+
+// GetType returns the statement type.
+func (*GroupedSelect) GetType() sql.StatementType { return StatementGroupedSelect }
+
+// SelectItem is the selected group column or the aggregate function.
+type SelectItem struct {
+	// Function is COUNT, SUM, MIN or MAX, empty for the group columns.
+	Function string
+	// Column is empty for COUNT(*).
+	Column string
+	// Name is the name of the result column.
+	Name string
+}
+
+func (i SelectItem) String() string {
+	text := i.Column
+	if i.Function != "" {
+		argument := i.Column
+		if argument == "" {
+			argument = "*"
+		}
+		text = i.Function + "(" + argument + ")"
+	}
+	if i.Name != i.Column && i.Name != strings.ToLower(i.Function) {
+		text += " AS " + i.Name
+	}
+
+	return text
+}
+
+// isGroupedSelect reports whether the statement is SELECT with GROUP BY.
+func isGroupedSelect(s *tokenStream) bool {
+	return s.isKeyword("SELECT") && keywordsIndex(s.tokens, "GROUP", "BY") >= 0
+}
+
+// parseGroupedSelect parses the selected items and the GROUP BY and
+// ORDER BY parts, the rest of the query is parsed by gosqlparser.
+func parseGroupedSelect(query string, s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SELECT")
+
+	items := make([]SelectItem, 0)
+	for {
+		item, err := parseSelectItem(s)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+
+		if !s.acceptSymbol(",") {
+			break
+		}
+	}
+
+	from := s.peek()
+	if err := s.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+
+	group := keywordsIndex(s.tokens, "GROUP", "BY")
+	s.pos = group + 2
+
+	groupBy := make([]string, 0)
+	for {
+		column, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		groupBy = append(groupBy, strings.ToLower(column))
+
+		if !s.acceptSymbol(",") {
+			break
+		}
+	}
+
+	var orderBy []OrderTerm
+	if s.acceptKeyword("ORDER", "BY") {
+		terms, err := parseOrderTerms(s)
+		if err != nil {
+			return nil, err
+		}
+		orderBy = terms
+	}
+
+	end := s.peek()
+	if !s.isKeyword("LIMIT") {
+		if err := s.expectEnd(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateGroupedSelect(items, groupBy, orderBy); err != nil {
+		return nil, err
+	}
+
+	// gosqlparser parses the table and the WHERE part of the query
+	// with the items and GROUP BY blanked to keep the error positions
+	start := s.tokens[group].pos
+	text := "SELECT c" + strings.Repeat(" ", from.pos-len("SELECT c")) + query[from.pos:start] +
+		strings.Repeat(" ", end.pos-start) + query[end.pos:]
+	statement, err := sql.Parse(protectEscapedQuotes(text))
+	if err != nil {
+		return nil, err
+	}
+
+	selected, ok := statement.(*sql.Select)
+	if !ok {
+		return nil, fmt.Errorf("GROUP BY is supported only in SELECT, got %T", statement)
+	}
+	selected.Columns = nil
+
+	return &GroupedSelect{selected, items, groupBy, orderBy}, nil
+}
+
+// parseSelectItem parses the group column or the aggregate function
+// with the optional AS name.
+func parseSelectItem(s *tokenStream) (SelectItem, error) {
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return SelectItem{}, err
+	}
+
+	item := SelectItem{Column: strings.ToLower(name), Name: strings.ToLower(name)}
+	function := strings.ToUpper(name)
+	if _, exists := aggregateFunctions[function]; exists && s.acceptSymbol("(") {
+		item = SelectItem{Function: function, Name: strings.ToLower(function)}
+		if function != "COUNT" || !s.acceptSymbol("*") {
+			column, err := s.expectIdentifier()
+			if err != nil {
+				return SelectItem{}, err
+			}
+			item.Column = strings.ToLower(column)
+		}
+
+		if err := s.expectSymbol(")"); err != nil {
+			return SelectItem{}, err
+		}
+	}
+
+	if s.acceptKeyword("AS") {
+		alias, err := s.expectIdentifier()
+		if err != nil {
+			return SelectItem{}, err
+		}
+		item.Name = strings.ToLower(alias)
+	}
+
+	return item, nil
+}
+
+// validateGroupedSelect checks that the selected columns are grouped
+// and ORDER BY refers to the selected items.
+func validateGroupedSelect(items []SelectItem, groupBy []string, orderBy []OrderTerm) error {
+	names := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		if _, exists := names[item.Name]; exists {
+			return fmt.Errorf("duplicate result column %s", item.Name)
+		}
+		names[item.Name] = struct{}{}
+
+		if item.Function == "" && !containsString(groupBy, item.Column) {
+			return fmt.Errorf("column %s must appear in GROUP BY or be used in an aggregate function", item.Column)
+		}
+	}
+
+	for _, term := range orderBy {
+		if _, exists := names[term.Column]; !exists {
+			return fmt.Errorf("ORDER BY %s must refer to a selected column", term.Column)
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AggregateStats counts the GROUP BY aggregations.
+type AggregateStats struct {
+	Aggregations uint64 `json:"aggregations"`
+	// Spilled is the number of the aggregations that have exceeded
+	// the work memory and written the rows to temporary files.
+	Spilled      uint64 `json:"spilled"`
+	SpilledRows  uint64 `json:"spilled_rows"`
+	SpilledBytes uint64 `json:"spilled_bytes"`
+}
+
+// AggregateStats returns the counters of the aggregations since start.
+func (db *Database) AggregateStats() AggregateStats {
+	db.aggregates.mu.Lock()
+	defer db.aggregates.mu.Unlock()
+
+	return AggregateStats{db.aggregates.operations, db.aggregates.spilled, db.aggregates.spilledRows, db.aggregates.spilledBytes}
+}
+
+// AggregateContext fetches the groups.
+func (db *Database) AggregateContext(ctx context.Context, query *GroupedSelect) ([][]interface{}, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return collectRows(func(f func(row []interface{}) error) error {
+		return db.aggregateEach(ctx, query, nil, nil, masks, f)
+	})
+}
+
+// AggregateEachContext fetches the groups and calls f for every group
+// without collecting them, the rows of the groups that do not fit in
+// the work memory are aggregated from temporary files.
+func (db *Database) AggregateEachContext(ctx context.Context, query *GroupedSelect, f func(row []interface{}) error) (err error) {
+	rows, started := 0, time.Now()
+	defer func() { db.logQuery(ctx, query, started, rows, err) }()
+
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.aggregateEach(ctx, query, nil, nil, masks, countRows(&rows, f))
+}
+
+// AggregateContext fetches the groups within the transaction.
+func (tx *Transaction) AggregateContext(ctx context.Context, query *GroupedSelect) ([][]interface{}, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	masks := tx.db.queryMasks(ctx, query.Table)
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return nil, err
+	}
+	tx.queried = true
+
+	return collectRows(func(f func(row []interface{}) error) error {
+		return tx.db.aggregateEach(ctx, query, nil, tx, masks, f)
+	})
+}
+
+// AggregateEachContext is AggregateEachContext of the database
+// within the transaction.
+func (tx *Transaction) AggregateEachContext(ctx context.Context, query *GroupedSelect, f func(row []interface{}) error) (err error) {
+	rows, started := 0, time.Now()
+	defer func() { tx.db.logQuery(ctx, query, started, rows, err) }()
+
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	masks := tx.db.queryMasks(ctx, query.Table)
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return err
+	}
+	tx.queried = true
+
+	return tx.db.aggregateEach(ctx, query, nil, tx, masks, countRows(&rows, f))
+}
+
+// ResultColumns returns the columns of the rows selected by the query
+// in the order of the row values.
+func (db *Database) ResultColumns(query sql.Statement) ([]ColumnDef, error) {
+	switch q := query.(type) {
+	case *sql.Select:
+		return db.Columns(q.Table)
+	case *OrderedSelect:
+		return db.Columns(q.Table)
+	case *AsOfSelect:
+		return db.Columns(q.Table)
+	case *CountRows:
+		return []ColumnDef{{Name: "count", Type: sql.TypeInteger}}, nil
+	case *GroupedSelect:
+		db.mu.Lock()
+		defer db.mu.Unlock()
+
+		schema, err := db.selectedSchema(q.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		g, err := newAggregation(schema, q)
+		if err != nil {
+			return nil, err
+		}
+
+		return g.columns, nil
+	}
+
+	return nil, fmt.Errorf("%T does not select rows", query)
+}
+
+// aggregateEach scans the selected rows into the groups and passes the
+// groups to f, sorted if the query has ORDER BY. The values are masked
+// before they are aggregated. It must be called with the database
+// locked, the lock is released while the partitions are aggregated.
+func (db *Database) aggregateEach(ctx context.Context, query *GroupedSelect, a *analysis, tx *Transaction, masks []*ColumnMask, f func(row []interface{}) error) error {
+	schema, err := db.selectedSchema(query.Table)
+	if err != nil {
+		return err
+	}
+
+	g, err := newAggregation(schema, query)
+	if err != nil {
+		return err
+	}
+
+	op := a.operator("hash aggregate")
+	defer op.finish()
+
+	memory := db.memory.query(db.options.WorkMem)
+	defer memory.close()
+
+	g.memory, g.tempDir = memory, db.options.TempDir
+	defer g.close()
+
+	err = db.selectEach(ctx, query.Select, a, tx, maskEach(masks, func(row []interface{}) error {
+		op.read()
+
+		return g.add(row)
+	}))
+	if err != nil {
+		return err
+	}
+
+	db.mu.Unlock()
+	defer db.mu.Lock()
+
+	emit := func(row []interface{}) error {
+		op.produce()
+
+		return f(row)
+	}
+
+	var sorter *externalSorter
+	if len(query.OrderBy) > 0 {
+		compare, err := orderBy(Schema{Name: schema.Name, Columns: g.schema}, query.OrderBy)
+		if err != nil {
+			return err
+		}
+
+		sorter = newExternalSorter(compare, memory, db.options.TempDir)
+		defer sorter.close()
+		emit = sorter.add
+		g.spillOutput = func() error {
+			if len(sorter.rows) < sortMinRunRows {
+				return nil
+			}
+
+			return sorter.spill()
+		}
+	}
+
+	err = g.each(ctx, emit)
+	db.aggregates.add(g.spilledRows, g.spilledBytes)
+	if g.spilledRows > 0 && op != nil {
+		op.name = fmt.Sprintf("hash aggregate (%d rows, %d bytes spilled)", g.spilledRows, g.spilledBytes)
+	}
+	if err != nil || sorter == nil {
+		return err
+	}
+
+	db.sorts.add(sorter.spilledRows, sorter.spilledBytes)
+
+	return sorter.each(ctx, func(row []interface{}) error {
+		op.produce()
+
+		return f(row)
+	})
+}
+
+// selectedSchema returns the schema of the table or the virtual table,
+// it must be called with the database locked.
+func (db *Database) selectedSchema(table string) (Schema, error) {
+	tableName := strings.ToLower(table)
+	if schema, exists := db.tables[tableName]; exists {
+		return schema, nil
+	}
+
+	if virtual, exists := virtualTables[tableName]; exists {
+		return virtual.schema, nil
+	}
+
+	return Schema{}, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+}
+
+// aggregation groups the table rows by the GROUP BY columns
+// and computes the selected items of the groups.
+type aggregation struct {
+	items []SelectItem
+	// keys are the positions of the GROUP BY columns in the table rows
+	keys []int
+	// positions are the positions of the item columns in the table
+	// rows, -1 for COUNT(*)
+	positions []int
+	columns   []ColumnDef
+	// schema are the result columns by name
+	schema map[string]ColumnDef
+
+	memory  *queryMemory
+	tempDir string
+	// spillOutput frees the memory of the operator the groups are
+	// passed to before the partitions are aggregated, nil if the
+	// groups are not kept
+	spillOutput func() error
+
+	// level is the level of the partitions aggregated in memory
+	level      *aggregationLevel
+	partitions []*spillFile
+
+	spilledRows  int
+	spilledBytes int64
+}
+
+// aggregationLevel is the hash table of the groups
+// of the table or the partition.
+type aggregationLevel struct {
+	depth  int
+	groups map[string][]interface{}
+	// keys are in the order of the first rows of the groups
+	keys []string
+	// size is the memory reserved for the groups
+	size int64
+	// partitions are nil until the level spills the rows
+	partitions []*spillFile
+}
+
+// newAggregation validates the query against the table schema.
+func newAggregation(schema Schema, query *GroupedSelect) (*aggregation, error) {
+	g := &aggregation{
+		items:     query.Items,
+		keys:      make([]int, len(query.GroupBy)),
+		positions: make([]int, len(query.Items)),
+		columns:   make([]ColumnDef, len(query.Items)),
+		schema:    make(map[string]ColumnDef, len(query.Items)),
+	}
+
+	for i, name := range query.GroupBy {
+		column, exists := schema.Columns[name]
+		if !exists {
+			return nil, newError(CodeUndefinedColumn, "column %s does not exist in table %s", name, schema.Name)
+		}
+		g.keys[i] = column.Position
+	}
+
+	for i, item := range query.Items {
+		g.positions[i] = -1
+		result := ColumnDef{Name: item.Name, Type: sql.TypeInteger, Position: i}
+		if item.Column != "" {
+			column, exists := schema.Columns[item.Column]
+			if !exists {
+				return nil, newError(CodeUndefinedColumn, "column %s does not exist in table %s", item.Column, schema.Name)
+			}
+			if item.Function == "SUM" && column.Type != sql.TypeInteger {
+				return nil, newError(CodeDatatypeMismatch, "SUM of column %s requires an integer column", item.Column)
+			}
+
+			g.positions[i] = column.Position
+			if item.Function != "COUNT" {
+				result.Type = column.Type
+			}
+		}
+
+		g.columns[i] = result
+		g.schema[item.Name] = result
+	}
+
+	g.level = newAggregationLevel(0)
+
+	return g, nil
+}
+
+func newAggregationLevel(depth int) *aggregationLevel {
+	return &aggregationLevel{depth: depth, groups: make(map[string][]interface{})}
+}
+
+// key encodes the values of the GROUP BY columns of the row.
+func (g *aggregation) key(row []interface{}) string {
+	var b strings.Builder
+	for _, position := range g.keys {
+		fmt.Fprintf(&b, "%#v,", row[position])
+	}
+
+	return b.String()
+}
+
+// add aggregates the row into its group, the row is spilled to the
+// partition of its group if the group is not in memory and the query
+// has no memory for it.
+func (g *aggregation) add(row []interface{}) error {
+	level := g.level
+	key := g.key(row)
+	if group, exists := level.groups[key]; exists {
+		g.update(group, row)
+
+		return nil
+	}
+
+	if level.partitions == nil {
+		group := g.start(row)
+		size := rowSize(group) + int64(len(key))
+		if level.depth >= aggregateMaxDepth {
+			// the last level can not spill anymore
+			if err := g.memory.grow(size); err != nil {
+				return err
+			}
+		} else if !g.memory.reserve(size) {
+			level.partitions = make([]*spillFile, aggregatePartitions)
+		}
+
+		if level.partitions == nil {
+			level.groups[key] = group
+			level.keys = append(level.keys, key)
+			level.size += size
+
+			return nil
+		}
+	}
+
+	// the seed of the hash differs by the level,
+	// so the partition rows are split again
+	hash := fnv.New32a()
+	hash.Write([]byte{byte(level.depth)})
+	hash.Write([]byte(key))
+	partition := hash.Sum32() % aggregatePartitions
+
+	file := level.partitions[partition]
+	if file == nil {
+		var err error
+		if file, err = createSpillFile(g.tempDir); err != nil {
+			return err
+		}
+		level.partitions[partition] = file
+		g.partitions = append(g.partitions, file)
+	}
+	g.spilledRows++
+
+	return file.write(row)
+}
+
+// start returns the group of the row with the aggregates
+// of the row.
+func (g *aggregation) start(row []interface{}) []interface{} {
+	group := make([]interface{}, len(g.items))
+	for i, item := range g.items {
+		switch item.Function {
+		case "":
+			group[i] = row[g.positions[i]]
+		case "COUNT":
+			group[i] = 0
+		}
+	}
+	g.update(group, row)
+
+	return group
+}
+
+// update aggregates the row into the group, NULL values
+// are skipped by the functions of the columns.
+func (g *aggregation) update(group []interface{}, row []interface{}) {
+	for i, item := range g.items {
+		if item.Function == "" {
+			continue
+		}
+
+		if g.positions[i] < 0 {
+			group[i] = group[i].(int) + 1
+			continue
+		}
+
+		value := row[g.positions[i]]
+		if value == nil {
+			continue
+		}
+
+		switch item.Function {
+		case "COUNT":
+			group[i] = group[i].(int) + 1
+		case "SUM":
+			sum, _ := group[i].(int)
+			group[i] = sum + value.(int)
+		case "MIN":
+			if group[i] == nil || less(value, group[i]) {
+				group[i] = value
+			}
+		case "MAX":
+			if group[i] == nil || less(group[i], value) {
+				group[i] = value
+			}
+		}
+	}
+}
+
+// each passes the groups in memory to f and then aggregates
+// the spilled partitions level by level.
+func (g *aggregation) each(ctx context.Context, f func(row []interface{}) error) error {
+	// the groups are passed on with their memory,
+	// the sort of the groups accounts them again
+	level := g.level
+	g.memory.release(level.size)
+	level.size = 0
+
+	for i, key := range level.keys {
+		if err := canceled(ctx, i); err != nil {
+			return err
+		}
+
+		if err := f(level.groups[key]); err != nil {
+			return err
+		}
+	}
+	level.groups, level.keys = nil, nil
+
+	for _, file := range level.partitions {
+		if file == nil {
+			continue
+		}
+
+		if g.spillOutput != nil {
+			if err := g.spillOutput(); err != nil {
+				return err
+			}
+		}
+
+		if err := file.finish(); err != nil {
+			return err
+		}
+		g.spilledBytes += file.size
+
+		g.level = newAggregationLevel(level.depth + 1)
+		for i := 0; ; i++ {
+			if err := canceled(ctx, i); err != nil {
+				return err
+			}
+
+			row, err := file.read()
+			if err != nil {
+				return err
+			}
+			if row == nil {
+				break
+			}
+
+			if err := g.add(row); err != nil {
+				return err
+			}
+		}
+		file.remove()
+
+		if err := g.each(ctx, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// close removes the partition files and releases
+// the memory of the groups.
+func (g *aggregation) close() {
+	for _, file := range g.partitions {
+		file.remove()
+	}
+	g.partitions = nil
+
+	if g.level != nil {
+		g.memory.release(g.level.size)
+		g.level = nil
+	}
+}
@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The archive keeps every version of the database files since it has
+// been enabled, so the database can be restored from a backup to any
+// moment after the backup. The files are replaced as a whole on every
+// change, so the archive is the sequence of the replaced and removed
+// files. The files changed by a transaction are marked with it, and
+// its commit is archived too, so the changes of the transactions
+// that have not been committed are not restored.
+
+// archiveIndexFileName is the name of the file in the archive
+// directory that lists the archive records, one per line.
+const archiveIndexFileName = "gosqldb.archive.jsonl"
+
+// archiveRecord is the archived file change or transaction commit.
+type archiveRecord struct {
+	// Sequence numbers the records from 1, it is the position
+	// in the archive.
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	// File is the name of the replaced or removed file in the
+	// db directory, empty for the commits.
+	File    string `json:"file,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+	// Checksum is the checksum of the archived file content.
+	Checksum string `json:"checksum,omitempty"`
+	// Transaction has written the file or has been committed,
+	// empty for the changes outside of the transactions.
+	Transaction string `json:"transaction,omitempty"`
+	Commit      bool   `json:"commit,omitempty"`
+	Rollback    bool   `json:"rollback,omitempty"`
+	// Term is the cluster term of the leader that has
+	// written the record, zero outside of the clusters.
+	Term uint64 `json:"term,omitempty"`
+}
+
+// archiver appends the records to the archive, it is used
+// with the database lock held.
+type archiver struct {
+	dir string
+	// sequence is the sequence number of the last record
+	sequence uint64
+	// term marks the appended records, lastTerm
+	// is the term of the last record
+	term     uint64
+	lastTerm uint64
+	// changed is closed and replaced on every append,
+	// so the streams wait for the new records
+	changed chan struct{}
+}
+
+// newArchiver opens the archive in the directory,
+// it returns nil if the directory is empty.
+func newArchiver(dir string, dbDir string) (*archiver, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	if err := validateArchiveDir(dir, dbDir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory %s: %w", dir, err)
+	}
+
+	records, err := readArchive(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &archiver{dir: dir, changed: make(chan struct{})}
+	if len(records) > 0 {
+		a.sequence = records[len(records)-1].Sequence
+		a.lastTerm = records[len(records)-1].Term
+		a.term = a.lastTerm
+	}
+
+	return a, nil
+}
+
+// validateArchiveDir makes sure that the archive is not inside the
+// db directory, so it is not backed up.
+func validateArchiveDir(dir string, dbDir string) error {
+	archiveDir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("invalid archive path %s: %w", dir, err)
+	}
+
+	absDBDir, err := filepath.Abs(dbDir)
+	if err != nil {
+		return fmt.Errorf("invalid db directory path %s: %w", dbDir, err)
+	}
+
+	if archiveDir == absDBDir || strings.HasPrefix(archiveDir, absDBDir+string(filepath.Separator)) {
+		return fmt.Errorf("archive directory %s is inside the db directory", archiveDir)
+	}
+
+	return nil
+}
+
+// archiveContentPath returns the path of the archived file content.
+func archiveContentPath(dir string, sequence uint64) string {
+	return path.Join(dir, fmt.Sprintf("%020d", sequence))
+}
+
+// append stores the content of the replaced file, if any,
+// and appends the record to the index.
+func (a *archiver) append(record archiveRecord, content []byte) error {
+	record.Sequence = a.sequence + 1
+	record.Time = time.Now().UTC()
+	record.Term = a.term
+
+	if record.File != "" && !record.Removed {
+		record.Checksum = checksum(content)
+		if err := writeSyncedFile(archiveContentPath(a.dir, record.Sequence), content); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode archive record: %w", err)
+	}
+
+	indexPath := path.Join(a.dir, archiveIndexFileName)
+	index, err := os.OpenFile(indexPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", indexPath, err)
+	}
+	defer func() { checkFileClose(indexPath, index.Close()) }()
+
+	if _, err := index.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", indexPath, err)
+	}
+
+	if err := index.Sync(); err != nil {
+		return fmt.Errorf("failed to flush file %s: %w", indexPath, err)
+	}
+
+	if err := syncDir(a.dir); err != nil {
+		return err
+	}
+	a.sequence, a.lastTerm = record.Sequence, record.Term
+	close(a.changed)
+	a.changed = make(chan struct{})
+
+	return nil
+}
+
+// readArchive reads the records of the archive in the sequence
+// order, the last line that has not been completely written
+// on crash is skipped.
+func readArchive(dir string) ([]archiveRecord, error) {
+	indexPath := path.Join(dir, archiveIndexFileName)
+	content, err := ioutil.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", indexPath, err)
+	}
+
+	records := make([]archiveRecord, 0)
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		var record archiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			if !strings.HasSuffix(string(content), "\n") && len(scanner.Bytes()) > 0 {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to decode archive record from %s: %w", indexPath, err)
+		}
+
+		if record.Sequence != uint64(len(records))+1 {
+			return nil, fmt.Errorf("archive %s has record %d after %d", dir, record.Sequence, len(records))
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// archiveFile archives the new content of the file in the db
+// directory, the files of the journals are not archived.
+func (db *Database) archiveFile(filePath string, content []byte, removed bool) error {
+	if db.archiver == nil || path.Dir(filePath) != path.Clean(db.dbDir) {
+		return nil
+	}
+
+	name := path.Base(filePath)
+	record := archiveRecord{File: name, Removed: removed}
+	tx := db.journalingTransaction(name)
+	if tx != nil {
+		record.Transaction = tx.ID
+	}
+
+	if err := db.archiver.append(record, content); err != nil {
+		return err
+	}
+
+	if tx != nil && tx.archived == 0 {
+		tx.archived = db.archiver.sequence
+	}
+
+	return nil
+}
+
+// archiveStorage archives the data file of the storage and its
+// checksum as they are on disk, after they are restored from the journal.
+func (db *Database) archiveStorage(name string) error {
+	filePath := tableFilePath(db.dbDir, name)
+	for _, filePath := range []string{filePath, checksumFilePath(filePath)} {
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+
+		if err := db.archiveFile(filePath, content, os.IsNotExist(err)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveEnd archives the commit or the rollback of the
+// transaction that has changed files.
+func (db *Database) archiveEnd(tx *Transaction, committed bool) {
+	if db.archiver == nil || tx.archived == 0 {
+		return
+	}
+
+	// the transaction has ended already, it can not fail
+	record := archiveRecord{Transaction: tx.ID, Commit: committed, Rollback: !committed}
+	if err := db.archiver.append(record, nil); err != nil {
+		logging.Errorf("failed to archive end of transaction %s, the archive is incomplete: %s", tx.ID, err)
+	}
+}
+
+// journalingTransaction returns the transaction that has journaled
+// the data file or its checksum, nil if there is none.
+func (db *Database) journalingTransaction(fileName string) *Transaction {
+	name := strings.TrimSuffix(strings.TrimSuffix(fileName, checksumFileExtension), tableFileExtension)
+	for _, tx := range db.transactions {
+		if _, exists := tx.journal[name]; exists {
+			return tx
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,312 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The time-travel queries read the table as it has been at the moment
+// within the retention of the changefeed:
+//
+//	SELECT id, name FROM users AS OF TIMESTAMP "2024-05-01T12:00:00Z" WHERE id == 1
+//
+// The current rows are read from the snapshot and the changes committed
+// after the moment are undone from the newest one: the inserted rows are
+// removed, the deleted ones are added back and the updated ones get
+// their old values. The rows are matched by their values, the changes
+// made before the changefeed has been enabled are not known.
+
+// AsOfSelect represents SELECT ... AS OF TIMESTAMP statement,
+// the AS OF part goes after the table name.
+type AsOfSelect struct {
+	*sql.Select
+	// Time is the moment the table is read as of.
+	Time time.Time
+}
+
+// isAsOfSelect reports whether the statement is SELECT with AS OF.
+func isAsOfSelect(s *tokenStream) bool {
+	return s.isKeyword("SELECT") && keywordsIndex(s.tokens, "AS", "OF") >= 0
+}
+
+// parseAsOfSelect parses the AS OF part, the rest of the query
+// is parsed by gosqlparser with the part blanked.
+func parseAsOfSelect(query string, s *tokenStream) (sql.Statement, error) {
+	asOf := keywordsIndex(s.tokens, "AS", "OF")
+	s.pos = asOf + 2
+
+	t, err := s.expectTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	// the blanked part keeps the error positions
+	start, end := s.tokens[asOf].pos, s.peek().pos
+	statement, err := sql.Parse(protectEscapedQuotes(query[:start] + strings.Repeat(" ", end-start) + query[end:]))
+	if err != nil {
+		return nil, err
+	}
+
+	selected, ok := statement.(*sql.Select)
+	if !ok {
+		return nil, fmt.Errorf("AS OF is supported only in SELECT, got %T", statement)
+	}
+
+	return &AsOfSelect{selected, t}, nil
+}
+
+// expectTimestamp parses TIMESTAMP "<RFC 3339>".
+func (s *tokenStream) expectTimestamp() (time.Time, error) {
+	if err := s.expectKeyword("TIMESTAMP"); err != nil {
+		return time.Time{}, err
+	}
+
+	at := s.peek()
+	value, err := s.expectString()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, &SyntaxError{fmt.Sprintf("invalid timestamp %s, expected RFC 3339 format", at.value), at.pos}
+	}
+
+	return t, nil
+}
+
+// AsOfContext selects the rows of the table as they have been
+// at the moment of the query.
+func (db *Database) AsOfContext(ctx context.Context, query *AsOfSelect) ([][]interface{}, error) {
+	rows := make([][]interface{}, 0)
+	err := db.AsOfEachContext(ctx, query, func(row []interface{}) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// AsOfEachContext calls f for every row of the table matched as it has
+// been at the moment of the query, the selection stops with the error
+// returned by f.
+func (db *Database) AsOfEachContext(ctx context.Context, query *AsOfSelect, f func(row []interface{}) error) error {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	rows, err := db.asOfRows(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := f(maskRow(masks, row)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// asOfRows returns the matched rows of the table as they have been
+// at the moment of the query.
+func (db *Database) asOfRows(ctx context.Context, query *AsOfSelect) ([][]interface{}, error) {
+	f := db.changefeed
+	if err := f.retained("AS OF", query.Time); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	tableName := strings.ToLower(query.Table)
+	schema, exists := db.tables[tableName]
+	if !exists {
+		db.mu.Unlock()
+		if _, exists := virtualTables[tableName]; exists {
+			return nil, fmt.Errorf("AS OF is not supported for %s", tableName)
+		}
+
+		return nil, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	// the changes after the position are not in the snapshot
+	position := db.ChangePosition()
+	all := *query.Select
+	all.Where = nil
+	current := newAsOfRows(schema)
+	err := db.selectEach(ctx, &all, nil, nil, func(row []interface{}) error {
+		current.add(row)
+		return nil
+	})
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	changes, _, err := f.read(0)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if !change.Time.After(query.Time) {
+			break
+		}
+
+		if change.Position > position || change.Table != tableName {
+			continue
+		}
+
+		if err := current.undo(change); err != nil {
+			return nil, fmt.Errorf("table %s can not be read as of %s: %w", tableName, query.Time.Format(time.RFC3339), err)
+		}
+	}
+
+	matched := make([][]interface{}, 0)
+	for _, row := range current.rows {
+		if row != nil && matches(schema, row, query.Where) {
+			matched = append(matched, row)
+		}
+	}
+
+	return matched, nil
+}
+
+// retained fails if the changes after the moment are not
+// retained, the statement is for the error messages.
+func (f *changefeed) retained(statement string, t time.Time) error {
+	if !f.enabled() {
+		return fmt.Errorf("%s requires the changefeed, the changes are not retained", statement)
+	}
+
+	if cutoff := time.Now().Add(-f.retention); t.Before(cutoff) {
+		return fmt.Errorf("%s is before the retention window of %s, the changes have expired", t.Format(time.RFC3339), f.retention)
+	}
+
+	return nil
+}
+
+// asOfRows are the rows of the table the changes are undone on,
+// the removed rows are nil.
+type asOfRows struct {
+	schema  Schema
+	columns []ColumnDef
+	rows    [][]interface{}
+	// positions of the rows by their values
+	positions map[string][]int
+}
+
+func newAsOfRows(schema Schema) *asOfRows {
+	columns := make([]ColumnDef, 0, len(schema.Columns))
+	for _, column := range sortedColumns(schema) {
+		// the virtual columns are computed, they are not compared
+		if column.Expression == "" || column.Stored {
+			columns = append(columns, column)
+		}
+	}
+
+	return &asOfRows{schema: schema, columns: columns, positions: make(map[string][]int)}
+}
+
+// key returns the values of the row to match it with the changes.
+func (r *asOfRows) key(values map[string]interface{}) string {
+	compared := make(map[string]interface{}, len(r.columns))
+	for _, column := range r.columns {
+		compared[column.Name] = values[column.Name]
+	}
+
+	// the maps are encoded with the sorted keys
+	key, err := json.Marshal(compared)
+	if err != nil {
+		// the values are integers and strings
+		panic(fmt.Errorf("failed to encode row: %w", err))
+	}
+
+	return string(key)
+}
+
+// add adds the row at the end.
+func (r *asOfRows) add(row []interface{}) {
+	key := r.key(rowValues(r.columns, row))
+	r.positions[key] = append(r.positions[key], len(r.rows))
+	r.rows = append(r.rows, row)
+}
+
+// take removes the row with the values and returns its position.
+func (r *asOfRows) take(values map[string]interface{}) (int, error) {
+	key := r.key(values)
+	positions := r.positions[key]
+	if len(positions) == 0 {
+		return 0, fmt.Errorf("the changed row %s is not found", key)
+	}
+
+	position := positions[len(positions)-1]
+	r.positions[key] = positions[:len(positions)-1]
+	r.rows[position] = nil
+
+	return position, nil
+}
+
+// undo reverts the change of the rows.
+func (r *asOfRows) undo(change Change) error {
+	switch change.Operation {
+	case ChangeInsert:
+		_, err := r.take(change.New)
+		return err
+	case ChangeDelete:
+		row, err := r.changeRow(change.Old)
+		if err != nil {
+			return err
+		}
+		r.add(row)
+	case ChangeUpdate:
+		position, err := r.take(change.New)
+		if err != nil {
+			return err
+		}
+
+		row, err := r.changeRow(change.Old)
+		if err != nil {
+			return err
+		}
+		key := r.key(change.Old)
+		r.positions[key] = append(r.positions[key], position)
+		r.rows[position] = row
+	}
+
+	return nil
+}
+
+// changeRow returns the row of the values of the change.
+func (r *asOfRows) changeRow(values map[string]interface{}) ([]interface{}, error) {
+	row := make([]interface{}, len(r.schema.Columns))
+	for _, column := range r.columns {
+		value := values[column.Name]
+		if number, ok := value.(json.Number); ok {
+			n, err := number.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of column %s: %w", column.Name, err)
+			}
+			value = int(n)
+		}
+		row[column.Position] = value
+	}
+
+	if err := computeGenerated(r.schema, row, true); err != nil {
+		return nil, err
+	}
+
+	return row, nil
+}
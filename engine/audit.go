@@ -0,0 +1,306 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The audit log records every executed statement with its user, text,
+// number of the affected rows and outcome for the compliance reviews.
+// Unlike the query history it is never rewritten: the entries are only
+// appended, the file is rotated when it grows over the maximum size and
+// the oldest rotated files are removed when there are too many of them.
+// The log of the database is queried with information_schema.audit,
+// available only to the superusers and the admin tokens.
+
+// auditFilePrefix and auditFileExtension name the audit log files, the
+// current one is gosqldb.audit.jsonl and the rotated ones are numbered
+// in the order of rotation, gosqldb.audit.1.jsonl, gosqldb.audit.2.jsonl.
+const (
+	auditFilePrefix    = "gosqldb.audit"
+	auditFileExtension = ".jsonl"
+)
+
+// auditTableName is the virtual table of the audit log.
+const auditTableName = "information_schema_audit"
+
+// readsAuditLog reports whether the statement selects from the audit log.
+func readsAuditLog(q sql.Statement) bool {
+	switch query := q.(type) {
+	case *sql.Select:
+		return strings.ToLower(query.Table) == auditTableName
+	case *CountRows:
+		return readsAuditLog(query.Select)
+	case *OrderedSelect:
+		return readsAuditLog(query.Select)
+	case *GroupedSelect:
+		return readsAuditLog(query.Select)
+	case *AsOfSelect:
+		return readsAuditLog(query.Select)
+	}
+
+	return false
+}
+
+// AuditEntry is a record about the executed statement.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`
+	Client string    `json:"client,omitempty"`
+	Query  string    `json:"query"`
+	Rows   int       `json:"rows"`
+	// Success is false for the failed statements, Error tells why.
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditLog is the append-only log of the executed statements.
+type auditLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	syncer   *syncer
+	// encrypts the entries, nil if the encryption is disabled
+	encryption *encryption
+
+	mu sync.Mutex
+	// size of the current file
+	size int64
+	// the number of the last rotated file
+	rotated int
+}
+
+func newAuditLog(dbDir string, maxSize int64, maxFiles int, syncer *syncer, e *encryption) (*auditLog, error) {
+	a := &auditLog{dir: dbDir, maxSize: maxSize, maxFiles: maxFiles, syncer: syncer, encryption: e}
+
+	info, err := os.Stat(a.currentPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read information about %s: %w", a.currentPath(), err)
+	}
+	if err == nil {
+		a.size = info.Size()
+	}
+
+	numbers, err := a.rotatedNumbers()
+	if err != nil {
+		return nil, err
+	}
+	if len(numbers) > 0 {
+		a.rotated = numbers[len(numbers)-1]
+	}
+
+	return a, nil
+}
+
+func (a *auditLog) currentPath() string {
+	return path.Join(a.dir, auditFilePrefix+auditFileExtension)
+}
+
+func (a *auditLog) rotatedPath(number int) string {
+	return path.Join(a.dir, auditFilePrefix+"."+strconv.Itoa(number)+auditFileExtension)
+}
+
+// rotatedNumbers returns the sorted numbers of the rotated files.
+func (a *auditLog) rotatedNumbers() ([]int, error) {
+	entries, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", a.dir, err)
+	}
+
+	numbers := make([]int, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, auditFilePrefix+".") || !strings.HasSuffix(name, auditFileExtension) {
+			continue
+		}
+
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, auditFilePrefix+"."), auditFileExtension))
+		if err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+
+	return numbers, nil
+}
+
+// record appends the entry and rotates the file when it is full.
+func (a *auditLog) record(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	line, err = a.encryption.sealLine(line)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	filePath := a.currentPath()
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer func() { checkFileClose(filePath, file.Close()) }()
+
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", filePath, err)
+	}
+	a.size += int64(len(line))
+
+	return a.syncer.written(filePath, file)
+}
+
+// rotate renames the current file into the next rotated one and
+// removes the oldest rotated files over the limit.
+func (a *auditLog) rotate() error {
+	a.rotated++
+	rotatedPath := a.rotatedPath(a.rotated)
+	if err := os.Rename(a.currentPath(), rotatedPath); err != nil {
+		return fmt.Errorf("failed to rotate file %s: %w", a.currentPath(), err)
+	}
+	a.size = 0
+
+	if err := syncDir(a.dir); err != nil {
+		return err
+	}
+
+	if a.maxFiles <= 0 {
+		return nil
+	}
+
+	numbers, err := a.rotatedNumbers()
+	if err != nil {
+		return err
+	}
+
+	for len(numbers) > a.maxFiles {
+		if err := os.Remove(a.rotatedPath(numbers[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove file %s: %w", a.rotatedPath(numbers[0]), err)
+		}
+		numbers = numbers[1:]
+	}
+
+	return nil
+}
+
+// load reads the entries of the rotated files and the current one
+// in the order they have been recorded.
+func (a *auditLog) load() ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	numbers, err := a.rotatedNumbers()
+	if err != nil {
+		return nil, err
+	}
+
+	filePaths := make([]string, 0, len(numbers)+1)
+	for _, number := range numbers {
+		filePaths = append(filePaths, a.rotatedPath(number))
+	}
+	filePaths = append(filePaths, a.currentPath())
+
+	entries := make([]AuditEntry, 0)
+	for _, filePath := range filePaths {
+		content, err := ioutil.ReadFile(filePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+
+		err = readLines(content, a.encryption, func(line []byte) error {
+			var entry AuditEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return fmt.Errorf("failed to decode audit entry from %s: %w", filePath, err)
+			}
+			entries = append(entries, entry)
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// audit records the executed statement in the audit log if it is
+// enabled, the failures to record are logged.
+func (db *Database) audit(ctx context.Context, q sql.Statement, rows int, queryErr error) {
+	if db.auditLog == nil {
+		return
+	}
+
+	entry := AuditEntry{Time: time.Now().UTC(), Query: fmt.Sprintf("%T", q), Rows: rows, Success: queryErr == nil}
+	if running, ok := ctx.Value(runningQueryKey{}).(*runningQuery); ok {
+		entry.User = running.user
+		entry.Client = running.client
+		entry.Query = running.text
+	}
+	if queryErr != nil {
+		entry.Error = queryErr.Error()
+	}
+
+	if err := db.auditLog.record(entry); err != nil {
+		logging.Errorf("failed to record audit entry: %s", err)
+	}
+}
+
+// auditRows describes the entries of the audit log.
+func (db *Database) auditRows() [][]interface{} {
+	rows := make([][]interface{}, 0)
+	if db.auditLog == nil {
+		return rows
+	}
+
+	entries, err := db.auditLog.load()
+	if err != nil {
+		logging.Errorf("failed to read audit log: %s", err)
+		return rows
+	}
+
+	for _, entry := range entries {
+		success := 0
+		if entry.Success {
+			success = 1
+		}
+
+		rows = append(rows, []interface{}{
+			entry.Time.Format(time.RFC3339Nano),
+			entry.User,
+			entry.Client,
+			entry.Query,
+			entry.Rows,
+			success,
+			entry.Error,
+		})
+	}
+
+	return rows
+}
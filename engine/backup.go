@@ -0,0 +1,275 @@
+package engine
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The backup is a copy of the database directory made while the
+// database is serving the queries. The files are opened under the
+// database lock, and as the data files are replaced, not rewritten,
+// the opened files keep the content of that moment while they are
+// copied. The journals of the active transactions are copied too,
+// so the transactions are rolled back when the backup is opened.
+
+// backupManifestFileName is the name of the file that describes
+// the backup, it is written last, so the backups without it are
+// incomplete.
+const backupManifestFileName = "gosqldb.backup.json"
+
+// Backup represents BACKUP TO "path" statement.
+type Backup struct {
+	Path string
+}
+
+// GetType returns the statement type.
+func (*Backup) GetType() sql.StatementType { return StatementBackup }
+
+// parseBackup parses BACKUP statement.
+func parseBackup(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("BACKUP")
+	if err := s.expectKeyword("TO"); err != nil {
+		return nil, err
+	}
+
+	backupPath, err := s.expectString()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backup{backupPath}, s.expectEnd()
+}
+
+// BackupManifest describes the backup.
+type BackupManifest struct {
+	Created time.Time `json:"created"`
+	// CommitSequence is the sequence number of the last
+	// commit included into the backup.
+	CommitSequence uint64 `json:"commit_sequence"`
+	// ArchiveSequence is the sequence number of the last archive
+	// record included into the backup, the restore applies the
+	// records after it. Zero if the archive is disabled.
+	ArchiveSequence uint64 `json:"archive_sequence,omitempty"`
+	// Files are the CRC-32 checksums of the files by the paths
+	// relative to the backup directory.
+	Files     map[string]string `json:"files"`
+	SizeBytes int64             `json:"size_bytes"`
+}
+
+// String describes the backup.
+func (m *BackupManifest) String() string {
+	return fmt.Sprintf("backup of %d files, %d bytes at commit sequence %d", len(m.Files), m.SizeBytes, m.CommitSequence)
+}
+
+// backupFile is the database file opened for the backup.
+type backupFile struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// Backup copies the database into the new or empty directory.
+func (db *Database) Backup(query *Backup) (*BackupManifest, error) {
+	backupDir, err := filepath.Abs(query.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup path %s: %w", query.Path, err)
+	}
+
+	dbDir, err := filepath.Abs(db.dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid db directory path %s: %w", db.dbDir, err)
+	}
+
+	if backupDir == dbDir || strings.HasPrefix(backupDir, dbDir+string(filepath.Separator)) {
+		return nil, fmt.Errorf("backup directory %s is inside the db directory", backupDir)
+	}
+
+	if err := createEmptyDir(backupDir); err != nil {
+		return nil, err
+	}
+
+	files, manifest, err := db.openBackupFiles()
+	defer func() {
+		for _, f := range files {
+			checkFileClose(f.name, f.file.Close())
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		sum, err := copyBackupFile(f, path.Join(backupDir, f.name))
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Files[f.name] = sum
+		manifest.SizeBytes += f.size
+	}
+
+	if err := syncBackupDirs(backupDir, files); err != nil {
+		return nil, err
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode backup manifest: %w", err)
+	}
+
+	if err := writeSyncedFile(path.Join(backupDir, backupManifestFileName), content); err != nil {
+		return nil, err
+	}
+
+	return manifest, syncDir(backupDir)
+}
+
+// createEmptyDir creates the directory, it fails
+// if the directory exists and is not empty.
+func createEmptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// openBackupFiles opens the database files under the database lock
+// and returns them with the manifest of that moment. The files
+// opened before the failure are returned too, so they are closed.
+func (db *Database) openBackupFiles() ([]backupFile, *BackupManifest, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.openFiles()
+}
+
+// openFiles opens the database files, it must be called
+// with the database lock held.
+func (db *Database) openFiles() ([]backupFile, *BackupManifest, error) {
+	files := make([]backupFile, 0)
+	err := filepath.Walk(db.dbDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(db.dbDir, filePath)
+		if err != nil {
+			return err
+		}
+
+		// the named databases are backed up on their own
+		if info.IsDir() && name == databasesDirName {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() || name == lockFileName || name == replicaStateFileName || name == leaseStateFileName || name == clusterStateFileName || strings.HasSuffix(name, tempFileExtension) {
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to open file %s: %w", filePath, err)
+		}
+
+		// the file that is appended, like the query history,
+		// is copied up to the size it has now
+		files = append(files, backupFile{filepath.ToSlash(name), file, info.Size()})
+
+		return nil
+	})
+	if err != nil {
+		return files, nil, fmt.Errorf("failed to open files of %s: %w", db.dbDir, err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	manifest := &BackupManifest{Created: time.Now().UTC(), CommitSequence: db.csn, Files: make(map[string]string, len(files))}
+	if db.archiver != nil {
+		manifest.ArchiveSequence = db.archiver.sequence
+	}
+
+	return files, manifest, nil
+}
+
+// copyBackupFile copies the opened file and returns its checksum.
+func copyBackupFile(f backupFile, targetPath string) (string, error) {
+	if err := os.MkdirAll(path.Dir(targetPath), 0700); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", path.Dir(targetPath), err)
+	}
+
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file %s: %w", targetPath, err)
+	}
+	defer func() { checkFileClose(targetPath, target.Close()) }()
+
+	hash := crc32.New(crc32Table)
+	if _, err := io.CopyN(io.MultiWriter(target, hash), f.file, f.size); err != nil {
+		return "", fmt.Errorf("failed to copy %s: %w", f.name, err)
+	}
+
+	if err := target.Sync(); err != nil {
+		return "", fmt.Errorf("failed to flush file %s: %w", targetPath, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// syncBackupDirs flushes the subdirectories with the copied files.
+func syncBackupDirs(backupDir string, files []backupFile) error {
+	synced := make(map[string]bool)
+	for _, f := range files {
+		dir := path.Dir(path.Join(backupDir, f.name))
+		if dir == backupDir || synced[dir] {
+			continue
+		}
+
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+		synced[dir] = true
+	}
+
+	return nil
+}
+
+// writeSyncedFile writes the new file and flushes it.
+func writeSyncedFile(filePath string, content []byte) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", filePath, err)
+	}
+	defer func() { checkFileClose(filePath, file.Close()) }()
+
+	if _, err := file.Write(content); err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", filePath, err)
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to flush file %s: %w", filePath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueryTimeout is returned when the statement runs longer than
+// the statement timeout or the deadline of its context.
+var ErrQueryTimeout = errors.New("query has timed out")
+
+// ErrQueryCanceled is returned when the context of the statement
+// is canceled, for example when the client disconnects.
+var ErrQueryCanceled = errors.New("query has been canceled")
+
+// cancelCheckRows is how often the scans check the context,
+// the check is not free for every row.
+const cancelCheckRows = 1024
+
+// statementContext applies the statement timeout to the context,
+// the one of the session takes precedence over the global one.
+func (db *Database) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout, ok := ctx.Value(statementTimeoutKey{}).(time.Duration)
+	if !ok {
+		timeout = time.Duration(atomic.LoadInt64(&db.statementTimeout))
+	}
+
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError returns the error of the done context, nil if
+// the context is not done.
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrQueryTimeout
+	default:
+		return ErrQueryCanceled
+	}
+}
+
+// canceled returns the error of the done context for every
+// cancelCheckRows-th row of the scan, nil for the rest.
+func canceled(ctx context.Context, index int) error {
+	if index%cancelCheckRows != 0 {
+		return nil
+	}
+
+	return contextError(ctx)
+}
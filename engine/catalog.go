@@ -0,0 +1,305 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// One server hosts the main database in the db directory and the named
+// databases in the subdirectories of its databases directory. Every named
+// database has its own tables, meta file, transactions and sessions, and
+// is opened with the options of the main one, but it is neither archived
+// nor replicated. The users, the tokens and the privileges are the ones
+// of the main database: the privileges granted on a table apply to the
+// tables of that name in every database.
+
+// databasesDirName is the directory of the named databases
+// within the db directory.
+const databasesDirName = "databases"
+
+// MainDatabase is the name of the database in the db directory.
+const MainDatabase = "main"
+
+// ErrUseDatabase is returned for USE outside of the connections that
+// keep the selected database.
+var ErrUseDatabase = errors.New("USE is supported only within the connections")
+
+// CreateDatabase represents CREATE DATABASE statement.
+type CreateDatabase struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*CreateDatabase) GetType() sql.StatementType { return StatementCreateDatabase }
+
+// DropDatabase represents DROP DATABASE statement.
+type DropDatabase struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*DropDatabase) GetType() sql.StatementType { return StatementDropDatabase }
+
+// UseDatabase represents USE statement.
+type UseDatabase struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*UseDatabase) GetType() sql.StatementType { return StatementUseDatabase }
+
+// parseDatabaseStatement parses CREATE DATABASE, DROP DATABASE
+// and USE statements.
+func parseDatabaseStatement(s *tokenStream) (sql.Statement, error) {
+	var statement sql.Statement
+	var name *string
+	switch {
+	case s.acceptKeyword("CREATE", "DATABASE"):
+		create := &CreateDatabase{}
+		statement, name = create, &create.Name
+	case s.acceptKeyword("DROP", "DATABASE"):
+		drop := &DropDatabase{}
+		statement, name = drop, &drop.Name
+	default:
+		s.mustKeyword("USE")
+		use := &UseDatabase{}
+		statement, name = use, &use.Name
+	}
+
+	var err error
+	*name, err = s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	return statement, s.expectEnd()
+}
+
+// Catalog keeps the databases hosted by the server.
+type Catalog struct {
+	main *Database
+	dir  string
+
+	mu        sync.Mutex
+	databases map[string]*Database
+}
+
+// OpenCatalog opens the named databases next to the main one. The
+// replicas host only the main database, the named ones are not
+// replicated.
+func OpenCatalog(main *Database) (*Catalog, error) {
+	c := &Catalog{
+		main:      main,
+		dir:       path.Join(main.dbDir, databasesDirName),
+		databases: make(map[string]*Database),
+	}
+	main.catalog = c
+
+	if main.options.Replica {
+		return c, nil
+	}
+
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read directory %s: %w", c.dir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		db, err := c.open(entry.Name())
+		if err != nil {
+			if closeErr := c.Close(); closeErr != nil {
+				logging.Errorf("failed to close databases: %s", closeErr)
+			}
+
+			return nil, fmt.Errorf("failed to open database %s: %w", entry.Name(), err)
+		}
+		c.databases[entry.Name()] = db
+	}
+
+	return c, nil
+}
+
+// open opens the named database in its directory.
+func (c *Catalog) open(name string) (*Database, error) {
+	options := c.main.options
+	options.ArchiveDir = ""
+	options.Failover = false
+	options.LeaderReads = false
+
+	db, err := NewDatabase(path.Join(c.dir, name), options)
+	if err != nil {
+		return nil, err
+	}
+	db.catalog = c
+	db.authority = c.main
+
+	return db, nil
+}
+
+// Database returns the database by the name, the main
+// one for the empty name.
+func (c *Catalog) Database(name string) (*Database, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == MainDatabase {
+		return c.main, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	db, exists := c.databases[name]
+	if !exists {
+		return nil, newError(CodeUndefinedObject, "database %s does not exist", name)
+	}
+
+	return db, nil
+}
+
+// Names returns the sorted names of the databases.
+func (c *Catalog) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := []string{MainDatabase}
+	for name := range c.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// create creates the named database in the new directory.
+func (c *Catalog) create(name string) error {
+	name = strings.ToLower(name)
+	if !isValidTableNameFormat(name) {
+		return fmt.Errorf("database name %s is not valid, expected format: %s", name, tableNameRegExp)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.databases[name]; exists || name == MainDatabase {
+		return newError(CodeDuplicateObject, "database %s exists (database names are case-insensitive)", name)
+	}
+
+	dir := path.Join(c.dir, name)
+	if err := createEmptyDir(dir); err != nil {
+		return err
+	}
+
+	db, err := c.open(name)
+	if err != nil {
+		if removeErr := os.RemoveAll(dir); removeErr != nil {
+			logging.Errorf("failed to remove directory %s: %s", dir, removeErr)
+		}
+
+		return fmt.Errorf("failed to open database %s: %w", name, err)
+	}
+	c.databases[name] = db
+
+	return syncDir(c.dir)
+}
+
+// drop closes the named database and removes its directory.
+func (c *Catalog) drop(name string) error {
+	name = strings.ToLower(name)
+	if name == MainDatabase {
+		return fmt.Errorf("database %s can not be dropped", MainDatabase)
+	}
+
+	c.mu.Lock()
+	db, exists := c.databases[name]
+	delete(c.databases, name)
+	c.mu.Unlock()
+	if !exists {
+		return newError(CodeUndefinedObject, "database %s does not exist", name)
+	}
+
+	// the statements in progress finish first,
+	// the transactions are rolled back
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("failed to close database %s: %w", name, err)
+	}
+
+	dir := path.Join(c.dir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove directory %s: %w", dir, err)
+	}
+
+	return syncDir(c.dir)
+}
+
+// Close closes the named databases, the main one
+// is closed by its owner.
+func (c *Catalog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var closeErr error
+	for name, db := range c.databases {
+		if err := db.Close(); err != nil {
+			closeErr = fmt.Errorf("failed to close database %s: %w", name, err)
+		}
+	}
+	c.databases = make(map[string]*Database)
+
+	return closeErr
+}
+
+// Catalog returns the catalog of the database,
+// nil if the catalog has not been opened.
+func (db *Database) Catalog() *Catalog {
+	return db.catalog
+}
+
+// CreateDatabase creates the named database.
+func (db *Database) CreateDatabase(query *CreateDatabase) error {
+	if db.catalog == nil {
+		return fmt.Errorf("databases are not hosted, the catalog is not opened")
+	}
+
+	return db.catalog.create(query.Name)
+}
+
+// DropDatabase drops the named database with all its tables,
+// the statement is executed in another database.
+func (db *Database) DropDatabase(query *DropDatabase) error {
+	if db.catalog == nil {
+		return fmt.Errorf("databases are not hosted, the catalog is not opened")
+	}
+
+	if target, err := db.catalog.Database(query.Name); err == nil && target == db {
+		return fmt.Errorf("database %s is in use, drop it from another database", strings.ToLower(query.Name))
+	}
+
+	return db.catalog.drop(query.Name)
+}
+
+// checkAuthority fails for the statements that manage the users and
+// the tokens in the named databases, they are managed in the main one.
+func (db *Database) checkAuthority(q sql.Statement) error {
+	if db.authority == nil {
+		return nil
+	}
+
+	switch q.(type) {
+	case *CreateUser, *AlterUser, *DropUser, *Grant, *Revoke, *CreateToken, *DropToken:
+		return fmt.Errorf("the users, the privileges and the tokens are managed in database %s", MainDatabase)
+	}
+
+	return nil
+}
@@ -0,0 +1,448 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The changefeed is the log of the committed row changes for the
+// downstream systems that mirror the tables. Every change has the
+// position, the clients resume the stream after the last position
+// they have processed. The changes of a transaction are appended
+// when it commits, the rolled back ones are never seen.
+
+// name of the file that stores the row changes,
+// one JSON object per line
+const changefeedFileName = "gosqldb.changes.jsonl"
+
+// ErrChangesExpired is returned when the changes after the
+// requested position have been removed by the retention.
+var ErrChangesExpired = errors.New("changes after the position have expired")
+
+// ChangeOperation is the kind of the row change.
+type ChangeOperation string
+
+const (
+	ChangeInsert ChangeOperation = "insert"
+	ChangeUpdate ChangeOperation = "update"
+	ChangeDelete ChangeOperation = "delete"
+)
+
+// Change is the committed change of a table row, the values
+// are by column names.
+type Change struct {
+	Position  uint64          `json:"position"`
+	Time      time.Time       `json:"time"`
+	Table     string          `json:"table"`
+	Operation ChangeOperation `json:"operation"`
+	// Old is nil for the inserts.
+	Old map[string]interface{} `json:"old,omitempty"`
+	// New is nil for the deletes.
+	New map[string]interface{} `json:"new,omitempty"`
+	// Transaction is empty for the changes
+	// outside of the transactions.
+	Transaction string `json:"transaction,omitempty"`
+}
+
+// matches reports whether the change mentions the key and
+// was committed within [from, to).
+func (c Change) matches(key string, from time.Time, to time.Time) bool {
+	if c.Time.Before(from) || !c.Time.Before(to) {
+		return false
+	}
+
+	for _, values := range []map[string]interface{}{c.Old, c.New} {
+		for _, value := range values {
+			if strings.Contains(fmt.Sprint(value), key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// changefeed is the append-only log of the row changes
+// with time-bounded retention.
+type changefeed struct {
+	filePath  string
+	retention time.Duration
+	syncer    *syncer
+	// encrypts the changes, nil if the encryption is disabled
+	encryption *encryption
+
+	mu sync.Mutex
+	// position is the position of the last change
+	position      uint64
+	lastCompacted time.Time
+	// generation grows on every rewrite of the file,
+	// so the streams read it again from the start
+	generation int
+	// changed is closed and replaced on every append
+	changed chan struct{}
+	// stopped is closed when the streams must return
+	stopped chan struct{}
+}
+
+func newChangefeed(dbDir string, retention time.Duration, syncer *syncer, e *encryption) (*changefeed, error) {
+	f := &changefeed{
+		filePath:      path.Join(dbDir, changefeedFileName),
+		retention:     retention,
+		syncer:        syncer,
+		encryption:    e,
+		lastCompacted: time.Now(),
+		changed:       make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	changes, _, err := f.read(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) > 0 {
+		f.position = changes[len(changes)-1].Position
+	}
+
+	return f, nil
+}
+
+func (f *changefeed) name() string {
+	return "changefeed"
+}
+
+// enabled reports whether the changes are captured,
+// the changefeed is disabled if the retention is zero.
+func (f *changefeed) enabled() bool {
+	return f.retention > 0
+}
+
+// append numbers the changes and appends them to the log.
+func (f *changefeed) append(changes []Change) error {
+	if !f.enabled() || len(changes) == 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.lastCompacted) > historyCompactionPeriod {
+		cutoff := time.Now().Add(-f.retention)
+		_, err := f.rewrite(func(c Change) bool { return c.Time.Before(cutoff) })
+		if err != nil {
+			return fmt.Errorf("failed to remove expired changes: %w", err)
+		}
+		f.lastCompacted = time.Now()
+	}
+
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	for i := range changes {
+		changes[i].Position = f.position + uint64(i) + 1
+		changes[i].Time = now
+
+		line, err := json.Marshal(changes[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %w", err)
+		}
+
+		line, err = f.encryption.sealLine(line)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt change: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	file, err := os.OpenFile(f.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", f.filePath, err)
+	}
+	defer func() { checkFileClose(f.filePath, file.Close()) }()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", f.filePath, err)
+	}
+
+	f.position += uint64(len(changes))
+	close(f.changed)
+	f.changed = make(chan struct{})
+
+	return f.syncer.written(f.filePath, file)
+}
+
+// read reads the completely written changes from the offset
+// and returns the number of the read bytes.
+func (f *changefeed) read(offset int64) ([]Change, int64, error) {
+	file, err := os.Open(f.filePath)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open file %s: %w", f.filePath, err)
+	}
+	defer func() { checkFileClose(f.filePath, file.Close()) }()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("failed to read file %s: %w", f.filePath, err)
+	}
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read file %s: %w", f.filePath, err)
+	}
+	content = content[:bytes.LastIndexByte(content, '\n')+1]
+
+	changes := make([]Change, 0)
+	err = readLines(content, f.encryption, func(line []byte) error {
+		var change Change
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&change); err != nil {
+			return fmt.Errorf("failed to decode change from %s: %w", f.filePath, err)
+		}
+		changes = append(changes, change)
+
+		return nil
+	})
+
+	return changes, int64(len(content)), err
+}
+
+// rewrite removes the changes for which remove returns true and
+// returns the number of removed changes. The removed last change is
+// replaced with the marker without the table and the values, so the
+// positions continue after it on the next start.
+func (f *changefeed) rewrite(remove func(Change) bool) (int, error) {
+	changes, _, err := f.read(0)
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	removed := 0
+	for i, change := range changes {
+		last := i == len(changes)-1
+		if change.Table == "" && !last {
+			// the marker is not needed after the next change
+			continue
+		}
+
+		if change.Table != "" && remove(change) {
+			removed++
+			if !last {
+				continue
+			}
+			change = Change{Position: change.Position, Time: change.Time}
+		}
+
+		line, err := json.Marshal(change)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode change: %w", err)
+		}
+
+		line, err = f.encryption.sealLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt change: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	file, err := os.Create(f.filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file %s: %w", f.filePath, err)
+	}
+	defer func() { checkFileClose(f.filePath, file.Close()) }()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to write to file %s: %w", f.filePath, err)
+	}
+	f.generation++
+
+	return removed, f.syncer.written(f.filePath, file)
+}
+
+func (f *changefeed) purge(key string, from time.Time, to time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rewrite(func(c Change) bool { return c.matches(key, from, to) })
+}
+
+func (f *changefeed) count(key string, from time.Time, to time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changes, _, err := f.read(0)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, change := range changes {
+		if change.matches(key, from, to) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// captureChanges records the row changes of the table, the changes of
+// the transaction are appended to the changefeed when it commits. The
+// old and the new rows are in the same order, either can be nil.
+func (db *Database) captureChanges(tx *Transaction, schema Schema, operation ChangeOperation, oldRows [][]interface{}, newRows [][]interface{}) error {
+	if !db.changefeed.enabled() {
+		return nil
+	}
+
+	count := len(oldRows)
+	if len(newRows) > count {
+		count = len(newRows)
+	}
+
+	columns := sortedColumns(schema)
+	changes := make([]Change, count)
+	for i := range changes {
+		changes[i] = Change{Table: schema.Name, Operation: operation}
+		if oldRows != nil {
+			changes[i].Old = rowValues(columns, oldRows[i])
+		}
+		if newRows != nil {
+			changes[i].New = rowValues(columns, newRows[i])
+		}
+	}
+
+	if tx != nil {
+		for i := range changes {
+			changes[i].Transaction = tx.ID
+		}
+		tx.changes = append(tx.changes, changes...)
+
+		return nil
+	}
+
+	if err := db.changefeed.append(changes); err != nil {
+		return fmt.Errorf("failed to capture changes: %w", err)
+	}
+
+	return nil
+}
+
+// rowValues returns the row values by column names.
+func rowValues(columns []ColumnDef, row []interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		if column.Position < len(row) {
+			values[column.Name] = row[column.Position]
+		}
+	}
+
+	return values
+}
+
+// captureCommit appends the changes of the committed transaction,
+// the transaction is committed already, so it can not fail.
+func (db *Database) captureCommit(tx *Transaction) {
+	if err := db.changefeed.append(tx.changes); err != nil {
+		logging.Errorf("failed to capture changes of transaction %s, the changefeed is incomplete: %s", tx.ID, err)
+	}
+}
+
+// ChangePosition returns the position of the last change.
+func (db *Database) ChangePosition() uint64 {
+	f := db.changefeed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.position
+}
+
+// StreamChanges passes the changes of the table after the position to
+// the function as they are committed, the empty table name means all
+// the tables. It returns when the context is done, the function fails
+// or the streams are closed.
+func (db *Database) StreamChanges(ctx context.Context, tableName string, after uint64, fn func(Change) error) error {
+	f := db.changefeed
+	if !f.enabled() {
+		return fmt.Errorf("the changefeed is disabled")
+	}
+	tableName = strings.ToLower(tableName)
+
+	if position := db.ChangePosition(); after > position {
+		return fmt.Errorf("position %d is after the last change %d", after, position)
+	}
+
+	var offset int64
+	generation := -1
+	for {
+		f.mu.Lock()
+		changed := f.changed
+		reread := generation != f.generation
+		if reread {
+			generation, offset = f.generation, 0
+		}
+		changes, read, err := f.read(offset)
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		offset += read
+
+		// the changes the stream has not seen yet may
+		// have been removed while the file was rewritten
+		if reread && after > 0 && len(changes) > 0 && changes[0].Position > after+1 {
+			return fmt.Errorf("%w, the oldest change is %d", ErrChangesExpired, changes[0].Position)
+		}
+
+		for _, change := range changes {
+			if change.Position <= after || change.Table == "" || (tableName != "" && change.Table != tableName) {
+				continue
+			}
+
+			if err := fn(change); err != nil {
+				return err
+			}
+			after = change.Position
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-f.stopped:
+			return nil
+		}
+	}
+}
+
+// CloseChangeStreams ends the change streams, so the server
+// does not wait for the clients on shutdown.
+func (db *Database) CloseChangeStreams() {
+	f := db.changefeed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	select {
+	case <-f.stopped:
+	default:
+		close(f.stopped)
+	}
+}
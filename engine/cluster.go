@@ -0,0 +1,296 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// The cluster replicates the archive of the elected leader to the
+// followers, the followers are the replicas of the leader. A follower
+// of the new leader copies its snapshot over the files it has, so the
+// changes the former leader has not replicated to the quorum are
+// discarded. The writes wait until the quorum has applied them.
+
+// ErrLeaderReads is returned for the reads of the followers
+// of the cluster that serves the reads by the leader.
+var ErrLeaderReads = errors.New("the reads are served by the leader of the cluster")
+
+// ErrNotReplicated is returned for the changes the leader has applied,
+// but the quorum of the cluster has not acknowledged in time.
+var ErrNotReplicated = errors.New("the change has not been replicated to the quorum of the cluster, it may be lost on the leader change")
+
+// clusterStateFileName is the name of the file that stores the term,
+// the vote and the members of the cluster node.
+const clusterStateFileName = "gosqldb.cluster.json"
+
+// CommitWaiter waits until the archive records up to the sequence
+// number are replicated, it fails if they may be lost.
+type CommitWaiter func(ctx context.Context, sequence uint64) error
+
+// SetCommitWaiter sets the function the committed changes wait for
+// before they are reported to the clients, nil does not wait.
+func (db *Database) SetCommitWaiter(w CommitWaiter) {
+	l := db.leadership
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.waiter = w
+}
+
+// waitCommitted waits until the changes of the committed
+// statement are replicated, if the database waits for it.
+func (db *Database) waitCommitted(ctx context.Context) error {
+	l := db.leadership
+	l.mu.Lock()
+	waiter := l.waiter
+	l.mu.Unlock()
+
+	if waiter == nil {
+		return nil
+	}
+
+	return waiter(ctx, db.ArchiveSequence())
+}
+
+// Demote makes the primary the replica of the leader, the active
+// transactions are rolled back, they can not be committed any more.
+func (db *Database) Demote(leader string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.replica != nil {
+		db.SetLeader(leader)
+		return nil
+	}
+
+	for _, tx := range db.transactions {
+		if err := db.rollback(tx); err != nil {
+			return fmt.Errorf("failed to roll back transaction %s: %w", tx.ID, err)
+		}
+	}
+
+	// the replica copies the snapshot of the leader first,
+	// its position is the one of its archive until then
+	db.replica = &replica{
+		transactions: make(map[string][]ReplicationRecord),
+		held:         make(map[string]ReplicationRecord),
+		promoted:     true,
+	}
+
+	l := db.leadership
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.replica, l.fenced, l.leader = true, false, leader
+
+	return nil
+}
+
+// LogPosition returns the term and the sequence number of the last
+// record of the leader archive the node has. The positions of the
+// nodes are comparable within the term, the later term is ahead.
+func (db *Database) LogPosition() (uint64, uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if r := db.replica; r != nil && !r.promoted {
+		return r.received.Term, r.received.Sequence
+	}
+
+	if db.archiver == nil {
+		return 0, 0
+	}
+
+	return db.archiver.lastTerm, db.archiver.sequence
+}
+
+// ArchiveTerm returns the term the archive records are marked with.
+func (db *Database) ArchiveTerm() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.archiver == nil {
+		return 0
+	}
+
+	return db.archiver.term
+}
+
+// StartTerm marks the following archive records with the term of the
+// elected leader and appends the record that starts the term, so the
+// leader is ahead of the nodes that have the records of the former terms.
+func (db *Database) StartTerm(term uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.archiver == nil {
+		return ErrArchiveDisabled
+	}
+
+	db.archiver.term = term
+	if err := db.archiver.append(archiveRecord{}, nil); err != nil {
+		return fmt.Errorf("failed to start term %d: %w", term, err)
+	}
+
+	return nil
+}
+
+// ReadClusterState decodes the stored cluster state of the node
+// into the value, false if the node has not stored it.
+func (db *Database) ReadClusterState(v interface{}) (bool, error) {
+	filePath := path.Join(db.dbDir, clusterStateFileName)
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	if err := json.Unmarshal(content, v); err != nil {
+		return false, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	return true, nil
+}
+
+// WriteClusterState replaces the stored cluster state of the node.
+func (db *Database) WriteClusterState(v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode cluster state: %w", err)
+	}
+
+	return restoreFile(db.dbDir, clusterStateFileName, content)
+}
+
+// resyncSkipped reports whether the file is kept by the replica
+// when it copies the snapshot of the new leader.
+func resyncSkipped(name string) bool {
+	switch name {
+	case lockFileName, replicaStateFileName, leaseStateFileName, clusterStateFileName, historyFileName, changefeedFileName, settingsFileName:
+		return true
+	}
+
+	return strings.HasSuffix(name, tempFileExtension)
+}
+
+// ApplySnapshot replaces the files of the replica with the snapshot of
+// the leader, the files the leader does not have are removed. The
+// changes of the transactions active in the snapshot are rolled back
+// from their journals, the replica receives them again from their
+// first records after the sequence number of the term.
+func (db *Database) ApplySnapshot(files []SnapshotFile, sequence uint64, term uint64) error {
+	contents := make(map[string][]byte, len(files))
+	journals := make([]SnapshotFile, 0)
+	for _, f := range files {
+		name := path.Clean(f.Name)
+		switch {
+		case strings.HasPrefix(name, journalDirName+"/"):
+			journals = append(journals, f)
+		case strings.Contains(name, "/"), resyncSkipped(name):
+		default:
+			contents[name] = f.Content
+		}
+	}
+
+	// the journaled originals replace the uncommitted changes
+	for _, f := range journals {
+		parts := strings.Split(path.Clean(f.Name), "/")
+		if len(parts) != 3 || strings.HasSuffix(parts[1], committedJournalSuffix) {
+			continue
+		}
+
+		name := parts[2]
+		switch {
+		case strings.HasSuffix(name, absentFileExtension):
+			dataFile := strings.TrimSuffix(name, absentFileExtension) + tableFileExtension
+			delete(contents, dataFile)
+			delete(contents, checksumFilePath(dataFile))
+		case strings.HasSuffix(name, tableFileExtension):
+			contents[name] = f.Content
+			if !snapshotHas(journals, parts[1], checksumFilePath(name)) {
+				delete(contents, checksumFilePath(name))
+			}
+		case strings.HasSuffix(name, tableFileExtension+checksumFileExtension):
+			contents[name] = f.Content
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r := db.replica
+	if r == nil {
+		return fmt.Errorf("database is not a replica")
+	}
+
+	existing, err := ioutil.ReadDir(db.dbDir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", db.dbDir, err)
+	}
+
+	changed := make(map[string]bool)
+	for _, entry := range existing {
+		name := entry.Name()
+		if _, kept := contents[name]; kept || entry.IsDir() || resyncSkipped(name) {
+			continue
+		}
+
+		filePath := path.Join(db.dbDir, name)
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("failed to remove file %s: %w", filePath, err)
+		}
+		if err := db.archiveFile(filePath, nil, true); err != nil {
+			return err
+		}
+		changed[name] = true
+	}
+
+	// the meta file is written last, so the tables
+	// have their data files if the copy is interrupted
+	for name, content := range contents {
+		if name == metaFileName {
+			continue
+		}
+
+		if err := db.writeFileBytes(path.Join(db.dbDir, name), content); err != nil {
+			return err
+		}
+		changed[name] = true
+	}
+
+	if content, exists := contents[metaFileName]; exists {
+		if err := db.writeFileBytes(db.metaFilePath, content); err != nil {
+			return err
+		}
+		changed[metaFileName] = true
+	}
+
+	if err := db.reloadReplicated(changed); err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+
+	r.transactions = make(map[string][]ReplicationRecord)
+	r.held = make(map[string]ReplicationRecord)
+	r.status.Sequence, r.status.PrimarySequence, r.status.Term = sequence, sequence, term
+	r.received, r.promoted = replicaPosition{sequence, term}, false
+
+	return writeReplicaState(db.dbDir, sequence, r.received)
+}
+
+// snapshotHas reports whether the journal of the snapshot has the file.
+func snapshotHas(journals []SnapshotFile, journal string, name string) bool {
+	for _, f := range journals {
+		if path.Clean(f.Name) == path.Join(journalDirName, journal, name) {
+			return true
+		}
+	}
+
+	return false
+}
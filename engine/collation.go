@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	sql "github.com/krasun/gosqlparser"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// The collation of the string column defines how its values are
+// compared by the WHERE conditions and sorted by ORDER BY. The string
+// columns of the new tables get the collation of the database options
+// and keep it in the meta file, so changing the option does not change
+// the results of the existing tables:
+//
+//	binary            the bytes are compared, the default
+//	case_insensitive  the values are compared in lowercase
+//	<language tag>    the rules of the language, like de or sv
+//
+// The data files are pruned by the values of the dictionaries, the
+// partitions and the statistics only for the binary columns.
+
+const (
+	// CollationBinary compares the bytes of the values.
+	CollationBinary = "binary"
+	// CollationCaseInsensitive compares the values in lowercase.
+	CollationCaseInsensitive = "case_insensitive"
+)
+
+// collators are the pools of the collators of the languages by the
+// collation names, the collators can not be used concurrently.
+var collators sync.Map
+
+// ParseCollation validates the name of the collation.
+func ParseCollation(name string) (string, error) {
+	switch name {
+	case "", CollationBinary:
+		return CollationBinary, nil
+	case CollationCaseInsensitive:
+		return name, nil
+	}
+
+	if _, err := language.Parse(name); err != nil {
+		return "", fmt.Errorf("unknown collation %s, expected %s, %s or a language tag", name, CollationBinary, CollationCaseInsensitive)
+	}
+
+	return name, nil
+}
+
+// binaryCollation reports whether the values of the
+// collation are compared by their bytes.
+func binaryCollation(collation string) bool {
+	return collation == "" || collation == CollationBinary
+}
+
+// compareStrings compares the strings by the validated collation.
+func compareStrings(collation string, a string, b string) int {
+	switch collation {
+	case "", CollationBinary:
+		return strings.Compare(a, b)
+	case CollationCaseInsensitive:
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	}
+
+	pool, _ := collators.LoadOrStore(collation, &sync.Pool{New: func() interface{} {
+		return collate.New(language.Make(collation))
+	}})
+	c := pool.(*sync.Pool).Get().(*collate.Collator)
+	defer pool.(*sync.Pool).Put(c)
+
+	return c.CompareString(a, b)
+}
+
+// exprCollation returns the collation of the column compared
+// by the operation, binary if there is no column.
+func exprCollation(schema Schema, operation sql.ExprOperation) string {
+	for _, operand := range []sql.Expr{operation.Left, operation.Right} {
+		if identifier, ok := operand.(sql.ExprIdentifier); ok {
+			return schema.Columns[strings.ToLower(identifier.Name)].Collation
+		}
+	}
+
+	return CollationBinary
+}
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The comments describe the tables and the columns where the data lives,
+// they are kept in the meta file and shown by information_schema:
+//
+//	COMMENT ON TABLE users IS "registered users"
+//	COMMENT ON COLUMN users.email IS "verified address"
+//	COMMENT ON COLUMN users.email IS NULL
+//
+// The empty comment or NULL removes the comment.
+
+// Comment represents COMMENT ON TABLE and COMMENT ON COLUMN statements.
+type Comment struct {
+	Table string
+	// Column is empty for the comment of the table.
+	Column string
+	Text   string
+}
+
+// GetType returns the statement type.
+func (*Comment) GetType() sql.StatementType { return StatementComment }
+
+// parseComment parses COMMENT ON statement.
+func parseComment(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("COMMENT", "ON")
+
+	query := &Comment{}
+	switch {
+	case s.acceptKeyword("TABLE"):
+		table, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		query.Table = table
+	case s.acceptKeyword("COLUMN"):
+		name, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+
+		if s.acceptSymbol(".") {
+			// the column of the table of the schema
+			query.Table = name
+			if query.Column, err = s.expectIdentifier(); err != nil {
+				return nil, err
+			}
+		} else {
+			// table.column is rewritten as the qualified name, the
+			// names of the public tables do not have the separator
+			separator := strings.Index(name, schemaSeparator)
+			if separator <= 0 {
+				return nil, fmt.Errorf("column %s must be qualified by the table name", name)
+			}
+			query.Table, query.Column = name[:separator], name[separator+len(schemaSeparator):]
+		}
+	default:
+		return nil, s.unexpected("TABLE or COLUMN")
+	}
+
+	if err := s.expectKeyword("IS"); err != nil {
+		return nil, err
+	}
+
+	if !s.acceptKeyword("NULL") {
+		text, err := s.expectString()
+		if err != nil {
+			return nil, err
+		}
+		query.Text = text
+	}
+
+	return query, s.expectEnd()
+}
+
+// Comment sets or removes the comment of the table or the column.
+func (db *Database) Comment(query *Comment) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(context.Background(), l, tableResource(tableName), lockExclusive); err != nil {
+		return err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	previous := schema
+	if query.Column == "" {
+		schema.Comment = query.Text
+	} else {
+		columnName := strings.ToLower(query.Column)
+		column, exists := schema.Columns[columnName]
+		if !exists {
+			return newError(CodeUndefinedColumn, "column %s does not exist in table %s", columnName, tableName)
+		}
+
+		// the schemas are shared with the open views
+		columns := make(map[string]ColumnDef, len(schema.Columns))
+		for name, def := range schema.Columns {
+			columns[name] = def
+		}
+		column.Comment = query.Text
+		columns[columnName] = column
+		schema.Columns = columns
+	}
+	db.replaceSchema(schema)
+
+	if err := db.storeTables(); err != nil {
+		db.tables[tableName] = previous
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	return nil
+}
+
+// commentStatements renders the statements that comment
+// the table and its columns.
+func commentStatements(schema Schema) []string {
+	var statements []string
+	if schema.Comment != "" {
+		statements = append(statements, fmt.Sprintf("COMMENT ON TABLE %s IS %s", sqlName(schema.Name), quoteString(schema.Comment)))
+	}
+	for _, column := range dumpedColumns(schema) {
+		if column.Comment != "" {
+			statements = append(statements, fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", sqlName(schema.Name), sqlName(column.Name), quoteString(column.Comment)))
+		}
+	}
+
+	return statements
+}
@@ -0,0 +1,545 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Copy represents the statement that loads the CSV file into the
+// table or writes the rows of the table or of the query to the CSV
+// or Parquet file:
+//
+//	COPY table [(column, ...)] FROM|TO "file.csv" [WITH (HEADER, DELIMITER ";")]
+//	COPY (SELECT ...) TO "file.parquet" WITH (FORMAT PARQUET)
+//
+// The file is read and written by the database server, the clients
+// stream the file with CopyFrom and CopyTo instead.
+type Copy struct {
+	Table string
+	// Columns are the columns of the CSV records, all the table
+	// columns in the order of the row values if empty.
+	Columns []string
+	// Query is the copied query of COPY (SELECT ...) TO.
+	Query *sql.Select
+	Path  string
+	// To is true for COPY ... TO.
+	To     bool
+	Format CopyFormat
+	CSVOptions
+}
+
+// CopyFormat is the format of the copied file.
+type CopyFormat string
+
+const (
+	// CopyCSV is the default format.
+	CopyCSV CopyFormat = "csv"
+	// CopyParquet is the Parquet file, it is supported only by COPY ... TO.
+	CopyParquet CopyFormat = "parquet"
+)
+
+// CSVOptions describe the format of the CSV.
+type CSVOptions struct {
+	// Header is true if the first record names the columns,
+	// COPY ... FROM without the columns reads them from it.
+	Header bool
+	// Delimiter separates the fields, comma if zero.
+	Delimiter rune
+}
+
+// GetType returns the statement type.
+func (*Copy) GetType() sql.StatementType { return StatementCopy }
+
+// parseCopy parses COPY statement.
+func parseCopy(query string, s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("COPY")
+	if t := s.peek(); t.kind == tokenSymbol && t.value == "(" {
+		return parseCopyQuery(query, s)
+	}
+
+	table, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &Copy{Table: table}
+	if s.acceptSymbol("(") {
+		for {
+			column, err := s.expectIdentifier()
+			if err != nil {
+				return nil, err
+			}
+			statement.Columns = append(statement.Columns, column)
+
+			if !s.acceptSymbol(",") {
+				break
+			}
+		}
+
+		if err := s.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case s.acceptKeyword("FROM"):
+	case s.acceptKeyword("TO"):
+		statement.To = true
+	default:
+		return nil, s.unexpected("FROM or TO")
+	}
+
+	return parseCopyFile(s, statement)
+}
+
+// parseCopyQuery parses COPY (SELECT ...) TO statement.
+func parseCopyQuery(query string, s *tokenStream) (sql.Statement, error) {
+	open := s.next()
+	depth := 1
+	for depth > 0 {
+		t := s.next()
+		switch {
+		case t.kind == tokenEnd:
+			return nil, &SyntaxError{fmt.Sprintf("unclosed parenthesis at %d", open.pos), open.pos}
+		case t.kind == tokenSymbol && t.value == "(":
+			depth++
+		case t.kind == tokenSymbol && t.value == ")":
+			depth--
+		}
+	}
+	end := s.tokens[s.pos-1].pos
+
+	// the blanked prefix keeps the error positions
+	offset := open.pos + 1
+	parsed, err := parseRewritten(strings.Repeat(" ", offset) + query[offset:end])
+	if err != nil {
+		return nil, err
+	}
+
+	selected, ok := parsed.(*sql.Select)
+	if !ok {
+		return nil, &SyntaxError{fmt.Sprintf("COPY supports only SELECT queries, got %T", parsed), offset}
+	}
+
+	if err := s.expectKeyword("TO"); err != nil {
+		return nil, err
+	}
+
+	return parseCopyFile(s, &Copy{Table: selected.Table, Columns: selected.Columns, Query: selected, To: true})
+}
+
+// parseCopyFile parses the file and the options of COPY.
+func parseCopyFile(s *tokenStream, statement *Copy) (sql.Statement, error) {
+	var err error
+	if statement.Path, err = s.expectString(); err != nil {
+		return nil, err
+	}
+
+	if s.acceptKeyword("WITH") {
+		if err := parseCopyOptions(s, statement); err != nil {
+			return nil, err
+		}
+	}
+
+	return statement, s.expectEnd()
+}
+
+// parseCopyOptions parses the parenthesized options of COPY.
+func parseCopyOptions(s *tokenStream, statement *Copy) error {
+	if err := s.expectSymbol("("); err != nil {
+		return err
+	}
+
+	options := &statement.CSVOptions
+	for {
+		switch {
+		case s.isKeyword("FORMAT"):
+			t := s.next()
+			switch {
+			case s.acceptKeyword("CSV"):
+				statement.Format = CopyCSV
+			case s.acceptKeyword("PARQUET"):
+				if !statement.To {
+					return &SyntaxError{"PARQUET format is supported only by COPY ... TO", t.pos}
+				}
+				statement.Format = CopyParquet
+			default:
+				return s.unexpected("CSV or PARQUET")
+			}
+		case s.acceptKeyword("HEADER"):
+			options.Header = true
+		case s.isKeyword("DELIMITER"):
+			t := s.next()
+			delimiter, err := s.expectString()
+			if err != nil {
+				return err
+			}
+
+			r, size := utf8.DecodeRuneInString(delimiter)
+			if size == 0 || size != len(delimiter) {
+				return &SyntaxError{fmt.Sprintf("delimiter must be one character, but got %q", delimiter), t.pos}
+			}
+			options.Delimiter = r
+		default:
+			return s.unexpected("FORMAT, HEADER or DELIMITER")
+		}
+
+		if !s.acceptSymbol(",") {
+			break
+		}
+	}
+
+	return s.expectSymbol(")")
+}
+
+// csvDelimiter returns the delimiter of the options.
+func (o CSVOptions) csvDelimiter() (rune, error) {
+	if o.Delimiter == 0 {
+		return ',', nil
+	}
+
+	if o.Delimiter == '"' || o.Delimiter == '\r' || o.Delimiter == '\n' || o.Delimiter == utf8.RuneError {
+		return 0, fmt.Errorf("invalid delimiter %q", o.Delimiter)
+	}
+
+	return o.Delimiter, nil
+}
+
+// Copy reads or writes the CSV file of the statement.
+func (db *Database) Copy(ctx context.Context, query *Copy) (int, error) {
+	tx, err := db.Begin(db.options.Isolation)
+	if err != nil {
+		return 0, err
+	}
+
+	copied, err := tx.Copy(ctx, query)
+	if err != nil {
+		rollbackCopy(tx)
+		return 0, err
+	}
+
+	return copied, tx.Commit()
+}
+
+// CopyFrom inserts the rows of the CSV into the table of the statement,
+// the path of the statement is ignored. All the rows are inserted in one
+// transaction, so none are inserted if any of the records is invalid.
+func (db *Database) CopyFrom(ctx context.Context, query *Copy, r io.Reader) (int, error) {
+	tx, err := db.Begin(db.options.Isolation)
+	if err != nil {
+		return 0, err
+	}
+
+	copied, err := tx.CopyFrom(ctx, query, r)
+	if err != nil {
+		rollbackCopy(tx)
+		return 0, err
+	}
+
+	return copied, tx.Commit()
+}
+
+// CopyTo writes the rows of the table of the statement as the CSV, the
+// path of the statement is ignored. The rows are read within a repeatable
+// read transaction, so the table is written consistently.
+func (db *Database) CopyTo(ctx context.Context, query *Copy, w io.Writer) (int, error) {
+	tx, err := db.Begin(RepeatableRead)
+	if err != nil {
+		return 0, err
+	}
+	defer rollbackCopy(tx)
+
+	return tx.CopyTo(ctx, query, w)
+}
+
+// rollbackCopy rolls back the transaction of the copy.
+func rollbackCopy(tx *Transaction) {
+	if err := tx.Rollback(); err != nil {
+		logging.Errorf("failed to roll back copy transaction %s: %s", tx.ID, err)
+	}
+}
+
+// Copy reads or writes the CSV file of the statement within the transaction.
+func (tx *Transaction) Copy(ctx context.Context, query *Copy) (int, error) {
+	if query.To {
+		file, err := os.Create(query.Path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create %s: %w", query.Path, err)
+		}
+
+		copied, err := tx.CopyTo(ctx, query, file)
+		if err != nil {
+			checkFileClose(query.Path, file.Close())
+			return 0, err
+		}
+
+		if err := file.Close(); err != nil {
+			return 0, fmt.Errorf("failed to close %s: %w", query.Path, err)
+		}
+
+		return copied, nil
+	}
+
+	file, err := os.Open(query.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", query.Path, err)
+	}
+	defer func() { checkFileClose(query.Path, file.Close()) }()
+
+	return tx.CopyFrom(ctx, query, file)
+}
+
+// CopyFrom inserts the rows of the CSV within the transaction.
+func (tx *Transaction) CopyFrom(ctx context.Context, query *Copy, r io.Reader) (int, error) {
+	if query.Format != "" && query.Format != CopyCSV {
+		return 0, fmt.Errorf("%s format is supported only by COPY ... TO", query.Format)
+	}
+
+	schema, err := tx.db.Schema(query.Table)
+	if err != nil {
+		return 0, err
+	}
+
+	source, err := newCSVSource(r, schema, query.Columns, query.CSVOptions)
+	if err != nil {
+		return 0, err
+	}
+
+	return loadBatches(source, func(rows [][]interface{}) (int, error) {
+		return tx.insertRows(ctx, schema.Name, source.names, rows)
+	})
+}
+
+// csvSource reads the rows of the CSV coerced to the column types.
+type csvSource struct {
+	reader *csv.Reader
+	names  []string
+	types  []sql.ColumnType
+	number int
+}
+
+// newCSVSource reads the header of the CSV if there is one. The
+// columns are taken from the header if they are not given and
+// are all the table columns if there is no header.
+func newCSVSource(r io.Reader, schema Schema, columns []string, options CSVOptions) (*csvSource, error) {
+	delimiter, err := options.csvDelimiter()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.Comma = delimiter
+
+	if options.Header {
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV header: %w", err)
+		}
+
+		if len(columns) == 0 {
+			columns = make([]string, len(header))
+			for i, name := range header {
+				columns[i] = strings.TrimSpace(name)
+			}
+		}
+	}
+	if len(columns) == 0 {
+		for _, column := range writableColumns(schema) {
+			columns = append(columns, column.Name)
+		}
+	}
+
+	types := make([]sql.ColumnType, len(columns))
+	for i, name := range columns {
+		column, exists := schema.Columns[strings.ToLower(name)]
+		if !exists {
+			return nil, newError(CodeUndefinedColumn, "column %s does not exist in table %s", name, schema.Name)
+		}
+		types[i] = column.Type
+	}
+
+	return &csvSource{reader: reader, names: columns, types: types}, nil
+}
+
+func (s *csvSource) columns() []string {
+	return s.names
+}
+
+func (s *csvSource) position() string {
+	return fmt.Sprintf("record %d", s.number)
+}
+
+func (s *csvSource) next() ([]interface{}, error) {
+	record, err := s.reader.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	s.number++
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV: %w", err)
+	}
+
+	if len(record) != len(s.names) {
+		return nil, fmt.Errorf("expected %d fields, but got %d", len(s.names), len(record))
+	}
+
+	row := make([]interface{}, len(record))
+	for i, field := range record {
+		if s.types[i] != sql.TypeInteger {
+			row[i] = field
+			continue
+		}
+
+		value, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q for column %s", field, s.names[i])
+		}
+		row[i] = value
+	}
+
+	return row, nil
+}
+
+// insertRows inserts the rows within the transaction.
+func (tx *Transaction) insertRows(ctx context.Context, table string, columns []string, rows [][]interface{}) (int, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return 0, err
+	}
+	tx.queried = true
+
+	return tx.db.insertRows(ctx, table, columns, rows, tx)
+}
+
+// CopyTo writes the rows of the table or of the query as the CSV
+// or Parquet within the transaction.
+func (tx *Transaction) CopyTo(ctx context.Context, query *Copy, w io.Writer) (int, error) {
+	schema, err := tx.db.Schema(query.Table)
+	if err != nil {
+		return 0, err
+	}
+
+	all := dumpedColumns(schema)
+	names := make([]string, len(all))
+	for i, column := range all {
+		names[i] = column.Name
+	}
+
+	columns := all
+	if len(query.Columns) > 0 && !(len(query.Columns) == 1 && query.Columns[0] == "*") {
+		columns = make([]ColumnDef, len(query.Columns))
+		for i, name := range query.Columns {
+			column, exists := schema.Columns[strings.ToLower(name)]
+			if !exists || column.Name == versionColumn {
+				return 0, newError(CodeUndefinedColumn, "column %s does not exist in table %s", name, schema.Name)
+			}
+			columns[i] = column
+		}
+	}
+
+	var writer rowWriter
+	switch query.Format {
+	case "", CopyCSV:
+		writer, err = newCSVWriter(w, columns, query.CSVOptions)
+	case CopyParquet:
+		writer, err = newParquetWriter(w, columns)
+	default:
+		err = fmt.Errorf("unsupported format %q", query.Format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	selected := &sql.Select{Table: schema.Name, Columns: names}
+	if query.Query != nil {
+		selected.Where = query.Query.Where
+	}
+
+	copied := 0
+	values := make([]interface{}, len(columns))
+	err = tx.SelectEachContext(ctx, selected, func(row []interface{}) error {
+		for i, column := range columns {
+			values[i] = row[column.Position]
+		}
+		copied++
+
+		return writer.writeRow(values)
+	})
+	if err != nil {
+		return copied, fmt.Errorf("failed to copy table %s: %w", schema.Name, err)
+	}
+
+	return copied, writer.close()
+}
+
+// rowWriter writes the copied rows in the format of the file.
+type rowWriter interface {
+	writeRow(values []interface{}) error
+	// close flushes the rows.
+	close() error
+}
+
+// csvWriter writes the rows as the CSV.
+type csvWriter struct {
+	writer *csv.Writer
+	record []string
+}
+
+// newCSVWriter writes the header if it is required.
+func newCSVWriter(w io.Writer, columns []ColumnDef, options CSVOptions) (*csvWriter, error) {
+	delimiter, err := options.csvDelimiter()
+	if err != nil {
+		return nil, err
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+	record := make([]string, len(columns))
+	if options.Header {
+		for i, column := range columns {
+			record[i] = column.Name
+		}
+
+		if err := writer.Write(record); err != nil {
+			return nil, fmt.Errorf("failed to write CSV: %w", err)
+		}
+	}
+
+	return &csvWriter{writer, record}, nil
+}
+
+func (c *csvWriter) writeRow(values []interface{}) error {
+	for i, value := range values {
+		if v, ok := value.(int); ok {
+			c.record[i] = strconv.Itoa(v)
+		} else {
+			c.record[i] = fmt.Sprint(value)
+		}
+	}
+
+	return c.writer.Write(c.record)
+}
+
+func (c *csvWriter) close() error {
+	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+
+	return nil
+}
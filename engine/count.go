@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// CountRows represents SELECT COUNT(*) FROM table [WHERE ...] statement,
+// the result is a single row with the number of the matched rows.
+//
+// COUNT(*) without WHERE is answered from the row count of the table
+// statistics without scanning the data when the statistics describe
+// the rows the reader sees: no other open transaction has changed the
+// table and the last committed change of the table is visible in the
+// snapshot of the reader. Otherwise the rows are counted by the scan.
+type CountRows struct {
+	*sql.Select
+}
+
+// GetType returns the statement type.
+func (*CountRows) GetType() sql.StatementType { return StatementCountRows }
+
+// isCountRows reports whether the statement is SELECT COUNT(*).
+func isCountRows(s *tokenStream) bool {
+	if !s.isKeyword("SELECT", "COUNT") || s.pos+5 >= len(s.tokens) {
+		return false
+	}
+
+	open, star, close := s.tokens[s.pos+2], s.tokens[s.pos+3], s.tokens[s.pos+4]
+
+	return open.value == "(" && star.value == "*" && close.value == ")"
+}
+
+// parseCountRows parses SELECT COUNT(*) FROM table [WHERE ...], the
+// count is replaced with a column name for gosqlparser.
+func parseCountRows(query string, s *tokenStream) (sql.Statement, error) {
+	count, close := s.tokens[s.pos+1], s.tokens[s.pos+4]
+	statement, err := sql.Parse(protectEscapedQuotes(query[:count.pos] + "count" + query[close.pos+1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	selected := statement.(*sql.Select)
+	selected.Columns = nil
+	if selected.Limit != "" {
+		return nil, fmt.Errorf("LIMIT is not supported with COUNT(*)")
+	}
+
+	return &CountRows{selected}, nil
+}
+
+// CountContext counts the rows of the table matched by the condition.
+func (db *Database) CountContext(ctx context.Context, query *CountRows) ([][]interface{}, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.countRows(ctx, query, nil)
+}
+
+// CountContext counts the rows of the table matched by the condition
+// within the transaction.
+func (tx *Transaction) CountContext(ctx context.Context, query *CountRows) ([][]interface{}, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return nil, err
+	}
+	tx.queried = true
+
+	return tx.db.countRows(ctx, query, tx)
+}
+
+// countRows counts the rows, it must be called with the database locked.
+func (db *Database) countRows(ctx context.Context, query *CountRows, tx *Transaction) ([][]interface{}, error) {
+	tableName := strings.ToLower(query.Table)
+	if schema, exists := db.tables[tableName]; exists && query.Where == nil {
+		if tx != nil {
+			storages, err := db.accessPlan(ctx, "SELECT", schema, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := db.lockRead(ctx, tx, tableName, storages); err != nil {
+				return nil, err
+			}
+		}
+
+		if db.rowCountVisible(tableName, tx) {
+			return [][]interface{}{{schema.Stats.RowCount}}, nil
+		}
+	}
+
+	count := 0
+	err := db.selectEach(ctx, query.Select, nil, tx, func(row []interface{}) error {
+		count++
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]interface{}{{count}}, nil
+}
+
+// rowCountVisible reports whether the row count of the table statistics
+// is the number of the rows visible to the transaction or, without it,
+// to the statement.
+func (db *Database) rowCountVisible(tableName string, tx *Transaction) bool {
+	for _, other := range db.transactions {
+		if other == tx {
+			continue
+		}
+
+		if _, changed := other.tables[tableName]; changed {
+			return false
+		}
+	}
+
+	csn := db.csn
+	if tx != nil && tx.snapshot != nil {
+		csn = tx.snapshot.csn
+	}
+
+	return db.changedCSN[tableName] <= csn
+}
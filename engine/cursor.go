@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The paged selection returns the matched rows by pages and the cursor
+// of the next page, the cursor is the position of the scan: the table
+// or the partition and the index of the row in it. The next page is
+// scanned from the position, the rows before it are neither matched
+// nor decoded. Like the offset, the position is not stable across the
+// changes: the rows deleted before it shift the rows, so the rows
+// changed between the pages can be skipped or returned twice.
+
+// ErrInvalidCursor is returned for the cursor that is malformed,
+// belongs to another query or whose partition has been dropped.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is the position of the paged selection.
+type Cursor struct {
+	// Query is the hash of the normalized statement.
+	Query string `json:"q"`
+	// Storage is the table or the partition of the next row.
+	Storage string `json:"s"`
+	// Row is the index of the next row in the storage.
+	Row int `json:"r"`
+	// Size is the number of the rows in the page.
+	Size int `json:"n"`
+}
+
+// String returns the opaque token of the cursor.
+func (c *Cursor) String() string {
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		// the cursor has only strings and integers
+		panic(fmt.Errorf("failed to encode cursor: %w", err))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// ParseCursor parses the token returned by Cursor.String.
+func ParseCursor(token string) (*Cursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal(decoded, &cursor); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+
+	if cursor.Row < 0 || cursor.Size <= 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// cursorQuery is the hash of the statement the cursor belongs to.
+func cursorQuery(query *sql.Select) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(resultKey(query)))
+
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// SelectPageContext selects the page of the rows from the cursor, the
+// first page if the cursor is nil, and returns the cursor of the next
+// page, nil if there are no more rows.
+func (db *Database) SelectPageContext(ctx context.Context, query *sql.Select, after *Cursor, size int) (rows [][]interface{}, next *Cursor, err error) {
+	started := time.Now()
+	defer func() { db.logQuery(ctx, query, started, len(rows), err) }()
+
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows, next, err = db.selectPage(ctx, query, after, size, nil)
+
+	return maskRows(masks, rows), next, err
+}
+
+// SelectPageContext selects the page of the rows within the transaction.
+func (tx *Transaction) SelectPageContext(ctx context.Context, query *sql.Select, after *Cursor, size int) (rows [][]interface{}, next *Cursor, err error) {
+	started := time.Now()
+	defer func() { tx.db.logQuery(ctx, query, started, len(rows), err) }()
+
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	masks := tx.db.queryMasks(ctx, query.Table)
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return nil, nil, err
+	}
+	tx.queried = true
+
+	rows, next, err = tx.db.selectPage(ctx, query, after, size, tx)
+
+	return maskRows(masks, rows), next, err
+}
+
+// selectPage selects the page of the rows, it must be called
+// with the database locked.
+func (db *Database) selectPage(ctx context.Context, query *sql.Select, after *Cursor, size int, tx *Transaction) ([][]interface{}, *Cursor, error) {
+	key := cursorQuery(query)
+	if after != nil {
+		if after.Query != key {
+			return nil, nil, fmt.Errorf("%w: the cursor belongs to another query", ErrInvalidCursor)
+		}
+		size = after.Size
+	}
+	if size <= 0 {
+		return nil, nil, fmt.Errorf("page size must be positive, got %d", size)
+	}
+
+	tableName := strings.ToLower(query.Table)
+	schema, exists := db.tables[tableName]
+	if !exists {
+		table, exists := virtualTables[tableName]
+		if !exists {
+			return nil, nil, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+		}
+
+		rows, err := db.selectVirtual(ctx, table, query)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		start := 0
+		if after != nil {
+			start = after.Row
+		}
+		if start >= len(rows) {
+			return [][]interface{}{}, nil, nil
+		}
+		if start+size >= len(rows) {
+			return rows[start:], nil, nil
+		}
+
+		return rows[start : start+size], &Cursor{Query: key, Storage: tableName, Row: start + size, Size: size}, nil
+	}
+
+	storages, err := db.accessPlan(ctx, "SELECT", schema, query.Where)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid WHERE part: %w", err)
+	}
+
+	first := 0
+	if after != nil {
+		first = -1
+		for i, name := range storages {
+			if name == after.Storage {
+				first = i
+			}
+		}
+		if first < 0 {
+			return nil, nil, fmt.Errorf("%w: %s does not exist", ErrInvalidCursor, after.Storage)
+		}
+	}
+
+	if tx != nil {
+		if err := db.lockRead(ctx, tx, tableName, storages); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := db.checkSchema(tx, schema); err != nil {
+		return nil, nil, err
+	}
+
+	view, err := db.openView(tx, schema, storages[first:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db.mu.Unlock()
+	rows, next, err := scanPage(ctx, view, query.Where, after, size)
+	db.mu.Lock()
+	db.closeView(view)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if next != nil {
+		next.Query = key
+	}
+
+	return rows, next, nil
+}
+
+// scanPage collects the page of the rows matched by the condition from
+// the cursor, it does not need the database lock. The returned cursor
+// points to the first matched row after the page.
+func scanPage(ctx context.Context, view *readView, where *sql.Where, after *Cursor, size int) ([][]interface{}, *Cursor, error) {
+	rows := make([][]interface{}, 0, size)
+	var next *Cursor
+	for i, storage := range view.storages {
+		start := 0
+		if after != nil && i == 0 {
+			start = after.Row
+		}
+
+		var fErr error
+		err := storage.scanFrom(view.schema, view.snapshot, start, func(index int, row []interface{}) bool {
+			if fErr = canceled(ctx, index); fErr != nil {
+				return false
+			}
+
+			if !matches(view.schema, row, where) {
+				return true
+			}
+
+			if len(rows) == size {
+				next = &Cursor{Storage: storage.name, Row: index, Size: size}
+				return false
+			}
+			rows = append(rows, row)
+
+			return true
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan %s: %w", storage.name, err)
+		}
+
+		if fErr != nil {
+			return nil, nil, fErr
+		}
+
+		if next != nil {
+			break
+		}
+	}
+
+	return rows, next, nil
+}
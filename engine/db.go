@@ -0,0 +1,2122 @@
+// Package engine is the gosqldb database engine, it can be embedded
+// into a program without the server:
+//
+//	db, err := engine.NewDatabase(dbDir, engine.Options{})
+//	...
+//	statement, err := engine.Parse("SELECT id, name FROM users WHERE id == 1")
+//	...
+//	rows, err := db.Execute(statement)
+//
+// The names of the tables and the columns are case-insensitive unless
+// they are quoted. The double quotes enclose the strings, so the names
+// are quoted with backticks as in MySQL, not with the double quotes of
+// standard SQL, and the names starting with _quoted are reserved:
+//
+//	CREATE TABLE `UserEvents` (`UserID` INTEGER)
+//
+// The process must lock the db directory with LockDir first,
+// so another process does not open the same directory.
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	"github.com/krasun/gosqldb/internal/tracing"
+	sql "github.com/krasun/gosqlparser"
+)
+
+var columnTypes = map[sql.ColumnType]struct{}{
+	sql.TypeInteger: {},
+	sql.TypeString:  {},
+}
+
+// regular expressions to check table and column names
+var entityNameRegExp = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
+var tableNameRegExp = entityNameRegExp
+var isValidTableNameFormat = entityNameRegExp.MatchString
+var columnNameRegExp = entityNameRegExp
+var isValidColumnNameFormat = entityNameRegExp.MatchString
+
+// name of the meta file that stores information about
+// table structures and other database meta information
+const metaFileName = "gosqldb.meta.json"
+
+// table file extension
+const tableFileExtension = ".table.json"
+
+// extension of the file that is written before
+// it replaces the original one
+const tempFileExtension = ".tmp"
+
+// Database is an orchestractor and main entry point for working
+// with a database.
+type Database struct {
+	// guards tables, data and files, the selections release it
+	// while they scan the captured views (see selectEach)
+	mu sync.Mutex
+	// a dbDir to the directory where the database stores
+	// all the data
+	dbDir string
+	// path to the meta file that stores information about
+	// table structures and other database meta information
+	metaFilePath string
+	// pointers to the tables
+	// by lowercase table names
+	tables map[string]Schema
+	// row versions by storage name, the table name or
+	// the table and partition names for partitioned tables
+	data map[string][]*rowVersion
+	// the last commit sequence number
+	csn uint64
+	// active snapshots of the readers and transactions
+	snapshots map[*snapshot]struct{}
+	// storage names of tables and partitions that are not loaded
+	// into memory and read through the memory-mapped files
+	mapped map[string]bool
+	// options the database has been opened with
+	options Options
+	// flushes written files according to the fsync policy
+	syncer *syncer
+	// encrypts the files, nil if the encryption is disabled
+	encryption *encryption
+	// verifies data files in the background
+	scrubber *scrubber
+	// removes obsolete row versions in the background
+	vacuum *vacuum
+	// log of the executed queries
+	history *queryHistory
+	// log of the committed row changes
+	changefeed *changefeed
+	// log of the executed statements, nil if disabled
+	auditLog *auditLog
+	// stores that can be purged for data-retention compliance
+	purgeables []purgeable
+	// registered prepared statements
+	prepared *preparedStatements
+	// active transactions by identifiers
+	transactions map[string]*Transaction
+	// open client sessions
+	sessions *sessions
+	// table and storage locks of the transactions and statements
+	locks *lockManager
+	// user accounts by lowercase names
+	users map[string]*user
+	// API tokens by lowercase names
+	tokens map[string]*apiToken
+	// schemas of the tables by lowercase names, without the public one
+	schemas map[string]struct{}
+	// sequences by their names
+	sequences map[string]*sequence
+	// the commit sequence numbers of the last committed
+	// changes of the data by table names
+	changedCSN map[string]uint64
+	// running queries that can be killed
+	processes *processList
+	// when the database has been opened
+	started time.Time
+	// archives the changed files, nil if the archive is disabled
+	archiver *archiver
+	// replication state, nil if the database is not a replica
+	replica *replica
+	// failover role of the node
+	leadership *leadership
+	// parsed statements by text, nil if the cache is disabled
+	statements *statementCache
+	// results of the SELECTs, nil if the cache is disabled
+	results *resultCache
+	// schemaVersion grows with every change of the table schemas
+	schemaVersion uint64
+	// groupCommit writes the concurrent inserts together,
+	// nil if group commit is disabled
+	groupCommit *groupCommitter
+	// readOnly is not zero while the changes are rejected
+	readOnly int32
+	// statementTimeout is the time.Duration of the statement
+	// timeout, it is changed by SET GLOBAL statement_timeout
+	statementTimeout int64
+	// settings are the ones changed by SET GLOBAL, the defaults
+	// are the values of the settings the database is opened with
+	settings        map[string]string
+	defaultSettings map[string]string
+	// disk is the state of the free space checks
+	disk diskGuard
+	// catalog hosts the database, nil if it has not been opened
+	catalog *Catalog
+	// authority is the main database that authorizes the named
+	// database, nil for the main one
+	authority *Database
+	// serializes the schema migrations
+	migrations sync.Mutex
+	// memory of the sorts and the aggregations of the queries
+	memory memoryAccountant
+	// counters of the ORDER BY sorts
+	sorts spillCounters
+	// counters of the GROUP BY aggregations
+	aggregates spillCounters
+}
+
+// Options configures the database.
+type Options struct {
+	// Fsync defines when written files are flushed to the stable storage.
+	Fsync FsyncPolicy
+	// FsyncInterval is the flush period for the interval fsync policy.
+	FsyncInterval time.Duration
+	// MmapThreshold is the table file size in bytes starting from which
+	// the table is not kept in memory, but scanned through the memory-mapped
+	// file. The table is moved back into memory when its file shrinks below
+	// the half of the threshold. Zero disables memory mapping.
+	MmapThreshold int64
+	// SegmentRows is the number of rows of the table or partition data
+	// file after which the new rows go to the next segment file, so the
+	// changes rewrite only the segments with the changed rows. Zero keeps
+	// all the rows in a single file.
+	SegmentRows int
+	// MaxRowSize is the maximum size of the encoded row in bytes,
+	// zero means no limit.
+	MaxRowSize int
+	// MaxValueSize is the maximum size of a single value in bytes,
+	// zero means no limit.
+	MaxValueSize int
+	// MaxTableRows is the maximum number of the rows of a table,
+	// zero means no limit.
+	MaxTableRows int
+	// MaxDatabaseSize is the maximum size in bytes of the data files
+	// of the tables, the inserts and the updates over it are rejected
+	// while the deletes are allowed. Zero means no limit.
+	MaxDatabaseSize int64
+	// ScrubInterval is the pause between the background integrity
+	// checks of the data files, zero disables the checks.
+	ScrubInterval time.Duration
+	// StorageModes override the storage mode by table names,
+	// the tables that are not listed use StorageAuto.
+	StorageModes map[string]StorageMode
+	// VacuumInterval is the pause between the background removals
+	// of the row versions that are not visible to anyone,
+	// zero disables the removal.
+	VacuumInterval time.Duration
+	// LockTimeout is how long the statement waits for the table
+	// locks held by others, zero means no timeout.
+	LockTimeout time.Duration
+	// StatementTimeout is how long a statement can run before it is
+	// canceled, zero means no timeout.
+	StatementTimeout time.Duration
+	// SlowQueryThreshold is how long a statement runs before it is
+	// logged as a slow query with its plan, zero disables the log.
+	SlowQueryThreshold time.Duration
+	// Isolation is the default isolation level of the transactions.
+	Isolation IsolationLevel
+	// TransactionTimeout is how long the transaction can stay unused
+	// before it is rolled back, zero means no timeout.
+	TransactionTimeout time.Duration
+	// SessionTimeout is how long the session can stay unused before
+	// it is closed, zero means no timeout.
+	SessionTimeout time.Duration
+	// IdempotencyWindow is how long the results of the statements sent
+	// over HTTP with the idempotency keys are returned to the retries,
+	// zero disables the idempotency keys. The keys can not be used
+	// within transactions.
+	IdempotencyWindow time.Duration
+	// HistoryRetention is how long the executed queries are kept
+	// in the query history, zero disables the history.
+	HistoryRetention time.Duration
+	// ChangefeedRetention is how long the committed row changes are
+	// kept in the changefeed, zero disables the changefeed.
+	ChangefeedRetention time.Duration
+	// AuditLog enables the append-only log of the executed statements.
+	AuditLog bool
+	// AuditMaxSize is the size in bytes the audit log file is rotated
+	// at, zero means no rotation.
+	AuditMaxSize int64
+	// AuditMaxFiles is the number of the rotated audit log files kept,
+	// zero keeps all of them.
+	AuditMaxFiles int
+	// ArchiveDir is the directory where every version of the changed
+	// files is archived for the point-in-time recovery, empty
+	// disables the archive.
+	ArchiveDir string
+	// Replica opens the database as the read-only replica that
+	// applies the archive records of the primary.
+	Replica bool
+	// Failover fences the primary until it holds the lease
+	// of the witness, the replica is promoted by the lease.
+	Failover bool
+	// LeaderReads sends the reads of the cluster followers to the
+	// leader, the followers serve the reads that may be behind
+	// the leader otherwise.
+	LeaderReads bool
+	// DictionaryMaxSize is the maximum number of distinct values of
+	// the dictionary-encoded string column. String columns of the new
+	// tables are dictionary-encoded if it is not zero.
+	DictionaryMaxSize int
+	// ScanWorkers is the number of the workers that scan the large
+	// in-memory tables at once, zero means the number of the CPUs
+	// and one disables the parallel scan.
+	ScanWorkers int
+	// StatementCacheSize is the number of the parsed statements
+	// cached by their text, zero disables the cache.
+	StatementCacheSize int
+	// ResultCacheSize is the estimated size in bytes of the rows kept
+	// by the result cache, zero disables the cache.
+	ResultCacheSize int64
+	// ResultCacheTTL is how long the cached rows are served,
+	// zero keeps them until they are invalidated or evicted.
+	ResultCacheTTL time.Duration
+	// Encryption supplies the keys the files are encrypted with at
+	// rest, nil disables the encryption.
+	Encryption KeyProvider
+	// EncryptPlaintext encrypts the files that have not been encrypted
+	// when the database is opened, so the encryption is enabled for the
+	// existing database. Such files are rejected otherwise.
+	EncryptPlaintext bool
+	// GroupCommitSize is the maximum number of the concurrent inserts
+	// outside of transactions that are written to the data files with
+	// a single write and sync, zero or one disables group commit.
+	GroupCommitSize int
+	// GroupCommitWindow is how long the inserts wait for the concurrent
+	// ones to be written with them while the inserts come concurrently,
+	// zero writes at once the inserts that have come during the last write.
+	GroupCommitWindow time.Duration
+	// ReadOnly rejects the statements that change the data, the schema,
+	// the users or the tokens until the mode is switched at runtime.
+	ReadOnly bool
+	// MigrationsDir is the directory of the schema migrations applied
+	// on demand, empty if the migrations are not used.
+	MigrationsDir string
+	// WorkMem is the estimated size in bytes of the rows a query sorts
+	// or aggregates in memory before it writes them to temporary files,
+	// zero keeps all the rows in memory.
+	WorkMem int64
+	// TempDir is the directory of the temporary files of the queries,
+	// empty means the default directory of the system.
+	TempDir string
+	// MinFreeDisk is the free space in bytes of the file system of the
+	// database below which the changes are rejected before they are
+	// written, zero disables the checks.
+	MinFreeDisk int64
+	// MemoryLimit is the estimated size in bytes of the loaded tables,
+	// the cached results and the rows of the running queries, the
+	// queries spill their rows or are rejected over the limit. Zero
+	// means no limit.
+	MemoryLimit int64
+	// Collation is the collation of the string columns of the new
+	// tables, empty means binary.
+	Collation string
+}
+
+// Schema represents a database table schema.
+type Schema struct {
+	Name    string               `json:"name"`
+	Columns map[string]ColumnDef `json:"columns"`
+	Engine  sql.EngineType       `json:"engine"`
+	// Partitioning is nil for not partitioned tables.
+	Partitioning *Partitioning `json:"partitioning,omitempty"`
+	// RowVersion is true if the table has the row version column.
+	RowVersion bool `json:"row_version,omitempty"`
+	// Stats is updated on every data change.
+	Stats TableStats `json:"stats"`
+	// Dictionaries of the dictionary-encoded string columns
+	// by column names.
+	Dictionaries map[string]*Dictionary `json:"dictionaries,omitempty"`
+	// InMemory is true for the tables that are never persisted.
+	InMemory bool `json:"in_memory,omitempty"`
+	// Session is the identifier of the session that owns the
+	// temporary table, empty for the other tables.
+	Session string `json:"session,omitempty"`
+	// Namespace is the schema of the table, empty for the public one.
+	Namespace string `json:"namespace,omitempty"`
+	// Triggers are fired by the row changes in the order of creation.
+	Triggers []Trigger `json:"triggers,omitempty"`
+	// Segments are the numbers of the last segments of the data files
+	// split into segments by the data file names.
+	Segments map[string]int `json:"segments,omitempty"`
+	// Comment describes the table, set by COMMENT ON TABLE.
+	Comment string `json:"comment,omitempty"`
+	// Version is the schema version of the database when the table
+	// has been created or changed, zero for the loaded tables.
+	Version uint64 `json:"-"`
+}
+
+// ColumnDef describes a table column.
+type ColumnDef struct {
+	Name     string         `json:"name"`
+	Type     sql.ColumnType `json:"type"`
+	Position int            `json:"position"`
+	// Expression computes the value of the generated column,
+	// empty for the other columns.
+	Expression string `json:"expression,omitempty"`
+	// Stored is true for the generated columns written
+	// to the data files.
+	Stored bool `json:"stored,omitempty"`
+	// Mask redacts the values for the users without the UNMASK
+	// privilege, nil for the columns that are not masked.
+	Mask *ColumnMask `json:"mask,omitempty"`
+	// Collation is empty for the binary string columns
+	// and for the integer ones.
+	Collation string `json:"collation,omitempty"`
+	// Comment describes the column, set by COMMENT ON COLUMN.
+	Comment string `json:"comment,omitempty"`
+}
+
+// Nullable reports whether the column can have no value, the values
+// of all the columns are required now, so none of them is nullable.
+func (def ColumnDef) Nullable() bool {
+	return false
+}
+
+func (def ColumnDef) ReflectType() reflect.Type {
+	switch def.Type {
+	case sql.TypeInteger:
+		return reflect.TypeOf(0)
+	case sql.TypeString:
+		return reflect.TypeOf("")
+	}
+
+	return nil
+}
+
+// TableNames returns the sorted names of the tables.
+func (db *Database) TableNames() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Schema returns the copy of the table schema without
+// the dictionaries.
+func (db *Database) Schema(tableName string) (Schema, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tableName = strings.ToLower(tableName)
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return Schema{}, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	columns := make(map[string]ColumnDef, len(schema.Columns))
+	for name, column := range schema.Columns {
+		columns[name] = column
+	}
+	schema.Columns = columns
+	schema.Dictionaries = nil
+
+	if schema.Partitioning != nil {
+		partitioning := *schema.Partitioning
+		partitioning.Partitions = append([]Partition(nil), partitioning.Partitions...)
+		schema.Partitioning = &partitioning
+	}
+
+	return schema, nil
+}
+
+// Columns returns the columns of the table or the virtual
+// table in the order of the row values.
+func (db *Database) Columns(tableName string) ([]ColumnDef, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tableName = strings.ToLower(tableName)
+	schema, exists := db.tables[tableName]
+	if !exists {
+		table, exists := virtualTables[tableName]
+		if !exists {
+			return nil, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+		}
+		schema = table.schema
+	}
+
+	columns := make([]ColumnDef, len(schema.Columns))
+	for _, column := range schema.Columns {
+		columns[column.Position] = column
+	}
+
+	return columns, nil
+}
+
+// NewDatabase creates new instance of the database and loads
+// all the necessary information.
+func NewDatabase(dbDir string, options Options) (*Database, error) {
+	dbDirStat, err := os.Stat(dbDir)
+	if err != nil && os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dbDir, err)
+	}
+
+	if !dbDirStat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory %s", dbDir, err)
+	}
+
+	if options.Fsync == "" {
+		options.Fsync = FsyncAlways
+	}
+
+	if _, err := ParseFsyncPolicy(string(options.Fsync)); err != nil {
+		return nil, err
+	}
+
+	if options.Isolation == "" {
+		options.Isolation = RepeatableRead
+	}
+
+	if _, err := ParseIsolationLevel(string(options.Isolation)); err != nil {
+		return nil, err
+	}
+
+	if options.Collation, err = ParseCollation(options.Collation); err != nil {
+		return nil, err
+	}
+
+	syncer := newSyncer(options.Fsync, options.FsyncInterval)
+	options.FsyncInterval = syncer.interval
+
+	encryption, err := newEncryption(options.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryption != nil && options.EncryptPlaintext {
+		if err := encryptPlaintextFiles(dbDir, encryption); err != nil {
+			return nil, fmt.Errorf("failed to encrypt files: %w", err)
+		}
+	}
+
+	metaFilePath := path.Join(dbDir, metaFileName)
+	err = initializeMetaFile(metaFilePath, syncer, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize meta file %s: %w", metaFilePath, err)
+	}
+
+	tables, err := loadSchema(metaFilePath, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tables: %w", err)
+	}
+
+	recovered, err := recoverJournals(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover transactions: %w", err)
+	}
+
+	tableData, mapped, err := loadData(dbDir, tables, options, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load data: %w", err)
+	}
+
+	users, err := loadUsers(dbDir, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load users: %w", err)
+	}
+
+	tokens, err := loadTokens(dbDir, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokens: %w", err)
+	}
+
+	schemas, err := loadSchemas(dbDir, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schemas: %w", err)
+	}
+
+	sequences, err := loadSequences(dbDir, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sequences: %w", err)
+	}
+
+	settings, err := loadSettings(dbDir, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %w", err)
+	}
+
+	archiver, err := newArchiver(options.ArchiveDir, dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	var replica *replica
+	if options.Replica {
+		replica, err = newReplica(dbDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read replica state: %w", err)
+		}
+	}
+
+	leadership, err := newLeadership(dbDir, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease state: %w", err)
+	}
+
+	db := &Database{
+		dbDir:        dbDir,
+		metaFilePath: metaFilePath,
+		tables:       tables,
+		data:         tableData,
+		csn:          loadedRecord.csn,
+		snapshots:    make(map[*snapshot]struct{}),
+		mapped:       mapped,
+		options:      options,
+		syncer:       syncer,
+		encryption:   encryption,
+		prepared:     newPreparedStatements(),
+		transactions: make(map[string]*Transaction),
+		sessions:     newSessions(),
+		locks:        newLockManager(),
+		processes:    newProcessList(),
+		users:        users,
+		tokens:       tokens,
+		schemas:      schemas,
+		sequences:    sequences,
+		changedCSN:   make(map[string]uint64),
+		started:      time.Now(),
+		archiver:     archiver,
+		replica:      replica,
+		leadership:   leadership,
+		statements:   newStatementCache(options.StatementCacheSize),
+		results:      newResultCache(options.ResultCacheSize, options.ResultCacheTTL),
+		memory:       memoryAccountant{limit: options.MemoryLimit},
+		// the statement timeout can be changed by SET GLOBAL
+		statementTimeout: int64(options.StatementTimeout),
+		// the cached plans of version zero are not built yet
+		schemaVersion: 1,
+	}
+	db.groupCommit = newGroupCommitter(db, options.GroupCommitSize, options.GroupCommitWindow)
+	db.results.account(&db.memory)
+	db.SetReadOnly(options.ReadOnly)
+	if err := db.applySettings(settings); err != nil {
+		return nil, fmt.Errorf("failed to apply settings: %w", err)
+	}
+	db.scrubber = newScrubber(db, options.ScrubInterval)
+	db.vacuum = newVacuum(db, options.VacuumInterval)
+	db.history = newQueryHistory(dbDir, options.HistoryRetention, syncer, encryption)
+	db.changefeed, err = newChangefeed(dbDir, options.ChangefeedRetention, syncer, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open changefeed: %w", err)
+	}
+	db.purgeables = []purgeable{db.history, db.changefeed}
+	// the audit log is never purged
+	if options.AuditLog {
+		db.auditLog, err = newAuditLog(dbDir, options.AuditMaxSize, options.AuditMaxFiles, syncer, encryption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
+
+	for _, tableName := range recovered {
+		if _, exists := db.tables[tableName]; !exists {
+			continue
+		}
+
+		err = db.refreshStats(tableName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh statistics: %w", err)
+		}
+	}
+
+	if err := db.accountTables(); err != nil {
+		return nil, fmt.Errorf("failed to account memory: %w", err)
+	}
+
+	return db, nil
+}
+
+// Close stops the background jobs, rolls back the active transactions
+// and flushes all the written files that have not been flushed yet.
+// The statement that is being executed is finished first.
+func (db *Database) Close() error {
+	db.scrubber.close()
+	db.vacuum.close()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, tx := range db.transactions {
+		logging.Infof("rolling back transaction %s", tx.ID)
+		if err := db.rollback(tx); err != nil {
+			return fmt.Errorf("failed to roll back transaction %s: %w", tx.ID, err)
+		}
+	}
+
+	return db.syncer.close()
+}
+
+// Options returns the options the database has been opened with,
+// the ones changed by SET GLOBAL are the current values.
+func (db *Database) Options() Options {
+	options := db.options
+	options.Fsync = db.syncer.currentPolicy()
+	options.StatementTimeout = time.Duration(atomic.LoadInt64(&db.statementTimeout))
+
+	return options
+}
+
+// CreateTable creates a table.
+func (db *Database) CreateTable(query *sql.CreateTable) error {
+	return db.createTable(query, Schema{})
+}
+
+// createTable creates a table with the partitioning, the row version
+// and the memory settings of the table, the columns are defined by
+// the query.
+func (db *Database) createTable(query *sql.CreateTable, table Schema) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tableName := strings.ToLower(query.Name)
+	if len(tableName) == 0 {
+		return fmt.Errorf("table name is empty")
+	}
+
+	if !isValidTableNameFormat(tableName) {
+		return fmt.Errorf("table name %s is not valid, expected format: %s", query.Name, tableNameRegExp)
+	}
+
+	_, exists := db.tables[tableName]
+	if exists {
+		return newError(CodeDuplicateTable, "table %s exists (table names are case-insensitive)", query.Name)
+	}
+
+	if _, exists := virtualTables[tableName]; exists {
+		return fmt.Errorf("table name %s is reserved", query.Name)
+	}
+
+	// the schemas of the temporary tables are not created
+	if table.Session == "" {
+		if err := db.checkTableSchema(tableName); err != nil {
+			return err
+		}
+	}
+
+	if len(query.Columns) == 0 {
+		return fmt.Errorf("failed to create %s: table must have at least one column", query.Name)
+	}
+
+	// the template columns are the generated ones
+	generated := table.Columns
+	tableColumns := make(map[string]ColumnDef)
+	// to detect column definition duplicates
+	columnNames := make(map[string]struct{})
+	for columnPosition, column := range query.Columns {
+		columnName := strings.ToLower(column.Name)
+		if len(columnName) == 0 {
+			return fmt.Errorf("column name is empty for table %s", query.Name)
+		}
+
+		if !isValidColumnNameFormat(tableName) {
+			return fmt.Errorf("column name %s is not valid, expected format: %s", column.Name, columnNameRegExp)
+		}
+
+		if _, exists := columnNames[columnName]; exists {
+			return fmt.Errorf("%s definition is repeated (column names are case-insensitive)", column.Name)
+		}
+
+		if columnName == versionColumn {
+			return fmt.Errorf("column name %s is reserved", column.Name)
+		}
+
+		columnType := column.Type
+		if _, exists := columnTypes[columnType]; !exists {
+			return fmt.Errorf("%s type definition is not found for column %s", column.Type.Name(), column.Name)
+		}
+
+		columnNames[columnName] = struct{}{}
+
+		tableColumns[columnName] = ColumnDef{Name: columnName, Type: columnType, Position: columnPosition}
+		if def, ok := generated[columnName]; ok {
+			tableColumns[columnName] = ColumnDef{
+				Name:       columnName,
+				Type:       columnType,
+				Position:   columnPosition,
+				Expression: def.Expression,
+				Stored:     def.Stored,
+			}
+		}
+	}
+	for name := range generated {
+		if _, exists := tableColumns[name]; !exists {
+			return fmt.Errorf("generated column %s is not defined", name)
+		}
+	}
+	if table.RowVersion {
+		tableColumns[versionColumn] = ColumnDef{Name: versionColumn, Type: sql.TypeInteger, Position: len(tableColumns)}
+	}
+	if table.Partitioning != nil {
+		if table.InMemory {
+			return fmt.Errorf("memory table %s can not be partitioned", query.Name)
+		}
+
+		err := validatePartitioning(table.Partitioning, tableColumns)
+		if err != nil {
+			return fmt.Errorf("invalid partitioning: %w", err)
+		}
+	}
+
+	if !binaryCollation(db.options.Collation) {
+		for name, column := range tableColumns {
+			if column.Type == sql.TypeString {
+				column.Collation = db.options.Collation
+				tableColumns[name] = column
+			}
+		}
+	}
+
+	table.Name = tableName
+	table.Namespace = tableSchema(tableName)
+	table.Columns = tableColumns
+	if err := validateGenerated(table); err != nil {
+		return err
+	}
+	table.Engine = query.Engine
+	// the rows of the memory tables are not encoded
+	if !table.InMemory {
+		table.Dictionaries = newDictionaries(tableColumns, db.options.DictionaryMaxSize)
+	}
+
+	db.replaceSchema(table)
+	if table.InMemory {
+		db.data[tableName] = nil
+		return nil
+	}
+
+	err := db.storeTables()
+	if err != nil {
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	return nil
+}
+
+// Select fetches data from the database.
+func (db *Database) Select(query *sql.Select) ([][]interface{}, error) {
+	return db.SelectContext(context.Background(), query)
+}
+
+// SelectContext fetches data from the database until the context is
+// done. The rows are read from the snapshot taken when the selection
+// starts, so the concurrent changes are never seen partially. The rows
+// share the values with the stored row versions and must not be changed.
+func (db *Database) SelectContext(ctx context.Context, query *sql.Select) ([][]interface{}, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var rows [][]interface{}
+	var err error
+	if db.results != nil {
+		rows, err = db.selectCached(ctx, query)
+	} else {
+		rows, err = db.selectRows(ctx, query, nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return maskRows(masks, rows), nil
+}
+
+// selectRows fetches data, the analysis collects execution
+// counters if not nil. Without the transaction only the rows
+// committed before the query are visible.
+func (db *Database) selectRows(ctx context.Context, query *sql.Select, a *analysis, tx *Transaction) ([][]interface{}, error) {
+	matched := make([][]interface{}, 0)
+	err := db.selectEach(ctx, query, a, tx, func(row []interface{}) error {
+		matched = append(matched, row)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matched, nil
+}
+
+// selectEach calls f for every matched row, the selection stops
+// with the error returned by f. It must be called with the database
+// locked, the lock is released while the rows are scanned, so long
+// selections do not block writers. The selection stops when
+// the context is done.
+func (db *Database) selectEach(ctx context.Context, query *sql.Select, a *analysis, tx *Transaction, f func(row []interface{}) error) error {
+	tableName := strings.ToLower(query.Table)
+	schema, exists := db.tables[tableName]
+	if !exists {
+		if table, exists := virtualTables[tableName]; exists {
+			rows, err := db.selectVirtual(ctx, table, query)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range rows {
+				if err := f(row); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	storages, err := db.accessPlan(ctx, "SELECT", schema, query.Where)
+	if err != nil {
+		return fmt.Errorf("invalid WHERE part: %w", err)
+	}
+
+	if tx != nil {
+		err = db.lockRead(ctx, tx, tableName, storages)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := db.checkSchema(tx, schema); err != nil {
+		return err
+	}
+
+	view, err := db.openView(tx, schema, storages)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Unlock()
+	err = scanView(ctx, view, query.Where, a, f)
+	db.mu.Lock()
+	db.closeView(view)
+
+	return err
+}
+
+// scanView calls f for every row of the view matched by the condition,
+// it does not need the database lock.
+func scanView(ctx context.Context, view *readView, where *sql.Where, a *analysis, f func(row []interface{}) error) error {
+	for _, storage := range view.storages {
+		if storage.file == nil && view.workers > 1 && len(storage.versions) >= parallelScanMinRows {
+			op := a.operator("parallel scan " + storage.name)
+			err := storage.parallelScan(ctx, view.schema, view.snapshot, where, view.workers, op, f)
+			op.finish()
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		var fErr error
+		op := a.operator("scan " + storage.name)
+		err := storage.scan(view.schema, view.snapshot, func(index int, row []interface{}) bool {
+			if fErr = canceled(ctx, index); fErr != nil {
+				return false
+			}
+
+			op.read()
+			if matches(view.schema, row, where) {
+				op.produce()
+				fErr = f(row)
+			}
+
+			return fErr == nil
+		})
+		op.finish()
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", storage.name, err)
+		}
+
+		if fErr != nil {
+			return fErr
+		}
+	}
+
+	return nil
+}
+
+func validateWhere(schema Schema, where *sql.Where) error {
+	if where == nil {
+		return nil
+	}
+
+	t, err := validateExpr(schema, where.Expr)
+	if err != nil {
+		return err
+	}
+
+	if t != boolType {
+		return fmt.Errorf("expression must be boolean, got %s", t)
+	}
+
+	return nil
+}
+
+// boolType is the type of the comparison and logical operations.
+var boolType = reflect.TypeOf(true)
+
+// validateExpr validates the expression against the schema and
+// returns the type of the expression result.
+func validateExpr(schema Schema, expr sql.Expr) (reflect.Type, error) {
+	switch e := expr.(type) {
+	case sql.ExprOperation:
+		lt, err := validateExpr(schema, e.Left)
+		if err != nil {
+			return nil, fmt.Errorf("invalid left operand: %w", err)
+		}
+
+		rt, err := validateExpr(schema, e.Right)
+		if err != nil {
+			return nil, fmt.Errorf("invalid right operand: %w", err)
+		}
+
+		switch e.Operator {
+		case sql.OperatorEquals:
+			if lt != rt {
+				return nil, newError(CodeDatatypeMismatch, "operand types do not match: %s != %s", lt, rt)
+			}
+		case sql.OperatorLogicalAnd:
+			if lt != boolType || rt != boolType {
+				return nil, fmt.Errorf("AND operands must be boolean: %s, %s", lt, rt)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported operator: %d", e.Operator)
+		}
+
+		return boolType, nil
+	case sql.ExprIdentifier:
+		column := strings.ToLower(e.Name)
+		columnDef, exists := schema.Columns[column]
+		if !exists {
+			return nil, newError(CodeUndefinedColumn, "column %s does not exist", column)
+		}
+
+		return columnDef.ReflectType(), nil
+	case sql.ExprValueInteger:
+		value, err := parseValue(e.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		return valueType(value), nil
+	case sql.ExprValueString:
+		value, err := parseValue(e.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		return valueType(value), nil
+	default:
+		return nil, fmt.Errorf("unsupported expression %T", expr)
+	}
+}
+
+func matches(schema Schema, row []interface{}, where *sql.Where) bool {
+	if where == nil {
+		return true
+	}
+
+	return evalExpr(schema, row, where.Expr) == true
+}
+
+// evalExpr evaluates the validated expression for the row.
+func evalExpr(schema Schema, row []interface{}, expr sql.Expr) interface{} {
+	switch e := expr.(type) {
+	case sql.ExprOperation:
+		left := evalExpr(schema, row, e.Left)
+		right := evalExpr(schema, row, e.Right)
+
+		switch e.Operator {
+		case sql.OperatorEquals:
+			if a, ok := left.(string); ok {
+				if b, ok := right.(string); ok {
+					return compareStrings(exprCollation(schema, e), a, b) == 0
+				}
+			}
+
+			return left == right
+		case sql.OperatorLogicalAnd:
+			return left == true && right == true
+		}
+	case sql.ExprIdentifier:
+		p := schema.Columns[strings.ToLower(e.Name)].Position
+
+		return row[p]
+	case sql.ExprValueInteger:
+		value, _ := parseValue(e.Value)
+
+		return value
+	case sql.ExprValueString:
+		value, _ := parseValue(e.Value)
+
+		return value
+	}
+
+	return nil
+}
+
+// parseValue converts the raw value from the query into
+// an integer or a string.
+func parseValue(raw string) (interface{}, error) {
+	if strings.HasPrefix(raw, `"`) {
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return nil, fmt.Errorf("string value %s is not properly quoted", raw)
+		}
+
+		value, err := unescapeString(raw[1 : len(raw)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid string value %s: %w", raw, err)
+		}
+
+		return value, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse integer value %s: %w", raw, err)
+	}
+
+	return value, nil
+}
+
+// Insert inserts data into the database.
+func (db *Database) Insert(query *sql.Insert) (int, error) {
+	return db.InsertContext(context.Background(), query)
+}
+
+// InsertContext inserts data into the database, the statement
+// is canceled when the context is done before the data is written.
+func (db *Database) InsertContext(ctx context.Context, query *sql.Insert) (int, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	if db.groupCommit != nil {
+		return db.groupCommit.insert(ctx, query)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.insert(ctx, query, nil)
+}
+
+// insert inserts data within the transaction if it is not nil.
+func (db *Database) insert(ctx context.Context, query *sql.Insert, tx *Transaction) (int, error) {
+	values, err := insertValues(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.insertRows(ctx, query.Table, query.Columns, [][]interface{}{values}, tx)
+}
+
+// insertValues parses the values of the inserted row.
+func insertValues(query *sql.Insert) ([]interface{}, error) {
+	if len(query.Values) == 0 {
+		return nil, fmt.Errorf("empty values, at least one is required")
+	}
+
+	values := make([]interface{}, len(query.Values))
+	for index, rawValue := range query.Values {
+		value, err := parseValue(rawValue)
+		if err != nil {
+			if index < len(query.Columns) {
+				return nil, fmt.Errorf("invalid value for column %s: %w", strings.ToLower(query.Columns[index]), err)
+			}
+
+			return nil, fmt.Errorf("invalid value: %w", err)
+		}
+
+		values[index] = value
+	}
+
+	return values, nil
+}
+
+// insertRows inserts the rows of the values of the columns within
+// the transaction if it is not nil, the rows are written at once.
+func (db *Database) insertRows(ctx context.Context, tableName string, columns []string, values [][]interface{}, tx *Transaction) (int, error) {
+	l, unlock := db.statementLocker(tx)
+	defer unlock()
+
+	insert, err := db.prepareInsert(ctx, l, tableName, columns, values, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	record, done := db.writeRecord(tx, insert.table.Name)
+	defer done()
+
+	if err := db.writeInserts(ctx, tx, record, []*pendingInsert{insert}); err != nil {
+		return 0, err
+	}
+
+	return insert.rows, nil
+}
+
+// pendingInsert is the validated insert of the rows that are not
+// written yet, its storages are locked for writing.
+type pendingInsert struct {
+	table Schema
+	// rowsByStorage are the new rows by the storage names
+	rowsByStorage map[string][][]interface{}
+	rows          int
+	// size is the size of the rows counted
+	// against the database size limit
+	size int64
+}
+
+// prepareInsert validates the rows of the values of the columns and
+// locks the storages they go to with the locker, accepted is nil
+// for the inserts outside of groups.
+func (db *Database) prepareInsert(ctx context.Context, l *locker, tableName string, columns []string, values [][]interface{}, accepted *acceptedRows) (*pendingInsert, error) {
+	tableName = strings.ToLower(tableName)
+	if err := db.lock(ctx, l, tableResource(tableName), lockIntentionExclusive); err != nil {
+		return nil, err
+	}
+
+	table, exists := db.tables[tableName]
+	if !exists {
+		return nil, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	if err := db.checkSchema(l.tx, table); err != nil {
+		return nil, err
+	}
+
+	rowsByStorage, rows, size, err := db.insertStorages(table, columns, values, accepted)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(rowsByStorage))
+	for name := range rowsByStorage {
+		names = append(names, name)
+	}
+
+	if err := db.beginWrite(ctx, l, tableName, names); err != nil {
+		return nil, err
+	}
+
+	// the rows are written at once, so the statement
+	// is canceled only before the writing
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	return &pendingInsert{table: table, rowsByStorage: rowsByStorage, rows: rows, size: size}, nil
+}
+
+// insertStorages validates the rows of the values of the columns
+// and returns them by the storages they go to, their number and their
+// size counted against the database size limit. The rows accepted
+// within the group of the insert count against the limits too.
+func (db *Database) insertStorages(table Schema, columns []string, values [][]interface{}, accepted *acceptedRows) (map[string][][]interface{}, int, int64, error) {
+	tableName := table.Name
+	var insertColumns = make(map[string]int)
+	for index, column := range columns {
+		columnName := strings.ToLower(column)
+		if _, exists := table.Columns[columnName]; !exists {
+			return nil, 0, 0, newError(CodeUndefinedColumn, "column %s does not exist in table %s", column, tableName)
+		}
+
+		if table.RowVersion && columnName == versionColumn {
+			return nil, 0, 0, fmt.Errorf("column %s is maintained by the database", versionColumn)
+		}
+
+		if table.Columns[columnName].Expression != "" {
+			return nil, 0, 0, fmt.Errorf("column %s is generated", columnName)
+		}
+
+		insertColumns[columnName] = index
+	}
+
+	for _, requiredColumn := range table.Columns {
+		if (table.RowVersion && requiredColumn.Name == versionColumn) || requiredColumn.Expression != "" {
+			continue
+		}
+
+		if _, exists := insertColumns[requiredColumn.Name]; !exists {
+			return nil, 0, 0, fmt.Errorf("%s column value is not provided", requiredColumn.Name)
+		}
+	}
+
+	for _, row := range values {
+		if len(row) != len(columns) {
+			return nil, 0, 0, fmt.Errorf("the number of values must be equal to the number of columns")
+		}
+
+		for index, value := range row {
+			columnName := strings.ToLower(columns[index])
+			vt := valueType(value)
+			ct := table.Columns[columnName].ReflectType()
+			if ct != vt {
+				return nil, 0, 0, newError(CodeDatatypeMismatch, "types do not match for column %s: column type = %s, value type = %s", columnName, ct, vt)
+			}
+		}
+	}
+
+	newRows := sortValues(table, insertColumns, values)
+	rowsByStorage := make(map[string][][]interface{})
+	for _, row := range newRows {
+		if err := computeGenerated(table, row, false); err != nil {
+			return nil, 0, 0, err
+		}
+		firstVersion(table, row)
+		if err := checkRowLimits(db.options, table, row); err != nil {
+			return nil, 0, 0, err
+		}
+
+		name, err := table.rowStorageName(row)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		rowsByStorage[name] = append(rowsByStorage[name], row)
+	}
+
+	rowsByStorage, err := db.segmentRows(table, rowsByStorage)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err := db.checkTableRows(table, accepted.tableRows(table.Name)+len(newRows)); err != nil {
+		return nil, 0, 0, err
+	}
+	size, err := db.checkDatabaseSize(table, newRows, accepted.totalSize())
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return rowsByStorage, len(newRows), size, nil
+}
+
+// writeInserts writes the rows of the prepared inserts as the versions
+// of the record, every data file is rewritten once for all of them.
+func (db *Database) writeInserts(ctx context.Context, tx *Transaction, record *txRecord, inserts []*pendingInsert) error {
+	if err := db.addSegments(inserts); err != nil {
+		return err
+	}
+
+	// the rows of the same storage are written in the order of the inserts
+	var names []string
+	rowsByStorage := make(map[string][][]interface{})
+	tables := make(map[string]Schema)
+	var tableNames []string
+	inserted := make(map[string]*rowsChange)
+	for _, insert := range inserts {
+		if _, exists := tables[insert.table.Name]; !exists {
+			tables[insert.table.Name] = insert.table
+			tableNames = append(tableNames, insert.table.Name)
+			inserted[insert.table.Name] = &rowsChange{}
+		}
+
+		for name, rows := range insert.rowsByStorage {
+			if _, exists := rowsByStorage[name]; !exists {
+				names = append(names, name)
+			}
+			rowsByStorage[name] = append(rowsByStorage[name], rows...)
+			for _, row := range rows {
+				inserted[insert.table.Name].insert(row)
+			}
+		}
+	}
+
+	for _, name := range names {
+		rows := rowsByStorage[name]
+		err := db.journalStorage(tx, name)
+		if err != nil {
+			return fmt.Errorf("failed to journal %s: %w", name, err)
+		}
+
+		_, span := tracing.Start(ctx, "persist", "db.storage", name, "db.rows", len(rows))
+		err = db.writeToFileNewRows(name, rows)
+		span.Fail(err)
+		span.End()
+		if err != nil {
+			return fmt.Errorf("failed to write to file: %w", err)
+		}
+
+		// store the data in-memory
+		if !db.mapped[name] {
+			db.data[name] = appendVersions(db.data[name], rows, record)
+		}
+	}
+
+	for _, insert := range inserts {
+		for _, name := range names {
+			rows, exists := insert.rowsByStorage[name]
+			if !exists {
+				continue
+			}
+
+			err := db.captureChanges(tx, insert.table, ChangeInsert, nil, rows)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, tableName := range tableNames {
+		logging.Debugf("the record has been inserted succesfully into %s", tableName)
+
+		db.noteModified(tableName, len(inserted[tableName].inserted))
+		err := db.updateStats(tableName, *inserted[tableName])
+		if err != nil {
+			return fmt.Errorf("failed to refresh statistics: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Update updates data in the database.
+func (db *Database) Update(query *sql.Update) (int, error) {
+	return db.UpdateContext(context.Background(), query)
+}
+
+// UpdateContext updates data in the database, the statement is
+// canceled when the context is done before the data is written.
+func (db *Database) UpdateContext(ctx context.Context, query *sql.Update) (int, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.update(ctx, query, 0, nil, nil)
+}
+
+// update updates data within the transaction if it is not nil,
+// the analysis collects execution counters if not nil. If the
+// version is not zero, all the matched rows must have it.
+func (db *Database) update(ctx context.Context, query *sql.Update, version int, a *analysis, tx *Transaction) (int, error) {
+	l, unlock := db.statementLocker(tx)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(ctx, l, tableResource(tableName), lockIntentionExclusive); err != nil {
+		return 0, err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return 0, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	if err := db.checkSchema(tx, schema); err != nil {
+		return 0, err
+	}
+
+	storages, err := db.accessPlan(ctx, "UPDATE", schema, query.Where)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WHERE part: %w", err)
+	}
+
+	set, err := validateSet(schema, query.Columns, query.Values)
+	if err != nil {
+		return 0, fmt.Errorf("invalid SET part: %w", err)
+	}
+
+	if schema.Partitioning != nil {
+		if _, exists := set[schema.Partitioning.Column]; exists {
+			return 0, fmt.Errorf("partition column %s can not be updated", schema.Partitioning.Column)
+		}
+	}
+
+	if err := db.beginWrite(ctx, l, tableName, storages); err != nil {
+		return 0, err
+	}
+
+	if version != 0 {
+		if err := db.checkVersions(schema, storages, query.Where, version); err != nil {
+			return 0, err
+		}
+	}
+	record, done := db.writeRecord(tx, tableName)
+	defer done()
+
+	updCnt := 0
+	var change rowsChange
+	for _, name := range storages {
+		cnt, err := db.updateStorage(ctx, name, schema, query.Where, set, a, tx, record, &change)
+		if err != nil {
+			return 0, err
+		}
+		updCnt += cnt
+	}
+	logging.Debugf("the records has been updated succesfully for %s", tableName)
+
+	if updCnt > 0 {
+		db.noteModified(tableName, updCnt)
+		err = db.updateStats(tableName, change)
+		if err != nil {
+			return 0, fmt.Errorf("failed to refresh statistics: %w", err)
+		}
+	}
+
+	return updCnt, nil
+}
+
+// updateStorage updates matched rows of the table or partition data
+// file, it is canceled when the context is done while the rows are
+// matched. The updated rows are noted in the change.
+func (db *Database) updateStorage(ctx context.Context, name string, schema Schema, where *sql.Where, set map[string]interface{}, a *analysis, tx *Transaction, record *txRecord, change *rowsChange) (int, error) {
+	if err := db.checkConflicts(tx, name, schema, where); err != nil {
+		return 0, err
+	}
+
+	updCnt := 0
+	updateRows := make(map[int][]interface{})
+	// the old and the new values in the scan order
+	var oldRows, newRows [][]interface{}
+	var limitErr, cancelErr error
+	op := a.operator("scan " + name)
+	err := db.scan(name, schema, func(index int, row []interface{}) bool {
+		if cancelErr = canceled(ctx, index); cancelErr != nil {
+			return false
+		}
+
+		op.read()
+		if matches(schema, row, where) {
+			op.produce()
+			newRow, err := updateValues(schema, set, row)
+			if err != nil {
+				limitErr = err
+				return false
+			}
+			updateRows[index] = newRow
+			oldRows = append(oldRows, row)
+			newRows = append(newRows, newRow)
+			updCnt++
+
+			limitErr = checkRowLimits(db.options, schema, newRow)
+		}
+
+		return limitErr == nil
+	})
+	op.finish()
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan %s: %w", name, err)
+	}
+
+	if cancelErr != nil {
+		return 0, cancelErr
+	}
+
+	if limitErr != nil {
+		return 0, limitErr
+	}
+
+	if updCnt == 0 {
+		return 0, nil
+	}
+
+	if _, err := db.checkDatabaseSize(schema, newRows, 0); err != nil {
+		return 0, err
+	}
+
+	err = db.journalStorage(tx, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to journal %s: %w", name, err)
+	}
+
+	op = a.operator("write " + name)
+	_, span := tracing.Start(ctx, "persist", "db.storage", name, "db.rows", len(updateRows))
+	err = db.updateRowsInFile(name, updateRows)
+	span.Fail(err)
+	span.End()
+	op.pass(len(updateRows))
+	op.finish()
+	if err != nil {
+		return 0, fmt.Errorf("failed to update file: %w", err)
+	}
+
+	// update the data in-memory
+	if !db.mapped[name] {
+		db.data[name] = updateVersions(db.data[name], updateRows, record)
+	}
+
+	err = db.captureChanges(tx, schema, ChangeUpdate, oldRows, newRows)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range oldRows {
+		change.delete(schema, oldRows[i])
+		change.insert(newRows[i])
+	}
+
+	return updCnt, nil
+}
+
+func updateValues(schema Schema, set map[string]interface{}, row []interface{}) ([]interface{}, error) {
+	newRow := make([]interface{}, len(row))
+	copy(newRow, row)
+	for column, value := range set {
+		newRow[schema.Columns[column].Position] = value
+	}
+	if err := computeGenerated(schema, newRow, false); err != nil {
+		return nil, err
+	}
+	nextVersion(schema, newRow)
+
+	return newRow, nil
+}
+
+// Delete deletes data from the database.
+func (db *Database) Delete(query *sql.Delete) (int, error) {
+	return db.DeleteContext(context.Background(), query)
+}
+
+// DeleteContext deletes data from the database, the statement is
+// canceled when the context is done before the data is written.
+func (db *Database) DeleteContext(ctx context.Context, query *sql.Delete) (int, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.delete(ctx, query, 0, nil, nil)
+}
+
+// delete deletes data within the transaction if it is not nil,
+// the analysis collects execution counters if not nil. If the
+// version is not zero, all the matched rows must have it.
+func (db *Database) delete(ctx context.Context, query *sql.Delete, version int, a *analysis, tx *Transaction) (int, error) {
+	l, unlock := db.statementLocker(tx)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(ctx, l, tableResource(tableName), lockIntentionExclusive); err != nil {
+		return 0, err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return 0, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	if err := db.checkSchema(tx, schema); err != nil {
+		return 0, err
+	}
+
+	storages, err := db.accessPlan(ctx, "DELETE", schema, query.Where)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WHERE part: %w", err)
+	}
+
+	if err := db.beginWrite(ctx, l, tableName, storages); err != nil {
+		return 0, err
+	}
+
+	if version != 0 {
+		if err := db.checkVersions(schema, storages, query.Where, version); err != nil {
+			return 0, err
+		}
+	}
+	record, done := db.writeRecord(tx, tableName)
+	defer done()
+
+	deleteCnt := 0
+	var change rowsChange
+	for _, name := range storages {
+		cnt, err := db.deleteFromStorage(ctx, name, schema, query.Where, a, tx, record, &change)
+		if err != nil {
+			return 0, err
+		}
+		deleteCnt += cnt
+	}
+	logging.Debugf("the records has been deleted succesfully for %s", tableName)
+
+	if deleteCnt > 0 {
+		db.noteModified(tableName, deleteCnt)
+		err = db.updateStats(tableName, change)
+		if err != nil {
+			return 0, fmt.Errorf("failed to refresh statistics: %w", err)
+		}
+	}
+
+	return deleteCnt, nil
+}
+
+// deleteFromStorage deletes matched rows from the table or partition
+// data file, it is canceled when the context is done while the rows
+// are matched. The deleted rows are noted in the change.
+func (db *Database) deleteFromStorage(ctx context.Context, name string, schema Schema, where *sql.Where, a *analysis, tx *Transaction, record *txRecord, change *rowsChange) (int, error) {
+	if err := db.checkConflicts(tx, name, schema, where); err != nil {
+		return 0, err
+	}
+
+	deleteCnt := 0
+	deleteRows := make(map[int]struct{})
+	var oldRows [][]interface{}
+	var cancelErr error
+	op := a.operator("scan " + name)
+	err := db.scan(name, schema, func(index int, row []interface{}) bool {
+		if cancelErr = canceled(ctx, index); cancelErr != nil {
+			return false
+		}
+
+		op.read()
+		if matches(schema, row, where) {
+			op.produce()
+			deleteRows[index] = struct{}{}
+			oldRows = append(oldRows, row)
+			deleteCnt++
+		}
+
+		return true
+	})
+	op.finish()
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan %s: %w", name, err)
+	}
+
+	if cancelErr != nil {
+		return 0, cancelErr
+	}
+
+	if deleteCnt == 0 {
+		return 0, nil
+	}
+
+	err = db.journalStorage(tx, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to journal %s: %w", name, err)
+	}
+
+	op = a.operator("write " + name)
+	_, span := tracing.Start(ctx, "persist", "db.storage", name, "db.rows", len(deleteRows))
+	err = db.deleteRowsInFile(name, deleteRows)
+	span.Fail(err)
+	span.End()
+	op.pass(len(deleteRows))
+	op.finish()
+	if err != nil {
+		return 0, fmt.Errorf("failed to update file: %w", err)
+	}
+
+	// update the data in-memory
+	if !db.mapped[name] {
+		db.data[name] = deleteVersions(db.data[name], deleteRows, record)
+	}
+
+	err = db.captureChanges(tx, schema, ChangeDelete, oldRows, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range oldRows {
+		change.delete(schema, row)
+	}
+
+	return deleteCnt, nil
+}
+
+func tableFilePath(dbDir string, tableName string) string {
+	return path.Join(dbDir, tableName) + tableFileExtension
+}
+
+// validateSet validates SET part of the UPDATE query and returns
+// parsed values by lowercase column names.
+func validateSet(schema Schema, columns []string, values []string) (map[string]interface{}, error) {
+	if len(columns) != len(values) {
+		return nil, fmt.Errorf("the number of values must be equal to the number of columns")
+	}
+
+	set := make(map[string]interface{})
+	for i, column := range columns {
+		col := strings.ToLower(column)
+		if _, ok := set[col]; ok {
+			return nil, fmt.Errorf("column %s is mentioned twice", col)
+		}
+
+		if schema.RowVersion && col == versionColumn {
+			return nil, fmt.Errorf("column %s is maintained by the database", versionColumn)
+		}
+
+		if schema.Columns[col].Expression != "" {
+			return nil, fmt.Errorf("column %s is generated", col)
+		}
+
+		value, err := parseValue(values[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression at %d: %w", i, err)
+		}
+
+		err = validateSetExpr(schema, col, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression at %d: %w", i, err)
+		}
+
+		set[col] = value
+	}
+
+	return set, nil
+}
+
+func validateSetExpr(schema Schema, column string, value interface{}) error {
+	colDef, exists := schema.Columns[column]
+	if !exists {
+		return newError(CodeUndefinedColumn, "column %s does not exist", column)
+	}
+
+	vt := valueType(value)
+	ct := colDef.ReflectType()
+	if ct != vt {
+		return newError(CodeDatatypeMismatch, "types do not match: column type = %s, value type = %s", ct, vt)
+	}
+
+	return nil
+}
+
+func valueType(value interface{}) reflect.Type {
+	if f, ok := value.(float64); ok && math.Trunc(f) == f {
+		return reflect.TypeOf(0)
+	}
+
+	return reflect.TypeOf(value)
+}
+
+func sortValues(table Schema, insertColumns map[string]int, values [][]interface{}) [][]interface{} {
+	newRows := make([][]interface{}, len(values))
+	for rowIndex, row := range values {
+		newRow := make([]interface{}, len(table.Columns))
+
+		for columnName, index := range insertColumns {
+			position := table.Columns[columnName].Position
+			newRow[position] = row[index]
+		}
+
+		newRows[rowIndex] = newRow
+	}
+
+	return newRows
+}
+
+func initializeMetaFile(metaFilePath string, syncer *syncer, e *encryption) error {
+	_, err := os.Stat(metaFilePath)
+	if err == nil {
+		logging.Infof("meta file %s has been already initialized", metaFilePath)
+		return nil
+	}
+
+	if os.IsNotExist(err) {
+		logging.Infof("meta file %s does not exist, creating a new one...", metaFilePath)
+		err = storeSchema(metaFilePath, make(map[string]Schema), syncer, e)
+		if err != nil {
+			return fmt.Errorf("failed to store empty table map to %s: %w", metaFilePath, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("failed to read information about %s: %w", metaFilePath, err)
+}
+
+func loadSchema(metaFilePath string, e *encryption) (map[string]Schema, error) {
+	content, err := readFileContent(metaFilePath, e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", metaFilePath, err)
+	}
+
+	var tables map[string]Schema
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	err = decoder.Decode(&tables)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", metaFilePath, err)
+	}
+
+	for _, schema := range tables {
+		normalizeStats(schema)
+	}
+
+	return tables, nil
+}
+
+// storeTables replaces the meta file with the tables, it must
+// be called with the database lock held.
+func (db *Database) storeTables() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "\t")
+
+	err := encoder.Encode(persistedTables(db.tables))
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON for %s: %w", db.metaFilePath, err)
+	}
+
+	return db.writeFileContent(db.metaFilePath, buf.Bytes())
+}
+
+func storeSchema(metaFilePath string, tables map[string]Schema, syncer *syncer, e *encryption) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "\t")
+
+	err := encoder.Encode(tables)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON for %s: %w", metaFilePath, err)
+	}
+
+	content, err := e.seal(buf.Bytes(), path.Base(metaFilePath))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", metaFilePath, err)
+	}
+
+	metaFile, err := os.Create(metaFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", metaFilePath, err)
+	}
+	defer func() { checkFileClose(metaFilePath, metaFile.Close()) }()
+
+	if _, err := metaFile.Write(content); err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", metaFilePath, err)
+	}
+
+	return syncer.written(metaFilePath, metaFile)
+}
+
+func loadData(dbDir string, tables map[string]Schema, options Options, e *encryption) (map[string][]*rowVersion, map[string]bool, error) {
+	tableData := make(map[string][]*rowVersion, 0)
+	mapped := make(map[string]bool)
+	for _, schema := range tables {
+		for _, name := range schema.storageNames() {
+			tableFilePath := tableFilePath(dbDir, name)
+			size, err := fileSize(tableFilePath)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if isMappedStorage(options, schema.Name, size, false) {
+				logging.Infof("%s is memory-mapped and not loaded into memory", name)
+				mapped[name] = true
+				continue
+			}
+
+			rows, err := readStorage(tableFilePath, schema, e)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			tableData[name] = newVersions(rows, loadedRecord)
+		}
+	}
+
+	return tableData, mapped, nil
+}
+
+// readStorage reads rows of the table or partition data file.
+func readStorage(tableFilePath string, schema Schema, e *encryption) ([][]interface{}, error) {
+	data, err := readFileContent(tableFilePath, e)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read file %s: %w", tableFilePath, err)
+	}
+
+	var rows [][]interface{}
+	if os.IsNotExist(err) {
+		rows = make([][]interface{}, 0)
+	} else {
+		err = verifyChecksum(tableFilePath, data, e)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(data, &rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JSON from %s: %w", tableFilePath, err)
+		}
+	}
+
+	for _, row := range rows {
+		normalizeRow(schema, row)
+		err = decodeRow(schema, row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode row from %s: %w", tableFilePath, err)
+		}
+	}
+
+	return rows, nil
+}
+
+// normalizeRow converts JSON numbers decoded as float64
+// back to integers for integer columns.
+func normalizeRow(schema Schema, row []interface{}) {
+	for _, column := range schema.Columns {
+		if column.Type != sql.TypeInteger || column.Position >= len(row) {
+			continue
+		}
+
+		if f, ok := row[column.Position].(float64); ok {
+			row[column.Position] = int(f)
+		}
+	}
+}
+
+func (db *Database) deleteRowsInFile(tableName string, deleteRows map[int]struct{}) error {
+	return db.updateFile(tableName, func(rows [][]interface{}) ([][]interface{}, error) {
+		newRows := make([][]interface{}, 0)
+		for index, row := range rows {
+			if _, del := deleteRows[index]; del {
+				continue
+			}
+
+			newRows = append(newRows, row)
+		}
+
+		return newRows, nil
+	})
+}
+
+func (db *Database) updateRowsInFile(tableName string, updateRows map[int][]interface{}) error {
+	return db.updateFile(tableName, func(rows [][]interface{}) ([][]interface{}, error) {
+		for index, newRow := range updateRows {
+			rows[index] = newRow
+		}
+
+		return rows, nil
+	})
+}
+
+func (db *Database) writeToFileNewRows(tableName string, newRows [][]interface{}) error {
+	return db.updateFile(tableName, func(rows [][]interface{}) ([][]interface{}, error) {
+		return append(rows, newRows...), nil
+	})
+}
+
+func (db *Database) updateFile(tableName string, updateRows func([][]interface{}) ([][]interface{}, error)) error {
+	if db.inMemory(tableName) {
+		// the rows of the memory tables are only in the versions
+		return nil
+	}
+
+	tableFilePath := tableFilePath(db.dbDir, tableName)
+	data, err := readFileContent(tableFilePath, db.encryption)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read file %s: %w", tableFilePath, err)
+	}
+
+	var rows [][]interface{}
+	if os.IsNotExist(err) {
+		rows = make([][]interface{}, 0)
+	} else {
+		err := json.Unmarshal(data, &rows)
+		if err != nil {
+			return fmt.Errorf("failed to decode JSON from %s: %w", tableFilePath, err)
+		}
+	}
+
+	newRows, err := updateRows(rows)
+	if err != nil {
+		return fmt.Errorf("failed to update rows: %w", err)
+	}
+
+	return db.writeFile(tableName, newRows)
+}
+
+// writeFile replaces the content of the table or partition data file
+// with the rows and stores the checksum of the new content. While the
+// data file is replaced, the checksum file lists the checksums of both
+// the new and the old content, so a crash between the two files leaves
+// the data file that matches its checksum.
+func (db *Database) writeFile(name string, rows [][]interface{}) error {
+	if db.inMemory(name) {
+		return nil
+	}
+
+	tableFilePath := tableFilePath(db.dbDir, name)
+
+	rows, err := db.encodeStorage(name, rows)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "\t")
+
+	err = encoder.Encode(rows)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON for %s: %w", tableFilePath, err)
+	}
+
+	checksumFilePath := checksumFilePath(tableFilePath)
+	sum := checksum(buf.Bytes())
+	previous, err := readFileContent(checksumFilePath, db.encryption)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read checksum of %s: %w", tableFilePath, err)
+	}
+	if len(previous) > 0 {
+		err = db.writeFileContent(checksumFilePath, []byte(sum+"\n"+strings.SplitN(string(previous), "\n", 2)[0]))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.writeFileContent(tableFilePath, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return db.writeFileContent(checksumFilePath, []byte(sum))
+}
+
+// writeFileContent replaces the file with a new one encrypted if the
+// encryption is enabled, so the readers that have opened the old file
+// keep reading the old content.
+func (db *Database) writeFileContent(filePath string, content []byte) error {
+	sealed, err := db.encryption.seal(content, path.Base(filePath))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", filePath, err)
+	}
+
+	return db.writeFileBytes(filePath, sealed)
+}
+
+// writeFileBytes replaces the file with the content as it is, it is
+// used for the files copied from the disk that are encrypted already.
+func (db *Database) writeFileBytes(filePath string, content []byte) error {
+	tempFilePath := filePath + tempFileExtension
+	file, err := os.Create(tempFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create/open file for write %s: %w", tempFilePath, err)
+	}
+	defer func() { checkFileClose(tempFilePath, file.Close()) }()
+
+	_, err = file.Write(content)
+	if err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", tempFilePath, err)
+	}
+
+	err = db.syncer.replaced(tempFilePath, filePath, file)
+	if err != nil {
+		return err
+	}
+
+	return db.archiveFile(filePath, content, false)
+}
+
+func checkFileClose(filePath string, err error) {
+	if err != nil {
+		panic(fmt.Errorf("failed to close file %s: %w", filePath, err))
+	}
+}
@@ -0,0 +1,200 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Dictionary encodes values of a low-cardinality string column
+// as small integers, the code of the value is its index.
+//
+// The dictionary only grows until it reaches the maximum size and
+// then it is sealed: values that are not in the sealed dictionary
+// are stored as is. Since codes are integers and the column is
+// a string one, the data files can mix codes and plain values.
+type Dictionary struct {
+	Values []string `json:"values"`
+	// Sealed is set when the dictionary has reached the maximum size,
+	// until then it contains every value ever written to the column.
+	Sealed bool `json:"sealed,omitempty"`
+
+	// codes by values, built on demand
+	codes map[string]int
+}
+
+// code returns the code of the value.
+func (d *Dictionary) code(value string) (int, bool) {
+	if d.codes == nil {
+		d.codes = make(map[string]int, len(d.Values))
+		for code, v := range d.Values {
+			d.codes[v] = code
+		}
+	}
+
+	code, exists := d.codes[value]
+
+	return code, exists
+}
+
+// add adds the value to the dictionary if it is not sealed
+// and returns its code.
+func (d *Dictionary) add(value string, maxSize int) (int, bool) {
+	if code, exists := d.code(value); exists {
+		return code, true
+	}
+
+	if d.Sealed {
+		return 0, false
+	}
+
+	if len(d.Values) >= maxSize {
+		d.Sealed = true
+		return 0, false
+	}
+
+	code := len(d.Values)
+	d.Values = append(d.Values, value)
+	d.codes[value] = code
+
+	return code, true
+}
+
+// newDictionaries creates empty dictionaries for all the string
+// columns, nil if dictionary encoding is disabled.
+func newDictionaries(columns map[string]ColumnDef, maxSize int) map[string]*Dictionary {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	dictionaries := make(map[string]*Dictionary)
+	for _, column := range columns {
+		if column.Type == sql.TypeString {
+			dictionaries[column.Name] = &Dictionary{Values: make([]string, 0)}
+		}
+	}
+
+	return dictionaries
+}
+
+// encodeRows replaces dictionary values with their codes. The rows
+// are not modified, the encoded copies are returned. It reports
+// whether any of the dictionaries has changed.
+func encodeRows(schema Schema, rows [][]interface{}, maxSize int) ([][]interface{}, bool) {
+	if len(schema.Dictionaries) == 0 {
+		return rows, false
+	}
+
+	changed := false
+	encoded := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		encoded[i] = make([]interface{}, len(row))
+		copy(encoded[i], row)
+
+		for name, dictionary := range schema.Dictionaries {
+			position := schema.Columns[name].Position
+			value, ok := row[position].(string)
+			if !ok {
+				// already encoded
+				continue
+			}
+
+			size, sealed := len(dictionary.Values), dictionary.Sealed
+			code, ok := dictionary.add(value, maxSize)
+			changed = changed || size != len(dictionary.Values) || sealed != dictionary.Sealed
+			if ok {
+				encoded[i][position] = code
+			}
+		}
+	}
+
+	return encoded, changed
+}
+
+// decodeRow replaces dictionary codes with the values, the values
+// are shared with the dictionary, and computes the virtual columns.
+func decodeRow(schema Schema, row []interface{}) error {
+	for name, dictionary := range schema.Dictionaries {
+		position := schema.Columns[name].Position
+		if position >= len(row) {
+			continue
+		}
+
+		code, ok := row[position].(float64)
+		if !ok {
+			continue
+		}
+
+		if code < 0 || int(code) >= len(dictionary.Values) {
+			return fmt.Errorf("unknown dictionary code %v of column %s", code, name)
+		}
+		row[position] = dictionary.Values[int(code)]
+	}
+
+	return computeGenerated(schema, row, true)
+}
+
+// frozenDictionaries copies the dictionaries to decode the rows
+// without the database lock, the copies do not see the values added
+// to the dictionaries later.
+func frozenDictionaries(dictionaries map[string]*Dictionary) map[string]*Dictionary {
+	if dictionaries == nil {
+		return nil
+	}
+
+	frozen := make(map[string]*Dictionary, len(dictionaries))
+	for name, dictionary := range dictionaries {
+		values := dictionary.Values
+		frozen[name] = &Dictionary{Values: values[:len(values):len(values)], Sealed: dictionary.Sealed}
+	}
+
+	return frozen
+}
+
+// dictionaryExcludes reports whether the expression requires a value
+// that is not in the complete dictionary, so no rows can match.
+func (schema Schema) dictionaryExcludes(expr sql.Expr) bool {
+	for name, dictionary := range schema.Dictionaries {
+		if dictionary.Sealed || !binaryCollation(schema.Columns[name].Collation) {
+			continue
+		}
+
+		value, found := equalityValue(expr, name)
+		if !found {
+			continue
+		}
+
+		if s, ok := value.(string); ok {
+			if _, exists := dictionary.code(s); !exists {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// encodeStorage encodes the rows of the table or partition data file
+// and stores the changed dictionaries before the data file is written,
+// so the written codes are always known.
+func (db *Database) encodeStorage(name string, rows [][]interface{}) ([][]interface{}, error) {
+	tableName := strings.SplitN(name, ".", 2)[0]
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return rows, nil
+	}
+
+	encoded, changed := encodeRows(schema, rows, db.options.DictionaryMaxSize)
+	encoded = stripVirtual(schema, encoded)
+	if !changed {
+		return encoded, nil
+	}
+
+	err := db.storeTables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store dictionaries: %w", err)
+	}
+
+	return encoded, nil
+}
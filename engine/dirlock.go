@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// Only one db process is allowed to run within the db directory.
+// The process holds an advisory lock on the lock file while it runs
+// and keeps its PID in the file. The operating system releases the
+// lock when the process dies, even if it has been killed, so the next
+// process takes the lock over, the PID left in the file is only logged.
+// The file itself is never removed: a process could lock the removed
+// file while another one locks the new file.
+const lockFileName = "gosqldb.lock"
+
+// errLocked is returned when the lock file is locked by another process.
+var errLocked = errors.New("locked by another process")
+
+// DirLock is the lock of the db directory held by the process.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir locks the db directory. With force the lock held by another
+// process is broken: the lock file is replaced by a new one, it must
+// be used only when the process holding the lock does not run.
+func LockDir(dbDir string, force bool) (*DirLock, error) {
+	lockFilePath := path.Join(dbDir, lockFileName)
+	file, err := openLockFile(lockFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file)
+	if errors.Is(err, errLocked) && force {
+		logging.Warnf("forcing unlock of %s held by process %s", lockFilePath, readLockPID(lockFilePath))
+		checkFileClose(lockFilePath, file.Close())
+		if err := os.Remove(lockFilePath); err != nil {
+			return nil, fmt.Errorf("failed to remove lock file %s: %w", lockFilePath, err)
+		}
+
+		file, err = openLockFile(lockFilePath)
+		if err != nil {
+			return nil, err
+		}
+		err = lockFile(file)
+	}
+
+	if errors.Is(err, errLocked) {
+		checkFileClose(lockFilePath, file.Close())
+
+		return nil, fmt.Errorf("database %s is locked by process %s, if the process does not run, start with -force-unlock", dbDir, readLockPID(lockFilePath))
+	}
+
+	if err != nil {
+		checkFileClose(lockFilePath, file.Close())
+
+		return nil, fmt.Errorf("failed to lock file %s: %w", lockFilePath, err)
+	}
+
+	if pid := readLockPID(lockFilePath); pid != "" {
+		logging.Warnf("reclaiming lock file %s left by process %s", lockFilePath, pid)
+	}
+
+	l := &DirLock{file}
+	err = l.writePID(strconv.Itoa(os.Getpid()) + "\n")
+	if err != nil {
+		if releaseErr := l.Release(); releaseErr != nil {
+			logging.Errorf("failed to release lock file %s: %s", lockFilePath, releaseErr)
+		}
+
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func openLockFile(lockFilePath string) (*os.File, error) {
+	file, err := os.OpenFile(lockFilePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", lockFilePath, err)
+	}
+
+	return file, nil
+}
+
+// readLockPID returns the PID stored in the lock file,
+// empty if there is none.
+func readLockPID(lockFilePath string) string {
+	content, err := ioutil.ReadFile(lockFilePath)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+// writePID replaces the content of the lock file with the PID.
+func (l *DirLock) writePID(pid string) error {
+	lockFilePath := l.file.Name()
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate lock file %s: %w", lockFilePath, err)
+	}
+
+	if _, err := l.file.WriteAt([]byte(pid), 0); err != nil {
+		return fmt.Errorf("failed to write lock file %s: %w", lockFilePath, err)
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync lock file %s: %w", lockFilePath, err)
+	}
+
+	return nil
+}
+
+// Path returns the path of the lock file.
+func (l *DirLock) Path() string {
+	return l.file.Name()
+}
+
+// Release clears the PID and unlocks the lock file.
+func (l *DirLock) Release() error {
+	lockFilePath := l.file.Name()
+	err := l.writePID("")
+	if err != nil {
+		return err
+	}
+
+	if err := unlockFile(l.file); err != nil {
+		return fmt.Errorf("failed to unlock file %s: %w", lockFilePath, err)
+	}
+
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close lock file %s: %w", lockFilePath, err)
+	}
+
+	return nil
+}
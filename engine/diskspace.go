@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The free space of the file system of the database is checked before
+// every statement that changes the data, the schema, the users or the
+// tokens. Below the minimum the database is degraded into the read-only
+// state and the statement is rejected before anything is written, so a
+// full disk does not fail a table file rewrite halfway. The state is
+// left by the first change after the space has been freed.
+
+// ErrDiskFull is returned for the changes while the file system of
+// the database has less free space than the minimum.
+var ErrDiskFull = errors.New("the disk is almost full, the database is read-only")
+
+// DiskStatus describes the free space of the file system of the database.
+type DiskStatus struct {
+	// FreeBytes is the free space found by the last check,
+	// -1 if it is not known.
+	FreeBytes    int64 `json:"free_bytes"`
+	MinFreeBytes int64 `json:"min_free_bytes"`
+	// Degraded is true while the changes are rejected
+	// because of the free space.
+	Degraded bool `json:"degraded"`
+}
+
+// diskGuard keeps the result of the last free space check.
+type diskGuard struct {
+	mu     sync.Mutex
+	status DiskStatus
+}
+
+// checkDiskSpace checks the free space before a change, the database
+// is degraded or recovered by the result.
+func (db *Database) checkDiskSpace() error {
+	if db.options.MinFreeDisk <= 0 {
+		return nil
+	}
+
+	free, err := freeDiskSpace(db.dbDir)
+	if err != nil {
+		return err
+	}
+
+	db.disk.mu.Lock()
+	defer db.disk.mu.Unlock()
+
+	status := &db.disk.status
+	status.FreeBytes, status.MinFreeBytes = free, db.options.MinFreeDisk
+	if free < 0 {
+		return nil
+	}
+
+	degraded := free < db.options.MinFreeDisk
+	if degraded != status.Degraded {
+		if degraded {
+			logging.Errorf("the disk has %d bytes free, less than %d, the database is read-only until the space is freed", free, db.options.MinFreeDisk)
+		} else {
+			logging.Infof("the disk has %d bytes free, the database is writable again", free)
+		}
+		status.Degraded = degraded
+	}
+
+	if degraded {
+		return fmt.Errorf("%w: %d bytes free, min %d bytes", ErrDiskFull, free, db.options.MinFreeDisk)
+	}
+
+	return nil
+}
+
+// DiskStatus checks the free space and returns the status, ok is false
+// if the free space is not checked.
+func (db *Database) DiskStatus() (status DiskStatus, ok bool) {
+	if db.options.MinFreeDisk <= 0 {
+		return DiskStatus{}, false
+	}
+
+	if err := db.checkDiskSpace(); err != nil && !errors.Is(err, ErrDiskFull) {
+		logging.Warnf("%s", err)
+	}
+
+	db.disk.mu.Lock()
+	defer db.disk.mu.Unlock()
+
+	return db.disk.status, true
+}
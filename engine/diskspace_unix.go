@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package engine
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeDiskSpace returns the bytes available to the process
+// on the file system of the directory.
+func freeDiskSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat file system of %s: %w", dir, err)
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
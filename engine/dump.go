@@ -0,0 +1,319 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The dump is the text with one statement per line: CREATE TABLE of
+// every dumped table and ALTER TABLE of its masked columns followed
+// by INSERT of every its row. The lines
+// starting with -- are comments. The dump is replayed by Import or
+// line by line over any API, so the tables can be moved to another
+// database. The row versions are not dumped, the imported rows
+// start from version 1.
+
+// dumpCommentPrefix starts the comment lines of the dump.
+const dumpCommentPrefix = "--"
+
+// maxDumpLineSize limits the statements of the dump.
+const maxDumpLineSize = 64 * 1024 * 1024
+
+// importBatchSize is the number of the rows imported in one transaction.
+const importBatchSize = 1000
+
+// Dump writes the statements that create the tables and insert their
+// rows, all the persisted tables if none are given. The rows are read
+// within a repeatable read transaction, so the tables are dumped
+// consistently.
+func (db *Database) Dump(ctx context.Context, w io.Writer, tables []string) error {
+	tx, err := db.BeginReadOnly()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			logging.Errorf("failed to roll back dump transaction %s: %s", tx.ID, err)
+		}
+	}()
+
+	return db.DumpTransaction(ctx, tx, w, tables)
+}
+
+// DumpTransaction writes the dump of the tables as they are seen
+// by the transaction, the transaction is not ended.
+func (db *Database) DumpTransaction(ctx context.Context, tx *Transaction, w io.Writer, tables []string) error {
+	if len(tables) == 0 {
+		tables = db.persistedTableNames()
+	}
+
+	b := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(b, "%s gosqldb dump of %d tables\n", dumpCommentPrefix, len(tables)); err != nil {
+		return fmt.Errorf("failed to write dump: %w", err)
+	}
+
+	for _, name := range tables {
+		schema, err := db.Schema(name)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintln(b, createTableStatement(schema)); err != nil {
+			return fmt.Errorf("failed to write dump: %w", err)
+		}
+
+		for _, statement := range maskStatements(schema) {
+			if _, err := fmt.Fprintln(b, statement); err != nil {
+				return fmt.Errorf("failed to write dump: %w", err)
+			}
+		}
+
+		columns := writableColumns(schema)
+		names := make([]string, len(columns))
+		sqlNames := make([]string, len(columns))
+		for i, column := range columns {
+			names[i] = column.Name
+			sqlNames[i] = sqlName(column.Name)
+		}
+
+		prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES (", sqlName(schema.Name), strings.Join(sqlNames, ", "))
+		query := &sql.Select{Table: schema.Name, Columns: names}
+		err = tx.SelectEachContext(ctx, query, func(row []interface{}) error {
+			// the versioned tables add the row version to the rows and
+			// the generated columns may be between the dumped ones
+			values := make([]string, len(columns))
+			for i, column := range columns {
+				values[i] = literal(row[column.Position])
+			}
+
+			_, err := fmt.Fprintf(b, "%s%s)\n", prefix, strings.Join(values, ", "))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to dump table %s: %w", schema.Name, err)
+		}
+	}
+
+	if err := b.Flush(); err != nil {
+		return fmt.Errorf("failed to write dump: %w", err)
+	}
+
+	return nil
+}
+
+// dumpedColumns returns the columns of the table in the order of
+// the row values without the row version column.
+func dumpedColumns(schema Schema) []ColumnDef {
+	columns := make([]ColumnDef, len(schema.Columns))
+	for _, column := range schema.Columns {
+		columns[column.Position] = column
+	}
+
+	dumped := columns[:0]
+	for _, column := range columns {
+		if column.Name != versionColumn {
+			dumped = append(dumped, column)
+		}
+	}
+
+	return dumped
+}
+
+// createTableStatement renders the statement that creates the table.
+func createTableStatement(schema Schema) string {
+	var b strings.Builder
+	switch {
+	case schema.Session != "":
+		b.WriteString("CREATE TEMPORARY TABLE ")
+	case schema.InMemory:
+		b.WriteString("CREATE MEMORY TABLE ")
+	default:
+		b.WriteString("CREATE TABLE ")
+	}
+	b.WriteString(sqlName(schema.Name))
+	b.WriteString(" (")
+	for i, column := range dumpedColumns(schema) {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(sqlName(column.Name))
+		if column.Type == sql.TypeString {
+			b.WriteString(" STRING")
+		} else {
+			b.WriteString(" INTEGER")
+		}
+		if column.Expression != "" {
+			fmt.Fprintf(&b, " AS (%s)", column.Expression)
+			if column.Stored {
+				b.WriteString(" STORED")
+			}
+		}
+	}
+	b.WriteString(")")
+
+	switch schema.Engine {
+	case sql.EngineLSM:
+		b.WriteString(" ENGINE = LSM")
+	case sql.EngineBPTree:
+		b.WriteString(" ENGINE = BPTREE")
+	}
+
+	if p := schema.Partitioning; p != nil {
+		if p.Type == PartitionHash {
+			fmt.Fprintf(&b, " PARTITION BY HASH (%s) PARTITIONS %d", p.Column, len(p.Partitions))
+		} else {
+			fmt.Fprintf(&b, " PARTITION BY RANGE (%s) (", p.Column)
+			for i, partition := range p.Partitions {
+				if i > 0 {
+					b.WriteString(", ")
+				}
+				fmt.Fprintf(&b, "PARTITION %s VALUES LESS THAN ", partition.Name)
+				if partition.LessThan == nil {
+					b.WriteString("MAXVALUE")
+				} else {
+					fmt.Fprintf(&b, "(%d)", *partition.LessThan)
+				}
+			}
+			b.WriteString(")")
+		}
+	}
+
+	if schema.RowVersion {
+		b.WriteString(" WITH ROW VERSION")
+	}
+
+	return b.String()
+}
+
+// maskStatements renders the statements that mask the columns.
+func maskStatements(schema Schema) []string {
+	var statements []string
+	for _, column := range dumpedColumns(schema) {
+		if column.Mask != nil {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET MASK %s", sqlName(schema.Name), sqlName(column.Name), column.Mask))
+		}
+	}
+
+	return statements
+}
+
+// literal renders the row value as the literal of the statement.
+func literal(value interface{}) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case string:
+		return quoteString(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ImportResult describes the imported dump.
+type ImportResult struct {
+	Statements int `json:"statements"`
+	Rows       int `json:"rows"`
+}
+
+// Import executes the statements of the dump. The consecutive inserts
+// are executed in the transactions of up to a thousand rows, the rest
+// of the statements are executed one by one. The import stops at the
+// first failed statement, the rows inserted before it stay.
+func (db *Database) Import(ctx context.Context, r io.Reader) (ImportResult, error) {
+	var result ImportResult
+	var tx *Transaction
+	batched := 0
+
+	commit := func() error {
+		if tx == nil {
+			return nil
+		}
+
+		err := tx.Commit()
+		if err == nil {
+			result.Rows += batched
+		}
+		tx, batched = nil, 0
+
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, dumpCommentPrefix) {
+			continue
+		}
+
+		query, err := Parse(text)
+		if err != nil {
+			rollbackImport(tx)
+			return result, fmt.Errorf("failed to parse line %d: %w", line, err)
+		}
+
+		insert, isInsert := query.(*sql.Insert)
+		if !isInsert {
+			if err := commit(); err != nil {
+				return result, fmt.Errorf("failed to commit rows before line %d: %w", line, err)
+			}
+
+			if _, err := db.ExecuteContext(ctx, query); err != nil {
+				return result, fmt.Errorf("failed to execute line %d: %w", line, err)
+			}
+			result.Statements++
+			continue
+		}
+
+		if tx == nil {
+			tx, err = db.Begin(db.options.Isolation)
+			if err != nil {
+				return result, err
+			}
+		}
+
+		if _, err := tx.InsertContext(ctx, insert); err != nil {
+			rollbackImport(tx)
+			return result, fmt.Errorf("failed to execute line %d: %w", line, err)
+		}
+		result.Statements++
+		batched++
+
+		if batched == importBatchSize {
+			if err := commit(); err != nil {
+				return result, fmt.Errorf("failed to commit rows at line %d: %w", line, err)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		rollbackImport(tx)
+		return result, fmt.Errorf("failed to read dump: %w", err)
+	}
+
+	if err := commit(); err != nil {
+		return result, fmt.Errorf("failed to commit rows: %w", err)
+	}
+
+	return result, nil
+}
+
+// rollbackImport rolls back the not committed rows of the failed import.
+func rollbackImport(tx *Transaction) {
+	if tx == nil {
+		return
+	}
+
+	if err := tx.Rollback(); err != nil {
+		logging.Errorf("failed to roll back import transaction %s: %s", tx.ID, err)
+	}
+}
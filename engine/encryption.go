@@ -0,0 +1,648 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The files of the database are encrypted at rest with AES-GCM if the
+// key provider is set: the data files with their checksums, the meta
+// file, the users, the tokens, the schemas and the sequences are
+// encrypted as a whole, the lines of the query history, the changefeed
+// and the audit log one by one. The journals, the backups and the
+// archive keep the files as they are on disk, so they are encrypted
+// too, and the replicas receive the encrypted files, the nodes of the
+// cluster must share the keys. The files of the node state, like the
+// lock and the replica position, have no user data and are not
+// encrypted. The encrypted file starts with the header that names the
+// key, so the files encrypted with the older keys are read while the
+// provider has the keys. The name of the file is authenticated with
+// its content, so the encrypted files can not be swapped, and the files
+// that have not been encrypted are rejected unless they are encrypted
+// by the migration when the database is opened. The plain lines of the
+// logs written before the encryption are read as they are. The
+// memory-mapped data files are decrypted into memory on every scan.
+//
+// The key rotation reloads the keys of the provider and re-encrypts
+// the files with the current key in the background. The lines of the
+// logs are not re-encrypted, they expire with the retention, so the
+// older keys are kept in the provider until then.
+
+// encryptedFileHeader starts the encrypted file, it is followed by the
+// format version, the length of the key identifier, the identifier,
+// the nonce and the sealed content.
+const encryptedFileHeader = "GOSQLENC"
+
+// encryptedFileVersion is the version of the format of the encrypted
+// files, the name of the file is the additional data since version 2.
+const encryptedFileVersion = 2
+
+// encryptedLinePrefix starts the encrypted line of the logs, the rest
+// is the encrypted file content in base64. The plain lines are JSON
+// objects, so they do not start with it.
+const encryptedLinePrefix = "~"
+
+// ErrNoEncryptionKey is returned for the encrypted file when the key
+// provider is not set or does not have the key of the file.
+var ErrNoEncryptionKey = errors.New("encryption key is not available")
+
+// ErrNotEncrypted is returned for the file that has not been encrypted
+// while the encryption is enabled.
+var ErrNotEncrypted = errors.New("file is not encrypted")
+
+// KeyProvider supplies the keys of the encryption at rest, the keys
+// are 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the identifier and the key the files are
+	// encrypted with.
+	CurrentKey() (string, []byte, error)
+	// Key returns the key by the identifier the file has been
+	// encrypted with.
+	Key(id string) ([]byte, error)
+}
+
+// ReloadableKeyProvider is the key provider that loads the keys again
+// before the rotation, the new current key is used after the reload.
+type ReloadableKeyProvider interface {
+	KeyProvider
+	Reload() error
+}
+
+// staticKeys are the keys by their identifiers, the current key
+// is the last listed one.
+type staticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (k *staticKeys) CurrentKey() (string, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *staticKeys) Key(id string) ([]byte, error) {
+	key, exists := k.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: key %s is unknown", ErrNoEncryptionKey, id)
+	}
+
+	return key, nil
+}
+
+// parseKeys parses the keys separated by the commas or the new lines,
+// every key is the identifier and the base64 value separated by "=":
+//
+//	2024-01=base64key,2024-02=base64key
+func parseKeys(spec string) (*staticKeys, error) {
+	keys := &staticKeys{keys: make(map[string][]byte)}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, fmt.Errorf("invalid key %q, expected id=base64", entry)
+		}
+
+		// the base64 padding is a part of the value
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", parts[0], err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", parts[0], err)
+		}
+
+		keys.keys[parts[0]] = key
+		keys.current = parts[0]
+	}
+
+	if keys.current == "" {
+		return nil, errors.New("no encryption keys")
+	}
+
+	return keys, nil
+}
+
+// keyFileProvider reads the keys from the file with a key per line,
+// the file is read again on the reload, so the new key is appended
+// to the file before the rotation.
+type keyFileProvider struct {
+	filePath string
+
+	mu   sync.Mutex
+	keys *staticKeys
+}
+
+func (p *keyFileProvider) Reload() error {
+	content, err := ioutil.ReadFile(p.filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read key file %s: %w", p.filePath, err)
+	}
+
+	keys, err := parseKeys(string(content))
+	if err != nil {
+		return fmt.Errorf("failed to parse key file %s: %w", p.filePath, err)
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *keyFileProvider) CurrentKey() (string, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.keys.CurrentKey()
+}
+
+func (p *keyFileProvider) Key(id string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.keys.Key(id)
+}
+
+// NewKeyProvider returns the provider of the keys by the specification:
+// "file:path" reads the keys from the file with a key per line and
+// reloads them on the rotation, otherwise the specification is the
+// list of the keys, id=base64 separated by the commas. The current key
+// is the last one.
+func NewKeyProvider(spec string) (KeyProvider, error) {
+	if strings.HasPrefix(spec, "file:") {
+		provider := &keyFileProvider{filePath: strings.TrimPrefix(spec, "file:")}
+		if err := provider.Reload(); err != nil {
+			return nil, err
+		}
+
+		return provider, nil
+	}
+
+	return parseKeys(spec)
+}
+
+// EncryptionStatus describes the encryption at rest and the
+// last key rotation.
+type EncryptionStatus struct {
+	Enabled    bool   `json:"enabled"`
+	CurrentKey string `json:"current_key,omitempty"`
+	Rotating   bool   `json:"rotating"`
+	// Rewritten is the number of the files re-encrypted by the last
+	// rotation, Remaining is the number of the files left.
+	Rewritten int       `json:"rewritten"`
+	Remaining int       `json:"remaining"`
+	Started   time.Time `json:"started,omitempty"`
+	Finished  time.Time `json:"finished,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// encryption seals and opens the content of the files, nil if the
+// encryption is disabled. The nil encryption passes the content as
+// it is and fails to open the encrypted content.
+type encryption struct {
+	provider KeyProvider
+
+	mu      sync.Mutex
+	current string
+	// ciphers by the key identifiers
+	ciphers map[string]cipher.AEAD
+	status  EncryptionStatus
+}
+
+func newEncryption(provider KeyProvider) (*encryption, error) {
+	if provider == nil {
+		return nil, nil
+	}
+
+	e := &encryption{provider: provider, ciphers: make(map[string]cipher.AEAD)}
+	if err := e.loadCurrent(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// loadCurrent loads the current key of the provider.
+func (e *encryption) loadCurrent() error {
+	id, key, err := e.provider.CurrentKey()
+	if err != nil {
+		return fmt.Errorf("failed to get current encryption key: %w", err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return fmt.Errorf("invalid encryption key %s: %w", id, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.current = id
+	e.ciphers[id] = aead
+	e.status.Enabled, e.status.CurrentKey = true, id
+
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// cipher returns the cipher of the key, the current one
+// if the identifier is empty.
+func (e *encryption) cipher(id string) (string, cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if id == "" {
+		id = e.current
+	}
+
+	if aead, exists := e.ciphers[id]; exists {
+		return id, aead, nil
+	}
+
+	key, err := e.provider.Key(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid encryption key %s: %w", id, err)
+	}
+	e.ciphers[id] = aead
+
+	return id, aead, nil
+}
+
+// seal encrypts the content of the named file with the current key.
+func (e *encryption) seal(content []byte, name string) ([]byte, error) {
+	if e == nil {
+		return content, nil
+	}
+
+	id, aead, err := e.cipher("")
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(encryptedFileHeader)+2+len(id)+aead.NonceSize()+len(content)+aead.Overhead())
+	sealed = append(sealed, encryptedFileHeader...)
+	sealed = append(sealed, encryptedFileVersion, byte(len(id)))
+	sealed = append(sealed, id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed = append(sealed, nonce...)
+
+	return aead.Seal(sealed, nonce, content, []byte(name)), nil
+}
+
+// encryptionKey returns the identifier of the key
+// the content is encrypted with.
+func encryptionKey(content []byte) (string, bool) {
+	if !bytes.HasPrefix(content, []byte(encryptedFileHeader)) || len(content) < len(encryptedFileHeader)+2 {
+		return "", false
+	}
+
+	idStart := len(encryptedFileHeader) + 2
+	idEnd := idStart + int(content[idStart-1])
+	if len(content) < idEnd {
+		return "", false
+	}
+
+	return string(content[idStart:idEnd]), true
+}
+
+// open decrypts the content of the named file, the content that has
+// not been encrypted is returned as it is only if the encryption is
+// disabled.
+func (e *encryption) open(content []byte, name string) ([]byte, error) {
+	id, encrypted := encryptionKey(content)
+	if !encrypted && e != nil {
+		return nil, ErrNotEncrypted
+	}
+	if !encrypted {
+		return content, nil
+	}
+
+	if e == nil {
+		return nil, fmt.Errorf("%w: the file is encrypted with key %s", ErrNoEncryptionKey, id)
+	}
+
+	// the files of the first version are not bound to their names,
+	// the key rotation encrypts them again
+	additionalData := []byte(name)
+	switch version := content[len(encryptedFileHeader)]; version {
+	case 1:
+		additionalData = nil
+	case encryptedFileVersion:
+	default:
+		return nil, fmt.Errorf("unsupported encrypted file version %d", version)
+	}
+
+	_, aead, err := e.cipher(id)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceStart := len(encryptedFileHeader) + 2 + len(id)
+	if len(content) < nonceStart+aead.NonceSize() {
+		return nil, errors.New("encrypted content is truncated")
+	}
+	nonce := content[nonceStart : nonceStart+aead.NonceSize()]
+
+	opened, err := aead.Open(nil, nonce, content[nonceStart+aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content with key %s: %w", id, err)
+	}
+
+	return opened, nil
+}
+
+// sealLine encrypts the line of the log without the line end.
+func (e *encryption) sealLine(line []byte) ([]byte, error) {
+	if e == nil {
+		return line, nil
+	}
+
+	sealed, err := e.seal(line, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(encryptedLinePrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openLine decrypts the line of the log, the line that has
+// not been encrypted is returned as it is.
+func (e *encryption) openLine(line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, []byte(encryptedLinePrefix)) {
+		return line, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(line[len(encryptedLinePrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted line: %w", err)
+	}
+
+	return e.open(sealed, "")
+}
+
+// readFileContent reads and decrypts the file.
+func readFileContent(filePath string, e *encryption) ([]byte, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	opened, err := e.open(content, path.Base(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", filePath, err)
+	}
+
+	return opened, nil
+}
+
+// encryptedFile reports whether the file of the db directory
+// is encrypted as a whole.
+func encryptedFile(name string) bool {
+	switch name {
+	case metaFileName, usersFileName, tokensFileName, schemasFileName, sequencesFileName, settingsFileName:
+		return true
+	}
+
+	return strings.HasSuffix(name, tableFileExtension) || strings.HasSuffix(name, checksumFileExtension)
+}
+
+// EncryptionStatus returns the state of the encryption at rest.
+func (db *Database) EncryptionStatus() EncryptionStatus {
+	if db.encryption == nil {
+		return EncryptionStatus{}
+	}
+
+	db.encryption.mu.Lock()
+	defer db.encryption.mu.Unlock()
+
+	return db.encryption.status
+}
+
+// RotateEncryptionKey reloads the keys of the provider and re-encrypts
+// the files with the current key in the background.
+func (db *Database) RotateEncryptionKey() error {
+	e := db.encryption
+	if e == nil {
+		return errors.New("encryption at rest is not enabled")
+	}
+
+	e.mu.Lock()
+	rotating := e.status.Rotating
+	if !rotating {
+		e.status.Rotating = true
+	}
+	e.mu.Unlock()
+	if rotating {
+		return errors.New("the key rotation is in progress")
+	}
+
+	if provider, ok := e.provider.(ReloadableKeyProvider); ok {
+		if err := provider.Reload(); err != nil {
+			e.finishRotation(err)
+			return err
+		}
+	}
+
+	if err := e.loadCurrent(); err != nil {
+		e.finishRotation(err)
+		return err
+	}
+
+	names, err := db.encryptedFileNames()
+	if err != nil {
+		e.finishRotation(err)
+		return err
+	}
+
+	e.mu.Lock()
+	e.status.Started, e.status.Finished = time.Now().UTC(), time.Time{}
+	e.status.Rewritten, e.status.Remaining, e.status.Error = 0, len(names), ""
+	e.mu.Unlock()
+
+	go func() {
+		err := db.reencrypt(names)
+		if err != nil {
+			logging.Errorf("failed to re-encrypt files: %s", err)
+		}
+		e.finishRotation(err)
+	}()
+
+	return nil
+}
+
+func (e *encryption) finishRotation(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.status.Rotating = false
+	e.status.Finished = time.Now().UTC()
+	if err != nil {
+		e.status.Error = err.Error()
+	}
+}
+
+// encryptedFileNames lists the files of the db directory
+// that are encrypted as a whole.
+func (db *Database) encryptedFileNames() ([]string, error) {
+	infos, err := ioutil.ReadDir(db.dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read db directory %s: %w", db.dbDir, err)
+	}
+
+	names := make([]string, 0)
+	for _, info := range infos {
+		if !info.IsDir() && encryptedFile(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// reencrypt rewrites the files that are not encrypted with the current
+// key or the current format, the database is locked for every file, so the files are not
+// changed meanwhile.
+func (db *Database) reencrypt(names []string) error {
+	for _, name := range names {
+		if err := db.reencryptFile(path.Join(db.dbDir, name)); err != nil {
+			return err
+		}
+
+		db.encryption.mu.Lock()
+		db.encryption.status.Rewritten++
+		db.encryption.status.Remaining--
+		db.encryption.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (db *Database) reencryptFile(filePath string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		// the table has been dropped meanwhile
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	current, _, err := db.encryption.cipher("")
+	if err != nil {
+		return err
+	}
+
+	id, encrypted := encryptionKey(content)
+	if encrypted && id == current && content[len(encryptedFileHeader)] == encryptedFileVersion {
+		return nil
+	}
+
+	opened, err := db.encryption.open(content, path.Base(filePath))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", filePath, err)
+	}
+
+	return db.writeFileContent(filePath, opened)
+}
+
+// encryptPlaintextFiles encrypts the files of the db directory that
+// have not been encrypted, it migrates the database created without
+// the encryption before it is opened.
+func encryptPlaintextFiles(dbDir string, e *encryption) error {
+	infos, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		return fmt.Errorf("failed to read db directory %s: %w", dbDir, err)
+	}
+
+	encrypted := 0
+	for _, info := range infos {
+		if info.IsDir() || !encryptedFile(info.Name()) {
+			continue
+		}
+
+		filePath := path.Join(dbDir, info.Name())
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+		if _, isEncrypted := encryptionKey(content); isEncrypted {
+			continue
+		}
+
+		sealed, err := e.seal(content, info.Name())
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", filePath, err)
+		}
+		if err := restoreFile(dbDir, info.Name(), sealed); err != nil {
+			return err
+		}
+		encrypted++
+	}
+
+	if encrypted > 0 {
+		logging.Infof("encrypted %d files of %s", encrypted, dbDir)
+	}
+
+	return nil
+}
+
+// readLines reads and decrypts the lines of the log content,
+// the empty lines are skipped.
+func readLines(content []byte, e *encryption, f func(line []byte) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		line, err := e.openLine(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if err := f(line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
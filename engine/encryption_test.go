@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testKeyProvider(t *testing.T) KeyProvider {
+	t.Helper()
+
+	provider, err := NewKeyProvider("k1=" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestEncryptionOpen(t *testing.T) {
+	e, err := newEncryption(testKeyProvider(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte(`[[1]]`)
+	sealed, err := e.seal(content, "a.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := e.open(sealed, "a.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(opened) != string(content) {
+		t.Errorf("expected %s, got %s", content, opened)
+	}
+
+	if _, err := e.open(sealed, "b.json"); err == nil {
+		t.Error("expected the file of another table to be rejected")
+	}
+
+	if _, err := e.open(content, "a.json"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("expected %v, got %v", ErrNotEncrypted, err)
+	}
+
+	var disabled *encryption
+	if opened, err := disabled.open(content, "a.json"); err != nil || string(opened) != string(content) {
+		t.Errorf("expected %s, got %s, %v", content, opened, err)
+	}
+}
+
+func TestEncryptPlaintextDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	execute := func(db *Database, statement string) interface{} {
+		t.Helper()
+
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		result, err := db.Execute(q)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		return result
+	}
+
+	db, err := NewDatabase(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute(db, `CREATE TABLE t (id INTEGER)`)
+	execute(db, `INSERT INTO t (id) VALUES (1)`)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := testKeyProvider(t)
+	if _, err := NewDatabase(dir, Options{Encryption: provider}); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("expected %v, got %v", ErrNotEncrypted, err)
+	}
+
+	db, err = NewDatabase(dir, Options{Encryption: provider, EncryptPlaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the renamed files are encrypted under the new names
+	execute(db, `ALTER TABLE t RENAME TO r`)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabase(dir, Options{Encryption: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows := execute(db, `SELECT id FROM r`)
+	if expected := [][]interface{}{{1}}; !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, got %v", expected, rows)
+	}
+}
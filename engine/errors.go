@@ -0,0 +1,213 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors of the statements are classified, so the clients branch on
+// the stable codes instead of the messages. The code names the error,
+// the category groups the codes as the classes of SQLSTATE do and the
+// SQLSTATE is reported over the PostgreSQL protocol. The engine returns
+// *Error for the undefined and duplicate objects, the mismatched types
+// and the invalid parameters, the other errors are classified by
+// Classify from the sentinel and the typed errors they wrap.
+
+// ErrorCategory is the class of the error codes.
+type ErrorCategory string
+
+const (
+	// CategorySyntax is for the statements that can not be parsed.
+	CategorySyntax ErrorCategory = "syntax"
+	// CategoryObject is for the undefined and duplicate tables,
+	// columns and other objects.
+	CategoryObject ErrorCategory = "object"
+	// CategoryData is for the values of wrong types or out of range.
+	CategoryData ErrorCategory = "data"
+	// CategoryLimit is for the exceeded limits.
+	CategoryLimit ErrorCategory = "limit"
+	// CategoryConflict is for the conflicts of the concurrent
+	// transactions, the statements can be retried.
+	CategoryConflict ErrorCategory = "conflict"
+	// CategoryAccess is for the failed authentication and the denied
+	// permissions.
+	CategoryAccess ErrorCategory = "access"
+	// CategoryState is for the statements not allowed in the current
+	// state of the database, the transaction or the cluster.
+	CategoryState ErrorCategory = "state"
+	// CategoryCanceled is for the canceled and timed out queries.
+	CategoryCanceled ErrorCategory = "canceled"
+	// CategoryQuery is for the other errors.
+	CategoryQuery ErrorCategory = "query"
+)
+
+// ErrorCode is the stable code of the error.
+type ErrorCode string
+
+// The error codes, the new codes are added, the existing
+// ones are not changed.
+const (
+	CodeSyntax              ErrorCode = "syntax_error"
+	CodeQuery               ErrorCode = "query_error"
+	CodeUndefinedTable      ErrorCode = "undefined_table"
+	CodeUndefinedColumn     ErrorCode = "undefined_column"
+	CodeUndefinedObject     ErrorCode = "undefined_object"
+	CodeDuplicateTable      ErrorCode = "duplicate_table"
+	CodeDuplicateObject     ErrorCode = "duplicate_object"
+	CodeDatatypeMismatch    ErrorCode = "datatype_mismatch"
+	CodeInvalidParameter    ErrorCode = "invalid_parameter"
+	CodeDivisionByZero      ErrorCode = "division_by_zero"
+	CodeInvalidCursor       ErrorCode = "invalid_cursor"
+	CodeLimit               ErrorCode = "limit_exceeded"
+	CodeTooManyRequests     ErrorCode = "too_many_requests"
+	CodeSerialization       ErrorCode = "serialization_failure"
+	CodeDeadlock            ErrorCode = "deadlock_detected"
+	CodeLockTimeout         ErrorCode = "lock_timeout"
+	CodeVersionConflict     ErrorCode = "version_conflict"
+	CodePermission          ErrorCode = "permission_denied"
+	CodeAuthentication      ErrorCode = "authentication_failed"
+	CodeReadOnly            ErrorCode = "read_only"
+	CodeReadOnlyTransaction ErrorCode = "read_only_transaction"
+	CodeNoTransaction       ErrorCode = "no_transaction"
+	CodeNotLeader           ErrorCode = "not_leader"
+	CodeNotReplicated       ErrorCode = "not_replicated"
+	CodeQueryTimeout        ErrorCode = "query_timeout"
+	CodeQueryCanceled       ErrorCode = "query_canceled"
+	CodeDiskFull            ErrorCode = "disk_full"
+	CodeSchemaChanged       ErrorCode = "schema_changed"
+)
+
+// errorClass is the category and the SQLSTATE of the code.
+type errorClass struct {
+	category ErrorCategory
+	sqlState string
+}
+
+var errorClasses = map[ErrorCode]errorClass{
+	CodeSyntax:              {CategorySyntax, "42601"},
+	CodeQuery:               {CategoryQuery, "42000"},
+	CodeUndefinedTable:      {CategoryObject, "42P01"},
+	CodeUndefinedColumn:     {CategoryObject, "42703"},
+	CodeUndefinedObject:     {CategoryObject, "42704"},
+	CodeDuplicateTable:      {CategoryObject, "42P07"},
+	CodeDuplicateObject:     {CategoryObject, "42710"},
+	CodeDatatypeMismatch:    {CategoryData, "42804"},
+	CodeInvalidParameter:    {CategoryData, "22023"},
+	CodeDivisionByZero:      {CategoryData, "22012"},
+	CodeInvalidCursor:       {CategoryData, "34000"},
+	CodeLimit:               {CategoryLimit, "54000"},
+	CodeTooManyRequests:     {CategoryLimit, "53000"},
+	CodeSerialization:       {CategoryConflict, "40001"},
+	CodeDeadlock:            {CategoryConflict, "40P01"},
+	CodeLockTimeout:         {CategoryConflict, "55P03"},
+	CodeVersionConflict:     {CategoryConflict, "40001"},
+	CodePermission:          {CategoryAccess, "42501"},
+	CodeAuthentication:      {CategoryAccess, "28P01"},
+	CodeReadOnly:            {CategoryState, "25006"},
+	CodeReadOnlyTransaction: {CategoryState, "25006"},
+	CodeNoTransaction:       {CategoryState, "25P01"},
+	CodeNotLeader:           {CategoryState, "25006"},
+	CodeNotReplicated:       {CategoryState, "40003"},
+	CodeQueryTimeout:        {CategoryCanceled, "57014"},
+	CodeQueryCanceled:       {CategoryCanceled, "57014"},
+	CodeDiskFull:            {CategoryState, "53100"},
+	CodeSchemaChanged:       {CategoryConflict, "40001"},
+}
+
+// Error is the classified error of the statement.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// Position is the byte offset of the error in the query,
+	// -1 if it is unknown.
+	Position int
+	// Err is the wrapped error, nil if there is none.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Category returns the category of the code,
+// the empty one for the unknown codes.
+func (e *Error) Category() ErrorCategory {
+	return errorClasses[e.Code].category
+}
+
+// SQLState returns the SQLSTATE of the code,
+// the one of the internal error for the unknown codes.
+func (e *Error) SQLState() string {
+	if class, exists := errorClasses[e.Code]; exists {
+		return class.sqlState
+	}
+
+	return "XX000"
+}
+
+// newError returns the error with the code and the formatted message,
+// the error of the %w verb is wrapped.
+func newError(code ErrorCode, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+
+	return &Error{Code: code, Message: err.Error(), Position: -1, Err: errors.Unwrap(err)}
+}
+
+// Classify returns the classified error with the message of the error
+// and the code of the *Error, the sentinel or the typed error wrapped
+// in it, CodeQuery if there is none.
+func Classify(err error) *Error {
+	classified := &Error{Code: CodeQuery, Message: err.Error(), Position: -1, Err: err}
+
+	var typedErr *Error
+	var syntaxErr *SyntaxError
+	var limitErr *LimitError
+	var timeoutErr *LockTimeoutError
+	var notLeaderErr *NotLeaderError
+	switch {
+	case errors.As(err, &typedErr):
+		classified.Code, classified.Position = typedErr.Code, typedErr.Position
+	case errors.As(err, &syntaxErr):
+		classified.Code, classified.Position = CodeSyntax, syntaxErr.Position
+	case errors.As(err, &limitErr):
+		classified.Code = CodeLimit
+	case errors.Is(err, ErrSerialization):
+		classified.Code = CodeSerialization
+	case errors.Is(err, ErrDeadlock):
+		classified.Code = CodeDeadlock
+	case errors.Is(err, ErrVersionConflict):
+		classified.Code = CodeVersionConflict
+	case errors.As(err, &timeoutErr):
+		classified.Code = CodeLockTimeout
+	case errors.Is(err, ErrPermissionDenied):
+		classified.Code = CodePermission
+	case errors.Is(err, ErrAuthentication):
+		classified.Code = CodeAuthentication
+	case errors.Is(err, ErrQueryTimeout):
+		classified.Code = CodeQueryTimeout
+	case errors.Is(err, ErrQueryCanceled):
+		classified.Code = CodeQueryCanceled
+	case errors.As(err, &notLeaderErr), errors.Is(err, ErrLeaderReads), errors.Is(err, ErrFenced):
+		classified.Code = CodeNotLeader
+	case errors.Is(err, ErrNotReplicated):
+		classified.Code = CodeNotReplicated
+	case errors.Is(err, ErrSchemaChanged):
+		classified.Code = CodeSchemaChanged
+	case errors.Is(err, ErrDiskFull):
+		classified.Code = CodeDiskFull
+	case errors.Is(err, ErrReadOnly), errors.Is(err, ErrReadOnlyReplica), errors.Is(err, ErrSyncFailed):
+		classified.Code = CodeReadOnly
+	case errors.Is(err, ErrReadOnlyTransaction):
+		classified.Code = CodeReadOnlyTransaction
+	case errors.Is(err, ErrNoTransaction):
+		classified.Code = CodeNoTransaction
+	case errors.Is(err, ErrInvalidCursor):
+		classified.Code = CodeInvalidCursor
+	}
+
+	return classified
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// String literals are enclosed in double quotes and support
+// the following escape sequences: \" \\ \n \r \t and \uXXXX.
+// Any other rune, including multi-byte ones and raw newlines,
+// is taken as is.
+
+// protectEscapedQuotes replaces escaped double quotes inside string
+// literals with the \u0022 sequence, since the SQL parser ends
+// a string literal at the first double quote it meets.
+func protectEscapedQuotes(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '"':
+			inString = !inString
+		case c == '\\' && inString && i+1 < len(query):
+			if query[i+1] == '"' {
+				b.WriteString(`\u0022`)
+			} else {
+				// keep the escaped character to not treat \\" as
+				// an escaped quote
+				b.WriteByte(c)
+				b.WriteByte(query[i+1])
+			}
+			i++
+
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// unescapeString decodes escape sequences of the string literal content.
+func unescapeString(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("unterminated escape sequence at %d", i)
+		}
+
+		i++
+		switch s[i] {
+		case '"':
+			b.WriteByte('"')
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if i+4 >= len(s) {
+				return "", fmt.Errorf("invalid unicode escape sequence at %d", i-1)
+			}
+
+			code, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid unicode escape sequence at %d: %w", i-1, err)
+			}
+
+			r := rune(code)
+			if !utf8.ValidRune(r) {
+				return "", fmt.Errorf("invalid unicode code point %U at %d", r, i-1)
+			}
+
+			b.WriteRune(r)
+			i += 4
+		default:
+			return "", fmt.Errorf("unknown escape sequence \\%c at %d", s[i], i-1)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// SplitStatements returns the statements ended by the semicolons
+// outside of the string literals and the rest of the text.
+func SplitStatements(text string) ([]string, string) {
+	var statements []string
+	inString, start := false, 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '\\' && inString:
+			i++
+		case c == '"':
+			inString = !inString
+		case c == ';' && !inString:
+			if statement := strings.TrimSpace(text[start:i]); statement != "" {
+				statements = append(statements, statement)
+			}
+			start = i + 1
+		}
+	}
+
+	return statements, text[start:]
+}
+
+// quoteString renders the string as a literal that can be used in a query.
+func quoteString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
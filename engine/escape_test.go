@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProtectEscapedQuotes(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{"no strings", `SELECT id FROM t`, `SELECT id FROM t`},
+		{"plain string", `SELECT id FROM t WHERE name == "a"`, `SELECT id FROM t WHERE name == "a"`},
+		{"escaped quote", `INSERT INTO t (s) VALUES ("a\"b")`, `INSERT INTO t (s) VALUES ("a\u0022b")`},
+		{"escaped backslash before quote", `INSERT INTO t (s) VALUES ("a\\")`, `INSERT INTO t (s) VALUES ("a\\")`},
+		{"other escapes", `INSERT INTO t (s) VALUES ("a\nb\tc")`, `INSERT INTO t (s) VALUES ("a\nb\tc")`},
+		{"backslash outside of strings", `a\"b`, `a\"b`},
+		{"multi-byte runes", `INSERT INTO t (s) VALUES ("日本\"語")`, `INSERT INTO t (s) VALUES ("日本\u0022語")`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := protectEscapedQuotes(test.query); actual != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestUnescapeString(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		expected string
+		err      string
+	}{
+		{"no escapes", `abc`, `abc`, ""},
+		{"quote", `a\"b`, `a"b`, ""},
+		{"backslash", `a\\b`, `a\b`, ""},
+		{"control characters", `a\nb\rc\td`, "a\nb\rc\td", ""},
+		{"unicode", `caf\u00e9`, "café", ""},
+		{"escaped quote marker", `a\u0022b`, `a"b`, ""},
+		{"multi-byte runes", `日本語 🙂`, `日本語 🙂`, ""},
+		{"unterminated", `abc\`, "", "unterminated escape sequence"},
+		{"short unicode", `\u00`, "", "invalid unicode escape sequence"},
+		{"invalid unicode", `\uzzzz`, "", "invalid unicode escape sequence"},
+		{"surrogate", `\ud800`, "", "invalid unicode code point"},
+		{"unknown", `\x`, "", "unknown escape sequence"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := unescapeString(test.s)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestQuoteStringRoundTrip(t *testing.T) {
+	tests := []string{
+		``,
+		`plain`,
+		`with "quotes"`,
+		`back\slash`,
+		`\"`,
+		"lines\nand\r\ntabs\t",
+		`日本語 and emoji 🙂`,
+		`trailing backslash \`,
+	}
+
+	for _, s := range tests {
+		t.Run(s, func(t *testing.T) {
+			quoted := quoteString(s)
+			if !strings.HasPrefix(quoted, `"`) || !strings.HasSuffix(quoted, `"`) {
+				t.Fatalf("expected quoted literal, got %s", quoted)
+			}
+
+			protected := protectEscapedQuotes(quoted)
+			actual, err := unescapeString(protected[1 : len(protected)-1])
+			if err != nil {
+				t.Fatalf("failed to unescape %s: %s", quoted, err)
+			}
+			if actual != s {
+				t.Errorf("expected %q, got %q", s, actual)
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements, rest := SplitStatements(`INSERT INTO t (s) VALUES ("a;b\";c"); SELECT s FROM t; DELETE`)
+
+	expected := []string{`INSERT INTO t (s) VALUES ("a;b\";c")`, `SELECT s FROM t`}
+	if len(statements) != len(expected) {
+		t.Fatalf("expected %d statements, got %d: %q", len(expected), len(statements), statements)
+	}
+	for i := range expected {
+		if statements[i] != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], statements[i])
+		}
+	}
+	if rest != ` DELETE` {
+		t.Errorf("expected the rest %q, got %q", ` DELETE`, rest)
+	}
+}
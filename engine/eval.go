@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// EvalRequest is the body of the expression debugging request. The schema
+// is taken either from the existing table or from the column list.
+//
+//	{
+//		"table": "users",
+//		"row": {"id": 5, "name": "bob"},
+//		"where": "id == 5 AND name == \"bob\"",
+//		"set": "name = \"alice\""
+//	}
+type EvalRequest struct {
+	Table   string                 `json:"table"`
+	Columns []EvalColumn           `json:"columns"`
+	Row     map[string]interface{} `json:"row"`
+	Where   string                 `json:"where"`
+	Set     string                 `json:"set"`
+}
+
+// EvalColumn is the column of the sample row.
+type EvalColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// EvalResponse shows how the expressions are resolved and evaluated.
+type EvalResponse struct {
+	Row    []interface{} `json:"row"`
+	Where  []EvalStep    `json:"where,omitempty"`
+	Result *bool         `json:"result,omitempty"`
+	Set    []EvalStep    `json:"set,omitempty"`
+	NewRow []interface{} `json:"new_row,omitempty"`
+}
+
+// EvalStep is the resolved type and the value of a subexpression.
+type EvalStep struct {
+	Expr  string      `json:"expr"`
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value"`
+	Error string      `json:"error,omitempty"`
+}
+
+// EvalExpressions resolves and evaluates the WHERE and SET
+// expressions of the request against the sample row.
+func (db *Database) EvalExpressions(request EvalRequest) (*EvalResponse, error) {
+	schema, err := db.evalSchema(request)
+	if err != nil {
+		return nil, err
+	}
+
+	row := make([]interface{}, len(schema.Columns))
+	for name, value := range request.Row {
+		column, exists := schema.Columns[strings.ToLower(name)]
+		if !exists {
+			return nil, newError(CodeUndefinedColumn, "column %s does not exist", name)
+		}
+		row[column.Position] = value
+	}
+	normalizeRow(schema, row)
+
+	response := &EvalResponse{Row: row}
+	if request.Where != "" {
+		statement, err := sql.Parse(protectEscapedQuotes("SELECT x FROM t WHERE " + request.Where))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse WHERE expression: %w", err)
+		}
+
+		where := statement.(*sql.Select).Where
+		response.Where = evalSteps(schema, row, where.Expr, nil)
+		if err := validateWhere(schema, where); err == nil {
+			result := matches(schema, row, where)
+			response.Result = &result
+		}
+	}
+
+	if request.Set != "" {
+		statement, err := sql.Parse(protectEscapedQuotes("UPDATE t SET " + request.Set))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SET expression: %w", err)
+		}
+
+		update := statement.(*sql.Update)
+		for i, column := range update.Columns {
+			step := EvalStep{Expr: column + " = " + update.Values[i]}
+			value, err := parseValue(update.Values[i])
+			if err != nil {
+				step.Error = err.Error()
+				response.Set = append(response.Set, step)
+				continue
+			}
+
+			step.Value = value
+			step.Type = fmt.Sprint(valueType(value))
+			if err := validateSetExpr(schema, strings.ToLower(column), value); err != nil {
+				step.Error = err.Error()
+			}
+			response.Set = append(response.Set, step)
+		}
+
+		set, err := validateSet(schema, update.Columns, update.Values)
+		if err == nil {
+			response.NewRow, _ = updateValues(schema, set, row)
+		}
+	}
+
+	return response, nil
+}
+
+func (db *Database) evalSchema(request EvalRequest) (Schema, error) {
+	if request.Table != "" {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+
+		tableName := strings.ToLower(request.Table)
+		schema, exists := db.tables[tableName]
+		if !exists {
+			return Schema{}, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+		}
+
+		return schema, nil
+	}
+
+	if len(request.Columns) == 0 {
+		return Schema{}, fmt.Errorf("table or columns are required")
+	}
+
+	columns := make([]sql.ColumnDefinition, len(request.Columns))
+	for i, column := range request.Columns {
+		columns[i].Name = strings.ToLower(column.Name)
+		switch strings.ToLower(column.Type) {
+		case sql.TypeInteger.Name():
+			columns[i].Type = sql.TypeInteger
+		case sql.TypeString.Name():
+			columns[i].Type = sql.TypeString
+		default:
+			return Schema{}, fmt.Errorf("unknown type %s of column %s", column.Type, column.Name)
+		}
+	}
+
+	return newVirtualSchema("sample", columns...), nil
+}
+
+// evalSteps resolves the type and evaluates every subexpression
+// in the evaluation order.
+func evalSteps(schema Schema, row []interface{}, expr sql.Expr, steps []EvalStep) []EvalStep {
+	if operation, ok := expr.(sql.ExprOperation); ok {
+		steps = evalSteps(schema, row, operation.Left, steps)
+		steps = evalSteps(schema, row, operation.Right, steps)
+	}
+
+	step := EvalStep{Expr: exprString(expr)}
+	t, err := validateExpr(schema, expr)
+	if err != nil {
+		step.Error = err.Error()
+
+		return append(steps, step)
+	}
+
+	step.Type = fmt.Sprint(t)
+	step.Value = evalExpr(schema, row, expr)
+
+	return append(steps, step)
+}
@@ -0,0 +1,317 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// ErrNoTransaction is returned for the transaction statements
+// executed outside of a transaction.
+var ErrNoTransaction = errors.New("there is no transaction")
+
+// ErrNoSession is returned for the session statements
+// executed outside of a session.
+var ErrNoSession = errors.New("there is no session")
+
+// Execute executes the statement. The result is the selected rows
+// for SELECT, the number of the affected rows for INSERT, UPDATE and
+// DELETE, the transaction identifier for BEGIN and nil for the
+// statements without a result.
+func (db *Database) Execute(q sql.Statement) (interface{}, error) {
+	return db.ExecuteContext(context.Background(), q)
+}
+
+// ExecuteContext executes the statement, the queries are canceled
+// with ErrQueryCanceled or ErrQueryTimeout when the context is done
+// before they change the data.
+func (db *Database) ExecuteContext(ctx context.Context, q sql.Statement) (interface{}, error) {
+	started := time.Now()
+	result, err := db.execute(ctx, q)
+	if err == nil && !readOnlyStatement(q) {
+		err = db.waitCommitted(ctx)
+	}
+	db.logQuery(ctx, q, started, affectedRows(result), err)
+
+	return result, err
+}
+
+func (db *Database) execute(ctx context.Context, q sql.Statement) (interface{}, error) {
+	if err := db.checkWritable(q); err != nil {
+		return nil, err
+	}
+
+	q, err := db.bindSequences(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.hasTriggers(q) {
+		return db.executeTriggered(ctx, q)
+	}
+
+	switch query := q.(type) {
+	case *Begin:
+		tx, err := db.Begin(query.Isolation)
+		if err != nil {
+			return nil, err
+		}
+		tx.User = queryUser(ctx)
+
+		return tx.ID, nil
+	case *Commit, *Rollback, *Savepoint, *RollbackToSavepoint, *ReleaseSavepoint, *SetTransaction:
+		return nil, ErrNoTransaction
+	case *SetSessionIsolation, *SetSearchPath:
+		return nil, ErrNoSession
+	case *SetSetting:
+		if query.Scope == ScopeSession {
+			return nil, ErrNoSession
+		}
+
+		return nil, db.SetSetting(query)
+	case *ShowSetting:
+		return db.ShowSetting(query)
+	case *sql.CreateTable:
+		return nil, db.CreateTable(query)
+	case *CreatePartitionedTable:
+		return nil, db.CreatePartitionedTable(query)
+	case *CreateVersionedTable:
+		return nil, db.CreateVersionedTable(query)
+	case *CreateMemoryTable:
+		return nil, db.CreateMemoryTable(query)
+	case *SetReadOnly:
+		db.SetReadOnly(query.ReadOnly)
+
+		return nil, nil
+	case *CreateDatabase:
+		return nil, db.CreateDatabase(query)
+	case *DropDatabase:
+		return nil, db.DropDatabase(query)
+	case *UseDatabase:
+		return nil, ErrUseDatabase
+	case *CreateSchema:
+		return nil, db.CreateSchema(query)
+	case *DropSchema:
+		return nil, db.DropSchema(query)
+	case *CreateTrigger:
+		create := *query
+		create.Trigger.User = queryUser(ctx)
+
+		return nil, db.CreateTrigger(&create)
+	case *DropTrigger:
+		return nil, db.DropTrigger(query)
+	case *CreateSequence:
+		return nil, db.CreateSequence(query)
+	case *DropSequence:
+		return nil, db.DropSequence(query)
+	case *DropPartition:
+		return nil, db.DropPartition(query)
+	case *RenameTable:
+		return nil, db.RenameTable(query)
+	case *AlterColumnMask:
+		return nil, db.AlterColumnMask(query)
+	case *Comment:
+		return nil, db.Comment(query)
+	case *Analyze:
+		return nil, db.Analyze(ctx, query)
+	case *CreateUser:
+		return nil, db.CreateUser(query)
+	case *AlterUser:
+		return nil, db.AlterUser(query)
+	case *DropUser:
+		return nil, db.DropUser(query)
+	case *Grant:
+		return nil, db.Grant(query)
+	case *Revoke:
+		return nil, db.Revoke(query)
+	case *CreateToken:
+		return db.CreateToken(query)
+	case *DropToken:
+		return nil, db.DropToken(query)
+	case *Kill:
+		return nil, db.Kill(query)
+	case *Backup:
+		return db.Backup(query)
+	case *Copy:
+		return db.Copy(ctx, query)
+	case *Flashback:
+		return db.Flashback(ctx, query)
+	case *ShowIsolationLevel:
+		return db.Options().Isolation, nil
+	case *ShowCreateTable:
+		return db.ShowCreateTable(query)
+	case *Explain:
+		if query.Validate {
+			return db.ValidateContext(ctx, query)
+		}
+
+		return db.ExplainContext(ctx, query)
+	case *sql.DropTable:
+		return nil, db.DropTable(query)
+	case *sql.Select:
+		return db.SelectContext(ctx, query)
+	case *OrderedSelect:
+		return db.SortContext(ctx, query)
+	case *AsOfSelect:
+		return db.AsOfContext(ctx, query)
+	case *GroupedSelect:
+		return db.AggregateContext(ctx, query)
+	case *CountRows:
+		return db.CountContext(ctx, query)
+	case *sql.Insert:
+		return db.InsertContext(ctx, query)
+	case *sql.Update:
+		return db.UpdateContext(ctx, query)
+	case *sql.Delete:
+		return db.DeleteContext(ctx, query)
+	case *UpdateIfVersion:
+		return db.UpdateIfVersionContext(ctx, query)
+	case *DeleteIfVersion:
+		return db.DeleteIfVersionContext(ctx, query)
+	default:
+		return nil, fmt.Errorf("unsupported query type: %T", query)
+	}
+}
+
+// Execute executes the statement within the transaction.
+func (tx *Transaction) Execute(q sql.Statement) (interface{}, error) {
+	return tx.ExecuteContext(context.Background(), q)
+}
+
+// ExecuteContext executes the statement within the transaction
+// until the context is done.
+func (tx *Transaction) ExecuteContext(ctx context.Context, q sql.Statement) (interface{}, error) {
+	started := time.Now()
+	result, err := tx.execute(ctx, q)
+	tx.db.logQuery(ctx, q, started, affectedRows(result), err)
+
+	return result, err
+}
+
+func (tx *Transaction) execute(ctx context.Context, q sql.Statement) (interface{}, error) {
+	if err := tx.db.checkWritable(q); err != nil {
+		return nil, err
+	}
+
+	if tx.readOnly && !readOnlyStatement(q) {
+		return nil, ErrReadOnlyTransaction
+	}
+
+	q, err := tx.db.bindSequences(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if tx.db.hasTriggers(q) {
+		return tx.executeTriggered(ctx, q)
+	}
+
+	switch query := q.(type) {
+	case *Begin:
+		return nil, fmt.Errorf("transaction %s is already started", tx.ID)
+	case *Commit:
+		return nil, tx.Commit()
+	case *Rollback:
+		return nil, tx.Rollback()
+	case *Savepoint:
+		return nil, tx.Savepoint(query.Name)
+	case *RollbackToSavepoint:
+		return nil, tx.RollbackTo(query.Name)
+	case *ReleaseSavepoint:
+		return nil, tx.Release(query.Name)
+	case *SetTransaction:
+		return nil, tx.SetIsolation(query.Isolation)
+	case *ShowIsolationLevel:
+		return tx.Isolation(), nil
+	case *ShowCreateTable:
+		return tx.db.ShowCreateTable(query)
+	case *ShowSetting:
+		return tx.db.ShowSetting(query)
+	case *sql.Select:
+		return tx.SelectContext(ctx, query)
+	case *OrderedSelect:
+		return tx.SortContext(ctx, query)
+	case *AsOfSelect:
+		// the past rows do not depend on the transaction
+		return tx.db.AsOfContext(ctx, query)
+	case *GroupedSelect:
+		return tx.AggregateContext(ctx, query)
+	case *CountRows:
+		return tx.CountContext(ctx, query)
+	case *sql.Insert:
+		return tx.InsertContext(ctx, query)
+	case *sql.Update:
+		return tx.UpdateContext(ctx, query)
+	case *sql.Delete:
+		return tx.DeleteContext(ctx, query)
+	case *UpdateIfVersion:
+		return tx.UpdateIfVersionContext(ctx, query)
+	case *DeleteIfVersion:
+		return tx.DeleteIfVersionContext(ctx, query)
+	case *Copy:
+		return tx.Copy(ctx, query)
+	case *Flashback:
+		return tx.Flashback(ctx, query)
+	case *Explain:
+		if query.Validate {
+			return tx.db.ValidateContext(ctx, query)
+		}
+
+		return nil, fmt.Errorf("%T is not supported in transactions", query)
+	default:
+		return nil, fmt.Errorf("%T is not supported in transactions", query)
+	}
+}
+
+// Execute executes the statement with the state of the session, the
+// transaction passed explicitly is used instead of the session one.
+func (s *Session) Execute(tx *Transaction, q sql.Statement) (interface{}, error) {
+	return s.ExecuteContext(context.Background(), tx, q)
+}
+
+// ExecuteContext executes the statement with the state of the
+// session until the context is done.
+func (s *Session) ExecuteContext(ctx context.Context, tx *Transaction, q sql.Statement) (interface{}, error) {
+	switch query := q.(type) {
+	case *SetSessionIsolation:
+		s.SetIsolation(query.Isolation)
+
+		return nil, nil
+	case *SetSearchPath:
+		return nil, s.SetSearchPath(query.Schemas)
+	case *SetSetting:
+		if query.Scope == ScopeSession {
+			return nil, s.SetSetting(query)
+		}
+	case *ShowSetting:
+		return s.ShowSetting(query)
+	}
+
+	q = s.Resolve(q)
+	ctx = s.settingsContext(ctx)
+
+	if tx != nil {
+		return tx.ExecuteContext(ctx, q)
+	}
+
+	switch query := q.(type) {
+	case *Begin:
+		tx, err := s.Begin(query.Isolation)
+		if err != nil {
+			return nil, err
+		}
+
+		return tx.ID, nil
+	case *ShowIsolationLevel:
+		return s.Isolation(), nil
+	case *CreateMemoryTable:
+		if query.Temporary {
+			return nil, s.CreateTemporaryTable(query)
+		}
+	}
+
+	return s.db.ExecuteContext(ctx, q)
+}
@@ -0,0 +1,249 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// The failover of the primary/replica pair is decided by the lease of
+// the witness. The node that holds the lease is the leader, the term of
+// the lease grows every time another node takes it. The primary executes
+// the writes only while its lease is valid and fences itself when it can
+// not renew the lease or another node has taken it. The replica takes the
+// expired lease and is promoted when the primary is gone.
+
+// ErrFenced is returned for the statements that change the data
+// of the primary that does not hold the lease.
+var ErrFenced = errors.New("the node is fenced, it does not hold the leader lease")
+
+// leaseStateFileName is the name of the file that stores the term
+// of the last lease the node has held.
+const leaseStateFileName = "gosqldb.lease.json"
+
+// NotLeaderError is returned for the statements that change the data
+// of the node that is not the leader.
+type NotLeaderError struct {
+	// Leader is the advertised address of the leader,
+	// empty if it is not known.
+	Leader string
+	Err    error
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%s, the leader is %s", e.Err, e.Leader)
+}
+
+func (e *NotLeaderError) Unwrap() error {
+	return e.Err
+}
+
+// Role is the role of the node in the failover pair.
+type Role string
+
+const (
+	RolePrimary Role = "primary"
+	RoleReplica Role = "replica"
+	// RoleFenced is the primary that does not execute the writes.
+	RoleFenced Role = "fenced"
+)
+
+// FailoverStatus describes the role of the node.
+type FailoverStatus struct {
+	Role Role `json:"role"`
+	// Term is the term of the last lease the node has held,
+	// zero if it has never held one.
+	Term uint64 `json:"term"`
+	// Leader is the advertised address of the current leader,
+	// empty if it is the node itself or is not known.
+	Leader string `json:"leader,omitempty"`
+}
+
+// leadership is the failover state of the node, it has its own lock,
+// so the statements check it without the database lock.
+type leadership struct {
+	mu      sync.Mutex
+	replica bool
+	fenced  bool
+	term    uint64
+	leader  string
+	// waiter is the function the committed changes wait for
+	waiter CommitWaiter
+}
+
+// leaseState is the content of the lease state file.
+type leaseState struct {
+	Term uint64 `json:"term"`
+}
+
+// readLeaseTerm reads the term of the last held lease,
+// zero if the node has never held one.
+func readLeaseTerm(dbDir string) (uint64, error) {
+	filePath := path.Join(dbDir, leaseStateFileName)
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	var state leaseState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return 0, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	return state.Term, nil
+}
+
+// writeLeaseTerm stores the term of the held lease.
+func writeLeaseTerm(dbDir string, term uint64) error {
+	content, err := json.Marshal(leaseState{term})
+	if err != nil {
+		return fmt.Errorf("failed to encode lease state: %w", err)
+	}
+
+	return restoreFile(dbDir, leaseStateFileName, content)
+}
+
+// newLeadership returns the failover state, the primary with the
+// failover enabled is fenced until it acquires the lease.
+func newLeadership(dbDir string, options Options) (*leadership, error) {
+	term, err := readLeaseTerm(dbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &leadership{
+		replica: options.Replica,
+		fenced:  options.Failover && !options.Replica,
+		term:    term,
+	}, nil
+}
+
+// notLeader returns the error for the statements that change the data,
+// nil if the node executes them.
+func (l *leadership) notLeader() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case l.replica:
+		return &NotLeaderError{Leader: l.leader, Err: ErrReadOnlyReplica}
+	case l.fenced:
+		return &NotLeaderError{Leader: l.leader, Err: ErrFenced}
+	default:
+		return nil
+	}
+}
+
+// FailoverStatus returns the role of the node.
+func (db *Database) FailoverStatus() FailoverStatus {
+	l := db.leadership
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := FailoverStatus{Role: RolePrimary, Term: l.term, Leader: l.leader}
+	switch {
+	case l.replica:
+		status.Role = RoleReplica
+	case l.fenced:
+		status.Role = RoleFenced
+	}
+
+	return status
+}
+
+// Lead lets the primary execute the writes under the lease of the term,
+// the term is stored, so the node does not take the leases of the later
+// terms it has not seen.
+func (db *Database) Lead(term uint64) error {
+	l := db.leadership
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.replica {
+		return fmt.Errorf("the replica leads only after the promotion")
+	}
+
+	if term != l.term {
+		if err := writeLeaseTerm(db.dbDir, term); err != nil {
+			return err
+		}
+		l.term = term
+	}
+	l.fenced, l.leader = false, ""
+
+	return nil
+}
+
+// Fence stops the primary from executing the writes, the leader is
+// the address the clients are sent to, empty if it is not known.
+func (db *Database) Fence(leader string) {
+	l := db.leadership
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.fenced, l.leader = true, leader
+}
+
+// SetLeader records the address of the leader
+// the clients of the replica are sent to.
+func (db *Database) SetLeader(leader string) {
+	l := db.leadership
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.leader = leader
+}
+
+// Promote makes the replica the primary that holds the lease of the
+// term. The records of the transactions that have not been committed
+// by the former primary are dropped. The promotion is stored, so the
+// node starts as the primary afterwards.
+func (db *Database) Promote(term uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r := db.replica
+	if r == nil {
+		return fmt.Errorf("database is not a replica")
+	}
+
+	if err := writeLeaseTerm(db.dbDir, term); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(replicaState{Sequence: r.status.Sequence, Promoted: true})
+	if err != nil {
+		return fmt.Errorf("failed to encode replica state: %w", err)
+	}
+	if err := restoreFile(db.dbDir, replicaStateFileName, content); err != nil {
+		return err
+	}
+
+	db.replica = nil
+
+	l := db.leadership
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.replica, l.fenced, l.term, l.leader = false, false, term, ""
+
+	return nil
+}
+
+// ReplicaPromoted reports whether the replica in the db
+// directory has been promoted to the primary.
+func ReplicaPromoted(dbDir string) (bool, error) {
+	state, _, err := readReplicaState(dbDir)
+
+	return state.Promoted, err
+}
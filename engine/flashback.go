@@ -0,0 +1,293 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// FLASHBACK reverts the recent changes of the table with the
+// compensating statements built from the changes retained by the
+// changefeed, from the newest one:
+//
+//	FLASHBACK TABLE users TO TIMESTAMP "2024-05-01T12:00:00Z"
+//	FLASHBACK TABLE users TO POSITION 42 DRY RUN
+//
+// The inserted rows are deleted, the deleted ones are inserted back
+// and the updated ones get their old values. The rows are matched by
+// all their values, so every statement must change exactly one row,
+// otherwise nothing is reverted. The row versions are not reverted,
+// they are incremented as by any other update. DRY RUN only returns
+// the statements. The returned statements have the values of the
+// masked columns redacted for the users that do not see them.
+
+// Flashback represents FLASHBACK TABLE statement.
+type Flashback struct {
+	Table string
+	// Time is zero when the changes are reverted to the position.
+	Time time.Time
+	// Position is the last change that is kept.
+	Position uint64
+	DryRun   bool
+}
+
+// GetType returns the statement type.
+func (*Flashback) GetType() sql.StatementType { return StatementFlashback }
+
+// parseFlashback parses FLASHBACK TABLE statement.
+func parseFlashback(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("FLASHBACK")
+	if err := s.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+
+	table, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.expectKeyword("TO"); err != nil {
+		return nil, err
+	}
+
+	query := &Flashback{Table: table}
+	switch {
+	case s.acceptKeyword("POSITION"):
+		position, err := s.expectInteger()
+		if err != nil {
+			return nil, err
+		}
+		if position < 0 {
+			return nil, fmt.Errorf("invalid position %d", position)
+		}
+		query.Position = uint64(position)
+	case s.isKeyword("TIMESTAMP"):
+		if query.Time, err = s.expectTimestamp(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, s.unexpected("TIMESTAMP or POSITION")
+	}
+
+	query.DryRun = s.acceptKeyword("DRY", "RUN")
+
+	return query, s.expectEnd()
+}
+
+// FlashbackResult lists the compensating statements of FLASHBACK.
+type FlashbackResult struct {
+	Statements []string `json:"statements"`
+	// Applied is false for DRY RUN.
+	Applied bool `json:"applied"`
+}
+
+// String describes the flashback.
+func (r *FlashbackResult) String() string {
+	if len(r.Statements) == 0 {
+		return "nothing to revert"
+	}
+
+	return strings.Join(r.Statements, ";\n") + ";"
+}
+
+// Flashback reverts the recent changes of the table in one transaction.
+func (db *Database) Flashback(ctx context.Context, query *Flashback) (*FlashbackResult, error) {
+	if query.DryRun {
+		_, shown, err := db.flashbackStatements(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		return &FlashbackResult{Statements: shown}, nil
+	}
+
+	tx, err := db.Begin(db.options.Isolation)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Flashback(ctx, query)
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			logging.Errorf("failed to roll back flashback transaction %s: %s", tx.ID, err)
+		}
+
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+// Flashback reverts the recent changes of the table within the transaction.
+func (tx *Transaction) Flashback(ctx context.Context, query *Flashback) (*FlashbackResult, error) {
+	statements, shown, err := tx.db.flashbackStatements(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FlashbackResult{Statements: shown, Applied: !query.DryRun}
+	if query.DryRun {
+		return result, nil
+	}
+
+	for _, statement := range statements {
+		q, err := Parse(statement)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", statement, err)
+		}
+
+		changed, err := tx.execute(ctx, q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute %s: %w", statement, err)
+		}
+
+		if rows := affectedRows(changed); rows != 1 {
+			return nil, fmt.Errorf("%s changed %d rows instead of one, the table has been changed or has the same rows", statement, rows)
+		}
+	}
+
+	return result, nil
+}
+
+// flashbackStatements returns the statements that revert the changes
+// of the table after the moment or the position, the newest first,
+// and the same statements shown to the user of the query.
+func (db *Database) flashbackStatements(ctx context.Context, query *Flashback) ([]string, []string, error) {
+	f := db.changefeed
+	if query.Time.IsZero() {
+		if !f.enabled() {
+			return nil, nil, fmt.Errorf("FLASHBACK requires the changefeed, the changes are not retained")
+		}
+	} else if err := f.retained("FLASHBACK", query.Time); err != nil {
+		return nil, nil, err
+	}
+
+	schema, err := db.Schema(query.Table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if last := db.ChangePosition(); query.Position > last {
+		return nil, nil, fmt.Errorf("position %d is after the last change %d", query.Position, last)
+	}
+
+	f.mu.Lock()
+	changes, _, err := f.read(0)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if query.Time.IsZero() && len(changes) > 0 && changes[0].Position > query.Position+1 {
+		return nil, nil, fmt.Errorf("%w, the oldest change is %d", ErrChangesExpired, changes[0].Position)
+	}
+
+	masked := db.queryMasks(ctx, schema.Name) != nil
+	statements, shown := make([]string, 0), make([]string, 0)
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if query.Time.IsZero() && change.Position <= query.Position || !query.Time.IsZero() && !change.Time.After(query.Time) {
+			break
+		}
+
+		if change.Table != schema.Name {
+			continue
+		}
+
+		if statement := compensatingStatement(schema, change, false); statement != "" {
+			statements = append(statements, statement)
+			shown = append(shown, compensatingStatement(schema, change, masked))
+		}
+	}
+
+	return statements, shown, nil
+}
+
+// compensatingStatement returns the statement that reverts the change,
+// it is empty for the updates that have not changed the values. The
+// values of the masked columns are redacted if masked is set.
+func compensatingStatement(schema Schema, change Change, masked bool) string {
+	switch change.Operation {
+	case ChangeInsert:
+		return fmt.Sprintf("DELETE FROM %s WHERE %s", sqlName(schema.Name), changeCondition(schema, change.New, masked))
+	case ChangeDelete:
+		names := make([]string, 0, len(schema.Columns))
+		values := make([]string, 0, len(schema.Columns))
+		for _, column := range sortedColumns(schema) {
+			if column.Expression == "" && column.Name != versionColumn {
+				names = append(names, sqlName(column.Name))
+				values = append(values, changeValue(column, change.Old, masked))
+			}
+		}
+
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", sqlName(schema.Name), strings.Join(names, ", "), strings.Join(values, ", "))
+	case ChangeUpdate:
+		set := make([]string, 0)
+		for _, column := range sortedColumns(schema) {
+			if column.Expression != "" || column.Name == versionColumn {
+				continue
+			}
+
+			if changeLiteral(change.Old[column.Name]) != changeLiteral(change.New[column.Name]) {
+				set = append(set, sqlName(column.Name)+" = "+changeValue(column, change.Old, masked))
+			}
+		}
+		if len(set) == 0 {
+			return ""
+		}
+
+		return fmt.Sprintf("UPDATE %s SET %s WHERE %s", sqlName(schema.Name), strings.Join(set, ", "), changeCondition(schema, change.New, masked))
+	}
+
+	return ""
+}
+
+// changeCondition matches the row by the values of the change, the
+// generated columns are skipped as they follow from the others.
+func changeCondition(schema Schema, values map[string]interface{}, masked bool) string {
+	conditions := make([]string, 0, len(schema.Columns))
+	for _, column := range sortedColumns(schema) {
+		if column.Expression == "" {
+			conditions = append(conditions, sqlName(column.Name)+" == "+changeValue(column, values, masked))
+		}
+	}
+
+	return strings.Join(conditions, " AND ")
+}
+
+// changeValue renders the value of the column in the change, redacted
+// if masked is set and the column is masked.
+func changeValue(column ColumnDef, values map[string]interface{}, masked bool) string {
+	value := values[column.Name]
+	if masked && column.Mask != nil {
+		// the integers of the changes are decoded as numbers
+		if number, ok := value.(json.Number); ok {
+			if n, err := number.Int64(); err == nil {
+				value = int(n)
+			}
+		}
+		value = column.Mask.apply(value)
+	}
+
+	return changeLiteral(value)
+}
+
+// changeLiteral renders the value of the change as a literal.
+func changeLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case json.Number:
+		return v.String()
+	case int:
+		return strconv.Itoa(v)
+	case string:
+		return quoteString(v)
+	}
+
+	return fmt.Sprint(value)
+}
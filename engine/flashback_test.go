@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlashbackMasksStatements(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{ChangefeedRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// execute executes the statement as the user
+	execute := func(userName string, statement string) interface{} {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		ctx, finish := db.StartQuery(context.Background(), userName, "test", statement)
+		defer finish()
+		result, err := db.ExecuteContext(ctx, q)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		return result
+	}
+
+	execute("", `CREATE TABLE cards (id INTEGER, card STRING)`)
+	execute("", `INSERT INTO cards (id, card) VALUES (1, "4111222233334444")`)
+	execute("", `ALTER TABLE cards ALTER COLUMN card SET MASK PARTIAL(4)`)
+	execute("", `CREATE USER admin PASSWORD "secret" SUPERUSER`)
+	execute("admin", `CREATE USER bob PASSWORD "secret"`)
+	execute("admin", `GRANT SELECT ON cards TO bob`)
+
+	tests := []struct {
+		user     string
+		expected []string
+	}{
+		{"bob", []string{`DELETE FROM cards WHERE id == 1 AND card == "****4444"`}},
+		{"admin", []string{`DELETE FROM cards WHERE id == 1 AND card == "4111222233334444"`}},
+	}
+	for _, test := range tests {
+		result := execute(test.user, `FLASHBACK TABLE cards TO POSITION 0 DRY RUN`).(*FlashbackResult)
+		if !reflect.DeepEqual(result.Statements, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.user, test.expected, result.Statements)
+		}
+	}
+}
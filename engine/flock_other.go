@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package engine
+
+import (
+	"os"
+)
+
+// lockFile treats the file with a PID as locked, advisory locks are
+// not supported on this platform. The PID of the killed process stays
+// in the file until the lock is forced.
+func lockFile(file *os.File) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() > 0 {
+		return errLocked
+	}
+
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package engine
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes the exclusive advisory lock on the file without
+// waiting, errLocked is returned if another process holds it.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+
+	return err
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
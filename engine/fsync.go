@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// FsyncPolicy defines when written files are flushed to the stable storage.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways flushes every file right after it is written, before
+	// the query is acknowledged.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval flushes written files periodically, acknowledged writes
+	// made within the last interval can be lost on power loss.
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever FsyncPolicy = "never"
+)
+
+// ErrSyncFailed is returned for the changes after the files have
+// failed to be flushed. The failed write-back can be lost even if a
+// later flush succeeds, so the database does not accept the changes
+// until it is restarted.
+var ErrSyncFailed = errors.New("failed to flush the files, the database is read-only")
+
+// DefaultFsyncInterval is used for the interval policy when
+// no interval is specified.
+const DefaultFsyncInterval = time.Second
+
+// ParseFsyncPolicy parses the policy name.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch policy := FsyncPolicy(name); policy {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy %s, expected one of: %s, %s, %s", name, FsyncAlways, FsyncInterval, FsyncNever)
+	}
+}
+
+// syncer flushes written files according to the fsync policy.
+type syncer struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// policy is changed by SET GLOBAL fsync
+	policy FsyncPolicy
+	// paths of the files written since the last flush
+	dirty map[string]struct{}
+	// failure is the first failed flush, it fails all the later writes
+	failure error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newSyncer creates a syncer and starts the background flushing,
+// the files are flushed in the background only with the interval policy.
+func newSyncer(policy FsyncPolicy, interval time.Duration) *syncer {
+	if interval <= 0 {
+		interval = DefaultFsyncInterval
+	}
+
+	s := &syncer{
+		policy:   policy,
+		interval: interval,
+		dirty:    make(map[string]struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *syncer) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				logging.Errorf("failed to flush files: %s", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// written must be called after the file has been written
+// and before it is closed.
+func (s *syncer) written(filePath string, file *os.File) error {
+	s.mu.Lock()
+	policy, failure := s.policy, s.failure
+	if policy == FsyncInterval {
+		s.dirty[filePath] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	if failure != nil {
+		return failure
+	}
+
+	if policy == FsyncAlways {
+		if err := file.Sync(); err != nil {
+			return s.fail(fmt.Errorf("failed to sync file %s: %w", filePath, err))
+		}
+
+		if err := syncDir(path.Dir(filePath)); err != nil {
+			return s.fail(err)
+		}
+	}
+
+	return nil
+}
+
+// replaced renames the written temporary file over the file, it must
+// be called before the temporary file is closed. With the always policy
+// the temporary file is flushed before it is renamed and the directory
+// after, so the file is either the old or the new one after a crash.
+func (s *syncer) replaced(tempFilePath string, filePath string, file *os.File) error {
+	if err := s.failed(); err != nil {
+		return err
+	}
+
+	policy := s.currentPolicy()
+	if policy == FsyncAlways {
+		if err := file.Sync(); err != nil {
+			return s.fail(fmt.Errorf("failed to sync file %s: %w", tempFilePath, err))
+		}
+	}
+
+	if err := os.Rename(tempFilePath, filePath); err != nil {
+		return fmt.Errorf("failed to replace file %s: %w", filePath, err)
+	}
+
+	switch policy {
+	case FsyncAlways:
+		if err := syncDir(path.Dir(filePath)); err != nil {
+			return s.fail(err)
+		}
+	case FsyncInterval:
+		s.mu.Lock()
+		s.dirty[filePath] = struct{}{}
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+// currentPolicy returns the policy the files are flushed with.
+func (s *syncer) currentPolicy() FsyncPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.policy
+}
+
+// setPolicy changes the policy of the files written from now on, the
+// files waiting for the interval are flushed when it is not used any more.
+func (s *syncer) setPolicy(policy FsyncPolicy) error {
+	s.mu.Lock()
+	previous := s.policy
+	s.policy = policy
+	s.mu.Unlock()
+
+	if previous == FsyncInterval && policy != FsyncInterval {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// flush syncs all the files written since the last flush. The files
+// are not retried after a failure: the kernel can drop the failed
+// pages and report the next flush as successful.
+func (s *syncer) flush() error {
+	s.mu.Lock()
+	dirty, failure := s.dirty, s.failure
+	s.dirty = make(map[string]struct{})
+	s.mu.Unlock()
+
+	if failure != nil {
+		return failure
+	}
+
+	dirs := make(map[string][]string)
+	for filePath := range dirty {
+		dir := path.Dir(filePath)
+		dirs[dir] = append(dirs[dir], filePath)
+	}
+
+	for dir, files := range dirs {
+		for _, filePath := range files {
+			if err := syncFile(filePath); err != nil {
+				return s.fail(err)
+			}
+		}
+
+		if err := syncDir(dir); err != nil {
+			return s.fail(err)
+		}
+	}
+
+	return nil
+}
+
+// failed returns the error of the failed flush, if any.
+func (s *syncer) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.failure
+}
+
+// fail stops accepting the writes after the flush has failed
+// and returns the error of the first failure.
+func (s *syncer) fail(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failure == nil {
+		logging.Errorf("the database is read-only from now on: %s", err)
+		s.failure = fmt.Errorf("%w: %s", ErrSyncFailed, err)
+	}
+
+	return s.failure
+}
+
+// close stops the background flushing and flushes the rest of the files.
+func (s *syncer) close() error {
+	close(s.stop)
+	<-s.done
+
+	return s.flush()
+}
+
+func syncFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the file has been removed since it was written
+			return nil
+		}
+
+		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer func() { checkFileClose(filePath, file.Close()) }()
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// syncDir makes sure that the created files are visible
+// in the directory after a crash.
+func syncDir(dir string) error {
+	return syncFile(dir)
+}
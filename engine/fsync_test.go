@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSyncerReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncInterval, FsyncNever} {
+		s := newSyncer(policy, 0)
+
+		filePath := path.Join(dir, string(policy)+tableFileExtension)
+		if err := ioutil.WriteFile(filePath, []byte(`[[1]]`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tempFilePath := filePath + tempFileExtension
+		file, err := os.Create(tempFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(`[[2]]`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.replaced(tempFilePath, filePath, file); err != nil {
+			t.Fatalf("%s: unexpected error: %s", policy, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if content, err := ioutil.ReadFile(filePath); err != nil || string(content) != `[[2]]` {
+			t.Errorf("%s: expected the replaced content, got %s, %v", policy, content, err)
+		}
+		if _, err := os.Stat(tempFilePath); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the temporary file to be renamed, got %v", policy, err)
+		}
+		s.mu.Lock()
+		_, dirty := s.dirty[filePath]
+		s.mu.Unlock()
+		if dirty != (policy == FsyncInterval) {
+			t.Errorf("%s: unexpected dirty %t", policy, dirty)
+		}
+
+		if err := s.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncerFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "t"+tableFileExtension)
+	if err := ioutil.WriteFile(filePath, []byte(`[[1]]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSyncer(FsyncInterval, time.Hour)
+	defer s.close()
+
+	// a file within a file can not be opened to be flushed
+	s.mu.Lock()
+	s.dirty[path.Join(filePath, "broken")] = struct{}{}
+	s.mu.Unlock()
+	if err := s.flush(); !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("expected %v, got %v", ErrSyncFailed, err)
+	}
+
+	// the failed files are not retried and the writes are failed
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := s.written(filePath, file); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("expected %v, got %v", ErrSyncFailed, err)
+	}
+	if err := s.flush(); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("expected %v, got %v", ErrSyncFailed, err)
+	}
+}
+
+func TestWritesAfterSyncFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	execute := func(statement string) error {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		if err := db.Authorize("", q); err != nil {
+			return err
+		}
+		_, err = db.Execute(q)
+
+		return err
+	}
+
+	if err := execute(`CREATE TABLE t (id INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is closed before it is flushed
+	file, err := os.Create(path.Join(dir, "closed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.syncer.written(file.Name(), file); !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("expected %v, got %v", ErrSyncFailed, err)
+	}
+
+	err = execute(`INSERT INTO t (id) VALUES (1)`)
+	if !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("expected %v, got %v", ErrSyncFailed, err)
+	}
+	if code := Classify(err).Code; code != CodeReadOnly {
+		t.Errorf("expected code %s, got %s", CodeReadOnly, code)
+	}
+	if err := execute(`SELECT id FROM t`); err != nil {
+		t.Errorf("expected the reads to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The generated columns are computed from the other columns of the row
+// with the expressions of integer arithmetic, + - * / and parentheses,
+// and string concatenation with +. The values of the stored columns are
+// computed when the rows are inserted or updated and are written to the
+// data files, the ones of the virtual columns are computed again when
+// the rows are read from the data files, where they are null. The
+// values are not inserted or updated directly, the expressions refer
+// only to the columns that are not generated.
+
+// GeneratedColumn describes the generated column of CREATE TABLE.
+type GeneratedColumn struct {
+	Column     string
+	Expression string
+	Stored     bool
+}
+
+// genExpr is the node of the compiled expression: the operation with
+// the operands, the column or the literal value.
+type genExpr struct {
+	op          string
+	left, right *genExpr
+	column      string
+	value       interface{}
+}
+
+// compiledExprs caches the compiled expressions by their text.
+var compiledExprs sync.Map
+
+// compileExpr parses the expression of the generated column.
+func compileExpr(expression string) (*genExpr, error) {
+	if expr, ok := compiledExprs.Load(expression); ok {
+		return expr.(*genExpr), nil
+	}
+
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &tokenStream{tokens: tokens}
+	expr, err := parseGenSum(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expectEnd(); err != nil {
+		return nil, err
+	}
+	compiledExprs.Store(expression, expr)
+
+	return expr, nil
+}
+
+func parseGenSum(s *tokenStream) (*genExpr, error) {
+	left, err := parseGenProduct(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := s.peek()
+		switch {
+		case op.kind == tokenSymbol && (op.value == "+" || op.value == "-"):
+			s.next()
+		case op.kind == tokenNumber && strings.HasPrefix(op.value, "-"):
+			// price-5 is tokenized as price and -5
+			s.next()
+			value, err := strconv.Atoi(op.value[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer %s", op.value)
+			}
+			left = &genExpr{op: "-", left: left, right: &genExpr{value: value}}
+			continue
+		default:
+			return left, nil
+		}
+
+		right, err := parseGenProduct(s)
+		if err != nil {
+			return nil, err
+		}
+		left = &genExpr{op: op.value, left: left, right: right}
+	}
+}
+
+func parseGenProduct(s *tokenStream) (*genExpr, error) {
+	left, err := parseGenFactor(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for s.peek().kind == tokenSymbol && (s.peek().value == "*" || s.peek().value == "/") {
+		op := s.next()
+		right, err := parseGenFactor(s)
+		if err != nil {
+			return nil, err
+		}
+		left = &genExpr{op: op.value, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func parseGenFactor(s *tokenStream) (*genExpr, error) {
+	t := s.next()
+	switch t.kind {
+	case tokenNumber:
+		value, err := strconv.Atoi(t.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", t.value)
+		}
+
+		return &genExpr{value: value}, nil
+	case tokenString:
+		value, err := parseValue(t.value)
+		if err != nil {
+			return nil, err
+		}
+
+		return &genExpr{value: value}, nil
+	case tokenWord:
+		return &genExpr{column: strings.ToLower(t.value)}, nil
+	case tokenSymbol:
+		switch t.value {
+		case "(":
+			expr, err := parseGenSum(s)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+
+			return expr, nil
+		case "-":
+			operand, err := parseGenFactor(s)
+			if err != nil {
+				return nil, err
+			}
+
+			return &genExpr{op: "-", left: &genExpr{value: 0}, right: operand}, nil
+		}
+	}
+
+	s.pos--
+	return nil, s.unexpected("column, value or (")
+}
+
+// columnType resolves the type of the expression
+// against the columns that are not generated.
+func (e *genExpr) columnType(schema Schema) (sql.ColumnType, error) {
+	switch {
+	case e.column != "":
+		column, exists := schema.Columns[e.column]
+		if !exists || e.column == versionColumn {
+			return 0, newError(CodeUndefinedColumn, "column %s does not exist", e.column)
+		}
+		if column.Expression != "" {
+			return 0, fmt.Errorf("column %s is generated", e.column)
+		}
+
+		return column.Type, nil
+	case e.op == "":
+		if _, ok := e.value.(string); ok {
+			return sql.TypeString, nil
+		}
+
+		return sql.TypeInteger, nil
+	}
+
+	left, err := e.left.columnType(schema)
+	if err != nil {
+		return 0, err
+	}
+	right, err := e.right.columnType(schema)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case left == sql.TypeInteger && right == sql.TypeInteger:
+		return sql.TypeInteger, nil
+	case left == sql.TypeString && right == sql.TypeString && e.op == "+":
+		return sql.TypeString, nil
+	default:
+		return 0, fmt.Errorf("operation %s is not supported for %s and %s", e.op, left.Name(), right.Name())
+	}
+}
+
+// eval computes the expression for the row.
+func (e *genExpr) eval(schema Schema, row []interface{}) (interface{}, error) {
+	if e.column != "" {
+		return row[schema.Columns[e.column].Position], nil
+	}
+	if e.op == "" {
+		return e.value, nil
+	}
+
+	left, err := e.left.eval(schema, row)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.eval(schema, row)
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := left.(string); ok {
+		r, _ := right.(string)
+		return l + r, nil
+	}
+
+	l, _ := left.(int)
+	r, _ := right.(int)
+	switch e.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	default:
+		if r == 0 {
+			return nil, newError(CodeDivisionByZero, "division by zero")
+		}
+
+		return l / r, nil
+	}
+}
+
+// validateGenerated checks the expressions of the generated columns,
+// the columns must have the types of their expressions.
+func validateGenerated(schema Schema) error {
+	for _, column := range schema.Columns {
+		if column.Expression == "" {
+			continue
+		}
+
+		expr, err := compileExpr(column.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid expression of column %s: %w", column.Name, err)
+		}
+
+		exprType, err := expr.columnType(schema)
+		if err != nil {
+			return fmt.Errorf("invalid expression of column %s: %w", column.Name, err)
+		}
+
+		if exprType != column.Type {
+			return fmt.Errorf("expression of column %s is %s, the column is %s", column.Name, exprType.Name(), column.Type.Name())
+		}
+	}
+
+	return nil
+}
+
+// computeGenerated computes the generated columns of the row,
+// only the virtual ones if virtualOnly is true.
+func computeGenerated(schema Schema, row []interface{}, virtualOnly bool) error {
+	for _, column := range schema.Columns {
+		if column.Expression == "" || (virtualOnly && column.Stored) || column.Position >= len(row) {
+			continue
+		}
+
+		expr, err := compileExpr(column.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid expression of column %s: %w", column.Name, err)
+		}
+
+		value, err := expr.eval(schema, row)
+		if err != nil {
+			return fmt.Errorf("failed to compute column %s: %w", column.Name, err)
+		}
+		row[column.Position] = value
+	}
+
+	return nil
+}
+
+// hasVirtual reports whether the table has virtual columns.
+func hasVirtual(schema Schema) bool {
+	for _, column := range schema.Columns {
+		if column.Expression != "" && !column.Stored {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripVirtual returns the rows with the values of the virtual columns
+// replaced with nulls, the rows are not modified.
+func stripVirtual(schema Schema, rows [][]interface{}) [][]interface{} {
+	if !hasVirtual(schema) {
+		return rows
+	}
+
+	stripped := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		stripped[i] = make([]interface{}, len(row))
+		copy(stripped[i], row)
+
+		for _, column := range schema.Columns {
+			if column.Expression != "" && !column.Stored && column.Position < len(row) {
+				stripped[i][column.Position] = nil
+			}
+		}
+	}
+
+	return stripped
+}
+
+// writableColumns returns the columns of the table in the order of
+// the row values without the row version and the generated columns.
+func writableColumns(schema Schema) []ColumnDef {
+	columns := dumpedColumns(schema)
+
+	writable := columns[:0]
+	for _, column := range columns {
+		if column.Expression == "" {
+			writable = append(writable, column)
+		}
+	}
+
+	return writable
+}
+
+// generatedClause finds [GENERATED ALWAYS] AS (expression) [STORED |
+// VIRTUAL] starting at the token, the end is the position after it.
+func generatedClause(query string, tokens []token, i int) (GeneratedColumn, int, int, bool) {
+	start := i
+	if tokens[i].kind == tokenWord && strings.EqualFold(tokens[i].value, "GENERATED") {
+		if i+1 >= len(tokens) || !strings.EqualFold(tokens[i+1].value, "ALWAYS") {
+			return GeneratedColumn{}, 0, 0, false
+		}
+		i += 2
+	}
+
+	if i+1 >= len(tokens) || tokens[i].kind != tokenWord || !strings.EqualFold(tokens[i].value, "AS") || tokens[i+1].value != "(" {
+		return GeneratedColumn{}, 0, 0, false
+	}
+
+	// the column name precedes the type
+	if start < 2 || tokens[start-2].kind != tokenWord {
+		return GeneratedColumn{}, 0, 0, false
+	}
+	column := GeneratedColumn{Column: strings.ToLower(tokens[start-2].value)}
+
+	open := i + 1
+	depth := 0
+	j := open
+	for ; j < len(tokens) && tokens[j].kind != tokenEnd; j++ {
+		if tokens[j].value == "(" && tokens[j].kind == tokenSymbol {
+			depth++
+		} else if tokens[j].value == ")" && tokens[j].kind == tokenSymbol {
+			depth--
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	if depth != 0 {
+		return GeneratedColumn{}, 0, 0, false
+	}
+	column.Expression = strings.TrimSpace(query[tokens[open].pos+1 : tokens[j].pos])
+	end := tokens[j].pos + 1
+
+	next := tokens[j+1]
+	switch {
+	case next.kind == tokenWord && strings.EqualFold(next.value, "STORED"):
+		column.Stored = true
+		end = next.pos + len(next.value)
+	case next.kind == tokenWord && strings.EqualFold(next.value, "VIRTUAL"):
+		end = next.pos + len(next.value)
+	}
+
+	return column, tokens[start].pos, end, true
+}
+
+// stripGenerated removes the generated clauses from the column
+// definitions of CREATE TABLE and returns the generated columns.
+func stripGenerated(query string) (string, []GeneratedColumn, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return query, nil, nil
+	}
+
+	var b strings.Builder
+	var generated []GeneratedColumn
+	last := 0
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == tokenSymbol && t.value == "(" {
+			depth++
+		}
+		if t.kind == tokenSymbol && t.value == ")" {
+			depth--
+		}
+		if depth != 1 || t.kind != tokenWord {
+			continue
+		}
+
+		column, start, end, ok := generatedClause(query, tokens, i)
+		if !ok {
+			continue
+		}
+		if column.Expression == "" {
+			return "", nil, fmt.Errorf("expression of column %s is empty", column.Column)
+		}
+
+		b.WriteString(query[last:start])
+		last = end
+		generated = append(generated, column)
+		for i+1 < len(tokens) && tokens[i+1].pos < end {
+			i++
+		}
+	}
+
+	if len(generated) == 0 {
+		return query, nil, nil
+	}
+	b.WriteString(query[last:])
+
+	return b.String(), generated, nil
+}
+
+// generatedColumns returns the template columns of the generated
+// columns passed to createTable.
+func generatedColumns(generated []GeneratedColumn) map[string]ColumnDef {
+	if len(generated) == 0 {
+		return nil
+	}
+
+	columns := make(map[string]ColumnDef, len(generated))
+	for _, column := range generated {
+		columns[column.Column] = ColumnDef{Name: column.Column, Expression: column.Expression, Stored: column.Stored}
+	}
+
+	return columns
+}
@@ -0,0 +1,426 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Privilege allows the user to execute the statements of a kind.
+type Privilege string
+
+const (
+	// PrivilegeSelect allows SELECT.
+	PrivilegeSelect Privilege = "SELECT"
+	// PrivilegeInsert allows INSERT.
+	PrivilegeInsert Privilege = "INSERT"
+	// PrivilegeUpdate allows UPDATE.
+	PrivilegeUpdate Privilege = "UPDATE"
+	// PrivilegeDelete allows DELETE.
+	PrivilegeDelete Privilege = "DELETE"
+	// PrivilegeDDL allows creating tables and dropping partitions.
+	PrivilegeDDL Privilege = "DDL"
+	// PrivilegeUnmask allows seeing the values of the masked columns.
+	PrivilegeUnmask Privilege = "UNMASK"
+)
+
+// allPrivileges are granted by ALL PRIVILEGES.
+var allPrivileges = []Privilege{PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate, PrivilegeDelete, PrivilegeDDL, PrivilegeUnmask}
+
+// grantDatabase is the grant target of the privileges
+// on all the tables, including the future ones.
+const grantDatabase = "*"
+
+// Grant represents GRANT privileges ON {DATABASE | [TABLE] name}
+// TO user statement.
+//
+//	GRANT SELECT, INSERT ON orders TO bob
+//	GRANT ALL PRIVILEGES ON DATABASE TO alice
+type Grant struct {
+	Privileges []Privilege
+	// Table is empty for the privileges on all the tables.
+	Table string
+	User  string
+}
+
+// GetType returns the statement type.
+func (*Grant) GetType() sql.StatementType { return StatementGrant }
+
+// Revoke represents REVOKE privileges ON {DATABASE | [TABLE] name}
+// FROM user statement. The privileges granted on the database are
+// revoked only on the database, not on a single table.
+type Revoke struct {
+	Privileges []Privilege
+	// Table is empty for the privileges on all the tables.
+	Table string
+	User  string
+}
+
+// GetType returns the statement type.
+func (*Revoke) GetType() sql.StatementType { return StatementRevoke }
+
+// parseGrant parses GRANT and REVOKE statements.
+func parseGrant(s *tokenStream) (sql.Statement, error) {
+	revoke := s.acceptKeyword("REVOKE")
+	if !revoke {
+		s.mustKeyword("GRANT")
+	}
+
+	privileges, err := parsePrivileges(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+
+	table := ""
+	if !s.acceptKeyword("DATABASE") {
+		s.acceptKeyword("TABLE")
+		table, err = s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if revoke {
+		err = s.expectKeyword("FROM")
+	} else {
+		err = s.expectKeyword("TO")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	userName, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.expectEnd(); err != nil {
+		return nil, err
+	}
+
+	if revoke {
+		return &Revoke{privileges, table, userName}, nil
+	}
+
+	return &Grant{privileges, table, userName}, nil
+}
+
+// parsePrivileges parses ALL [PRIVILEGES] or the comma-separated
+// privilege names.
+func parsePrivileges(s *tokenStream) ([]Privilege, error) {
+	if s.acceptKeyword("ALL") {
+		s.acceptKeyword("PRIVILEGES")
+
+		return allPrivileges, nil
+	}
+
+	privileges := make([]Privilege, 0)
+	for {
+		found := false
+		for _, privilege := range allPrivileges {
+			if s.acceptKeyword(string(privilege)) {
+				privileges = append(privileges, privilege)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, s.unexpected("SELECT, INSERT, UPDATE, DELETE, DDL, UNMASK or ALL")
+		}
+
+		if !s.acceptSymbol(",") {
+			return privileges, nil
+		}
+	}
+}
+
+// grantTarget returns the key of the grants of the table, the
+// privileges on the temporary tables are the ones on their names.
+func grantTarget(table string) string {
+	if table == "" {
+		return grantDatabase
+	}
+
+	table = strings.ToLower(table)
+	if schema := tableSchema(table); strings.HasPrefix(schema, temporarySchemaPrefix) {
+		return strings.TrimPrefix(table, schema+schemaSeparator)
+	}
+
+	return table
+}
+
+// Grant grants the privileges to the user.
+func (db *Database) Grant(query *Grant) error {
+	return db.changeGrants(query.User, query.Table, func(granted map[Privilege]bool) {
+		for _, privilege := range query.Privileges {
+			granted[privilege] = true
+		}
+	})
+}
+
+// Revoke revokes the privileges from the user.
+func (db *Database) Revoke(query *Revoke) error {
+	return db.changeGrants(query.User, query.Table, func(granted map[Privilege]bool) {
+		for _, privilege := range query.Privileges {
+			delete(granted, privilege)
+		}
+	})
+}
+
+// changeGrants changes the privileges of the user on the table
+// and stores the users.
+func (db *Database) changeGrants(userName string, table string, change func(granted map[Privilege]bool)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := strings.ToLower(userName)
+	u, exists := db.users[name]
+	if !exists {
+		return newError(CodeUndefinedObject, "user %s does not exist", name)
+	}
+
+	if table != "" {
+		if _, exists := virtualTables[strings.ToLower(table)]; exists {
+			return fmt.Errorf("%s is readable by all users", table)
+		}
+	}
+
+	target := grantTarget(table)
+	previous := u.Grants[target]
+
+	granted := make(map[Privilege]bool)
+	for _, privilege := range previous {
+		granted[privilege] = true
+	}
+	change(granted)
+
+	privileges := make([]Privilege, 0, len(granted))
+	for _, privilege := range allPrivileges {
+		if granted[privilege] {
+			privileges = append(privileges, privilege)
+		}
+	}
+
+	if u.Grants == nil {
+		u.Grants = make(map[string][]Privilege)
+	}
+	if len(privileges) == 0 {
+		delete(u.Grants, target)
+	} else {
+		u.Grants[target] = privileges
+	}
+
+	if err := db.storeUsers(); err != nil {
+		if previous == nil {
+			delete(u.Grants, target)
+		} else {
+			u.Grants[target] = previous
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// requiredPrivilege returns the privilege the statement requires
+// and the table it is required on, the privilege is empty for the
+// statements that do not require any.
+func requiredPrivilege(q sql.Statement) (Privilege, string) {
+	switch query := q.(type) {
+	case *sql.Select:
+		if _, exists := virtualTables[strings.ToLower(query.Table)]; exists {
+			return "", ""
+		}
+
+		return PrivilegeSelect, query.Table
+	case *CountRows:
+		return requiredPrivilege(query.Select)
+	case *OrderedSelect:
+		return requiredPrivilege(query.Select)
+	case *GroupedSelect:
+		return requiredPrivilege(query.Select)
+	case *AsOfSelect:
+		return requiredPrivilege(query.Select)
+	case *sql.Insert:
+		return PrivilegeInsert, query.Table
+	case *sql.Update:
+		return PrivilegeUpdate, query.Table
+	case *UpdateIfVersion:
+		return PrivilegeUpdate, query.Table
+	case *sql.Delete:
+		return PrivilegeDelete, query.Table
+	case *DeleteIfVersion:
+		return PrivilegeDelete, query.Table
+	case *sql.CreateTable:
+		return PrivilegeDDL, query.Name
+	case *CreatePartitionedTable:
+		return PrivilegeDDL, query.Name
+	case *CreateVersionedTable:
+		return PrivilegeDDL, query.Name
+	case *CreateMemoryTable:
+		return PrivilegeDDL, query.Name
+	case *sql.DropTable:
+		return PrivilegeDDL, query.Table
+	case *DropPartition:
+		return PrivilegeDDL, query.Table
+	case *RenameTable:
+		return PrivilegeDDL, query.Table
+	case *AlterColumnMask:
+		return PrivilegeDDL, query.Table
+	case *Comment:
+		return PrivilegeDDL, query.Table
+	case *Analyze:
+		return PrivilegeDDL, query.Table
+	case *CreateSchema, *DropSchema, *CreateSequence, *DropSequence:
+		return PrivilegeDDL, ""
+	case *CreateTrigger:
+		return PrivilegeDDL, query.Table
+	case *DropTrigger:
+		return PrivilegeDDL, query.Table
+	case *Explain:
+		return requiredPrivilege(query.Statement)
+	case *Copy:
+		if query.To {
+			return PrivilegeSelect, query.Table
+		}
+
+		return PrivilegeInsert, query.Table
+	case *ShowCreateTable:
+		return PrivilegeSelect, query.Table
+	case *Flashback:
+		if query.DryRun {
+			return PrivilegeSelect, query.Table
+		}
+
+		// the changes of any kind are reverted
+		return PrivilegeDDL, query.Table
+	}
+
+	return "", ""
+}
+
+// tableAccess reports whether the user has the privilege on the
+// table, any privilege if it is empty.
+type tableAccess func(privilege Privilege, table string) bool
+
+// tableAccess returns the access of the user of the query started
+// with the context, it must be called with the database lock held.
+// The embedded callers that have not started the query with
+// StartQuery access all the tables.
+func (db *Database) tableAccess(ctx context.Context) tableAccess {
+	running, ok := ctx.Value(runningQueryKey{}).(*runningQuery)
+	if !ok {
+		return func(Privilege, string) bool { return true }
+	}
+
+	return func(privilege Privilege, table string) bool {
+		return db.canAccess(running.user, privilege, table)
+	}
+}
+
+// TableVisible reports whether the table is listed for the user or
+// the token principal, the users see the tables they have any
+// privilege on.
+func (db *Database) TableVisible(userName string, table string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.canAccess(userName, "", strings.ToLower(table))
+}
+
+// canAccess reports whether the user or the token principal has the
+// privilege on the table, any privilege if it is empty. It must be
+// called with the database lock held, the named databases take the
+// lock of the main one.
+func (db *Database) canAccess(userName string, privilege Privilege, table string) bool {
+	if db.authority == nil {
+		return db.accessible(userName, privilege, table)
+	}
+
+	db.authority.mu.Lock()
+	defer db.authority.mu.Unlock()
+
+	return db.authority.accessible(userName, privilege, table)
+}
+
+// accessible reports whether the user or the token principal has the
+// privilege on the table, it must be called with the lock held.
+func (db *Database) accessible(userName string, privilege Privilege, table string) bool {
+	if !db.authenticationRequired() {
+		return true
+	}
+
+	// all the tokens select all the tables
+	if strings.HasPrefix(userName, tokenPrincipalPrefix) {
+		t, exists := db.tokens[strings.TrimPrefix(userName, tokenPrincipalPrefix)]
+
+		return exists && !t.expired()
+	}
+
+	u, exists := db.users[strings.ToLower(userName)]
+	if !exists {
+		return false
+	}
+	if u.Superuser {
+		return true
+	}
+	if privilege != "" {
+		return u.hasPrivilege(privilege, table)
+	}
+
+	for _, granted := range allPrivileges {
+		if u.hasPrivilege(granted, table) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasPrivilege reports whether the privilege is granted to the user
+// on the table or on the database.
+func (u *user) hasPrivilege(privilege Privilege, table string) bool {
+	for _, target := range []string{grantTarget(table), grantDatabase} {
+		for _, granted := range u.Grants[target] {
+			if granted == privilege {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// grantRows describes the privileges granted to the users,
+// the database-wide ones are on the * table.
+func (db *Database) grantRows() [][]interface{} {
+	rows := make([][]interface{}, 0)
+	for _, u := range db.users {
+		for target, privileges := range u.Grants {
+			for _, privilege := range privileges {
+				rows = append(rows, []interface{}{u.Name, target, string(privilege)})
+			}
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		for k := range rows[i] {
+			if rows[i][k] != rows[j][k] {
+				return rows[i][k].(string) < rows[j][k].(string)
+			}
+		}
+
+		return false
+	})
+
+	return rows
+}
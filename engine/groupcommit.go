@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Every insert rewrites and syncs the data files of the rows and the meta
+// file of the table, so the concurrent inserts spend most of the time
+// waiting for each other. With group commit the inserts outside of
+// transactions are queued, the first one in the queue becomes the leader
+// that takes the whole queue, validates the inserts one by one and writes
+// the rows of the valid ones with a single write and sync of every data
+// file. The inserts that come in the meantime are taken by the next leader.
+// The failed inserts do not affect the others, only the failed writes fail
+// the whole group.
+
+// GroupCommitStats counts the groups of the inserts written at once.
+type GroupCommitStats struct {
+	Groups     uint64 `json:"groups"`
+	Statements uint64 `json:"statements"`
+	Largest    int    `json:"largest"`
+}
+
+// groupInsert is the insert waiting in the queue.
+type groupInsert struct {
+	ctx   context.Context
+	query *sql.Insert
+	// lead is closed when the insert becomes the leader
+	lead chan struct{}
+	// done is closed when the insert has been written or has failed
+	done     chan struct{}
+	inserted int
+	err      error
+}
+
+// groupCommitter queues the concurrent inserts outside of transactions.
+type groupCommitter struct {
+	db     *Database
+	size   int
+	window time.Duration
+
+	mu    sync.Mutex
+	queue []*groupInsert
+	// leading is true while the queue has the leader
+	leading bool
+	// full is signaled when the queue has grown to the size
+	full chan struct{}
+	// grouped is the number of the inserts of the last group
+	grouped int
+	stats   GroupCommitStats
+}
+
+func newGroupCommitter(db *Database, size int, window time.Duration) *groupCommitter {
+	if size <= 1 {
+		return nil
+	}
+
+	return &groupCommitter{db: db, size: size, window: window, full: make(chan struct{}, 1)}
+}
+
+// insert queues the insert and waits until it is written by the leader
+// of its group, possibly by itself.
+func (c *groupCommitter) insert(ctx context.Context, query *sql.Insert) (int, error) {
+	g := &groupInsert{ctx: ctx, query: query, lead: make(chan struct{}), done: make(chan struct{})}
+
+	c.mu.Lock()
+	c.queue = append(c.queue, g)
+	leader := !c.leading
+	c.leading = true
+	if len(c.queue) >= c.size {
+		select {
+		case c.full <- struct{}{}:
+		default:
+		}
+	}
+	c.mu.Unlock()
+
+	// the queued insert is not canceled by the context, it is checked
+	// by the leader, so the canceled insert is never written
+	if !leader {
+		select {
+		case <-g.done:
+			return g.inserted, g.err
+		case <-g.lead:
+		}
+	}
+
+	c.lead()
+	<-g.done
+
+	return g.inserted, g.err
+}
+
+// lead writes the group from the head of the queue and passes
+// the leadership to the next insert in the queue.
+func (c *groupCommitter) lead() {
+	select {
+	case <-c.full:
+	default:
+	}
+
+	// the window is waited only while the inserts come concurrently,
+	// a single insert is written at once
+	c.mu.Lock()
+	wait := c.window > 0 && c.grouped > 1 && len(c.queue) < c.size
+	c.mu.Unlock()
+	if wait {
+		timer := time.NewTimer(c.window)
+		select {
+		case <-timer.C:
+		case <-c.full:
+		}
+		timer.Stop()
+	}
+
+	c.mu.Lock()
+	n := len(c.queue)
+	if n > c.size {
+		n = c.size
+	}
+	group := make([]*groupInsert, n)
+	copy(group, c.queue)
+	c.queue = c.queue[n:]
+	c.mu.Unlock()
+
+	c.db.writeGroup(group)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.grouped = n
+	c.stats.Groups++
+	c.stats.Statements += uint64(n)
+	if n > c.stats.Largest {
+		c.stats.Largest = n
+	}
+
+	if len(c.queue) > 0 {
+		close(c.queue[0].lead)
+	} else {
+		c.leading = false
+	}
+}
+
+func (c *groupCommitter) currentStats() GroupCommitStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// writeGroup validates the inserts of the group and writes the valid
+// ones as a single statement.
+func (db *Database) writeGroup(group []*groupInsert) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	inserts := make([]*pendingInsert, 0, len(group))
+	valid := make([]*groupInsert, 0, len(group))
+	accepted := newAcceptedRows()
+	for _, g := range group {
+		values, err := insertValues(g.query)
+		if err != nil {
+			g.err = err
+			close(g.done)
+			continue
+		}
+
+		insert, err := db.prepareInsert(g.ctx, l, g.query.Table, g.query.Columns, [][]interface{}{values}, accepted)
+		if err != nil {
+			g.err = err
+			close(g.done)
+			continue
+		}
+		accepted.add(insert)
+
+		inserts = append(inserts, insert)
+		valid = append(valid, g)
+	}
+
+	if len(inserts) == 0 {
+		return
+	}
+
+	tableNames := make([]string, len(inserts))
+	for i, insert := range inserts {
+		tableNames[i] = insert.table.Name
+	}
+
+	record, done := db.writeRecord(nil, tableNames...)
+	// the group is written within the trace of its first insert
+	err := db.writeInserts(valid[0].ctx, nil, record, inserts)
+	done()
+
+	for i, g := range valid {
+		if err != nil {
+			g.err = err
+		} else {
+			g.inserted = inserts[i].rows
+		}
+		close(g.done)
+	}
+}
+
+// GroupCommitStats returns the counters of group commit,
+// the zero stats if group commit is disabled.
+func (db *Database) GroupCommitStats() GroupCommitStats {
+	if db.groupCommit == nil {
+		return GroupCommitStats{}
+	}
+
+	return db.groupCommit.currentStats()
+}
@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the file that stores the executed queries,
+// one JSON object per line
+const historyFileName = "gosqldb.history.jsonl"
+
+// historyCompactionPeriod is how often expired entries
+// are removed from the history file.
+const historyCompactionPeriod = time.Minute
+
+// HistoryEntry is a record about the executed query.
+type HistoryEntry struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Query  string    `json:"query"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// matches reports whether the entry mentions the key and
+// was recorded within [from, to).
+func (e HistoryEntry) matches(key string, from time.Time, to time.Time) bool {
+	if e.Time.Before(from) || !e.Time.Before(to) {
+		return false
+	}
+
+	return strings.Contains(e.Query, key) || strings.Contains(e.Client, key) || strings.Contains(e.Error, key)
+}
+
+// purgeable is a store of records that can be purged
+// for data-retention compliance.
+type purgeable interface {
+	// name of the store reported in the purge results
+	name() string
+	// purge removes the records related to the key within [from, to).
+	purge(key string, from time.Time, to time.Time) (int, error)
+	// count counts the records related to the key within [from, to).
+	count(key string, from time.Time, to time.Time) (int, error)
+}
+
+// queryHistory is an append-only log of executed queries
+// with time-bounded retention.
+type queryHistory struct {
+	filePath  string
+	retention time.Duration
+	syncer    *syncer
+	// encrypts the entries, nil if the encryption is disabled
+	encryption *encryption
+
+	mu            sync.Mutex
+	lastCompacted time.Time
+}
+
+func newQueryHistory(dbDir string, retention time.Duration, syncer *syncer, e *encryption) *queryHistory {
+	return &queryHistory{
+		filePath:   path.Join(dbDir, historyFileName),
+		retention:  retention,
+		syncer:     syncer,
+		encryption: e,
+	}
+}
+
+func (h *queryHistory) name() string {
+	return "query_history"
+}
+
+// record appends the entry, history is disabled if retention is zero.
+func (h *queryHistory) record(entry HistoryEntry) error {
+	if h.retention <= 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if time.Since(h.lastCompacted) > historyCompactionPeriod {
+		cutoff := time.Now().Add(-h.retention)
+		_, err := h.rewrite(func(e HistoryEntry) bool { return e.Time.Before(cutoff) })
+		if err != nil {
+			return fmt.Errorf("failed to remove expired entries: %w", err)
+		}
+		h.lastCompacted = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode history entry: %w", err)
+	}
+
+	line, err = h.encryption.sealLine(line)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt history entry: %w", err)
+	}
+
+	file, err := os.OpenFile(h.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", h.filePath, err)
+	}
+	defer func() { checkFileClose(h.filePath, file.Close()) }()
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", h.filePath, err)
+	}
+
+	return h.syncer.written(h.filePath, file)
+}
+
+func (h *queryHistory) purge(key string, from time.Time, to time.Time) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.rewrite(func(e HistoryEntry) bool { return e.matches(key, from, to) })
+}
+
+func (h *queryHistory) count(key string, from time.Time, to time.Time) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries, err := h.load()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if entry.matches(key, from, to) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (h *queryHistory) load() ([]HistoryEntry, error) {
+	content, err := ioutil.ReadFile(h.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read file %s: %w", h.filePath, err)
+	}
+
+	entries := make([]HistoryEntry, 0)
+	err = readLines(content, h.encryption, func(line []byte) error {
+		var entry HistoryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("failed to decode history entry from %s: %w", h.filePath, err)
+		}
+		entries = append(entries, entry)
+
+		return nil
+	})
+
+	return entries, err
+}
+
+// rewrite removes the entries for which remove returns true
+// and returns the number of removed entries.
+func (h *queryHistory) rewrite(remove func(HistoryEntry) bool) (int, error) {
+	entries, err := h.load()
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	removed := 0
+	for _, entry := range entries {
+		if remove(entry) {
+			removed++
+			continue
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode history entry: %w", err)
+		}
+
+		line, err = h.encryption.sealLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt history entry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	file, err := os.Create(h.filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file %s: %w", h.filePath, err)
+	}
+	defer func() { checkFileClose(h.filePath, file.Close()) }()
+
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("failed to write to file %s: %w", h.filePath, err)
+	}
+
+	return removed, h.syncer.written(h.filePath, file)
+}
+
+// PurgeResult describes the purge of a single store.
+type PurgeResult struct {
+	Store  string `json:"store"`
+	Purged int    `json:"purged"`
+	// Remaining is the number of matching records found
+	// after the purge, must be zero.
+	Remaining int  `json:"remaining"`
+	Verified  bool `json:"verified"`
+}
+
+// RecordQuery appends the executed query to the query history,
+// the passwords of the user statements are redacted.
+func (db *Database) RecordQuery(client string, query string, queryErr error) error {
+	entry := HistoryEntry{Time: time.Now().UTC(), Client: client, Query: redactPasswords(query)}
+	if queryErr != nil {
+		entry.Error = queryErr.Error()
+	}
+
+	return db.history.record(entry)
+}
+
+// Purge removes the records related to the key within [from, to)
+// from all the stores and verifies that nothing is left.
+func (db *Database) Purge(key string, from time.Time, to time.Time) ([]PurgeResult, error) {
+	if key == "" {
+		return nil, fmt.Errorf("key is required")
+	}
+
+	if !from.Before(to) {
+		return nil, fmt.Errorf("invalid time range: %s - %s", from, to)
+	}
+
+	results := make([]PurgeResult, 0, len(db.purgeables))
+	for _, store := range db.purgeables {
+		purged, err := store.purge(key, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("failed to purge %s: %w", store.name(), err)
+		}
+
+		remaining, err := store.count(key, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify %s: %w", store.name(), err)
+		}
+
+		results = append(results, PurgeResult{store.name(), purged, remaining, remaining == 0})
+	}
+
+	return results, nil
+}
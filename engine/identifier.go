@@ -0,0 +1,205 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The unquoted names are case-insensitive, Events and events are the
+// same table. The names quoted with backticks keep their case, as the
+// double quotes enclose the strings:
+//
+//	CREATE TABLE `UserEvents` (`UserID` INTEGER)
+//	SELECT `UserID` FROM `UserEvents`
+//
+// The quoted names in lowercase are the same as the unquoted ones. The
+// others are rewritten before parsing, as the qualified names are, into
+// the names with the quotedPrefix where every uppercase letter is
+// preceded by an underscore and every underscore is followed by 0, so
+// `UserEvents` is _quoted_user_events and does not match userevents.
+// The names that start with the prefix are rejected, quoted or not, so
+// they do not name the quoted tables and columns. DisplayName restores the
+// quoted names for the clients.
+
+// quotedPrefix starts the names of the quoted identifiers with case.
+const quotedPrefix = "_quoted"
+
+// quoteIdentifiers rewrites the quoted identifiers outside of the
+// strings into the names the parser accepts and rejects the names
+// reserved for them.
+func quoteIdentifiers(query string) (string, error) {
+	if !strings.Contains(query, "`") && !strings.Contains(strings.ToLower(query), quotedPrefix) {
+		return query, nil
+	}
+
+	var rewritten strings.Builder
+	rewritten.Grow(len(query))
+
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '"':
+			inString = !inString
+		case c == '\\' && inString && i+1 < len(query):
+			rewritten.WriteByte(c)
+			rewritten.WriteByte(query[i+1])
+			i++
+
+			continue
+		case c == '`' && !inString:
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				return "", &SyntaxError{fmt.Sprintf("unterminated quoted identifier at %d", i), i}
+			}
+
+			name := query[i+1 : i+1+end]
+			if !entityNameRegExp.MatchString(name) {
+				return "", &SyntaxError{fmt.Sprintf("quoted identifier `%s` is not valid, expected format: %s", name, entityNameRegExp), i}
+			}
+			if reservedName(name) {
+				return "", &SyntaxError{fmt.Sprintf("name %s is reserved for the quoted identifiers", name), i}
+			}
+
+			rewritten.WriteString(quotedName(name))
+			i += end + 1
+
+			continue
+		case isIdentifierByte(c) && !inString:
+			end := i + 1
+			for end < len(query) && isIdentifierByte(query[end]) {
+				end++
+			}
+
+			word := query[i:end]
+			if reservedName(word) {
+				return "", &SyntaxError{fmt.Sprintf("name %s is reserved for the quoted identifiers", word), i}
+			}
+
+			rewritten.WriteString(word)
+			i = end - 1
+
+			continue
+		}
+
+		rewritten.WriteByte(c)
+	}
+
+	return rewritten.String(), nil
+}
+
+// reservedName reports whether the name of the table, qualified with
+// the schema or not, or of the column starts with the quotedPrefix.
+func reservedName(name string) bool {
+	name = strings.ToLower(name)
+	if separator := strings.Index(name, schemaSeparator); separator > 0 {
+		name = name[separator+len(schemaSeparator):]
+	}
+
+	return strings.HasPrefix(name, quotedPrefix)
+}
+
+// quotedText quotes the rewritten identifiers of the statement outside
+// of the strings again, so the statement can be parsed again.
+func quotedText(query string) string {
+	var rewritten strings.Builder
+	rewritten.Grow(len(query))
+
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '"':
+			inString = !inString
+		case c == '\\' && inString && i+1 < len(query):
+			rewritten.WriteByte(c)
+			rewritten.WriteByte(query[i+1])
+			i++
+
+			continue
+		case isIdentifierByte(c) && !inString:
+			end := i + 1
+			for end < len(query) && isIdentifierByte(query[end]) {
+				end++
+			}
+
+			if word := query[i:end]; reservedName(word) {
+				rewritten.WriteString(sqlName(word))
+			} else {
+				rewritten.WriteString(word)
+			}
+			i = end - 1
+
+			continue
+		}
+
+		rewritten.WriteByte(c)
+	}
+
+	return rewritten.String()
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// quotedName returns the name of the quoted identifier.
+func quotedName(name string) string {
+	if name == strings.ToLower(name) {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteString(quotedPrefix)
+	for _, r := range name {
+		switch {
+		case unicode.IsUpper(r):
+			b.WriteByte('_')
+			b.WriteRune(unicode.ToLower(r))
+		case r == '_':
+			b.WriteString("_0")
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// DisplayName returns the name of the table or the column as it
+// has been quoted, the other names are returned as they are.
+func DisplayName(name string) string {
+	// the qualified names of the tables of the schemas
+	if separator := strings.Index(name, schemaSeparator); separator > 0 {
+		return name[:separator+len(schemaSeparator)] + DisplayName(name[separator+len(schemaSeparator):])
+	}
+
+	if !strings.HasPrefix(name, quotedPrefix) {
+		return name
+	}
+
+	var b strings.Builder
+	escaped := false
+	for _, r := range name[len(quotedPrefix):] {
+		switch {
+		case !escaped && r == '_':
+			escaped = true
+			continue
+		case !escaped:
+			b.WriteRune(r)
+		case r == '0':
+			b.WriteByte('_')
+		case unicode.IsLower(r):
+			b.WriteRune(unicode.ToUpper(r))
+		default:
+			return name
+		}
+		escaped = false
+	}
+	if escaped {
+		return name
+	}
+
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestQuoteIdentifiers(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		reserved bool
+	}{
+		{"SELECT id FROM events", "SELECT id FROM events", false},
+		{"SELECT `UserID` FROM `UserEvents`", "SELECT _quoted_user_i_d FROM _quoted_user_events", false},
+		{"SELECT `id` FROM `events`", "SELECT id FROM events", false},
+		{`INSERT INTO t (s) VALUES ("_quoted_x and ` + "`X`" + `")`, `INSERT INTO t (s) VALUES ("_quoted_x and ` + "`X`" + `")`, false},
+		{"SELECT id FROM my_quoted_events", "SELECT id FROM my_quoted_events", false},
+		{"INSERT INTO _quoted_user_events (id) VALUES (1)", "", true},
+		{"CREATE TABLE _QUOTED_a (id INTEGER)", "", true},
+		{"SELECT _quoted_x FROM t", "", true},
+		{"SELECT id FROM s___quoted_x", "", true},
+		{"SELECT id FROM `_quoted_x`", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			actual, err := quoteIdentifiers(test.query)
+			if test.reserved {
+				if err == nil {
+					t.Fatalf("expected the reserved name to be rejected, got %s", actual)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestQuotedText(t *testing.T) {
+	query := "INSERT INTO s.`AuditLog` (`UserID`, note) VALUES (1, \"_quoted_x\")"
+	rewritten, err := quoteIdentifiers(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "INSERT INTO s.`AuditLog` (`UserID`, note) VALUES (1, \"_quoted_x\")"
+	if actual := quotedText(rewritten); actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+	if actual := quotedText("INSERT INTO s___quoted_audit_log (id) VALUES (1)"); actual != "INSERT INTO s.`AuditLog` (id) VALUES (1)" {
+		t.Errorf("expected the qualified name to be quoted, got %s", actual)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range []string{
+		"CREATE TABLE `UserEvents` (`UserID` INTEGER)",
+		"INSERT INTO `UserEvents` (`UserID`) VALUES (1)",
+		"ALTER TABLE `UserEvents` RENAME TO `AllEvents`",
+	} {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		if _, err := db.Execute(q); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+
+	for _, statement := range []string{
+		"INSERT INTO _quoted_all_events (_quoted_user_i_d) VALUES (2)",
+		"CREATE TABLE _quoted_a (id INTEGER)",
+		"ALTER TABLE `AllEvents` RENAME TO _quoted_b",
+	} {
+		if _, err := Parse(statement); err == nil {
+			t.Errorf("%s: expected the reserved name to be rejected", statement)
+		}
+	}
+}
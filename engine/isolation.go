@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// IsolationLevel defines what the transaction sees of the changes
+// made by the concurrent transactions.
+//
+// The transactions that fail with ErrSerialization or ErrDeadlock
+// can be retried from the start, the lock timeouts can be retried
+// statement by statement.
+type IsolationLevel string
+
+const (
+	// ReadCommitted transactions read the changes committed before
+	// every statement, the rows can change between the statements.
+	ReadCommitted IsolationLevel = "read committed"
+	// RepeatableRead transactions read the snapshot taken at the start
+	// and fail with ErrSerialization if they change the rows changed
+	// by others after the snapshot.
+	RepeatableRead IsolationLevel = "repeatable read"
+	// Serializable transactions lock the tables they read in the shared
+	// mode and the data files they change in the exclusive mode until
+	// they end, so the concurrent transactions either wait for each
+	// other or one of them fails with ErrDeadlock.
+	Serializable IsolationLevel = "serializable"
+)
+
+// ErrSerialization is returned when the repeatable read transaction
+// changes the rows changed by others after its snapshot.
+var ErrSerialization = errors.New("could not serialize access")
+
+// ParseIsolationLevel parses the isolation level name,
+// the words can be separated by spaces or underscores.
+func ParseIsolationLevel(s string) (IsolationLevel, error) {
+	level := IsolationLevel(strings.Join(strings.Fields(strings.ToLower(strings.ReplaceAll(s, "_", " "))), " "))
+	switch level {
+	case ReadCommitted, RepeatableRead, Serializable:
+		return level, nil
+	}
+
+	return "", fmt.Errorf("unknown isolation level %q, expected one of: %s, %s, %s", s, ReadCommitted, RepeatableRead, Serializable)
+}
+
+// SetTransaction represents SET TRANSACTION ISOLATION LEVEL statement.
+type SetTransaction struct {
+	Isolation IsolationLevel
+}
+
+// GetType returns the statement type.
+func (*SetTransaction) GetType() sql.StatementType { return StatementSetTransaction }
+
+// ShowIsolationLevel represents SHOW TRANSACTION ISOLATION LEVEL statement.
+type ShowIsolationLevel struct{}
+
+// GetType returns the statement type.
+func (*ShowIsolationLevel) GetType() sql.StatementType { return StatementShowIsolationLevel }
+
+// parseIsolationLevel parses ISOLATION LEVEL clause.
+func parseIsolationLevel(s *tokenStream) (IsolationLevel, error) {
+	err := s.expectKeyword("ISOLATION", "LEVEL")
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case s.acceptKeyword("READ", "COMMITTED"):
+		return ReadCommitted, nil
+	case s.acceptKeyword("REPEATABLE", "READ"):
+		return RepeatableRead, nil
+	case s.acceptKeyword("SERIALIZABLE"):
+		return Serializable, nil
+	}
+
+	return "", s.unexpected("READ COMMITTED, REPEATABLE READ or SERIALIZABLE")
+}
+
+// parseSetTransaction parses SET TRANSACTION ISOLATION LEVEL statement.
+func parseSetTransaction(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SET", "TRANSACTION")
+	level, err := parseIsolationLevel(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetTransaction{level}, s.expectEnd()
+}
+
+// parseShowIsolationLevel parses SHOW TRANSACTION ISOLATION LEVEL statement.
+func parseShowIsolationLevel(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SHOW", "TRANSACTION")
+	err := s.expectKeyword("ISOLATION", "LEVEL")
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShowIsolationLevel{}, s.expectEnd()
+}
+
+// SetIsolation changes the isolation level of the transaction,
+// it must be done before the first query of the transaction.
+func (tx *Transaction) SetIsolation(level IsolationLevel) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return err
+	}
+
+	if tx.queried {
+		return fmt.Errorf("isolation level must be set before the first query of transaction %s", tx.ID)
+	}
+
+	tx.db.setIsolation(tx, level)
+
+	return nil
+}
+
+// Isolation returns the isolation level of the transaction.
+func (tx *Transaction) Isolation() IsolationLevel {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	return tx.isolation
+}
+
+// setIsolation changes the isolation level, only the repeatable
+// read transactions keep the snapshot for their whole life.
+func (db *Database) setIsolation(tx *Transaction, level IsolationLevel) {
+	tx.isolation = level
+	if level == RepeatableRead && tx.snapshot == nil {
+		tx.snapshot = db.takeSnapshot(tx.record)
+	}
+
+	if level != RepeatableRead && tx.snapshot != nil {
+		db.releaseSnapshot(tx.snapshot)
+		tx.snapshot = nil
+	}
+}
+
+// statementSnapshot returns the snapshot the statement reads, the
+// snapshot must be released by the returned function.
+func (db *Database) statementSnapshot(tx *Transaction) (*snapshot, func()) {
+	if tx != nil && tx.snapshot != nil {
+		return tx.snapshot, func() {}
+	}
+
+	var own *txRecord
+	if tx != nil {
+		own = tx.record
+	}
+	s := db.takeSnapshot(own)
+
+	return s, func() { db.releaseSnapshot(s) }
+}
+
+// lockRead locks what the transaction reads according
+// to its isolation level.
+func (db *Database) lockRead(ctx context.Context, tx *Transaction, tableName string, names []string) error {
+	switch tx.isolation {
+	case Serializable:
+		// the table lock covers the rows inserted by others into
+		// any of its data files
+		return db.lock(ctx, tx.locker, tableResource(tableName), lockShared)
+	case RepeatableRead:
+		return db.lockMappedStorages(ctx, tx, tableName, names)
+	}
+
+	return nil
+}
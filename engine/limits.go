@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// LimitError is returned when a row, a value, a table or the database
+// exceeds the configured limit.
+type LimitError struct {
+	// Limit is the name of the exceeded limit.
+	Limit string
+	// Table is the table the row is written to.
+	Table string
+	// Column is the column of the value, empty for the other limits.
+	Column string
+	// Size is the actual size in bytes, the number of the rows
+	// for the table rows limit.
+	Size int
+	// Max is the maximum allowed size.
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	unit := "bytes"
+	if e.Limit == limitTableRows {
+		unit = "rows"
+	}
+
+	if e.Column != "" {
+		return fmt.Sprintf("%s limit exceeded for column %s of table %s: %d %s, max %d %s", e.Limit, e.Column, e.Table, e.Size, unit, e.Max, unit)
+	}
+
+	return fmt.Sprintf("%s limit exceeded for table %s: %d %s, max %d %s", e.Limit, e.Table, e.Size, unit, e.Max, unit)
+}
+
+const (
+	limitRowSize      = "row size"
+	limitValueSize    = "value size"
+	limitTableRows    = "table rows"
+	limitDatabaseSize = "database size"
+)
+
+// checkRowLimits verifies that the row and its values do not exceed
+// the configured limits. The row size is the size of the encoded row.
+func checkRowLimits(options Options, schema Schema, row []interface{}) error {
+	if options.MaxValueSize > 0 {
+		for _, column := range schema.Columns {
+			value, ok := row[column.Position].(string)
+			if !ok {
+				continue
+			}
+
+			if len(value) > options.MaxValueSize {
+				return &LimitError{limitValueSize, schema.Name, column.Name, len(value), options.MaxValueSize}
+			}
+		}
+	}
+
+	if options.MaxRowSize > 0 {
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			return fmt.Errorf("failed to encode row: %w", err)
+		}
+
+		if len(encoded) > options.MaxRowSize {
+			return &LimitError{limitRowSize, schema.Name, "", len(encoded), options.MaxRowSize}
+		}
+	}
+
+	return nil
+}
+
+// acceptedRows counts the rows and their size of the inserts accepted
+// within a group but not written yet, the statistics of the tables
+// are updated only when the whole group has been written.
+type acceptedRows struct {
+	rows map[string]int
+	size int64
+}
+
+func newAcceptedRows() *acceptedRows {
+	return &acceptedRows{rows: make(map[string]int)}
+}
+
+// add counts the rows of the accepted insert.
+func (a *acceptedRows) add(insert *pendingInsert) {
+	a.rows[insert.table.Name] += insert.rows
+	a.size += insert.size
+}
+
+// tableRows returns the number of the accepted rows of the table,
+// zero for the nil counter of the inserts outside of groups.
+func (a *acceptedRows) tableRows(table string) int {
+	if a == nil {
+		return 0
+	}
+
+	return a.rows[table]
+}
+
+// totalSize returns the size of the accepted rows.
+func (a *acceptedRows) totalSize() int64 {
+	if a == nil {
+		return 0
+	}
+
+	return a.size
+}
+
+// checkTableRows verifies that the inserted rows do not exceed the
+// maximum number of the rows of the table. It must be called with
+// the database locked.
+func (db *Database) checkTableRows(schema Schema, inserted int) error {
+	if db.options.MaxTableRows <= 0 {
+		return nil
+	}
+
+	if rows := schema.Stats.RowCount + inserted; rows > db.options.MaxTableRows {
+		return &LimitError{limitTableRows, schema.Name, "", rows, db.options.MaxTableRows}
+	}
+
+	return nil
+}
+
+// checkDatabaseSize verifies that the written rows do not grow the data
+// files of the database over the maximum size, the rows are estimated
+// by their encoded size. The pending size is of the rows accepted but
+// not written yet. The memory tables are not counted. It returns the
+// size of the rows and must be called with the database locked.
+func (db *Database) checkDatabaseSize(schema Schema, rows [][]interface{}, pending int64) (int64, error) {
+	if db.options.MaxDatabaseSize <= 0 || schema.InMemory || len(rows) == 0 {
+		return 0, nil
+	}
+
+	size := int64(0)
+	for _, row := range rows {
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode row: %w", err)
+		}
+		size += int64(len(encoded))
+	}
+
+	total := size + pending
+	for _, table := range db.tables {
+		total += table.Stats.SizeBytes
+	}
+
+	if total > db.options.MaxDatabaseSize {
+		return 0, &LimitError{limitDatabaseSize, schema.Name, "", int(total), int(db.options.MaxDatabaseSize)}
+	}
+
+	return size, nil
+}
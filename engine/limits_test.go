@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTableRowsLimitOfConcurrentInserts(t *testing.T) {
+	const maxRows, inserts = 15, 40
+
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{
+		Fsync:             FsyncAlways,
+		GroupCommitSize:   inserts,
+		GroupCommitWindow: 10 * time.Millisecond,
+		MaxTableRows:      maxRows,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q, err := Parse(`CREATE TABLE t (id INTEGER)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Execute(q); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, inserts)
+	var wg sync.WaitGroup
+	for i := 0; i < inserts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			q, err := Parse(`INSERT INTO t (id) VALUES (` + strconv.Itoa(i) + `)`)
+			if err == nil {
+				_, err = db.Execute(q)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	inserted := 0
+	for err := range errs {
+		var limitErr *LimitError
+		switch {
+		case err == nil:
+			inserted++
+		case !errors.As(err, &limitErr):
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	if inserted != maxRows {
+		t.Errorf("expected %d inserted rows, got %d", maxRows, inserted)
+	}
+
+	q, err = Parse(`SELECT id FROM t`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Execute(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := len(rows.([][]interface{})); stored != maxRows {
+		t.Errorf("expected %d stored rows, got %d", maxRows, stored)
+	}
+}
@@ -0,0 +1,260 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// loadBatchSize is the number of the loaded rows written at once,
+// every write rewrites the data file, so the batches are large.
+const loadBatchSize = 50000
+
+// LoadFormat is the format of the loaded stream.
+type LoadFormat string
+
+const (
+	// LoadNDJSON is the stream of the JSON objects by the column
+	// names or the JSON arrays of the column values, one per line.
+	LoadNDJSON LoadFormat = "ndjson"
+	// LoadCSV is the CSV stream.
+	LoadCSV LoadFormat = "csv"
+)
+
+// LoadOptions describe the loaded stream.
+type LoadOptions struct {
+	Format LoadFormat
+	// Columns are the columns of the CSV records and of the JSON
+	// arrays, all the table columns in the order of the row values
+	// if empty.
+	Columns []string
+	CSV     CSVOptions
+}
+
+// rowSource reads the rows of the loaded stream one by one,
+// io.EOF ends the rows.
+type rowSource interface {
+	// columns are the columns of the row values.
+	columns() []string
+	// position describes the last read row for the errors.
+	position() string
+	next() ([]interface{}, error)
+}
+
+// Load inserts the rows of the stream into the table. The rows are
+// validated and written in batches, every batch is committed with
+// a single write of the data files, so the batches loaded before
+// the failed one stay and their number is returned with the error.
+func (db *Database) Load(ctx context.Context, table string, r io.Reader, options LoadOptions) (int, error) {
+	if err := db.checkWritable(&sql.Insert{Table: table}); err != nil {
+		return 0, err
+	}
+
+	schema, err := db.Schema(table)
+	if err != nil {
+		return 0, err
+	}
+
+	var source rowSource
+	switch options.Format {
+	case LoadNDJSON:
+		source, err = newJSONSource(r, schema, options.Columns)
+	case LoadCSV:
+		source, err = newCSVSource(r, schema, options.Columns, options.CSV)
+	default:
+		err = fmt.Errorf("unsupported load format %q", options.Format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return loadBatches(source, func(rows [][]interface{}) (int, error) {
+		inserted, err := db.insertBatch(ctx, schema.Name, source.columns(), rows)
+		if err != nil {
+			return 0, err
+		}
+
+		return inserted, db.waitCommitted(ctx)
+	})
+}
+
+// insertBatch inserts the rows outside of a transaction.
+func (db *Database) insertBatch(ctx context.Context, table string, columns []string, rows [][]interface{}) (int, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.insertRows(ctx, table, columns, rows, nil)
+}
+
+// loadBatches reads the rows of the source and inserts them in
+// batches of up to loadBatchSize rows.
+func loadBatches(source rowSource, insert func(rows [][]interface{}) (int, error)) (int, error) {
+	loaded := 0
+	rows := make([][]interface{}, 0, loadBatchSize)
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+
+		inserted, err := insert(rows)
+		if err != nil {
+			return err
+		}
+		loaded += inserted
+		rows = rows[:0]
+
+		return nil
+	}
+
+	for {
+		row, err := source.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("%s: %w", source.position(), err)
+		}
+		rows = append(rows, row)
+
+		if len(rows) == loadBatchSize {
+			if err := flush(); err != nil {
+				return loaded, fmt.Errorf("%s: %w", source.position(), err)
+			}
+		}
+	}
+
+	return loaded, flush()
+}
+
+// jsonSource reads the rows of the NDJSON stream.
+type jsonSource struct {
+	scanner *bufio.Scanner
+	schema  Schema
+	names   []string
+	// indexes are the indexes of the values by the column names.
+	indexes map[string]int
+	line    int
+}
+
+// newJSONSource reads the NDJSON with the values of the columns,
+// all the table columns if the columns are not given.
+func newJSONSource(r io.Reader, schema Schema, columns []string) (*jsonSource, error) {
+	if len(columns) == 0 {
+		for _, column := range writableColumns(schema) {
+			columns = append(columns, column.Name)
+		}
+	}
+
+	indexes := make(map[string]int, len(columns))
+	for i, name := range columns {
+		name = strings.ToLower(name)
+		if _, exists := schema.Columns[name]; !exists {
+			return nil, newError(CodeUndefinedColumn, "column %s does not exist in table %s", name, schema.Name)
+		}
+		indexes[name] = i
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLineSize)
+
+	return &jsonSource{scanner: scanner, schema: schema, names: columns, indexes: indexes}, nil
+}
+
+func (s *jsonSource) columns() []string {
+	return s.names
+}
+
+func (s *jsonSource) position() string {
+	return fmt.Sprintf("line %d", s.line)
+}
+
+func (s *jsonSource) next() ([]interface{}, error) {
+	var line []byte
+	for len(line) == 0 {
+		if !s.scanner.Scan() {
+			if err := s.scanner.Err(); err != nil {
+				return nil, fmt.Errorf("failed to read NDJSON: %w", err)
+			}
+
+			return nil, io.EOF
+		}
+		s.line++
+		line = bytes.TrimSpace(s.scanner.Bytes())
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+
+	var values []interface{}
+	if line[0] == '[' {
+		if err := decoder.Decode(&values); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+
+		if len(values) != len(s.names) {
+			return nil, fmt.Errorf("expected %d values, but got %d", len(s.names), len(values))
+		}
+	} else {
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			return nil, fmt.Errorf("invalid JSON object: %w", err)
+		}
+
+		values = make([]interface{}, len(s.names))
+		for name, value := range object {
+			index, exists := s.indexes[strings.ToLower(name)]
+			if !exists {
+				return nil, fmt.Errorf("column %s is not loaded into table %s", name, s.schema.Name)
+			}
+			values[index] = value
+		}
+	}
+
+	row := make([]interface{}, len(values))
+	for i, value := range values {
+		name := strings.ToLower(s.names[i])
+		converted, err := jsonValue(s.schema.Columns[name].Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for column %s: %w", name, err)
+		}
+		row[i] = converted
+	}
+
+	return row, nil
+}
+
+// jsonValue converts the decoded JSON value to the value of the column type.
+func jsonValue(columnType sql.ColumnType, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("value is not provided")
+	case json.Number:
+		if columnType != sql.TypeInteger {
+			return nil, fmt.Errorf("expected string, but got number %s", v)
+		}
+
+		n, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("expected integer, but got %s", v)
+		}
+
+		return int(n), nil
+	case string:
+		if columnType != sql.TypeString {
+			return nil, fmt.Errorf("expected integer, but got string %q", v)
+		}
+
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v", v)
+	}
+}
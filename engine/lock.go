@@ -0,0 +1,403 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// lockMode is the mode of the table or storage lock. The intention
+// modes are taken on the table before the storages of the table
+// are locked in the shared or exclusive mode.
+type lockMode int
+
+const (
+	lockIntentionShared lockMode = iota
+	lockIntentionExclusive
+	lockShared
+	lockExclusive
+)
+
+func (m lockMode) String() string {
+	return [...]string{"IS", "IX", "S", "X"}[m]
+}
+
+// lockCompatible tells whether the locks in the modes can be held
+// by different lockers at the same time.
+var lockCompatible = [4][4]bool{
+	lockIntentionShared:    {true, true, true, false},
+	lockIntentionExclusive: {true, true, false, false},
+	lockShared:             {true, false, true, false},
+	lockExclusive:          {false, false, false, false},
+}
+
+// combineLockModes returns the weakest mode that covers both modes.
+func combineLockModes(a lockMode, b lockMode) lockMode {
+	switch {
+	case a == b:
+		return a
+	case a == lockIntentionShared:
+		return b
+	case b == lockIntentionShared:
+		return a
+	}
+
+	// IX and S together are as strong as X
+	return lockExclusive
+}
+
+// ErrDeadlock is returned to the locker chosen to break a deadlock.
+var ErrDeadlock = errors.New("deadlock detected")
+
+// LockTimeoutError is returned when the lock has not been
+// granted within the lock timeout.
+type LockTimeoutError struct {
+	resource string
+	mode     lockMode
+	holders  []string
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for %s lock on %s held by %s", e.mode, e.resource, strings.Join(e.holders, ", "))
+}
+
+// locker holds the locks of a transaction or, outside of
+// transactions, of a single statement.
+type locker struct {
+	// name is the transaction ID or "statement"
+	name string
+	// tx is nil for the statements outside of transactions
+	tx   *Transaction
+	held map[string]lockMode
+	// waiting is the request the locker is blocked on
+	waiting *lockRequest
+}
+
+type lockRequest struct {
+	locker   *locker
+	resource string
+	mode     lockMode
+	// granted is closed when the lock is granted or
+	// the request is canceled
+	granted  chan struct{}
+	done     bool
+	canceled bool
+}
+
+type lockResource struct {
+	holders map[*locker]lockMode
+	// queue of the requests waiting in the arrival order
+	queue []*lockRequest
+}
+
+// lockManager grants the table and storage locks, all the methods
+// must be called with the database lock held.
+type lockManager struct {
+	resources map[string]*lockResource
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{resources: make(map[string]*lockResource)}
+}
+
+func tableResource(tableName string) string {
+	return "table " + tableName
+}
+
+func storageResource(name string) string {
+	return "storage " + name
+}
+
+func newLocker(tx *Transaction) *locker {
+	name := "statement"
+	if tx != nil {
+		name = tx.ID
+	}
+
+	return &locker{name: name, tx: tx, held: make(map[string]lockMode)}
+}
+
+// statementLocker returns the locker of the transaction or, without
+// the transaction, a new one whose locks are released by the returned
+// function at the end of the statement.
+func (db *Database) statementLocker(tx *Transaction) (*locker, func()) {
+	if tx != nil {
+		return tx.locker, func() {}
+	}
+
+	l := newLocker(nil)
+
+	return l, func() { db.unlockAll(l) }
+}
+
+// grantable reports whether the locker can get the lock
+// without waiting for the other holders.
+func (r *lockResource) grantable(l *locker, mode lockMode) bool {
+	for holder, held := range r.holders {
+		if holder != l && !lockCompatible[held][mode] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lock acquires the lock on the resource. While the lock is waited for
+// the database lock is released, so the database state must be re-read
+// after the call. The lock is waited for at most the lock timeout, and
+// if waiting would close a cycle of lockers waiting for each other, the
+// locker is the deadlock victim: its transaction is rolled back. The
+// waiting stops when the context is done.
+func (db *Database) lock(ctx context.Context, l *locker, resource string, mode lockMode) error {
+	held, holds := l.held[resource]
+	if holds {
+		if combineLockModes(held, mode) == held {
+			return nil
+		}
+		mode = combineLockModes(held, mode)
+	}
+
+	err := db.rollbackExpiredHolders(resource, l)
+	if err != nil {
+		return err
+	}
+
+	r, exists := db.locks.resources[resource]
+	if !exists {
+		r = &lockResource{holders: make(map[*locker]lockMode)}
+		db.locks.resources[resource] = r
+	}
+
+	// the upgrades do not wait for the queue
+	if (len(r.queue) == 0 || holds) && r.grantable(l, mode) {
+		r.holders[l] = mode
+		l.held[resource] = mode
+
+		return nil
+	}
+
+	request := &lockRequest{locker: l, resource: resource, mode: mode, granted: make(chan struct{})}
+	r.queue = append(r.queue, request)
+	l.waiting = request
+
+	if db.waitsFor(l, l, make(map[*locker]bool)) {
+		db.cancelRequest(request)
+		logging.Warnf("deadlock detected, %s is waiting for %s lock on %s", l.name, mode, resource)
+		if l.tx != nil {
+			if err := db.rollback(l.tx); err != nil {
+				return fmt.Errorf("%w, failed to roll back transaction %s: %s", ErrDeadlock, l.tx.ID, err)
+			}
+
+			return fmt.Errorf("%w, transaction %s has been rolled back", ErrDeadlock, l.tx.ID)
+		}
+
+		return ErrDeadlock
+	}
+
+	var timeout <-chan time.Time
+	if db.options.LockTimeout > 0 {
+		timer := time.NewTimer(db.options.LockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	db.mu.Unlock()
+	select {
+	case <-request.granted:
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	db.mu.Lock()
+
+	if request.canceled || request.done && l.tx != nil && l.tx.done {
+		return fmt.Errorf("transaction %s has ended while waiting for %s", l.name, resource)
+	}
+
+	if request.done {
+		return nil
+	}
+
+	if err := contextError(ctx); err != nil {
+		db.cancelRequest(request)
+
+		return err
+	}
+
+	holders := make([]string, 0, len(r.holders))
+	for holder := range r.holders {
+		holders = append(holders, holder.name)
+	}
+	sort.Strings(holders)
+	db.cancelRequest(request)
+
+	return &LockTimeoutError{resource, mode, holders}
+}
+
+// rollbackExpiredHolders rolls back the expired transactions that hold
+// the resource, so they do not block other lockers until they are used.
+func (db *Database) rollbackExpiredHolders(resource string, l *locker) error {
+	r, exists := db.locks.resources[resource]
+	if !exists {
+		return nil
+	}
+
+	for holder := range r.holders {
+		if holder == l || holder.tx == nil || !db.expired(holder.tx) {
+			continue
+		}
+
+		logging.Warnf("rolling back expired transaction %s", holder.tx.ID)
+		if err := db.rollback(holder.tx); err != nil {
+			return fmt.Errorf("failed to roll back expired transaction %s: %w", holder.tx.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// waitsFor reports whether the locker waits, directly or through other
+// lockers, for the target locker.
+func (db *Database) waitsFor(l *locker, target *locker, visited map[*locker]bool) bool {
+	if l.waiting == nil || visited[l] {
+		return false
+	}
+	visited[l] = true
+
+	r := db.locks.resources[l.waiting.resource]
+	blockers := make([]*locker, 0)
+	for holder, held := range r.holders {
+		if holder != l && !lockCompatible[held][l.waiting.mode] {
+			blockers = append(blockers, holder)
+		}
+	}
+	// the requests ahead in the queue are granted first
+	for _, request := range r.queue {
+		if request == l.waiting {
+			break
+		}
+		blockers = append(blockers, request.locker)
+	}
+
+	for _, blocker := range blockers {
+		if blocker == target || db.waitsFor(blocker, target, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cancelRequest removes the request that has not been granted.
+func (db *Database) cancelRequest(request *lockRequest) {
+	request.locker.waiting = nil
+	r := db.locks.resources[request.resource]
+	for i, queued := range r.queue {
+		if queued == request {
+			r.queue = append(r.queue[:i:i], r.queue[i+1:]...)
+			break
+		}
+	}
+
+	db.grantWaiting(request.resource)
+}
+
+// unlockAll releases all the locks of the locker and
+// cancels the request it is waiting for.
+func (db *Database) unlockAll(l *locker) {
+	if request := l.waiting; request != nil {
+		db.cancelRequest(request)
+		request.canceled = true
+		close(request.granted)
+	}
+
+	for resource := range l.held {
+		delete(db.locks.resources[resource].holders, l)
+		delete(l.held, resource)
+		db.grantWaiting(resource)
+	}
+}
+
+// grantWaiting grants the queued requests in the arrival order
+// until the first one that has to wait.
+func (db *Database) grantWaiting(resource string) {
+	r := db.locks.resources[resource]
+	for len(r.queue) > 0 {
+		request := r.queue[0]
+		if !r.grantable(request.locker, request.mode) {
+			break
+		}
+
+		r.queue = r.queue[1:]
+		r.holders[request.locker] = request.mode
+		request.locker.held[resource] = request.mode
+		request.locker.waiting = nil
+		request.done = true
+		close(request.granted)
+	}
+
+	if len(r.holders) == 0 && len(r.queue) == 0 {
+		delete(db.locks.resources, resource)
+	}
+}
+
+// lockStorages locks the storages in the name order, so the lockers
+// locking the same storages do not deadlock.
+func (db *Database) lockStorages(ctx context.Context, l *locker, names []string, mode lockMode) error {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if err := db.lock(ctx, l, storageResource(name), mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storageWriter returns the transaction that holds the exclusive
+// lock on the storage, nil if there is none.
+func (db *Database) storageWriter(name string) *Transaction {
+	r, exists := db.locks.resources[storageResource(name)]
+	if !exists {
+		return nil
+	}
+
+	for holder, mode := range r.holders {
+		if mode == lockExclusive {
+			return holder.tx
+		}
+	}
+
+	return nil
+}
+
+// lockRows describes the held and waited for locks.
+func (db *Database) lockRows() [][]interface{} {
+	resources := make([]string, 0, len(db.locks.resources))
+	for resource := range db.locks.resources {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	rows := make([][]interface{}, 0)
+	for _, resource := range resources {
+		r := db.locks.resources[resource]
+		holders := make([][]interface{}, 0, len(r.holders))
+		for holder, mode := range r.holders {
+			holders = append(holders, []interface{}{resource, mode.String(), holder.name, "granted"})
+		}
+		sort.Slice(holders, func(i, j int) bool { return holders[i][2].(string) < holders[j][2].(string) })
+		rows = append(rows, holders...)
+
+		for _, request := range r.queue {
+			rows = append(rows, []interface{}{resource, request.mode.String(), request.locker.name, "waiting"})
+		}
+	}
+
+	return rows
+}
@@ -0,0 +1,324 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The values of the masked columns are redacted in the results of the
+// queries of the users that have no UNMASK privilege on the table, the
+// superusers and the admin tokens see them as they are. The conditions
+// are evaluated on the real values, so the masking keeps the values
+// out of the results of the ad-hoc queries, it does not hide them from
+// the users that search by them on purpose. The embedded callers that
+// have not started the query with StartQuery see the real values.
+
+// maskFill replaces the redacted part of the masked strings.
+const maskFill = "****"
+
+// maxMaskKeep is the most characters a partial mask keeps, the
+// integers of more than 18 digits do not fit into the modulo.
+const maxMaskKeep = 18
+
+// ColumnMask redacts the values of the column.
+type ColumnMask struct {
+	// Keep is the number of the last characters of the strings and
+	// the last digits of the integers that are not redacted,
+	// 0 redacts the whole value.
+	Keep int `json:"keep"`
+}
+
+// String renders the mask as in ALTER TABLE ... SET MASK.
+func (m *ColumnMask) String() string {
+	if m.Keep == 0 {
+		return "FULL"
+	}
+
+	return fmt.Sprintf("PARTIAL(%d)", m.Keep)
+}
+
+// apply returns the redacted value. The strings are replaced with
+// maskFill followed by the kept characters, so the length of the
+// value is not revealed, and the integers keep only the last digits.
+func (m *ColumnMask) apply(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if m.Keep == 0 || utf8.RuneCountInString(v) <= m.Keep {
+			return maskFill
+		}
+
+		runes := []rune(v)
+		return maskFill + string(runes[len(runes)-m.Keep:])
+	case int:
+		if m.Keep == 0 {
+			return 0
+		}
+
+		modulo := 1
+		for i := 0; i < m.Keep; i++ {
+			modulo *= 10
+		}
+		if v < 0 {
+			v = -v
+		}
+
+		return v % modulo
+	}
+
+	return value
+}
+
+// AlterColumnMask represents ALTER TABLE name ALTER [COLUMN] column
+// {SET MASK {FULL | PARTIAL(n)} | DROP MASK} statement.
+//
+//	ALTER TABLE customers ALTER COLUMN card SET MASK PARTIAL(4)
+//	ALTER TABLE customers ALTER COLUMN email DROP MASK
+type AlterColumnMask struct {
+	Table  string
+	Column string
+	// Mask is nil for DROP MASK.
+	Mask *ColumnMask
+}
+
+// GetType returns the statement type.
+func (*AlterColumnMask) GetType() sql.StatementType { return StatementAlterColumnMask }
+
+// parseAlterColumnMask parses the rest of ALTER TABLE ... ALTER COLUMN
+// statement after the table name.
+func parseAlterColumnMask(s *tokenStream, table string) (sql.Statement, error) {
+	s.mustKeyword("ALTER")
+	s.acceptKeyword("COLUMN")
+
+	column, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.acceptKeyword("DROP", "MASK") {
+		return &AlterColumnMask{table, column, nil}, s.expectEnd()
+	}
+
+	if err := s.expectKeyword("SET", "MASK"); err != nil {
+		return nil, err
+	}
+
+	mask := &ColumnMask{}
+	switch {
+	case s.acceptKeyword("FULL"):
+	case s.acceptKeyword("PARTIAL"):
+		if err := s.expectSymbol("("); err != nil {
+			return nil, err
+		}
+
+		t := s.peek()
+		mask.Keep, err = s.expectInteger()
+		if err != nil {
+			return nil, err
+		}
+		if mask.Keep < 1 || mask.Keep > maxMaskKeep {
+			return nil, &SyntaxError{fmt.Sprintf("partial mask keeps from 1 to %d characters, got %d", maxMaskKeep, mask.Keep), t.pos}
+		}
+
+		if err := s.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, s.unexpected("FULL or PARTIAL")
+	}
+
+	return &AlterColumnMask{table, column, mask}, s.expectEnd()
+}
+
+// AlterColumnMask sets or drops the mask of the column.
+func (db *Database) AlterColumnMask(query *AlterColumnMask) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(context.Background(), l, tableResource(tableName), lockExclusive); err != nil {
+		return err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	columnName := strings.ToLower(query.Column)
+	column, exists := schema.Columns[columnName]
+	if !exists {
+		return newError(CodeUndefinedColumn, "column %s does not exist in table %s", columnName, tableName)
+	}
+
+	// the schemas are shared with the open views
+	columns := make(map[string]ColumnDef, len(schema.Columns))
+	for name, def := range schema.Columns {
+		columns[name] = def
+	}
+	column.Mask = query.Mask
+	columns[columnName] = column
+
+	previous := schema
+	schema.Columns = columns
+	db.replaceSchema(schema)
+
+	if err := db.storeTables(); err != nil {
+		db.tables[tableName] = previous
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	return nil
+}
+
+// unmasks reports whether the user or the token principal sees the
+// values of the masked columns of the table.
+func (db *Database) unmasks(userName string, table string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.authenticationRequired() {
+		return true
+	}
+
+	if strings.HasPrefix(userName, tokenPrincipalPrefix) {
+		t, exists := db.tokens[strings.TrimPrefix(userName, tokenPrincipalPrefix)]
+
+		return exists && !t.expired() && t.Role == RoleAdmin
+	}
+
+	u, exists := db.users[strings.ToLower(userName)]
+
+	return exists && (u.Superuser || u.hasPrivilege(PrivilegeUnmask, table))
+}
+
+// columnMasks returns the masks of the table columns by positions for
+// the user, nil if the user sees the real values. It must be called
+// without the database lock.
+func (db *Database) columnMasks(userName string, table string) []*ColumnMask {
+	authority := db
+	if db.authority != nil {
+		authority = db.authority
+	}
+	if authority.unmasks(userName, table) {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema, exists := db.tables[strings.ToLower(table)]
+	if !exists {
+		return nil
+	}
+
+	var masks []*ColumnMask
+	for _, column := range schema.Columns {
+		if column.Mask == nil {
+			continue
+		}
+
+		if masks == nil {
+			masks = make([]*ColumnMask, len(schema.Columns))
+		}
+		masks[column.Position] = column.Mask
+	}
+
+	return masks
+}
+
+// queryMasks returns the masks of the table columns for the user of
+// the query started with the context, nil if the values are not masked.
+func (db *Database) queryMasks(ctx context.Context, table string) []*ColumnMask {
+	running, ok := ctx.Value(runningQueryKey{}).(*runningQuery)
+	if !ok {
+		return nil
+	}
+
+	return db.columnMasks(running.user, table)
+}
+
+// maskRow returns the copy of the row with the masked values redacted,
+// the row itself is shared with the table and the result cache.
+func maskRow(masks []*ColumnMask, row []interface{}) []interface{} {
+	if masks == nil {
+		return row
+	}
+
+	masked := make([]interface{}, len(row))
+	copy(masked, row)
+	for position, mask := range masks {
+		if mask != nil && position < len(masked) {
+			masked[position] = mask.apply(masked[position])
+		}
+	}
+
+	return masked
+}
+
+// maskRows redacts the masked values of the rows.
+func maskRows(masks []*ColumnMask, rows [][]interface{}) [][]interface{} {
+	if masks == nil {
+		return rows
+	}
+
+	masked := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		masked[i] = maskRow(masks, row)
+	}
+
+	return masked
+}
+
+// maskEach passes the rows with the masked values redacted to f.
+func maskEach(masks []*ColumnMask, f func(row []interface{}) error) func(row []interface{}) error {
+	if masks == nil {
+		return f
+	}
+
+	return func(row []interface{}) error {
+		return f(maskRow(masks, row))
+	}
+}
+
+// MaskChange redacts the values of the masked columns in the change
+// of the table for the user.
+func (db *Database) MaskChange(userName string, change Change) Change {
+	masks := db.columnMasks(userName, change.Table)
+	if masks == nil {
+		return change
+	}
+
+	db.mu.Lock()
+	schema, exists := db.tables[change.Table]
+	db.mu.Unlock()
+	if !exists {
+		return change
+	}
+
+	maskValues := func(values map[string]interface{}) map[string]interface{} {
+		if values == nil {
+			return nil
+		}
+
+		masked := make(map[string]interface{}, len(values))
+		for name, value := range values {
+			if column, exists := schema.Columns[name]; exists && column.Mask != nil {
+				value = column.Mask.apply(value)
+			}
+			masked[name] = value
+		}
+
+		return masked
+	}
+	change.Old = maskValues(change.Old)
+	change.New = maskValues(change.New)
+
+	return change
+}
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The memory tables keep their rows only in memory: they have no data
+// files, are not in the meta file and are gone when the database is
+// closed, so they are neither archived, replicated, backed up nor
+// dumped. Within transactions their rows are journaled in memory only.
+// The temporary tables are the memory tables owned by the session that
+// has created them, they are dropped when the session is closed. They
+// are in the schema of the session, pg_temp_N, visible only within the
+// session, where their unqualified names are resolved before the ones
+// of the other tables. The other memory tables share the names with
+// the persisted tables.
+
+// temporarySchemaPrefix starts the names of the schemas
+// of the temporary tables of the sessions.
+const temporarySchemaPrefix = "pg_temp_"
+
+// CreateMemoryTable represents CREATE MEMORY TABLE and CREATE TEMPORARY
+// TABLE statements with the optional WITH ROW VERSION clause.
+type CreateMemoryTable struct {
+	*sql.CreateTable
+	RowVersion bool
+	// Temporary is true for the tables dropped with the session.
+	Temporary bool
+	Generated []GeneratedColumn
+}
+
+// GetType returns the statement type.
+func (*CreateMemoryTable) GetType() sql.StatementType { return StatementCreateMemoryTable }
+
+// parseCreateMemoryTable parses CREATE MEMORY TABLE and CREATE TEMPORARY
+// TABLE as CREATE TABLE without the MEMORY or TEMPORARY keyword.
+func parseCreateMemoryTable(query string, s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("CREATE")
+	keyword := s.next()
+	temporary := strings.EqualFold(keyword.value, "TEMPORARY")
+
+	query = query[:keyword.pos] + query[keyword.pos+len(keyword.value):]
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+
+	statement, err := parseCreateTable(query, &tokenStream{tokens: tokens})
+	if err != nil {
+		return nil, err
+	}
+
+	switch create := statement.(type) {
+	case *sql.CreateTable:
+		return &CreateMemoryTable{create, false, temporary, nil}, nil
+	case *CreatePartitionedTable:
+		if create.Partitioning == nil {
+			return &CreateMemoryTable{create.CreateTable, false, temporary, create.Generated}, nil
+		}
+	case *CreateVersionedTable:
+		if create.Partitioning == nil {
+			return &CreateMemoryTable{create.CreateTable, true, temporary, create.Generated}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s tables can not be partitioned", strings.ToLower(keyword.value))
+}
+
+// CreateMemoryTable creates the table that is never persisted,
+// the temporary tables can be created only in the sessions.
+func (db *Database) CreateMemoryTable(query *CreateMemoryTable) error {
+	if query.Temporary {
+		return ErrNoSession
+	}
+
+	return db.createTable(query.CreateTable, Schema{RowVersion: query.RowVersion, InMemory: true, Columns: generatedColumns(query.Generated)})
+}
+
+// CreateTemporaryTable creates the memory table dropped when
+// the session is closed in the schema of the session.
+func (s *Session) CreateTemporaryTable(query *CreateMemoryTable) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("session %s is closed", s.ID)
+	}
+
+	create := *query.CreateTable
+	create.Name = strings.ToLower(create.Name)
+	if schema := tableSchema(create.Name); schema == "" {
+		create.Name = qualifiedTableName(s.temporarySchema, create.Name)
+	} else if schema != s.temporarySchema {
+		return fmt.Errorf("temporary tables can not be created in schema %s", schema)
+	}
+
+	return s.db.createTable(&create, Schema{RowVersion: query.RowVersion, InMemory: true, Session: s.ID, Columns: generatedColumns(query.Generated)})
+}
+
+// checkSessionTables checks that the temporary tables the statement
+// refers to belong to the session, the session is empty for the
+// statements executed without one.
+func (db *Database) checkSessionTables(sessionID string, q sql.Statement) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var err error
+	withTableNames(q, func(name string, create bool) string {
+		tableName := strings.ToLower(name)
+		if schema, exists := db.tables[tableName]; exists && schema.Session != "" && schema.Session != sessionID && err == nil {
+			err = newError(CodeUndefinedTable, "table %s does not exist", tableName)
+		}
+
+		return name
+	})
+
+	return err
+}
+
+// DropTable removes the table with all its rows, only the memory
+// tables can be dropped.
+func (db *Database) DropTable(query *sql.DropTable) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tableName := strings.ToLower(query.Table)
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	if !schema.InMemory {
+		return fmt.Errorf("table %s is persisted, only memory tables can be dropped", tableName)
+	}
+
+	return db.dropMemoryTable(context.Background(), tableName)
+}
+
+// dropMemoryTable removes the memory table when the statements and
+// the transactions using it have finished.
+func (db *Database) dropMemoryTable(ctx context.Context, tableName string) error {
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	if err := db.lock(ctx, l, tableResource(tableName), lockExclusive); err != nil {
+		return err
+	}
+
+	// the table may have been dropped while the lock was waited for
+	if _, exists := db.tables[tableName]; !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	delete(db.tables, tableName)
+	delete(db.data, tableName)
+	db.schemaChanged()
+
+	return db.accountTables()
+}
+
+// dropSessionTables drops the temporary tables of the session.
+func (db *Database) dropSessionTables(sessionID string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	names := make([]string, 0)
+	for name, schema := range db.tables {
+		if schema.Session == sessionID {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		if err := db.dropMemoryTable(context.Background(), name); err != nil {
+			logging.Errorf("failed to drop temporary table %s of session %s: %s", name, sessionID, err)
+		}
+	}
+}
+
+// inMemory reports whether the storage belongs to a memory table,
+// the memory tables are not partitioned, so their storages are
+// named after them.
+func (db *Database) inMemory(name string) bool {
+	return db.tables[name].InMemory
+}
+
+// persistedTableNames returns the sorted names of the tables
+// that are not in memory.
+func (db *Database) persistedTableNames() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	names := make([]string, 0, len(db.tables))
+	for name, schema := range db.tables {
+		if !schema.InMemory {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// persistedTables returns the tables stored in the meta file.
+func persistedTables(tables map[string]Schema) map[string]Schema {
+	persisted := make(map[string]Schema, len(tables))
+	for name, schema := range tables {
+		if !schema.InMemory {
+			persisted[name] = schema
+		}
+	}
+
+	return persisted
+}
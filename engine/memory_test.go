@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTemporaryTablesOfSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	owner, err := db.OpenSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.OpenSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// execute authorizes and executes the statement within the
+	// session, without a session if it is nil
+	execute := func(s *Session, statement string) (interface{}, error) {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		if s == nil {
+			if err := db.Authorize("", q); err != nil {
+				return nil, err
+			}
+
+			return db.Execute(q)
+		}
+
+		q = s.Resolve(q)
+		if err := s.Authorize("", q); err != nil {
+			return nil, err
+		}
+
+		return s.Execute(nil, q)
+	}
+
+	for _, step := range []struct {
+		session   *Session
+		statement string
+	}{
+		{nil, `CREATE TABLE t (id INTEGER)`},
+		{nil, `INSERT INTO t (id) VALUES (1)`},
+		{owner, `CREATE TEMPORARY TABLE t (id INTEGER)`},
+		{owner, `INSERT INTO t (id) VALUES (2)`},
+		// the names of the temporary tables of the sessions do not clash
+		{other, `CREATE TEMPORARY TABLE t (id INTEGER)`},
+	} {
+		if _, err := execute(step.session, step.statement); err != nil {
+			t.Fatalf("%s: %s", step.statement, err)
+		}
+	}
+
+	for _, test := range []struct {
+		session  *Session
+		expected [][]interface{}
+	}{
+		{owner, [][]interface{}{{2}}},
+		{other, [][]interface{}{}},
+		{nil, [][]interface{}{{1}}},
+	} {
+		rows, err := execute(test.session, `SELECT id FROM t`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows, test.expected) {
+			t.Errorf("expected %v, got %v", test.expected, rows)
+		}
+	}
+
+	qualified := owner.temporarySchema + ".t"
+	for _, s := range []*Session{other, nil} {
+		for _, statement := range []string{
+			`SELECT id FROM ` + qualified,
+			`DELETE FROM ` + qualified,
+			`CREATE TABLE ` + qualified + `2 (id INTEGER)`,
+		} {
+			if _, err := execute(s, statement); err == nil {
+				t.Errorf("%s: expected the temporary table of another session to be rejected", statement)
+			}
+		}
+	}
+
+	tableName := qualifiedTableName(owner.temporarySchema, "t")
+	if _, err := db.Schema(tableName); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CloseSession(owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Schema(tableName); err == nil {
+		t.Errorf("expected %s to be dropped with the session", qualified)
+	}
+}
@@ -0,0 +1,325 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The schema migrations are the SQL files of a directory applied in
+// the order of their versions. The files are named <version>_<name>.sql,
+// the version is a positive integer, and contain the statements ended
+// by semicolons, the lines starting with -- are comments. The applied
+// versions are recorded in the migrationsTable with the checksums of
+// the files, so every migration is applied once and the files changed
+// after they have been applied are detected.
+//
+// The migration of the statements supported in transactions is applied
+// in a single transaction together with its record. The schema changes
+// can not be rolled back, so the migration with them is applied
+// statement by statement and is recorded after the last one, the
+// failed migration leaves the previous statements applied.
+
+// migrationsTable records the applied migrations.
+const migrationsTable = "gosqldb_migrations"
+
+// migrationFileRegExp matches the names of the migration files.
+var migrationFileRegExp = regexp.MustCompile(`^([0-9]+)_([A-Za-z0-9_-]+)\.sql$`)
+
+// Migration is the schema migration file and its state.
+type Migration struct {
+	Version  int    `json:"version"`
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+	// AppliedAt is nil for the pending migrations.
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	// Changed is true if the file has been changed
+	// after the migration has been applied.
+	Changed bool `json:"changed,omitempty"`
+	// Missing is true if the file of the applied migration
+	// has been removed.
+	Missing bool `json:"missing,omitempty"`
+
+	statements []string
+}
+
+// LoadMigrations reads the migration files of the directory
+// ordered by their versions, the other files are ignored.
+func LoadMigrations(dir string) ([]*Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	migrations := make([]*Migration, 0)
+	versions := make(map[int]string)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".sql" {
+			continue
+		}
+
+		match := migrationFileRegExp.FindStringSubmatch(file.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s is not named <version>_<name>.sql", file.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration file %s has invalid version %s", file.Name(), match[1])
+		}
+		if other, exists := versions[version]; exists {
+			return nil, fmt.Errorf("migration files %s and %s have the same version", other, file.Name())
+		}
+		versions[version] = file.Name()
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration file %s: %w", file.Name(), err)
+		}
+
+		checksum := sha256.Sum256(data)
+		migrations = append(migrations, &Migration{
+			Version:    version,
+			Name:       match[2],
+			Checksum:   hex.EncodeToString(checksum[:]),
+			statements: migrationStatements(string(data)),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// migrationStatements returns the statements of the migration file
+// without the comment lines, the last statement can miss the semicolon.
+func migrationStatements(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), dumpCommentPrefix) {
+			lines[i] = ""
+		}
+	}
+
+	statements, rest := SplitStatements(strings.Join(lines, "\n"))
+	if rest = strings.TrimSpace(rest); rest != "" {
+		statements = append(statements, rest)
+	}
+
+	return statements
+}
+
+// Migrations returns the migrations of the directory with their state,
+// the applied migrations without the files are included.
+func (db *Database) Migrations(ctx context.Context, dir string) ([]*Migration, error) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		if record, exists := applied[m.Version]; exists {
+			m.AppliedAt = record.AppliedAt
+			m.Changed = record.Checksum != m.Checksum
+			delete(applied, m.Version)
+		}
+	}
+
+	for _, record := range applied {
+		record.Missing = true
+		migrations = append(migrations, record)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// appliedMigrations returns the recorded migrations by versions.
+func (db *Database) appliedMigrations(ctx context.Context) (map[int]*Migration, error) {
+	applied := make(map[int]*Migration)
+
+	db.mu.Lock()
+	_, exists := db.tables[migrationsTable]
+	db.mu.Unlock()
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := db.SelectContext(ctx, &sql.Select{Table: migrationsTable})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	for _, row := range rows {
+		version, _ := row[0].(int)
+		name, _ := row[1].(string)
+		checksum, _ := row[2].(string)
+		appliedAt, err := time.Parse(time.RFC3339, fmt.Sprint(row[3]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time of applied migration %d: %w", version, err)
+		}
+
+		applied[version] = &Migration{Version: version, Name: name, Checksum: checksum, AppliedAt: &appliedAt}
+	}
+
+	return applied, nil
+}
+
+// Migrate applies the pending migrations of the directory in the order
+// of their versions and returns the applied ones. The migrations are
+// not applied if an applied one has been changed.
+func (db *Database) Migrate(ctx context.Context, dir string) ([]*Migration, error) {
+	db.migrations.Lock()
+	defer db.migrations.Unlock()
+
+	migrations, err := db.Migrations(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]*Migration, 0)
+	for _, m := range migrations {
+		if m.Changed {
+			return nil, fmt.Errorf("migration %d_%s has been changed after it was applied", m.Version, m.Name)
+		}
+		if m.AppliedAt == nil {
+			pending = append(pending, m)
+		}
+	}
+
+	if len(pending) == 0 {
+		return pending, nil
+	}
+
+	if err := db.createMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	applied := make([]*Migration, 0, len(pending))
+	for _, m := range pending {
+		if err := db.applyMigration(ctx, m); err != nil {
+			return applied, fmt.Errorf("failed to apply migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+// createMigrationsTable creates the migrationsTable if it does not exist.
+func (db *Database) createMigrationsTable(ctx context.Context) error {
+	db.mu.Lock()
+	_, exists := db.tables[migrationsTable]
+	db.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	_, err := db.ExecuteContext(ctx, &sql.CreateTable{Name: migrationsTable, Columns: []sql.ColumnDefinition{
+		{Name: "version", Type: sql.TypeInteger},
+		{Name: "name", Type: sql.TypeString},
+		{Name: "checksum", Type: sql.TypeString},
+		{Name: "applied_at", Type: sql.TypeString},
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", migrationsTable, err)
+	}
+
+	return nil
+}
+
+// applyMigration executes the statements of the migration
+// and records it.
+func (db *Database) applyMigration(ctx context.Context, m *Migration) error {
+	statements := make([]sql.Statement, len(m.statements))
+	transactional := true
+	for i, text := range m.statements {
+		q, err := Parse(text)
+		if err != nil {
+			return fmt.Errorf("failed to parse statement %d: %w", i+1, err)
+		}
+
+		switch q.(type) {
+		case *Begin, *Commit, *Rollback, *Savepoint, *RollbackToSavepoint, *ReleaseSavepoint:
+			return fmt.Errorf("statement %d: migrations are applied in transactions by the migration runner", i+1)
+		case *sql.Select, *CountRows, *OrderedSelect, *GroupedSelect, *AsOfSelect, *sql.Insert, *sql.Update, *sql.Delete, *UpdateIfVersion, *DeleteIfVersion:
+		default:
+			transactional = false
+		}
+		statements[i] = q
+	}
+
+	appliedAt := time.Now().UTC().Truncate(time.Second)
+	record := &sql.Insert{
+		Table:   migrationsTable,
+		Columns: []string{"version", "name", "checksum", "applied_at"},
+		Values: []string{
+			strconv.Itoa(m.Version),
+			quoteString(m.Name),
+			quoteString(m.Checksum),
+			quoteString(appliedAt.Format(time.RFC3339)),
+		},
+	}
+	statements = append(statements, record)
+
+	if !transactional {
+		for i, q := range statements {
+			if _, err := db.ExecuteContext(ctx, q); err != nil {
+				if i == len(statements)-1 {
+					return fmt.Errorf("failed to record migration, its statements are applied: %w", err)
+				}
+
+				return fmt.Errorf("statement %d failed, the previous statements are applied: %w", i+1, err)
+			}
+		}
+		m.AppliedAt = &appliedAt
+
+		return nil
+	}
+
+	tx, err := db.Begin(db.options.Isolation)
+	if err != nil {
+		return err
+	}
+
+	for i, q := range statements {
+		if _, err := tx.ExecuteContext(ctx, q); err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return fmt.Errorf("statement %d failed: %s, failed to roll back: %w", i+1, err, rollbackErr)
+			}
+
+			if i == len(statements)-1 {
+				return fmt.Errorf("failed to record migration: %w", err)
+			}
+
+			return fmt.Errorf("statement %d failed: %w", i+1, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	m.AppliedAt = &appliedAt
+
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads the whole opened file, memory mapping is not supported
+// on this platform.
+func mapFile(file *os.File) ([]byte, func() error, error) {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file %s: %w", file.Name(), err)
+	}
+
+	return data, func() error { return nil }, nil
+}
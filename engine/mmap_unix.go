@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package engine
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the opened file into memory for reading, the returned
+// function must be called to unmap the file. The file can be closed
+// before the data is unmapped.
+func mapFile(file *os.File) ([]byte, func() error, error) {
+	filePath := file.Name()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat file %s: %w", filePath, err)
+	}
+
+	if stat.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to map file %s: %w", filePath, err)
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,358 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// txRecord tracks whether the changes of a statement or a transaction
+// have been committed, the row versions created by the changes refer
+// to it.
+type txRecord struct {
+	// csn is the commit sequence number, zero until the changes
+	// are committed, it is accessed atomically
+	csn uint64
+}
+
+// loadedRecord has created the rows loaded from the data files,
+// they are visible to all the snapshots.
+var loadedRecord = &txRecord{csn: 1}
+
+// rowVersion is an immutable version of a row. A change of the row adds
+// a new version that points to the older one, so the readers that have
+// started before the change still find the version they can see.
+type rowVersion struct {
+	values []interface{}
+	// created refers to the statement or the transaction
+	// that has created the version
+	created *txRecord
+	// deleted marks the version that deletes the row
+	deleted bool
+	older   *rowVersion
+}
+
+// snapshot defines the row versions visible to the reader: the ones
+// committed before the snapshot has been taken and its own ones.
+type snapshot struct {
+	csn uint64
+	// schemaVersion is the schema version of the database
+	// when the snapshot has been taken
+	schemaVersion uint64
+	// own is the record of the reading transaction, nil for
+	// the statements outside of transactions
+	own *txRecord
+}
+
+// sees reports whether the changes of the record are visible.
+func (s *snapshot) sees(r *txRecord) bool {
+	if r == s.own {
+		return true
+	}
+
+	csn := atomic.LoadUint64(&r.csn)
+
+	return csn != 0 && csn <= s.csn
+}
+
+// visible returns the row values visible in the snapshot, nil if
+// the row does not exist in the snapshot.
+func (s *snapshot) visible(v *rowVersion) []interface{} {
+	for ; v != nil; v = v.older {
+		if !s.sees(v.created) {
+			continue
+		}
+
+		if v.deleted {
+			return nil
+		}
+
+		return v.values
+	}
+
+	return nil
+}
+
+// takeSnapshot registers the snapshot of the committed changes,
+// the snapshot must be released when the reader is done.
+func (db *Database) takeSnapshot(own *txRecord) *snapshot {
+	s := &snapshot{csn: db.csn, schemaVersion: db.schemaVersion, own: own}
+	db.snapshots[s] = struct{}{}
+
+	return s
+}
+
+func (db *Database) releaseSnapshot(s *snapshot) {
+	delete(db.snapshots, s)
+}
+
+// horizon is the oldest commit sequence number visible to the active
+// snapshots, the versions replaced before it are not visible to anyone.
+func (db *Database) horizon() uint64 {
+	horizon := db.csn
+	for s := range db.snapshots {
+		if s.csn < horizon {
+			horizon = s.csn
+		}
+	}
+
+	return horizon
+}
+
+// writeRecord returns the record for the versions created by the
+// statement in the tables: the record of the transaction or, without
+// the transaction, a new one that is committed by the returned function.
+func (db *Database) writeRecord(tx *Transaction, tableNames ...string) (*txRecord, func()) {
+	if tx != nil {
+		return tx.record, func() {}
+	}
+
+	r := &txRecord{}
+
+	return r, func() {
+		db.commitRecord(r)
+		db.tablesCommitted(tableNames)
+	}
+}
+
+// commitRecord makes the versions created by the record visible
+// to the snapshots taken from now on.
+func (db *Database) commitRecord(r *txRecord) {
+	db.csn++
+	atomic.StoreUint64(&r.csn, db.csn)
+}
+
+// tablesCommitted records that the changes of the tables are
+// committed, it must be called after the commit record.
+func (db *Database) tablesCommitted(tableNames []string) {
+	for _, tableName := range tableNames {
+		db.changedCSN[tableName] = db.csn
+	}
+	if db.results != nil {
+		db.results.invalidate(tableNames...)
+	}
+}
+
+// newVersions creates the first versions of the rows.
+func newVersions(rows [][]interface{}, created *txRecord) []*rowVersion {
+	versions := make([]*rowVersion, len(rows))
+	for i, row := range rows {
+		versions[i] = &rowVersion{values: row, created: created}
+	}
+
+	return versions
+}
+
+// liveRows returns the latest values of the existing rows.
+func liveRows(versions []*rowVersion) [][]interface{} {
+	rows := make([][]interface{}, 0, len(versions))
+	for _, v := range versions {
+		if !v.deleted {
+			rows = append(rows, v.values)
+		}
+	}
+
+	return rows
+}
+
+// The versions of the storage are never changed in place, the readers
+// scan them without the database lock. Appending does not touch the
+// elements visible to the readers, the other changes copy the slice.
+
+// appendVersions adds the inserted rows.
+func appendVersions(versions []*rowVersion, rows [][]interface{}, created *txRecord) []*rowVersion {
+	for _, row := range rows {
+		versions = append(versions, &rowVersion{values: row, created: created})
+	}
+
+	return versions
+}
+
+// updateVersions adds the new versions of the updated rows,
+// the rows are indexed as they are by scan.
+func updateVersions(versions []*rowVersion, updateRows map[int][]interface{}, created *txRecord) []*rowVersion {
+	return changeVersions(versions, func(index int, v *rowVersion) *rowVersion {
+		values, updated := updateRows[index]
+		if !updated {
+			return v
+		}
+
+		return &rowVersion{values: values, created: created, older: v}
+	})
+}
+
+// deleteVersions adds the deleting versions of the deleted rows,
+// the rows are indexed as they are by scan.
+func deleteVersions(versions []*rowVersion, deleteRows map[int]struct{}, created *txRecord) []*rowVersion {
+	return changeVersions(versions, func(index int, v *rowVersion) *rowVersion {
+		if _, deleted := deleteRows[index]; !deleted {
+			return v
+		}
+
+		return &rowVersion{values: v.values, created: created, deleted: true, older: v}
+	})
+}
+
+func changeVersions(versions []*rowVersion, change func(index int, v *rowVersion) *rowVersion) []*rowVersion {
+	changed := make([]*rowVersion, len(versions))
+	index := 0
+	for i, v := range versions {
+		changed[i] = v
+		if v.deleted {
+			continue
+		}
+
+		changed[i] = change(index, v)
+		index++
+	}
+
+	return changed
+}
+
+// checkConflicts fails if the rows the transaction is about to change
+// have been changed after its snapshot has been taken: the transaction
+// would overwrite the changes it has never seen.
+func (db *Database) checkConflicts(tx *Transaction, name string, schema Schema, where *sql.Where) error {
+	if tx == nil || tx.isolation != RepeatableRead || db.mapped[name] {
+		return nil
+	}
+
+	for _, v := range db.data[name] {
+		if tx.snapshot.sees(v.created) {
+			continue
+		}
+
+		latest := !v.deleted && matches(schema, v.values, where)
+		seen := tx.snapshot.visible(v)
+		if latest || (seen != nil && matches(schema, seen, where)) {
+			return fmt.Errorf("%w to %s: the row has been changed after transaction %s has started", ErrSerialization, name, tx.ID)
+		}
+	}
+
+	return nil
+}
+
+// storageView is the table or partition rows captured for
+// the reader while the database is locked.
+type storageView struct {
+	name string
+	// versions of the in-memory rows
+	versions []*rowVersion
+	// file is the opened memory-mapped data file, the replaced data
+	// files are not changed, so the reader sees the file as it has been
+	// when the view has been taken
+	file *os.File
+	// encryption decrypts the file, nil if it is disabled
+	encryption *encryption
+}
+
+// readView is everything the reader needs to scan the table
+// without the database lock.
+type readView struct {
+	schema   Schema
+	snapshot *snapshot
+	storages []storageView
+	// workers is the number of the parallel scan workers
+	workers int
+	// release releases the snapshot
+	release func()
+}
+
+// openView captures the storages for the reader, the view must be
+// closed.
+func (db *Database) openView(tx *Transaction, schema Schema, names []string) (*readView, error) {
+	// the dictionaries grow while the rows are decoded
+	schema.Dictionaries = frozenDictionaries(schema.Dictionaries)
+
+	view := &readView{schema: schema, workers: scanWorkers(db.options.ScanWorkers)}
+	view.snapshot, view.release = db.statementSnapshot(tx)
+
+	for _, name := range names {
+		storage, err := db.storageView(tx, name)
+		if err != nil {
+			db.closeView(view)
+			return nil, err
+		}
+		view.storages = append(view.storages, storage)
+	}
+
+	return view, nil
+}
+
+// storageView captures the rows of the table or partition.
+func (db *Database) storageView(tx *Transaction, name string) (storageView, error) {
+	filePath := tableFilePath(db.dbDir, name)
+	mapped := db.mapped[name]
+
+	if owner := db.storageWriter(name); owner != nil && owner != tx {
+		if entry, exists := owner.journal[name]; exists {
+			// the data file has the changes of another transaction,
+			// the in-memory rows have them as invisible versions
+			switch {
+			case !entry.existed:
+				return storageView{name: name}, nil
+			case entry.mapped:
+				filePath, mapped = path.Join(entry.dir, path.Base(filePath)), true
+			case mapped:
+				return storageView{name: name, versions: entry.versions}, nil
+			}
+		}
+	}
+
+	if !mapped {
+		return storageView{name: name, versions: db.data[name]}, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storageView{name: name}, nil
+		}
+
+		return storageView{}, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+
+	return storageView{name: name, file: file, encryption: db.encryption}, nil
+}
+
+// scan iterates over the rows of the storage visible in the snapshot.
+func (v storageView) scan(schema Schema, s *snapshot, f scanFunc) error {
+	return v.scanFrom(schema, s, 0, f)
+}
+
+// scanFrom iterates over the rows of the storage visible in the
+// snapshot starting from the row with the index.
+func (v storageView) scanFrom(schema Schema, s *snapshot, start int, f scanFunc) error {
+	if v.file != nil {
+		return scanMapped(v.file, schema, start, v.encryption, f)
+	}
+
+	index := 0
+	for _, version := range v.versions {
+		values := s.visible(version)
+		if values == nil {
+			continue
+		}
+
+		if index >= start && !f(index, values) {
+			break
+		}
+		index++
+	}
+
+	return nil
+}
+
+// closeView closes the files and releases the snapshot of the view.
+func (db *Database) closeView(view *readView) {
+	for _, storage := range view.storages {
+		if storage.file != nil {
+			checkFileClose(storage.file.Name(), storage.file.Close())
+		}
+	}
+
+	view.release()
+}
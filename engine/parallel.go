@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The large in-memory tables are scanned by a pool of workers: the row
+// versions of the table or partition are split into chunks, the workers
+// check the visibility and the WHERE condition of the chunks at once,
+// and the matched rows are passed on chunk by chunk in the order of the
+// table, so the rows come in the same order as from the single scan.
+// The memory-mapped files are decoded as a stream and are scanned by
+// one goroutine.
+
+// parallelScanMinRows is the number of the row versions starting from
+// which the storage is scanned by the workers, the smaller ones are
+// scanned faster than the workers start.
+const parallelScanMinRows = 16 * 1024
+
+// parallelScanChunkRows is the smallest chunk of the row versions
+// a worker takes at once.
+const parallelScanChunkRows = 4 * 1024
+
+// scanWorkers is the number of the parallel scan workers by the
+// option, the number of the CPUs by default.
+func scanWorkers(option int) int {
+	if option > 0 {
+		return option
+	}
+
+	return runtime.GOMAXPROCS(0)
+}
+
+// parallelChunk is the filtered chunk of the row versions.
+type parallelChunk struct {
+	rows [][]interface{}
+	read int
+}
+
+// parallelScan calls f for every visible row of the in-memory storage
+// matched by the condition, the rows are filtered by the workers.
+func (v storageView) parallelScan(ctx context.Context, schema Schema, s *snapshot, where *sql.Where, workers int, op *operatorStats, f func(row []interface{}) error) error {
+	// more chunks than workers, so the workers finish at about the same time
+	chunkRows := len(v.versions) / (workers * 4)
+	if chunkRows < parallelScanChunkRows {
+		chunkRows = parallelScanChunkRows
+	}
+	chunks := (len(v.versions) + chunkRows - 1) / chunkRows
+
+	scanCtx, cancel := context.WithCancel(ctx)
+
+	// the chunk results are delivered in the order of the chunks, at most
+	// twice as many chunks as the workers are filtered ahead of f
+	results := make([]chan parallelChunk, chunks)
+	for i := range results {
+		results[i] = make(chan parallelChunk, 1)
+	}
+	ahead := make(chan struct{}, workers*2)
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	defer func() {
+		// the workers stop when f fails
+		cancel()
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(next)
+
+		for i := 0; i < chunks; i++ {
+			select {
+			case ahead <- struct{}{}:
+			case <-scanCtx.Done():
+				return
+			}
+
+			select {
+			case next <- i:
+			case <-scanCtx.Done():
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				end := (i + 1) * chunkRows
+				if end > len(v.versions) {
+					end = len(v.versions)
+				}
+
+				var chunk parallelChunk
+				for j, version := range v.versions[i*chunkRows : end] {
+					if j%cancelCheckRows == 0 && scanCtx.Err() != nil {
+						break
+					}
+
+					values := s.visible(version)
+					if values == nil {
+						continue
+					}
+
+					chunk.read++
+					if matches(schema, values, where) {
+						chunk.rows = append(chunk.rows, values)
+					}
+				}
+				results[i] <- chunk
+			}
+		}()
+	}
+
+	for i := 0; i < chunks; i++ {
+		var chunk parallelChunk
+		select {
+		case chunk = <-results[i]:
+		case <-scanCtx.Done():
+			return contextError(ctx)
+		}
+		<-ahead
+
+		if err := contextError(ctx); err != nil {
+			return err
+		}
+
+		op.readRows(chunk.read)
+		for _, row := range chunk.rows {
+			op.produce()
+			if err := f(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
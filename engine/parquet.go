@@ -0,0 +1,380 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The Parquet file has one required column per exported column, INTEGER
+// columns are INT64 and STRING columns are UTF-8 BYTE_ARRAY. The values
+// are PLAIN encoded and not compressed, every row group has a single
+// data page per column. The metadata is encoded with the Thrift compact
+// protocol as defined by parquet.thrift.
+
+// parquetMagic starts and ends the Parquet file.
+const parquetMagic = "PAR1"
+
+// parquetRowGroupSize and parquetRowGroupBytes limit the buffered rows
+// of the row group, the group is written when one of them is reached.
+const (
+	parquetRowGroupSize  = 1024 * 1024
+	parquetRowGroupBytes = 64 * 1024 * 1024
+)
+
+// the values of the parquet.thrift enums
+const (
+	parquetTypeInt64     = 2
+	parquetTypeByteArray = 6
+
+	parquetRequired = 0
+
+	parquetConvertedUTF8  = 0
+	parquetConvertedInt64 = 18
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+
+	parquetCodecUncompressed = 0
+
+	parquetPageData = 0
+)
+
+// parquetColumnChunk describes the written column of the row group.
+type parquetColumnChunk struct {
+	offset int64
+	size   int64
+}
+
+// parquetRowGroup describes the written row group.
+type parquetRowGroup struct {
+	rows    int
+	size    int64
+	columns []parquetColumnChunk
+}
+
+// parquetWriter writes the rows as the Parquet file.
+type parquetWriter struct {
+	w       *bufio.Writer
+	offset  int64
+	columns []ColumnDef
+	// values are the encoded values of the buffered rows by the columns.
+	values []bytes.Buffer
+	rows   int
+	bytes  int
+	groups []parquetRowGroup
+	total  int64
+}
+
+// newParquetWriter writes the magic of the file.
+func newParquetWriter(w io.Writer, columns []ColumnDef) (*parquetWriter, error) {
+	p := &parquetWriter{w: bufio.NewWriter(w), columns: columns, values: make([]bytes.Buffer, len(columns))}
+	if err := p.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *parquetWriter) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write Parquet: %w", err)
+	}
+
+	return nil
+}
+
+// writeRow buffers the values of the row in the order of the columns.
+func (p *parquetWriter) writeRow(row []interface{}) error {
+	var scratch [8]byte
+	for i, column := range p.columns {
+		buffer := &p.values[i]
+		if column.Type == sql.TypeInteger {
+			value, ok := row[i].(int)
+			if !ok {
+				return fmt.Errorf("unexpected value %v of column %s", row[i], column.Name)
+			}
+			binary.LittleEndian.PutUint64(scratch[:], uint64(value))
+			buffer.Write(scratch[:])
+			p.bytes += 8
+
+			continue
+		}
+
+		value, ok := row[i].(string)
+		if !ok {
+			return fmt.Errorf("unexpected value %v of column %s", row[i], column.Name)
+		}
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(value)))
+		buffer.Write(scratch[:4])
+		buffer.WriteString(value)
+		p.bytes += 4 + len(value)
+	}
+	p.rows++
+
+	if p.rows >= parquetRowGroupSize || p.bytes >= parquetRowGroupBytes {
+		return p.writeRowGroup()
+	}
+
+	return nil
+}
+
+// writeRowGroup writes the buffered rows as the row group.
+func (p *parquetWriter) writeRowGroup() error {
+	if p.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{rows: p.rows, columns: make([]parquetColumnChunk, len(p.columns))}
+	for i := range p.columns {
+		values := p.values[i].Bytes()
+
+		var header thriftWriter
+		header.begin()
+		header.i32(1, parquetPageData)
+		header.i32(2, int32(len(values)))
+		header.i32(3, int32(len(values)))
+		header.structBegin(5)
+		header.i32(1, int32(p.rows))
+		header.i32(2, parquetEncodingPlain)
+		header.i32(3, parquetEncodingRLE)
+		header.i32(4, parquetEncodingRLE)
+		header.structEnd()
+		header.end()
+
+		chunk := parquetColumnChunk{offset: p.offset, size: int64(header.b.Len() + len(values))}
+		if err := p.write(header.b.Bytes()); err != nil {
+			return err
+		}
+		if err := p.write(values); err != nil {
+			return err
+		}
+
+		group.columns[i] = chunk
+		group.size += chunk.size
+		p.values[i].Reset()
+	}
+
+	p.groups = append(p.groups, group)
+	p.total += int64(p.rows)
+	p.rows, p.bytes = 0, 0
+
+	return nil
+}
+
+// close writes the last row group and the footer.
+func (p *parquetWriter) close() error {
+	if err := p.writeRowGroup(); err != nil {
+		return err
+	}
+
+	var metadata thriftWriter
+	metadata.begin()
+	metadata.i32(1, 1)
+
+	metadata.listBegin(2, thriftStruct, len(p.columns)+1)
+	metadata.begin()
+	metadata.binary(4, "schema")
+	metadata.i32(5, int32(len(p.columns)))
+	metadata.end()
+	for _, column := range p.columns {
+		metadata.begin()
+		if column.Type == sql.TypeInteger {
+			metadata.i32(1, parquetTypeInt64)
+		} else {
+			metadata.i32(1, parquetTypeByteArray)
+		}
+		metadata.i32(3, parquetRequired)
+		metadata.binary(4, column.Name)
+		// the logical type
+		if column.Type == sql.TypeInteger {
+			metadata.i32(6, parquetConvertedInt64)
+			metadata.structBegin(10)
+			metadata.structBegin(10)
+			metadata.i8(1, 64)
+			metadata.bool(2, true)
+			metadata.structEnd()
+			metadata.structEnd()
+		} else {
+			metadata.i32(6, parquetConvertedUTF8)
+			metadata.structBegin(10)
+			metadata.structBegin(1)
+			metadata.structEnd()
+			metadata.structEnd()
+		}
+		metadata.end()
+	}
+
+	metadata.i64(3, p.total)
+
+	metadata.listBegin(4, thriftStruct, len(p.groups))
+	for _, group := range p.groups {
+		metadata.begin()
+		metadata.listBegin(1, thriftStruct, len(group.columns))
+		for i, chunk := range group.columns {
+			column := p.columns[i]
+			metadata.begin()
+			metadata.i64(2, chunk.offset)
+			metadata.structBegin(3)
+			if column.Type == sql.TypeInteger {
+				metadata.i32(1, parquetTypeInt64)
+			} else {
+				metadata.i32(1, parquetTypeByteArray)
+			}
+			metadata.listBegin(2, thriftI32, 2)
+			metadata.listI32(parquetEncodingPlain)
+			metadata.listI32(parquetEncodingRLE)
+			metadata.listBegin(3, thriftBinary, 1)
+			metadata.listBinary(column.Name)
+			metadata.i32(4, parquetCodecUncompressed)
+			metadata.i64(5, int64(group.rows))
+			metadata.i64(6, chunk.size)
+			metadata.i64(7, chunk.size)
+			metadata.i64(9, chunk.offset)
+			metadata.structEnd()
+			metadata.end()
+		}
+		metadata.i64(2, group.size)
+		metadata.i64(3, int64(group.rows))
+		metadata.end()
+	}
+
+	metadata.binary(6, "gosqldb")
+	metadata.end()
+
+	if err := p.write(metadata.b.Bytes()); err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(metadata.b.Len()))
+	if err := p.write(length[:]); err != nil {
+		return err
+	}
+	if err := p.write([]byte(parquetMagic)); err != nil {
+		return err
+	}
+
+	if err := p.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write Parquet: %w", err)
+	}
+
+	return nil
+}
+
+// the types of the Thrift compact protocol
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the structs with the Thrift compact protocol.
+type thriftWriter struct {
+	b bytes.Buffer
+	// last are the identifiers of the last written fields of the
+	// nested structs, the field identifiers are delta encoded.
+	last []int16
+}
+
+// begin starts the struct that is the top one or the list element.
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+// end ends the struct started by begin.
+func (t *thriftWriter) end() {
+	t.b.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.b.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.b.WriteByte(kind)
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	t.b.Write(buf[:n])
+}
+
+// varint writes the zigzag encoded integer.
+func (t *thriftWriter) varint(v int64) {
+	t.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (t *thriftWriter) bool(id int16, v bool) {
+	if v {
+		t.field(id, thriftTrue)
+	} else {
+		t.field(id, thriftFalse)
+	}
+}
+
+func (t *thriftWriter) i8(id int16, v int8) {
+	t.field(id, thriftByte)
+	t.b.WriteByte(byte(v))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.listBinary(v)
+}
+
+// structBegin starts the struct field, structEnd ends it.
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.end()
+}
+
+// listBegin starts the list field, the elements follow it.
+func (t *thriftWriter) listBegin(id int16, kind byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.b.WriteByte(byte(size)<<4 | kind)
+	} else {
+		t.b.WriteByte(0xf0 | kind)
+		t.uvarint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) listBinary(v string) {
+	t.uvarint(uint64(len(v)))
+	t.b.WriteString(v)
+}
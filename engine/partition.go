@@ -0,0 +1,460 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// PartitionType defines how rows are distributed among partitions.
+type PartitionType string
+
+const (
+	// PartitionRange splits rows by ranges of an integer column.
+	PartitionRange PartitionType = "range"
+	// PartitionHash splits rows by the hash of a column value.
+	PartitionHash PartitionType = "hash"
+)
+
+// Partitioning describes how table rows are split across data files.
+type Partitioning struct {
+	Type       PartitionType `json:"type"`
+	Column     string        `json:"column"`
+	Partitions []Partition   `json:"partitions"`
+}
+
+// Partition is a table partition stored in its own data file.
+type Partition struct {
+	Name string `json:"name"`
+	// LessThan is the exclusive upper bound of the range partition,
+	// nil means no upper bound (MAXVALUE).
+	LessThan *int `json:"less_than,omitempty"`
+}
+
+// CreatePartitionedTable represents CREATE TABLE statement with
+// the PARTITION BY clause.
+//
+//	CREATE TABLE t (id INTEGER, name STRING)
+//	PARTITION BY RANGE (id) (
+//		PARTITION p0 VALUES LESS THAN (100),
+//		PARTITION p1 VALUES LESS THAN MAXVALUE
+//	)
+//
+//	CREATE TABLE t (id INTEGER, name STRING)
+//	PARTITION BY HASH (id) PARTITIONS 4
+type CreatePartitionedTable struct {
+	*sql.CreateTable
+	// Partitioning is nil for the not partitioned tables
+	// with the generated columns.
+	Partitioning *Partitioning
+	Generated    []GeneratedColumn
+}
+
+// GetType returns the statement type.
+func (*CreatePartitionedTable) GetType() sql.StatementType {
+	return StatementCreatePartitionedTable
+}
+
+// DropPartition represents ALTER TABLE ... DROP PARTITION statement.
+type DropPartition struct {
+	Table     string
+	Partition string
+}
+
+// GetType returns the statement type.
+func (*DropPartition) GetType() sql.StatementType { return StatementDropPartition }
+
+func parsePartitionBy(s *tokenStream) (*Partitioning, error) {
+	s.mustKeyword("PARTITION", "BY")
+
+	var partitioning Partitioning
+	switch {
+	case s.acceptKeyword("RANGE"):
+		partitioning.Type = PartitionRange
+	case s.acceptKeyword("HASH"):
+		partitioning.Type = PartitionHash
+	default:
+		return nil, s.unexpected("RANGE or HASH")
+	}
+
+	if err := s.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	column, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	partitioning.Column = column
+
+	if err := s.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	if partitioning.Type == PartitionHash {
+		if err := s.expectKeyword("PARTITIONS"); err != nil {
+			return nil, err
+		}
+
+		count, err := s.expectInteger()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < count; i++ {
+			partitioning.Partitions = append(partitioning.Partitions, Partition{Name: "p" + strconv.Itoa(i)})
+		}
+
+		return &partitioning, s.expectEnd()
+	}
+
+	if err := s.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := s.expectKeyword("PARTITION"); err != nil {
+			return nil, err
+		}
+
+		name, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.expectKeyword("VALUES", "LESS", "THAN"); err != nil {
+			return nil, err
+		}
+
+		partition := Partition{Name: name}
+		if !s.acceptKeyword("MAXVALUE") {
+			if err := s.expectSymbol("("); err != nil {
+				return nil, err
+			}
+
+			lessThan, err := s.expectInteger()
+			if err != nil {
+				return nil, err
+			}
+			partition.LessThan = &lessThan
+
+			if err := s.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+		}
+
+		partitioning.Partitions = append(partitioning.Partitions, partition)
+
+		if !s.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := s.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	return &partitioning, s.expectEnd()
+}
+
+// validatePartitioning validates the partitioning against the table columns
+// and normalizes the column and partition names.
+func validatePartitioning(partitioning *Partitioning, columns map[string]ColumnDef) error {
+	partitioning.Column = strings.ToLower(partitioning.Column)
+	column, exists := columns[partitioning.Column]
+	if !exists {
+		return newError(CodeUndefinedColumn, "partition column %s does not exist", partitioning.Column)
+	}
+
+	if partitioning.Type == PartitionRange && column.Type != sql.TypeInteger {
+		return fmt.Errorf("range partition column %s must be an integer", partitioning.Column)
+	}
+
+	if len(partitioning.Partitions) == 0 {
+		return fmt.Errorf("at least one partition is required")
+	}
+
+	names := make(map[string]struct{})
+	for i, partition := range partitioning.Partitions {
+		name := strings.ToLower(partition.Name)
+		if !isValidTableNameFormat(name) {
+			return fmt.Errorf("partition name %s is not valid, expected format: %s", partition.Name, tableNameRegExp)
+		}
+
+		if _, exists := names[name]; exists {
+			return fmt.Errorf("partition %s is repeated (partition names are case-insensitive)", partition.Name)
+		}
+		names[name] = struct{}{}
+		partitioning.Partitions[i].Name = name
+
+		if partitioning.Type != PartitionRange || i == 0 {
+			continue
+		}
+
+		previous := partitioning.Partitions[i-1].LessThan
+		if previous == nil {
+			return fmt.Errorf("MAXVALUE partition must be the last one")
+		}
+
+		if partition.LessThan != nil && *partition.LessThan <= *previous {
+			return fmt.Errorf("partition %s bound must be greater than %d", partition.Name, *previous)
+		}
+	}
+
+	return nil
+}
+
+// storageName is the name of the table or partition data file
+// without the extension.
+func storageName(tableName string, partition string) string {
+	if partition == "" {
+		return tableName
+	}
+
+	return tableName + "." + partition
+}
+
+// storageNames returns names of all the data files of the table
+// with their segments.
+func (schema Schema) storageNames() []string {
+	if len(schema.Segments) == 0 {
+		return schema.fileNames()
+	}
+
+	names := make([]string, 0)
+	for _, name := range schema.fileNames() {
+		names = append(names, schema.segmentNames(name)...)
+	}
+
+	return names
+}
+
+// fileNames returns names of the data files of the table or
+// its partitions without the segments.
+func (schema Schema) fileNames() []string {
+	if schema.Partitioning == nil {
+		return []string{schema.Name}
+	}
+
+	names := make([]string, len(schema.Partitioning.Partitions))
+	for i, partition := range schema.Partitioning.Partitions {
+		names[i] = storageName(schema.Name, partition.Name)
+	}
+
+	return names
+}
+
+// rowStorageName returns the name of the data file the row belongs to.
+func (schema Schema) rowStorageName(row []interface{}) (string, error) {
+	if schema.Partitioning == nil {
+		return schema.Name, nil
+	}
+
+	column := schema.Columns[schema.Partitioning.Column]
+	partition, ok := schema.Partitioning.partitionFor(row[column.Position])
+	if !ok {
+		return "", fmt.Errorf("no partition of table %s for value %v", schema.Name, row[column.Position])
+	}
+
+	return storageName(schema.Name, partition), nil
+}
+
+// partitionFor returns the name of the partition for the partition column value.
+func (p *Partitioning) partitionFor(value interface{}) (string, bool) {
+	switch p.Type {
+	case PartitionHash:
+		h := fnv.New32a()
+		fmt.Fprint(h, value)
+
+		return p.Partitions[h.Sum32()%uint32(len(p.Partitions))].Name, true
+	case PartitionRange:
+		v, ok := value.(int)
+		if !ok {
+			return "", false
+		}
+
+		for _, partition := range p.Partitions {
+			if partition.LessThan == nil || v < *partition.LessThan {
+				return partition.Name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// prune returns names of the data files that can contain rows
+// matching the WHERE clause. Only equality with a value on the partition
+// column in the top-level AND chain is used for pruning. Nothing is scanned
+// if the value of the dictionary-encoded column is not in its dictionary.
+func (schema Schema) prune(where *sql.Where) []string {
+	if where != nil && schema.dictionaryExcludes(where.Expr) {
+		return []string{}
+	}
+
+	if schema.Partitioning == nil || where == nil {
+		return schema.storageNames()
+	}
+
+	value, found := equalityValue(where.Expr, schema.Partitioning.Column)
+	if !found || !binaryCollation(schema.Columns[schema.Partitioning.Column].Collation) {
+		return schema.storageNames()
+	}
+
+	partition, ok := schema.Partitioning.partitionFor(value)
+	if !ok {
+		return []string{}
+	}
+
+	return schema.segmentNames(storageName(schema.Name, partition))
+}
+
+// equalityValue looks for the "column == value" expression in
+// the AND chain.
+func equalityValue(expr sql.Expr, column string) (interface{}, bool) {
+	operation, ok := expr.(sql.ExprOperation)
+	if !ok {
+		return nil, false
+	}
+
+	switch operation.Operator {
+	case sql.OperatorLogicalAnd:
+		if value, found := equalityValue(operation.Left, column); found {
+			return value, true
+		}
+
+		return equalityValue(operation.Right, column)
+	case sql.OperatorEquals:
+		identifier, value := operation.Left, operation.Right
+		if _, ok := identifier.(sql.ExprIdentifier); !ok {
+			identifier, value = value, identifier
+		}
+
+		id, ok := identifier.(sql.ExprIdentifier)
+		if !ok || strings.ToLower(id.Name) != column {
+			return nil, false
+		}
+
+		switch v := value.(type) {
+		case sql.ExprValueInteger:
+			parsed, err := parseValue(v.Value)
+			return parsed, err == nil
+		case sql.ExprValueString:
+			parsed, err := parseValue(v.Value)
+			return parsed, err == nil
+		}
+	}
+
+	return nil, false
+}
+
+// CreatePartitionedTable creates a table split into partitions.
+func (db *Database) CreatePartitionedTable(query *CreatePartitionedTable) error {
+	return db.createTable(query.CreateTable, Schema{Partitioning: query.Partitioning, Columns: generatedColumns(query.Generated)})
+}
+
+// DropPartition removes the range partition with all its rows.
+func (db *Database) DropPartition(query *DropPartition) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(context.Background(), l, tableResource(tableName), lockExclusive); err != nil {
+		return err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	if schema.Partitioning == nil {
+		return fmt.Errorf("table %s is not partitioned", tableName)
+	}
+
+	if schema.Partitioning.Type != PartitionRange {
+		return fmt.Errorf("only range partitions can be dropped")
+	}
+
+	if len(schema.Partitioning.Partitions) == 1 {
+		return fmt.Errorf("the last partition of table %s can not be dropped", tableName)
+	}
+
+	partitionName := strings.ToLower(query.Partition)
+	partitions := make([]Partition, 0, len(schema.Partitioning.Partitions))
+	for _, partition := range schema.Partitioning.Partitions {
+		if partition.Name != partitionName {
+			partitions = append(partitions, partition)
+		}
+	}
+
+	if len(partitions) == len(schema.Partitioning.Partitions) {
+		return newError(CodeUndefinedObject, "partition %s does not exist in table %s", partitionName, tableName)
+	}
+
+	partitionFile := storageName(tableName, partitionName)
+	dropped := schema.segmentNames(partitionFile)
+
+	// only the rows of the partition are scanned for the statistics
+	var change rowsChange
+	for _, name := range dropped {
+		err := db.scan(name, schema, func(_ int, row []interface{}) bool {
+			change.delete(schema, row)
+
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", name, err)
+		}
+	}
+	if _, exists := schema.Segments[partitionFile]; exists {
+		segments := make(map[string]int, len(schema.Segments))
+		for name, last := range schema.Segments {
+			if name != partitionFile {
+				segments[name] = last
+			}
+		}
+		schema.Segments = segments
+	}
+
+	partitioning := *schema.Partitioning
+	partitioning.Partitions = partitions
+	schema.Partitioning = &partitioning
+	db.replaceSchema(schema)
+
+	err := db.storeTables()
+	if err != nil {
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	for _, name := range dropped {
+		delete(db.data, name)
+		delete(db.mapped, name)
+
+		filePath := tableFilePath(db.dbDir, name)
+		for _, filePath := range []string{filePath, checksumFilePath(filePath)} {
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove file %s: %w", filePath, err)
+			}
+
+			if err := db.archiveFile(filePath, nil, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = db.updateStats(tableName, change)
+	if err != nil {
+		return fmt.Errorf("failed to refresh statistics: %w", err)
+	}
+
+	return nil
+}
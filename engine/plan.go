@@ -0,0 +1,434 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Cost model constants, the cost is measured in the units of
+// reading a single row from memory.
+const (
+	// memoryRowCost is the cost of reading a row from memory.
+	memoryRowCost = 1.0
+	// mappedRowCost is the cost of decoding a row from a memory-mapped file.
+	mappedRowCost = 4.0
+	// defaultEqualitySelectivity is the estimated fraction of rows matching
+	// "column == value" when the value is within the column min/max range
+	// and the table has not been analyzed.
+	defaultEqualitySelectivity = 0.1
+)
+
+// Access paths.
+const (
+	accessFullScan      = "full scan"
+	accessPartitionScan = "partition scan"
+	accessVirtualScan   = "virtual table scan"
+	accessNoScan        = "no scan"
+)
+
+// Explain represents EXPLAIN statement, with ANALYZE the query
+// is executed and the real execution counters are reported, with
+// VALIDATE any statement is validated without executing it.
+//
+//	EXPLAIN SELECT id FROM t WHERE id == 5
+//	EXPLAIN ANALYZE DELETE FROM t WHERE id == 5
+//	EXPLAIN VALIDATE INSERT INTO t (id) VALUES (5)
+type Explain struct {
+	Statement sql.Statement
+	Analyze   bool
+	Validate  bool
+	// Query is the text of the validated statement.
+	Query string
+}
+
+// GetType returns the statement type.
+func (*Explain) GetType() sql.StatementType { return StatementExplain }
+
+func parseExplain(query string, s *tokenStream) (sql.Statement, error) {
+	explain := s.next()
+	analyze := s.acceptKeyword("ANALYZE")
+	validate := !analyze && s.acceptKeyword("VALIDATE")
+	if analyze || validate {
+		explain = s.tokens[s.pos-1]
+	}
+
+	// the blanked prefix keeps the error positions
+	offset := explain.pos + len(explain.value)
+	statement, err := parseRewritten(strings.Repeat(" ", offset) + query[offset:])
+	if err != nil {
+		return nil, err
+	}
+
+	if validate {
+		return &Explain{Statement: statement, Validate: true, Query: strings.TrimSpace(query[offset:])}, nil
+	}
+
+	switch statement.(type) {
+	case *sql.Select, *OrderedSelect, *GroupedSelect, *sql.Update, *sql.Delete:
+		return &Explain{Statement: statement, Analyze: analyze}, nil
+	default:
+		return nil, fmt.Errorf("EXPLAIN supports only SELECT, UPDATE and DELETE, got %T", statement)
+	}
+}
+
+// Plan describes how the query is executed.
+type Plan struct {
+	// Operation is the query operation: SELECT, UPDATE or DELETE.
+	Operation string
+	// Table is the name of the queried table.
+	Table string
+	// Access is the chosen access path.
+	Access string
+	// Storages are the names of the scanned table or partition data files.
+	Storages []string
+	// Filter is the WHERE expression, nil if all rows match.
+	Filter sql.Expr
+	// ScannedRows is the estimated number of rows to read.
+	ScannedRows int
+	// EstimatedRows is the estimated number of rows matching the filter.
+	EstimatedRows int
+	// Group is the GROUP BY part, nil if the rows are not grouped.
+	Group []string
+	// Groups is the estimated number of the groups.
+	Groups int
+	// Sort is the ORDER BY part, nil if the rows are not sorted.
+	Sort []OrderTerm
+	// Cost is the estimated cost of the query.
+	Cost float64
+	// Analysis holds the real execution counters for EXPLAIN ANALYZE.
+	Analysis *analysis
+}
+
+// String renders the plan as human-readable text.
+func (p *Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", p.Operation, p.Table)
+	fmt.Fprintf(&b, "  -> %s", p.Access)
+	if len(p.Storages) > 0 {
+		fmt.Fprintf(&b, " of %s", strings.Join(p.Storages, ", "))
+	}
+	fmt.Fprintf(&b, " (rows=%d cost=%.2f)\n", p.ScannedRows, p.Cost)
+	if p.Filter != nil {
+		fmt.Fprintf(&b, "  -> filter: %s (rows=%d)\n", exprString(p.Filter), p.EstimatedRows)
+	}
+	rows := p.EstimatedRows
+	if p.Group != nil {
+		fmt.Fprintf(&b, "  -> hash aggregate: group by %s (groups=%d)\n", strings.Join(p.Group, ", "), p.Groups)
+		rows = p.Groups
+	}
+	if p.Sort != nil {
+		terms := make([]string, len(p.Sort))
+		for i, term := range p.Sort {
+			terms[i] = term.String()
+		}
+		fmt.Fprintf(&b, "  -> sort: %s (rows=%d)\n", strings.Join(terms, ", "), rows)
+	}
+
+	if p.Analysis != nil {
+		fmt.Fprintf(&b, "execution: %s, %d rows\n", p.Analysis.total, p.Analysis.rows)
+		for _, op := range p.Analysis.operators {
+			fmt.Fprintf(&b, "  -> %s: time=%s read=%d produced=%d filtered=%d\n", op.name, op.duration, op.rowsRead, op.rowsProduced, op.rowsRead-op.rowsProduced)
+		}
+	}
+
+	return b.String()
+}
+
+// plan chooses the data files to scan and estimates the cost
+// of the query against the table.
+func (db *Database) plan(operation string, schema Schema, where *sql.Where) *Plan {
+	p := &Plan{Operation: operation, Table: schema.Name, Access: accessFullScan}
+	if where != nil {
+		p.Filter = where.Expr
+	}
+
+	p.Storages = schema.prune(where)
+	if schema.Partitioning != nil && len(p.Storages) < len(schema.Partitioning.Partitions) {
+		p.Access = accessPartitionScan
+	}
+	if len(p.Storages) == 0 {
+		p.Access = accessNoScan
+	}
+
+	tableRows := schema.Stats.RowCount
+	for _, name := range p.Storages {
+		rows := tableRows
+		if schema.Partitioning != nil {
+			// statistics are per table, assume even distribution
+			partitions := len(schema.Partitioning.Partitions)
+			rows = (tableRows + partitions - 1) / partitions
+		}
+
+		rowCost := memoryRowCost
+		if db.mapped[name] {
+			rowCost = mappedRowCost
+		}
+
+		p.ScannedRows += rows
+		p.Cost += float64(rows) * rowCost
+	}
+
+	p.EstimatedRows = int(float64(p.ScannedRows) * selectivity(schema, p.Filter))
+
+	return p
+}
+
+// selectivity estimates the fraction of rows matching the expression.
+func selectivity(schema Schema, expr sql.Expr) float64 {
+	if expr == nil {
+		return 1
+	}
+
+	operation, ok := expr.(sql.ExprOperation)
+	if !ok {
+		return 1
+	}
+
+	switch operation.Operator {
+	case sql.OperatorLogicalAnd:
+		return selectivity(schema, operation.Left) * selectivity(schema, operation.Right)
+	case sql.OperatorEquals:
+		for _, column := range schema.Columns {
+			value, found := equalityValue(expr, column.Name)
+			if !found {
+				continue
+			}
+
+			columnStats := schema.Stats.Columns[column.Name]
+			if columnStats.Min != nil && binaryCollation(column.Collation) && (less(value, columnStats.Min) || less(columnStats.Max, value)) {
+				return 0
+			}
+
+			return columnStats.equalitySelectivity(value)
+		}
+	}
+
+	return 1
+}
+
+// Explain returns the plan of the query without executing it.
+func (db *Database) Explain(query *Explain) (*Plan, error) {
+	return db.ExplainContext(context.Background(), query)
+}
+
+// ExplainContext is Explain that stops executing the analyzed
+// query when the context is done.
+func (db *Database) ExplainContext(ctx context.Context, query *Explain) (*Plan, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var operation, table string
+	var where *sql.Where
+	var order []OrderTerm
+	var grouped *GroupedSelect
+	switch q := query.Statement.(type) {
+	case *sql.Select:
+		operation, table, where = "SELECT", q.Table, q.Where
+	case *OrderedSelect:
+		operation, table, where, order = "SELECT", q.Table, q.Where, q.OrderBy
+	case *GroupedSelect:
+		operation, table, where, grouped = "SELECT", q.Table, q.Where, q
+	case *sql.Update:
+		operation, table, where = "UPDATE", q.Table, q.Where
+	case *sql.Delete:
+		operation, table, where = "DELETE", q.Table, q.Where
+	default:
+		return nil, fmt.Errorf("unsupported statement %T", q)
+	}
+
+	tableName := strings.ToLower(table)
+	schema, exists := db.tables[tableName]
+	if !exists {
+		if virtual, exists := virtualTables[tableName]; exists && operation == "SELECT" {
+			schema = virtual.schema
+			p := &Plan{Operation: operation, Table: tableName, Access: accessVirtualScan, Sort: order}
+			if where != nil {
+				p.Filter = where.Expr
+			}
+			if _, err := orderBy(schema, order); err != nil {
+				return nil, err
+			}
+			if err := planGroups(p, schema, grouped); err != nil {
+				return nil, err
+			}
+
+			return p, validateWhere(schema, where)
+		}
+
+		return nil, newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	err := validateWhere(schema, where)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WHERE part: %w", err)
+	}
+
+	if _, err := orderBy(schema, order); err != nil {
+		return nil, err
+	}
+
+	p := db.plan(operation, schema, where)
+	p.Sort = order
+	if err := planGroups(p, schema, grouped); err != nil {
+		return nil, err
+	}
+	if !query.Analyze {
+		return p, nil
+	}
+
+	p.Analysis = &analysis{}
+	start := time.Now()
+	switch q := query.Statement.(type) {
+	case *sql.Select:
+		var rows [][]interface{}
+		rows, err = db.selectRows(ctx, q, p.Analysis, nil)
+		p.Analysis.rows = len(rows)
+	case *OrderedSelect:
+		err = db.sortEach(ctx, q, p.Analysis, nil, nil, func(row []interface{}) error {
+			p.Analysis.rows++
+
+			return nil
+		})
+	case *GroupedSelect:
+		err = db.aggregateEach(ctx, q, p.Analysis, nil, nil, func(row []interface{}) error {
+			p.Analysis.rows++
+
+			return nil
+		})
+	case *sql.Update:
+		p.Analysis.rows, err = db.update(ctx, q, 0, p.Analysis, nil)
+	case *sql.Delete:
+		p.Analysis.rows, err = db.delete(ctx, q, 0, p.Analysis, nil)
+	}
+	p.Analysis.total = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// planGroups validates GROUP BY of the query and estimates the number
+// of the groups by the distinct values of the columns, nothing is done
+// for the queries without GROUP BY.
+func planGroups(p *Plan, schema Schema, query *GroupedSelect) error {
+	if query == nil {
+		return nil
+	}
+
+	g, err := newAggregation(schema, query)
+	if err != nil {
+		return err
+	}
+	if _, err := orderBy(Schema{Name: schema.Name, Columns: g.schema}, query.OrderBy); err != nil {
+		return err
+	}
+
+	p.Group, p.Sort = query.GroupBy, query.OrderBy
+	p.Groups = 1
+	for _, column := range query.GroupBy {
+		distinct := schema.Stats.Columns[column].Distinct
+		if distinct == 0 || p.Groups*distinct > p.EstimatedRows {
+			p.Groups = p.EstimatedRows
+			break
+		}
+		p.Groups *= distinct
+	}
+	if p.Groups > p.EstimatedRows {
+		p.Groups = p.EstimatedRows
+	}
+
+	return nil
+}
+
+// analysis collects execution counters of the plan operators.
+// All the methods are no-op for nil analysis.
+type analysis struct {
+	operators []*operatorStats
+	// total execution time
+	total time.Duration
+	// rows returned or affected by the query
+	rows int
+}
+
+// operatorStats are execution counters of a single operator.
+type operatorStats struct {
+	name         string
+	start        time.Time
+	duration     time.Duration
+	rowsRead     int
+	rowsProduced int
+}
+
+// operator starts the operator timer.
+func (a *analysis) operator(name string) *operatorStats {
+	if a == nil {
+		return nil
+	}
+
+	op := &operatorStats{name: name, start: time.Now()}
+	a.operators = append(a.operators, op)
+
+	return op
+}
+
+func (op *operatorStats) read() {
+	if op != nil {
+		op.rowsRead++
+	}
+}
+
+// readRows counts the rows read at once.
+func (op *operatorStats) readRows(rows int) {
+	if op != nil {
+		op.rowsRead += rows
+	}
+}
+
+func (op *operatorStats) produce() {
+	if op != nil {
+		op.rowsProduced++
+	}
+}
+
+// pass counts rows that are read and produced without filtering.
+func (op *operatorStats) pass(rows int) {
+	if op != nil {
+		op.rowsRead += rows
+		op.rowsProduced += rows
+	}
+}
+
+func (op *operatorStats) finish() {
+	if op != nil {
+		op.duration = time.Since(op.start)
+	}
+}
+
+// exprString renders the expression as SQL.
+func exprString(expr sql.Expr) string {
+	switch e := expr.(type) {
+	case sql.ExprOperation:
+		switch e.Operator {
+		case sql.OperatorEquals:
+			return exprString(e.Left) + " == " + exprString(e.Right)
+		case sql.OperatorLogicalAnd:
+			return exprString(e.Left) + " AND " + exprString(e.Right)
+		}
+	case sql.ExprIdentifier:
+		return e.Name
+	case sql.ExprValueInteger:
+		return e.Value
+	case sql.ExprValueString:
+		return e.Value
+	}
+
+	return fmt.Sprintf("%v", expr)
+}
@@ -0,0 +1,315 @@
+package engine
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/krasun/gosqldb/internal/tracing"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The statement cache keeps the parsed statements by their text, so the
+// queries sent again and again are parsed once. The statements are never
+// changed by the execution, so the cached ones are shared as the prepared
+// statements are. The WHERE parts of the cached statements also keep the
+// validated access plan: the checked columns and the pruned data files.
+// The plan holds until the schema changes, every DDL statement bumps the
+// schema version and the plans of the older versions are rebuilt. The
+// queries with the placeholders are cached as the prepared statements
+// by their text prefixed with placeholderMarker, their WHERE parts are
+// copied by every binding, so they have no plans.
+
+// maxCachedStatementSize is the length of the longest cached statement
+// text, the larger ones are mostly the bulk inserts sent once.
+const maxCachedStatementSize = 16 * 1024
+
+// StatementCacheStats counts the lookups of the statement cache.
+type StatementCacheStats struct {
+	Size       int    `json:"size"`
+	Capacity   int    `json:"capacity"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	PlanHits   uint64 `json:"plan_hits"`
+	PlanMisses uint64 `json:"plan_misses"`
+}
+
+// cachedStatement is the entry of the statement cache.
+type cachedStatement struct {
+	text      string
+	statement sql.Statement
+	// prepared is the statement with the placeholders,
+	// nil for the other statements
+	prepared *PreparedStatement
+}
+
+// cachedPlan is the validated access plan of the WHERE part.
+type cachedPlan struct {
+	// version is the schema version the plan is valid for,
+	// zero if the plan has not been built yet.
+	version  uint64
+	table    string
+	storages []string
+}
+
+// statementCache is the LRU cache of the parsed statements,
+// nil if the cache is disabled.
+type statementCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	// order has the most recently used entry first
+	order *list.List
+	// plans are the access plans of the WHERE parts
+	// of the cached statements
+	plans map[*sql.Where]*cachedPlan
+	stats StatementCacheStats
+}
+
+func newStatementCache(capacity int) *statementCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &statementCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		plans:    make(map[*sql.Where]*cachedPlan),
+	}
+}
+
+// get returns the cached statement of the text.
+func (c *statementCache) get(text string) (sql.Statement, bool) {
+	entry, exists := c.lookup(text)
+	if !exists {
+		return nil, false
+	}
+
+	return entry.statement, true
+}
+
+// getPrepared returns the cached prepared statement of the text.
+func (c *statementCache) getPrepared(text string) (*PreparedStatement, bool) {
+	entry, exists := c.lookup(placeholderMarker + text)
+	if !exists {
+		return nil, false
+	}
+
+	return entry.prepared, true
+}
+
+func (c *statementCache) lookup(key string) (*cachedStatement, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+
+	return element.Value.(*cachedStatement), true
+}
+
+// put caches the parsed statement.
+func (c *statementCache) put(text string, statement sql.Statement) {
+	c.add(&cachedStatement{text: text, statement: statement})
+}
+
+// putPrepared caches the prepared statement.
+func (c *statementCache) putPrepared(text string, prepared *PreparedStatement) {
+	c.add(&cachedStatement{text: placeholderMarker + text, prepared: prepared})
+}
+
+// add caches the entry and evicts the least recently used
+// one over the capacity.
+func (c *statementCache) add(entry *cachedStatement) {
+	if len(entry.text) > maxCachedStatementSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[entry.text]; exists {
+		return
+	}
+
+	c.entries[entry.text] = c.order.PushFront(entry)
+	if where := statementWhere(entry.statement); where != nil {
+		c.plans[where] = &cachedPlan{}
+	}
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		evicted := c.order.Remove(oldest).(*cachedStatement)
+		delete(c.entries, evicted.text)
+		if where := statementWhere(evicted.statement); where != nil {
+			delete(c.plans, where)
+		}
+		c.stats.Evictions++
+	}
+}
+
+// plan returns the storages of the cached plan of the WHERE part if it
+// is valid for the schema version, plan reports false for the WHERE
+// parts of the statements that are not cached.
+func (c *statementCache) plan(where *sql.Where, table string, version uint64) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, exists := c.plans[where]
+	if !exists {
+		return nil, false
+	}
+
+	if p.version != version || p.table != table {
+		c.stats.PlanMisses++
+		return nil, false
+	}
+	c.stats.PlanHits++
+
+	return p.storages, true
+}
+
+// setPlan keeps the plan of the WHERE part of the cached statement.
+func (c *statementCache) setPlan(where *sql.Where, table string, version uint64, storages []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, exists := c.plans[where]; exists {
+		p.version, p.table, p.storages = version, table, storages
+	}
+}
+
+func (c *statementCache) currentStats() StatementCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+
+	return stats
+}
+
+// statementWhere returns the WHERE part of the statement, nil if
+// it has none.
+func statementWhere(statement sql.Statement) *sql.Where {
+	switch s := statement.(type) {
+	case *sql.Select:
+		return s.Where
+	case *CountRows:
+		return s.Where
+	case *OrderedSelect:
+		return s.Where
+	case *GroupedSelect:
+		return s.Where
+	case *AsOfSelect:
+		return s.Where
+	case *sql.Update:
+		return s.Where
+	case *sql.Delete:
+		return s.Where
+	case *UpdateIfVersion:
+		return s.Where
+	case *DeleteIfVersion:
+		return s.Where
+	case *Explain:
+		return statementWhere(s.Statement)
+	}
+
+	return nil
+}
+
+// Parse parses the query as the package Parse does, the parsed
+// statements are cached by the query text.
+func (db *Database) Parse(query string) (sql.Statement, error) {
+	if db.statements == nil {
+		return Parse(query)
+	}
+
+	if statement, cached := db.statements.get(query); cached {
+		return statement, nil
+	}
+
+	statement, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	db.statements.put(query, statement)
+
+	return statement, nil
+}
+
+// ParsePrepared parses the query with the $N placeholders into the
+// prepared statement that is not registered, the statements are
+// cached by the query text.
+func (db *Database) ParsePrepared(query string) (*PreparedStatement, error) {
+	if db.statements == nil {
+		return NewPreparedStatement(query)
+	}
+
+	if prepared, cached := db.statements.getPrepared(query); cached {
+		return prepared, nil
+	}
+
+	prepared, err := NewPreparedStatement(query)
+	if err != nil {
+		return nil, err
+	}
+	db.statements.putPrepared(query, prepared)
+
+	return prepared, nil
+}
+
+// StatementCacheStats returns the counters of the statement cache,
+// the zero stats if the cache is disabled.
+func (db *Database) StatementCacheStats() StatementCacheStats {
+	if db.statements == nil {
+		return StatementCacheStats{}
+	}
+
+	return db.statements.currentStats()
+}
+
+// schemaChanged invalidates the cached plans, it must be called
+// with the database lock held after every change of the table schemas.
+func (db *Database) schemaChanged() {
+	db.schemaVersion++
+	if db.results != nil {
+		db.results.clear()
+	}
+}
+
+// accessPlan validates the WHERE part against the table and chooses
+// the data files to scan, the plans of the cached statements are
+// reused until the schema changes.
+func (db *Database) accessPlan(ctx context.Context, operation string, schema Schema, where *sql.Where) ([]string, error) {
+	_, span := tracing.Start(ctx, "plan", "db.operation", operation, "db.table", schema.Name)
+	defer span.End()
+
+	if where != nil && db.statements != nil {
+		if storages, cached := db.statements.plan(where, schema.Name, db.schemaVersion); cached {
+			span.SetAttributes("db.plan_cached", true, "db.storages", len(storages))
+			return storages, nil
+		}
+	}
+
+	if err := validateWhere(schema, where); err != nil {
+		span.Fail(err)
+		return nil, err
+	}
+
+	storages := db.plan(operation, schema, where).Storages
+	span.SetAttributes("db.plan_cached", false, "db.storages", len(storages))
+	if where != nil && db.statements != nil {
+		db.statements.setPlan(where, schema.Name, db.schemaVersion, storages)
+	}
+
+	return storages, nil
+}
@@ -0,0 +1,275 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// placeholderMarker starts the string literal that replaces the
+// placeholder before the query is parsed, queries with the marker
+// itself are rejected, so the literal can not be confused with
+// a value.
+const placeholderMarker = "\x00"
+
+// PreparedStatement is a query parsed once and executed many times
+// with different parameters. The parameters are referenced by the
+// $1, $2, ... placeholders that can be used instead of values:
+//
+//	SELECT id, name FROM users WHERE id == $1
+//	INSERT INTO users (id, name) VALUES ($1, $2)
+//	UPDATE users SET name = $2 WHERE id == $1
+//
+// The values are bound to the parsed statement and never become
+// a part of the query text.
+type PreparedStatement struct {
+	// ID identifies the statement registered in the database.
+	ID string
+	// Query is the query text with the placeholders.
+	Query string
+	// Params is the number of the parameters.
+	Params int
+
+	statement sql.Statement
+}
+
+// NewPreparedStatement parses the query with the placeholders,
+// the statement is not registered.
+func NewPreparedStatement(query string) (*PreparedStatement, error) {
+	if strings.Contains(query, placeholderMarker) {
+		return nil, fmt.Errorf("query must not contain NUL characters")
+	}
+
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", syntaxError(err))
+	}
+
+	var b strings.Builder
+	last := 0
+	used := make(map[int]bool)
+	params := 0
+	for _, t := range tokens {
+		if t.kind != tokenPlaceholder {
+			continue
+		}
+
+		n, err := strconv.Atoi(t.value[1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid placeholder %s", t)
+		}
+		used[n] = true
+		if n > params {
+			params = n
+		}
+
+		b.WriteString(query[last:t.pos])
+		b.WriteString(placeholderLiteral(n))
+		last = t.pos + len(t.value)
+	}
+	b.WriteString(query[last:])
+
+	for n := 1; n <= params; n++ {
+		if !used[n] {
+			return nil, fmt.Errorf("placeholder $%d is not used", n)
+		}
+	}
+
+	statement, err := parseStatement(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", syntaxError(err))
+	}
+
+	switch statement.(type) {
+	case *sql.Select, *OrderedSelect, *GroupedSelect, *sql.Insert, *sql.Update, *sql.Delete:
+	default:
+		if params > 0 {
+			return nil, fmt.Errorf("placeholders are supported only in SELECT, INSERT, UPDATE and DELETE, got %T", statement)
+		}
+	}
+
+	return &PreparedStatement{Query: query, Params: params, statement: statement}, nil
+}
+
+// placeholderLiteral is the string literal that replaces
+// the placeholder in the query.
+func placeholderLiteral(n int) string {
+	return `"` + placeholderMarker + strconv.Itoa(n) + `"`
+}
+
+// Bind returns the statement with the placeholders replaced by the
+// arguments, $1 is the first argument. The arguments must be integers
+// or strings, integral float64 values are accepted as integers.
+func (p *PreparedStatement) Bind(args ...interface{}) (sql.Statement, error) {
+	if len(args) != p.Params {
+		return nil, newError(CodeInvalidParameter, "expected %d parameters, got %d", p.Params, len(args))
+	}
+
+	if p.Params == 0 {
+		return p.statement, nil
+	}
+
+	literals := make(map[string]sql.Expr, len(args))
+	for i, arg := range args {
+		expr, err := ValueExpr(arg)
+		if err != nil {
+			return nil, newError(CodeInvalidParameter, "invalid parameter $%d: %w", i+1, err)
+		}
+		literals[placeholderLiteral(i+1)] = expr
+	}
+
+	switch s := p.statement.(type) {
+	case *sql.Select:
+		bound := *s
+		bound.Where = bindWhere(s.Where, literals)
+
+		return &bound, nil
+	case *OrderedSelect:
+		bound := *s.Select
+		bound.Where = bindWhere(s.Where, literals)
+
+		return &OrderedSelect{&bound, s.OrderBy}, nil
+	case *GroupedSelect:
+		bound := *s.Select
+		bound.Where = bindWhere(s.Where, literals)
+
+		return &GroupedSelect{&bound, s.Items, s.GroupBy, s.OrderBy}, nil
+	case *sql.Insert:
+		bound := *s
+		bound.Values = bindValues(s.Values, literals)
+
+		return &bound, nil
+	case *sql.Update:
+		bound := *s
+		bound.Values = bindValues(s.Values, literals)
+		bound.Where = bindWhere(s.Where, literals)
+
+		return &bound, nil
+	case *sql.Delete:
+		bound := *s
+		bound.Where = bindWhere(s.Where, literals)
+
+		return &bound, nil
+	}
+
+	return nil, fmt.Errorf("unsupported statement %T", p.statement)
+}
+
+// ValueExpr converts the integer or the string to the value expression.
+func ValueExpr(arg interface{}) (sql.Expr, error) {
+	switch v := arg.(type) {
+	case int:
+		return sql.ExprValueInteger{Value: strconv.Itoa(v)}, nil
+	case float64:
+		// JSON numbers are exact up to 2^53
+		if math.Trunc(v) != v || math.Abs(v) > 1<<53 {
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+
+		return sql.ExprValueInteger{Value: strconv.Itoa(int(v))}, nil
+	case string:
+		return sql.ExprValueString{Value: quoteString(v)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %T, expected integer or string", arg)
+}
+
+func bindWhere(where *sql.Where, literals map[string]sql.Expr) *sql.Where {
+	if where == nil {
+		return nil
+	}
+
+	return &sql.Where{Expr: bindExpr(where.Expr, literals)}
+}
+
+func bindExpr(expr sql.Expr, literals map[string]sql.Expr) sql.Expr {
+	switch e := expr.(type) {
+	case sql.ExprOperation:
+		return sql.ExprOperation{
+			Left:     bindExpr(e.Left, literals),
+			Operator: e.Operator,
+			Right:    bindExpr(e.Right, literals),
+		}
+	case sql.ExprValueString:
+		if literal, exists := literals[e.Value]; exists {
+			return literal
+		}
+	}
+
+	return expr
+}
+
+func bindValues(values []string, literals map[string]sql.Expr) []string {
+	bound := make([]string, len(values))
+	for i, value := range values {
+		bound[i] = value
+		switch literal := literals[value].(type) {
+		case sql.ExprValueInteger:
+			bound[i] = literal.Value
+		case sql.ExprValueString:
+			bound[i] = literal.Value
+		}
+	}
+
+	return bound
+}
+
+// preparedStatements is a registry of the prepared statements
+// by their identifiers.
+type preparedStatements struct {
+	mu         sync.Mutex
+	lastID     int
+	statements map[string]*PreparedStatement
+}
+
+func newPreparedStatements() *preparedStatements {
+	return &preparedStatements{statements: make(map[string]*PreparedStatement)}
+}
+
+// Prepare parses the query with the placeholders and registers
+// the statement, so it can be executed by its identifier.
+func (db *Database) Prepare(query string) (*PreparedStatement, error) {
+	statement, err := NewPreparedStatement(query)
+	if err != nil {
+		return nil, err
+	}
+
+	db.prepared.mu.Lock()
+	defer db.prepared.mu.Unlock()
+
+	db.prepared.lastID++
+	statement.ID = strconv.Itoa(db.prepared.lastID)
+	db.prepared.statements[statement.ID] = statement
+
+	return statement, nil
+}
+
+// PreparedStatement returns the registered prepared statement.
+func (db *Database) PreparedStatement(id string) (*PreparedStatement, error) {
+	db.prepared.mu.Lock()
+	defer db.prepared.mu.Unlock()
+
+	statement, exists := db.prepared.statements[id]
+	if !exists {
+		return nil, newError(CodeUndefinedObject, "prepared statement %s does not exist", id)
+	}
+
+	return statement, nil
+}
+
+// Deallocate removes the registered prepared statement.
+func (db *Database) Deallocate(id string) error {
+	db.prepared.mu.Lock()
+	defer db.prepared.mu.Unlock()
+
+	if _, exists := db.prepared.statements[id]; !exists {
+		return newError(CodeUndefinedObject, "prepared statement %s does not exist", id)
+	}
+	delete(db.prepared.statements, id)
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// processListTable lists the running queries, SHOW PROCESSLIST
+// is the shorthand of the selection from it.
+const processListTable = "information_schema_processlist"
+
+// Kill represents KILL [QUERY] id statement that cancels
+// the running query with the identifier from SHOW PROCESSLIST.
+type Kill struct {
+	QueryID int
+}
+
+// GetType returns the statement type.
+func (*Kill) GetType() sql.StatementType { return StatementKill }
+
+// parseKill parses KILL statement.
+func parseKill(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("KILL")
+	s.acceptKeyword("QUERY")
+
+	id, err := s.expectInteger()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Kill{id}, s.expectEnd()
+}
+
+// parseShowProcessList parses SHOW PROCESSLIST statement
+// into the selection of all the running queries.
+func parseShowProcessList(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SHOW", "PROCESSLIST")
+	if err := s.expectEnd(); err != nil {
+		return nil, err
+	}
+
+	columns := sortedColumns(virtualTables[processListTable].schema)
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+
+	return &sql.Select{Table: processListTable, Columns: names}, nil
+}
+
+// runningQuery is the query registered by StartQuery.
+type runningQuery struct {
+	id      int
+	user    string
+	client  string
+	text    string
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+// runningQueryKey is the context key of the running query.
+type runningQueryKey struct{}
+
+// queryText returns the text of the query started with the context,
+// the redacted one, so it can be logged.
+func queryText(ctx context.Context) (string, bool) {
+	q, ok := ctx.Value(runningQueryKey{}).(*runningQuery)
+	if !ok {
+		return "", false
+	}
+
+	return q.text, true
+}
+
+// queryUser returns the user of the query started with the context,
+// empty if there is none.
+func queryUser(ctx context.Context) string {
+	q, ok := ctx.Value(runningQueryKey{}).(*runningQuery)
+	if !ok {
+		return ""
+	}
+
+	return q.user
+}
+
+// processList is the registry of the running queries, it has
+// its own lock as KILL must not wait for the database lock held
+// by the query it cancels.
+type processList struct {
+	mu      sync.Mutex
+	lastID  int
+	queries map[int]*runningQuery
+}
+
+func newProcessList() *processList {
+	return &processList{queries: make(map[int]*runningQuery)}
+}
+
+// StartQuery registers the running query of the user and returns
+// the context that is canceled by KILL, the returned function must
+// be called when the query is executed.
+func (db *Database) StartQuery(ctx context.Context, userName string, client string, text string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	p := db.processes
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastID++
+	q := &runningQuery{
+		id:      p.lastID,
+		user:    strings.ToLower(userName),
+		client:  client,
+		text:    redactPasswords(text),
+		started: time.Now(),
+		cancel:  cancel,
+	}
+	p.queries[q.id] = q
+
+	return context.WithValue(ctx, runningQueryKey{}, q), func() {
+		p.mu.Lock()
+		delete(p.queries, q.id)
+		p.mu.Unlock()
+
+		cancel()
+	}
+}
+
+// Kill cancels the running query, it fails with ErrQueryCanceled.
+func (db *Database) Kill(query *Kill) error {
+	p := db.processes
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q, exists := p.queries[query.QueryID]
+	if !exists {
+		return fmt.Errorf("query %d is not running", query.QueryID)
+	}
+	q.cancel()
+
+	return nil
+}
+
+// queryOwner returns the user of the running query,
+// false if the query is not running.
+func (p *processList) queryOwner(id int) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q, exists := p.queries[id]
+	if !exists {
+		return "", false
+	}
+
+	return q.user, true
+}
+
+// authorizeKill allows the users and the tokens
+// to kill only their own queries.
+func (db *Database) authorizeKill(principal string, query *Kill) error {
+	owner, running := db.processes.queryOwner(query.QueryID)
+	if running && owner != strings.ToLower(principal) {
+		return fmt.Errorf("%w, query %d is run by another user", ErrPermissionDenied, query.QueryID)
+	}
+
+	return nil
+}
+
+// processRows describes the running queries in the start order.
+func (db *Database) processRows() [][]interface{} {
+	p := db.processes
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queries := make([]*runningQuery, 0, len(p.queries))
+	for _, q := range p.queries {
+		queries = append(queries, q)
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].id < queries[j].id })
+
+	now := time.Now()
+	rows := make([][]interface{}, 0, len(queries))
+	for _, q := range queries {
+		elapsed := int(now.Sub(q.started) / time.Millisecond)
+		rows = append(rows, []interface{}{q.id, q.user, q.client, q.text, q.started.UTC().Format(time.RFC3339), elapsed})
+	}
+
+	return rows
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// logQuery records the executed statement in the audit log and logs it
+// with the debug level, the statements running longer than the slow
+// query threshold are logged with the warn level together with their plans.
+func (db *Database) logQuery(ctx context.Context, q sql.Statement, started time.Time, rows int, err error) {
+	db.audit(ctx, q, rows, err)
+
+	duration := time.Since(started)
+	slow := db.options.SlowQueryThreshold > 0 && duration >= db.options.SlowQueryThreshold
+	if !slow && !logging.Enabled(logging.Debug) {
+		return
+	}
+
+	text, ok := queryText(ctx)
+	if !ok {
+		text = fmt.Sprintf("%T", q)
+	}
+
+	fields := []interface{}{"query", text, "duration_ms", float64(duration) / float64(time.Millisecond), "rows", rows}
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+
+	logger := logging.FromContext(ctx)
+	if !slow {
+		logger.Log(logging.Debug, "executed query", fields...)
+		return
+	}
+
+	if plan := db.queryPlan(q); plan != "" {
+		fields = append(fields, "plan", plan)
+	}
+	logger.Log(logging.Warn, "slow query", fields...)
+}
+
+// queryPlan returns the plan of the statement in a single line,
+// empty for the statements without a plan.
+func (db *Database) queryPlan(q sql.Statement) string {
+	switch q.(type) {
+	case *sql.Select, *OrderedSelect, *GroupedSelect, *sql.Update, *sql.Delete:
+	default:
+		return ""
+	}
+
+	plan, err := db.Explain(&Explain{Statement: q})
+	if err != nil {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimSpace(plan.String()), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+
+	return strings.Join(lines, "; ")
+}
+
+// affectedRows returns the number of the selected or
+// the affected rows of the statement result.
+func affectedRows(result interface{}) int {
+	switch r := result.(type) {
+	case [][]interface{}:
+		return len(r)
+	case int:
+		return r
+	default:
+		return 0
+	}
+}
+
+// countRows returns f that also counts the rows passed to it.
+func countRows(rows *int, f func(row []interface{}) error) func(row []interface{}) error {
+	return func(row []interface{}) error {
+		*rows++
+
+		return f(row)
+	}
+}
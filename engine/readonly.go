@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// ErrReadOnly is returned for the statements that change the data,
+// the schema, the users or the tokens while the database is read-only.
+var ErrReadOnly = errors.New("the database is read-only")
+
+// ErrReadOnlyTransaction is returned for the changes
+// within the read-only transactions.
+var ErrReadOnlyTransaction = errors.New("the transaction is read-only")
+
+// SetReadOnly represents SET DATABASE READ ONLY and
+// SET DATABASE READ WRITE statements.
+type SetReadOnly struct {
+	ReadOnly bool
+}
+
+// GetType returns the statement type.
+func (*SetReadOnly) GetType() sql.StatementType { return StatementSetReadOnly }
+
+// parseSetReadOnly parses SET DATABASE READ ONLY and
+// SET DATABASE READ WRITE statements.
+func parseSetReadOnly(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SET", "DATABASE")
+	switch {
+	case s.acceptKeyword("READ", "ONLY"):
+		return &SetReadOnly{true}, s.expectEnd()
+	case s.acceptKeyword("READ", "WRITE"):
+		return &SetReadOnly{false}, s.expectEnd()
+	default:
+		return nil, s.unexpected("READ ONLY or READ WRITE")
+	}
+}
+
+// ReadOnly reports whether the database rejects the changes.
+func (db *Database) ReadOnly() bool {
+	return atomic.LoadInt32(&db.readOnly) != 0
+}
+
+// SetReadOnly switches the database into or out of the read-only mode.
+// The transactions that have already changed the data can still be
+// committed or rolled back.
+func (db *Database) SetReadOnly(readOnly bool) {
+	var value int32
+	if readOnly {
+		value = 1
+	}
+
+	if atomic.SwapInt32(&db.readOnly, value) != value {
+		if readOnly {
+			logging.Warnf("the database is read-only from now on")
+		} else {
+			logging.Infof("the database is writable from now on")
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// RenameTable represents ALTER TABLE ... RENAME TO statement.
+type RenameTable struct {
+	Table   string
+	NewName string
+}
+
+// GetType returns the statement type.
+func (*RenameTable) GetType() sql.StatementType { return StatementRenameTable }
+
+// RenameTable renames the table with its data files, the schema keeps
+// the columns, the masks, the triggers and the statistics. The table
+// stays in its schema, the unqualified new name is in it too. The data
+// files are linked under the new names before the meta file is stored
+// and the old names are removed after it, so the data files of the
+// stored tables exist whenever the rename is interrupted.
+func (db *Database) RenameTable(query *RenameTable) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(context.Background(), l, tableResource(tableName), lockExclusive); err != nil {
+		return err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	newName, err := renamedTableName(tableName, query.NewName)
+	if err != nil {
+		return err
+	}
+
+	if !isValidTableNameFormat(newName) {
+		return fmt.Errorf("table name %s is not valid, expected format: %s", query.NewName, tableNameRegExp)
+	}
+
+	if _, exists := db.tables[newName]; exists {
+		return newError(CodeDuplicateTable, "table %s exists (table names are case-insensitive)", query.NewName)
+	}
+
+	if _, exists := virtualTables[newName]; exists {
+		return fmt.Errorf("table name %s is reserved", query.NewName)
+	}
+
+	if err := db.checkTableSchema(newName); err != nil {
+		return err
+	}
+
+	// the storages of the partitions and the segments
+	// are named after the table
+	oldNames := schema.storageNames()
+	newNames := make([]string, len(oldNames))
+	for i, name := range oldNames {
+		newNames[i] = newName + strings.TrimPrefix(name, tableName)
+	}
+
+	if !schema.InMemory {
+		if err := db.linkStorages(oldNames, newNames); err != nil {
+			return err
+		}
+	}
+
+	renamed := schema
+	renamed.Name = newName
+	if len(schema.Segments) > 0 {
+		renamed.Segments = make(map[string]int, len(schema.Segments))
+		for name, last := range schema.Segments {
+			renamed.Segments[newName+strings.TrimPrefix(name, tableName)] = last
+		}
+	}
+
+	delete(db.tables, tableName)
+	db.replaceSchema(renamed)
+	if err := db.storeTables(); err != nil {
+		delete(db.tables, newName)
+		db.tables[tableName] = schema
+		db.removeStorages(newNames)
+
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	for i, name := range oldNames {
+		if data, exists := db.data[name]; exists {
+			db.data[newNames[i]] = data
+			delete(db.data, name)
+		}
+		if db.mapped[name] {
+			db.mapped[newNames[i]] = true
+			delete(db.mapped, name)
+		}
+	}
+	db.changedCSN[newName] = db.csn
+	delete(db.changedCSN, tableName)
+
+	if !schema.InMemory {
+		db.removeStorages(oldNames)
+	}
+
+	return db.renameGrants(tableName, newName)
+}
+
+// renamedTableName returns the new name of the table, the unqualified
+// name is resolved in the schema of the table as the tables are not
+// moved between the schemas.
+func renamedTableName(tableName string, newName string) (string, error) {
+	schema, newName := tableSchema(strings.ToLower(tableName)), strings.ToLower(newName)
+	newSchema := tableSchema(newName)
+	if newSchema == "" && schema != "" {
+		return qualifiedTableName(schema, newName), nil
+	}
+
+	if newSchema != schema {
+		if newSchema == "" {
+			newSchema = PublicSchema
+		}
+
+		return "", fmt.Errorf("table %s can not be moved to schema %s, only renamed within its schema", tableName, newSchema)
+	}
+
+	return newName, nil
+}
+
+// linkStorages links the data files and their checksums under the new
+// names, the new files are archived as they are on disk. The encrypted
+// files are encrypted again as their names are authenticated.
+func (db *Database) linkStorages(oldNames []string, newNames []string) error {
+	for i, name := range oldNames {
+		oldPath, newPath := tableFilePath(db.dbDir, name), tableFilePath(db.dbDir, newNames[i])
+		links := map[string]string{oldPath: newPath, checksumFilePath(oldPath): checksumFilePath(newPath)}
+		for oldPath, newPath := range links {
+			// the files left by an interrupted rename
+			if err := os.Remove(newPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove file %s: %w", newPath, err)
+			}
+
+			link := os.Link
+			if db.encryption != nil {
+				link = db.reencryptAs
+			}
+			if err := link(oldPath, newPath); err != nil && !os.IsNotExist(err) {
+				db.removeStorages(newNames[:i+1])
+				return fmt.Errorf("failed to link file %s to %s: %w", oldPath, newPath, err)
+			}
+		}
+
+		if err := db.archiveStorage(newNames[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reencryptAs writes the decrypted content of the file
+// into the new file encrypted under its name.
+func (db *Database) reencryptAs(oldPath string, newPath string) error {
+	content, err := readFileContent(oldPath, db.encryption)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := db.encryption.seal(content, path.Base(newPath))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", newPath, err)
+	}
+
+	if err := ioutil.WriteFile(newPath, sealed, 0644); err != nil {
+		return err
+	}
+
+	return syncFile(newPath)
+}
+
+// removeStorages removes the data files and their checksums, the
+// failures are logged as the files are not used any more.
+func (db *Database) removeStorages(names []string) {
+	for _, name := range names {
+		filePath := tableFilePath(db.dbDir, name)
+		for _, filePath := range []string{filePath, checksumFilePath(filePath)} {
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				logging.Errorf("failed to remove file %s: %s", filePath, err)
+				continue
+			}
+
+			if err := db.archiveFile(filePath, nil, true); err != nil {
+				logging.Errorf("failed to archive removal of file %s: %s", filePath, err)
+			}
+		}
+	}
+}
+
+// renameGrants moves the privileges on the table to its new name.
+func (db *Database) renameGrants(tableName string, newName string) error {
+	changed := false
+	for _, u := range db.users {
+		if privileges, exists := u.Grants[tableName]; exists {
+			u.Grants[newName] = privileges
+			delete(u.Grants, tableName)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := db.storeUsers(); err != nil {
+		return fmt.Errorf("table %s is renamed, but its grants are not: %w", tableName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRenameTableWithinSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	execute := func(statement string) (interface{}, error) {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		return db.Execute(q)
+	}
+
+	for _, statement := range []string{
+		`CREATE SCHEMA s`,
+		`CREATE SCHEMA other`,
+		`CREATE TABLE s.a (x INTEGER)`,
+		`INSERT INTO s.a (x) VALUES (1)`,
+		`CREATE TABLE p (x INTEGER)`,
+		`ALTER TABLE s.a RENAME TO b`,
+		`ALTER TABLE s.b RENAME TO s.c`,
+	} {
+		if _, err := execute(statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+
+	rows, err := execute(`SELECT x FROM s.c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]interface{}{{1}}; !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, got %v", expected, rows)
+	}
+
+	for _, statement := range []string{
+		`ALTER TABLE s.c RENAME TO other.c`,
+		`ALTER TABLE p RENAME TO s.p`,
+	} {
+		if _, err := execute(statement); err == nil {
+			t.Errorf("%s: expected the table not to be moved to another schema", statement)
+		}
+	}
+}
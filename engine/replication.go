@@ -0,0 +1,782 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The replication ships the archive of the primary to the replicas.
+// A new replica copies the snapshot of the primary files first and
+// then applies the archive records that follow the snapshot as they
+// are appended. The changes of a transaction are applied together
+// when its commit arrives and are dropped on its rollback, so the
+// replica reads only the committed data. The replica executes only
+// the statements that do not change the data.
+
+// ErrArchiveDisabled is returned when the primary
+// does not archive the changed files.
+var ErrArchiveDisabled = errors.New("the archive is disabled, the replication requires it")
+
+// ErrReadOnlyReplica is returned for the statements that
+// change the data of the replica.
+var ErrReadOnlyReplica = errors.New("the replica is read-only, the data is changed on the primary")
+
+// replicaStateFileName is the name of the file that stores the
+// sequence number of the archive record the replica resumes after.
+const replicaStateFileName = "gosqldb.replica.json"
+
+// ReplicationRecord is the archive record with the file content
+// shipped to the replicas.
+type ReplicationRecord struct {
+	Sequence uint64
+	// Time is when the record has been archived by the primary.
+	Time time.Time
+	// File is the name of the replaced or removed file,
+	// empty for the commits and the rollbacks.
+	File    string
+	Removed bool
+	Content []byte
+	// Transaction has written the file or has ended, empty
+	// for the changes outside of the transactions.
+	Transaction string
+	Commit      bool
+	Rollback    bool
+	// Term is the cluster term of the leader that has
+	// written the record, zero outside of the clusters.
+	Term uint64
+}
+
+// SnapshotFile is the file of the snapshot a new replica starts from.
+type SnapshotFile struct {
+	// Name is the slash-separated path relative to the db directory.
+	Name    string
+	Content []byte
+}
+
+// ReplicaStatus describes how far the replica is behind the primary.
+type ReplicaStatus struct {
+	// Connected is true while the replica receives the records.
+	Connected bool `json:"connected"`
+	// Sequence is the sequence number of the last received record.
+	Sequence uint64 `json:"sequence"`
+	// Applied is when the last received record has been archived
+	// by the primary.
+	Applied time.Time `json:"applied"`
+	// PrimarySequence is the sequence number of the last record
+	// of the primary archive known to the replica.
+	PrimarySequence uint64 `json:"primary_sequence"`
+	// Heartbeat is when the primary has been heard from.
+	Heartbeat time.Time `json:"heartbeat"`
+	// LagRecords is the number of the records not yet received.
+	LagRecords uint64 `json:"lag_records"`
+	// LagSeconds is how old the last received record is when the
+	// replica is behind, zero when it has received everything.
+	LagSeconds float64 `json:"lag_seconds"`
+	// PendingTransactions is the number of the transactions
+	// whose changes wait for the commit.
+	PendingTransactions int `json:"pending_transactions"`
+	// Term is the cluster term of the last received record.
+	Term uint64 `json:"term,omitempty"`
+}
+
+// replica is the replication state of the replica database,
+// it is used with the database lock held.
+type replica struct {
+	status ReplicaStatus
+	// transactions are the records of the uncommitted
+	// transactions by their identifiers
+	transactions map[string][]ReplicationRecord
+	// held are the data files replaced outside of the transactions
+	// by their names, they are applied with their checksums
+	held map[string]ReplicationRecord
+	// received is the last received record before the restart, the
+	// records after the resume sequence are received again
+	received replicaPosition
+	// promoted is true if the replica has been the primary and has
+	// not copied the snapshot of the leader since
+	promoted bool
+}
+
+// replicaPosition is the last record the replica has received.
+type replicaPosition struct {
+	Sequence uint64 `json:"sequence"`
+	Term     uint64 `json:"term,omitempty"`
+}
+
+// replicaState is the content of the replica state file.
+type replicaState struct {
+	// Sequence is the record the replica resumes after.
+	Sequence uint64 `json:"sequence"`
+	// Promoted is true if the replica has become the primary.
+	Promoted bool `json:"promoted,omitempty"`
+	// Received is the last received record.
+	Received replicaPosition `json:"received"`
+}
+
+// readReplicaState reads the replica state,
+// false if the replica has not been bootstrapped.
+func readReplicaState(dbDir string) (replicaState, bool, error) {
+	var state replicaState
+	filePath := path.Join(dbDir, replicaStateFileName)
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, false, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	return state, true, nil
+}
+
+// writeReplicaState stores the record the replica resumes after
+// and the last received record.
+func writeReplicaState(dbDir string, sequence uint64, received replicaPosition) error {
+	content, err := json.Marshal(replicaState{Sequence: sequence, Received: received})
+	if err != nil {
+		return fmt.Errorf("failed to encode replica state: %w", err)
+	}
+
+	return restoreFile(dbDir, replicaStateFileName, content)
+}
+
+// newReplica returns the replica state, the records are resumed
+// after the stored sequence number.
+func newReplica(dbDir string) (*replica, error) {
+	state, _, err := readReplicaState(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	sequence := state.Sequence
+
+	return &replica{
+		status:       ReplicaStatus{Sequence: sequence, PrimarySequence: sequence},
+		transactions: make(map[string][]ReplicationRecord),
+		held:         make(map[string]ReplicationRecord),
+		received:     state.Received,
+		promoted:     state.Promoted,
+	}, nil
+}
+
+// ReplicaBootstrapped reports whether the snapshot of the primary
+// has been completely written into the db directory.
+func ReplicaBootstrapped(dbDir string) (bool, error) {
+	_, exists, err := readReplicaState(dbDir)
+
+	return exists, err
+}
+
+// ReplicaBootstrap writes the snapshot of the primary
+// into the new or empty db directory.
+type ReplicaBootstrap struct {
+	dbDir string
+}
+
+// NewReplicaBootstrap prepares the locked db directory for
+// the snapshot, there must be nothing but the lock file.
+func NewReplicaBootstrap(dbDir string) (*ReplicaBootstrap, error) {
+	entries, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dbDir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.Name() != lockFileName {
+			return nil, fmt.Errorf("directory %s is not empty, the replica is bootstrapped into the empty one", dbDir)
+		}
+	}
+
+	return &ReplicaBootstrap{dbDir}, nil
+}
+
+// WriteFile writes the snapshot file.
+func (b *ReplicaBootstrap) WriteFile(f SnapshotFile) error {
+	name := path.Clean(f.Name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("snapshot file %s is outside of the db directory", f.Name)
+	}
+
+	return restoreFile(b.dbDir, name, f.Content)
+}
+
+// Finish marks the snapshot complete, the replica
+// resumes after the record with the sequence number.
+func (b *ReplicaBootstrap) Finish(sequence uint64) error {
+	if err := writeReplicaState(b.dbDir, sequence, replicaPosition{Sequence: sequence}); err != nil {
+		return err
+	}
+
+	return syncDir(b.dbDir)
+}
+
+// ArchiveSequence returns the sequence number of the last archive
+// record, zero if the archive is disabled.
+func (db *Database) ArchiveSequence() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.archiver == nil {
+		return 0
+	}
+
+	return db.archiver.sequence
+}
+
+// ReplicationSnapshot passes the files of the database to the function
+// and returns the sequence number of the record the replica resumes
+// after. The snapshot has the changes of the active transactions, and
+// their journals, so the replica rolls them back on start and receives
+// them again from their first records.
+func (db *Database) ReplicationSnapshot(f func(SnapshotFile) error) (uint64, error) {
+	files, sequence, err := db.openSnapshotFiles()
+	defer func() {
+		for _, f := range files {
+			checkFileClose(f.name, f.file.Close())
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadAll(io.LimitReader(file.file, file.size))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read file %s: %w", file.name, err)
+		}
+
+		if err := f(SnapshotFile{file.name, content}); err != nil {
+			return 0, err
+		}
+	}
+
+	return sequence, nil
+}
+
+// openSnapshotFiles opens the database files and returns the sequence
+// number of the record before the first record of the active transactions.
+func (db *Database) openSnapshotFiles() ([]backupFile, uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.archiver == nil {
+		return nil, 0, ErrArchiveDisabled
+	}
+
+	files, _, err := db.openFiles()
+	if err != nil {
+		return files, 0, err
+	}
+
+	sequence := db.archiver.sequence
+	for _, tx := range db.transactions {
+		if tx.archived > 0 && tx.archived-1 < sequence {
+			sequence = tx.archived - 1
+		}
+	}
+
+	return files, sequence, nil
+}
+
+// StreamArchive passes the archive records after the sequence number
+// to the function as they are appended, until the context is done
+// or the function fails.
+func (db *Database) StreamArchive(ctx context.Context, after uint64, f func(ReplicationRecord) error) error {
+	db.mu.Lock()
+	a := db.archiver
+	var last uint64
+	if a != nil {
+		last = a.sequence
+	}
+	db.mu.Unlock()
+
+	if a == nil {
+		return ErrArchiveDisabled
+	}
+
+	if after > last {
+		return fmt.Errorf("replica is at record %d after the last archive record %d", after, last)
+	}
+
+	var offset int64
+	for {
+		db.mu.Lock()
+		changed := a.changed
+		db.mu.Unlock()
+
+		records, read, err := readArchiveFrom(a.dir, offset)
+		if err != nil {
+			return err
+		}
+		offset += read
+
+		for _, record := range records {
+			if record.Sequence <= after {
+				continue
+			}
+
+			replicated, err := replicationRecord(a.dir, record)
+			if err != nil {
+				return err
+			}
+
+			if err := f(replicated); err != nil {
+				return err
+			}
+			after = record.Sequence
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readArchiveFrom reads the completely written records of the
+// archive index from the offset and returns the number of read bytes.
+func readArchiveFrom(dir string, offset int64) ([]archiveRecord, int64, error) {
+	indexPath := path.Join(dir, archiveIndexFileName)
+	index, err := os.Open(indexPath)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open file %s: %w", indexPath, err)
+	}
+	defer func() { checkFileClose(indexPath, index.Close()) }()
+
+	if _, err := index.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("failed to read file %s: %w", indexPath, err)
+	}
+
+	content, err := ioutil.ReadAll(index)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read file %s: %w", indexPath, err)
+	}
+	content = content[:bytes.LastIndexByte(content, '\n')+1]
+
+	records := make([]archiveRecord, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var record archiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode archive record from %s: %w", indexPath, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, int64(len(content)), scanner.Err()
+}
+
+// replicationRecord reads the archived file content of the record.
+func replicationRecord(dir string, record archiveRecord) (ReplicationRecord, error) {
+	replicated := ReplicationRecord{
+		Sequence:    record.Sequence,
+		Time:        record.Time,
+		File:        record.File,
+		Removed:     record.Removed,
+		Transaction: record.Transaction,
+		Commit:      record.Commit,
+		Rollback:    record.Rollback,
+		Term:        record.Term,
+	}
+
+	if record.File != "" && !record.Removed {
+		content, err := readVerified(archiveContentPath(dir, record.Sequence), record.Checksum)
+		if err != nil {
+			return ReplicationRecord{}, err
+		}
+		replicated.Content = content
+	}
+
+	return replicated, nil
+}
+
+// checkWritable fails for the statements that change the data of
+// the replica, of the fenced primary and of the read-only database,
+// and for the reads of the followers if the reads are served by
+// the leader.
+func (db *Database) checkWritable(q sql.Statement) error {
+	if !readOnlyStatement(q) {
+		if err := db.leadership.notLeader(); err != nil {
+			return err
+		}
+
+		if db.ReadOnly() {
+			return ErrReadOnly
+		}
+
+		if err := db.syncer.failed(); err != nil {
+			return err
+		}
+
+		return db.checkDiskSpace()
+	}
+
+	switch q.(type) {
+	case *sql.Select, *CountRows, *OrderedSelect, *GroupedSelect, *AsOfSelect, *Explain:
+		var notLeader *NotLeaderError
+		if db.options.LeaderReads && errors.As(db.leadership.notLeader(), &notLeader) {
+			return &NotLeaderError{Leader: notLeader.Leader, Err: ErrLeaderReads}
+		}
+	}
+
+	return nil
+}
+
+// ReadOnlyStatement reports whether the statement does not
+// change the data, the users and the tokens.
+func ReadOnlyStatement(q sql.Statement) bool {
+	return readOnlyStatement(q)
+}
+
+// readOnlyStatement reports whether the statement does not
+// change the data, the users and the tokens.
+func readOnlyStatement(q sql.Statement) bool {
+	switch query := q.(type) {
+	case *sql.Select, *CountRows, *OrderedSelect, *GroupedSelect, *AsOfSelect, *ShowIsolationLevel, *ShowCreateTable, *ShowSetting, *Kill, *Backup:
+		return true
+	case *Begin, *Commit, *Rollback, *Savepoint, *RollbackToSavepoint, *ReleaseSavepoint:
+		return true
+	case *SetTransaction, *SetSessionIsolation, *SetReadOnly, *UseDatabase, *SetSearchPath, *SetSetting:
+		return true
+	case *Explain:
+		return !query.Analyze || readOnlyStatement(query.Statement)
+	case *Copy:
+		return query.To
+	case *Flashback:
+		return query.DryRun
+	default:
+		return false
+	}
+}
+
+// SetReplicaConnected records whether the replica
+// is connected to the primary.
+func (db *Database) SetReplicaConnected(connected bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.replica != nil {
+		db.replica.status.Connected = connected
+	}
+}
+
+// ReplicaHeartbeat records the last archive record of the primary.
+func (db *Database) ReplicaHeartbeat(sequence uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.replica == nil {
+		return
+	}
+
+	db.replica.status.Heartbeat = time.Now().UTC()
+	if sequence > db.replica.status.PrimarySequence {
+		db.replica.status.PrimarySequence = sequence
+	}
+}
+
+// ReplicaStatus returns the replication status,
+// false if the database is not a replica.
+func (db *Database) ReplicaStatus() (ReplicaStatus, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.replica == nil {
+		return ReplicaStatus{}, false
+	}
+
+	return db.replica.currentStatus(), true
+}
+
+// currentStatus returns the status with the lag.
+func (r *replica) currentStatus() ReplicaStatus {
+	status := r.status
+	status.PendingTransactions = len(r.transactions)
+	if status.PrimarySequence > status.Sequence {
+		status.LagRecords = status.PrimarySequence - status.Sequence
+		if !status.Applied.IsZero() {
+			status.LagSeconds = time.Since(status.Applied).Seconds()
+		}
+	}
+
+	return status
+}
+
+// ReplicaSequence returns the sequence number of the last
+// received record, the stream of the primary resumes after it.
+func (db *Database) ReplicaSequence() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.replica == nil {
+		return 0
+	}
+
+	return db.replica.status.Sequence
+}
+
+// ApplyReplicated applies the record of the primary archive. The
+// records of the transactions wait for their commits, the replaced
+// data files wait for their checksums, so the readers of the replica
+// see only the complete changes.
+func (db *Database) ApplyReplicated(record ReplicationRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r := db.replica
+	if r == nil {
+		return fmt.Errorf("database is not a replica")
+	}
+
+	if record.Sequence != r.status.Sequence+1 {
+		return fmt.Errorf("replication record %d does not follow record %d", record.Sequence, r.status.Sequence)
+	}
+
+	var apply []ReplicationRecord
+	switch {
+	case record.Commit:
+		apply = r.transactions[record.Transaction]
+		delete(r.transactions, record.Transaction)
+	case record.Rollback:
+		delete(r.transactions, record.Transaction)
+	case record.Transaction != "":
+		r.transactions[record.Transaction] = append(r.transactions[record.Transaction], record)
+	case record.File == "":
+		// the start of the leader term
+	case record.File == replicaStateFileName:
+		// the state of the primary that is a replica itself
+	case strings.HasSuffix(record.File, tableFileExtension):
+		r.held[record.File] = record
+	case strings.HasSuffix(record.File, tableFileExtension+checksumFileExtension):
+		name := strings.TrimSuffix(record.File, checksumFileExtension)
+		if held, exists := r.held[name]; exists {
+			apply = append(apply, held)
+			delete(r.held, name)
+		}
+		apply = append(apply, record)
+	default:
+		apply = append(apply, record)
+	}
+
+	if err := db.applyRecords(apply); err != nil {
+		return fmt.Errorf("failed to apply replication record %d: %w", record.Sequence, err)
+	}
+
+	r.status.Sequence = record.Sequence
+	r.status.Applied = record.Time
+	r.status.Term = record.Term
+	if record.Sequence > r.status.PrimarySequence {
+		r.status.PrimarySequence = record.Sequence
+	}
+	if record.Sequence > r.received.Sequence {
+		r.received = replicaPosition{record.Sequence, record.Term}
+	}
+
+	return writeReplicaState(db.dbDir, r.resumeSequence(), r.received)
+}
+
+// resumeSequence returns the sequence number the stream resumes
+// after, the records that wait are received again.
+func (r *replica) resumeSequence() uint64 {
+	sequence := r.status.Sequence
+	for _, records := range r.transactions {
+		if records[0].Sequence-1 < sequence {
+			sequence = records[0].Sequence - 1
+		}
+	}
+
+	for _, record := range r.held {
+		if record.Sequence-1 < sequence {
+			sequence = record.Sequence - 1
+		}
+	}
+
+	return sequence
+}
+
+// applyRecords writes the files of the records and reloads the
+// tables, the data, the users and the tokens from the changed files.
+func (db *Database) applyRecords(records []ReplicationRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	changed := make(map[string]bool)
+	for _, record := range records {
+		filePath := path.Join(db.dbDir, path.Base(record.File))
+		if record.Removed {
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove file %s: %w", filePath, err)
+			}
+
+			if err := db.archiveFile(filePath, nil, true); err != nil {
+				return err
+			}
+		} else if err := db.writeFileBytes(filePath, record.Content); err != nil {
+			return err
+		}
+		changed[path.Base(record.File)] = true
+	}
+
+	return db.reloadReplicated(changed)
+}
+
+// reloadReplicated reloads the state from the changed files.
+func (db *Database) reloadReplicated(changed map[string]bool) error {
+	storages := make(map[string]bool)
+	if changed[metaFileName] {
+		tables, err := loadSchema(db.metaFilePath, db.encryption)
+		if err != nil {
+			return err
+		}
+		db.tables = tables
+		db.schemaChanged()
+
+		// the storages of the created tables are loaded,
+		// the ones of the removed tables are dropped
+		for _, schema := range tables {
+			for _, name := range schema.storageNames() {
+				if _, loaded := db.data[name]; !loaded && !db.mapped[name] {
+					storages[name] = true
+				}
+			}
+		}
+
+		for _, names := range []map[string]bool{db.mapped, loadedStorages(db.data)} {
+			for name := range names {
+				if !db.storageExists(name) {
+					delete(db.data, name)
+					delete(db.mapped, name)
+				}
+			}
+		}
+	}
+
+	if changed[usersFileName] {
+		users, err := loadUsers(db.dbDir, db.encryption)
+		if err != nil {
+			return err
+		}
+		db.users = users
+	}
+
+	if changed[schemasFileName] {
+		schemas, err := loadSchemas(db.dbDir, db.encryption)
+		if err != nil {
+			return err
+		}
+		db.schemas = schemas
+	}
+
+	if changed[sequencesFileName] {
+		sequences, err := loadSequences(db.dbDir, db.encryption)
+		if err != nil {
+			return err
+		}
+		db.sequences = sequences
+	}
+
+	if changed[tokensFileName] {
+		tokens, err := loadTokens(db.dbDir, db.encryption)
+		if err != nil {
+			return err
+		}
+		db.tokens = tokens
+	}
+
+	for name := range changed {
+		if strings.HasSuffix(name, tableFileExtension) {
+			storages[strings.TrimSuffix(name, tableFileExtension)] = true
+		}
+	}
+
+	for name := range storages {
+		if err := db.reloadStorage(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadedStorages returns the names of the storages loaded into memory.
+func loadedStorages(data map[string][]*rowVersion) map[string]bool {
+	names := make(map[string]bool, len(data))
+	for name := range data {
+		names[name] = true
+	}
+
+	return names
+}
+
+// storageExists reports whether the storage belongs to a table.
+func (db *Database) storageExists(name string) bool {
+	schema, exists := db.tables[strings.SplitN(name, ".", 2)[0]]
+	if !exists {
+		return false
+	}
+
+	for _, storage := range schema.storageNames() {
+		if storage == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reloadStorage reads the replaced data file of the table or
+// partition, the rows are visible to all the readers.
+func (db *Database) reloadStorage(name string) error {
+	if db.results != nil {
+		db.results.invalidate(strings.SplitN(name, ".", 2)[0])
+	}
+
+	if !db.storageExists(name) {
+		delete(db.data, name)
+		delete(db.mapped, name)
+		return nil
+	}
+
+	schema := db.tables[strings.SplitN(name, ".", 2)[0]]
+	filePath := tableFilePath(db.dbDir, name)
+	size, err := fileSize(filePath)
+	if err != nil {
+		return err
+	}
+
+	if isMappedStorage(db.options, schema.Name, size, db.mapped[name]) {
+		delete(db.data, name)
+		db.mapped[name] = true
+		return nil
+	}
+
+	rows, err := readStorage(filePath, schema, db.encryption)
+	if err != nil {
+		return err
+	}
+
+	db.data[name] = newVersions(rows, loadedRecord)
+	delete(db.mapped, name)
+
+	return nil
+}
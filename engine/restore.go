@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// RestoreOptions configures the restore from a backup.
+type RestoreOptions struct {
+	// ArchiveDir is the archive of the database, the changes archived
+	// after the backup are applied up to the target. Empty restores
+	// the backup as it is.
+	ArchiveDir string
+	// UntilTime is the last moment to restore, zero means the end
+	// of the archive.
+	UntilTime time.Time
+	// UntilSequence is the last archive record to restore, zero
+	// means the end of the archive.
+	UntilSequence uint64
+}
+
+// RestoreResult describes the restored database.
+type RestoreResult struct {
+	// Backup is the manifest of the restored backup.
+	Backup *BackupManifest
+	// Applied is the number of the applied archive records.
+	Applied int
+	// Sequence is the sequence number of the last applied
+	// archive record, the backup one if there are none.
+	Sequence uint64
+	// Time is the time of the last applied archive
+	// record, the backup one if there are none.
+	Time time.Time
+}
+
+// String describes the restored database.
+func (r *RestoreResult) String() string {
+	return fmt.Sprintf("restored %d files of the backup created at %s and %d archive records up to sequence %d at %s",
+		len(r.Backup.Files), r.Backup.Created.Format(time.RFC3339), r.Applied, r.Sequence, r.Time.Format(time.RFC3339Nano))
+}
+
+// Restore restores the backup into the new or empty db directory and
+// applies the archived changes, the checksums of the backup and the
+// archive files are verified. The database must not be opened.
+func Restore(backupDir string, dbDir string, options RestoreOptions) (*RestoreResult, error) {
+	if options.ArchiveDir == "" && (!options.UntilTime.IsZero() || options.UntilSequence > 0) {
+		return nil, fmt.Errorf("the point-in-time recovery requires the archive")
+	}
+
+	manifest, err := readBackupManifest(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createEmptyDir(dbDir); err != nil {
+		return nil, err
+	}
+
+	for name, sum := range manifest.Files {
+		content, err := readVerified(path.Join(backupDir, filepath.FromSlash(name)), sum)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := restoreFile(dbDir, name, content); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &RestoreResult{Backup: manifest, Sequence: manifest.ArchiveSequence, Time: manifest.Created}
+	if options.ArchiveDir != "" {
+		if err := applyArchive(dbDir, options, result); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, syncDir(dbDir)
+}
+
+// readBackupManifest reads the manifest of the complete backup.
+func readBackupManifest(backupDir string) (*BackupManifest, error) {
+	manifestPath := path.Join(backupDir, backupManifestFileName)
+	content, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not a complete backup, there is no %s", backupDir, backupManifestFileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", manifestPath, err)
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", manifestPath, err)
+	}
+
+	return &manifest, nil
+}
+
+// readVerified reads the file and compares its checksum.
+func readVerified(filePath string, sum string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	if actual := checksum(content); actual != sum {
+		return nil, fmt.Errorf("file %s is corrupted: checksum %s, expected %s", filePath, actual, sum)
+	}
+
+	return content, nil
+}
+
+// restoreFile writes the restored file into the db directory.
+func restoreFile(dbDir string, name string, content []byte) error {
+	filePath := path.Join(dbDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(path.Dir(filePath), 0700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", path.Dir(filePath), err)
+	}
+
+	if err := ioutil.WriteFile(filePath+tempFileExtension, content, 0644); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	}
+
+	// the file is flushed before it replaces the old one
+	if err := syncFile(filePath + tempFileExtension); err != nil {
+		return err
+	}
+
+	if err := os.Rename(filePath+tempFileExtension, filePath); err != nil {
+		return fmt.Errorf("failed to replace file %s: %w", filePath, err)
+	}
+
+	return syncDir(path.Dir(filePath))
+}
+
+// applyArchive applies the archive records after the backup up to
+// the target. The changes of the transactions that have not been
+// committed by the target are skipped, the journals of the ones
+// that have been are removed, so they are not rolled back on start.
+func applyArchive(dbDir string, options RestoreOptions, result *RestoreResult) error {
+	records, err := readArchive(options.ArchiveDir)
+	if err != nil {
+		return err
+	}
+
+	from := result.Backup.ArchiveSequence
+	if uint64(len(records)) < from {
+		return fmt.Errorf("archive %s ends at record %d before the backup at %d", options.ArchiveDir, len(records), from)
+	}
+
+	applied := make([]archiveRecord, 0)
+	committed := make(map[string]bool)
+	for _, record := range records[from:] {
+		if options.UntilSequence > 0 && record.Sequence > options.UntilSequence {
+			break
+		}
+
+		if !options.UntilTime.IsZero() && record.Time.After(options.UntilTime) {
+			break
+		}
+
+		applied = append(applied, record)
+		if record.Commit {
+			committed[record.Transaction] = true
+		}
+	}
+
+	for _, record := range applied {
+		result.Applied++
+		result.Sequence, result.Time = record.Sequence, record.Time
+		if record.File == "" || (record.Transaction != "" && !committed[record.Transaction]) {
+			continue
+		}
+
+		if record.Removed {
+			if err := os.Remove(path.Join(dbDir, record.File)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove file %s: %w", record.File, err)
+			}
+
+			continue
+		}
+
+		content, err := readVerified(archiveContentPath(options.ArchiveDir, record.Sequence), record.Checksum)
+		if err != nil {
+			return err
+		}
+
+		if err := restoreFile(dbDir, record.File, content); err != nil {
+			return err
+		}
+	}
+
+	for id := range committed {
+		journalDir := path.Join(dbDir, journalDirName, id)
+		if err := os.RemoveAll(journalDir); err != nil {
+			return fmt.Errorf("failed to remove journal %s: %w", journalDir, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The result cache keeps the rows selected outside of transactions by
+// the normalized statement, the table, the columns, the WHERE part with
+// the bound parameters and the limit, so the repeated identical SELECTs
+// are served from memory. The entries of the table are invalidated when
+// the changes of the table are committed and all of them when the schema
+// changes. The rows selected while the changes of the table have been
+// committed are not cached, they may be older than the cache. The cache
+// is limited by the estimated size of the rows, the least recently used
+// entries are evicted over the limit, and the entries expire after the
+// TTL if it is set.
+
+// ResultCacheStats counts the lookups of the result cache.
+type ResultCacheStats struct {
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+	MaxBytes      int64  `json:"max_bytes"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Expirations   uint64 `json:"expirations"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+// cachedResult is the entry of the result cache.
+type cachedResult struct {
+	key   string
+	table string
+	rows  [][]interface{}
+	size  int64
+	// expires is zero if the entry does not expire
+	expires time.Time
+}
+
+// resultCache is the LRU cache of the selected rows,
+// nil if the cache is disabled.
+type resultCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	// order has the most recently used entry first
+	order *list.List
+	// keys of the entries by table names
+	tables map[string]map[string]struct{}
+	bytes  int64
+	stats  ResultCacheStats
+	// memory accounts the cached rows, nil if they are not accounted
+	memory *memoryAccountant
+}
+
+func newResultCache(maxBytes int64, ttl time.Duration) *resultCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	return &resultCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		tables:   make(map[string]map[string]struct{}),
+	}
+}
+
+// account accounts the cached rows with the memory accountant,
+// the entries are evicted over the memory limit.
+func (c *resultCache) account(memory *memoryAccountant) {
+	if c != nil {
+		c.memory = memory
+	}
+}
+
+// resultKey is the normalized SELECT statement.
+func resultKey(query *sql.Select) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(query.Table))
+	b.WriteString("\x00")
+	for i, column := range query.Columns {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(strings.ToLower(column))
+	}
+	b.WriteString("\x00")
+	if query.Where != nil {
+		b.WriteString(exprString(query.Where.Expr))
+	}
+	b.WriteString("\x00")
+	b.WriteString(query.Limit)
+
+	return b.String()
+}
+
+// resultSize estimates the memory taken by the rows.
+func resultSize(rows [][]interface{}) int64 {
+	size := int64(0)
+	for _, row := range rows {
+		size += rowSize(row)
+	}
+
+	return size
+}
+
+// rowSize estimates the memory taken by the row.
+func rowSize(row []interface{}) int64 {
+	size := int64(24 + 16*len(row))
+	for _, value := range row {
+		if s, ok := value.(string); ok {
+			size += int64(len(s))
+		}
+	}
+
+	return size
+}
+
+// get returns the cached rows of the statement, the rows
+// are shared and must not be changed.
+func (c *resultCache) get(key string) ([][]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry := element.Value.(*cachedResult)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+
+	return entry.rows, true
+}
+
+// put caches the rows of the statement and evicts the least recently
+// used entries over the maximum size, the rows larger than a quarter
+// of the cache are not cached.
+func (c *resultCache) put(key string, table string, rows [][]interface{}) {
+	size := resultSize(rows) + int64(len(key))
+	if size > c.maxBytes/4 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		c.remove(element)
+	}
+
+	entry := &cachedResult{key: key, table: table, rows: rows, size: size}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	if c.tables[table] == nil {
+		c.tables[table] = make(map[string]struct{})
+	}
+	c.tables[table][key] = struct{}{}
+	c.bytes += size
+	within := c.memory == nil || c.memory.addCache(size)
+
+	for c.bytes > c.maxBytes || !within && c.order.Len() > 0 {
+		within = c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove removes the entry and reports whether the accounted memory
+// is within the limit, it must be called with the cache locked.
+func (c *resultCache) remove(element *list.Element) bool {
+	entry := c.order.Remove(element).(*cachedResult)
+	delete(c.entries, entry.key)
+	delete(c.tables[entry.table], entry.key)
+	if len(c.tables[entry.table]) == 0 {
+		delete(c.tables, entry.table)
+	}
+	c.bytes -= entry.size
+
+	return c.memory == nil || c.memory.addCache(-entry.size)
+}
+
+// invalidate removes the entries of the tables.
+func (c *resultCache) invalidate(tableNames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tableName := range tableNames {
+		for key := range c.tables[tableName] {
+			c.remove(c.entries[key])
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// clear removes all the entries.
+func (c *resultCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Invalidations += uint64(c.order.Len())
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.tables = make(map[string]map[string]struct{})
+	c.bytes = 0
+}
+
+func (c *resultCache) currentStats() ResultCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Bytes = c.bytes
+	stats.MaxBytes = c.maxBytes
+
+	return stats
+}
+
+// selectCached selects the rows of the table through the result cache,
+// it must be called with the database locked.
+func (db *Database) selectCached(ctx context.Context, query *sql.Select) ([][]interface{}, error) {
+	tableName := strings.ToLower(query.Table)
+	if _, exists := db.tables[tableName]; !exists {
+		return db.selectRows(ctx, query, nil, nil)
+	}
+
+	key := resultKey(query)
+	if rows, cached := db.results.get(key); cached {
+		return rows, nil
+	}
+
+	csn, version := db.csn, db.schemaVersion
+	rows, err := db.selectRows(ctx, query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the lock is released while the rows are scanned
+	if db.schemaVersion == version && db.changedCSN[tableName] <= csn {
+		db.results.put(key, tableName, rows)
+	}
+
+	return rows, nil
+}
+
+// ResultCacheStats returns the counters of the result cache,
+// the zero stats if the cache is disabled.
+func (db *Database) ResultCacheStats() ResultCacheStats {
+	if db.results == nil {
+		return ResultCacheStats{}
+	}
+
+	return db.results.currentStats()
+}
@@ -0,0 +1,227 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// versionColumn is the hidden column of the tables created WITH ROW
+// VERSION. The engine sets it to 1 on insert and increments it on
+// every update, the clients can not set it, but can read and filter
+// by it.
+const versionColumn = "_version"
+
+// ErrVersionConflict is returned when the row changed by UPDATE or
+// DELETE ... IF VERSION has a different version than expected: the row
+// has been changed since the client has read it.
+var ErrVersionConflict = errors.New("row version conflict")
+
+// CreateVersionedTable represents CREATE TABLE statement with
+// the WITH ROW VERSION clause, it goes after PARTITION BY.
+//
+//	CREATE TABLE t (id INTEGER, name STRING) WITH ROW VERSION
+type CreateVersionedTable struct {
+	*sql.CreateTable
+	// Partitioning is nil for not partitioned tables.
+	Partitioning *Partitioning
+	Generated    []GeneratedColumn
+}
+
+// GetType returns the statement type.
+func (*CreateVersionedTable) GetType() sql.StatementType { return StatementCreateVersionedTable }
+
+// UpdateIfVersion represents UPDATE statement with the IF VERSION
+// clause, it fails if any of the matched rows has another version.
+//
+//	UPDATE t SET name = "b" WHERE id == 1 IF VERSION 3
+type UpdateIfVersion struct {
+	*sql.Update
+	Version int
+}
+
+// GetType returns the statement type.
+func (*UpdateIfVersion) GetType() sql.StatementType { return StatementUpdateIfVersion }
+
+// DeleteIfVersion represents DELETE statement with the IF VERSION
+// clause, it fails if any of the matched rows has another version.
+//
+//	DELETE FROM t WHERE id == 1 IF VERSION 3
+type DeleteIfVersion struct {
+	*sql.Delete
+	Version int
+}
+
+// GetType returns the statement type.
+func (*DeleteIfVersion) GetType() sql.StatementType { return StatementDeleteIfVersion }
+
+// parseIfVersion parses UPDATE and DELETE with the IF VERSION clause,
+// the rest of the statement is parsed by gosqlparser.
+func parseIfVersion(query string, s *tokenStream) (sql.Statement, error) {
+	ifVersion, found := s.findKeyword("IF", "VERSION")
+	if !found {
+		return sql.Parse(protectEscapedQuotes(query))
+	}
+
+	statement, err := sql.Parse(protectEscapedQuotes(query[:ifVersion.pos]))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mustKeyword("IF", "VERSION")
+	version, err := s.expectInteger()
+	if err != nil {
+		return nil, err
+	}
+
+	if version < 1 {
+		return nil, fmt.Errorf("row versions start from 1, got %d", version)
+	}
+
+	if err := s.expectEnd(); err != nil {
+		return nil, err
+	}
+
+	switch statement := statement.(type) {
+	case *sql.Update:
+		return &UpdateIfVersion{statement, version}, nil
+	case *sql.Delete:
+		return &DeleteIfVersion{statement, version}, nil
+	}
+
+	return nil, fmt.Errorf("IF VERSION is supported only in UPDATE and DELETE, got %T", statement)
+}
+
+// CreateVersionedTable creates a table with the row version column.
+func (db *Database) CreateVersionedTable(query *CreateVersionedTable) error {
+	return db.createTable(query.CreateTable, Schema{Partitioning: query.Partitioning, RowVersion: true, Columns: generatedColumns(query.Generated)})
+}
+
+// UpdateIfVersion updates the rows if all of them have the version.
+func (db *Database) UpdateIfVersion(query *UpdateIfVersion) (int, error) {
+	return db.UpdateIfVersionContext(context.Background(), query)
+}
+
+// UpdateIfVersionContext is UpdateIfVersion canceled when
+// the context is done before the rows are written.
+func (db *Database) UpdateIfVersionContext(ctx context.Context, query *UpdateIfVersion) (int, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.update(ctx, query.Update, query.Version, nil, nil)
+}
+
+// DeleteIfVersion deletes the rows if all of them have the version.
+func (db *Database) DeleteIfVersion(query *DeleteIfVersion) (int, error) {
+	return db.DeleteIfVersionContext(context.Background(), query)
+}
+
+// DeleteIfVersionContext is DeleteIfVersion canceled when
+// the context is done before the rows are written.
+func (db *Database) DeleteIfVersionContext(ctx context.Context, query *DeleteIfVersion) (int, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.delete(ctx, query.Delete, query.Version, nil, nil)
+}
+
+// UpdateIfVersion updates the rows within the transaction
+// if all of them have the version.
+func (tx *Transaction) UpdateIfVersion(query *UpdateIfVersion) (int, error) {
+	return tx.UpdateIfVersionContext(context.Background(), query)
+}
+
+// UpdateIfVersionContext is UpdateIfVersion within the transaction
+// canceled when the context is done before the rows are written.
+func (tx *Transaction) UpdateIfVersionContext(ctx context.Context, query *UpdateIfVersion) (int, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return 0, err
+	}
+	tx.queried = true
+
+	return tx.db.update(ctx, query.Update, query.Version, nil, tx)
+}
+
+// DeleteIfVersion deletes the rows within the transaction
+// if all of them have the version.
+func (tx *Transaction) DeleteIfVersion(query *DeleteIfVersion) (int, error) {
+	return tx.DeleteIfVersionContext(context.Background(), query)
+}
+
+// DeleteIfVersionContext is DeleteIfVersion within the transaction
+// canceled when the context is done before the rows are written.
+func (tx *Transaction) DeleteIfVersionContext(ctx context.Context, query *DeleteIfVersion) (int, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return 0, err
+	}
+	tx.queried = true
+
+	return tx.db.delete(ctx, query.Delete, query.Version, nil, tx)
+}
+
+// checkVersions fails if any of the rows matched by the condition
+// has another version. All the storages are checked before any of
+// them is changed.
+func (db *Database) checkVersions(schema Schema, names []string, where *sql.Where, version int) error {
+	if !schema.RowVersion {
+		return fmt.Errorf("table %s has no row version, it must be created WITH ROW VERSION", schema.Name)
+	}
+
+	position := schema.Columns[versionColumn].Position
+	for _, name := range names {
+		var conflict error
+		err := db.scan(name, schema, func(index int, row []interface{}) bool {
+			if matches(schema, row, where) && row[position] != version {
+				conflict = fmt.Errorf("%w: the row version is %v, expected %d", ErrVersionConflict, row[position], version)
+			}
+
+			return conflict == nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", name, err)
+		}
+
+		if conflict != nil {
+			return conflict
+		}
+	}
+
+	return nil
+}
+
+// firstVersion sets the row version of the inserted row.
+func firstVersion(schema Schema, row []interface{}) {
+	if schema.RowVersion {
+		row[schema.Columns[versionColumn].Position] = 1
+	}
+}
+
+// nextVersion sets the row version of the updated row.
+func nextVersion(schema Schema, row []interface{}) {
+	if !schema.RowVersion {
+		return
+	}
+
+	position := schema.Columns[versionColumn].Position
+	row[position] = row[position].(int) + 1
+}
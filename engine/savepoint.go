@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Savepoint represents SAVEPOINT name statement.
+type Savepoint struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*Savepoint) GetType() sql.StatementType { return StatementSavepoint }
+
+// RollbackToSavepoint represents ROLLBACK TO [SAVEPOINT] name statement.
+type RollbackToSavepoint struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*RollbackToSavepoint) GetType() sql.StatementType { return StatementRollbackToSavepoint }
+
+// ReleaseSavepoint represents RELEASE [SAVEPOINT] name statement.
+type ReleaseSavepoint struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*ReleaseSavepoint) GetType() sql.StatementType { return StatementReleaseSavepoint }
+
+// parseSavepointName parses the name after the optional SAVEPOINT keyword.
+func parseSavepointName(s *tokenStream) (string, error) {
+	s.acceptKeyword("SAVEPOINT")
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(name), s.expectEnd()
+}
+
+// savepoint marks the state of the transaction that can be
+// restored without rolling back the whole transaction.
+type savepoint struct {
+	name string
+	// dir is the journal directory of the savepoint
+	dir string
+	// original state of the data files changed after
+	// the savepoint by storage names
+	journal map[string]*journalEntry
+	// changes is the number of the row changes
+	// captured before the savepoint
+	changes int
+}
+
+// Savepoint marks the current state of the transaction, the name
+// of an existing savepoint hides the older one until it is released.
+func (tx *Transaction) Savepoint(name string) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return err
+	}
+
+	tx.savepointSeq++
+	tx.savepoints = append(tx.savepoints, &savepoint{
+		name:    strings.ToLower(name),
+		dir:     path.Join(tx.db.journalDir(tx), "savepoint."+strconv.Itoa(tx.savepointSeq)),
+		journal: make(map[string]*journalEntry),
+		changes: len(tx.changes),
+	})
+
+	return nil
+}
+
+// RollbackTo discards the changes made after the savepoint and the
+// savepoints created after it, the savepoint itself is kept. The locks
+// taken after the savepoint are held until the transaction ends.
+func (tx *Transaction) RollbackTo(name string) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return err
+	}
+
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	sp := tx.savepoints[i]
+	tables := make(map[string]struct{})
+	for name, entry := range sp.journal {
+		err := tx.db.restoreEntry(name, entry)
+		if err != nil {
+			return fmt.Errorf("failed to roll back to savepoint %s: %w", sp.name, err)
+		}
+		tables[strings.SplitN(name, ".", 2)[0]] = struct{}{}
+	}
+
+	err = tx.db.removeSavepoints(tx, i)
+	if err != nil {
+		return err
+	}
+	sp.journal = make(map[string]*journalEntry)
+	tx.savepoints = append(tx.savepoints[:i], sp)
+	tx.changes = tx.changes[:sp.changes]
+
+	for tableName := range tables {
+		if _, exists := tx.db.tables[tableName]; !exists {
+			continue
+		}
+
+		err := tx.db.refreshStats(tableName)
+		if err != nil {
+			return fmt.Errorf("failed to refresh statistics: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Release removes the savepoint and the savepoints created after it,
+// the changes made after the savepoint are kept.
+func (tx *Transaction) Release(name string) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return err
+	}
+
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	err = tx.db.removeSavepoints(tx, i)
+	if err != nil {
+		return err
+	}
+	tx.savepoints = tx.savepoints[:i]
+
+	return nil
+}
+
+// findSavepoint returns the index of the newest savepoint with the name.
+func (tx *Transaction) findSavepoint(name string) (int, error) {
+	name = strings.ToLower(name)
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+
+	return 0, newError(CodeUndefinedObject, "savepoint %s does not exist", name)
+}
+
+// removeSavepoints removes the journals of the savepoints starting
+// from the i-th one, the journals of the older savepoints are shared
+// only with the newer ones.
+func (db *Database) removeSavepoints(tx *Transaction, i int) error {
+	for _, sp := range tx.savepoints[i:] {
+		if err := os.RemoveAll(sp.dir); err != nil {
+			return fmt.Errorf("failed to remove journal of savepoint %s: %w", sp.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// scanFunc is called for every row of the table, the scan
+// stops when it returns false.
+type scanFunc func(index int, row []interface{}) bool
+
+// scan iterates over the rows of the table or partition data file.
+// Rows of the memory-mapped files are decoded lazily, rows of others
+// are read from memory.
+func (db *Database) scan(name string, schema Schema, f scanFunc) error {
+	if !db.mapped[name] {
+		index := 0
+		for _, v := range db.data[name] {
+			if v.deleted {
+				continue
+			}
+
+			if !f(index, v.values) {
+				break
+			}
+			index++
+		}
+
+		return nil
+	}
+
+	return scanFile(tableFilePath(db.dbDir, name), schema, db.encryption, f)
+}
+
+// scanFile maps the table file into memory and decodes
+// the rows one by one.
+func scanFile(tableFilePath string, schema Schema, e *encryption, f scanFunc) error {
+	file, err := os.Open(tableFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to open file %s: %w", tableFilePath, err)
+	}
+	defer func() { checkFileClose(tableFilePath, file.Close()) }()
+
+	return scanMapped(file, schema, 0, e, f)
+}
+
+// scanMapped maps the opened table file into memory and decodes
+// the rows one by one from the start index, the rows before it
+// are skipped without decoding the values. The encrypted file is
+// decrypted into memory.
+func scanMapped(file *os.File, schema Schema, start int, e *encryption, f scanFunc) error {
+	tableFilePath := file.Name()
+	data, unmap, err := mapFile(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := unmap(); err != nil {
+			panic(fmt.Errorf("failed to unmap file %s: %w", tableFilePath, err))
+		}
+	}()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	data, err = e.open(data, path.Base(tableFilePath))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", tableFilePath, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	_, err = decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to decode JSON from %s: %w", tableFilePath, err)
+	}
+
+	for index := 0; decoder.More(); index++ {
+		if index < start {
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return fmt.Errorf("failed to decode row %d from %s: %w", index, tableFilePath, err)
+			}
+			continue
+		}
+
+		var row []interface{}
+		err = decoder.Decode(&row)
+		if err != nil {
+			return fmt.Errorf("failed to decode row %d from %s: %w", index, tableFilePath, err)
+		}
+		normalizeRow(schema, row)
+		err = decodeRow(schema, row)
+		if err != nil {
+			return fmt.Errorf("failed to decode row %d from %s: %w", index, tableFilePath, err)
+		}
+
+		if !f(index, row) {
+			break
+		}
+	}
+
+	return nil
+}
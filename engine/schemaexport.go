@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The schema export is the structure of the database without the data:
+// the statements that create the schemas, the sequences, the tables with
+// their masks and comments and then the triggers, as the triggers may refer to any
+// table. The export is the JSON document or the SQL bundle with one
+// statement per line after the version comment, both are imported only
+// into the empty database to provision the same structure elsewhere.
+// The temporary tables of the sessions are not exported.
+
+// SchemaExportVersion is the version of the exported documents, the
+// documents of the newer versions are not imported.
+const SchemaExportVersion = 1
+
+// schemaBundleHeader starts the SQL bundle with the version.
+const schemaBundleHeader = dumpCommentPrefix + " gosqldb schema version "
+
+// SchemaExport is the portable structure of the database.
+type SchemaExport struct {
+	Version    int      `json:"version"`
+	Statements []string `json:"statements"`
+}
+
+// SQL renders the export as the SQL bundle.
+func (e *SchemaExport) SQL() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%d\n", schemaBundleHeader, e.Version)
+	for _, statement := range e.Statements {
+		b.WriteString(statement)
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// ParseSchemaBundle reads the export from the SQL bundle.
+func ParseSchemaBundle(r io.Reader) (*SchemaExport, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLineSize)
+
+	var export *SchemaExport
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if export == nil {
+			if text == "" {
+				continue
+			}
+
+			var version int
+			if _, err := fmt.Sscanf(text, schemaBundleHeader+"%d", &version); err != nil {
+				return nil, fmt.Errorf("schema bundle must start with %q and the version", schemaBundleHeader)
+			}
+			export = &SchemaExport{Version: version, Statements: make([]string, 0)}
+
+			continue
+		}
+
+		if text != "" && !strings.HasPrefix(text, dumpCommentPrefix) {
+			export.Statements = append(export.Statements, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema bundle: %w", err)
+	}
+	if export == nil {
+		return nil, fmt.Errorf("schema bundle is empty")
+	}
+
+	return export, nil
+}
+
+// ExportSchema returns the structure of the database.
+func (db *Database) ExportSchema() *SchemaExport {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	export := &SchemaExport{Version: SchemaExportVersion, Statements: make([]string, 0)}
+
+	schemas := make([]string, 0, len(db.schemas))
+	for name := range db.schemas {
+		schemas = append(schemas, name)
+	}
+	sort.Strings(schemas)
+	for _, name := range schemas {
+		export.Statements = append(export.Statements, "CREATE SCHEMA "+name)
+	}
+
+	sequences := make([]string, 0, len(db.sequences))
+	for name := range db.sequences {
+		sequences = append(sequences, name)
+	}
+	sort.Strings(sequences)
+	for _, name := range sequences {
+		s := db.sequences[name]
+		export.Statements = append(export.Statements, fmt.Sprintf("CREATE SEQUENCE %s START WITH %d INCREMENT BY %d", name, s.Start, s.Increment))
+	}
+
+	tables := make([]Schema, 0, len(db.tables))
+	for _, schema := range db.tables {
+		if schema.Session == "" {
+			tables = append(tables, schema)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	for _, schema := range tables {
+		export.Statements = append(export.Statements, createTableStatement(schema))
+		export.Statements = append(export.Statements, maskStatements(schema)...)
+		export.Statements = append(export.Statements, commentStatements(schema)...)
+	}
+	for _, schema := range tables {
+		export.Statements = append(export.Statements, triggerStatements(schema)...)
+	}
+
+	return export
+}
+
+// ImportSchema creates the structure of the export in the empty
+// database. The statements are all parsed and checked first, so the
+// incompatible export is rejected with all its problems before any
+// change: the statements of other kinds, the duplicate names and the
+// references to the tables and the schemas created neither before
+// nor by the export. The import stops at the first failed statement,
+// the structure created before it stays.
+func (db *Database) ImportSchema(ctx context.Context, export *SchemaExport) (ImportResult, error) {
+	var result ImportResult
+	if export.Version < 1 || export.Version > SchemaExportVersion {
+		return result, fmt.Errorf("schema version %d is not supported, expected 1 to %d", export.Version, SchemaExportVersion)
+	}
+
+	if err := db.checkEmpty(); err != nil {
+		return result, err
+	}
+
+	statements := make([]sql.Statement, len(export.Statements))
+	var problems []string
+	// created are the names of the schemas, the sequences
+	// and the tables by the kinds
+	created := map[string]map[string]bool{"schema": {}, "sequence": {}, "table": {}}
+	for i, text := range export.Statements {
+		statement, err := Parse(text)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("statement %d: %s", i+1, err))
+			continue
+		}
+		statements[i] = statement
+
+		if problem := importedStatementProblem(statement, created); problem != "" {
+			problems = append(problems, fmt.Sprintf("statement %d: %s", i+1, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return result, fmt.Errorf("schema is not compatible:\n%s", strings.Join(problems, "\n"))
+	}
+
+	for i, statement := range statements {
+		if _, err := db.ExecuteContext(ctx, statement); err != nil {
+			return result, fmt.Errorf("failed to execute statement %d %s: %w", i+1, export.Statements[i], err)
+		}
+		result.Statements++
+	}
+
+	return result, nil
+}
+
+// importedStatementProblem checks the statement of the schema export
+// against the names created by the statements before it, the problem
+// is empty for the valid statement.
+func importedStatementProblem(statement sql.Statement, created map[string]map[string]bool) string {
+	create := func(kind string, name string) string {
+		name = strings.ToLower(name)
+		if created[kind][name] {
+			return fmt.Sprintf("%s %s is created twice", kind, name)
+		}
+		created[kind][name] = true
+
+		return ""
+	}
+	createTable := func(query *sql.CreateTable) string {
+		name := strings.ToLower(query.Name)
+		if separator := strings.Index(name, schemaSeparator); separator > 0 && !created["schema"][name[:separator]] {
+			return fmt.Sprintf("schema %s of table %s is not created", name[:separator], name)
+		}
+
+		return create("table", name)
+	}
+	requireTable := func(name string) string {
+		if name = strings.ToLower(name); !created["table"][name] {
+			return fmt.Sprintf("table %s is not created", name)
+		}
+
+		return ""
+	}
+
+	switch query := statement.(type) {
+	case *CreateSchema:
+		return create("schema", query.Name)
+	case *CreateSequence:
+		return create("sequence", query.Name)
+	case *sql.CreateTable:
+		return createTable(query)
+	case *CreatePartitionedTable:
+		return createTable(query.CreateTable)
+	case *CreateVersionedTable:
+		return createTable(query.CreateTable)
+	case *CreateMemoryTable:
+		if query.Temporary {
+			return "temporary tables belong to the sessions"
+		}
+
+		return createTable(query.CreateTable)
+	case *AlterColumnMask:
+		return requireTable(query.Table)
+	case *Comment:
+		return requireTable(query.Table)
+	case *CreateTrigger:
+		if problem := requireTable(query.Table); problem != "" || query.Trigger.AuditTable == "" {
+			return problem
+		}
+
+		return requireTable(query.Trigger.AuditTable)
+	}
+
+	return "only the statements creating the structure are imported"
+}
+
+// checkEmpty returns the error if the database has
+// the tables, the schemas or the sequences.
+func (db *Database) checkEmpty() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(db.tables) > 0 || len(db.schemas) > 0 || len(db.sequences) > 0 {
+		return fmt.Errorf("schema is imported only into the empty database, it has %d tables, %d schemas and %d sequences", len(db.tables), len(db.schemas), len(db.sequences))
+	}
+
+	return nil
+}
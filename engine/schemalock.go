@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The statements that change the schema of a table lock it exclusively,
+// so they wait for the statements and the transactions that have locked
+// the table for reading or writing, and the statements locking the table
+// wait for them. The selections outside of transactions do not lock the
+// table, they read the schema and the rows captured together.
+//
+// Every change of the schema advances the version of the table. The
+// statement that has read the schema before waiting for a lock and the
+// repeatable read transaction whose snapshot is older than the schema
+// fail with ErrSchemaChanged, the statement can be retried.
+
+// ErrSchemaChanged is returned to the statements that have read
+// the schema of the table before it has been changed.
+var ErrSchemaChanged = errors.New("schema changed, retry")
+
+// replaceSchema stores the changed schema of the table and advances
+// its version, it must be called with the database lock held.
+func (db *Database) replaceSchema(schema Schema) {
+	db.schemaChanged()
+	schema.Version = db.schemaVersion
+	db.tables[schema.Name] = schema
+}
+
+// checkSchema fails if the schema read by the statement is not the
+// current one or it is newer than the snapshot of the transaction. It
+// must be called with the database lock held.
+func (db *Database) checkSchema(tx *Transaction, schema Schema) error {
+	if current, exists := db.tables[schema.Name]; !exists || current.Version != schema.Version {
+		return fmt.Errorf("%w: table %s has been changed while the statement was waiting", ErrSchemaChanged, schema.Name)
+	}
+
+	if tx != nil && tx.snapshot != nil && schema.Version > tx.snapshot.schemaVersion {
+		return fmt.Errorf("%w: table %s has been changed after transaction %s has started", ErrSchemaChanged, schema.Name, tx.ID)
+	}
+
+	return nil
+}
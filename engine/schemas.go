@@ -0,0 +1,560 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The schemas are the namespaces of the tables within a database. The
+// qualified names like analytics.events are rewritten before parsing
+// into the names the parser accepts, analytics__events, so a table of
+// a schema is stored and addressed everywhere by that name and its data
+// files stay in the db directory. The tables of the public schema are
+// the ones with the unqualified names. The names of the schemas are
+// kept in the schemas file, the schema of every table in the meta file.
+// The unqualified names are resolved with the search path of the session,
+// the first schema of the path that has the table wins, and the tables
+// are created in the first schema of the path.
+
+const schemasFileName = "gosqldb.schemas.json"
+
+// PublicSchema is the schema of the tables with the unqualified names.
+const PublicSchema = "public"
+
+// informationSchema is the schema of the virtual tables,
+// they are named with its prefix.
+const informationSchema = "information_schema"
+
+// schemaSeparator separates the schema and the table
+// in the names of the tables of the schemas.
+const schemaSeparator = "__"
+
+// CreateSchema represents CREATE SCHEMA statement.
+type CreateSchema struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*CreateSchema) GetType() sql.StatementType { return StatementCreateSchema }
+
+// DropSchema represents DROP SCHEMA statement.
+type DropSchema struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*DropSchema) GetType() sql.StatementType { return StatementDropSchema }
+
+// SetSearchPath represents SET SEARCH_PATH TO statement.
+type SetSearchPath struct {
+	Schemas []string
+}
+
+// GetType returns the statement type.
+func (*SetSearchPath) GetType() sql.StatementType { return StatementSetSearchPath }
+
+// parseSchemaStatement parses CREATE SCHEMA and DROP SCHEMA statements.
+func parseSchemaStatement(s *tokenStream) (sql.Statement, error) {
+	create := s.acceptKeyword("CREATE", "SCHEMA")
+	if !create {
+		s.mustKeyword("DROP", "SCHEMA")
+	}
+
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if create {
+		return &CreateSchema{name}, s.expectEnd()
+	}
+
+	return &DropSchema{name}, s.expectEnd()
+}
+
+// parseSetSearchPath parses SET SEARCH_PATH TO schema [, ...],
+// the equals sign can be used instead of TO.
+func parseSetSearchPath(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SET", "SEARCH_PATH")
+	if !s.acceptKeyword("TO") && !s.acceptSymbol("=") {
+		return nil, s.unexpected("TO or =")
+	}
+
+	query := &SetSearchPath{}
+	for {
+		name, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		query.Schemas = append(query.Schemas, strings.ToLower(name))
+
+		if !s.acceptSymbol(",") {
+			break
+		}
+	}
+
+	return query, s.expectEnd()
+}
+
+// qualifyNames rewrites the qualified names outside of the strings into
+// the names of the tables of the schemas, the names of the public schema
+// lose the qualification and the ones of the information schema are
+// the virtual tables.
+func qualifyNames(query string, tokens []token) string {
+	var rewritten strings.Builder
+	last := 0
+	for i := 0; i+2 < len(tokens); i++ {
+		schema, dot, table := tokens[i], tokens[i+1], tokens[i+2]
+		if schema.kind != tokenWord || dot.value != "." || table.kind != tokenWord ||
+			dot.pos != schema.pos+len(schema.value) || table.pos != dot.pos+1 {
+			continue
+		}
+
+		// the references to the rows in the trigger actions
+		if isTriggerRow(schema.value) {
+			i += 2
+			continue
+		}
+
+		rewritten.WriteString(query[last:schema.pos])
+		switch {
+		case strings.EqualFold(schema.value, PublicSchema):
+			rewritten.WriteString(table.value)
+		case strings.EqualFold(schema.value, informationSchema):
+			rewritten.WriteString(informationSchema + "_" + table.value)
+		default:
+			rewritten.WriteString(schema.value + schemaSeparator + table.value)
+		}
+		last = table.pos + len(table.value)
+		i += 2
+	}
+
+	if last == 0 {
+		return query
+	}
+	rewritten.WriteString(query[last:])
+
+	return rewritten.String()
+}
+
+// tableSchema returns the schema of the table, empty
+// for the tables of the public schema.
+func tableSchema(tableName string) string {
+	separator := strings.Index(tableName, schemaSeparator)
+	if separator <= 0 {
+		return ""
+	}
+
+	return tableName[:separator]
+}
+
+// qualifiedTableName returns the name of the table of the schema.
+func qualifiedTableName(schema string, tableName string) string {
+	if schema == PublicSchema {
+		return tableName
+	}
+
+	return schema + schemaSeparator + tableName
+}
+
+// validateSchemaName validates the name of the new schema.
+func validateSchemaName(name string) error {
+	if !isValidTableNameFormat(name) || strings.Contains(name, schemaSeparator) ||
+		strings.HasPrefix(name, "_") || strings.HasSuffix(name, "_") {
+		return fmt.Errorf("schema name %s is not valid, expected format: %s without double underscores", name, tableNameRegExp)
+	}
+
+	if name == PublicSchema || name == informationSchema || isTriggerRow(name) || strings.HasPrefix(name, temporarySchemaPrefix) {
+		return fmt.Errorf("schema name %s is reserved", name)
+	}
+
+	return nil
+}
+
+// checkTableSchema checks that the schema of the new table exists,
+// it must be called with the database lock held.
+func (db *Database) checkTableSchema(tableName string) error {
+	schema := tableSchema(tableName)
+	if schema == "" {
+		return nil
+	}
+
+	if _, exists := db.schemas[schema]; !exists {
+		return newError(CodeUndefinedObject, "schema %s does not exist", schema)
+	}
+
+	if tableName == schema+schemaSeparator {
+		return fmt.Errorf("table name is empty")
+	}
+
+	return nil
+}
+
+// CreateSchema creates the schema for the tables.
+func (db *Database) CreateSchema(query *CreateSchema) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := strings.ToLower(query.Name)
+	if err := validateSchemaName(name); err != nil {
+		return err
+	}
+
+	if _, exists := db.schemas[name]; exists {
+		return newError(CodeDuplicateObject, "schema %s exists (schema names are case-insensitive)", name)
+	}
+
+	db.schemas[name] = struct{}{}
+	if err := db.storeSchemas(); err != nil {
+		delete(db.schemas, name)
+		return err
+	}
+
+	return nil
+}
+
+// DropSchema drops the schema without tables.
+func (db *Database) DropSchema(query *DropSchema) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := strings.ToLower(query.Name)
+	if _, exists := db.schemas[name]; !exists {
+		return newError(CodeUndefinedObject, "schema %s does not exist", name)
+	}
+
+	for tableName := range db.tables {
+		if tableSchema(tableName) == name {
+			return fmt.Errorf("schema %s is not empty, table %s is in it", name, tableName)
+		}
+	}
+
+	delete(db.schemas, name)
+	if err := db.storeSchemas(); err != nil {
+		db.schemas[name] = struct{}{}
+		return err
+	}
+
+	return nil
+}
+
+// SchemaNames returns the sorted names of the schemas,
+// the public one included.
+func (db *Database) SchemaNames() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	names := []string{PublicSchema}
+	for name := range db.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// schemaRows describes the schemas with the numbers of their tables.
+func (db *Database) schemaRows() [][]interface{} {
+	tables := make(map[string]int)
+	for tableName := range db.tables {
+		tables[tableSchema(tableName)]++
+	}
+
+	rows := [][]interface{}{{PublicSchema, tables[""]}}
+	for name := range db.schemas {
+		rows = append(rows, []interface{}{name, tables[name]})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0].(string) < rows[j][0].(string) })
+
+	return rows
+}
+
+func loadSchemas(dbDir string, e *encryption) (map[string]struct{}, error) {
+	filePath := path.Join(dbDir, schemasFileName)
+	content, err := readFileContent(filePath, e)
+	if os.IsNotExist(err) {
+		return make(map[string]struct{}), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	var names []string
+	if err := json.Unmarshal(content, &names); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	schemas := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		schemas[name] = struct{}{}
+	}
+
+	return schemas, nil
+}
+
+// storeSchemas replaces the schemas file, it must be called
+// with the database lock held.
+func (db *Database) storeSchemas() error {
+	names := make([]string, 0, len(db.schemas))
+	for name := range db.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	content, err := json.MarshalIndent(names, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode schemas: %w", err)
+	}
+
+	return db.writeFileContent(path.Join(db.dbDir, schemasFileName), content)
+}
+
+// SetSearchPath sets the schemas the unqualified table names
+// of the session are resolved with.
+func (s *Session) SetSearchPath(schemas []string) error {
+	for _, schema := range schemas {
+		if schema == PublicSchema {
+			continue
+		}
+
+		s.db.mu.Lock()
+		_, exists := s.db.schemas[schema]
+		s.db.mu.Unlock()
+		if !exists {
+			return newError(CodeUndefinedObject, "schema %s does not exist", schema)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.searchPath = schemas
+
+	return nil
+}
+
+// SearchPath returns the search path of the session,
+// the public schema only by default.
+func (s *Session) SearchPath() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.searchPath) == 0 {
+		return []string{PublicSchema}
+	}
+
+	return s.searchPath
+}
+
+// Resolve returns the statement with the unqualified table names
+// resolved with the temporary tables and the search path of the
+// session, the statement itself if the names are not changed. The
+// statements are resolved before their privileges are checked.
+func (s *Session) Resolve(q sql.Statement) sql.Statement {
+	return s.db.resolveTables(q, s.SearchPath(), s.temporarySchema)
+}
+
+// resolveTables resolves the table names of the statement, the
+// temporary tables of the schema come before the search path.
+func (db *Database) resolveTables(q sql.Statement, searchPath []string, temporarySchema string) sql.Statement {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	memory, _ := q.(*CreateMemoryTable)
+	temporary := memory != nil && memory.Temporary
+
+	return withTableNames(q, func(name string, create bool) string {
+		lowered := strings.ToLower(name)
+		if tableSchema(lowered) != "" {
+			return name
+		}
+		if _, exists := virtualTables[lowered]; exists {
+			return name
+		}
+
+		switch {
+		case create && temporary:
+			return qualifiedTableName(temporarySchema, lowered)
+		case create && len(searchPath) == 1 && searchPath[0] == PublicSchema:
+			return name
+		case create:
+			return qualifiedTableName(searchPath[0], lowered)
+		}
+
+		// the temporary tables shadow the others
+		if qualified := qualifiedTableName(temporarySchema, lowered); db.tables[qualified].Session != "" {
+			return qualified
+		}
+
+		for _, schema := range searchPath {
+			qualified := qualifiedTableName(schema, lowered)
+			if _, exists := db.tables[qualified]; exists {
+				return qualified
+			}
+		}
+
+		return name
+	})
+}
+
+// withTableNames returns the copy of the statement with the table names
+// replaced by the function, the statement itself if none is replaced.
+// The create argument is true for the names of the created tables.
+func withTableNames(q sql.Statement, replace func(name string, create bool) string) sql.Statement {
+	switch query := q.(type) {
+	case *sql.Select:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *sql.Insert:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *sql.Update:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *sql.Delete:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *CountRows:
+		if selected := withTableNames(query.Select, replace); selected != query.Select {
+			return &CountRows{selected.(*sql.Select)}
+		}
+	case *OrderedSelect:
+		if selected := withTableNames(query.Select, replace); selected != query.Select {
+			return &OrderedSelect{selected.(*sql.Select), query.OrderBy}
+		}
+	case *GroupedSelect:
+		if selected := withTableNames(query.Select, replace); selected != query.Select {
+			return &GroupedSelect{selected.(*sql.Select), query.Items, query.GroupBy, query.OrderBy}
+		}
+	case *AsOfSelect:
+		if selected := withTableNames(query.Select, replace); selected != query.Select {
+			return &AsOfSelect{selected.(*sql.Select), query.Time}
+		}
+	case *UpdateIfVersion:
+		if update := withTableNames(query.Update, replace); update != query.Update {
+			return &UpdateIfVersion{update.(*sql.Update), query.Version}
+		}
+	case *DeleteIfVersion:
+		if deleteQuery := withTableNames(query.Delete, replace); deleteQuery != query.Delete {
+			return &DeleteIfVersion{deleteQuery.(*sql.Delete), query.Version}
+		}
+	case *sql.CreateTable:
+		if name := replace(query.Name, true); name != query.Name {
+			resolved := *query
+			resolved.Name = name
+			return &resolved
+		}
+	case *CreatePartitionedTable:
+		if create := withTableNames(query.CreateTable, replace); create != query.CreateTable {
+			return &CreatePartitionedTable{create.(*sql.CreateTable), query.Partitioning, query.Generated}
+		}
+	case *CreateVersionedTable:
+		if create := withTableNames(query.CreateTable, replace); create != query.CreateTable {
+			return &CreateVersionedTable{create.(*sql.CreateTable), query.Partitioning, query.Generated}
+		}
+	case *CreateMemoryTable:
+		if create := withTableNames(query.CreateTable, replace); create != query.CreateTable {
+			return &CreateMemoryTable{create.(*sql.CreateTable), query.RowVersion, query.Temporary, query.Generated}
+		}
+	case *sql.DropTable:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *DropPartition:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *AlterColumnMask:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *Comment:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *RenameTable:
+		// the unqualified new name is in the schema of the table
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *Analyze:
+		// all the tables are analyzed without the table
+		if query.Table == "" {
+			break
+		}
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *CreateTrigger:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *DropTrigger:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *Explain:
+		if statement := withTableNames(query.Statement, replace); statement != query.Statement {
+			resolved := *query
+			resolved.Statement = statement
+			return &resolved
+		}
+	case *Copy:
+		resolved := *query
+		resolved.Table = replace(query.Table, false)
+		if query.Query != nil {
+			resolved.Query = withTableNames(query.Query, replace).(*sql.Select)
+		}
+		if resolved.Table != query.Table || resolved.Query != query.Query {
+			return &resolved
+		}
+	case *Flashback:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	case *ShowCreateTable:
+		if name := replace(query.Table, false); name != query.Table {
+			resolved := *query
+			resolved.Table = name
+			return &resolved
+		}
+	}
+
+	return q
+}
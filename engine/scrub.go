@@ -0,0 +1,351 @@
+package engine
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// checksum file extension, the checksum file is stored next to
+// the data file and contains CRC-32 (Castagnoli) of its content, or
+// the lines of the new and the old one while the data file is replaced
+const checksumFileExtension = ".checksum"
+
+// scrubPause is a pause between checks of two files to keep
+// the scrubber from competing with the queries.
+const scrubPause = 10 * time.Millisecond
+
+var crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+func checksumFilePath(tableFilePath string) string {
+	return tableFilePath + checksumFileExtension
+}
+
+func checksum(content []byte) string {
+	sum := crc32.Checksum(content, crc32Table)
+
+	return hex.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+}
+
+// ScrubStats describes the results of the background integrity checks.
+type ScrubStats struct {
+	// Runs is the number of completed passes over all the data files.
+	Runs int `json:"runs"`
+	// LastRun is the time the last pass has been completed.
+	LastRun time.Time `json:"last_run"`
+	// FilesChecked is the number of checked files since start.
+	FilesChecked int `json:"files_checked"`
+	// Repaired is the number of files rewritten from memory since start.
+	Repaired int `json:"repaired"`
+	// Corrupted lists the corrupted files that could not be repaired
+	// during the last pass.
+	Corrupted []string `json:"corrupted,omitempty"`
+}
+
+// scrubber continuously verifies the data files against their checksums,
+// the table schema and the in-memory data, and rewrites corrupted files
+// from memory when the table is loaded into memory.
+type scrubber struct {
+	db       *Database
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats ScrubStats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newScrubber creates the scrubber and starts it if the interval is positive.
+func newScrubber(db *Database, interval time.Duration) *scrubber {
+	s := &scrubber{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s
+}
+
+func (s *scrubber) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-time.After(s.interval):
+			if !s.scrub() {
+				return
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// scrub makes a single pass over all the data files, returns false
+// if the scrubber has been stopped in the middle of the pass.
+func (s *scrubber) scrub() bool {
+	corrupted := make([]string, 0)
+	checked := 0
+	repaired := 0
+
+	for _, file := range s.db.storageFiles() {
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(scrubPause):
+		}
+
+		ok, fixed, err := s.db.scrubStorage(file.name, file.schema)
+		checked++
+		if err != nil {
+			logging.Errorf("failed to check %s: %s", file.name, err)
+			continue
+		}
+
+		if fixed {
+			repaired++
+		} else if !ok {
+			corrupted = append(corrupted, file.name)
+		}
+	}
+
+	s.mu.Lock()
+	s.stats.Runs++
+	s.stats.LastRun = time.Now()
+	s.stats.FilesChecked += checked
+	s.stats.Repaired += repaired
+	s.stats.Corrupted = corrupted
+	s.mu.Unlock()
+
+	return true
+}
+
+func (s *scrubber) close() {
+	if s.interval > 0 {
+		close(s.stop)
+	}
+	<-s.done
+}
+
+// Stats returns the results of the background integrity checks.
+func (s *scrubber) Stats() ScrubStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Corrupted = append([]string(nil), s.stats.Corrupted...)
+
+	return stats
+}
+
+// ScrubStats returns the results of the background integrity checks.
+func (db *Database) ScrubStats() ScrubStats {
+	return db.scrubber.Stats()
+}
+
+type storageFile struct {
+	name   string
+	schema Schema
+}
+
+// storageFiles lists the data files of all the tables.
+func (db *Database) storageFiles() []storageFile {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	files := make([]storageFile, 0)
+	for _, schema := range db.tables {
+		if schema.InMemory {
+			continue
+		}
+
+		for _, name := range schema.storageNames() {
+			files = append(files, storageFile{name, schema})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	return files
+}
+
+// scrubStorage verifies the data file and repairs it from memory
+// if possible. It returns whether the file is intact and whether it
+// has been repaired.
+func (db *Database) scrubStorage(name string, schema Schema) (bool, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if current, exists := db.tables[schema.Name]; !exists || !reflect.DeepEqual(current, schema) {
+		// the table has been changed since the pass has started
+		return true, false, nil
+	}
+
+	err := db.verifyStorage(name, schema)
+	if err == nil {
+		return true, false, nil
+	}
+
+	var corruption *corruptionError
+	if !errors.As(err, &corruption) {
+		return false, false, err
+	}
+
+	logging.Errorf("CORRUPTION: %s", err)
+	if db.mapped[name] {
+		logging.Errorf("CORRUPTION: %s is not loaded into memory and can not be repaired", name)
+
+		return false, false, nil
+	}
+
+	err = db.writeFile(name, liveRows(db.data[name]))
+	if err != nil {
+		return false, false, fmt.Errorf("failed to repair %s: %w", name, err)
+	}
+	logging.Infof("%s has been repaired from memory", name)
+
+	return false, true, nil
+}
+
+// verifyChecksum compares the checksum of the data file content
+// with the stored ones.
+func verifyChecksum(tableFilePath string, content []byte, e *encryption) error {
+	expected, err := readFileContent(checksumFilePath(tableFilePath), e)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// files written before checksums were introduced have no checksum
+			return nil
+		}
+
+		return fmt.Errorf("failed to read checksum of %s: %w", tableFilePath, err)
+	}
+
+	actual := checksum(content)
+	for _, sum := range strings.Split(string(expected), "\n") {
+		if sum == actual {
+			return nil
+		}
+	}
+
+	return &corruptionError{tableFilePath, "checksum mismatch"}
+}
+
+// corruptionError is returned when the data file does not pass
+// the integrity check.
+type corruptionError struct {
+	name   string
+	reason string
+}
+
+func (e *corruptionError) Error() string {
+	return fmt.Sprintf("%s is corrupted: %s", e.name, e.reason)
+}
+
+// verifyStorage checks the data file checksum, decodes it and compares
+// the rows with the schema and with the in-memory copy.
+func (db *Database) verifyStorage(name string, schema Schema) error {
+	tableFilePath := tableFilePath(db.dbDir, name)
+	content, err := readFileContent(tableFilePath, db.encryption)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read file %s: %w", tableFilePath, err)
+		}
+
+		if !db.mapped[name] && len(liveRows(db.data[name])) > 0 {
+			return &corruptionError{name, "the data file is missing"}
+		}
+
+		return nil
+	}
+
+	err = verifyChecksum(tableFilePath, content, db.encryption)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]interface{}
+	err = json.Unmarshal(content, &rows)
+	if err != nil {
+		return &corruptionError{name, fmt.Sprintf("failed to decode JSON: %s", err)}
+	}
+
+	for index, row := range rows {
+		if len(row) != len(schema.Columns) {
+			return &corruptionError{name, fmt.Sprintf("row %d has %d values, expected %d", index, len(row), len(schema.Columns))}
+		}
+
+		normalizeRow(schema, row)
+		if err := decodeRow(schema, row); err != nil {
+			return &corruptionError{name, fmt.Sprintf("row %d: %s", index, err)}
+		}
+
+		for _, column := range schema.Columns {
+			if valueType(row[column.Position]) != column.ReflectType() {
+				return &corruptionError{name, fmt.Sprintf("row %d has invalid value for column %s", index, column.Name)}
+			}
+		}
+	}
+
+	if db.mapped[name] {
+		return nil
+	}
+
+	inMemory := liveRows(db.data[name])
+	if len(rows) != len(inMemory) {
+		return &corruptionError{name, fmt.Sprintf("%d rows in the file, %d rows in memory", len(rows), len(inMemory))}
+	}
+
+	for index, row := range rows {
+		if !reflect.DeepEqual(row, inMemory[index]) {
+			return &corruptionError{name, fmt.Sprintf("row %d differs from the in-memory copy", index)}
+		}
+	}
+
+	return nil
+}
+
+// CheckResult describes the integrity check of the data files.
+type CheckResult struct {
+	FilesChecked int `json:"files_checked"`
+	// Corrupted describes the corrupted files.
+	Corrupted []string `json:"corrupted,omitempty"`
+}
+
+// Check verifies the data files once without repairing them,
+// the corrupted files are reported in the result.
+func (db *Database) Check() (CheckResult, error) {
+	var result CheckResult
+	for _, file := range db.storageFiles() {
+		db.mu.Lock()
+		err := db.verifyStorage(file.name, file.schema)
+		db.mu.Unlock()
+
+		var corruption *corruptionError
+		if errors.As(err, &corruption) {
+			result.Corrupted = append(result.Corrupted, err.Error())
+		} else if err != nil {
+			return result, err
+		}
+		result.FilesChecked++
+	}
+
+	return result, nil
+}
@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestVerifyChecksumWhileReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldContent, newContent := []byte(`[[1]]`), []byte(`[[1],[2]]`)
+	tableFilePath := path.Join(dir, "t"+tableFileExtension)
+	sums := checksum(newContent) + "\n" + checksum(oldContent)
+	if err := ioutil.WriteFile(checksumFilePath(tableFilePath), []byte(sums), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the crash before and after the data file has been replaced
+	for _, content := range [][]byte{oldContent, newContent} {
+		if err := verifyChecksum(tableFilePath, content, nil); err != nil {
+			t.Errorf("%s: unexpected error: %s", content, err)
+		}
+	}
+
+	if err := verifyChecksum(tableFilePath, []byte(`[[3]]`), nil); err == nil {
+		t.Error("expected checksum mismatch")
+	}
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"fmt"
+)
+
+// The data files of the tables and the partitions are split into the
+// segments of at most SegmentRows rows. The first segment is the data
+// file itself, the next ones are added when the last one is full and
+// their numbers are kept in the meta file. Every segment is a storage of
+// its own, so an update or a delete rewrites only the segments with the
+// changed rows and an insert rewrites only the last ones.
+
+// segmentName returns the name of the segment of the data file.
+func segmentName(name string, segment int) string {
+	if segment == 0 {
+		return name
+	}
+
+	return fmt.Sprintf("%s.seg%d", name, segment)
+}
+
+// segmentNames returns the names of all the segments of the data file.
+func (schema Schema) segmentNames(name string) []string {
+	names := make([]string, schema.Segments[name]+1)
+	for i := range names {
+		names[i] = segmentName(name, i)
+	}
+
+	return names
+}
+
+// segmentRows splits the new rows of the data files between their last
+// segments and the new ones, it returns the rows by the segment names.
+// The new segments are added by addSegments when the rows are written.
+func (db *Database) segmentRows(schema Schema, rowsByFile map[string][][]interface{}) (map[string][][]interface{}, error) {
+	if db.options.SegmentRows <= 0 || schema.InMemory {
+		return rowsByFile, nil
+	}
+
+	rowsBySegment := make(map[string][][]interface{}, len(rowsByFile))
+	for name, rows := range rowsByFile {
+		segment := schema.Segments[name]
+		count := 0
+		err := db.scan(segmentName(name, segment), schema, func(index int, row []interface{}) bool {
+			count++
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to count rows of %s: %w", segmentName(name, segment), err)
+		}
+
+		for len(rows) > 0 {
+			free := db.options.SegmentRows - count
+			if free <= 0 {
+				segment, count = segment+1, 0
+				continue
+			}
+			if free > len(rows) {
+				free = len(rows)
+			}
+
+			name := segmentName(name, segment)
+			rowsBySegment[name] = append(rowsBySegment[name], rows[:free]...)
+			rows, count = rows[free:], count+free
+		}
+	}
+
+	return rowsBySegment, nil
+}
+
+// addSegments stores the segments the inserted rows go to, they are
+// stored before the rows are written. It must be called with the
+// database lock held.
+func (db *Database) addSegments(inserts []*pendingInsert) error {
+	added := false
+	for _, insert := range inserts {
+		schema, exists := db.tables[insert.table.Name]
+		if !exists {
+			continue
+		}
+
+		var segments map[string]int
+		for _, name := range schema.fileNames() {
+			last := schema.Segments[name]
+			for {
+				if _, exists := insert.rowsByStorage[segmentName(name, last+1)]; !exists {
+					break
+				}
+				last++
+			}
+			if last == schema.Segments[name] {
+				continue
+			}
+
+			// the schemas are shared with the open views
+			if segments == nil {
+				segments = make(map[string]int, len(schema.Segments)+1)
+				for name, last := range schema.Segments {
+					segments[name] = last
+				}
+			}
+			segments[name] = last
+		}
+
+		if segments != nil {
+			schema.Segments = segments
+			db.tables[schema.Name] = schema
+			added = true
+		}
+	}
+
+	if !added {
+		return nil
+	}
+	// the cached plans do not have the new segments
+	db.schemaChanged()
+
+	if err := db.storeTables(); err != nil {
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	return nil
+}
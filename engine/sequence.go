@@ -0,0 +1,491 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The sequences are the named counters that generate unique integers
+// independently of the tables and the transactions, the values taken
+// by the rolled back transactions are not returned. They are used with
+// nextval("name") and currval("name") in the values of INSERT and UPDATE
+// and in WHERE. The calls are rewritten before parsing into the string
+// literals with the marker and are replaced with the values every time
+// the statement is executed, so the cached and the prepared statements
+// take the new values.
+//
+// The allocations are logged ahead: the sequences file records the last
+// value that can be returned without writing it again, it is written
+// every sequenceLogValues values with the same atomic write as the other
+// files of the database. After a crash the sequence continues after the
+// logged value, the values are never reused but there can be a gap.
+
+const sequencesFileName = "gosqldb.sequences.json"
+
+// sequenceLogValues is the number of the values logged ahead.
+const sequenceLogValues = 32
+
+// sequenceMarker starts the string literal that replaces the call
+// of the sequence function before the query is parsed.
+const sequenceMarker = placeholderMarker + "seq:"
+
+// Sequence is the definition and the logged state of the sequence.
+type Sequence struct {
+	Name      string `json:"name"`
+	Start     int    `json:"start"`
+	Increment int    `json:"increment"`
+	// Logged is the last value that can be returned without logging,
+	// it is meaningful only when Called is true.
+	Logged int  `json:"logged"`
+	Called bool `json:"called"`
+}
+
+// sequence is the sequence with its values in memory.
+type sequence struct {
+	Sequence
+	// value is the last returned value, valid when called is true.
+	value  int
+	called bool
+	// current is true when nextval has returned the value since
+	// the database is open.
+	current bool
+}
+
+// CreateSequence represents CREATE SEQUENCE statement.
+type CreateSequence struct {
+	Name      string
+	Start     int
+	Increment int
+}
+
+// GetType returns the statement type.
+func (*CreateSequence) GetType() sql.StatementType { return StatementCreateSequence }
+
+// DropSequence represents DROP SEQUENCE statement.
+type DropSequence struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*DropSequence) GetType() sql.StatementType { return StatementDropSequence }
+
+// parseSequenceStatement parses CREATE SEQUENCE name [INCREMENT [BY] n]
+// [START [WITH] n] and DROP SEQUENCE name statements.
+func parseSequenceStatement(s *tokenStream) (sql.Statement, error) {
+	create := s.acceptKeyword("CREATE", "SEQUENCE")
+	if !create {
+		s.mustKeyword("DROP", "SEQUENCE")
+	}
+
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if !create {
+		return &DropSequence{strings.ToLower(name)}, s.expectEnd()
+	}
+
+	query := &CreateSequence{Name: strings.ToLower(name), Start: 1, Increment: 1}
+	for s.peek().kind != tokenEnd {
+		switch {
+		case s.acceptKeyword("INCREMENT"):
+			s.acceptKeyword("BY")
+			if query.Increment, err = s.expectInteger(); err != nil {
+				return nil, err
+			}
+		case s.acceptKeyword("START"):
+			s.acceptKeyword("WITH")
+			if query.Start, err = s.expectInteger(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, s.unexpected("INCREMENT or START")
+		}
+	}
+
+	return query, nil
+}
+
+// sequenceCalls rewrites the calls of nextval and currval outside of
+// the strings into the string literals with the marker.
+func sequenceCalls(query string, tokens []token) string {
+	var rewritten strings.Builder
+	last := 0
+	for i := 0; i+3 < len(tokens); i++ {
+		function, open, name, close := tokens[i], tokens[i+1], tokens[i+2], tokens[i+3]
+		if function.kind != tokenWord || open.value != "(" || close.value != ")" ||
+			(name.kind != tokenWord && name.kind != tokenString) {
+			continue
+		}
+		if !strings.EqualFold(function.value, "nextval") && !strings.EqualFold(function.value, "currval") {
+			continue
+		}
+
+		sequenceName := name.value
+		if name.kind == tokenString {
+			sequenceName = strings.Trim(sequenceName, `"`)
+		}
+
+		rewritten.WriteString(query[last:function.pos])
+		rewritten.WriteString(`"` + sequenceMarker + strings.ToLower(function.value) + ":" + strings.ToLower(sequenceName) + `"`)
+		last = close.pos + 1
+		i += 3
+	}
+
+	if last == 0 {
+		return query
+	}
+	rewritten.WriteString(query[last:])
+
+	return rewritten.String()
+}
+
+// sequenceCall returns the function and the sequence
+// of the literal that replaced the call.
+func sequenceCall(literal string) (string, string, bool) {
+	if !strings.HasPrefix(literal, `"`+sequenceMarker) {
+		return "", "", false
+	}
+
+	call := strings.SplitN(strings.Trim(literal, `"`)[len(sequenceMarker):], ":", 2)
+	if len(call) != 2 {
+		return "", "", false
+	}
+
+	return call[0], call[1], true
+}
+
+// hasSequenceCalls reports whether the query calls the sequence functions.
+func hasSequenceCalls(q sql.Statement) bool {
+	switch query := q.(type) {
+	case *sql.Insert:
+		return valuesCallSequences(query.Values)
+	case *sql.Update:
+		return valuesCallSequences(query.Values) || whereCallsSequences(query.Where)
+	case *sql.Select:
+		return whereCallsSequences(query.Where)
+	case *sql.Delete:
+		return whereCallsSequences(query.Where)
+	case *UpdateIfVersion:
+		return valuesCallSequences(query.Values) || whereCallsSequences(query.Where)
+	case *DeleteIfVersion:
+		return whereCallsSequences(query.Where)
+	}
+
+	return false
+}
+
+func valuesCallSequences(values []string) bool {
+	for _, value := range values {
+		if _, _, ok := sequenceCall(value); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func whereCallsSequences(where *sql.Where) bool {
+	if where == nil {
+		return false
+	}
+
+	var calls func(expr sql.Expr) bool
+	calls = func(expr sql.Expr) bool {
+		switch e := expr.(type) {
+		case sql.ExprOperation:
+			return calls(e.Left) || calls(e.Right)
+		case sql.ExprValueString:
+			_, _, ok := sequenceCall(e.Value)
+			return ok
+		}
+
+		return false
+	}
+
+	return calls(where.Expr)
+}
+
+// bindSequences returns the statement with the calls of the sequence
+// functions replaced with their values, the same calls within the
+// statement share the value.
+func (db *Database) bindSequences(q sql.Statement) (sql.Statement, error) {
+	return bindSequenceCalls(q, func(function string, name string) (int, error) {
+		if function == "nextval" {
+			return db.NextValue(name)
+		}
+
+		return db.CurrentValue(name)
+	})
+}
+
+// bindSequenceCalls returns the statement with the calls of the
+// sequence functions replaced with the values returned by value.
+func bindSequenceCalls(q sql.Statement, value func(function string, name string) (int, error)) (sql.Statement, error) {
+	if !hasSequenceCalls(q) {
+		return q, nil
+	}
+
+	literals := make(map[string]sql.Expr)
+	var bindErr error
+	bind := func(literal string) {
+		function, name, ok := sequenceCall(literal)
+		if _, bound := literals[literal]; !ok || bound || bindErr != nil {
+			return
+		}
+
+		var result int
+		result, bindErr = value(function, name)
+		literals[literal] = sql.ExprValueInteger{Value: strconv.Itoa(result)}
+	}
+
+	var walk func(expr sql.Expr)
+	walk = func(expr sql.Expr) {
+		switch e := expr.(type) {
+		case sql.ExprOperation:
+			walk(e.Left)
+			walk(e.Right)
+		case sql.ExprValueString:
+			bind(e.Value)
+		}
+	}
+
+	bindCallValues := func(values []string) []string {
+		for _, value := range values {
+			bind(value)
+		}
+
+		return bindValues(values, literals)
+	}
+	bindCallWhere := func(where *sql.Where) *sql.Where {
+		if where == nil {
+			return nil
+		}
+		walk(where.Expr)
+
+		return bindWhere(where, literals)
+	}
+
+	var bound sql.Statement
+	switch query := q.(type) {
+	case *sql.Insert:
+		copied := *query
+		copied.Values = bindCallValues(query.Values)
+		bound = &copied
+	case *sql.Update:
+		copied := *query
+		copied.Values = bindCallValues(query.Values)
+		copied.Where = bindCallWhere(query.Where)
+		bound = &copied
+	case *sql.Select:
+		copied := *query
+		copied.Where = bindCallWhere(query.Where)
+		bound = &copied
+	case *sql.Delete:
+		copied := *query
+		copied.Where = bindCallWhere(query.Where)
+		bound = &copied
+	case *UpdateIfVersion:
+		copied := *query
+		update := *query.Update
+		update.Values = bindCallValues(query.Values)
+		update.Where = bindCallWhere(query.Where)
+		copied.Update = &update
+		bound = &copied
+	case *DeleteIfVersion:
+		copied := *query
+		deleteQuery := *query.Delete
+		deleteQuery.Where = bindCallWhere(query.Where)
+		copied.Delete = &deleteQuery
+		bound = &copied
+	}
+
+	if bindErr != nil {
+		return nil, bindErr
+	}
+
+	return bound, nil
+}
+
+// CreateSequence creates the sequence.
+func (db *Database) CreateSequence(query *CreateSequence) error {
+	if query.Increment == 0 {
+		return fmt.Errorf("increment of sequence %s must not be zero", query.Name)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.sequences[query.Name]; exists {
+		return newError(CodeDuplicateObject, "sequence %s exists (sequence names are case-insensitive)", query.Name)
+	}
+
+	db.sequences[query.Name] = &sequence{Sequence: Sequence{Name: query.Name, Start: query.Start, Increment: query.Increment}}
+	if err := db.storeSequences(); err != nil {
+		delete(db.sequences, query.Name)
+		return err
+	}
+
+	return nil
+}
+
+// DropSequence drops the sequence.
+func (db *Database) DropSequence(query *DropSequence) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seq, exists := db.sequences[query.Name]
+	if !exists {
+		return newError(CodeUndefinedObject, "sequence %s does not exist", query.Name)
+	}
+
+	delete(db.sequences, query.Name)
+	if err := db.storeSequences(); err != nil {
+		db.sequences[query.Name] = seq
+		return err
+	}
+
+	return nil
+}
+
+// NextValue advances the sequence and returns the new value, the
+// next values are logged ahead when the logged ones run out.
+func (db *Database) NextValue(name string) (int, error) {
+	if err := db.leadership.notLeader(); err != nil {
+		return 0, err
+	}
+	if db.ReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seq, exists := db.sequences[name]
+	if !exists {
+		return 0, newError(CodeUndefinedObject, "sequence %s does not exist", name)
+	}
+
+	value := seq.Start
+	if seq.called {
+		if (seq.Increment > 0 && seq.value > math.MaxInt64-seq.Increment) ||
+			(seq.Increment < 0 && seq.value < math.MinInt64-seq.Increment) {
+			return 0, fmt.Errorf("sequence %s reached its limit", name)
+		}
+		value = seq.value + seq.Increment
+	}
+
+	logged := seq.Called && ((seq.Increment > 0 && value <= seq.Logged) || (seq.Increment < 0 && value >= seq.Logged))
+	if !logged {
+		previous := seq.Sequence
+		seq.Called = true
+		seq.Logged = value
+		for i := 1; i < sequenceLogValues; i++ {
+			if (seq.Increment > 0 && seq.Logged > math.MaxInt64-seq.Increment) ||
+				(seq.Increment < 0 && seq.Logged < math.MinInt64-seq.Increment) {
+				break
+			}
+			seq.Logged += seq.Increment
+		}
+
+		if err := db.storeSequences(); err != nil {
+			seq.Sequence = previous
+			return 0, err
+		}
+	}
+
+	seq.value = value
+	seq.called = true
+	seq.current = true
+
+	return value, nil
+}
+
+// CurrentValue returns the value last returned by NextValue
+// since the database is open.
+func (db *Database) CurrentValue(name string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seq, exists := db.sequences[name]
+	if !exists {
+		return 0, newError(CodeUndefinedObject, "sequence %s does not exist", name)
+	}
+	if !seq.current {
+		return 0, fmt.Errorf("currval of sequence %s is not yet defined", name)
+	}
+
+	return seq.value, nil
+}
+
+// sequenceRows describes the sequences.
+func (db *Database) sequenceRows() [][]interface{} {
+	names := make([]string, 0, len(db.sequences))
+	for name := range db.sequences {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([][]interface{}, 0, len(names))
+	for _, name := range names {
+		seq := db.sequences[name]
+		var lastValue interface{}
+		if seq.current {
+			lastValue = seq.value
+		}
+		rows = append(rows, []interface{}{seq.Name, seq.Start, seq.Increment, lastValue})
+	}
+
+	return rows
+}
+
+// loadSequences reads the sequences, they continue
+// after the logged values.
+func loadSequences(dbDir string, e *encryption) (map[string]*sequence, error) {
+	filePath := path.Join(dbDir, sequencesFileName)
+	content, err := readFileContent(filePath, e)
+	if os.IsNotExist(err) {
+		return make(map[string]*sequence), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	var logged []Sequence
+	if err := json.Unmarshal(content, &logged); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	sequences := make(map[string]*sequence, len(logged))
+	for _, seq := range logged {
+		sequences[seq.Name] = &sequence{Sequence: seq, value: seq.Logged, called: seq.Called}
+	}
+
+	return sequences, nil
+}
+
+// storeSequences replaces the sequences file, it must be called
+// with the database lock held.
+func (db *Database) storeSequences() error {
+	logged := make([]Sequence, 0, len(db.sequences))
+	for _, seq := range db.sequences {
+		logged = append(logged, seq.Sequence)
+	}
+	sort.Slice(logged, func(i, j int) bool { return logged[i].Name < logged[j].Name })
+
+	content, err := json.MarshalIndent(logged, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode sequences: %w", err)
+	}
+
+	return db.writeFileContent(path.Join(db.dbDir, sequencesFileName), content)
+}
@@ -0,0 +1,330 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// SetSessionIsolation represents SET SESSION CHARACTERISTICS AS
+// TRANSACTION ISOLATION LEVEL statement.
+type SetSessionIsolation struct {
+	Isolation IsolationLevel
+}
+
+// GetType returns the statement type.
+func (*SetSessionIsolation) GetType() sql.StatementType { return StatementSetSessionIsolation }
+
+// parseSetSessionIsolation parses SET SESSION CHARACTERISTICS AS
+// TRANSACTION ISOLATION LEVEL statement.
+func parseSetSessionIsolation(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SET", "SESSION")
+	err := s.expectKeyword("CHARACTERISTICS", "AS", "TRANSACTION")
+	if err != nil {
+		return nil, err
+	}
+
+	level, err := parseIsolationLevel(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetSessionIsolation{level}, s.expectEnd()
+}
+
+// Session keeps the state of a client between the requests: the open
+// transaction, the prepared statements and the settings. The session
+// is closed after it has not been used for the session timeout.
+type Session struct {
+	// ID identifies the session in the requests.
+	ID string
+	// User is the name of the user who has opened the session,
+	// empty if the session has been opened without authentication.
+	User string
+
+	db *Database
+
+	mu       sync.Mutex
+	opened   time.Time
+	lastUsed time.Time
+	// tx is the transaction started in the session,
+	// it is nil or done if there is none
+	tx *Transaction
+	// prepared statements of the session by identifiers
+	prepared       map[string]*PreparedStatement
+	lastPreparedID int
+	// isolation is the isolation level of the transactions
+	// started in the session
+	isolation IsolationLevel
+	// searchPath are the schemas the unqualified table names
+	// are resolved with, the public one if empty
+	searchPath []string
+	// temporarySchema is the schema of the temporary tables
+	// of the session
+	temporarySchema string
+	// settings are the ones changed by SET SESSION
+	settings map[string]string
+	closed   bool
+}
+
+// sessions is a registry of the open sessions by identifiers.
+type sessions struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	// lastNumber numbers the schemas of the temporary tables,
+	// the identifiers of the sessions are secret
+	lastNumber int
+}
+
+func newSessions() *sessions {
+	return &sessions{sessions: make(map[string]*Session)}
+}
+
+// OpenSession starts a new session.
+func (db *Database) OpenSession() (*Session, error) {
+	return db.OpenUserSession("")
+}
+
+// OpenUserSession starts a new session of the user.
+func (db *Database) OpenUserSession(userName string) (*Session, error) {
+	db.expireSessions()
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session id: %w", err)
+	}
+
+	s := &Session{
+		ID:        hex.EncodeToString(id),
+		User:      strings.ToLower(userName),
+		db:        db,
+		opened:    time.Now(),
+		lastUsed:  time.Now(),
+		prepared:  make(map[string]*PreparedStatement),
+		isolation: db.options.Isolation,
+		settings:  make(map[string]string),
+	}
+
+	db.sessions.mu.Lock()
+	db.sessions.lastNumber++
+	s.temporarySchema = temporarySchemaPrefix + strconv.Itoa(db.sessions.lastNumber)
+	db.sessions.sessions[s.ID] = s
+	db.sessions.mu.Unlock()
+
+	return s, nil
+}
+
+// Session returns the open session and marks it as used.
+func (db *Database) Session(id string) (*Session, error) {
+	db.expireSessions()
+
+	db.sessions.mu.Lock()
+	s, exists := db.sessions.sessions[id]
+	db.sessions.mu.Unlock()
+	if !exists {
+		return nil, newError(CodeUndefinedObject, "session %s does not exist", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, newError(CodeUndefinedObject, "session %s does not exist", id)
+	}
+	s.lastUsed = time.Now()
+
+	return s, nil
+}
+
+// CloseSession closes the session and rolls back its transaction.
+func (db *Database) CloseSession(id string) error {
+	db.sessions.mu.Lock()
+	s, exists := db.sessions.sessions[id]
+	delete(db.sessions.sessions, id)
+	db.sessions.mu.Unlock()
+	if !exists {
+		return newError(CodeUndefinedObject, "session %s does not exist", id)
+	}
+
+	return s.close()
+}
+
+// expireSessions closes the sessions that have not been used
+// for longer than the session timeout.
+func (db *Database) expireSessions() {
+	timeout := db.options.SessionTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	expired := make([]*Session, 0)
+	db.sessions.mu.Lock()
+	for id, s := range db.sessions.sessions {
+		s.mu.Lock()
+		if time.Since(s.lastUsed) > timeout {
+			expired = append(expired, s)
+			delete(db.sessions.sessions, id)
+		}
+		s.mu.Unlock()
+	}
+	db.sessions.mu.Unlock()
+
+	for _, s := range expired {
+		logging.Warnf("closing expired session %s", s.ID)
+		if err := s.close(); err != nil {
+			logging.Errorf("failed to close expired session %s: %s", s.ID, err)
+		}
+	}
+}
+
+// close rolls back the transaction of the session and drops
+// its prepared statements and temporary tables.
+func (s *Session) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.prepared = nil
+	tx := s.transaction()
+	s.tx = nil
+	// the temporary tables are dropped after the transaction
+	// that may use them has ended
+	defer s.db.dropSessionTables(s.ID)
+	if tx == nil {
+		return nil
+	}
+
+	if err := tx.Rollback(); err != nil {
+		return fmt.Errorf("failed to roll back transaction %s of session %s: %w", tx.ID, s.ID, err)
+	}
+
+	return nil
+}
+
+// Transaction returns the active transaction of the session, nil if
+// the transaction has not been started or has already ended.
+func (s *Session) Transaction() *Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.transaction()
+}
+
+func (s *Session) transaction() *Transaction {
+	if s.tx == nil {
+		return nil
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.tx.done {
+		return nil
+	}
+
+	return s.tx
+}
+
+// Begin starts the transaction of the session, empty isolation
+// level means the level of the session.
+func (s *Session) Begin(isolation IsolationLevel) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, fmt.Errorf("session %s is closed", s.ID)
+	}
+
+	if tx := s.transaction(); tx != nil {
+		return nil, fmt.Errorf("transaction %s is already started in session %s", tx.ID, s.ID)
+	}
+
+	if isolation == "" {
+		isolation = s.isolation
+	}
+
+	tx, err := s.db.Begin(isolation)
+	if err != nil {
+		return nil, err
+	}
+	tx.User = s.User
+	s.tx = tx
+
+	return tx, nil
+}
+
+// SetIsolation changes the isolation level of the transactions
+// started in the session from now on.
+func (s *Session) SetIsolation(level IsolationLevel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.isolation = level
+}
+
+// Isolation returns the isolation level of the session transactions.
+func (s *Session) Isolation() IsolationLevel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.isolation
+}
+
+// Prepare registers the prepared statement in the session,
+// the statement is removed when the session is closed.
+func (s *Session) Prepare(query string) (*PreparedStatement, error) {
+	statement, err := NewPreparedStatement(query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, fmt.Errorf("session %s is closed", s.ID)
+	}
+
+	// the prefix keeps the session statements apart from
+	// the statements registered in the database
+	s.lastPreparedID++
+	statement.ID = "s" + strconv.Itoa(s.lastPreparedID)
+	s.prepared[statement.ID] = statement
+
+	return statement, nil
+}
+
+// PreparedStatement returns the prepared statement of the session
+// or, if there is none with the identifier, of the database.
+func (s *Session) PreparedStatement(id string) (*PreparedStatement, error) {
+	s.mu.Lock()
+	statement, exists := s.prepared[id]
+	s.mu.Unlock()
+	if exists {
+		return statement, nil
+	}
+
+	return s.db.PreparedStatement(id)
+}
+
+// Deallocate removes the prepared statement of the session
+// or, if there is none with the identifier, of the database.
+func (s *Session) Deallocate(id string) error {
+	s.mu.Lock()
+	_, exists := s.prepared[id]
+	delete(s.prepared, id)
+	s.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	return s.db.Deallocate(id)
+}
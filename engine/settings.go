@@ -0,0 +1,418 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// settingsFileName is the file of the settings changed by SET GLOBAL,
+// they are applied over the options the database is opened with.
+const settingsFileName = "gosqldb.settings.json"
+
+// SettingScope defines whom the changed setting applies to.
+type SettingScope string
+
+const (
+	// ScopeSession changes the setting for the statements of the session.
+	ScopeSession SettingScope = "session"
+	// ScopeGlobal changes the setting for all the statements
+	// and keeps it after the restart.
+	ScopeGlobal SettingScope = "global"
+)
+
+// SetSetting represents SET [GLOBAL | SESSION] name = value statement.
+type SetSetting struct {
+	Scope SettingScope
+	Name  string
+	// Value is empty for DEFAULT
+	Value string
+}
+
+// GetType returns the statement type.
+func (*SetSetting) GetType() sql.StatementType { return StatementSetSetting }
+
+// ShowSetting represents SHOW name statement.
+type ShowSetting struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*ShowSetting) GetType() sql.StatementType { return StatementShowSetting }
+
+// setting is the knob that can be changed at runtime.
+type setting struct {
+	description string
+	// session reports whether the setting can be changed for
+	// the session, it is changed for it by default then
+	session bool
+	// process reports whether the setting is shared by all the
+	// databases of the process, it is changed in the main one
+	process bool
+	// parse returns the normalized value
+	parse func(value string) (string, error)
+	get   func(db *Database) string
+	// set is called with the parsed value
+	set func(db *Database, value string) error
+}
+
+var settings = map[string]setting{
+	"fsync": {
+		description: "when the written files are flushed to the stable storage: always, interval or never",
+		parse: func(value string) (string, error) {
+			policy, err := ParseFsyncPolicy(strings.ToLower(value))
+
+			return string(policy), err
+		},
+		get: func(db *Database) string {
+			return string(db.syncer.currentPolicy())
+		},
+		set: func(db *Database, value string) error {
+			return db.syncer.setPolicy(FsyncPolicy(value))
+		},
+	},
+	"log_level": {
+		description: "which messages are logged: debug, info, warn or error",
+		process:     true,
+		parse: func(value string) (string, error) {
+			level, err := logging.ParseLevel(strings.ToLower(value))
+
+			return string(level), err
+		},
+		get: func(*Database) string {
+			return string(logging.CurrentLevel())
+		},
+		set: func(_ *Database, value string) error {
+			logging.SetLevel(logging.Level(value))
+
+			return nil
+		},
+	},
+	"statement_timeout": {
+		description: "how long a statement can run, in milliseconds or as a duration like 5s, 0 disables the timeout",
+		session:     true,
+		parse: func(value string) (string, error) {
+			timeout, err := parseStatementTimeout(value)
+
+			return timeout.String(), err
+		},
+		get: func(db *Database) string {
+			return time.Duration(atomic.LoadInt64(&db.statementTimeout)).String()
+		},
+		set: func(db *Database, value string) error {
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			atomic.StoreInt64(&db.statementTimeout, int64(timeout))
+
+			return nil
+		},
+	},
+}
+
+// parseStatementTimeout parses the milliseconds or the duration.
+func parseStatementTimeout(value string) (time.Duration, error) {
+	if milliseconds, err := strconv.Atoi(value); err == nil {
+		value = strconv.Itoa(milliseconds) + "ms"
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid statement timeout %s, expected milliseconds or duration", value)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("invalid statement timeout %s, it can not be negative", value)
+	}
+
+	return timeout, nil
+}
+
+// isSetSetting reports whether the next tokens are SET of a setting.
+func isSetSetting(s *tokenStream) bool {
+	next := 1
+	if s.isKeyword("SET", "GLOBAL") || s.isKeyword("SET", "SESSION") {
+		next++
+	}
+
+	return s.isKeyword("SET") && s.pos+next < len(s.tokens) && isSettingName(s.tokens[s.pos+next])
+}
+
+// isShowSetting reports whether the next tokens are SHOW of a setting.
+func isShowSetting(s *tokenStream) bool {
+	return s.isKeyword("SHOW") && s.pos+1 < len(s.tokens) && isSettingName(s.tokens[s.pos+1])
+}
+
+func isSettingName(t token) bool {
+	_, exists := settings[strings.ToLower(t.value)]
+
+	return t.kind == tokenWord && exists
+}
+
+// parseSetSetting parses SET [GLOBAL | SESSION] name {= | TO}
+// {value | DEFAULT} statement, the session settings are changed
+// for the session and the rest globally without the scope.
+func parseSetSetting(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SET")
+	query := &SetSetting{}
+	switch {
+	case s.acceptKeyword("GLOBAL"):
+		query.Scope = ScopeGlobal
+	case s.acceptKeyword("SESSION"):
+		query.Scope = ScopeSession
+	}
+
+	t := s.next()
+	query.Name = strings.ToLower(t.value)
+	setting := settings[query.Name]
+	if query.Scope == "" {
+		query.Scope = ScopeGlobal
+		if setting.session {
+			query.Scope = ScopeSession
+		}
+	}
+	if query.Scope == ScopeSession && !setting.session {
+		return nil, &SyntaxError{fmt.Sprintf("setting %s can only be changed globally", query.Name), t.pos}
+	}
+
+	if !s.acceptKeyword("TO") && !s.acceptSymbol("=") {
+		return nil, s.unexpected("TO or =")
+	}
+
+	if s.acceptKeyword("DEFAULT") {
+		return query, s.expectEnd()
+	}
+
+	var value string
+	valuePos := s.peek().pos
+	switch s.peek().kind {
+	case tokenWord:
+		value = s.next().value
+	case tokenNumber, tokenString:
+		v, err := s.expectValue()
+		if err != nil {
+			return nil, err
+		}
+		value = fmt.Sprint(v)
+	default:
+		return nil, s.unexpected("value")
+	}
+
+	parsed, err := setting.parse(value)
+	if err != nil {
+		return nil, &SyntaxError{err.Error(), valuePos}
+	}
+	query.Value = parsed
+
+	return query, s.expectEnd()
+}
+
+// parseShowSetting parses SHOW name statement.
+func parseShowSetting(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SHOW")
+
+	return &ShowSetting{strings.ToLower(s.next().value)}, s.expectEnd()
+}
+
+// SetSetting changes the setting globally, the value is kept in the
+// settings file until it is set to DEFAULT.
+func (db *Database) SetSetting(query *SetSetting) error {
+	setting, exists := settings[query.Name]
+	if !exists {
+		return newError(CodeUndefinedObject, "setting %s does not exist", query.Name)
+	}
+	if setting.process && db.authority != nil {
+		return fmt.Errorf("setting %s is shared by the databases, it is changed in database %s", query.Name, MainDatabase)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	value := query.Value
+	if value == "" {
+		value = db.defaultSettings[query.Name]
+	}
+
+	previous := setting.get(db)
+	if err := setting.set(db, value); err != nil {
+		return fmt.Errorf("failed to set %s: %w", query.Name, err)
+	}
+
+	stored, wasStored := db.settings[query.Name]
+	if query.Value == "" {
+		delete(db.settings, query.Name)
+	} else {
+		db.settings[query.Name] = query.Value
+	}
+
+	if err := db.storeSettings(); err != nil {
+		if wasStored {
+			db.settings[query.Name] = stored
+		} else {
+			delete(db.settings, query.Name)
+		}
+		if rollbackErr := setting.set(db, previous); rollbackErr != nil {
+			logging.Errorf("failed to restore %s: %s", query.Name, rollbackErr)
+		}
+
+		return err
+	}
+
+	logging.Infof("setting %s is %s from now on", query.Name, value)
+
+	return nil
+}
+
+// ShowSetting returns the global value of the setting.
+func (db *Database) ShowSetting(query *ShowSetting) (string, error) {
+	setting, exists := settings[query.Name]
+	if !exists {
+		return "", newError(CodeUndefinedObject, "setting %s does not exist", query.Name)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return setting.get(db), nil
+}
+
+// SetSetting changes the setting for the statements of the
+// session, DEFAULT restores the global value.
+func (s *Session) SetSetting(query *SetSetting) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if query.Value == "" {
+		delete(s.settings, query.Name)
+	} else {
+		s.settings[query.Name] = query.Value
+	}
+
+	return nil
+}
+
+// ShowSetting returns the value of the setting
+// for the statements of the session.
+func (s *Session) ShowSetting(query *ShowSetting) (string, error) {
+	s.mu.Lock()
+	value, exists := s.settings[query.Name]
+	s.mu.Unlock()
+	if exists {
+		return value, nil
+	}
+
+	return s.db.ShowSetting(query)
+}
+
+// statementTimeoutKey is the context key of the
+// statement timeout of the session.
+type statementTimeoutKey struct{}
+
+// settingsContext returns the context of the
+// statement with the settings of the session.
+func (s *Session) settingsContext(ctx context.Context) context.Context {
+	s.mu.Lock()
+	value, exists := s.settings["statement_timeout"]
+	s.mu.Unlock()
+	if !exists {
+		return ctx
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, statementTimeoutKey{}, timeout)
+}
+
+// settingRows returns the rows of the settings table,
+// it must be called with the database lock held.
+func (db *Database) settingRows() [][]interface{} {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([][]interface{}, 0, len(names))
+	for _, name := range names {
+		setting := settings[name]
+		scope := ScopeGlobal
+		if setting.session {
+			scope = ScopeSession
+		}
+		rows = append(rows, []interface{}{name, setting.get(db), db.defaultSettings[name], string(scope), setting.description})
+	}
+
+	return rows
+}
+
+// loadSettings reads the settings changed by SET GLOBAL.
+func loadSettings(dbDir string, e *encryption) (map[string]string, error) {
+	filePath := path.Join(dbDir, settingsFileName)
+	content, err := readFileContent(filePath, e)
+	if os.IsNotExist(err) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	stored := make(map[string]string)
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	return stored, nil
+}
+
+// applySettings remembers the values the database is opened with and
+// applies the stored settings over them, the unknown ones are ignored.
+func (db *Database) applySettings(stored map[string]string) error {
+	db.defaultSettings = make(map[string]string, len(settings))
+	for name, setting := range settings {
+		db.defaultSettings[name] = setting.get(db)
+	}
+
+	db.settings = make(map[string]string, len(stored))
+	for name, value := range stored {
+		setting, exists := settings[name]
+		if !exists {
+			logging.Warnf("ignoring stored setting %s", name)
+			continue
+		}
+
+		parsed, err := setting.parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid stored setting %s: %w", name, err)
+		}
+		if err := setting.set(db, parsed); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+		db.settings[name] = parsed
+	}
+
+	return nil
+}
+
+// storeSettings replaces the settings file, it must be called
+// with the database lock held.
+func (db *Database) storeSettings() error {
+	content, err := json.MarshalIndent(db.settings, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+
+	return db.writeFileContent(path.Join(db.dbDir, settingsFileName), content)
+}
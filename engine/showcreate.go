@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// ShowCreateTable represents SHOW CREATE TABLE statement.
+type ShowCreateTable struct {
+	Table string
+}
+
+// GetType returns the statement type.
+func (*ShowCreateTable) GetType() sql.StatementType { return StatementShowCreateTable }
+
+// parseShowCreateTable parses SHOW CREATE TABLE statement.
+func parseShowCreateTable(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("SHOW", "CREATE", "TABLE")
+
+	table, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShowCreateTable{Table: table}, s.expectEnd()
+}
+
+// ShowCreateTable returns the statements that create the table as it
+// is: CREATE TABLE with the columns, the engine, the partitions and the
+// row version followed by the masks of the columns, the comments and
+// the triggers, separated by semicolons and new lines. The statements
+// are executed one by one to create the same table in another database.
+func (db *Database) ShowCreateTable(query *ShowCreateTable) (string, error) {
+	schema, err := db.Schema(query.Table)
+	if err != nil {
+		return "", err
+	}
+
+	statements := []string{createTableStatement(schema)}
+	statements = append(statements, maskStatements(schema)...)
+	statements = append(statements, commentStatements(schema)...)
+	statements = append(statements, triggerStatements(schema)...)
+
+	return strings.Join(statements, ";\n") + ";", nil
+}
+
+// triggerStatements renders the statements that create the triggers.
+func triggerStatements(schema Schema) []string {
+	statements := make([]string, 0, len(schema.Triggers))
+	for _, trigger := range schema.Triggers {
+		statement := fmt.Sprintf("CREATE TRIGGER %s %s %s ON %s", trigger.Name, trigger.Timing, trigger.Event, sqlName(schema.Name))
+		if trigger.AuditTable != "" {
+			statement += " AUDIT INTO " + sqlName(trigger.AuditTable)
+		} else {
+			statement += " EXECUTE " + quotedText(trigger.Action)
+		}
+		statements = append(statements, statement)
+	}
+
+	return statements
+}
+
+// sqlName renders the name of the table or the column for the
+// statements, the tables of the schemas are qualified and the names
+// quoted with their case are quoted again.
+func sqlName(name string) string {
+	if separator := strings.Index(name, schemaSeparator); separator > 0 {
+		return name[:separator] + "." + sqlName(name[separator+len(schemaSeparator):])
+	}
+
+	if display := DisplayName(name); display != name {
+		return "`" + display + "`"
+	}
+
+	return name
+}
@@ -0,0 +1,644 @@
+package engine
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The selected rows are sorted in memory while the query has the memory
+// for them. Then the sorted rows are written to a temporary file as a
+// run and the sort continues with the next rows. The runs and the rows
+// left in memory are merged when the rows are read, so the sort holds
+// the work memory and a row of every run. The temporary files are
+// removed when the sort is done.
+
+// spillFilePattern is the name pattern of the temporary files
+// of the rows spilled by the queries.
+const spillFilePattern = "gosqldb-spill-*" + tempFileExtension
+
+// sortMinRunRows is the minimum number of the rows of a sorted run, so
+// the sort does not write a file per row when the memory is exhausted,
+// the rows of the run are kept over the memory limit.
+const sortMinRunRows = 128
+
+// OrderedSelect represents SELECT ... [WHERE ...] ORDER BY column
+// [ASC|DESC], ... [LIMIT ...] statement, the rows are sorted by the
+// columns with the ties kept in the order of the scan.
+type OrderedSelect struct {
+	*sql.Select
+	OrderBy []OrderTerm
+}
+
+// GetType returns the statement type.
+func (*OrderedSelect) GetType() sql.StatementType { return StatementOrderedSelect }
+
+// OrderTerm is the column of ORDER BY.
+type OrderTerm struct {
+	Column     string
+	Descending bool
+}
+
+func (t OrderTerm) String() string {
+	if t.Descending {
+		return t.Column + " DESC"
+	}
+
+	return t.Column
+}
+
+// orderByIndex returns the index of the ORDER token of ORDER BY,
+// -1 if the query has no ORDER BY.
+func orderByIndex(tokens []token) int {
+	return keywordsIndex(tokens, "ORDER", "BY")
+}
+
+// keywordsIndex returns the index of the first of the adjacent
+// keywords, -1 if the tokens do not have them.
+func keywordsIndex(tokens []token, first, second string) int {
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i].kind == tokenWord && strings.EqualFold(tokens[i].value, first) &&
+			tokens[i+1].kind == tokenWord && strings.EqualFold(tokens[i+1].value, second) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// isOrderedSelect reports whether the statement is SELECT with ORDER BY.
+func isOrderedSelect(s *tokenStream) bool {
+	return s.isKeyword("SELECT") && orderByIndex(s.tokens) >= 0
+}
+
+// parseOrderedSelect parses the ORDER BY part, the rest of the query
+// is parsed by gosqlparser with the part blanked.
+func parseOrderedSelect(query string, s *tokenStream) (sql.Statement, error) {
+	order := orderByIndex(s.tokens)
+	s.pos = order + 2
+
+	terms, err := parseOrderTerms(s)
+	if err != nil {
+		return nil, err
+	}
+
+	end := s.peek()
+	if !s.isKeyword("LIMIT") {
+		if err := s.expectEnd(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the blanked part keeps the error positions
+	start := s.tokens[order].pos
+	statement, err := sql.Parse(protectEscapedQuotes(query[:start] + strings.Repeat(" ", end.pos-start) + query[end.pos:]))
+	if err != nil {
+		return nil, err
+	}
+
+	selected, ok := statement.(*sql.Select)
+	if !ok {
+		return nil, fmt.Errorf("ORDER BY is supported only in SELECT, got %T", statement)
+	}
+
+	return &OrderedSelect{selected, terms}, nil
+}
+
+// parseOrderTerms parses the columns of ORDER BY.
+func parseOrderTerms(s *tokenStream) ([]OrderTerm, error) {
+	terms := make([]OrderTerm, 0)
+	for {
+		column, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+
+		term := OrderTerm{Column: strings.ToLower(column)}
+		if s.acceptKeyword("DESC") {
+			term.Descending = true
+		} else {
+			s.acceptKeyword("ASC")
+		}
+		terms = append(terms, term)
+
+		if !s.acceptSymbol(",") {
+			return terms, nil
+		}
+	}
+}
+
+// SortStats counts the sorts of the ORDER BY queries.
+type SortStats struct {
+	Sorts uint64 `json:"sorts"`
+	// Spilled is the number of the sorts that have exceeded
+	// the work memory and written the rows to temporary files.
+	Spilled      uint64 `json:"spilled"`
+	SpilledRows  uint64 `json:"spilled_rows"`
+	SpilledBytes uint64 `json:"spilled_bytes"`
+}
+
+// spillCounters count the operations of the queries, the sorts or the
+// aggregations, and the rows they have written to temporary files.
+type spillCounters struct {
+	mu           sync.Mutex
+	operations   uint64
+	spilled      uint64
+	spilledRows  uint64
+	spilledBytes uint64
+}
+
+// add counts the operation with the spilled rows and bytes.
+func (c *spillCounters) add(rows int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.operations++
+	if rows > 0 {
+		c.spilled++
+		c.spilledRows += uint64(rows)
+		c.spilledBytes += uint64(bytes)
+	}
+}
+
+// SortStats returns the counters of the sorts since start.
+func (db *Database) SortStats() SortStats {
+	db.sorts.mu.Lock()
+	defer db.sorts.mu.Unlock()
+
+	return SortStats{db.sorts.operations, db.sorts.spilled, db.sorts.spilledRows, db.sorts.spilledBytes}
+}
+
+// SortContext fetches the sorted rows.
+func (db *Database) SortContext(ctx context.Context, query *OrderedSelect) ([][]interface{}, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return collectRows(func(f func(row []interface{}) error) error {
+		return db.sortEach(ctx, query, nil, nil, masks, f)
+	})
+}
+
+// SortEachContext fetches the sorted rows and calls f for every row
+// without collecting them, the rows that do not fit in the work memory
+// are sorted in temporary files.
+func (db *Database) SortEachContext(ctx context.Context, query *OrderedSelect, f func(row []interface{}) error) (err error) {
+	rows, started := 0, time.Now()
+	defer func() { db.logQuery(ctx, query, started, rows, err) }()
+
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.sortEach(ctx, query, nil, nil, masks, countRows(&rows, f))
+}
+
+// SortContext fetches the sorted rows within the transaction.
+func (tx *Transaction) SortContext(ctx context.Context, query *OrderedSelect) ([][]interface{}, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	masks := tx.db.queryMasks(ctx, query.Table)
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return nil, err
+	}
+	tx.queried = true
+
+	return collectRows(func(f func(row []interface{}) error) error {
+		return tx.db.sortEach(ctx, query, nil, tx, masks, f)
+	})
+}
+
+// SortEachContext is SortEachContext of the database
+// within the transaction.
+func (tx *Transaction) SortEachContext(ctx context.Context, query *OrderedSelect, f func(row []interface{}) error) (err error) {
+	rows, started := 0, time.Now()
+	defer func() { tx.db.logQuery(ctx, query, started, rows, err) }()
+
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	masks := tx.db.queryMasks(ctx, query.Table)
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return err
+	}
+	tx.queried = true
+
+	return tx.db.sortEach(ctx, query, nil, tx, masks, countRows(&rows, f))
+}
+
+// collectRows returns the rows passed by each.
+func collectRows(each func(f func(row []interface{}) error) error) ([][]interface{}, error) {
+	rows := make([][]interface{}, 0)
+	err := each(func(row []interface{}) error {
+		rows = append(rows, row)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// sortEach scans the selected rows into the sorter and passes them to
+// f in the order. The values are masked before they are sorted, so the
+// order does not reveal the masked ones. It must be called with the
+// database locked, the lock is released while the rows are merged.
+func (db *Database) sortEach(ctx context.Context, query *OrderedSelect, a *analysis, tx *Transaction, masks []*ColumnMask, f func(row []interface{}) error) error {
+	compare, err := db.rowOrder(query)
+	if err != nil {
+		return err
+	}
+
+	op := a.operator("sort")
+	defer op.finish()
+
+	memory := db.memory.query(db.options.WorkMem)
+	defer memory.close()
+
+	sorter := newExternalSorter(compare, memory, db.options.TempDir)
+	defer sorter.close()
+
+	err = db.selectEach(ctx, query.Select, a, tx, maskEach(masks, func(row []interface{}) error {
+		op.read()
+
+		return sorter.add(row)
+	}))
+	if err != nil {
+		return err
+	}
+	db.sorts.add(sorter.spilledRows, sorter.spilledBytes)
+	if len(sorter.runs) > 0 && op != nil {
+		op.name = fmt.Sprintf("external sort (%d runs, %d bytes spilled)", len(sorter.runs), sorter.spilledBytes)
+	}
+
+	db.mu.Unlock()
+	defer db.mu.Lock()
+
+	return sorter.each(ctx, func(row []interface{}) error {
+		op.produce()
+
+		return f(row)
+	})
+}
+
+// rowOrder returns the comparison of the rows of the table by the
+// ORDER BY columns, it must be called with the database locked.
+func (db *Database) rowOrder(query *OrderedSelect) (func(a, b []interface{}) bool, error) {
+	schema, err := db.selectedSchema(query.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	return orderBy(schema, query.OrderBy)
+}
+
+// orderBy validates the ORDER BY columns and returns the comparison
+// of the rows by them.
+func orderBy(schema Schema, terms []OrderTerm) (func(a, b []interface{}) bool, error) {
+	positions := make([]int, len(terms))
+	collations := make([]string, len(terms))
+	for i, term := range terms {
+		column, exists := schema.Columns[term.Column]
+		if !exists {
+			return nil, newError(CodeUndefinedColumn, "column %s does not exist in table %s", term.Column, schema.Name)
+		}
+		positions[i] = column.Position
+		collations[i] = column.Collation
+	}
+
+	return func(a, b []interface{}) bool {
+		for i, term := range terms {
+			x, y := a[positions[i]], b[positions[i]]
+			if term.Descending {
+				x, y = y, x
+			}
+
+			if a, ok := x.(string); ok && !binaryCollation(collations[i]) {
+				if b, ok := y.(string); ok {
+					if compared := compareStrings(collations[i], a, b); compared != 0 {
+						return compared < 0
+					}
+					continue
+				}
+			}
+
+			if less(x, y) {
+				return true
+			}
+			if less(y, x) {
+				return false
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// externalSorter sorts the rows in memory while the query has the
+// memory for them, then the sorted rows are written to a temporary
+// file as a run and the runs are merged when the rows are read.
+type externalSorter struct {
+	less    func(a, b []interface{}) bool
+	memory  *queryMemory
+	tempDir string
+
+	rows [][]interface{}
+	// size is the memory reserved for the rows
+	size int64
+	runs []*spillFile
+
+	spilledRows  int
+	spilledBytes int64
+}
+
+func newExternalSorter(less func(a, b []interface{}) bool, memory *queryMemory, tempDir string) *externalSorter {
+	return &externalSorter{less: less, memory: memory, tempDir: tempDir}
+}
+
+// add adds the row, the rows are spilled to a temporary file
+// when the query has no memory for the row.
+func (s *externalSorter) add(row []interface{}) error {
+	s.rows = append(s.rows, row)
+	size := rowSize(row)
+	if s.memory.reserve(size) {
+		s.size += size
+
+		return nil
+	}
+
+	if len(s.rows) < sortMinRunRows {
+		s.memory.force(size)
+		s.size += size
+
+		return nil
+	}
+
+	return s.spill()
+}
+
+// spill writes the sorted rows in memory to a new run file.
+func (s *externalSorter) spill() error {
+	sort.SliceStable(s.rows, func(i, j int) bool {
+		return s.less(s.rows[i], s.rows[j])
+	})
+
+	file, err := createSpillFile(s.tempDir)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, file)
+
+	for _, row := range s.rows {
+		if err := file.write(row); err != nil {
+			return err
+		}
+	}
+	if err := file.finish(); err != nil {
+		return err
+	}
+
+	s.spilledRows += len(s.rows)
+	s.spilledBytes += file.size
+	s.memory.release(s.size)
+	s.rows, s.size = nil, 0
+
+	return nil
+}
+
+// each passes the sorted rows to f, the selection stops
+// with the error returned by f or when the context is done.
+func (s *externalSorter) each(ctx context.Context, f func(row []interface{}) error) error {
+	sort.SliceStable(s.rows, func(i, j int) bool {
+		return s.less(s.rows[i], s.rows[j])
+	})
+
+	if len(s.runs) == 0 {
+		for i, row := range s.rows {
+			if err := canceled(ctx, i); err != nil {
+				return err
+			}
+
+			if err := f(row); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// the rows in memory are the last run
+	merge := &sortMerge{less: s.less}
+	for i := 0; i <= len(s.runs); i++ {
+		run := &sortRun{order: i}
+		if i < len(s.runs) {
+			run.file = s.runs[i]
+		} else {
+			run.rows = s.rows
+		}
+
+		ok, err := run.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			merge.runs = append(merge.runs, run)
+		}
+	}
+	heap.Init(merge)
+
+	for i := 0; merge.Len() > 0; i++ {
+		if err := canceled(ctx, i); err != nil {
+			return err
+		}
+
+		run := merge.runs[0]
+		if err := f(run.row); err != nil {
+			return err
+		}
+
+		ok, err := run.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(merge, 0)
+		} else {
+			heap.Pop(merge)
+		}
+	}
+
+	return nil
+}
+
+// close removes the run files and releases the memory of the rows.
+func (s *externalSorter) close() {
+	for _, file := range s.runs {
+		file.remove()
+	}
+	s.memory.release(s.size)
+	s.runs, s.rows, s.size = nil, nil, 0
+}
+
+// sortRun is the sorted run of the merge,
+// read from the file or from memory.
+type sortRun struct {
+	file *spillFile
+	rows [][]interface{}
+	// row is the current row of the run
+	row []interface{}
+	// order is the order of the run, the equal rows
+	// of the earlier runs are merged first
+	order int
+}
+
+// advance reads the next row of the run,
+// it returns false when the run is over.
+func (r *sortRun) advance() (bool, error) {
+	if r.file == nil {
+		if len(r.rows) == 0 {
+			return false, nil
+		}
+		r.row, r.rows = r.rows[0], r.rows[1:]
+
+		return true, nil
+	}
+
+	row, err := r.file.read()
+	if err != nil || row == nil {
+		return false, err
+	}
+	r.row = row
+
+	return true, nil
+}
+
+// sortMerge is the min-heap of the runs by their current rows.
+type sortMerge struct {
+	runs []*sortRun
+	less func(a, b []interface{}) bool
+}
+
+func (m *sortMerge) Len() int { return len(m.runs) }
+
+func (m *sortMerge) Less(i, j int) bool {
+	a, b := m.runs[i], m.runs[j]
+	if m.less(a.row, b.row) {
+		return true
+	}
+	if m.less(b.row, a.row) {
+		return false
+	}
+
+	return a.order < b.order
+}
+
+func (m *sortMerge) Swap(i, j int)      { m.runs[i], m.runs[j] = m.runs[j], m.runs[i] }
+func (m *sortMerge) Push(x interface{}) { m.runs = append(m.runs, x.(*sortRun)) }
+
+func (m *sortMerge) Pop() interface{} {
+	old := m.runs
+	x := old[len(old)-1]
+	m.runs = old[:len(old)-1]
+
+	return x
+}
+
+// spillFile is the temporary file of the rows spilled by the query,
+// the rows are written and then read in the same order.
+type spillFile struct {
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	// size is the number of the written bytes
+	size int64
+}
+
+func createSpillFile(dir string) (*spillFile, error) {
+	file, err := ioutil.TempFile(dir, spillFilePattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %w", err)
+	}
+
+	w := bufio.NewWriter(file)
+
+	return &spillFile{file: file, writer: w, encoder: gob.NewEncoder(w)}, nil
+}
+
+func (f *spillFile) write(row []interface{}) error {
+	if err := f.encoder.Encode(row); err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+
+	return nil
+}
+
+// finish flushes the written rows and rewinds the file for reading.
+func (f *spillFile) finish() error {
+	if err := f.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+
+	size, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	f.size = size
+
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spill file: %w", err)
+	}
+	f.decoder = gob.NewDecoder(bufio.NewReader(f.file))
+
+	return nil
+}
+
+// read returns the next row, nil after the last one.
+func (f *spillFile) read() ([]interface{}, error) {
+	var row []interface{}
+	if err := f.decoder.Decode(&row); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read spill file: %w", err)
+	}
+
+	return row, nil
+}
+
+// remove closes and removes the file.
+func (f *spillFile) remove() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
@@ -0,0 +1,628 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Statement types of the gosqldb extension statements that
+// are not supported by gosqlparser.
+const (
+	// StatementCreatePartitionedTable for CREATE TABLE ... PARTITION BY query
+	StatementCreatePartitionedTable sql.StatementType = iota + 100
+	// StatementDropPartition for ALTER TABLE ... DROP PARTITION query
+	StatementDropPartition
+	// StatementExplain for EXPLAIN query
+	StatementExplain
+	// StatementBegin for BEGIN query
+	StatementBegin
+	// StatementCommit for COMMIT query
+	StatementCommit
+	// StatementRollback for ROLLBACK query
+	StatementRollback
+	// StatementSavepoint for SAVEPOINT query
+	StatementSavepoint
+	// StatementRollbackToSavepoint for ROLLBACK TO SAVEPOINT query
+	StatementRollbackToSavepoint
+	// StatementReleaseSavepoint for RELEASE SAVEPOINT query
+	StatementReleaseSavepoint
+	// StatementSetTransaction for SET TRANSACTION query
+	StatementSetTransaction
+	// StatementShowIsolationLevel for SHOW TRANSACTION ISOLATION LEVEL query
+	StatementShowIsolationLevel
+	// StatementSetSessionIsolation for SET SESSION CHARACTERISTICS query
+	StatementSetSessionIsolation
+	// StatementCreateVersionedTable for CREATE TABLE ... WITH ROW VERSION query
+	StatementCreateVersionedTable
+	// StatementUpdateIfVersion for UPDATE ... IF VERSION query
+	StatementUpdateIfVersion
+	// StatementDeleteIfVersion for DELETE ... IF VERSION query
+	StatementDeleteIfVersion
+	// StatementCreateUser for CREATE USER query
+	StatementCreateUser
+	// StatementAlterUser for ALTER USER query
+	StatementAlterUser
+	// StatementDropUser for DROP USER query
+	StatementDropUser
+	// StatementGrant for GRANT query
+	StatementGrant
+	// StatementRevoke for REVOKE query
+	StatementRevoke
+	// StatementCreateToken for CREATE TOKEN query
+	StatementCreateToken
+	// StatementDropToken for DROP TOKEN query
+	StatementDropToken
+	// StatementKill for KILL query
+	StatementKill
+	// StatementBackup for BACKUP TO query
+	StatementBackup
+	// StatementCopy for COPY ... FROM and COPY ... TO query
+	StatementCopy
+	// StatementCreateMemoryTable for CREATE MEMORY TABLE and
+	// CREATE TEMPORARY TABLE query
+	StatementCreateMemoryTable
+	// StatementSetReadOnly for SET DATABASE READ ONLY and
+	// SET DATABASE READ WRITE query
+	StatementSetReadOnly
+	// StatementCreateDatabase for CREATE DATABASE query
+	StatementCreateDatabase
+	// StatementDropDatabase for DROP DATABASE query
+	StatementDropDatabase
+	// StatementUseDatabase for USE query
+	StatementUseDatabase
+	// StatementCreateSchema for CREATE SCHEMA query
+	StatementCreateSchema
+	// StatementDropSchema for DROP SCHEMA query
+	StatementDropSchema
+	// StatementSetSearchPath for SET SEARCH_PATH query
+	StatementSetSearchPath
+	// StatementCreateTrigger for CREATE TRIGGER query
+	StatementCreateTrigger
+	// StatementDropTrigger for DROP TRIGGER query
+	StatementDropTrigger
+	// StatementCreateSequence for CREATE SEQUENCE query
+	StatementCreateSequence
+	// StatementDropSequence for DROP SEQUENCE query
+	StatementDropSequence
+	// StatementCountRows for SELECT COUNT(*) query
+	StatementCountRows
+	// StatementAlterColumnMask for ALTER TABLE ... ALTER COLUMN ... MASK query
+	StatementAlterColumnMask
+	// StatementAnalyze for ANALYZE query
+	StatementAnalyze
+	// StatementOrderedSelect for SELECT ... ORDER BY query
+	StatementOrderedSelect
+	// StatementGroupedSelect for SELECT ... GROUP BY query
+	StatementGroupedSelect
+	// StatementAsOfSelect for SELECT ... AS OF TIMESTAMP query
+	StatementAsOfSelect
+	// StatementFlashback for FLASHBACK TABLE query
+	StatementFlashback
+	// StatementRenameTable for ALTER TABLE ... RENAME TO query
+	StatementRenameTable
+	// StatementShowCreateTable for SHOW CREATE TABLE query
+	StatementShowCreateTable
+	// StatementComment for COMMENT ON query
+	StatementComment
+	// StatementSetSetting for SET [GLOBAL | SESSION] name = value query
+	StatementSetSetting
+	// StatementShowSetting for SHOW name query
+	StatementShowSetting
+)
+
+// Parse parses the statement, the errors are *SyntaxError.
+func Parse(query string) (sql.Statement, error) {
+	statement, err := parseStatement(query)
+	if err != nil {
+		return nil, syntaxError(err)
+	}
+
+	return statement, nil
+}
+
+// parseStatement parses the gosqldb extension statements and
+// delegates the rest to gosqlparser.
+func parseStatement(query string) (sql.Statement, error) {
+	query, err := quoteIdentifiers(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRewritten(query)
+}
+
+// parseRewritten parses the statement with the quoted identifiers
+// rewritten already, like the nested statements and the trigger
+// actions taken from the rewritten statements.
+func parseRewritten(query string) (sql.Statement, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		// let gosqlparser report the error
+		return sql.Parse(protectEscapedQuotes(query))
+	}
+
+	if qualified := qualifyNames(query, tokens); qualified != query {
+		query = qualified
+		if tokens, err = tokenize(query); err != nil {
+			return nil, err
+		}
+	}
+
+	if called := sequenceCalls(query, tokens); called != query {
+		query = called
+		if tokens, err = tokenize(query); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &tokenStream{tokens: tokens}
+	switch {
+	case isAsOfSelect(s):
+		return parseAsOfSelect(query, s)
+	case isGroupedSelect(s):
+		return parseGroupedSelect(query, s)
+	case isCountRows(s):
+		return parseCountRows(query, s)
+	case isOrderedSelect(s):
+		return parseOrderedSelect(query, s)
+	case s.isKeyword("CREATE", "TABLE"):
+		return parseCreateTable(query, s)
+	case s.isKeyword("CREATE", "MEMORY", "TABLE"), s.isKeyword("CREATE", "TEMPORARY", "TABLE"):
+		return parseCreateMemoryTable(query, s)
+	case s.isKeyword("UPDATE"), s.isKeyword("DELETE"):
+		return parseIfVersion(query, s)
+	case s.isKeyword("ALTER", "TABLE"):
+		return parseAlterTable(s)
+	case s.isKeyword("CREATE", "DATABASE"), s.isKeyword("DROP", "DATABASE"), s.isKeyword("USE"):
+		return parseDatabaseStatement(s)
+	case s.isKeyword("CREATE", "SCHEMA"), s.isKeyword("DROP", "SCHEMA"):
+		return parseSchemaStatement(s)
+	case s.isKeyword("SET", "SEARCH_PATH"):
+		return parseSetSearchPath(s)
+	case s.isKeyword("CREATE", "TRIGGER"):
+		return parseCreateTrigger(query, s)
+	case s.isKeyword("DROP", "TRIGGER"):
+		return parseDropTrigger(s)
+	case s.isKeyword("CREATE", "SEQUENCE"), s.isKeyword("DROP", "SEQUENCE"):
+		return parseSequenceStatement(s)
+	case s.isKeyword("CREATE", "USER"):
+		return parseCreateUser(s)
+	case s.isKeyword("ALTER", "USER"):
+		return parseAlterUser(s)
+	case s.isKeyword("DROP", "USER"):
+		return parseDropUser(s)
+	case s.isKeyword("GRANT"), s.isKeyword("REVOKE"):
+		return parseGrant(s)
+	case s.isKeyword("CREATE", "TOKEN"):
+		return parseCreateToken(s)
+	case s.isKeyword("DROP", "TOKEN"):
+		return parseDropToken(s)
+	case s.isKeyword("EXPLAIN"):
+		return parseExplain(query, s)
+	case s.isKeyword("BEGIN"), s.isKeyword("COMMIT"), s.isKeyword("ROLLBACK"),
+		s.isKeyword("SAVEPOINT"), s.isKeyword("RELEASE"):
+		return parseTransactionStatement(s)
+	case isSetSetting(s):
+		return parseSetSetting(s)
+	case s.isKeyword("SET", "TRANSACTION"):
+		return parseSetTransaction(s)
+	case s.isKeyword("SET", "SESSION"):
+		return parseSetSessionIsolation(s)
+	case s.isKeyword("SET", "DATABASE"):
+		return parseSetReadOnly(s)
+	case s.isKeyword("SHOW", "TRANSACTION"):
+		return parseShowIsolationLevel(s)
+	case s.isKeyword("SHOW", "PROCESSLIST"):
+		return parseShowProcessList(s)
+	case s.isKeyword("SHOW", "CREATE", "TABLE"):
+		return parseShowCreateTable(s)
+	case isShowSetting(s):
+		return parseShowSetting(s)
+	case s.isKeyword("KILL"):
+		return parseKill(s)
+	case s.isKeyword("BACKUP"):
+		return parseBackup(s)
+	case s.isKeyword("COPY"):
+		return parseCopy(query, s)
+	case s.isKeyword("ANALYZE"):
+		return parseAnalyze(s)
+	case s.isKeyword("FLASHBACK"):
+		return parseFlashback(s)
+	case s.isKeyword("COMMENT", "ON"):
+		return parseComment(s)
+	}
+
+	return sql.Parse(protectEscapedQuotes(query))
+}
+
+// parseCreateTable parses CREATE TABLE with the optional PARTITION BY
+// and WITH ROW VERSION clauses and the generated columns, the rest is
+// parsed by gosqlparser.
+func parseCreateTable(query string, s *tokenStream) (sql.Statement, error) {
+	query, generated, err := stripGenerated(query)
+	if err != nil {
+		return nil, err
+	}
+	if generated != nil {
+		tokens, err := tokenize(query)
+		if err != nil {
+			return nil, err
+		}
+		s = &tokenStream{tokens: tokens}
+	}
+
+	withRowVersion, versioned := s.findKeyword("WITH", "ROW", "VERSION")
+	if versioned {
+		// the clause is the last one
+		s.mustKeyword("WITH", "ROW", "VERSION")
+		if err := s.expectEnd(); err != nil {
+			return nil, err
+		}
+
+		query = query[:withRowVersion.pos]
+		tokens, err := tokenize(query)
+		if err != nil {
+			return nil, err
+		}
+		s = &tokenStream{tokens: tokens}
+	}
+
+	partitionBy, partitioned := s.findKeyword("PARTITION", "BY")
+	if partitioned {
+		query = query[:partitionBy.pos]
+	}
+
+	statement, err := sql.Parse(protectEscapedQuotes(query))
+	if err != nil {
+		return nil, err
+	}
+
+	if !partitioned && !versioned && generated == nil {
+		return statement, nil
+	}
+
+	createTable, ok := statement.(*sql.CreateTable)
+	if !ok {
+		return nil, fmt.Errorf("expected CREATE TABLE statement, got %T", statement)
+	}
+
+	var partitioning *Partitioning
+	if partitioned {
+		partitioning, err = parsePartitionBy(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PARTITION BY: %w", err)
+		}
+	}
+
+	if versioned {
+		return &CreateVersionedTable{createTable, partitioning, generated}, nil
+	}
+
+	return &CreatePartitionedTable{createTable, partitioning, generated}, nil
+}
+
+// parseAlterTable parses ALTER TABLE statement.
+func parseAlterTable(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("ALTER", "TABLE")
+	table, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case s.acceptKeyword("DROP", "PARTITION"):
+		partition, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+
+		return &DropPartition{table, partition}, s.expectEnd()
+	case s.acceptKeyword("RENAME", "TO"):
+		newName, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+
+		return &RenameTable{table, newName}, s.expectEnd()
+	case s.isKeyword("ALTER"):
+		return parseAlterColumnMask(s, table)
+	default:
+		return nil, s.unexpected("DROP PARTITION, RENAME TO or ALTER COLUMN")
+	}
+}
+
+// SyntaxError is the error of the query parsing.
+type SyntaxError struct {
+	Message string
+	// Position is the byte offset of the error in the query,
+	// -1 if it is unknown.
+	Position int
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Message
+}
+
+// syntaxError wraps the parsing error that has no position.
+func syntaxError(err error) error {
+	var syntaxErr *SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return err
+	}
+
+	return &SyntaxError{err.Error(), -1}
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenSymbol
+	// $1, $2, ... parameter placeholder
+	tokenPlaceholder
+	tokenEnd
+)
+
+// token is a lexeme of the extension statement, the value of
+// the string token is the quoted literal as it is in the query.
+type token struct {
+	kind  tokenKind
+	value string
+	// byte position of the token in the query
+	pos int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEnd {
+		return "end of the query"
+	}
+
+	return fmt.Sprintf("%q at %d", t.value, t.pos)
+}
+
+// twoCharSymbols are the symbols that consist of two characters.
+var twoCharSymbols = map[string]struct{}{
+	"==": {},
+	"!=": {},
+	"<=": {},
+	">=": {},
+}
+
+// tokenize splits the query into tokens.
+func tokenize(query string) ([]token, error) {
+	tokens := make([]token, 0)
+	for pos := 0; pos < len(query); {
+		r, width := utf8.DecodeRuneInString(query[pos:])
+		start := pos
+
+		switch {
+		case unicode.IsSpace(r):
+			pos += width
+			continue
+		case unicode.IsDigit(r) || (r == '-' && pos+1 < len(query) && unicode.IsDigit(rune(query[pos+1]))):
+			pos++
+			for pos < len(query) && unicode.IsDigit(rune(query[pos])) {
+				pos++
+			}
+			tokens = append(tokens, token{tokenNumber, query[start:pos], start})
+		case r == '_' || unicode.IsLetter(r):
+			for pos < len(query) {
+				r, width := utf8.DecodeRuneInString(query[pos:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				pos += width
+			}
+			tokens = append(tokens, token{tokenWord, query[start:pos], start})
+		case r == '"':
+			pos++
+			for ; pos < len(query) && query[pos] != '"'; pos++ {
+				if query[pos] == '\\' {
+					pos++
+				}
+			}
+			if pos >= len(query) {
+				return nil, &SyntaxError{fmt.Sprintf("unterminated string at %d", start), start}
+			}
+			pos++
+			tokens = append(tokens, token{tokenString, query[start:pos], start})
+		case r == '$' && pos+1 < len(query) && unicode.IsDigit(rune(query[pos+1])):
+			pos++
+			for pos < len(query) && unicode.IsDigit(rune(query[pos])) {
+				pos++
+			}
+			tokens = append(tokens, token{tokenPlaceholder, query[start:pos], start})
+		case strings.ContainsRune("(),=*;.<>!+-/", r):
+			pos++
+			if pos < len(query) {
+				if _, ok := twoCharSymbols[query[start:pos+1]]; ok {
+					pos++
+				}
+			}
+			tokens = append(tokens, token{tokenSymbol, query[start:pos], start})
+		default:
+			return nil, &SyntaxError{fmt.Sprintf("unexpected %q at %d", r, start), start}
+		}
+	}
+
+	return append(tokens, token{tokenEnd, "", len(query)}), nil
+}
+
+// tokenStream is a cursor over the tokens.
+type tokenStream struct {
+	tokens []token
+	pos    int
+}
+
+func (s *tokenStream) peek() token {
+	return s.tokens[s.pos]
+}
+
+func (s *tokenStream) next() token {
+	t := s.tokens[s.pos]
+	if t.kind != tokenEnd {
+		s.pos++
+	}
+
+	return t
+}
+
+// isKeyword reports whether the next tokens are the keywords.
+func (s *tokenStream) isKeyword(keywords ...string) bool {
+	for i, keyword := range keywords {
+		if s.pos+i >= len(s.tokens) {
+			return false
+		}
+
+		t := s.tokens[s.pos+i]
+		if t.kind != tokenWord || !strings.EqualFold(t.value, keyword) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// acceptKeyword consumes the keywords if they are next.
+func (s *tokenStream) acceptKeyword(keywords ...string) bool {
+	if !s.isKeyword(keywords...) {
+		return false
+	}
+	s.pos += len(keywords)
+
+	return true
+}
+
+// mustKeyword consumes the keywords that are known to be next.
+func (s *tokenStream) mustKeyword(keywords ...string) {
+	if !s.acceptKeyword(keywords...) {
+		panic(fmt.Errorf("expected %s", strings.Join(keywords, " ")))
+	}
+}
+
+// unexpected returns the error about the next token.
+func (s *tokenStream) unexpected(expected string) error {
+	t := s.peek()
+
+	return &SyntaxError{fmt.Sprintf("expected %s, but got %s", expected, t), t.pos}
+}
+
+func (s *tokenStream) expectKeyword(keywords ...string) error {
+	if !s.acceptKeyword(keywords...) {
+		return s.unexpected(strings.Join(keywords, " "))
+	}
+
+	return nil
+}
+
+// findKeyword looks for the keywords outside of parentheses starting
+// from the current position and, if found, moves the cursor to them.
+func (s *tokenStream) findKeyword(keywords ...string) (token, bool) {
+	depth := 0
+	for i := s.pos; i < len(s.tokens); i++ {
+		t := s.tokens[i]
+		switch {
+		case t.kind == tokenSymbol && t.value == "(":
+			depth++
+		case t.kind == tokenSymbol && t.value == ")":
+			depth--
+		case depth == 0:
+			saved := s.pos
+			s.pos = i
+			if s.isKeyword(keywords...) {
+				return t, true
+			}
+			s.pos = saved
+		}
+	}
+
+	return token{}, false
+}
+
+func (s *tokenStream) acceptSymbol(symbol string) bool {
+	t := s.peek()
+	if t.kind != tokenSymbol || t.value != symbol {
+		return false
+	}
+	s.pos++
+
+	return true
+}
+
+func (s *tokenStream) expectSymbol(symbol string) error {
+	if !s.acceptSymbol(symbol) {
+		return s.unexpected(symbol)
+	}
+
+	return nil
+}
+
+func (s *tokenStream) expectIdentifier() (string, error) {
+	if s.peek().kind != tokenWord {
+		return "", s.unexpected("identifier")
+	}
+
+	return s.next().value, nil
+}
+
+func (s *tokenStream) expectInteger() (int, error) {
+	if s.peek().kind != tokenNumber {
+		return 0, s.unexpected("integer")
+	}
+
+	t := s.next()
+	value, err := strconv.Atoi(t.value)
+	if err != nil {
+		return 0, &SyntaxError{fmt.Sprintf("failed to parse integer %s: %s", t, err), t.pos}
+	}
+
+	return value, nil
+}
+
+// expectString reads a string value.
+func (s *tokenStream) expectString() (string, error) {
+	if s.peek().kind != tokenString {
+		return "", s.unexpected("string")
+	}
+
+	value, err := s.expectValue()
+	if err != nil {
+		return "", err
+	}
+
+	return value.(string), nil
+}
+
+// expectValue reads an integer or a string value.
+func (s *tokenStream) expectValue() (interface{}, error) {
+	if kind := s.peek().kind; kind != tokenNumber && kind != tokenString {
+		return nil, s.unexpected("value")
+	}
+
+	t := s.next()
+	value, err := parseValue(t.value)
+	if err != nil {
+		return nil, &SyntaxError{fmt.Sprintf("invalid value %s: %s", t, err), t.pos}
+	}
+
+	return value, nil
+}
+
+// expectEnd makes sure that there is nothing left
+// except the optional semicolon.
+func (s *tokenStream) expectEnd() error {
+	s.acceptSymbol(";")
+	if s.peek().kind != tokenEnd {
+		return s.unexpected("end of the query")
+	}
+
+	return nil
+}
@@ -0,0 +1,505 @@
+package engine
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The row counts, the sizes and the min and max values are updated from
+// the rows changed by every statement, they are recomputed only when a
+// deleted row has held the min or the max value. The distinct values and the histograms the planner
+// estimates the equality conditions with are computed by ANALYZE and
+// automatically with the next change once the rows changed since the
+// last analysis exceed autoAnalyzeRows and autoAnalyzeFraction of the
+// table. The distinct values are estimated from the smallest hashes of
+// the values and the histograms are built from a sample of the values,
+// so the analysis takes the same memory for the tables of any size.
+
+const (
+	// autoAnalyzeRows and autoAnalyzeFraction of the rows
+	// changed since the last analysis trigger the next one.
+	autoAnalyzeRows     = 50
+	autoAnalyzeFraction = 0.1
+	// histogramBuckets is the number of the histogram buckets.
+	histogramBuckets = 16
+	// statsSampleSize is the number of the values sampled
+	// for the histogram of the column.
+	statsSampleSize = 10000
+	// distinctSketchSize is the number of the smallest hashes
+	// the distinct values are estimated from.
+	distinctSketchSize = 1024
+)
+
+// TableStats holds statistics of the table data.
+type TableStats struct {
+	// RowCount is the number of rows in the table.
+	RowCount int `json:"row_count"`
+	// SizeBytes is the total size of the table data files.
+	SizeBytes int64 `json:"size_bytes"`
+	// Columns holds statistics by column names.
+	Columns map[string]ColumnStats `json:"columns,omitempty"`
+	// Analyzed is when the table has been analyzed,
+	// zero if it has not been.
+	Analyzed time.Time `json:"analyzed"`
+	// ModifiedRows is the number of the rows changed
+	// since the table has been analyzed.
+	ModifiedRows int `json:"modified_rows,omitempty"`
+}
+
+// ColumnStats holds statistics of the column values.
+type ColumnStats struct {
+	// Min is the minimum value, nil for empty tables.
+	Min interface{} `json:"min"`
+	// Max is the maximum value, nil for empty tables.
+	Max interface{} `json:"max"`
+	// Distinct is the estimated number of the distinct values,
+	// zero if the table has not been analyzed.
+	Distinct int `json:"distinct,omitempty"`
+	// Histogram is the bounds of the buckets with the same number
+	// of the sampled values, nil if the table has not been analyzed.
+	Histogram []interface{} `json:"histogram,omitempty"`
+}
+
+// equalitySelectivity estimates the fraction of rows with the value
+// within the min/max range of the column. The value repeated in the
+// bounds of the histogram takes the buckets between them, the other
+// values are estimated as equally frequent.
+func (s ColumnStats) equalitySelectivity(value interface{}) float64 {
+	if s.Distinct == 0 {
+		return defaultEqualitySelectivity
+	}
+
+	estimate := 1 / float64(s.Distinct)
+	repeated := 0
+	for _, bound := range s.Histogram {
+		if !less(bound, value) && !less(value, bound) {
+			repeated++
+		}
+	}
+	if repeated > 1 {
+		if frequent := float64(repeated-1) / float64(len(s.Histogram)-1); frequent > estimate {
+			return frequent
+		}
+	}
+
+	return estimate
+}
+
+// needsAnalyze reports whether enough rows have been changed
+// since the last analysis.
+func (s TableStats) needsAnalyze() bool {
+	return s.ModifiedRows > autoAnalyzeRows+int(autoAnalyzeFraction*float64(s.RowCount))
+}
+
+// noteModified counts the changed rows of the table
+// for the automatic analysis.
+func (db *Database) noteModified(tableName string, rows int) {
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return
+	}
+
+	schema.Stats.ModifiedRows += rows
+	db.tables[tableName] = schema
+}
+
+// rowsChange is the rows changed by the statement, the
+// statistics are updated from them without a scan.
+type rowsChange struct {
+	inserted [][]interface{}
+	deleted  int
+	// extremeDeleted reports whether a deleted row has
+	// held the min or the max value of a column
+	extremeDeleted bool
+}
+
+// insert notes the new row.
+func (c *rowsChange) insert(row []interface{}) {
+	c.inserted = append(c.inserted, row)
+}
+
+// delete notes the removed row of the table.
+func (c *rowsChange) delete(schema Schema, row []interface{}) {
+	c.deleted++
+	if c.extremeDeleted {
+		return
+	}
+
+	for _, column := range schema.Columns {
+		columnStats := schema.Stats.Columns[column.Name]
+		value := row[column.Position]
+		// the values of different types are not ordered
+		if columnStats.Min == nil || columnStats.Max == nil ||
+			!less(columnStats.Min, value) || !less(value, columnStats.Max) {
+			c.extremeDeleted = true
+
+			return
+		}
+	}
+}
+
+// refreshStats recomputes statistics of the table and stores them
+// in the meta file. It moves the table data between memory and
+// disk if needed.
+func (db *Database) refreshStats(tableName string) error {
+	return db.collectStats(tableName, db.tables[tableName].Stats.needsAnalyze())
+}
+
+// updateStats updates statistics of the table with the changed rows
+// and stores them in the meta file, the statistics are recomputed if
+// the min or the max value may have been deleted or the table needs
+// the analysis.
+func (db *Database) updateStats(tableName string, change rowsChange) error {
+	schema := db.tables[tableName]
+	if change.extremeDeleted || schema.Stats.needsAnalyze() {
+		return db.refreshStats(tableName)
+	}
+
+	stats := schema.Stats
+	stats.RowCount += len(change.inserted) - change.deleted
+	stats.Columns = make(map[string]ColumnStats, len(schema.Columns))
+	for name, columnStats := range schema.Stats.Columns {
+		if _, exists := schema.Columns[name]; exists {
+			stats.Columns[name] = columnStats
+		}
+	}
+	for _, row := range change.inserted {
+		for _, column := range schema.Columns {
+			columnStats := stats.Columns[column.Name]
+			value := row[column.Position]
+			if columnStats.Min == nil || less(value, columnStats.Min) {
+				columnStats.Min = value
+			}
+			if columnStats.Max == nil || less(columnStats.Max, value) {
+				columnStats.Max = value
+			}
+			stats.Columns[column.Name] = columnStats
+		}
+	}
+
+	stats.SizeBytes = 0
+	for _, name := range schema.storageNames() {
+		size, err := db.storageSize(name, schema)
+		if err != nil {
+			return err
+		}
+		stats.SizeBytes += size
+	}
+
+	return db.storeStats(tableName, schema, stats)
+}
+
+// storageSize returns the size of the data file of the table or
+// partition and moves it between memory and disk if needed.
+func (db *Database) storageSize(name string, schema Schema) (int64, error) {
+	if schema.InMemory {
+		return 0, nil
+	}
+
+	size, err := fileSize(tableFilePath(db.dbDir, name))
+	if err != nil {
+		return 0, err
+	}
+
+	// the table may have grown or shrunk enough
+	// to be moved between memory and disk
+	err = db.adaptStorage(name, schema, size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to adapt storage of %s: %w", name, err)
+	}
+
+	return size, nil
+}
+
+// collectStats is refreshStats that analyzes the table if analyze is
+// true, otherwise the results of the last analysis are kept.
+func (db *Database) collectStats(tableName string, analyze bool) error {
+	schema := db.tables[tableName]
+
+	previous := schema.Stats
+	stats := TableStats{Columns: make(map[string]ColumnStats), Analyzed: previous.Analyzed, ModifiedRows: previous.ModifiedRows}
+	var samplers map[string]*columnSampler
+	if analyze {
+		samplers = make(map[string]*columnSampler, len(schema.Columns))
+		for name := range schema.Columns {
+			samplers[name] = newColumnSampler()
+		}
+	}
+	for _, name := range schema.storageNames() {
+		size, err := db.storageSize(name, schema)
+		if err != nil {
+			return err
+		}
+		stats.SizeBytes += size
+
+		err = db.scan(name, schema, func(index int, row []interface{}) bool {
+			stats.RowCount++
+			for _, column := range schema.Columns {
+				columnStats := stats.Columns[column.Name]
+				value := row[column.Position]
+				if columnStats.Min == nil || less(value, columnStats.Min) {
+					columnStats.Min = value
+				}
+				if columnStats.Max == nil || less(columnStats.Max, value) {
+					columnStats.Max = value
+				}
+				stats.Columns[column.Name] = columnStats
+
+				if analyze {
+					samplers[column.Name].add(value)
+				}
+			}
+
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", name, err)
+		}
+	}
+
+	if analyze {
+		stats.Analyzed, stats.ModifiedRows = time.Now(), 0
+		for name, sampler := range samplers {
+			columnStats := stats.Columns[name]
+			columnStats.Distinct, columnStats.Histogram = sampler.distinct(), sampler.histogram()
+			stats.Columns[name] = columnStats
+		}
+	} else {
+		for name, previousStats := range previous.Columns {
+			if _, exists := schema.Columns[name]; !exists {
+				continue
+			}
+
+			columnStats := stats.Columns[name]
+			columnStats.Distinct, columnStats.Histogram = previousStats.Distinct, previousStats.Histogram
+			stats.Columns[name] = columnStats
+		}
+	}
+
+	return db.storeStats(tableName, schema, stats)
+}
+
+// storeStats replaces statistics of the table and stores them
+// in the meta file unless the table is kept only in memory.
+func (db *Database) storeStats(tableName string, schema Schema, stats TableStats) error {
+	schema.Stats = stats
+	db.tables[tableName] = schema
+	if err := db.accountTables(); err != nil {
+		return err
+	}
+	if schema.InMemory {
+		return nil
+	}
+
+	err := db.storeTables()
+	if err != nil {
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	return nil
+}
+
+// less compares two values of the same column type.
+func less(a interface{}, b interface{}) bool {
+	switch av := a.(type) {
+	case int:
+		bv, ok := b.(int)
+		return ok && av < bv
+	case string:
+		bv, ok := b.(string)
+		return ok && av < bv
+	}
+
+	return false
+}
+
+// normalizeStats converts JSON numbers decoded as float64
+// back to integers for integer columns.
+func normalizeStats(schema Schema) {
+	for name, columnStats := range schema.Stats.Columns {
+		column, exists := schema.Columns[name]
+		if !exists || column.Type != sql.TypeInteger {
+			continue
+		}
+
+		if f, ok := columnStats.Min.(float64); ok {
+			columnStats.Min = int(f)
+		}
+		if f, ok := columnStats.Max.(float64); ok {
+			columnStats.Max = int(f)
+		}
+		for i, bound := range columnStats.Histogram {
+			if f, ok := bound.(float64); ok {
+				columnStats.Histogram[i] = int(f)
+			}
+		}
+		schema.Stats.Columns[name] = columnStats
+	}
+}
+
+// columnSampler collects the values of the column for the analysis:
+// the smallest hashes of the values for the distinct values estimate
+// and the uniform sample of the values for the histogram.
+type columnSampler struct {
+	hashes hashHeap
+	hashed map[uint64]struct{}
+	sample []interface{}
+	seen   int
+	random *rand.Rand
+}
+
+func newColumnSampler() *columnSampler {
+	return &columnSampler{hashed: make(map[uint64]struct{}), random: rand.New(rand.NewSource(1))}
+}
+
+func (s *columnSampler) add(value interface{}) {
+	h := fnv.New64a()
+	fmt.Fprint(h, value)
+	hash := h.Sum64()
+	if _, exists := s.hashed[hash]; !exists {
+		if len(s.hashes) < distinctSketchSize {
+			heap.Push(&s.hashes, hash)
+			s.hashed[hash] = struct{}{}
+		} else if hash < s.hashes[0] {
+			delete(s.hashed, heap.Pop(&s.hashes).(uint64))
+			heap.Push(&s.hashes, hash)
+			s.hashed[hash] = struct{}{}
+		}
+	}
+
+	// reservoir sampling keeps every value with the same probability
+	s.seen++
+	if len(s.sample) < statsSampleSize {
+		s.sample = append(s.sample, value)
+	} else if i := s.random.Intn(s.seen); i < statsSampleSize {
+		s.sample[i] = value
+	}
+}
+
+// distinct estimates the number of the distinct values, it is exact
+// while the values have fewer hashes than the sketch keeps.
+func (s *columnSampler) distinct() int {
+	if len(s.hashes) < distinctSketchSize {
+		return len(s.hashes)
+	}
+
+	// the k smallest of the uniform hashes are spread over
+	// the fraction of the hash space as k of the n values
+	fraction := float64(s.hashes[0]) / math.MaxUint64
+	estimate := int(float64(distinctSketchSize-1) / fraction)
+	if estimate > s.seen {
+		return s.seen
+	}
+
+	return estimate
+}
+
+// histogram returns the bounds of the buckets with the same
+// number of the sampled values, nil if there are no values.
+func (s *columnSampler) histogram() []interface{} {
+	if len(s.sample) == 0 {
+		return nil
+	}
+
+	sort.Slice(s.sample, func(i, j int) bool {
+		return less(s.sample[i], s.sample[j])
+	})
+
+	buckets := histogramBuckets
+	if len(s.sample) < buckets {
+		buckets = len(s.sample)
+	}
+
+	bounds := make([]interface{}, buckets+1)
+	for i := range bounds {
+		bounds[i] = s.sample[i*(len(s.sample)-1)/buckets]
+	}
+
+	return bounds
+}
+
+// hashHeap is the max-heap of the hashes.
+type hashHeap []uint64
+
+func (h hashHeap) Len() int            { return len(h) }
+func (h hashHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+
+func (h *hashHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
+
+// Analyze represents ANALYZE [table] statement,
+// all the tables are analyzed without the table.
+type Analyze struct {
+	// Table is empty for all the tables.
+	Table string
+}
+
+// GetType returns the statement type.
+func (*Analyze) GetType() sql.StatementType { return StatementAnalyze }
+
+// parseAnalyze parses ANALYZE statement.
+func parseAnalyze(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("ANALYZE")
+
+	query := &Analyze{}
+	if s.peek().kind == tokenWord {
+		table, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		query.Table = table
+	}
+
+	return query, s.expectEnd()
+}
+
+// Analyze computes the distinct values and the histograms
+// of the table or of all the tables.
+func (db *Database) Analyze(ctx context.Context, query *Analyze) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tableNames := make([]string, 0)
+	if query.Table != "" {
+		tableName := strings.ToLower(query.Table)
+		if _, exists := db.tables[tableName]; !exists {
+			return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+		}
+		tableNames = append(tableNames, tableName)
+	} else {
+		for _, schema := range sortedTables(db.tables) {
+			tableNames = append(tableNames, strings.ToLower(schema.Name))
+		}
+	}
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	for _, tableName := range tableNames {
+		if err := db.lock(ctx, l, tableResource(tableName), lockShared); err != nil {
+			return err
+		}
+
+		if err := db.collectStats(tableName, true); err != nil {
+			return fmt.Errorf("failed to analyze %s: %w", tableName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateStatsMatchesRecomputed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{Fsync: FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	statements := []string{
+		`CREATE TABLE t (id INTEGER, name STRING)`,
+		`INSERT INTO t (id, name) VALUES (5, "e")`,
+		`INSERT INTO t (id, name) VALUES (2, "b")`,
+		`INSERT INTO t (id, name) VALUES (9, "x")`,
+		// neither the min nor the max is deleted
+		`UPDATE t SET name = "c" WHERE id == 5`,
+		// the max is deleted
+		`DELETE FROM t WHERE id == 9`,
+		`UPDATE t SET id = 1 WHERE id == 2`,
+		`DELETE FROM t WHERE id == 5`,
+	}
+
+	for _, statement := range statements {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		if _, err := db.Execute(q); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		db.mu.Lock()
+		updated := db.tables["t"].Stats
+		err = db.collectStats("t", false)
+		recomputed := db.tables["t"].Stats
+		db.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if updated.RowCount != recomputed.RowCount || updated.SizeBytes != recomputed.SizeBytes {
+			t.Errorf("%s: expected %d rows of %d bytes, got %d rows of %d bytes", statement,
+				recomputed.RowCount, recomputed.SizeBytes, updated.RowCount, updated.SizeBytes)
+		}
+		if (len(updated.Columns) > 0 || len(recomputed.Columns) > 0) && !reflect.DeepEqual(updated.Columns, recomputed.Columns) {
+			t.Errorf("%s: expected columns %v, got %v", statement, recomputed.Columns, updated.Columns)
+		}
+	}
+}
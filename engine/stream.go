@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// SelectEach fetches data and calls f for every matched row without
+// collecting the rows, the selection stops with the error returned by f.
+// The rows are read from the snapshot taken when the selection starts,
+// the writers are not blocked while the rows are passed to f.
+func (db *Database) SelectEach(query *sql.Select, f func(row []interface{}) error) error {
+	return db.SelectEachContext(context.Background(), query, f)
+}
+
+// SelectEachContext is SelectEach that stops when the context is done.
+func (db *Database) SelectEachContext(ctx context.Context, query *sql.Select, f func(row []interface{}) error) (err error) {
+	rows, started := 0, time.Now()
+	// the query is logged after the database is unlocked
+	defer func() { db.logQuery(ctx, query, started, rows, err) }()
+
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	masks := db.queryMasks(ctx, query.Table)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.selectEach(ctx, query, nil, nil, countRows(&rows, maskEach(masks, f)))
+}
+
+// SelectEach fetches data within the transaction and calls f
+// for every matched row without collecting the rows.
+func (tx *Transaction) SelectEach(query *sql.Select, f func(row []interface{}) error) error {
+	return tx.SelectEachContext(context.Background(), query, f)
+}
+
+// SelectEachContext is SelectEach within the transaction
+// that stops when the context is done.
+func (tx *Transaction) SelectEachContext(ctx context.Context, query *sql.Select, f func(row []interface{}) error) (err error) {
+	rows, started := 0, time.Now()
+	defer func() { tx.db.logQuery(ctx, query, started, rows, err) }()
+
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	masks := tx.db.queryMasks(ctx, query.Table)
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return err
+	}
+	tx.queried = true
+
+	return tx.db.selectEach(ctx, query, nil, tx, countRows(&rows, maskEach(masks, f)))
+}
@@ -0,0 +1,349 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// name of the file that stores the API tokens
+// with the hashes of their secrets
+const tokensFileName = "gosqldb.tokens.json"
+
+// tokenPrefix starts the API tokens, so they are easy
+// to recognize in the configs and the logs.
+const tokenPrefix = "gsq_"
+
+// tokenPrincipalPrefix starts the principal names of the tokens
+// passed to Authorize, the user names can not contain the colon,
+// so they are not confused with the tokens.
+const tokenPrincipalPrefix = "token:"
+
+// TokenRole defines what the token is allowed to execute.
+type TokenRole string
+
+const (
+	// RoleReadOnly tokens execute SELECT on all the tables.
+	RoleReadOnly TokenRole = "read_only"
+	// RoleReadWrite tokens also execute INSERT, UPDATE and DELETE.
+	RoleReadWrite TokenRole = "read_write"
+	// RoleAdmin tokens are allowed everything as the superusers.
+	RoleAdmin TokenRole = "admin"
+)
+
+// apiToken is the credential of a service client.
+type apiToken struct {
+	Name string    `json:"name"`
+	Role TokenRole `json:"role"`
+	// Hash is the SHA-256 hash of the secret, the secret is random,
+	// so it does not need a slow hash.
+	Hash    []byte    `json:"hash"`
+	Created time.Time `json:"created"`
+	// Expires is zero for the tokens that do not expire.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// expired reports whether the token has expired.
+func (t *apiToken) expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// CreateToken represents CREATE TOKEN name ROLE role [VALID FOR
+// "duration"] statement, the result is the token secret that is
+// shown only once.
+//
+//	CREATE TOKEN reports ROLE read_only VALID FOR "720h"
+type CreateToken struct {
+	Name string
+	Role TokenRole
+	// ValidFor is zero for the tokens that do not expire.
+	ValidFor time.Duration
+}
+
+// GetType returns the statement type.
+func (*CreateToken) GetType() sql.StatementType { return StatementCreateToken }
+
+// DropToken represents DROP TOKEN statement.
+type DropToken struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*DropToken) GetType() sql.StatementType { return StatementDropToken }
+
+// parseCreateToken parses CREATE TOKEN statement.
+func parseCreateToken(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("CREATE", "TOKEN")
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.expectKeyword("ROLE"); err != nil {
+		return nil, err
+	}
+
+	var role TokenRole
+	switch {
+	case s.acceptKeyword(string(RoleReadOnly)):
+		role = RoleReadOnly
+	case s.acceptKeyword(string(RoleReadWrite)):
+		role = RoleReadWrite
+	case s.acceptKeyword(string(RoleAdmin)):
+		role = RoleAdmin
+	default:
+		return nil, s.unexpected("read_only, read_write or admin")
+	}
+
+	var validFor time.Duration
+	if s.acceptKeyword("VALID", "FOR") {
+		value, err := s.expectValue()
+		if err != nil {
+			return nil, err
+		}
+
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected duration string, such as \"720h\"")
+		}
+
+		validFor, err = time.ParseDuration(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration: %w", err)
+		}
+
+		if validFor <= 0 {
+			return nil, fmt.Errorf("duration must be positive, got %s", validFor)
+		}
+	}
+
+	return &CreateToken{Name: name, Role: role, ValidFor: validFor}, s.expectEnd()
+}
+
+// parseDropToken parses DROP TOKEN statement.
+func parseDropToken(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("DROP", "TOKEN")
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DropToken{name}, s.expectEnd()
+}
+
+// loadTokens reads the tokens by lowercase names, there are none
+// if the file does not exist.
+func loadTokens(dbDir string, e *encryption) (map[string]*apiToken, error) {
+	filePath := path.Join(dbDir, tokensFileName)
+	content, err := readFileContent(filePath, e)
+	if os.IsNotExist(err) {
+		return make(map[string]*apiToken), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	tokens := make(map[string]*apiToken)
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	return tokens, nil
+}
+
+// storeTokens replaces the tokens file, it must be called
+// with the database lock held.
+func (db *Database) storeTokens() error {
+	content, err := json.MarshalIndent(db.tokens, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode tokens: %w", err)
+	}
+
+	return db.writeFileContent(path.Join(db.dbDir, tokensFileName), content)
+}
+
+// IsToken reports whether the credential is an API token.
+func IsToken(credential string) bool {
+	return strings.HasPrefix(credential, tokenPrefix)
+}
+
+// tokenHash returns the hash of the token secret.
+func tokenHash(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+
+	return hash[:]
+}
+
+// CreateToken creates the token and returns its secret. There must be
+// a superuser, so the tokens do not lock the users out.
+func (db *Database) CreateToken(query *CreateToken) (string, error) {
+	if !isValidTableNameFormat(query.Name) {
+		return "", fmt.Errorf("token name %s is not valid", query.Name)
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	name := strings.ToLower(query.Name)
+	secret := tokenPrefix + name + "_" + hex.EncodeToString(random)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.superusers() == 0 {
+		return "", fmt.Errorf("there is no superuser, create one with CREATE USER ... SUPERUSER first")
+	}
+
+	if _, exists := db.tokens[name]; exists {
+		return "", newError(CodeDuplicateObject, "token %s already exists", name)
+	}
+
+	t := &apiToken{Name: name, Role: query.Role, Hash: tokenHash(secret), Created: time.Now().UTC()}
+	if query.ValidFor > 0 {
+		t.Expires = t.Created.Add(query.ValidFor)
+	}
+
+	db.tokens[name] = t
+	if err := db.storeTokens(); err != nil {
+		delete(db.tokens, name)
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// DropToken removes the token, the clients using it
+// are not authenticated any more.
+func (db *Database) DropToken(query *DropToken) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := strings.ToLower(query.Name)
+	t, exists := db.tokens[name]
+	if !exists {
+		return newError(CodeUndefinedObject, "token %s does not exist", name)
+	}
+
+	delete(db.tokens, name)
+	if err := db.storeTokens(); err != nil {
+		db.tokens[name] = t
+		return err
+	}
+
+	return nil
+}
+
+// AuthenticateToken checks the token secret and returns the principal
+// name of the token to pass to Authorize.
+func (db *Database) AuthenticateToken(secret string) (string, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return "", ErrAuthentication
+	}
+
+	// the name is a part of the secret, so the hash
+	// is compared only with the hash of that token
+	rest := secret[len(tokenPrefix):]
+	separator := strings.LastIndex(rest, "_")
+	if separator < 0 {
+		return "", ErrAuthentication
+	}
+	name := rest[:separator]
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, exists := db.tokens[name]
+	if !exists || subtle.ConstantTimeCompare(t.Hash, tokenHash(secret)) != 1 {
+		return "", ErrAuthentication
+	}
+
+	if t.expired() {
+		return "", fmt.Errorf("%w, token %s has expired", ErrAuthentication, name)
+	}
+
+	return tokenPrincipalPrefix + name, nil
+}
+
+// authorizeToken checks whether the role of the token allows the
+// statement, it must be called with the database lock held.
+func (db *Database) authorizeToken(principal string, q sql.Statement) error {
+	name := strings.TrimPrefix(principal, tokenPrincipalPrefix)
+	t, exists := db.tokens[name]
+	if !exists || t.expired() {
+		return ErrAuthentication
+	}
+
+	if t.Role == RoleAdmin {
+		return nil
+	}
+
+	if readsAuditLog(q) {
+		return fmt.Errorf("%w, %s token can not read the audit log", ErrPermissionDenied, t.Role)
+	}
+
+	switch query := q.(type) {
+	case *CreateUser, *AlterUser, *DropUser, *Grant, *Revoke, *CreateToken, *DropToken:
+		return fmt.Errorf("%w, %s token can not manage users and tokens", ErrPermissionDenied, t.Role)
+	case *Backup:
+		return fmt.Errorf("%w, %s token can not back up the database", ErrPermissionDenied, t.Role)
+	case *AlterColumnMask:
+		return fmt.Errorf("%w, %s token can not mask columns", ErrPermissionDenied, t.Role)
+	case *CreateDatabase, *DropDatabase:
+		return fmt.Errorf("%w, %s token can not manage databases", ErrPermissionDenied, t.Role)
+	case *SetReadOnly:
+		return fmt.Errorf("%w, %s token can not switch the read-only mode", ErrPermissionDenied, t.Role)
+	case *SetSetting:
+		if query.Scope == ScopeGlobal {
+			return fmt.Errorf("%w, %s token can not change the global settings", ErrPermissionDenied, t.Role)
+		}
+	case *Copy:
+		if query.Path != "" {
+			return fmt.Errorf("%w, %s token can not copy the files of the server", ErrPermissionDenied, t.Role)
+		}
+	case *Kill:
+		return db.authorizeKill(principal, query)
+	}
+
+	privilege, table := requiredPrivilege(q)
+	switch {
+	case privilege == "", privilege == PrivilegeSelect:
+		return nil
+	case t.Role == RoleReadWrite && privilege != PrivilegeDDL:
+		return nil
+	}
+
+	return fmt.Errorf("%w, %s token is not allowed %s on table %s", ErrPermissionDenied, t.Role, privilege, strings.ToLower(table))
+}
+
+// tokenRows describes the tokens without the secret hashes.
+func (db *Database) tokenRows() [][]interface{} {
+	names := make([]string, 0, len(db.tokens))
+	for name := range db.tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([][]interface{}, 0, len(names))
+	for _, name := range names {
+		t := db.tokens[name]
+		expires := ""
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format(time.RFC3339)
+		}
+		rows = append(rows, []interface{}{t.Name, string(t.Role), t.Created.Format(time.RFC3339), expires})
+	}
+
+	return rows
+}
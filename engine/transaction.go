@@ -0,0 +1,736 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// journalDirName is the directory with the rollback journals
+// of the transactions, one subdirectory per transaction.
+const journalDirName = "gosqldb.journal"
+
+// committedJournalSuffix marks the journal of the committed
+// transaction that has not been removed yet.
+const committedJournalSuffix = ".committed"
+
+// absentFileExtension marks the data file that did not exist
+// before the transaction.
+const absentFileExtension = ".absent"
+
+// Begin represents BEGIN [TRANSACTION] [ISOLATION LEVEL level] statement.
+type Begin struct {
+	// Isolation is empty for the default isolation level.
+	Isolation IsolationLevel
+}
+
+// GetType returns the statement type.
+func (*Begin) GetType() sql.StatementType { return StatementBegin }
+
+// Commit represents COMMIT statement.
+type Commit struct{}
+
+// GetType returns the statement type.
+func (*Commit) GetType() sql.StatementType { return StatementCommit }
+
+// Rollback represents ROLLBACK statement.
+type Rollback struct{}
+
+// GetType returns the statement type.
+func (*Rollback) GetType() sql.StatementType { return StatementRollback }
+
+// parseTransactionStatement parses BEGIN, COMMIT, ROLLBACK
+// and the savepoint statements.
+func parseTransactionStatement(s *tokenStream) (sql.Statement, error) {
+	var statement sql.Statement
+	switch {
+	case s.acceptKeyword("BEGIN"):
+		s.acceptKeyword("TRANSACTION")
+		begin := &Begin{}
+		if s.isKeyword("ISOLATION") {
+			level, err := parseIsolationLevel(s)
+			if err != nil {
+				return nil, err
+			}
+			begin.Isolation = level
+		}
+		statement = begin
+	case s.acceptKeyword("COMMIT"):
+		statement = &Commit{}
+	case s.acceptKeyword("ROLLBACK", "TO"):
+		name, err := parseSavepointName(s)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RollbackToSavepoint{name}, nil
+	case s.acceptKeyword("ROLLBACK"):
+		statement = &Rollback{}
+	case s.acceptKeyword("SAVEPOINT"):
+		name, err := s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		statement = &Savepoint{strings.ToLower(name)}
+	case s.acceptKeyword("RELEASE"):
+		name, err := parseSavepointName(s)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ReleaseSavepoint{name}, nil
+	default:
+		return nil, s.unexpected("BEGIN, COMMIT, ROLLBACK, SAVEPOINT or RELEASE")
+	}
+
+	return statement, s.expectEnd()
+}
+
+// Transaction groups data changes that are committed or rolled
+// back together.
+//
+// The changes are written to the data files right away, but before
+// the first change of a data file its original content is copied to
+// the rollback journal of the transaction. Rollback restores the
+// files from the journal and commit removes the journal. The journals
+// left after a crash are rolled back on start.
+//
+// The transaction holds the locks of the data files it has changed
+// until it ends: other writers wait for them and other readers see
+// the rows as they were before the transaction. What the transaction
+// reads depends on its isolation level.
+type Transaction struct {
+	// ID identifies the transaction.
+	ID string
+	// User is the name of the user who has started the transaction,
+	// empty if it has been started without authentication.
+	User string
+
+	db       *Database
+	lastUsed time.Time
+	// record of the row versions created by the transaction
+	record *txRecord
+	// snapshot of the repeatable read transaction, nil for other
+	// levels that take a snapshot for every statement
+	snapshot  *snapshot
+	isolation IsolationLevel
+	// queried is set by the first query, the isolation level
+	// can not be changed after it
+	queried bool
+	locker  *locker
+	// active savepoints from the oldest to the newest
+	savepoints []*savepoint
+	// the last savepoint number, it names the savepoint journals
+	savepointSeq int
+	// tables changed by the transaction
+	tables map[string]struct{}
+	// original rows of the changed data files by storage names
+	journal map[string]*journalEntry
+	// archived is the sequence number of the first archive
+	// record of the transaction, zero if there is none
+	archived uint64
+	// row changes appended to the changefeed on commit
+	changes []Change
+	done    bool
+	// readOnly rejects the changes, the transaction is the read
+	// snapshot of the tools reading through the server
+	readOnly bool
+}
+
+// journalEntry is the original state of the data file.
+type journalEntry struct {
+	// dir is the journal directory with the copy of the data file
+	dir string
+	// versions of the in-memory rows
+	versions []*rowVersion
+	// mapped is true if the rows were not in memory,
+	// they are read from the journal
+	mapped bool
+	// existed is false if the data file did not exist
+	existed bool
+}
+
+// Begin starts a transaction with the isolation level,
+// empty one means the default level.
+func (db *Database) Begin(isolation IsolationLevel) (*Transaction, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate transaction id: %w", err)
+	}
+
+	tx := &Transaction{
+		ID:       hex.EncodeToString(id),
+		db:       db,
+		lastUsed: time.Now(),
+		record:   &txRecord{},
+		tables:   make(map[string]struct{}),
+		journal:  make(map[string]*journalEntry),
+	}
+	tx.locker = newLocker(tx)
+	if isolation == "" {
+		isolation = db.options.Isolation
+	}
+	db.setIsolation(tx, isolation)
+	db.transactions[tx.ID] = tx
+
+	return tx, nil
+}
+
+// BeginReadOnly starts the repeatable read transaction that rejects
+// the changes, so the tools read the consistent snapshot of all
+// the tables through the running server instead of the files.
+func (db *Database) BeginReadOnly() (*Transaction, error) {
+	tx, err := db.Begin(RepeatableRead)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx.readOnly = true
+	// the snapshot must not be released by SET TRANSACTION
+	tx.queried = true
+
+	return tx, nil
+}
+
+// SnapshotSequence returns the commit sequence number of the snapshot
+// of the repeatable read transaction, zero for the other levels.
+func (tx *Transaction) SnapshotSequence() uint64 {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if tx.snapshot == nil {
+		return 0
+	}
+
+	return tx.snapshot.csn
+}
+
+// Transaction returns the active transaction.
+func (db *Database) Transaction(id string) (*Transaction, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx, exists := db.transactions[id]
+	if !exists {
+		return nil, newError(CodeUndefinedObject, "transaction %s does not exist", id)
+	}
+
+	return tx, nil
+}
+
+// Select fetches data within the transaction.
+func (tx *Transaction) Select(query *sql.Select) ([][]interface{}, error) {
+	return tx.SelectContext(context.Background(), query)
+}
+
+// SelectContext fetches data within the transaction until the context is done.
+func (tx *Transaction) SelectContext(ctx context.Context, query *sql.Select) ([][]interface{}, error) {
+	masks := tx.db.queryMasks(ctx, query.Table)
+
+	rows, err := tx.selectRows(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return maskRows(masks, rows), nil
+}
+
+// selectRows fetches data within the transaction without masking
+// the values, so the triggers see the real ones.
+func (tx *Transaction) selectRows(ctx context.Context, query *sql.Select) ([][]interface{}, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return nil, err
+	}
+	tx.queried = true
+
+	return tx.db.selectRows(ctx, query, nil, tx)
+}
+
+// Insert inserts data within the transaction.
+func (tx *Transaction) Insert(query *sql.Insert) (int, error) {
+	return tx.InsertContext(context.Background(), query)
+}
+
+// InsertContext inserts data within the transaction until the context is done.
+func (tx *Transaction) InsertContext(ctx context.Context, query *sql.Insert) (int, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return 0, err
+	}
+	tx.queried = true
+
+	return tx.db.insert(ctx, query, tx)
+}
+
+// Update updates data within the transaction.
+func (tx *Transaction) Update(query *sql.Update) (int, error) {
+	return tx.UpdateContext(context.Background(), query)
+}
+
+// UpdateContext updates data within the transaction until the context is done.
+func (tx *Transaction) UpdateContext(ctx context.Context, query *sql.Update) (int, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return 0, err
+	}
+	tx.queried = true
+
+	return tx.db.update(ctx, query, 0, nil, tx)
+}
+
+// Delete deletes data within the transaction.
+func (tx *Transaction) Delete(query *sql.Delete) (int, error) {
+	return tx.DeleteContext(context.Background(), query)
+}
+
+// DeleteContext deletes data within the transaction until the context is done.
+func (tx *Transaction) DeleteContext(ctx context.Context, query *sql.Delete) (int, error) {
+	ctx, cancel := tx.db.statementContext(ctx)
+	defer cancel()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if err := tx.db.use(tx); err != nil {
+		return 0, err
+	}
+	tx.queried = true
+
+	return tx.db.delete(ctx, query, 0, nil, tx)
+}
+
+// Commit makes the changes of the transaction permanent.
+func (tx *Transaction) Commit() error {
+	tx.db.mu.Lock()
+	err := tx.db.use(tx)
+	if err == nil {
+		err = tx.db.commit(tx)
+	}
+	tx.db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return tx.db.waitCommitted(context.Background())
+}
+
+// Rollback discards the changes of the transaction.
+func (tx *Transaction) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if tx.done {
+		return fmt.Errorf("transaction %s has already ended", tx.ID)
+	}
+
+	return tx.db.rollback(tx)
+}
+
+// use checks that the transaction is active, the expired
+// transaction is rolled back.
+func (db *Database) use(tx *Transaction) error {
+	if tx.done {
+		return fmt.Errorf("transaction %s has already ended", tx.ID)
+	}
+
+	if db.expired(tx) {
+		if err := db.rollback(tx); err != nil {
+			return fmt.Errorf("failed to roll back expired transaction %s: %w", tx.ID, err)
+		}
+
+		return fmt.Errorf("transaction %s has expired and has been rolled back", tx.ID)
+	}
+	tx.lastUsed = time.Now()
+
+	return nil
+}
+
+// expired reports whether the transaction has not been used
+// for longer than the transaction timeout.
+func (db *Database) expired(tx *Transaction) bool {
+	timeout := db.options.TransactionTimeout
+
+	return timeout > 0 && time.Since(tx.lastUsed) > timeout
+}
+
+// beginWrite locks the storages of the table for writing and,
+// within the transaction, marks the table as changed.
+func (db *Database) beginWrite(ctx context.Context, l *locker, tableName string, names []string) error {
+	err := db.lockStorages(ctx, l, names, lockExclusive)
+	if err != nil {
+		return err
+	}
+
+	if l.tx != nil {
+		if l.tx.readOnly {
+			return ErrReadOnlyTransaction
+		}
+		l.tx.tables[tableName] = struct{}{}
+	}
+
+	return nil
+}
+
+// lockMappedStorages locks the memory-mapped storages read by the
+// transaction in the shared mode: they have no row versions, so they
+// are kept from changing until the transaction ends.
+func (db *Database) lockMappedStorages(ctx context.Context, tx *Transaction, tableName string, names []string) error {
+	mapped := make([]string, 0)
+	for _, name := range names {
+		if db.mapped[name] {
+			mapped = append(mapped, name)
+		}
+	}
+
+	if len(mapped) == 0 {
+		return nil
+	}
+
+	err := db.lock(ctx, tx.locker, tableResource(tableName), lockIntentionShared)
+	if err != nil {
+		return err
+	}
+
+	return db.lockStorages(ctx, tx.locker, mapped, lockShared)
+}
+
+func (db *Database) journalDir(tx *Transaction) string {
+	return path.Join(db.dbDir, journalDirName, tx.ID)
+}
+
+// journalStorage copies the data file to the journal of the transaction
+// and of its savepoints before its first change since they have started,
+// it is no-op without the transaction.
+func (db *Database) journalStorage(tx *Transaction, name string) error {
+	if tx == nil {
+		return nil
+	}
+
+	// the data file has not changed since the transaction
+	// or the savepoint that has not journaled it yet, so all
+	// of them share the same copy
+	var captured *journalEntry
+	journal := func(dir string) (*journalEntry, error) {
+		if captured != nil {
+			return captured, nil
+		}
+
+		var err error
+		captured, err = db.captureStorage(dir, name)
+
+		return captured, err
+	}
+
+	if _, exists := tx.journal[name]; !exists {
+		entry, err := journal(db.journalDir(tx))
+		if err != nil {
+			return err
+		}
+		tx.journal[name] = entry
+	}
+
+	for _, sp := range tx.savepoints {
+		if _, exists := sp.journal[name]; !exists {
+			entry, err := journal(sp.dir)
+			if err != nil {
+				return err
+			}
+			sp.journal[name] = entry
+		}
+	}
+
+	return nil
+}
+
+// captureStorage copies the data file into the directory.
+func (db *Database) captureStorage(dir string, name string) (*journalEntry, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal directory %s: %w", dir, err)
+	}
+
+	entry := &journalEntry{dir: dir, existed: true}
+	if db.inMemory(name) {
+		entry.versions = db.data[name][:len(db.data[name]):len(db.data[name])]
+		return entry, nil
+	}
+
+	filePath := tableFilePath(db.dbDir, name)
+	for _, filePath := range []string{filePath, checksumFilePath(filePath)} {
+		content, err := ioutil.ReadFile(filePath)
+		if os.IsNotExist(err) {
+			// files written before checksums were introduced have no checksum
+			if filePath == tableFilePath(db.dbDir, name) {
+				entry.existed = false
+			}
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+
+		err = db.writeFileBytes(path.Join(dir, path.Base(filePath)), content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !entry.existed {
+		err = db.writeFileBytes(path.Join(dir, name+absentFileExtension), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entry.mapped = db.mapped[name]
+	if !entry.mapped {
+		// the versions are not changed in place, but appending to
+		// the journaled slice after rollback must not reuse its array
+		versions := db.data[name]
+		entry.versions = versions[:len(versions):len(versions)]
+	}
+
+	return entry, nil
+}
+
+// restoreEntry restores the data file and the in-memory rows.
+func (db *Database) restoreEntry(name string, entry *journalEntry) error {
+	if db.inMemory(name) {
+		db.data[name] = entry.versions
+		return nil
+	}
+
+	err := restoreStorage(db.dbDir, entry.dir, name)
+	if err != nil {
+		return err
+	}
+
+	err = db.archiveStorage(name)
+	if err != nil {
+		return err
+	}
+
+	if !entry.mapped || !entry.existed {
+		db.data[name] = entry.versions
+		delete(db.mapped, name)
+	} else {
+		delete(db.data, name)
+		db.mapped[name] = true
+	}
+
+	return nil
+}
+
+func (db *Database) commit(tx *Transaction) error {
+	if len(tx.journal) > 0 {
+		journalDir := db.journalDir(tx)
+		// the rename is the commit point
+		err := os.Rename(journalDir, journalDir+committedJournalSuffix)
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction %s: %w", tx.ID, err)
+		}
+
+		err = syncDir(path.Dir(journalDir))
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction %s: %w", tx.ID, err)
+		}
+
+		err = os.RemoveAll(journalDir + committedJournalSuffix)
+		if err != nil {
+			logging.Errorf("failed to remove journal of committed transaction %s: %s", tx.ID, err)
+		}
+	}
+
+	db.archiveEnd(tx, true)
+	db.captureCommit(tx)
+	db.commitRecord(tx.record)
+	tableNames := make([]string, 0, len(tx.tables))
+	for tableName := range tx.tables {
+		tableNames = append(tableNames, tableName)
+	}
+	db.tablesCommitted(tableNames)
+	db.endTransaction(tx)
+
+	return nil
+}
+
+func (db *Database) rollback(tx *Transaction) error {
+	journalDir := db.journalDir(tx)
+	for name, entry := range tx.journal {
+		err := db.restoreEntry(name, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(tx.journal) > 0 {
+		err := os.RemoveAll(journalDir)
+		if err != nil {
+			return fmt.Errorf("failed to remove journal %s: %w", journalDir, err)
+		}
+	}
+	db.archiveEnd(tx, false)
+
+	db.endTransaction(tx)
+
+	for tableName := range tx.tables {
+		if _, exists := db.tables[tableName]; !exists {
+			continue
+		}
+
+		err := db.refreshStats(tableName)
+		if err != nil {
+			return fmt.Errorf("failed to refresh statistics: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (db *Database) endTransaction(tx *Transaction) {
+	tx.done = true
+	if tx.snapshot != nil {
+		db.releaseSnapshot(tx.snapshot)
+	}
+	db.unlockAll(tx.locker)
+	delete(db.transactions, tx.ID)
+}
+
+// restoreStorage restores the data file and its checksum
+// from the journal.
+func restoreStorage(dbDir string, journalDir string, name string) error {
+	filePath := tableFilePath(dbDir, name)
+	_, err := os.Stat(path.Join(journalDir, name+absentFileExtension))
+	absent := err == nil
+
+	for _, filePath := range []string{filePath, checksumFilePath(filePath)} {
+		if absent {
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove file %s: %w", filePath, err)
+			}
+
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path.Join(journalDir, path.Base(filePath)))
+		if os.IsNotExist(err) && filePath != tableFilePath(dbDir, name) {
+			// the data file had no checksum
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove file %s: %w", filePath, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read journal of %s: %w", name, err)
+		}
+
+		// the file is replaced, it can be still read by the readers
+		err = ioutil.WriteFile(filePath+tempFileExtension, content, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to restore file %s: %w", filePath, err)
+		}
+
+		err = os.Rename(filePath+tempFileExtension, filePath)
+		if err != nil {
+			return fmt.Errorf("failed to restore file %s: %w", filePath, err)
+		}
+
+		err = syncFile(filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncDir(dbDir)
+}
+
+// recoverJournals rolls back the transactions that were active on
+// crash and returns the names of the restored tables.
+func recoverJournals(dbDir string) ([]string, error) {
+	journalsDir := path.Join(dbDir, journalDirName)
+	journals, err := ioutil.ReadDir(journalsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read journal directory %s: %w", journalsDir, err)
+	}
+
+	tables := make([]string, 0)
+	for _, journal := range journals {
+		journalDir := path.Join(journalsDir, journal.Name())
+		if strings.HasSuffix(journal.Name(), committedJournalSuffix) {
+			if err := os.RemoveAll(journalDir); err != nil {
+				return nil, fmt.Errorf("failed to remove journal %s: %w", journalDir, err)
+			}
+
+			continue
+		}
+
+		files, err := ioutil.ReadDir(journalDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal %s: %w", journalDir, err)
+		}
+
+		for _, file := range files {
+			var name string
+			switch {
+			case strings.HasSuffix(file.Name(), tableFileExtension):
+				name = strings.TrimSuffix(file.Name(), tableFileExtension)
+			case strings.HasSuffix(file.Name(), absentFileExtension):
+				name = strings.TrimSuffix(file.Name(), absentFileExtension)
+			default:
+				continue
+			}
+
+			err = restoreStorage(dbDir, journalDir, name)
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, strings.SplitN(name, ".", 2)[0])
+		}
+
+		if err := os.RemoveAll(journalDir); err != nil {
+			return nil, fmt.Errorf("failed to remove journal %s: %w", journalDir, err)
+		}
+		logging.Warnf("unfinished transaction %s has been rolled back", journal.Name())
+	}
+
+	return tables, nil
+}
@@ -0,0 +1,684 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The triggers are fired for every row changed by INSERT, UPDATE and
+// DELETE executed as statements, before or after the change. The action
+// of a trigger is either an INSERT, UPDATE or DELETE of another table,
+// where NEW.column and OLD.column are replaced with the values of the
+// row after and before the change, or the insert of the change into an
+// audit table. The actions are executed within the transaction of the
+// statement, the statements outside of transactions are executed in
+// their own ones, so the failed action rolls back the whole statement.
+// The actions may fire the triggers of their tables up to a depth.
+// The actions are authorized as the user who has created the trigger,
+// both when it is created and when it fires.
+
+// maxTriggerDepth limits the nesting of the trigger actions.
+const maxTriggerDepth = 16
+
+// auditColumns are the string columns every audit table must have.
+var auditColumns = []string{"operation", "table_name", "old_row", "new_row", "changed_at"}
+
+// Trigger describes the action fired by the row changes of a table.
+type Trigger struct {
+	Name string `json:"name"`
+	// Timing is BEFORE or AFTER.
+	Timing string `json:"timing"`
+	// Event is INSERT, UPDATE or DELETE.
+	Event string `json:"event"`
+	// Action is the statement executed for every changed row,
+	// empty for the audit triggers.
+	Action string `json:"action,omitempty"`
+	// AuditTable is the table the changes are inserted into
+	// by the audit triggers.
+	AuditTable string `json:"audit_table,omitempty"`
+	// User is the name of the user who has created the trigger,
+	// empty if it has been created without authentication.
+	User string `json:"user,omitempty"`
+}
+
+// CreateTrigger represents CREATE TRIGGER statement.
+type CreateTrigger struct {
+	Table   string
+	Trigger Trigger
+}
+
+// GetType returns the statement type.
+func (*CreateTrigger) GetType() sql.StatementType { return StatementCreateTrigger }
+
+// DropTrigger represents DROP TRIGGER ... ON statement.
+type DropTrigger struct {
+	Name  string
+	Table string
+}
+
+// GetType returns the statement type.
+func (*DropTrigger) GetType() sql.StatementType { return StatementDropTrigger }
+
+// triggerRef is the reference to the column of the changed row
+// in the action of a trigger.
+type triggerRef struct {
+	// row is NEW or OLD
+	row    string
+	column string
+	pos    int
+	end    int
+}
+
+// parseCreateTrigger parses CREATE TRIGGER name BEFORE|AFTER
+// INSERT|UPDATE|DELETE ON table [FOR EACH ROW] followed by
+// EXECUTE statement or AUDIT INTO table.
+func parseCreateTrigger(query string, s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("CREATE", "TRIGGER")
+
+	create := &CreateTrigger{}
+	var err error
+	create.Trigger.Name, err = s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	create.Trigger.Name = strings.ToLower(create.Trigger.Name)
+
+	switch {
+	case s.acceptKeyword("BEFORE"):
+		create.Trigger.Timing = "BEFORE"
+	case s.acceptKeyword("AFTER"):
+		create.Trigger.Timing = "AFTER"
+	default:
+		return nil, s.unexpected("BEFORE or AFTER")
+	}
+
+	switch {
+	case s.acceptKeyword("INSERT"):
+		create.Trigger.Event = "INSERT"
+	case s.acceptKeyword("UPDATE"):
+		create.Trigger.Event = "UPDATE"
+	case s.acceptKeyword("DELETE"):
+		create.Trigger.Event = "DELETE"
+	default:
+		return nil, s.unexpected("INSERT, UPDATE or DELETE")
+	}
+
+	if err := s.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	create.Table, err = s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.acceptKeyword("FOR") {
+		if err := s.expectKeyword("EACH", "ROW"); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.acceptKeyword("AUDIT") {
+		if err := s.expectKeyword("INTO"); err != nil {
+			return nil, err
+		}
+		create.Trigger.AuditTable, err = s.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		create.Trigger.AuditTable = strings.ToLower(create.Trigger.AuditTable)
+
+		return create, s.expectEnd()
+	}
+
+	if err := s.expectKeyword("EXECUTE"); err != nil {
+		return nil, err
+	}
+
+	execute := s.tokens[s.pos-1]
+	create.Trigger.Action = strings.TrimSpace(query[execute.pos+len(execute.value):])
+	if _, err := parseTriggerAction(create.Trigger.Action); err != nil {
+		return nil, fmt.Errorf("invalid trigger action: %w", err)
+	}
+
+	return create, nil
+}
+
+// parseDropTrigger parses DROP TRIGGER name ON table.
+func parseDropTrigger(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("DROP", "TRIGGER")
+
+	drop := &DropTrigger{}
+	var err error
+	drop.Name, err = s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	drop.Table, err = s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	return drop, s.expectEnd()
+}
+
+// parseTriggerAction parses the action with the references to
+// the changed row replaced with zeros.
+func parseTriggerAction(action string) (sql.Statement, error) {
+	refs, err := triggerRefs(action)
+	if err != nil {
+		return nil, err
+	}
+
+	statement, err := parseRewritten(bindRefs(action, refs, func(triggerRef) string { return "0" }))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, event := changedTable(statement); event == "" {
+		return nil, fmt.Errorf("the action must be INSERT, UPDATE or DELETE, got %T", statement)
+	}
+
+	return statement, nil
+}
+
+// triggerStatement returns the statement the trigger of the table
+// executes, the action or the insert into the audit table.
+func triggerStatement(tableName string, trigger Trigger) (sql.Statement, error) {
+	if trigger.AuditTable != "" {
+		return auditInsert(trigger.AuditTable, tableName, trigger.Event, rowChange{})
+	}
+
+	return parseTriggerAction(trigger.Action)
+}
+
+// triggerRefs returns the references to the changed row in the action.
+func triggerRefs(action string) ([]triggerRef, error) {
+	tokens, err := tokenize(action)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]triggerRef, 0)
+	for i := 0; i+2 < len(tokens); i++ {
+		row, dot, column := tokens[i], tokens[i+1], tokens[i+2]
+		if row.kind != tokenWord || !isTriggerRow(row.value) || dot.value != "." || column.kind != tokenWord {
+			continue
+		}
+
+		refs = append(refs, triggerRef{
+			row:    strings.ToUpper(row.value),
+			column: strings.ToLower(column.value),
+			pos:    row.pos,
+			end:    column.pos + len(column.value),
+		})
+		i += 2
+	}
+
+	return refs, nil
+}
+
+// isTriggerRow reports whether the qualifier is NEW or OLD.
+func isTriggerRow(name string) bool {
+	return strings.EqualFold(name, "NEW") || strings.EqualFold(name, "OLD")
+}
+
+// bindRefs replaces the references in the action with the literals.
+func bindRefs(action string, refs []triggerRef, literal func(triggerRef) string) string {
+	var b strings.Builder
+	last := 0
+	for _, ref := range refs {
+		b.WriteString(action[last:ref.pos])
+		b.WriteString(literal(ref))
+		last = ref.end
+	}
+	b.WriteString(action[last:])
+
+	return b.String()
+}
+
+// changedTable returns the table and the event of the statement
+// that changes the rows, the empty event for the other statements.
+func changedTable(q sql.Statement) (string, string) {
+	switch query := q.(type) {
+	case *sql.Insert:
+		return query.Table, "INSERT"
+	case *sql.Update:
+		return query.Table, "UPDATE"
+	case *UpdateIfVersion:
+		return query.Table, "UPDATE"
+	case *sql.Delete:
+		return query.Table, "DELETE"
+	case *DeleteIfVersion:
+		return query.Table, "DELETE"
+	}
+
+	return "", ""
+}
+
+// CreateTrigger adds the trigger to the table.
+func (db *Database) CreateTrigger(query *CreateTrigger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(context.Background(), l, tableResource(tableName), lockExclusive); err != nil {
+		return err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	trigger := query.Trigger
+	for _, existing := range schema.Triggers {
+		if existing.Name == trigger.Name {
+			return newError(CodeDuplicateObject, "trigger %s exists on table %s", trigger.Name, tableName)
+		}
+	}
+
+	if err := db.validateTrigger(tableName, schema, trigger); err != nil {
+		return err
+	}
+
+	schema.Triggers = append(append([]Trigger(nil), schema.Triggers...), trigger)
+
+	return db.replaceTriggers(tableName, schema)
+}
+
+// DropTrigger removes the trigger from the table.
+func (db *Database) DropTrigger(query *DropTrigger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, unlock := db.statementLocker(nil)
+	defer unlock()
+
+	tableName := strings.ToLower(query.Table)
+	if err := db.lock(context.Background(), l, tableResource(tableName), lockExclusive); err != nil {
+		return err
+	}
+
+	schema, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	name := strings.ToLower(query.Name)
+	triggers := make([]Trigger, 0, len(schema.Triggers))
+	for _, trigger := range schema.Triggers {
+		if trigger.Name != name {
+			triggers = append(triggers, trigger)
+		}
+	}
+	if len(triggers) == len(schema.Triggers) {
+		return newError(CodeUndefinedObject, "trigger %s does not exist on table %s", name, tableName)
+	}
+	schema.Triggers = triggers
+
+	return db.replaceTriggers(tableName, schema)
+}
+
+// replaceTriggers stores the table with the changed triggers,
+// it must be called with the database lock held.
+func (db *Database) replaceTriggers(tableName string, schema Schema) error {
+	previous := db.tables[tableName]
+	db.replaceSchema(schema)
+	if schema.InMemory {
+		return nil
+	}
+
+	if err := db.storeTables(); err != nil {
+		db.tables[tableName] = previous
+		return fmt.Errorf("failed to store tables: %w", err)
+	}
+
+	return nil
+}
+
+// validateTrigger checks the action of the trigger against the tables,
+// it must be called with the database lock held.
+func (db *Database) validateTrigger(tableName string, schema Schema, trigger Trigger) error {
+	if trigger.AuditTable != "" {
+		audit, exists := db.tables[trigger.AuditTable]
+		if !exists {
+			return newError(CodeUndefinedTable, "audit table %s does not exist", trigger.AuditTable)
+		}
+
+		if trigger.AuditTable == tableName {
+			return fmt.Errorf("table %s can not be audited into itself", tableName)
+		}
+
+		for _, column := range auditColumns {
+			if def, exists := audit.Columns[column]; !exists || def.Type != sql.TypeString {
+				return fmt.Errorf("audit table %s must have string columns %s", trigger.AuditTable, strings.Join(auditColumns, ", "))
+			}
+		}
+
+		return nil
+	}
+
+	statement, err := parseTriggerAction(trigger.Action)
+	if err != nil {
+		return fmt.Errorf("invalid trigger action: %w", err)
+	}
+
+	if target, _ := changedTable(statement); strings.ToLower(target) == tableName {
+		return fmt.Errorf("the action of the trigger can not change table %s", tableName)
+	}
+
+	refs, err := triggerRefs(trigger.Action)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		switch {
+		case ref.row == "NEW" && trigger.Event == "DELETE":
+			return fmt.Errorf("NEW.%s can not be referenced by DELETE triggers", ref.column)
+		case ref.row == "OLD" && trigger.Event == "INSERT":
+			return fmt.Errorf("OLD.%s can not be referenced by INSERT triggers", ref.column)
+		}
+
+		if _, exists := schema.Columns[ref.column]; !exists || ref.column == versionColumn {
+			return newError(CodeUndefinedColumn, "column %s does not exist in table %s", ref.column, tableName)
+		}
+	}
+
+	return nil
+}
+
+// triggers returns the triggers of the table fired by the event.
+func (db *Database) triggers(tableName string, event string) []Trigger {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	fired := make([]Trigger, 0)
+	for _, trigger := range db.tables[strings.ToLower(tableName)].Triggers {
+		if trigger.Event == event {
+			fired = append(fired, trigger)
+		}
+	}
+
+	return fired
+}
+
+// hasTriggers reports whether the statement fires triggers.
+func (db *Database) hasTriggers(q sql.Statement) bool {
+	tableName, event := changedTable(q)
+
+	return event != "" && len(db.triggers(tableName, event)) > 0
+}
+
+// executeTriggered executes the statement that fires the triggers
+// in its own transaction.
+func (db *Database) executeTriggered(ctx context.Context, q sql.Statement) (interface{}, error) {
+	tx, err := db.Begin("")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.executeTriggered(ctx, q)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logging.Errorf("failed to roll back transaction %s: %s", tx.ID, rollbackErr)
+		}
+
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+// triggerDepthKey is the context key of the nesting depth of the actions.
+type triggerDepthKey struct{}
+
+// rowChange is the row changed by the statement, old is nil for
+// the inserted rows and new is nil for the deleted ones.
+type rowChange struct {
+	old map[string]interface{}
+	new map[string]interface{}
+}
+
+// executeTriggered executes the statement with its triggers, the
+// changes of the failed statement and its actions are rolled back.
+func (tx *Transaction) executeTriggered(ctx context.Context, q sql.Statement) (interface{}, error) {
+	depth, _ := ctx.Value(triggerDepthKey{}).(int)
+	if depth >= maxTriggerDepth {
+		return nil, fmt.Errorf("the triggers are nested deeper than %d", maxTriggerDepth)
+	}
+	ctx = context.WithValue(ctx, triggerDepthKey{}, depth+1)
+
+	tableName, event := changedTable(q)
+	triggers := tx.db.triggers(tableName, event)
+
+	savepoint := fmt.Sprintf("trigger.%d", depth)
+	if err := tx.Savepoint(savepoint); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.executeWithTriggers(ctx, q, tableName, event, triggers)
+	if err != nil {
+		if rollbackErr := tx.RollbackTo(savepoint); rollbackErr != nil {
+			logging.Errorf("failed to roll back transaction %s to savepoint %s: %s", tx.ID, savepoint, rollbackErr)
+		}
+	}
+	if releaseErr := tx.Release(savepoint); releaseErr != nil && err == nil {
+		err = releaseErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (tx *Transaction) executeWithTriggers(ctx context.Context, q sql.Statement, tableName string, event string, triggers []Trigger) (interface{}, error) {
+	changes, err := tx.changedRows(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.fireTriggers(ctx, triggers, "BEFORE", tableName, event, changes); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.executeChange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.fireTriggers(ctx, triggers, "AFTER", tableName, event, changes); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// executeChange executes INSERT, UPDATE or DELETE without the triggers.
+func (tx *Transaction) executeChange(ctx context.Context, q sql.Statement) (interface{}, error) {
+	switch query := q.(type) {
+	case *sql.Insert:
+		return tx.InsertContext(ctx, query)
+	case *sql.Update:
+		return tx.UpdateContext(ctx, query)
+	case *sql.Delete:
+		return tx.DeleteContext(ctx, query)
+	case *UpdateIfVersion:
+		return tx.UpdateIfVersionContext(ctx, query)
+	case *DeleteIfVersion:
+		return tx.DeleteIfVersionContext(ctx, query)
+	default:
+		return nil, fmt.Errorf("unsupported query type: %T", query)
+	}
+}
+
+// changedRows returns the rows the statement is going to change, the
+// updated and the deleted ones are selected within the transaction.
+func (tx *Transaction) changedRows(ctx context.Context, q sql.Statement) ([]rowChange, error) {
+	tableName, _ := changedTable(q)
+	schema, err := tx.db.Schema(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := dumpedColumns(schema)
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+
+	var where *sql.Where
+	var set map[string]interface{}
+	switch query := q.(type) {
+	case *sql.Insert:
+		values, err := insertValues(query)
+		if err != nil {
+			return nil, err
+		}
+
+		inserted := query.Columns
+		if len(inserted) == 0 {
+			inserted = names
+		}
+
+		row := make(map[string]interface{}, len(names))
+		for i, column := range inserted {
+			if i < len(values) {
+				row[strings.ToLower(column)] = values[i]
+			}
+		}
+
+		return []rowChange{{new: row}}, nil
+	case *sql.Update:
+		where = query.Where
+		set, err = validateSet(schema, query.Columns, query.Values)
+	case *UpdateIfVersion:
+		where = query.Where
+		set, err = validateSet(schema, query.Columns, query.Values)
+	case *sql.Delete:
+		where = query.Where
+	case *DeleteIfVersion:
+		where = query.Where
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.selectRows(ctx, &sql.Select{Table: tableName, Columns: names, Where: where})
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]rowChange, len(rows))
+	for i, values := range rows {
+		row := make(map[string]interface{}, len(names))
+		for j, name := range names {
+			row[name] = values[j]
+		}
+		changes[i].old = row
+
+		if set != nil {
+			updated := make(map[string]interface{}, len(row))
+			for name, value := range row {
+				updated[name] = value
+			}
+			for name, value := range set {
+				updated[name] = value
+			}
+			changes[i].new = updated
+		}
+	}
+
+	return changes, nil
+}
+
+// fireTriggers executes the actions of the triggers with the timing
+// for every changed row.
+func (tx *Transaction) fireTriggers(ctx context.Context, triggers []Trigger, timing string, tableName string, event string, changes []rowChange) error {
+	for _, trigger := range triggers {
+		if trigger.Timing != timing {
+			continue
+		}
+
+		for _, change := range changes {
+			var action sql.Statement
+			var err error
+			if trigger.AuditTable != "" {
+				action, err = auditInsert(trigger.AuditTable, tableName, event, change)
+			} else {
+				action, err = bindAction(trigger.Action, change)
+			}
+			if err != nil {
+				return fmt.Errorf("trigger %s failed: %w", trigger.Name, err)
+			}
+
+			// the privileges could have been revoked since the creation
+			if err := tx.db.Authorize(trigger.User, action); err != nil {
+				return fmt.Errorf("trigger %s failed: %w", trigger.Name, err)
+			}
+
+			if _, err := tx.execute(ctx, action); err != nil {
+				return fmt.Errorf("trigger %s failed: %w", trigger.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// bindAction parses the action with the references replaced
+// with the values of the changed row.
+func bindAction(action string, change rowChange) (sql.Statement, error) {
+	refs, err := triggerRefs(action)
+	if err != nil {
+		return nil, err
+	}
+
+	statement, err := parseRewritten(bindRefs(action, refs, func(ref triggerRef) string {
+		if ref.row == "OLD" {
+			return literal(change.old[ref.column])
+		}
+
+		return literal(change.new[ref.column])
+	}))
+	if err != nil {
+		return nil, syntaxError(err)
+	}
+
+	return statement, nil
+}
+
+// auditInsert returns the insert of the change into the audit table,
+// the rows are encoded as JSON objects.
+func auditInsert(auditTable string, tableName string, event string, change rowChange) (sql.Statement, error) {
+	values := []string{quoteString(event), quoteString(strings.ToLower(tableName))}
+	for _, row := range []map[string]interface{}{change.old, change.new} {
+		if row == nil {
+			values = append(values, quoteString(""))
+			continue
+		}
+
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode row: %w", err)
+		}
+		values = append(values, quoteString(string(encoded)))
+	}
+	values = append(values, quoteString(time.Now().UTC().Format(time.RFC3339Nano)))
+
+	return &sql.Insert{Table: auditTable, Columns: auditColumns, Values: values}, nil
+}
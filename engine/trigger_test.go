@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTriggerPrivileges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// execute authorizes and executes the statement as the user
+	execute := func(userName string, statement string) error {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		if err := db.Authorize(userName, q); err != nil {
+			return err
+		}
+
+		ctx, finish := db.StartQuery(context.Background(), userName, "test", statement)
+		defer finish()
+		_, err = db.ExecuteContext(ctx, q)
+
+		return err
+	}
+
+	for _, statement := range []string{
+		`CREATE TABLE a (id INTEGER)`,
+		`CREATE TABLE b (id INTEGER)`,
+		`CREATE TABLE changes (operation STRING, table_name STRING, old_row STRING, new_row STRING, changed_at STRING)`,
+		`CREATE USER admin PASSWORD "secret" SUPERUSER`,
+	} {
+		if err := execute("", statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+	for _, statement := range []string{
+		`CREATE USER bob PASSWORD "secret"`,
+		`GRANT DDL, INSERT ON a TO bob`,
+		`INSERT INTO b (id) VALUES (1)`,
+	} {
+		if err := execute("admin", statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+
+	for _, statement := range []string{
+		`CREATE TRIGGER wipe AFTER INSERT ON a EXECUTE DELETE FROM b`,
+		`CREATE TRIGGER audit AFTER INSERT ON a AUDIT INTO changes`,
+	} {
+		if err := execute("bob", statement); !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("%s: expected %v, got %v", statement, ErrPermissionDenied, err)
+		}
+	}
+
+	if err := execute("admin", `GRANT DELETE ON b TO bob`); err != nil {
+		t.Fatal(err)
+	}
+	if err := execute("bob", `CREATE TRIGGER wipe AFTER INSERT ON a EXECUTE DELETE FROM b`); err != nil {
+		t.Fatal(err)
+	}
+
+	// the action is authorized as bob when the trigger fires
+	if err := execute("admin", `REVOKE DELETE ON b FROM bob`); err != nil {
+		t.Fatal(err)
+	}
+	if err := execute("admin", `INSERT INTO a (id) VALUES (1)`); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected %v, got %v", ErrPermissionDenied, err)
+	}
+
+	if err := execute("admin", `GRANT DELETE ON b TO bob`); err != nil {
+		t.Fatal(err)
+	}
+	if err := execute("admin", `INSERT INTO a (id) VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	q, err := Parse(`SELECT id FROM b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Execute(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selected := rows.([][]interface{}); len(selected) != 0 {
+		t.Errorf("expected the rows to be deleted by the trigger, got %v", selected)
+	}
+}
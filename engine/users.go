@@ -0,0 +1,622 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// name of the file that stores the user accounts
+// with the password hashes
+const usersFileName = "gosqldb.users.json"
+
+// maxPasswordSize is the longest password bcrypt can hash.
+const maxPasswordSize = 72
+
+// ErrAuthentication is returned for unknown users and wrong passwords,
+// it does not tell which of them is wrong.
+var ErrAuthentication = errors.New("invalid user name or password")
+
+// ErrPermissionDenied is returned when the user is not allowed
+// to execute the statement.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// user is the account the clients authenticate with.
+type user struct {
+	Name string `json:"name"`
+	// Hash is the bcrypt hash of the password, it includes the salt.
+	Hash      []byte    `json:"hash"`
+	Superuser bool      `json:"superuser"`
+	Created   time.Time `json:"created"`
+	// Grants are the privileges by lowercase table names,
+	// the database-wide ones are by grantDatabase.
+	Grants map[string][]Privilege `json:"grants,omitempty"`
+	// verified is the digest of the password checked last time, so the
+	// clients that authenticate every request do not pay for bcrypt on
+	// every request
+	verified []byte
+}
+
+// CreateUser represents CREATE USER name [WITH] PASSWORD "..."
+// [SUPERUSER | NOSUPERUSER] statement.
+type CreateUser struct {
+	Name      string
+	Password  string
+	Superuser bool
+}
+
+// GetType returns the statement type.
+func (*CreateUser) GetType() sql.StatementType { return StatementCreateUser }
+
+// String describes the statement without the password.
+func (q *CreateUser) String() string {
+	return fmt.Sprintf("CREATE USER %s (superuser: %t)", q.Name, q.Superuser)
+}
+
+// AlterUser represents ALTER USER name [WITH] [PASSWORD "..."]
+// [SUPERUSER | NOSUPERUSER] statement, nil fields are not changed.
+type AlterUser struct {
+	Name      string
+	Password  *string
+	Superuser *bool
+}
+
+// GetType returns the statement type.
+func (*AlterUser) GetType() sql.StatementType { return StatementAlterUser }
+
+// String describes the statement without the password.
+func (q *AlterUser) String() string {
+	changes := make([]string, 0, 2)
+	if q.Password != nil {
+		changes = append(changes, "password")
+	}
+	if q.Superuser != nil {
+		changes = append(changes, fmt.Sprintf("superuser: %t", *q.Superuser))
+	}
+
+	return fmt.Sprintf("ALTER USER %s (%s)", q.Name, strings.Join(changes, ", "))
+}
+
+// DropUser represents DROP USER statement.
+type DropUser struct {
+	Name string
+}
+
+// GetType returns the statement type.
+func (*DropUser) GetType() sql.StatementType { return StatementDropUser }
+
+// parseCreateUser parses CREATE USER statement.
+func parseCreateUser(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("CREATE", "USER")
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	password, superuser, err := parseUserOptions(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if password == nil {
+		return nil, s.unexpected("PASSWORD")
+	}
+
+	return &CreateUser{name, *password, superuser != nil && *superuser}, nil
+}
+
+// parseAlterUser parses ALTER USER statement.
+func parseAlterUser(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("ALTER", "USER")
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	password, superuser, err := parseUserOptions(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if password == nil && superuser == nil {
+		return nil, s.unexpected("PASSWORD, SUPERUSER or NOSUPERUSER")
+	}
+
+	return &AlterUser{name, password, superuser}, nil
+}
+
+// parseUserOptions parses the options of CREATE and ALTER USER
+// up to the end of the statement, nil options are not set.
+func parseUserOptions(s *tokenStream) (*string, *bool, error) {
+	s.acceptKeyword("WITH")
+
+	var password *string
+	var superuser *bool
+	for {
+		switch {
+		case password == nil && s.acceptKeyword("PASSWORD"):
+			value, err := s.expectValue()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			text, ok := value.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("password must be a string")
+			}
+			password = &text
+		case superuser == nil && s.acceptKeyword("SUPERUSER"):
+			superuser = new(bool)
+			*superuser = true
+		case superuser == nil && s.acceptKeyword("NOSUPERUSER"):
+			superuser = new(bool)
+		default:
+			return password, superuser, s.expectEnd()
+		}
+	}
+}
+
+// parseDropUser parses DROP USER statement.
+func parseDropUser(s *tokenStream) (sql.Statement, error) {
+	s.mustKeyword("DROP", "USER")
+	name, err := s.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DropUser{name}, s.expectEnd()
+}
+
+// redactPasswords replaces the passwords of the user statements
+// in the query text, so they are not kept in the query history.
+func redactPasswords(query string) string {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return query
+	}
+
+	var b strings.Builder
+	last := 0
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i].kind != tokenWord || !strings.EqualFold(tokens[i].value, "PASSWORD") || tokens[i+1].kind != tokenString {
+			continue
+		}
+
+		value := tokens[i+1]
+		b.WriteString(query[last:value.pos])
+		b.WriteString(`"***"`)
+		last = value.pos + len(value.value)
+	}
+	b.WriteString(query[last:])
+
+	return b.String()
+}
+
+// loadUsers reads the users by lowercase names, there are none
+// if the file does not exist.
+func loadUsers(dbDir string, e *encryption) (map[string]*user, error) {
+	filePath := path.Join(dbDir, usersFileName)
+	content, err := readFileContent(filePath, e)
+	if os.IsNotExist(err) {
+		return make(map[string]*user), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	users := make(map[string]*user)
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", filePath, err)
+	}
+
+	return users, nil
+}
+
+// storeUsers replaces the users file, it must be called
+// with the database lock held.
+func (db *Database) storeUsers() error {
+	content, err := json.MarshalIndent(db.users, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode users: %w", err)
+	}
+
+	return db.writeFileContent(path.Join(db.dbDir, usersFileName), content)
+}
+
+// hashPassword returns the salted hash of the password.
+func hashPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, fmt.Errorf("password can not be empty")
+	}
+
+	if len(password) > maxPasswordSize {
+		return nil, fmt.Errorf("password can not be longer than %d bytes", maxPasswordSize)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return hash, nil
+}
+
+// passwordDigest is the digest of the verified password kept in memory.
+func passwordDigest(hash []byte, password string) []byte {
+	digest := sha256.Sum256(append(append([]byte(nil), hash...), password...))
+
+	return digest[:]
+}
+
+// CreateUser creates the user, the first user must be a superuser,
+// so the users can be managed after authentication is enabled.
+func (db *Database) CreateUser(query *CreateUser) error {
+	if !isValidTableNameFormat(query.Name) {
+		return fmt.Errorf("user name %s is not valid", query.Name)
+	}
+
+	// hashing is slow, so it is done without the database lock
+	hash, err := hashPassword(query.Password)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := strings.ToLower(query.Name)
+	if _, exists := db.users[name]; exists {
+		return newError(CodeDuplicateObject, "user %s already exists", name)
+	}
+
+	if len(db.users) == 0 && !query.Superuser {
+		return fmt.Errorf("the first user must be a superuser")
+	}
+
+	db.users[name] = &user{Name: name, Hash: hash, Superuser: query.Superuser, Created: time.Now().UTC()}
+	if err := db.storeUsers(); err != nil {
+		delete(db.users, name)
+		return err
+	}
+
+	return nil
+}
+
+// AlterUser changes the password or the superuser flag of the user.
+func (db *Database) AlterUser(query *AlterUser) error {
+	var hash []byte
+	if query.Password != nil {
+		var err error
+		hash, err = hashPassword(*query.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := strings.ToLower(query.Name)
+	u, exists := db.users[name]
+	if !exists {
+		return newError(CodeUndefinedObject, "user %s does not exist", name)
+	}
+
+	if query.Superuser != nil && !*query.Superuser && u.Superuser && db.superusers() == 1 {
+		return fmt.Errorf("user %s is the last superuser", name)
+	}
+
+	previous := *u
+	if hash != nil {
+		u.Hash = hash
+		u.verified = nil
+	}
+	if query.Superuser != nil {
+		u.Superuser = *query.Superuser
+	}
+
+	if err := db.storeUsers(); err != nil {
+		*u = previous
+		return err
+	}
+
+	return nil
+}
+
+// DropUser removes the user, the last superuser can not be removed
+// while there are other users.
+func (db *Database) DropUser(query *DropUser) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := strings.ToLower(query.Name)
+	u, exists := db.users[name]
+	if !exists {
+		return newError(CodeUndefinedObject, "user %s does not exist", name)
+	}
+
+	if u.Superuser && db.superusers() == 1 && len(db.users) > 1 {
+		return fmt.Errorf("user %s is the last superuser", name)
+	}
+
+	delete(db.users, name)
+	if err := db.storeUsers(); err != nil {
+		db.users[name] = u
+		return err
+	}
+
+	return nil
+}
+
+// superusers counts the superusers, it must be called
+// with the database lock held.
+func (db *Database) superusers() int {
+	n := 0
+	for _, u := range db.users {
+		if u.Superuser {
+			n++
+		}
+	}
+
+	return n
+}
+
+// AuthenticationRequired reports whether there are users or tokens,
+// so the clients must authenticate.
+func (db *Database) AuthenticationRequired() bool {
+	if db.authority != nil {
+		return db.authority.AuthenticationRequired()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.authenticationRequired()
+}
+
+// authenticationRequired must be called with the database lock held.
+func (db *Database) authenticationRequired() bool {
+	return len(db.users) > 0 || len(db.tokens) > 0
+}
+
+// Authenticate checks the password of the user.
+func (db *Database) Authenticate(name string, password string) error {
+	name = strings.ToLower(name)
+
+	db.mu.Lock()
+	u, exists := db.users[name]
+	var hash, verified []byte
+	if exists {
+		hash, verified = u.Hash, u.verified
+	}
+	db.mu.Unlock()
+
+	if !exists {
+		return ErrAuthentication
+	}
+
+	digest := passwordDigest(hash, password)
+	if verified != nil {
+		if subtle.ConstantTimeCompare(verified, digest) != 1 {
+			return ErrAuthentication
+		}
+
+		return nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return ErrAuthentication
+	}
+
+	db.mu.Lock()
+	// the password could have been changed in the meantime
+	if u, exists := db.users[name]; exists && string(u.Hash) == string(hash) {
+		u.verified = digest
+	}
+	db.mu.Unlock()
+
+	return nil
+}
+
+// Authorize checks whether the user or the token principal returned by
+// AuthenticateToken is allowed to execute the statement, the user name
+// is empty for the clients that have not authenticated, they are allowed
+// everything until there are users. The tokens are allowed what their
+// roles allow.
+//
+// The superusers are allowed everything, the other users need the
+// privileges granted on the table or on the database, except for the
+// information_schema tables readable by all users. Only the superusers
+// manage the users, the privileges and the column masks, the others
+// can change only their own password. The replica allows only the
+// statements that do not change the data. The named databases are
+// authorized by the users of the main one. Creating a trigger requires
+// the privileges of its action too. The temporary tables of the
+// sessions are authorized only with Session.Authorize.
+func (db *Database) Authorize(userName string, q sql.Statement) error {
+	return db.authorizeSession("", userName, q)
+}
+
+// Authorize checks the statement executed within the session as
+// Database.Authorize does, with the temporary tables of the session.
+func (s *Session) Authorize(userName string, q sql.Statement) error {
+	return s.db.authorizeSession(s.ID, userName, q)
+}
+
+// authorizeSession checks the statement executed within the session,
+// the session is empty for the statements executed without one.
+func (db *Database) authorizeSession(sessionID string, userName string, q sql.Statement) error {
+	if err := db.checkWritable(q); err != nil {
+		return err
+	}
+
+	// validating the statement requires the privileges of executing it
+	if explain, ok := q.(*Explain); ok && explain.Validate {
+		q = explain.Statement
+	}
+
+	if err := db.checkSessionTables(sessionID, q); err != nil {
+		return err
+	}
+
+	if db.authority != nil {
+		if err := db.checkAuthority(q); err != nil {
+			return err
+		}
+
+		if err := db.authority.authorize(userName, q); err != nil {
+			return err
+		}
+	} else if err := db.authorize(userName, q); err != nil {
+		return err
+	}
+
+	if query, ok := q.(*CreateTrigger); ok {
+		action, err := triggerStatement(query.Table, query.Trigger)
+		if err != nil {
+			return fmt.Errorf("invalid trigger action: %w", err)
+		}
+
+		return db.Authorize(userName, action)
+	}
+
+	return nil
+}
+
+// authorize checks the privileges of the user or the token principal.
+func (db *Database) authorize(userName string, q sql.Statement) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.authenticationRequired() {
+		return nil
+	}
+
+	if strings.HasPrefix(userName, tokenPrincipalPrefix) {
+		return db.authorizeToken(userName, q)
+	}
+
+	u, exists := db.users[strings.ToLower(userName)]
+	if !exists {
+		return ErrAuthentication
+	}
+
+	if u.Superuser {
+		return nil
+	}
+
+	if query, ok := q.(*Kill); ok {
+		return db.authorizeKill(u.Name, query)
+	}
+
+	if readsAuditLog(q) {
+		return fmt.Errorf("%w, only superusers read the audit log", ErrPermissionDenied)
+	}
+
+	switch query := q.(type) {
+	case *CreateUser, *DropUser:
+		return fmt.Errorf("%w, only superusers manage users", ErrPermissionDenied)
+	case *AlterUser:
+		if strings.ToLower(query.Name) != u.Name || query.Superuser != nil {
+			return fmt.Errorf("%w, only superusers manage users", ErrPermissionDenied)
+		}
+	case *Grant, *Revoke:
+		return fmt.Errorf("%w, only superusers manage privileges", ErrPermissionDenied)
+	case *AlterColumnMask:
+		return fmt.Errorf("%w, only superusers mask columns", ErrPermissionDenied)
+	case *CreateToken, *DropToken:
+		return fmt.Errorf("%w, only superusers manage tokens", ErrPermissionDenied)
+	case *Backup:
+		return fmt.Errorf("%w, only superusers back up the database", ErrPermissionDenied)
+	case *CreateDatabase, *DropDatabase:
+		return fmt.Errorf("%w, only superusers manage databases", ErrPermissionDenied)
+	case *SetReadOnly:
+		return fmt.Errorf("%w, only superusers switch the read-only mode", ErrPermissionDenied)
+	case *SetSetting:
+		if query.Scope == ScopeGlobal {
+			return fmt.Errorf("%w, only superusers change the global settings", ErrPermissionDenied)
+		}
+	case *Copy:
+		if query.Path != "" {
+			return fmt.Errorf("%w, only superusers copy the files of the server", ErrPermissionDenied)
+		}
+	}
+
+	privilege, table := requiredPrivilege(q)
+	if privilege != "" && !u.hasPrivilege(privilege, table) {
+		return fmt.Errorf("%w, %s privilege on table %s is required", ErrPermissionDenied, privilege, strings.ToLower(table))
+	}
+
+	return nil
+}
+
+// AuthorizeSuperuser checks whether the user is a superuser or the
+// principal of an admin token, the clients that have not authenticated
+// are superusers until there are users.
+func (db *Database) AuthorizeSuperuser(userName string) error {
+	if db.authority != nil {
+		return db.authority.AuthorizeSuperuser(userName)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.authenticationRequired() {
+		return nil
+	}
+
+	if strings.HasPrefix(userName, tokenPrincipalPrefix) {
+		t, exists := db.tokens[strings.TrimPrefix(userName, tokenPrincipalPrefix)]
+		if !exists || t.expired() {
+			return ErrAuthentication
+		}
+
+		if t.Role != RoleAdmin {
+			return fmt.Errorf("%w, admin token is required", ErrPermissionDenied)
+		}
+
+		return nil
+	}
+
+	u, exists := db.users[strings.ToLower(userName)]
+	if !exists {
+		return ErrAuthentication
+	}
+
+	if !u.Superuser {
+		return fmt.Errorf("%w, superuser is required", ErrPermissionDenied)
+	}
+
+	return nil
+}
+
+// userRows describes the users without the password hashes.
+func (db *Database) userRows() [][]interface{} {
+	names := make([]string, 0, len(db.users))
+	for name := range db.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([][]interface{}, 0, len(names))
+	for _, name := range names {
+		u := db.users[name]
+		superuser := 0
+		if u.Superuser {
+			superuser = 1
+		}
+		rows = append(rows, []interface{}{u.Name, superuser, u.Created.Format(time.RFC3339)})
+	}
+
+	return rows
+}
@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VacuumStats describes the removal of the obsolete row versions.
+type VacuumStats struct {
+	// Runs is the number of completed passes over all the tables.
+	Runs int `json:"runs"`
+	// LastRun is the time the last pass has been completed.
+	LastRun time.Time `json:"last_run"`
+	// Removed is the number of removed row versions since start.
+	Removed int `json:"removed"`
+}
+
+// vacuum removes the row versions that are not visible to any
+// of the active snapshots and will not be visible to the new ones.
+type vacuum struct {
+	db       *Database
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats VacuumStats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newVacuum creates the vacuum and starts it if the interval is positive.
+func newVacuum(db *Database, interval time.Duration) *vacuum {
+	v := &vacuum{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go v.run()
+	} else {
+		close(v.done)
+	}
+
+	return v
+}
+
+func (v *vacuum) run() {
+	defer close(v.done)
+
+	for {
+		select {
+		case <-time.After(v.interval):
+			if !v.vacuum() {
+				return
+			}
+		case <-v.stop:
+			return
+		}
+	}
+}
+
+// vacuum makes a single pass over all the in-memory tables, returns
+// false if the vacuum has been stopped in the middle of the pass.
+func (v *vacuum) vacuum() bool {
+	removed := 0
+	for _, file := range v.db.storageFiles() {
+		select {
+		case <-v.stop:
+			return false
+		default:
+		}
+
+		removed += v.db.vacuumStorage(file.name)
+	}
+
+	v.mu.Lock()
+	v.stats.Runs++
+	v.stats.LastRun = time.Now()
+	v.stats.Removed += removed
+	v.mu.Unlock()
+
+	return true
+}
+
+func (v *vacuum) close() {
+	if v.interval > 0 {
+		close(v.stop)
+	}
+	<-v.done
+}
+
+// Stats returns the results of the obsolete row versions removal.
+func (v *vacuum) Stats() VacuumStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.stats
+}
+
+// VacuumStats returns the results of the obsolete row versions removal.
+func (db *Database) VacuumStats() VacuumStats {
+	return db.vacuum.Stats()
+}
+
+// vacuumStorage removes the obsolete row versions of the table or
+// partition and returns the number of the removed versions.
+func (db *Database) vacuumStorage(name string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	versions, exists := db.data[name]
+	if !exists {
+		return 0
+	}
+
+	horizon := db.horizon()
+	removed := 0
+	vacuumed := make([]*rowVersion, 0, len(versions))
+	for _, v := range versions {
+		v, n := pruneVersions(v, horizon)
+		removed += n
+		if v != nil {
+			vacuumed = append(vacuumed, v)
+		}
+	}
+
+	if removed > 0 {
+		// the readers keep scanning the old versions
+		db.data[name] = vacuumed
+	}
+
+	return removed
+}
+
+// pruneVersions returns the row without the versions that are older
+// than the newest version committed before the horizon, nil if the
+// row has been deleted before the horizon. The versions are not
+// changed, the kept ones are copied.
+func pruneVersions(head *rowVersion, horizon uint64) (*rowVersion, int) {
+	// the newer versions are kept
+	kept := 0
+	v := head
+	for ; v != nil; v = v.older {
+		if csn := atomic.LoadUint64(&v.created.csn); csn != 0 && csn <= horizon {
+			break
+		}
+		kept++
+	}
+
+	if v == nil {
+		return head, 0
+	}
+
+	removed := 0
+	for older := v.older; older != nil; older = older.older {
+		removed++
+	}
+
+	// the version is visible to all the snapshots
+	if v.deleted {
+		removed++
+	} else {
+		kept++
+	}
+
+	if removed == 0 {
+		return head, 0
+	}
+
+	if kept == 0 {
+		return nil, removed
+	}
+
+	copies := make([]rowVersion, kept)
+	for i, v := 0, head; i < kept; i, v = i+1, v.older {
+		copies[i] = *v
+		copies[i].older = nil
+		if i > 0 {
+			copies[i-1].older = &copies[i]
+		}
+	}
+
+	return &copies[0], removed
+}
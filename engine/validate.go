@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The statements are validated without executing them with EXPLAIN
+// VALIDATE or the X-Validate-Only header of the HTTP API, so the queries
+// of the applications can be checked in CI against the current schema.
+// The statement is parsed, the tables, the columns and the types of the
+// values are checked as the execution checks them and SELECT, UPDATE and
+// DELETE are planned. Nothing is locked or changed and the sequences are
+// not advanced. The statements that do not use the tables are only
+// parsed.
+
+// keywords are uppercased in the normalized statements.
+var keywords = map[string]struct{}{}
+
+func init() {
+	for _, keyword := range strings.Fields(`
+		AFTER ALL ALTER ANALYZE AND AS ASC AUDIT BACKUP BEFORE BEGIN BY
+		CHARACTERISTICS COLUMN COMMENT COMMIT COMMITTED COPY COUNT CREATE CSV
+		DATABASE DDL DELETE DELIMITER DESC DROP DRY EACH EXECUTE EXPLAIN FLASHBACK FOR FORMAT
+		FROM FULL GLOBAL GRANT GROUP HASH HEADER IF INCREMENT INSERT INTEGER INTO
+		IS ISOLATION KILL LESS LEVEL LIMIT MASK MAX MAXVALUE MEMORY MIN NOSUPERUSER NULL OF ON
+		ONLY ORDER PARQUET PARTIAL PARTITION PARTITIONS PASSWORD POSITION PRIVILEGES
+		PROCESSLIST QUERY RANGE READ RELEASE RENAME REPEATABLE REVOKE ROLE ROLLBACK
+		ROW RUN SAVEPOINT SCHEMA SEARCH_PATH SELECT SEQUENCE SERIALIZABLE
+		SESSION SET SHOW START STRING SUM SUPERUSER TABLE TEMPORARY THAN TIMESTAMP TO
+		TOKEN TRANSACTION TRIGGER UNMASK UPDATE USE USER VALID VALIDATE
+		VALUES VERSION WHERE WITH WRITE`) {
+		keywords[keyword] = struct{}{}
+	}
+}
+
+// Validation is the result of the validated statement.
+type Validation struct {
+	// Statement is the normalized text of the statement.
+	Statement string
+	// Plan is nil for the statements other than
+	// SELECT, UPDATE and DELETE.
+	Plan *Plan
+}
+
+// String renders the validation as human-readable text.
+func (v *Validation) String() string {
+	text := "valid: " + v.Statement + "\n"
+	if v.Plan != nil {
+		text += v.Plan.String()
+	}
+
+	return text
+}
+
+// normalizeQuery returns the query with the keywords uppercased, the
+// identifiers lowercased and the tokens separated by single spaces.
+func normalizeQuery(query string) (string, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	previous := ""
+	for _, t := range tokens {
+		value := t.value
+		switch t.kind {
+		case tokenEnd:
+			continue
+		case tokenWord:
+			if _, exists := keywords[strings.ToUpper(value)]; exists {
+				value = strings.ToUpper(value)
+			} else {
+				value = strings.ToLower(value)
+			}
+		case tokenSymbol:
+			if value == ";" {
+				continue
+			}
+		}
+
+		if b.Len() > 0 && value != "," && value != ")" && value != "." && previous != "(" && previous != "." {
+			b.WriteByte(' ')
+		}
+		b.WriteString(value)
+		previous = value
+	}
+
+	return b.String(), nil
+}
+
+// ValidateContext validates the statement of EXPLAIN VALIDATE
+// against the current schema without executing it.
+func (db *Database) ValidateContext(ctx context.Context, query *Explain) (*Validation, error) {
+	normalized, err := normalizeQuery(query.Query)
+	if err != nil {
+		return nil, syntaxError(err)
+	}
+	validation := &Validation{Statement: normalized}
+
+	// the sequences must exist, but they are not advanced
+	statement, err := bindSequenceCalls(query.Statement, func(function string, name string) (int, error) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+
+		seq, exists := db.sequences[name]
+		if !exists {
+			return 0, newError(CodeUndefinedObject, "sequence %s does not exist", name)
+		}
+
+		return seq.Start, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch q := statement.(type) {
+	case *sql.Select:
+		validation.Plan, err = db.ExplainContext(ctx, &Explain{Statement: q})
+	case *CountRows:
+		validation.Plan, err = db.ExplainContext(ctx, &Explain{Statement: q.Select})
+	case *OrderedSelect:
+		validation.Plan, err = db.ExplainContext(ctx, &Explain{Statement: q})
+	case *GroupedSelect:
+		validation.Plan, err = db.ExplainContext(ctx, &Explain{Statement: q})
+	case *AsOfSelect:
+		validation.Plan, err = db.ExplainContext(ctx, &Explain{Statement: q.Select})
+	case *sql.Update:
+		validation.Plan, err = db.validateUpdate(ctx, q)
+	case *UpdateIfVersion:
+		validation.Plan, err = db.validateUpdate(ctx, q.Update)
+	case *sql.Delete:
+		validation.Plan, err = db.ExplainContext(ctx, &Explain{Statement: q})
+	case *DeleteIfVersion:
+		validation.Plan, err = db.ExplainContext(ctx, &Explain{Statement: q.Delete})
+	case *sql.Insert:
+		err = db.validateInsert(q)
+	case *sql.CreateTable:
+		err = db.validateNewTable(q.Name)
+	case *CreatePartitionedTable:
+		err = db.validateNewTable(q.Name)
+	case *CreateVersionedTable:
+		err = db.validateNewTable(q.Name)
+	case *CreateMemoryTable:
+		err = db.validateNewTable(q.Name)
+	case *sql.DropTable:
+		_, err = db.Schema(q.Table)
+	case *DropPartition:
+		_, err = db.Schema(q.Table)
+	case *RenameTable:
+		var newName string
+		if _, err = db.Schema(q.Table); err == nil {
+			newName, err = renamedTableName(q.Table, q.NewName)
+		}
+		if err == nil {
+			err = db.validateNewTable(newName)
+		}
+	case *AlterColumnMask:
+		err = db.validateColumn(q.Table, q.Column)
+	case *Comment:
+		if q.Column == "" {
+			_, err = db.Schema(q.Table)
+		} else {
+			err = db.validateColumn(q.Table, q.Column)
+		}
+	case *Analyze:
+		if q.Table != "" {
+			_, err = db.Schema(q.Table)
+		}
+	case *Flashback:
+		_, err = db.Schema(q.Table)
+	case *ShowCreateTable:
+		_, err = db.Schema(q.Table)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return validation, nil
+}
+
+// validateUpdate plans the update and validates its SET part.
+func (db *Database) validateUpdate(ctx context.Context, query *sql.Update) (*Plan, error) {
+	plan, err := db.ExplainContext(ctx, &Explain{Statement: query})
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := db.Schema(query.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := validateSet(schema, query.Columns, query.Values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SET part: %w", err)
+	}
+
+	if schema.Partitioning != nil {
+		if _, exists := set[schema.Partitioning.Column]; exists {
+			return nil, fmt.Errorf("partition column %s can not be updated", schema.Partitioning.Column)
+		}
+	}
+
+	return plan, nil
+}
+
+// validateInsert validates the inserted row as the insert does.
+func (db *Database) validateInsert(query *sql.Insert) error {
+	values, err := insertValues(query)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tableName := strings.ToLower(query.Table)
+	table, exists := db.tables[tableName]
+	if !exists {
+		return newError(CodeUndefinedTable, "table %s does not exist", tableName)
+	}
+
+	_, _, _, err = db.insertStorages(table, query.Columns, [][]interface{}{values}, nil)
+
+	return err
+}
+
+// validateNewTable checks that the table can be created.
+func (db *Database) validateNewTable(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tableName := strings.ToLower(name)
+	if !isValidTableNameFormat(tableName) {
+		return fmt.Errorf("table name %s is not valid, expected format: %s", name, tableNameRegExp)
+	}
+
+	if _, exists := db.tables[tableName]; exists {
+		return newError(CodeDuplicateTable, "table %s exists (table names are case-insensitive)", name)
+	}
+
+	if _, exists := virtualTables[tableName]; exists {
+		return fmt.Errorf("table name %s is reserved", name)
+	}
+
+	return nil
+}
+
+// validateColumn checks that the column of the table exists.
+func (db *Database) validateColumn(table string, column string) error {
+	schema, err := db.Schema(table)
+	if err != nil {
+		return err
+	}
+
+	columnName := strings.ToLower(column)
+	if _, exists := schema.Columns[columnName]; !exists {
+		return newError(CodeUndefinedColumn, "column %s does not exist in table %s", columnName, schema.Name)
+	}
+
+	return nil
+}
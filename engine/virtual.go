@@ -0,0 +1,302 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	sql "github.com/krasun/gosqlparser"
+)
+
+// virtualTable is a read-only table computed from the database state,
+// like information_schema tables in other databases. The tables and
+// the columns are listed only for the users that have the privileges
+// on them.
+type virtualTable struct {
+	schema Schema
+	// rows must be called with the database lock held
+	rows func(db *Database, access tableAccess) [][]interface{}
+}
+
+var virtualTables = map[string]virtualTable{
+	"information_schema_tables": {
+		newVirtualSchema(
+			"information_schema_tables",
+			sql.ColumnDefinition{Name: "table_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "partitions", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "row_count", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "size_bytes", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "storage", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "analyzed", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "modified_rows", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "comment", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			rows := make([][]interface{}, 0, len(db.tables))
+			for _, schema := range sortedTables(db.tables) {
+				if !access("", schema.Name) {
+					continue
+				}
+
+				partitions := 0
+				if schema.Partitioning != nil {
+					partitions = len(schema.Partitioning.Partitions)
+				}
+				analyzed := ""
+				if !schema.Stats.Analyzed.IsZero() {
+					analyzed = schema.Stats.Analyzed.Format(time.RFC3339)
+				}
+
+				rows = append(rows, []interface{}{
+					DisplayName(schema.Name),
+					partitions,
+					schema.Stats.RowCount,
+					int(schema.Stats.SizeBytes),
+					db.storageLocation(schema),
+					analyzed,
+					schema.Stats.ModifiedRows,
+					schema.Comment,
+				})
+			}
+
+			return rows
+		},
+	},
+	"information_schema_columns": {
+		newVirtualSchema(
+			"information_schema_columns",
+			sql.ColumnDefinition{Name: "table_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "column_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "type", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "position", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "min", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "max", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "mask", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "distinct_values", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "comment", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			rows := make([][]interface{}, 0)
+			for _, schema := range sortedTables(db.tables) {
+				if !access("", schema.Name) {
+					continue
+				}
+
+				// the statistics are the data of the table
+				selected := access(PrivilegeSelect, schema.Name)
+				for _, column := range sortedColumns(schema) {
+					columnStats := schema.Stats.Columns[column.Name]
+					minValue, maxValue, mask := statsValue(columnStats.Min), statsValue(columnStats.Max), ""
+					distinct := columnStats.Distinct
+					if !selected {
+						minValue, maxValue, distinct = "", "", 0
+					}
+					// the table is readable by all users
+					if column.Mask != nil {
+						minValue, maxValue, mask, distinct = "", "", column.Mask.String(), 0
+					}
+					rows = append(rows, []interface{}{
+						DisplayName(schema.Name),
+						DisplayName(column.Name),
+						column.Type.Name(),
+						column.Position,
+						minValue,
+						maxValue,
+						mask,
+						distinct,
+						column.Comment,
+					})
+				}
+			}
+
+			return rows
+		},
+	},
+	"information_schema_locks": {
+		newVirtualSchema(
+			"information_schema_locks",
+			sql.ColumnDefinition{Name: "resource", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "mode", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "locker", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "status", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.lockRows()
+		},
+	},
+	processListTable: {
+		newVirtualSchema(
+			processListTable,
+			sql.ColumnDefinition{Name: "query_id", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "user_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "client", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "query", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "started", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "elapsed_ms", Type: sql.TypeInteger},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.processRows()
+		},
+	},
+	"information_schema_users": {
+		newVirtualSchema(
+			"information_schema_users",
+			sql.ColumnDefinition{Name: "user_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "superuser", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "created", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.userRows()
+		},
+	},
+	"information_schema_grants": {
+		newVirtualSchema(
+			"information_schema_grants",
+			sql.ColumnDefinition{Name: "user_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "table_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "privilege", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.grantRows()
+		},
+	},
+	"information_schema_tokens": {
+		newVirtualSchema(
+			"information_schema_tokens",
+			sql.ColumnDefinition{Name: "token_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "role", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "created", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "expires", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.tokenRows()
+		},
+	},
+	"information_schema_schemata": {
+		newVirtualSchema(
+			"information_schema_schemata",
+			sql.ColumnDefinition{Name: "schema_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "tables", Type: sql.TypeInteger},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.schemaRows()
+		},
+	},
+	"information_schema_sequences": {
+		newVirtualSchema(
+			"information_schema_sequences",
+			sql.ColumnDefinition{Name: "sequence_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "start_value", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "increment", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "last_value", Type: sql.TypeInteger},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.sequenceRows()
+		},
+	},
+	"information_schema_settings": {
+		newVirtualSchema(
+			"information_schema_settings",
+			sql.ColumnDefinition{Name: "name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "value", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "default_value", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "scope", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "description", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.settingRows()
+		},
+	},
+	auditTableName: {
+		newVirtualSchema(
+			auditTableName,
+			sql.ColumnDefinition{Name: "time", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "user_name", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "client", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "query", Type: sql.TypeString},
+			sql.ColumnDefinition{Name: "rows", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "success", Type: sql.TypeInteger},
+			sql.ColumnDefinition{Name: "error", Type: sql.TypeString},
+		),
+		func(db *Database, access tableAccess) [][]interface{} {
+			return db.auditRows()
+		},
+	},
+}
+
+func newVirtualSchema(name string, columns ...sql.ColumnDefinition) Schema {
+	schema := Schema{Name: name, Columns: make(map[string]ColumnDef)}
+	for position, column := range columns {
+		schema.Columns[column.Name] = ColumnDef{Name: column.Name, Type: column.Type, Position: position}
+	}
+
+	return schema
+}
+
+// selectVirtual fetches rows of the virtual table for the user
+// of the query started with the context.
+func (db *Database) selectVirtual(ctx context.Context, table virtualTable, query *sql.Select) ([][]interface{}, error) {
+	err := validateWhere(table.schema, query.Where)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WHERE part: %w", err)
+	}
+
+	matched := make([][]interface{}, 0)
+	for _, row := range table.rows(db, db.tableAccess(ctx)) {
+		if matches(table.schema, row, query.Where) {
+			matched = append(matched, row)
+		}
+	}
+
+	return matched, nil
+}
+
+func statsValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
+
+func sortedTables(tables map[string]Schema) []Schema {
+	sorted := make([]Schema, 0, len(tables))
+	for _, schema := range tables {
+		sorted = append(sorted, schema)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	return sorted
+}
+
+func sortedColumns(schema Schema) []ColumnDef {
+	sorted := make([]ColumnDef, 0, len(schema.Columns))
+	for _, column := range schema.Columns {
+		sorted = append(sorted, column)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Position < sorted[j].Position })
+
+	return sorted
+}
+
+// storageLocation describes where the table rows are: in memory,
+// on disk or, for partitioned tables, both.
+func (db *Database) storageLocation(schema Schema) string {
+	mapped := 0
+	names := schema.storageNames()
+	for _, name := range names {
+		if db.mapped[name] {
+			mapped++
+		}
+	}
+
+	switch mapped {
+	case 0:
+		return string(StorageMemory)
+	case len(names):
+		return string(StorageDisk)
+	default:
+		return "mixed"
+	}
+}
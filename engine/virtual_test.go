@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCatalogPrivileges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// execute executes the statement as the user
+	execute := func(userName string, statement string) [][]interface{} {
+		q, err := Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		ctx, finish := db.StartQuery(context.Background(), userName, "test", statement)
+		defer finish()
+		result, err := db.ExecuteContext(ctx, q)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		rows, _ := result.([][]interface{})
+
+		return rows
+	}
+
+	for _, statement := range []string{
+		`CREATE TABLE hidden (id INTEGER)`,
+		`CREATE TABLE listed (id INTEGER)`,
+		`CREATE TABLE selected (id INTEGER)`,
+		`CREATE USER admin PASSWORD "secret" SUPERUSER`,
+	} {
+		execute("", statement)
+	}
+	for _, statement := range []string{
+		`INSERT INTO hidden (id) VALUES (1)`,
+		`INSERT INTO listed (id) VALUES (2)`,
+		`INSERT INTO selected (id) VALUES (3)`,
+		`CREATE USER bob PASSWORD "secret"`,
+		`GRANT INSERT ON listed TO bob`,
+		`GRANT SELECT ON selected TO bob`,
+	} {
+		execute("admin", statement)
+	}
+
+	tables := make([]interface{}, 0)
+	for _, row := range execute("bob", `SELECT table_name FROM information_schema_tables`) {
+		tables = append(tables, row[0])
+	}
+	if expected := []interface{}{"listed", "selected"}; !reflect.DeepEqual(tables, expected) {
+		t.Errorf("expected tables %v, got %v", expected, tables)
+	}
+
+	// the statistics are shown only with SELECT
+	columns := make([][]interface{}, 0)
+	for _, row := range execute("bob", `SELECT table_name FROM information_schema_columns`) {
+		columns = append(columns, []interface{}{row[0], row[4], row[5]})
+	}
+	expected := [][]interface{}{{"listed", "", ""}, {"selected", "3", "3"}}
+	if !reflect.DeepEqual(columns, expected) {
+		t.Errorf("expected columns %v, got %v", expected, columns)
+	}
+
+	if !db.TableVisible("bob", "LISTED") || db.TableVisible("bob", "hidden") || !db.TableVisible("admin", "hidden") {
+		t.Error("expected only the tables with the privileges of bob to be visible to bob")
+	}
+
+	// the embedded callers see all the tables
+	q, err := Parse(`SELECT table_name FROM information_schema_tables`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Execute(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := result.([][]interface{}); len(rows) != 3 {
+		t.Errorf("expected 3 tables, got %v", rows)
+	}
+}
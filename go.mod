@@ -2,4 +2,12 @@ module github.com/krasun/gosqldb
 
 go 1.14
 
-require github.com/krasun/gosqlparser v1.0.5
+require (
+	github.com/klauspost/compress v1.13.6
+	github.com/krasun/gosqlparser v1.0.5
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+	golang.org/x/text v0.3.3
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
+)
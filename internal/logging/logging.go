@@ -0,0 +1,302 @@
+// Package logging writes the leveled log messages with the fields
+// in the text, logfmt or JSON format.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level defines which messages are logged.
+type Level string
+
+const (
+	// Debug logs every executed statement in addition to Info.
+	Debug Level = "debug"
+	// Info logs the database events.
+	Info Level = "info"
+	// Warn logs the slow queries, the deadlocks and other events
+	// that may need attention.
+	Warn Level = "warn"
+	// Error logs only the errors.
+	Error Level = "error"
+)
+
+// severities order the levels.
+var severities = map[Level]int{Debug: 0, Info: 1, Warn: 2, Error: 3}
+
+// Format defines how the messages are written.
+type Format string
+
+const (
+	// Text is the human-readable line: time, level, message and fields.
+	Text Format = "text"
+	// Logfmt is the line of key=value pairs.
+	Logfmt Format = "logfmt"
+	// JSON is the JSON object per line.
+	JSON Format = "json"
+)
+
+// the settings of the process, they are set once on start
+var (
+	lineFormat           = Text
+	output     io.Writer = os.Stderr
+)
+
+// level is the Level of the process, unlike the other settings
+// it can be changed while the messages are logged.
+var level atomic.Value
+
+func init() {
+	level.Store(Info)
+}
+
+// mu serializes the writes of the messages.
+var mu sync.Mutex
+
+// ParseLevel parses the log level name.
+func ParseLevel(name string) (Level, error) {
+	l := Level(name)
+	if _, exists := severities[l]; !exists {
+		return "", fmt.Errorf("unknown log level %s, expected one of: %s, %s, %s, %s", name, Debug, Info, Warn, Error)
+	}
+
+	return l, nil
+}
+
+// ParseFormat parses the log format name.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(name); f {
+	case Text, Logfmt, JSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown log format %s, expected one of: %s, %s, %s", name, Text, Logfmt, JSON)
+	}
+}
+
+// SetLevel sets the level of the process, it can
+// be called while the messages are logged.
+func SetLevel(l Level) {
+	level.Store(l)
+}
+
+// SetFormat sets the format of the messages, it must
+// be called before the messages are logged.
+func SetFormat(f Format) {
+	lineFormat = f
+}
+
+// SetOutput sets where the messages are written, it must
+// be called before the messages are logged.
+func SetOutput(w io.Writer) {
+	output = w
+}
+
+// CurrentLevel returns the level of the process.
+func CurrentLevel() Level {
+	return level.Load().(Level)
+}
+
+// CurrentFormat returns the format of the messages.
+func CurrentFormat() Format {
+	return lineFormat
+}
+
+// Enabled reports whether the messages of the level are logged.
+func Enabled(l Level) bool {
+	return severities[l] >= severities[CurrentLevel()]
+}
+
+// Logger writes the messages with its fields.
+type Logger struct {
+	// fields are the key and value pairs
+	fields []interface{}
+}
+
+// root is the logger without fields.
+var root = &Logger{}
+
+// With returns the logger that adds the key and value pairs
+// to the fields of the messages.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+
+	return &Logger{fields}
+}
+
+// Log writes the message with the logger fields and
+// the key and value pairs if the level is enabled.
+func (l *Logger) Log(lvl Level, message string, keyvals ...interface{}) {
+	if !Enabled(lvl) {
+		return
+	}
+
+	fields := append(append([]interface{}(nil), l.fields...), keyvals...)
+	line := formatLine(time.Now(), lvl, strings.TrimRight(message, "\n"), fields)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// there is nowhere to report the failed write
+	_, _ = io.WriteString(output, line)
+}
+
+// Debugf logs the message only with the debug log level.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if Enabled(Debug) {
+		l.Log(Debug, fmt.Sprintf(format, v...))
+	}
+}
+
+// Infof logs the message with the info level.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.Log(Info, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs the message with the warn level.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.Log(Warn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs the message with the error level.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.Log(Error, fmt.Sprintf(format, v...))
+}
+
+// With returns the logger with the key and value pairs.
+func With(keyvals ...interface{}) *Logger {
+	return root.With(keyvals...)
+}
+
+// Log writes the message without the logger fields.
+func Log(lvl Level, message string, keyvals ...interface{}) {
+	root.Log(lvl, message, keyvals...)
+}
+
+// Debugf logs the message only with the debug log level.
+func Debugf(format string, v ...interface{}) {
+	root.Debugf(format, v...)
+}
+
+// Infof logs the message with the info level.
+func Infof(format string, v ...interface{}) {
+	root.Infof(format, v...)
+}
+
+// Warnf logs the message with the warn level.
+func Warnf(format string, v ...interface{}) {
+	root.Warnf(format, v...)
+}
+
+// Errorf logs the message with the error level.
+func Errorf(format string, v ...interface{}) {
+	root.Errorf(format, v...)
+}
+
+// Fatalf logs the message with the error level and exits.
+func Fatalf(format string, v ...interface{}) {
+	root.Errorf(format, v...)
+	os.Exit(1)
+}
+
+// contextKey is the context key of the logger.
+type contextKey struct{}
+
+// NewContext returns the context with the logger.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger of the context,
+// the logger without fields if there is none.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+
+	return root
+}
+
+// formatLine formats the message in the format of the process.
+func formatLine(t time.Time, lvl Level, message string, fields []interface{}) string {
+	var b bytes.Buffer
+	switch lineFormat {
+	case JSON:
+		b.WriteString(`{"time":`)
+		writeJSON(&b, t.UTC().Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, string(lvl))
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, message)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeJSON(&b, fmt.Sprint(fields[i]))
+			b.WriteByte(':')
+			writeJSON(&b, fieldValue(fields, i+1))
+		}
+		b.WriteByte('}')
+	case Logfmt:
+		fmt.Fprintf(&b, "time=%s level=%s msg=%s", t.UTC().Format(time.RFC3339Nano), lvl, logfmtValue(message))
+		writeLogfmt(&b, fields)
+	default:
+		fmt.Fprintf(&b, "%s %s %s", t.Format("2006/01/02 15:04:05"), strings.ToUpper(string(lvl)), message)
+		writeLogfmt(&b, fields)
+	}
+	b.WriteByte('\n')
+
+	return b.String()
+}
+
+// fieldValue returns the value of the field, the errors and other
+// values that are not numbers or booleans are written as strings.
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i >= len(fields) {
+		return "(missing)"
+	}
+
+	switch v := fields[i].(type) {
+	case int, int64, uint64, float64, bool, nil:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeJSON writes the value without escaping the HTML
+// characters, the plans and the queries are easier to read.
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		encoded.Reset()
+		_ = encoder.Encode(fmt.Sprint(v))
+	}
+	b.Write(bytes.TrimRight(encoded.Bytes(), "\n"))
+}
+
+func writeLogfmt(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(b, " %s=%s", fields[i], logfmtValue(fmt.Sprint(fieldValue(fields, i+1))))
+	}
+}
+
+// logfmtValue quotes the value if it has spaces, quotes
+// or the equal sign.
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
@@ -0,0 +1,343 @@
+// Package tracing records the spans of the requests and exports
+// them to the OpenTelemetry collector over OTLP/HTTP in JSON.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// TraceparentHeader is the W3C Trace Context header
+// of the trace the request is a part of.
+const TraceparentHeader = "traceparent"
+
+// serviceName is the service.name of the exported spans.
+const serviceName = "gosqldb"
+
+const (
+	// batchSize is the number of the spans exported at once.
+	batchSize = 512
+	// queueSize is the number of the spans waiting for the export,
+	// the others are dropped.
+	queueSize = 2048
+	// exportInterval is the pause between the exports.
+	exportInterval = 5 * time.Second
+	// exportTimeout limits the export requests.
+	exportTimeout = 10 * time.Second
+)
+
+// the OTLP span kinds and status codes
+const (
+	kindInternal    = 1
+	kindServer      = 2
+	statusCodeError = 2
+)
+
+// the exporter of the process, it is set once on start
+var (
+	endpoint string
+	queue    chan *Span
+	flushed  chan struct{}
+	once     sync.Once
+)
+
+// SetEndpoint starts the export of the spans to the OTLP/HTTP traces
+// endpoint, like http://localhost:4318/v1/traces. It must be called
+// before the requests are served, the spans are not recorded without it.
+func SetEndpoint(url string) {
+	endpoint = url
+	queue = make(chan *Span, queueSize)
+	flushed = make(chan struct{})
+
+	go export(queue, flushed)
+}
+
+// Endpoint returns the endpoint the spans are exported
+// to, empty if the spans are not recorded.
+func Endpoint() string {
+	return endpoint
+}
+
+// Flush exports the recorded spans, it must be called once
+// when the requests are not served any more.
+func Flush(ctx context.Context) error {
+	if queue == nil {
+		return nil
+	}
+
+	once.Do(func() { close(queue) })
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to export spans: %w", ctx.Err())
+	}
+}
+
+// spanContext identifies the span within its trace.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// contextKey is the context key of the current span.
+type contextKey struct{}
+
+// Span is the timed operation of the request, the methods
+// of the nil span do nothing, so the callers do not check
+// whether the span is recorded.
+type Span struct {
+	spanContext
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes []interface{}
+	err        string
+}
+
+// StartRequest starts the span of the request received by the server,
+// it continues the trace of the traceparent header if it is valid.
+func StartRequest(ctx context.Context, name string, traceparent string, keyvals ...interface{}) (context.Context, *Span) {
+	if queue == nil {
+		return ctx, nil
+	}
+
+	parent, ok := parseTraceparent(traceparent)
+	if !ok {
+		parent = spanContext{traceID: randomTraceID(), sampled: true}
+	}
+
+	return start(ctx, parent, name, kindServer, keyvals)
+}
+
+// Start starts the child span of the span of the context, the span
+// is not recorded outside of the recorded requests.
+func Start(ctx context.Context, name string, keyvals ...interface{}) (context.Context, *Span) {
+	parent, ok := ctx.Value(contextKey{}).(spanContext)
+	if !ok || queue == nil {
+		return ctx, nil
+	}
+
+	return start(ctx, parent, name, kindInternal, keyvals)
+}
+
+// start starts the span of the parent.
+func start(ctx context.Context, parent spanContext, name string, kind int, keyvals []interface{}) (context.Context, *Span) {
+	if !parent.sampled {
+		return ctx, nil
+	}
+
+	s := &Span{
+		spanContext: spanContext{traceID: parent.traceID, spanID: randomSpanID(), sampled: true},
+		parentID:    parent.spanID,
+		name:        name,
+		kind:        kind,
+		start:       time.Now(),
+		attributes:  keyvals,
+	}
+
+	return context.WithValue(ctx, contextKey{}, s.spanContext), s
+}
+
+// SetAttributes adds the key and value pairs to the attributes.
+func (s *Span) SetAttributes(keyvals ...interface{}) {
+	if s != nil {
+		s.attributes = append(s.attributes, keyvals...)
+	}
+}
+
+// Fail marks the span as failed by the error.
+func (s *Span) Fail(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// End ends the span and queues it for the export,
+// the span is dropped if the queue is full.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+
+	defer func() {
+		// the queue is closed by Flush
+		_ = recover()
+	}()
+
+	select {
+	case queue <- s:
+	default:
+	}
+}
+
+// parseTraceparent parses the version 00 of the header:
+// 00-<trace id>-<parent id>-<flags>.
+func parseTraceparent(header string) (spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext{}, false
+	}
+
+	var parent spanContext
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil || parent.traceID == [16]byte{} {
+		return spanContext{}, false
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil || parent.spanID == [8]byte{} {
+		return spanContext{}, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return spanContext{}, false
+	}
+	parent.sampled = flags&1 == 1
+
+	return parent, true
+}
+
+// randomTraceID returns the new trace identifier.
+func randomTraceID() (id [16]byte) {
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+// randomSpanID returns the new span identifier.
+func randomSpanID() (id [8]byte) {
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+// export sends the queued spans in batches
+// until the queue is closed.
+func export(queue chan *Span, flushed chan struct{}) {
+	defer close(flushed)
+
+	client := &http.Client{Timeout: exportTimeout}
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := post(client, batch); err != nil {
+			logging.Warnf("failed to export %d spans: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s, ok := <-queue:
+			if !ok {
+				send()
+				return
+			}
+
+			batch = append(batch, s)
+			if len(batch) == batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+// post sends the spans to the endpoint.
+func post(client *http.Client, spans []*Span) error {
+	body, err := json.Marshal(exportRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// exportRequest returns the OTLP request of the spans in the JSON
+// encoding, the identifiers are hex strings and the times are the
+// strings of the nanoseconds.
+func exportRequest(spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			span["status"] = map[string]interface{}{"code": statusCodeError, "message": s.err}
+		}
+		encoded[i] = span
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attributes([]interface{}{"service.name", serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": serviceName},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+// attributes returns the OTLP attributes of the key and value pairs.
+func attributes(keyvals []interface{}) []interface{} {
+	encoded := make([]interface{}, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		var value map[string]interface{}
+		switch v := keyvals[i+1].(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": fmt.Sprint(keyvals[i]), "value": value})
+	}
+
+	return encoded
+}
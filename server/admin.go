@@ -0,0 +1,487 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	"github.com/krasun/gosqldb/internal/tracing"
+)
+
+// The admin endpoints describe the running server for the operators:
+// the effective configuration, the tables with their sizes, the open
+// sessions and the runtime state. They are available only to the
+// superusers.
+
+// adminConfig is the effective configuration, the names
+// match the command-line flags.
+type adminConfig struct {
+	Fsync               engine.FsyncPolicy            `json:"fsync"`
+	FsyncInterval       string                        `json:"fsync_interval"`
+	MmapThreshold       int64                         `json:"mmap_threshold"`
+	SegmentRows         int                           `json:"segment_rows"`
+	StorageModes        map[string]engine.StorageMode `json:"storage_mode,omitempty"`
+	MaxRowSize          int                           `json:"max_row_size"`
+	MaxValueSize        int                           `json:"max_value_size"`
+	MaxTableRows        int                           `json:"max_table_rows"`
+	MaxDatabaseSize     int64                         `json:"max_database_size"`
+	ScrubInterval       string                        `json:"scrub_interval"`
+	VacuumInterval      string                        `json:"vacuum_interval"`
+	HistoryRetention    string                        `json:"history_retention"`
+	ChangefeedRetention string                        `json:"changefeed_retention"`
+	AuditLog            bool                          `json:"audit_log"`
+	AuditMaxSize        int64                         `json:"audit_max_size"`
+	AuditMaxFiles       int                           `json:"audit_max_files"`
+	DictionaryMaxSize   int                           `json:"dictionary_max_size"`
+	Collation           string                        `json:"collation"`
+	StatementCacheSize  int                           `json:"statement_cache_size"`
+	ResultCacheSize     int64                         `json:"result_cache_size"`
+	ResultCacheTTL      string                        `json:"result_cache_ttl"`
+	WorkMem             int64                         `json:"work_mem"`
+	TempDir             string                        `json:"temp_dir"`
+	MemoryLimit         int64                         `json:"memory_limit"`
+	MinFreeDisk         int64                         `json:"min_free_disk"`
+	ScanWorkers         int                           `json:"scan_workers"`
+	GroupCommitSize     int                           `json:"group_commit_size"`
+	GroupCommitWindow   string                        `json:"group_commit_window"`
+	ReadOnly            bool                          `json:"read_only"`
+	ArchiveDir          string                        `json:"archive_dir"`
+	LockTimeout         string                        `json:"lock_timeout"`
+	StatementTimeout    string                        `json:"statement_timeout"`
+	SlowQueryThreshold  string                        `json:"slow_query_threshold"`
+	Isolation           engine.IsolationLevel         `json:"isolation_level"`
+	TransactionTimeout  string                        `json:"transaction_timeout"`
+	SessionTimeout      string                        `json:"session_timeout"`
+	IdempotencyWindow   string                        `json:"idempotency_window"`
+	RateLimit           float64                       `json:"rate_limit"`
+	RateBurst           int                           `json:"rate_burst"`
+	MaxConcurrent       int                           `json:"max_concurrent_queries"`
+	MaxQueued           int                           `json:"max_queued_queries"`
+	QueueTimeout        string                        `json:"queue_timeout"`
+	LogLevel            logging.Level                 `json:"log_level"`
+	LogFormat           logging.Format                `json:"log_format"`
+	OTLPEndpoint        string                        `json:"otlp_endpoint"`
+	Authentication      bool                          `json:"authentication"`
+	Encryption          bool                          `json:"encryption"`
+	MigrationsDir       string                        `json:"migrations_dir"`
+}
+
+func newAdminConfig(db *engine.Database, admission *Admission) adminConfig {
+	options := db.Options()
+	config := adminConfig{
+		Fsync:               options.Fsync,
+		FsyncInterval:       options.FsyncInterval.String(),
+		MmapThreshold:       options.MmapThreshold,
+		SegmentRows:         options.SegmentRows,
+		StorageModes:        options.StorageModes,
+		MaxRowSize:          options.MaxRowSize,
+		MaxValueSize:        options.MaxValueSize,
+		MaxTableRows:        options.MaxTableRows,
+		MaxDatabaseSize:     options.MaxDatabaseSize,
+		ScrubInterval:       options.ScrubInterval.String(),
+		VacuumInterval:      options.VacuumInterval.String(),
+		HistoryRetention:    options.HistoryRetention.String(),
+		ChangefeedRetention: options.ChangefeedRetention.String(),
+		AuditLog:            options.AuditLog,
+		AuditMaxSize:        options.AuditMaxSize,
+		AuditMaxFiles:       options.AuditMaxFiles,
+		DictionaryMaxSize:   options.DictionaryMaxSize,
+		Collation:           options.Collation,
+		StatementCacheSize:  options.StatementCacheSize,
+		ResultCacheSize:     options.ResultCacheSize,
+		ResultCacheTTL:      options.ResultCacheTTL.String(),
+		WorkMem:             options.WorkMem,
+		TempDir:             options.TempDir,
+		MemoryLimit:         options.MemoryLimit,
+		MinFreeDisk:         options.MinFreeDisk,
+		ScanWorkers:         options.ScanWorkers,
+		GroupCommitSize:     options.GroupCommitSize,
+		GroupCommitWindow:   options.GroupCommitWindow.String(),
+		ReadOnly:            db.ReadOnly(),
+		ArchiveDir:          options.ArchiveDir,
+		LockTimeout:         options.LockTimeout.String(),
+		StatementTimeout:    options.StatementTimeout.String(),
+		SlowQueryThreshold:  options.SlowQueryThreshold.String(),
+		Isolation:           options.Isolation,
+		TransactionTimeout:  options.TransactionTimeout.String(),
+		SessionTimeout:      options.SessionTimeout.String(),
+		IdempotencyWindow:   options.IdempotencyWindow.String(),
+		QueueTimeout:        time.Duration(0).String(),
+		LogLevel:            logging.CurrentLevel(),
+		LogFormat:           logging.CurrentFormat(),
+		OTLPEndpoint:        tracing.Endpoint(),
+		Authentication:      db.AuthenticationRequired(),
+		Encryption:          options.Encryption != nil,
+		MigrationsDir:       options.MigrationsDir,
+	}
+
+	if admission != nil {
+		config.RateLimit = admission.options.Rate
+		config.RateBurst = admission.options.Burst
+		config.MaxConcurrent = admission.options.MaxConcurrent
+		config.MaxQueued = admission.options.MaxQueued
+		config.QueueTimeout = admission.options.QueueTimeout.String()
+	}
+
+	return config
+}
+
+// adminRuntime is the runtime state of the server.
+type adminRuntime struct {
+	engine.RuntimeStats
+	Uptime string `json:"uptime"`
+}
+
+func newAdminRuntime(db *engine.Database) (*adminRuntime, error) {
+	stats, err := db.RuntimeStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect runtime stats: %w", err)
+	}
+
+	return &adminRuntime{stats, time.Since(stats.Started).Round(time.Second).String()}, nil
+}
+
+// adminHandler writes the response of the describe function
+// to the superusers.
+func adminHandler(db *engine.Database, describe func() (interface{}, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		response, err := describe()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, response)
+	}
+}
+
+// adminConfigHandler describes the effective configuration.
+func adminConfigHandler(db *engine.Database, admission *Admission) func(w http.ResponseWriter, r *http.Request) {
+	return adminHandler(db, func() (interface{}, error) {
+		return newAdminConfig(db, admission), nil
+	})
+}
+
+// adminTablesHandler describes the tables with their sizes.
+func adminTablesHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return adminHandler(db, func() (interface{}, error) {
+		return db.TableInfos(), nil
+	})
+}
+
+// adminRuntimeHandler describes the runtime state.
+func adminRuntimeHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return adminHandler(db, func() (interface{}, error) {
+		return newAdminRuntime(db)
+	})
+}
+
+// adminSessionsHandler describes the open sessions.
+func adminSessionsHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return adminHandler(db, func() (interface{}, error) {
+		return db.SessionInfos(), nil
+	})
+}
+
+// backupRequest is the body of the backup request.
+type backupRequest struct {
+	// Path is the new or empty directory on the server.
+	Path string `json:"path"`
+}
+
+// backupHandler backs up the database into the directory
+// and returns the backup manifest.
+func backupHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		var request backupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, fmt.Sprintf("failed to decode request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if request.Path == "" {
+			writeError(w, "path is required", http.StatusBadRequest)
+			return
+		}
+
+		manifest, err := db.Backup(&engine.Backup{Path: request.Path})
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		logging.FromContext(r.Context()).Infof("database has been backed up to %s", request.Path)
+
+		writeJSON(w, manifest)
+	}
+}
+
+// encryptionHandler describes the encryption at rest on GET and
+// starts the key rotation on POST, the files are re-encrypted with
+// the current key of the provider in the background.
+func encryptionHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := db.RotateEncryptionKey(); err != nil {
+				writeError(w, err.Error(), http.StatusConflict)
+				return
+			}
+		default:
+			writeError(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, db.EncryptionStatus())
+	}
+}
+
+// snapshotResponse describes the opened read snapshot.
+type snapshotResponse struct {
+	// TransactionID is sent in the transaction header of the queries
+	// and of the dump requests that read the snapshot.
+	TransactionID string `json:"transaction_id"`
+	// CommitSequence is the sequence number of the last commit
+	// visible in the snapshot.
+	CommitSequence uint64 `json:"commit_sequence"`
+}
+
+// snapshotHandler opens the consistent read snapshot of the database
+// for the tools that can not open the files locked by the server,
+// the snapshot is the read-only transaction closed with DELETE.
+func snapshotHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			tx, err := db.BeginReadOnly()
+			if err != nil {
+				writeQueryError(w, err)
+				return
+			}
+			tx.User = requestUser(r)
+
+			writeJSON(w, snapshotResponse{tx.ID, tx.SnapshotSequence()})
+		case http.MethodDelete:
+			tx, err := db.Transaction(r.Header.Get(transactionHeader))
+			if err != nil {
+				writeError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			if err := tx.Rollback(); err != nil {
+				writeQueryError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, "only POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// dumpHandler writes the dump of the tables given by the table
+// parameters, all the tables if there are none. The dump reads the
+// snapshot of the transaction header if it is sent.
+func dumpHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		tables := r.URL.Query()["table"]
+		for _, table := range tables {
+			if _, err := db.Schema(table); err != nil {
+				writeError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		}
+
+		var tx *engine.Transaction
+		if id := r.Header.Get(transactionHeader); id != "" {
+			var err error
+			if tx, err = db.Transaction(id); err != nil {
+				writeError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		dump := func() error { return db.Dump(r.Context(), w, tables) }
+		if tx != nil {
+			dump = func() error { return db.DumpTransaction(r.Context(), tx, w, tables) }
+		}
+		if err := dump(); err != nil {
+			// the status has been sent with the first written row
+			logging.FromContext(r.Context()).Errorf("failed to dump database: %s", err)
+		}
+	}
+}
+
+// importHandler executes the dump sent in the body.
+func importHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		result, err := db.Import(r.Context(), r.Body)
+		if err != nil {
+			if redirectToLeader(w, r, err) {
+				return
+			}
+			writeQueryError(w, fmt.Errorf("failed after %d statements: %w", result.Statements, err))
+			return
+		}
+		logging.FromContext(r.Context()).Infof("imported %d statements, %d rows", result.Statements, result.Rows)
+
+		writeJSON(w, result)
+	}
+}
+
+// schemaHandler exports the structure of the database on GET, as the
+// JSON document or as the SQL bundle with ?format=sql, and imports the
+// one sent in the body into the empty database on POST.
+func schemaHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			export := db.ExportSchema()
+			switch format := r.URL.Query().Get("format"); format {
+			case "", "json":
+				writeJSON(w, export)
+			case "sql":
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				if _, err := io.WriteString(w, export.SQL()); err != nil {
+					logging.FromContext(r.Context()).Errorf("failed to write schema: %s", err)
+				}
+			default:
+				writeError(w, fmt.Sprintf("unknown format %s, expected json or sql", format), http.StatusBadRequest)
+			}
+		case http.MethodPost:
+			var export *engine.SchemaExport
+			var err error
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+				if err = json.NewDecoder(r.Body).Decode(&export); err == nil && export == nil {
+					err = fmt.Errorf("schema is empty")
+				}
+			} else {
+				export, err = engine.ParseSchemaBundle(r.Body)
+			}
+			if err != nil {
+				writeError(w, fmt.Sprintf("failed to decode schema: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			result, err := db.ImportSchema(r.Context(), export)
+			if err != nil {
+				if redirectToLeader(w, r, err) {
+					return
+				}
+				writeQueryError(w, err)
+				return
+			}
+			logging.FromContext(r.Context()).Infof("imported schema of %d statements", result.Statements)
+
+			writeJSON(w, result)
+		default:
+			writeError(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// migrationsHandler lists the schema migrations of the migrations
+// directory with their state and applies the pending ones on POST.
+func migrationsHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		dir := db.Options().MigrationsDir
+		if dir == "" {
+			writeError(w, "migrations directory is not configured", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			applied, err := db.Migrate(r.Context(), dir)
+			for _, m := range applied {
+				logging.FromContext(r.Context()).Infof("applied migration %d_%s", m.Version, m.Name)
+			}
+			if err != nil {
+				if redirectToLeader(w, r, err) {
+					return
+				}
+				writeQueryError(w, fmt.Errorf("failed after %d migrations: %w", len(applied), err))
+				return
+			}
+		default:
+			writeError(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		migrations, err := db.Migrations(r.Context(), dir)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, migrations)
+	}
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// The admission control protects the server from the clients that
+// flood it with queries: every client has its own rate limit, and the
+// number of the queries executed at once is limited for all the
+// clients together, the queries over the limit wait in the queue.
+// The clients are the authenticated users or tokens, the anonymous
+// clients are told apart by the IP address.
+
+// AdmissionOptions configures the admission control,
+// the zero options admit all the queries.
+type AdmissionOptions struct {
+	// Rate is the number of queries per second a client can
+	// execute, 0 means no limit.
+	Rate float64
+	// Burst is the number of queries a client can execute at once
+	// over the rate, 0 means the rate rounded up.
+	Burst int
+	// MaxConcurrent is the number of queries executed at once,
+	// 0 means no limit.
+	MaxConcurrent int
+	// MaxQueued is the number of queries waiting for the execution
+	// when MaxConcurrent queries are executed, the rest are rejected.
+	MaxQueued int
+	// QueueTimeout is how long a query waits in the queue,
+	// 0 means until the client gives up.
+	QueueTimeout time.Duration
+}
+
+// AdmissionStats counts the admitted and the rejected queries.
+type AdmissionStats struct {
+	Admitted            uint64 `json:"admitted"`
+	RejectedRate        uint64 `json:"rejected_rate"`
+	RejectedConcurrency uint64 `json:"rejected_concurrency"`
+	Executing           int    `json:"executing"`
+	Queued              int    `json:"queued"`
+}
+
+// AdmissionError is returned when the query is not admitted.
+type AdmissionError struct {
+	Message string
+	// RetryAfter is when the client is admitted again,
+	// zero if unknown.
+	RetryAfter time.Duration
+}
+
+func (e *AdmissionError) Error() string {
+	return "too many requests, " + e.Message
+}
+
+// Admission admits the queries by the options, nil admits all.
+type Admission struct {
+	// the counters are accessed atomically, they go first
+	// to be aligned on 32-bit platforms
+	admitted            uint64
+	rejectedRate        uint64
+	rejectedConcurrency uint64
+	queued              int64
+
+	options AdmissionOptions
+	burst   float64
+	// slots has a value per executed query, nil without the limit
+	slots chan struct{}
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+// rateBucket is the token bucket of a client.
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateSweepInterval is the pause between the removals of the
+// buckets of the clients that have not been seen for a while.
+const rateSweepInterval = time.Minute
+
+// NewAdmission returns the admission control with the options.
+func NewAdmission(options AdmissionOptions) *Admission {
+	a := &Admission{options: options, buckets: make(map[string]*rateBucket), swept: time.Now()}
+
+	a.burst = float64(options.Burst)
+	if a.burst == 0 {
+		a.burst = math.Max(1, math.Ceil(options.Rate))
+	}
+
+	if options.MaxConcurrent > 0 {
+		a.slots = make(chan struct{}, options.MaxConcurrent)
+	}
+
+	return a
+}
+
+// admit waits until the query of the client can be executed, the
+// returned function must be called when the query is executed.
+func (a *Admission) admit(ctx context.Context, client string) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	if wait, ok := a.allow(client, time.Now()); !ok {
+		atomic.AddUint64(&a.rejectedRate, 1)
+		return nil, &AdmissionError{fmt.Sprintf("rate limit of %g queries per second exceeded", a.options.Rate), wait}
+	}
+
+	if err := a.acquire(ctx); err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&a.admitted, 1)
+
+	if a.slots == nil {
+		return func() {}, nil
+	}
+
+	var once sync.Once
+
+	return func() { once.Do(func() { <-a.slots }) }, nil
+}
+
+// allow takes a token from the bucket of the client, it returns
+// false and the time until the next token if there are none.
+func (a *Admission) allow(client string, now time.Time) (time.Duration, bool) {
+	if a.options.Rate <= 0 {
+		return 0, true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.swept) > rateSweepInterval {
+		for name, b := range a.buckets {
+			if a.refill(b, now) >= a.burst {
+				delete(a.buckets, name)
+			}
+		}
+		a.swept = now
+	}
+
+	b, exists := a.buckets[client]
+	if !exists {
+		b = &rateBucket{tokens: a.burst, updated: now}
+		a.buckets[client] = b
+	}
+
+	if a.refill(b, now) < 1 {
+		return time.Duration((1 - b.tokens) / a.options.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+
+	return 0, true
+}
+
+// refill adds the tokens accumulated since the last update.
+func (a *Admission) refill(b *rateBucket, now time.Time) float64 {
+	b.tokens = math.Min(a.burst, b.tokens+now.Sub(b.updated).Seconds()*a.options.Rate)
+	b.updated = now
+
+	return b.tokens
+}
+
+// acquire takes an execution slot, waiting in the queue
+// if there are no free slots.
+func (a *Admission) acquire(ctx context.Context) error {
+	if a.slots == nil {
+		return nil
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	defer atomic.AddInt64(&a.queued, -1)
+	if atomic.AddInt64(&a.queued, 1) > int64(a.options.MaxQueued) {
+		atomic.AddUint64(&a.rejectedConcurrency, 1)
+		return &AdmissionError{Message: fmt.Sprintf("%d queries are executed and the queue is full", a.options.MaxConcurrent)}
+	}
+
+	var timeout <-chan time.Time
+	if a.options.QueueTimeout > 0 {
+		timer := time.NewTimer(a.options.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		atomic.AddUint64(&a.rejectedConcurrency, 1)
+		return &AdmissionError{Message: fmt.Sprintf("%d queries are executed, waited in the queue for %s", a.options.MaxConcurrent, a.options.QueueTimeout)}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the admission counters.
+func (a *Admission) Stats() AdmissionStats {
+	return AdmissionStats{
+		Admitted:            atomic.LoadUint64(&a.admitted),
+		RejectedRate:        atomic.LoadUint64(&a.rejectedRate),
+		RejectedConcurrency: atomic.LoadUint64(&a.rejectedConcurrency),
+		Executing:           len(a.slots),
+		Queued:              int(atomic.LoadInt64(&a.queued)),
+	}
+}
+
+// admissionClient identifies the client by the authenticated
+// user name or by the IP address.
+func admissionClient(userName string, addr string) string {
+	if userName != "" {
+		return userName
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// admitted admits the requests except the version and the status
+// ones, so the server can be monitored when saturated, and the change
+// streams and the query channels that would hold the execution slots
+// while they are open, the query channels admit their queries instead.
+func admitted(admission *Admission, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" || r.URL.Path == "/status" || r.URL.Path == "/healthz" || r.URL.Path == "/changes" || r.URL.Path == "/ws" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		release, err := admission.admit(r.Context(), admissionClient(requestUser(r), r.RemoteAddr))
+		if err != nil {
+			if admissionErr, ok := err.(*AdmissionError); ok && admissionErr.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(admissionErr.RetryAfter.Seconds()))))
+			}
+			writeError(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// grpcAdmissionInterceptors admit the unary and the streaming calls.
+func grpcAdmissionInterceptors(admission *Admission) []grpc.ServerOption {
+	admit := func(ctx context.Context) (func(), error) {
+		addr := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr.String()
+		}
+
+		release, err := admission.admit(ctx, admissionClient(contextUser(ctx), addr))
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		return release, nil
+	}
+
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, err := admit(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		return handler(ctx, req)
+	}
+
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, err := admit(ss.Context())
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		return handler(srv, ss)
+	}
+
+	return []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream)}
+}
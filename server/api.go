@@ -0,0 +1,597 @@
+// Package server serves the database over the HTTP API, the REST API,
+// the PostgreSQL wire protocol and gRPC.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	"github.com/krasun/gosqldb/internal/tracing"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// Handler returns the handler of the HTTP and the REST API,
+// the requests are admitted by the admission control and the
+// bodies are compressed as negotiated with the clients.
+func Handler(db *engine.Database, admission *Admission) http.Handler {
+	return identified(compressed(authenticated(db, admitted(admission, databaseRouter(db, admission)))))
+}
+
+// databaseHandler returns the handler of the HTTP and
+// the REST API of the database.
+func databaseHandler(db *engine.Database, admission *Admission) http.Handler {
+	idempotency := newIdempotencyStore()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", versioned(traced(handler(db, idempotency))))
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/status", statusHandler(db, admission))
+	mux.HandleFunc("/healthz", healthHandler(db))
+	mux.HandleFunc("/admin/purge", purgeHandler(db))
+	mux.HandleFunc("/admin/config", adminConfigHandler(db, admission))
+	mux.HandleFunc("/admin/tables", adminTablesHandler(db))
+	mux.HandleFunc("/admin/runtime", adminRuntimeHandler(db))
+	mux.HandleFunc("/admin/sessions", adminSessionsHandler(db))
+	mux.HandleFunc("/admin/backup", backupHandler(db))
+	mux.HandleFunc("/admin/dump", dumpHandler(db))
+	mux.HandleFunc("/admin/snapshot", snapshotHandler(db))
+	mux.HandleFunc("/admin/encryption", encryptionHandler(db))
+	mux.HandleFunc("/admin/import", importHandler(db))
+	mux.HandleFunc("/admin/schema", schemaHandler(db))
+	mux.HandleFunc("/admin/migrations", migrationsHandler(db))
+	mux.HandleFunc("/export", exportHandler(db))
+	mux.HandleFunc("/session", sessionHandler(db))
+	mux.HandleFunc("/prepare", prepareHandler(db))
+	mux.HandleFunc("/execute", versioned(traced(executeHandler(db, idempotency))))
+	mux.HandleFunc("/changes", changesHandler(db))
+	mux.HandleFunc("/ws", channelHandler(db, admission))
+	mux.HandleFunc("/ui", uiHandler)
+	mux.HandleFunc("/ui/", uiHandler)
+	mux.HandleFunc("/tables", tablesHandler(db))
+	mux.HandleFunc("/tables/", tablesHandler(db))
+	mux.HandleFunc("/debug/eval", evalHandler(db))
+
+	return mux
+}
+
+// traced records the span of the query request, it continues
+// the trace of the client sent in the traceparent header.
+func traced(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.StartRequest(r.Context(), r.Method+" "+r.URL.Path, r.Header.Get(tracing.TraceparentHeader),
+			"http.method", r.Method, "http.target", r.URL.Path, "http.request_id", w.Header().Get(requestIDHeader))
+		defer span.End()
+
+		h(w, r.WithContext(ctx))
+	}
+}
+
+func handler(db *engine.Database, idempotency *idempotencyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracing.Start(r.Context(), "parse")
+		text, params, query, err := parseQuery(db, r)
+		span.Fail(err)
+		span.End()
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		executeAndWrite(db, idempotency, w, r, text, params, query)
+	}
+}
+
+// executeAndWrite executes the parsed query, records it
+// in the query history and writes the result. The results of the
+// statements changing the data are kept by their idempotency keys
+// and the texts and the parameters of the statements.
+func executeAndWrite(db *engine.Database, idempotency *idempotencyStore, w http.ResponseWriter, r *http.Request, text string, params []interface{}, query sql.Statement) {
+	session, tx, err := requestTransaction(db, r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if r.Header.Get(validateOnlyHeader) == "true" {
+		query = &engine.Explain{Statement: query, Validate: true, Query: text}
+	}
+
+	// the privileges are checked on the resolved table names
+	authorize := db.Authorize
+	if session != nil {
+		query = session.Resolve(query)
+		authorize = session.Authorize
+	}
+
+	if err := authorize(requestUser(r), query); err != nil {
+		if historyErr := db.RecordQuery(requestClient(r), text, err); historyErr != nil {
+			logging.Errorf("failed to record query: %s", historyErr)
+		}
+		if redirectToLeader(w, r, err) {
+			return
+		}
+		writeQueryError(w, err)
+		return
+	}
+
+	var recorder *idempotentWriter
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" && !engine.ReadOnlyStatement(query) {
+		if window := db.Options().IdempotencyWindow; window > 0 {
+			// the result of the statement rolled back
+			// with its transaction must not be returned again
+			if tx != nil {
+				writeError(w, "idempotency keys can not be used within transactions", http.StatusBadRequest)
+				return
+			}
+
+			recorder = idempotency.begin(w, r, key, text, params, window)
+			if recorder == nil {
+				return
+			}
+			defer recorder.finish()
+			w = recorder
+		}
+	}
+
+	ctx, finish := db.StartQuery(r.Context(), requestUser(r), requestClient(r), text)
+	defer finish()
+	ctx, span := tracing.Start(ctx, "execute", "db.statement", text, "db.user", requestUser(r))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	if _, ok := rowSource(db, tx, query); ok && wantsStream(r) {
+		streamAndWrite(db, tx, w, r, text, query)
+		return
+	}
+
+	if selectQuery, ok := query.(*sql.Select); ok && wantsPage(r) {
+		pageAndWrite(db, tx, w, r, text, selectQuery)
+		return
+	}
+
+	result, err := execute(r.Context(), db, session, tx, query)
+	if historyErr := db.RecordQuery(requestClient(r), text, err); historyErr != nil {
+		logging.Errorf("failed to record query: %s", historyErr)
+	}
+	if err != nil {
+		span.Fail(err)
+		if recorder != nil {
+			recorder.fail(err)
+		}
+		writeQueryError(w, err)
+		return
+	}
+
+	writeQueryResult(w, db, query, result)
+}
+
+// requestSession returns the session of the request, nil if the
+// request is not sent within a session. The session can be used
+// only by the user who has opened it.
+func requestSession(db *engine.Database, r *http.Request) (*engine.Session, error) {
+	id := r.Header.Get(sessionHeader)
+	if id == "" {
+		return nil, nil
+	}
+
+	session, err := db.Session(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.User != requestUser(r) {
+		return nil, fmt.Errorf("session %s does not exist", id)
+	}
+
+	return session, nil
+}
+
+// requestTransaction returns the session and the transaction of the
+// request, the transaction is taken from the transaction header or from
+// the session. Both are nil if the request is not sent within them.
+// The transaction can be used only by the user who has started it.
+func requestTransaction(db *engine.Database, r *http.Request) (*engine.Session, *engine.Transaction, error) {
+	session, err := requestSession(db, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if id := r.Header.Get(transactionHeader); id != "" {
+		tx, err := db.Transaction(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if tx.User != requestUser(r) {
+			return nil, nil, fmt.Errorf("transaction %s does not exist", id)
+		}
+
+		return session, tx, nil
+	}
+
+	if session != nil {
+		return session, session.Transaction(), nil
+	}
+
+	return nil, nil, nil
+}
+
+// sessionResponse describes the opened session.
+type sessionResponse struct {
+	ID      string `json:"id"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// sessionHandler opens a session on POST and closes the session
+// passed in the session header on DELETE.
+func sessionHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			session, err := db.OpenUserSession(requestUser(r))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			response := sessionResponse{ID: session.ID}
+			if timeout := db.Options().SessionTimeout; timeout > 0 {
+				response.Timeout = timeout.String()
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(response)
+			if err != nil {
+				logging.Errorf("failed to write session: %s", err)
+			}
+		case http.MethodDelete:
+			session, err := requestSession(db, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			if session == nil {
+				http.Error(w, fmt.Sprintf("pass the session identifier in the %s header", sessionHeader), http.StatusBadRequest)
+				return
+			}
+
+			err = db.CloseSession(session.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "only POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// preparedResponse describes the registered prepared statement.
+type preparedResponse struct {
+	ID     string `json:"id"`
+	Params int    `json:"params"`
+}
+
+// prepareHandler registers the prepared statement from the query
+// in the body on POST and removes it by the id parameter on DELETE.
+// Within the session the statement is registered in the session.
+func prepareHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := requestSession(db, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to read request body: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			var statement *engine.PreparedStatement
+			if session != nil {
+				statement, err = session.Prepare(string(body))
+			} else {
+				statement, err = db.Prepare(string(body))
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(preparedResponse{statement.ID, statement.Params})
+			if err != nil {
+				logging.Errorf("failed to write prepared statement: %s", err)
+			}
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if session != nil {
+				err = session.Deallocate(id)
+			} else {
+				err = db.Deallocate(id)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "only POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// executeRequest is the body of the prepared statement execution
+// request, the parameters are JSON integers or strings.
+type executeRequest struct {
+	ID     string        `json:"id"`
+	Params []interface{} `json:"params"`
+}
+
+// executeHandler executes the prepared statement with the parameters.
+func executeHandler(db *engine.Database, idempotency *idempotencyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request executeRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeError(w, fmt.Sprintf("failed to decode request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		session, err := requestSession(db, r)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		var statement *engine.PreparedStatement
+		if session != nil {
+			statement, err = session.PreparedStatement(request.ID)
+		} else {
+			statement, err = db.PreparedStatement(request.ID)
+		}
+		if err != nil {
+			writeError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		query, err := statement.Bind(request.Params...)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		executeAndWrite(db, idempotency, w, r, statement.Query, request.Params, query)
+	}
+}
+
+// serverStatus describes the server state.
+type serverStatus struct {
+	Fsync         engine.FsyncPolicy     `json:"fsync"`
+	FsyncInterval string                 `json:"fsync_interval,omitempty"`
+	Scrub         *engine.ScrubStats     `json:"scrub,omitempty"`
+	Vacuum        *engine.VacuumStats    `json:"vacuum,omitempty"`
+	Admission     *AdmissionStats        `json:"admission,omitempty"`
+	Replica       *engine.ReplicaStatus  `json:"replica,omitempty"`
+	Failover      *engine.FailoverStatus `json:"failover,omitempty"`
+	Disk          *engine.DiskStatus     `json:"disk,omitempty"`
+}
+
+func statusHandler(db *engine.Database, admission *Admission) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options := db.Options()
+		s := serverStatus{Fsync: options.Fsync}
+		if options.Fsync == engine.FsyncInterval {
+			s.FsyncInterval = options.FsyncInterval.String()
+		}
+
+		if options.ScrubInterval > 0 {
+			stats := db.ScrubStats()
+			s.Scrub = &stats
+		}
+
+		if options.VacuumInterval > 0 {
+			stats := db.VacuumStats()
+			s.Vacuum = &stats
+		}
+
+		if admission != nil {
+			stats := admission.Stats()
+			s.Admission = &stats
+		}
+
+		if status, ok := db.ReplicaStatus(); ok {
+			s.Replica = &status
+		}
+
+		if options.Failover || options.Replica {
+			status := db.FailoverStatus()
+			s.Failover = &status
+		}
+
+		if status, ok := db.DiskStatus(); ok {
+			s.Disk = &status
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(s)
+		if err != nil {
+			logging.Errorf("failed to write status: %s", err)
+		}
+	}
+}
+
+// healthStatus is the body of the health check.
+type healthStatus struct {
+	// Status is "ok" or "degraded".
+	Status   string             `json:"status"`
+	ReadOnly bool               `json:"read_only"`
+	Disk     *engine.DiskStatus `json:"disk,omitempty"`
+}
+
+// healthHandler reports whether the database accepts the changes, the
+// status is 503 while it is degraded by the lack of the free space.
+func healthHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := healthStatus{Status: "ok", ReadOnly: db.ReadOnly()}
+		code := http.StatusOK
+		if status, ok := db.DiskStatus(); ok {
+			h.Disk = &status
+			if status.Degraded {
+				h.Status, h.ReadOnly = "degraded", true
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		err := json.NewEncoder(w).Encode(h)
+		if err != nil {
+			logging.Errorf("failed to write health: %s", err)
+		}
+	}
+}
+
+// purgeRequest is the body of the purge request, the time range
+// is in RFC 3339 format.
+type purgeRequest struct {
+	Key  string    `json:"key"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// purgeHandler removes query history and other records
+// related to the key within the time range.
+func purgeHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := db.AuthorizeSuperuser(requestUser(r)); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		var request purgeRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeError(w, fmt.Sprintf("failed to decode request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		results, err := db.Purge(request.Key, request.From, request.To)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.Infof("purged records for the time range %s - %s", request.From, request.To)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(results)
+		if err != nil {
+			logging.Errorf("failed to write purge results: %s", err)
+		}
+	}
+}
+
+// queryRequest is the JSON body of the query with the parameters of
+// its $N placeholders, they are bound to the parsed statement.
+//
+//	{"sql": "SELECT id, name FROM users WHERE id == $1", "params": [7]}
+type queryRequest struct {
+	SQL    string        `json:"sql"`
+	Params []interface{} `json:"params"`
+}
+
+// parseQuery parses the query of the request body, the query text or
+// the JSON queryRequest if the content type is application/json,
+// and returns its text and the bound parameters.
+func parseQuery(db *engine.Database, r *http.Request) (string, []interface{}, sql.Statement, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var request queryRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return "", nil, nil, fmt.Errorf("failed to decode request: %w", err)
+		}
+
+		prepared, err := db.ParsePrepared(request.SQL)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to parse sql: %w", err)
+		}
+
+		query, err := prepared.Bind(request.Params...)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		return request.SQL, request.Params, query, nil
+	}
+
+	query, err := db.Parse(string(body))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to parse body: %w", err)
+	}
+
+	return string(body), nil, query, nil
+}
+
+// transactionHeader is the request header with the identifier
+// of the transaction returned by BEGIN.
+const transactionHeader = "X-Transaction-ID"
+
+// validateOnlyHeader is the request header that validates
+// the query without executing it, as EXPLAIN VALIDATE does.
+const validateOnlyHeader = "X-Validate-Only"
+
+// sessionHeader is the request header with the identifier
+// of the session returned by POST /session.
+const sessionHeader = "X-Session-ID"
+
+// execute executes the query within the session and the transaction,
+// both can be nil. The query is canceled when the context is done.
+func execute(ctx context.Context, db *engine.Database, session *engine.Session, tx *engine.Transaction, q sql.Statement) (interface{}, error) {
+	var result interface{}
+	var err error
+	switch {
+	case session != nil:
+		result, err = session.ExecuteContext(ctx, tx, q)
+	case tx != nil:
+		result, err = tx.ExecuteContext(ctx, q)
+	default:
+		result, err = db.ExecuteContext(ctx, q)
+	}
+
+	switch {
+	case errors.Is(err, engine.ErrNoTransaction):
+		return nil, fmt.Errorf("%w, pass the identifier returned by BEGIN in the %s header", err, transactionHeader)
+	case errors.Is(err, engine.ErrNoSession):
+		return nil, fmt.Errorf("%w, pass the identifier returned by POST /session in the %s header", err, sessionHeader)
+	case errors.Is(err, engine.ErrUseDatabase):
+		return nil, fmt.Errorf("%w, select the database with the %s header or the %s<name> path prefix", err, databaseHeader, databasesPathPrefix)
+	}
+
+	return result, err
+}
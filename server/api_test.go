@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/krasun/gosqldb/engine"
+)
+
+// query posts the statement to the handler and returns the response.
+func query(t *testing.T, h http.Handler, text string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(text))
+	r.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion3))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: expected status 200, got %d: %s", text, w.Code, w.Body)
+	}
+
+	return w
+}
+
+func TestStringValuesRoundTrip(t *testing.T) {
+	values := []struct {
+		literal  string
+		expected string
+	}{
+		{`"plain"`, "plain"},
+		{`"with \"quotes\""`, `with "quotes"`},
+		{`"back\\slash"`, `back\slash`},
+		{`"trailing backslash \\"`, `trailing backslash \`},
+		{`"lines\nand\r\ntabs\t"`, "lines\nand\r\ntabs\t"},
+		{`"café"`, "café"},
+		{`"日本語 and emoji 🙂"`, "日本語 and emoji 🙂"},
+		{`"semicolon; inside"`, "semicolon; inside"},
+	}
+
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := engine.NewDatabase(dir, engine.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(db, nil)
+	query(t, h, `CREATE TABLE notes (id INTEGER, body STRING)`)
+	for i, value := range values {
+		query(t, h, `INSERT INTO notes (id, body) VALUES (`+strconv.Itoa(i)+`, `+value.literal+`)`)
+	}
+
+	// the values are read back from the data files
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = engine.NewDatabase(dir, engine.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h = Handler(db, nil)
+	for i, value := range values {
+		w := query(t, h, `SELECT body FROM notes WHERE id == `+strconv.Itoa(i))
+
+		var response struct {
+			Rows [][]interface{} `json:"rows"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("failed to decode %s: %s", w.Body, err)
+		}
+		if len(response.Rows) != 1 || len(response.Rows[0]) == 0 {
+			t.Fatalf("%s: expected one row, got %s", value.literal, w.Body)
+		}
+		if actual := response.Rows[0][len(response.Rows[0])-1]; actual != value.expected {
+			t.Errorf("%s: expected %q, got %q", value.literal, value.expected, actual)
+		}
+	}
+}
+
+func TestTransactionOfAnotherUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := engine.NewDatabase(dir, engine.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range []string{
+		`CREATE USER admin WITH PASSWORD "admin" SUPERUSER`,
+		`CREATE USER bob WITH PASSWORD "bob"`,
+		`CREATE TABLE t (id INTEGER)`,
+		`GRANT ALL PRIVILEGES ON DATABASE TO bob`,
+	} {
+		q, err := engine.Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		if _, err := db.Execute(q); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+
+	h := Handler(db, nil)
+	send := func(user, txID, text string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(text))
+		r.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion3))
+		r.SetBasicAuth(user, user)
+		if txID != "" {
+			r.Header.Set(transactionHeader, txID)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w
+	}
+
+	w := send("admin", "", `BEGIN`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var begin struct {
+		TransactionID string `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &begin); err != nil || begin.TransactionID == "" {
+		t.Fatalf("failed to decode transaction from %s: %v", w.Body, err)
+	}
+
+	if w := send("admin", begin.TransactionID, `INSERT INTO t (id) VALUES (1)`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	for _, text := range []string{`SELECT id FROM t`, `ROLLBACK`, `COMMIT`} {
+		if w := send("bob", begin.TransactionID, text); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d: %s", text, w.Code, w.Body)
+		}
+	}
+	if w := send("admin", begin.TransactionID, `COMMIT`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTablesOfUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := engine.NewDatabase(dir, engine.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range []string{
+		`CREATE USER admin WITH PASSWORD "admin" SUPERUSER`,
+		`CREATE USER bob WITH PASSWORD "bob"`,
+		`CREATE TABLE hidden (id INTEGER)`,
+		`CREATE TABLE listed (id INTEGER)`,
+		`GRANT INSERT ON listed TO bob`,
+	} {
+		q, err := engine.Parse(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+		if _, err := db.Execute(q); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+
+	h := Handler(db, nil)
+	get := func(user, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.SetBasicAuth(user, user)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w
+	}
+
+	var tables restTables
+	w := get("bob", "/tables")
+	if err := json.Unmarshal(w.Body.Bytes(), &tables); err != nil {
+		t.Fatalf("failed to decode tables from %s: %v", w.Body, err)
+	}
+	if len(tables.Tables) != 1 || tables.Tables[0] != "listed" {
+		t.Errorf("expected only the listed table, got %v", tables.Tables)
+	}
+
+	if w := get("bob", "/tables/listed/schema"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := get("bob", "/tables/hidden/schema"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d: %s", w.Code, w.Body)
+	}
+	if w := get("admin", "/tables/hidden/schema"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+}
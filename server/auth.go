@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/krasun/gosqldb/engine"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// The clients authenticate once there are users created with CREATE
+// USER: the HTTP API and gRPC clients send the user name and the
+// password with every request in the Basic Authorization header, the
+// PostgreSQL clients send the password in the clear text, so both
+// should be used with TLS beyond localhost.
+//
+// The service clients authenticate with the API tokens created with
+// CREATE TOKEN instead: the token is sent in the Bearer Authorization
+// header or as the password, the user name is ignored then.
+
+// authRealm is the realm of the Basic authentication challenge.
+const authRealm = "gosqldb"
+
+// userContextKey is the context key of the authenticated user name.
+type userContextKey struct{}
+
+// contextUser returns the authenticated user name,
+// empty if the client has not authenticated.
+func contextUser(ctx context.Context) string {
+	name, _ := ctx.Value(userContextKey{}).(string)
+
+	return name
+}
+
+// requestUser returns the authenticated user name of the request.
+func requestUser(r *http.Request) string {
+	return contextUser(r.Context())
+}
+
+// authenticated requires the Basic or Bearer authentication of the requests
+// except the version ones, while there are users.
+func authenticated(db *engine.Database, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" || r.URL.Path == "/healthz" || !db.AuthenticationRequired() {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := authenticate(db, r.Header.Get("Authorization"))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`"`)
+			writeError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, principal)))
+	})
+}
+
+// bearerToken returns the token of the Bearer Authorization header.
+func bearerToken(header string) (string, bool) {
+	const bearer = "Bearer "
+	if len(header) > len(bearer) && strings.EqualFold(header[:len(bearer)], bearer) {
+		return header[len(bearer):], true
+	}
+
+	return "", false
+}
+
+// errNoCredentials is returned when the Authorization header is missing.
+var errNoCredentials = errors.New("authentication is required")
+
+// authenticate checks the Basic or Bearer Authorization header
+// and returns the principal to authorize the statements of.
+func authenticate(db *engine.Database, header string) (string, error) {
+	if header == "" {
+		return "", errNoCredentials
+	}
+
+	if token, ok := bearerToken(header); ok {
+		return db.AuthenticateToken(token)
+	}
+
+	name, password, ok := parseBasicAuth(header)
+	if !ok {
+		return "", fmt.Errorf("expected Basic or Bearer authorization")
+	}
+
+	return authenticatePassword(db, name, password)
+}
+
+// authenticatePassword checks the password of the user or, if the
+// password is an API token, the token.
+func authenticatePassword(db *engine.Database, name string, password string) (string, error) {
+	if engine.IsToken(password) {
+		return db.AuthenticateToken(password)
+	}
+
+	if err := db.Authenticate(name, password); err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(name), nil
+}
+
+// requestClient describes the client in the query history.
+func requestClient(r *http.Request) string {
+	return clientName(requestUser(r), r.RemoteAddr)
+}
+
+// clientName prefixes the address with the user name if there is one.
+func clientName(userName string, addr string) string {
+	if userName == "" {
+		return addr
+	}
+
+	return userName + "@" + addr
+}
+
+// grpcAuthenticate checks the credentials of the call metadata
+// and returns the context with the authenticated user name.
+func grpcAuthenticate(db *engine.Database, ctx context.Context) (context.Context, error) {
+	if !db.AuthenticationRequired() {
+		return ctx, nil
+	}
+
+	header := ""
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) > 0 {
+		header = values[0]
+	}
+
+	principal, err := authenticate(db, header)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return context.WithValue(ctx, userContextKey{}, principal), nil
+}
+
+// parseBasicAuth parses the Basic authorization header value.
+func parseBasicAuth(value string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// grpcAuthInterceptors authenticate the unary and the streaming calls.
+func grpcAuthInterceptors(db *engine.Database) []grpc.ServerOption {
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := grpcAuthenticate(db, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := grpcAuthenticate(db, ss.Context())
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &contextStream{ss, ctx})
+	}
+
+	return []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream)}
+}
+
+// contextStream is the server stream with the context
+// replaced by the interceptor.
+type contextStream struct {
+	grpc.ServerStream
+
+	ctx context.Context
+}
+
+// Context returns the context of the interceptor.
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
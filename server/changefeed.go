@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The changefeed is streamed as the server-sent events, the event
+// identifier is the change position, so the clients that reconnect
+// with the Last-Event-ID header resume after the last change:
+//
+//	GET /changes?table=users&after=42
+//
+//	id: 43
+//	event: change
+//	data: {"position":43,"table":"users","operation":"update","old":{...},"new":{...}}
+
+// changesKeepAliveInterval is the pause between the comments
+// that keep the idle stream open through the proxies.
+const changesKeepAliveInterval = 15 * time.Second
+
+// changesHandler streams the committed row changes of the table,
+// or of all the tables to the superusers.
+func changesHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if db.Options().ChangefeedRetention <= 0 {
+			writeError(w, "the changefeed is disabled, enable it with -changefeed-retention", http.StatusNotFound)
+			return
+		}
+
+		tableName := r.URL.Query().Get("table")
+		position := r.URL.Query().Get("after")
+		if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+			position = lastID
+		}
+
+		var after uint64
+		if position != "" {
+			var err error
+			after, err = strconv.ParseUint(position, 10, 64)
+			if err != nil {
+				writeError(w, fmt.Sprintf("invalid position %s", position), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if last := db.ChangePosition(); after > last {
+			writeError(w, fmt.Sprintf("position %d is after the last change %d", after, last), http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if tableName == "" {
+			err = db.AuthorizeSuperuser(requestUser(r))
+		} else {
+			err = db.Authorize(requestUser(r), &sql.Select{Table: tableName})
+		}
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		var mu sync.Mutex
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(changesKeepAliveInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					mu.Lock()
+					_, err := fmt.Fprint(w, ": keep-alive\n\n")
+					if err == nil {
+						flusher.Flush()
+					}
+					mu.Unlock()
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		user := requestUser(r)
+		err = db.StreamChanges(r.Context(), tableName, after, func(change engine.Change) error {
+			data, err := json.Marshal(db.MaskChange(user, change))
+			if err != nil {
+				return fmt.Errorf("failed to encode change: %w", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", change.Position, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+
+			return nil
+		})
+		if err == nil || r.Context().Err() != nil {
+			return
+		}
+
+		// the headers are sent, the error is the last event
+		mu.Lock()
+		defer mu.Unlock()
+		if _, writeErr := fmt.Fprintf(w, "event: error\ndata: %s\n\n", err); writeErr != nil {
+			logging.FromContext(r.Context()).Errorf("failed to stream changes: %s", err)
+		}
+	}
+}
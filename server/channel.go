@@ -0,0 +1,493 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The query channel is the WebSocket connection that executes the
+// statements within a session and pushes the results, the progress
+// of the long queries and the changes of the subscribed tables. The
+// client tags every message with an identifier of its choice and
+// the server tags the answers with it:
+//
+//	GET /ws
+//
+//	-> {"id":"1","type":"query","query":"SELECT id, name FROM users"}
+//	<- {"id":"1","type":"columns","columns":[{"name":"id","type":"integer"},{"name":"name","type":"string"}]}
+//	<- {"id":"1","type":"rows","rows":[[1,"Ann"],[2,"Bob"]]}
+//	<- {"id":"1","type":"progress","row_count":2,"elapsed_ms":1000}
+//	<- {"id":"1","type":"done","row_count":2}
+//
+//	-> {"id":"2","type":"subscribe","table":"users","after":42}
+//	<- {"id":"2","type":"change","change":{"position":43,"table":"users","operation":"insert","new":{...}}}
+//	-> {"id":"2","type":"cancel"}
+//	<- {"id":"2","type":"done"}
+//
+// The failures are answered with the error in the format of the API
+// version 3. The queries are executed one by one in the order they are
+// sent, so BEGIN and COMMIT work as in the session, and every query is
+// admitted on its own. The cancel message cancels the query or ends the
+// subscription with the identifier.
+
+// the types of the query channel messages
+const (
+	channelQuery     = "query"
+	channelSubscribe = "subscribe"
+	channelCancel    = "cancel"
+	channelColumns   = "columns"
+	channelRows      = "rows"
+	channelProgress  = "progress"
+	channelChange    = "change"
+	channelDone      = "done"
+	channelError     = "error"
+)
+
+// channelQueueSize is the number of the queries waiting for
+// the running one, the client gets the error over it.
+const channelQueueSize = 100
+
+// channelProgressInterval is the pause between the progress
+// messages of the running query.
+const channelProgressInterval = time.Second
+
+// channelPingInterval is the pause between the pings that keep the
+// idle connection open, the client that has not answered three of
+// them is disconnected.
+const channelPingInterval = 15 * time.Second
+
+// channelRequest is the message of the client.
+type channelRequest struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Query string `json:"query,omitempty"`
+	Table string `json:"table,omitempty"`
+	After uint64 `json:"after,omitempty"`
+}
+
+// channelMessage is the message of the server.
+type channelMessage struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Columns      []columnV3      `json:"columns,omitempty"`
+	Rows         [][]interface{} `json:"rows,omitempty"`
+	RowCount     *int            `json:"row_count,omitempty"`
+	AffectedRows *int            `json:"affected_rows,omitempty"`
+	Result       interface{}     `json:"result,omitempty"`
+	ElapsedMS    int64           `json:"elapsed_ms,omitempty"`
+	Change       *engine.Change  `json:"change,omitempty"`
+	Error        *errorDetailV3  `json:"error,omitempty"`
+}
+
+// queuedQuery is the query waiting for the execution.
+type queuedQuery struct {
+	id   string
+	text string
+	ctx  context.Context
+}
+
+// queryChannel serves the WebSocket connection of the client.
+type queryChannel struct {
+	db        *engine.Database
+	admission *Admission
+	conn      *wsConn
+	user      string
+	addr      string
+	session   *engine.Session
+	// ctx is done when the connection is closed.
+	ctx     context.Context
+	stop    context.CancelFunc
+	queries chan queuedQuery
+
+	mu sync.Mutex
+	// cancels cancel the queued and the running queries
+	// and the subscriptions by their identifiers.
+	cancels map[string]context.CancelFunc
+}
+
+// channelHandler upgrades the connection to the query channel.
+func channelHandler(db *engine.Database, admission *Admission) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkWebSocketHandshake(r); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		session, err := db.OpenUserSession(requestUser(r))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			if err := db.CloseSession(session.ID); err != nil {
+				logging.Debugf("failed to close session %s: %s", session.ID, err)
+			}
+		}()
+
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("%s", err)
+			return
+		}
+		conn.readTimeout = 3 * channelPingInterval
+
+		ctx, cancel := context.WithCancel(logging.NewContext(r.Context(), logging.FromContext(r.Context()).With("session_id", session.ID)))
+		defer cancel()
+
+		c := &queryChannel{
+			db:        db,
+			admission: admission,
+			conn:      conn,
+			user:      requestUser(r),
+			addr:      r.RemoteAddr,
+			session:   session,
+			ctx:       ctx,
+			stop:      cancel,
+			queries:   make(chan queuedQuery, channelQueueSize),
+			cancels:   make(map[string]context.CancelFunc),
+		}
+		logging.FromContext(ctx).Debugf("WebSocket connection from %s", r.RemoteAddr)
+
+		c.serve()
+	}
+}
+
+// serve reads the messages of the client until the connection is closed.
+func (c *queryChannel) serve() {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.run()
+	}()
+	go func() {
+		defer wg.Done()
+		c.keepAlive()
+	}()
+
+	// the queries and the subscriptions end with the connection
+	defer c.stop()
+
+	for {
+		message, err := c.conn.readMessage()
+		if err != nil {
+			var wsErr *webSocketError
+			var netErr net.Error
+			switch {
+			case errors.As(err, &wsErr):
+				c.conn.close(wsErr.code, wsErr.message)
+			case errors.As(err, &netErr) && netErr.Timeout():
+				c.conn.close(wsCloseGoingAway, "client has not answered pings")
+			default:
+				c.conn.close(wsCloseGoingAway, "")
+			}
+			if err != errWebSocketClosed {
+				logging.FromContext(c.ctx).Debugf("WebSocket connection from %s is closed: %s", c.addr, err)
+			}
+
+			return
+		}
+
+		var request channelRequest
+		if err := json.Unmarshal(message, &request); err != nil {
+			c.sendError("", fmt.Errorf("invalid message: %w", err))
+			continue
+		}
+
+		switch request.Type {
+		case channelQuery:
+			c.enqueue(request)
+		case channelSubscribe:
+			c.subscribe(request)
+		case channelCancel:
+			if !c.cancel(request.ID) {
+				c.sendError(request.ID, fmt.Errorf("query or subscription %q is not running", request.ID))
+			}
+		default:
+			c.sendError(request.ID, fmt.Errorf("unknown message type %q", request.Type))
+		}
+	}
+}
+
+// keepAlive pings the client until the connection is closed.
+func (c *queryChannel) keepAlive() {
+	ticker := time.NewTicker(channelPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.conn.ping(); err != nil {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// register registers the cancel function of the query or the
+// subscription, the identifier must not be used by another one.
+func (c *queryChannel) register(id string) (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.cancels[id]; exists {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.cancels[id] = cancel
+
+	return ctx, true
+}
+
+// unregister releases the identifier of the finished query or subscription.
+func (c *queryChannel) unregister(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cancel, exists := c.cancels[id]; exists {
+		cancel()
+		delete(c.cancels, id)
+	}
+}
+
+// cancel cancels the query or the subscription,
+// false if there is none with the identifier.
+func (c *queryChannel) cancel(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cancel, exists := c.cancels[id]
+	if exists {
+		cancel()
+	}
+
+	return exists
+}
+
+// enqueue queues the query for the execution.
+func (c *queryChannel) enqueue(request channelRequest) {
+	ctx, ok := c.register(request.ID)
+	if !ok {
+		c.sendError(request.ID, fmt.Errorf("identifier %q is used by another query", request.ID))
+		return
+	}
+
+	select {
+	case c.queries <- queuedQuery{request.ID, request.Query, ctx}:
+	default:
+		c.unregister(request.ID)
+		c.sendError(request.ID, fmt.Errorf("too many queued queries, at most %d can wait", channelQueueSize))
+	}
+}
+
+// run executes the queued queries one by one.
+func (c *queryChannel) run() {
+	for {
+		select {
+		case q := <-c.queries:
+			c.execute(q)
+			c.unregister(q.id)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// execute executes the query and sends its result.
+func (c *queryChannel) execute(q queuedQuery) {
+	if q.ctx.Err() != nil {
+		c.sendError(q.id, engine.ErrQueryCanceled)
+		return
+	}
+
+	// the session expires as the HTTP ones if the connection is idle
+	if _, err := c.db.Session(c.session.ID); err != nil {
+		c.sendError(q.id, err)
+		c.conn.close(wsCloseGoingAway, err.Error())
+		return
+	}
+
+	query, err := c.db.Parse(q.text)
+	if err != nil {
+		c.sendError(q.id, err)
+		return
+	}
+
+	query = c.session.Resolve(query)
+	client := clientName(c.user, c.addr)
+	err = c.session.Authorize(c.user, query)
+	if err == nil {
+		err = c.executeAdmitted(q, query)
+	}
+	if historyErr := c.db.RecordQuery(client, q.text, err); historyErr != nil {
+		logging.Errorf("failed to record query: %s", historyErr)
+	}
+	if err != nil {
+		c.sendError(q.id, err)
+	}
+}
+
+// executeAdmitted admits the query and executes it sending the
+// progress while it runs, the SELECT rows are sent as they are
+// scanned in batches of streamFlushRows.
+func (c *queryChannel) executeAdmitted(q queuedQuery, query sql.Statement) error {
+	release, err := c.admission.admit(q.ctx, admissionClient(c.user, c.addr))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, finish := c.db.StartQuery(q.ctx, c.user, clientName(c.user, c.addr), q.text)
+	defer finish()
+
+	var rows int64
+	started := time.Now()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(channelProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				count := int(atomic.LoadInt64(&rows))
+				c.send(channelMessage{ID: q.id, Type: channelProgress, RowCount: &count, ElapsedMS: time.Since(started).Milliseconds()})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	tx := c.session.Transaction()
+	each, ok := rowSource(c.db, tx, query)
+	if !ok {
+		result, err := execute(ctx, c.db, c.session, tx, query)
+		if err != nil {
+			return err
+		}
+
+		message := channelMessage{ID: q.id, Type: channelDone}
+		switch query.(type) {
+		case *sql.Insert, *sql.Update, *sql.Delete, *engine.UpdateIfVersion, *engine.DeleteIfVersion:
+			affected := result.(int)
+			message.AffectedRows = &affected
+		default:
+			if stringer, ok := result.(fmt.Stringer); ok {
+				result = stringer.String()
+			}
+			message.Result = result
+		}
+		c.send(message)
+
+		return nil
+	}
+
+	columns, err := c.db.ResultColumns(query)
+	if err != nil {
+		return err
+	}
+	c.send(channelMessage{ID: q.id, Type: channelColumns, Columns: describeColumns(columns)})
+
+	batch := make([][]interface{}, 0, streamFlushRows)
+	err = each(ctx, func(row []interface{}) error {
+		batch = append(batch, row)
+		atomic.AddInt64(&rows, 1)
+		if len(batch) == streamFlushRows {
+			if err := c.send(channelMessage{ID: q.id, Type: channelRows, Rows: batch}); err != nil {
+				return err
+			}
+			batch = make([][]interface{}, 0, streamFlushRows)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		c.send(channelMessage{ID: q.id, Type: channelRows, Rows: batch})
+	}
+	count := int(rows)
+	c.send(channelMessage{ID: q.id, Type: channelDone, RowCount: &count})
+
+	return nil
+}
+
+// subscribe pushes the committed changes of the table, or of all
+// the tables to the superusers, until the subscription is canceled.
+func (c *queryChannel) subscribe(request channelRequest) {
+	if c.db.Options().ChangefeedRetention <= 0 {
+		c.sendError(request.ID, fmt.Errorf("the changefeed is disabled, enable it with -changefeed-retention"))
+		return
+	}
+
+	var err error
+	if request.Table == "" {
+		err = c.db.AuthorizeSuperuser(c.user)
+	} else {
+		err = c.db.Authorize(c.user, &sql.Select{Table: request.Table})
+	}
+	if err != nil {
+		c.sendError(request.ID, err)
+		return
+	}
+
+	ctx, ok := c.register(request.ID)
+	if !ok {
+		c.sendError(request.ID, fmt.Errorf("identifier %q is used by another subscription", request.ID))
+		return
+	}
+
+	go func() {
+		defer c.unregister(request.ID)
+
+		err := c.db.StreamChanges(ctx, request.Table, request.After, func(change engine.Change) error {
+			change = c.db.MaskChange(c.user, change)
+			return c.send(channelMessage{ID: request.ID, Type: channelChange, Change: &change})
+		})
+		if err != nil && ctx.Err() == nil {
+			c.sendError(request.ID, err)
+			return
+		}
+
+		c.send(channelMessage{ID: request.ID, Type: channelDone})
+	}()
+}
+
+// send writes the message to the client.
+func (c *queryChannel) send(message channelMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	return c.conn.writeMessage(data)
+}
+
+// sendError sends the error with the API version 3 code.
+func (c *queryChannel) sendError(id string, err error) {
+	_, classified := queryErrorCode(err)
+	detail := errorDetail(classified)
+
+	if sendErr := c.send(channelMessage{ID: id, Type: channelError, Error: detail}); sendErr != nil {
+		logging.FromContext(c.ctx).Debugf("failed to send error: %s", sendErr)
+	}
+}
@@ -0,0 +1,954 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The cluster elects the leader among its members by the votes of the
+// majority, like Raft does. The leader executes the writes, streams its
+// archive to the followers over the replication protocol and reports the
+// change committed when the majority has applied it. The leader sends the
+// heartbeats with the members, the follower that has not heard from the
+// leader for the election timeout starts the election of the next term.
+// The vote is given to the candidate whose archive is not behind, so the
+// committed changes survive the loss of the minority of the nodes. The
+// cluster endpoints are served on their own address:
+//
+//	GET  /cluster                                    the state of the node
+//	POST /cluster/join  {"node": "c", "address": ..., "http": ..., "replication": ...}
+//	POST /cluster/leave {"node": "c"}
+//	POST /cluster/vote, POST /cluster/heartbeat      the messages of the nodes
+//
+// The membership changes are accepted by the leader.
+
+const (
+	// clusterTickInterval is the pause between the checks of the node.
+	clusterTickInterval = 100 * time.Millisecond
+	// clusterHeartbeatInterval is the pause between the heartbeats of the leader.
+	clusterHeartbeatInterval = 300 * time.Millisecond
+	// minElectionTimeout is how long the follower waits for the leader at
+	// least, the timeout is random up to twice as long, so the elections
+	// of the nodes rarely start together.
+	minElectionTimeout = 1500 * time.Millisecond
+	// clusterRequestTimeout limits the messages between the nodes.
+	clusterRequestTimeout = 500 * time.Millisecond
+	// clusterCommitTimeout is how long the change waits for the quorum.
+	clusterCommitTimeout = 5 * time.Second
+)
+
+// ClusterOptions configures the cluster node.
+type ClusterOptions struct {
+	// Node is the name of the node, unique within the cluster.
+	Node string
+	// Address is the advertised URL of the cluster endpoints.
+	Address string
+	// HTTP is the advertised URL of the HTTP API,
+	// the clients of the followers are redirected to it.
+	HTTP string
+	// Replication is the advertised address of the replication
+	// listener, the followers stream the archive of the leader from it.
+	Replication string
+	// Secret authenticates the nodes to each other.
+	Secret string
+	// Bootstrap starts the new cluster with the node as its only member.
+	Bootstrap bool
+	// User and Password authenticate the followers at the leader.
+	User     string
+	Password string
+	// Replicas are the connections of the followers to the leader.
+	Replicas *ReplicationServer
+}
+
+// ClusterMember is the node of the cluster.
+type ClusterMember struct {
+	Node        string `json:"node"`
+	Address     string `json:"address"`
+	HTTP        string `json:"http"`
+	Replication string `json:"replication"`
+}
+
+// clusterState is the state of the node stored in the db directory.
+type clusterState struct {
+	Term uint64 `json:"term"`
+	// Vote is the node voted for in the term.
+	Vote string `json:"vote,omitempty"`
+	// Followed is the leader whose archive the node has copied,
+	// the node copies the snapshot of another leader first.
+	Followed string          `json:"followed,omitempty"`
+	Members  []ClusterMember `json:"members"`
+}
+
+// ClusterStatus describes the node of the cluster.
+type ClusterStatus struct {
+	Node   string          `json:"node"`
+	Term   uint64          `json:"term"`
+	Leader string          `json:"leader,omitempty"`
+	Role   engine.Role     `json:"role"`
+	Log    clusterPosition `json:"log"`
+	// Members are the nodes of the cluster, Contacted is when the
+	// leader has heard from them.
+	Members   []ClusterMember      `json:"members"`
+	Contacted map[string]time.Time `json:"contacted,omitempty"`
+}
+
+// clusterPosition is the last archive record the node has.
+type clusterPosition struct {
+	Term     uint64 `json:"term"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// ahead reports whether the position is not behind the other one.
+func (p clusterPosition) ahead(other clusterPosition) bool {
+	return p.Term > other.Term || (p.Term == other.Term && p.Sequence >= other.Sequence)
+}
+
+type voteRequest struct {
+	Term      uint64          `json:"term"`
+	Candidate string          `json:"candidate"`
+	Log       clusterPosition `json:"log"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type heartbeatRequest struct {
+	Term    uint64          `json:"term"`
+	Leader  string          `json:"leader"`
+	Members []ClusterMember `json:"members"`
+}
+
+type heartbeatResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+}
+
+type leaveRequest struct {
+	Node string `json:"node"`
+}
+
+// clusterError is the error response of the cluster endpoints,
+// Leader is the address the membership changes are sent to.
+type clusterError struct {
+	Error  string `json:"error"`
+	Leader string `json:"leader,omitempty"`
+}
+
+// Cluster is the node of the cluster.
+type Cluster struct {
+	db      *engine.Database
+	options ClusterOptions
+	client  *http.Client
+	ctx     context.Context
+
+	mu    sync.Mutex
+	state clusterState
+	// leader is the node that leads the term, empty if it is not known
+	leader string
+	// heard is when the leader has been heard from or the vote given
+	heard           time.Time
+	electionTimeout time.Duration
+	lastHeartbeat   time.Time
+	// contacted is when the leader has heard from the followers
+	contacted map[string]time.Time
+	// stopFollowing stops the replication from the followed leader,
+	// following is its node and followed is closed when it stops
+	stopFollowing context.CancelFunc
+	following     string
+	followed      chan struct{}
+	generation    int
+}
+
+// NewCluster returns the node with its stored state, the database
+// must be opened as the replica, it follows the leader or is elected.
+func NewCluster(db *engine.Database, options ClusterOptions) (*Cluster, error) {
+	c := &Cluster{
+		db:        db,
+		options:   options,
+		client:    &http.Client{Timeout: clusterRequestTimeout},
+		contacted: make(map[string]time.Time),
+		heard:     time.Now(),
+	}
+	c.resetElectionTimeout()
+
+	if _, err := db.ReadClusterState(&c.state); err != nil {
+		return nil, err
+	}
+
+	if len(c.state.Members) == 0 && options.Bootstrap {
+		c.state.Members = []ClusterMember{c.self()}
+		if err := c.store(); err != nil {
+			return nil, err
+		}
+		logging.Infof("bootstrapped cluster with node %s", options.Node)
+	}
+
+	return c, nil
+}
+
+// self returns the node as the member.
+func (c *Cluster) self() ClusterMember {
+	return ClusterMember{
+		Node:        c.options.Node,
+		Address:     c.options.Address,
+		HTTP:        c.options.HTTP,
+		Replication: c.options.Replication,
+	}
+}
+
+// store replaces the stored state, it is called with the lock held.
+func (c *Cluster) store() error {
+	return c.db.WriteClusterState(c.state)
+}
+
+func (c *Cluster) resetElectionTimeout() {
+	c.electionTimeout = minElectionTimeout + time.Duration(rand.Int63n(int64(minElectionTimeout)))
+}
+
+// member returns the member of the node, false if it is not a member.
+func (c *Cluster) member(node string) (ClusterMember, bool) {
+	for _, m := range c.state.Members {
+		if m.Node == node {
+			return m, true
+		}
+	}
+
+	return ClusterMember{}, false
+}
+
+// quorum returns the number of the members that make the majority.
+func (c *Cluster) quorum() int {
+	return len(c.state.Members)/2 + 1
+}
+
+// peers returns the members but the node itself.
+func (c *Cluster) peers() []ClusterMember {
+	peers := make([]ClusterMember, 0, len(c.state.Members))
+	for _, m := range c.state.Members {
+		if m.Node != c.options.Node {
+			peers = append(peers, m)
+		}
+	}
+
+	return peers
+}
+
+// Run elects the leader and follows it until the context is done.
+func (c *Cluster) Run(ctx context.Context) {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(clusterTickInterval)
+	defer ticker.Stop()
+
+	for {
+		c.mu.Lock()
+		leading := c.leader == c.options.Node
+		c.mu.Unlock()
+
+		if leading {
+			c.lead(ctx)
+		} else {
+			c.campaign(ctx)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.mu.Lock()
+			if c.stopFollowing != nil {
+				c.stopFollowing()
+			}
+			followed := c.followed
+			c.mu.Unlock()
+
+			if followed != nil {
+				<-followed
+			}
+			return
+		}
+	}
+}
+
+// lead sends the heartbeats and steps down when the leader
+// has not heard from the majority for the election timeout.
+func (c *Cluster) lead(ctx context.Context) {
+	c.mu.Lock()
+	if time.Since(c.lastHeartbeat) < clusterHeartbeatInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.lastHeartbeat = time.Now()
+	request := heartbeatRequest{Term: c.state.Term, Leader: c.options.Node, Members: c.state.Members}
+	peers := c.peers()
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer ClusterMember) {
+			defer wg.Done()
+			c.heartbeat(ctx, peer, request)
+		}(peer)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leader != c.options.Node || c.state.Term != request.Term {
+		return
+	}
+
+	contacted := 1
+	for _, peer := range c.peers() {
+		if time.Since(c.contacted[peer.Node]) < minElectionTimeout {
+			contacted++
+		}
+	}
+	if _, member := c.member(c.options.Node); !member || contacted < c.quorum() {
+		logging.Errorf("leader of term %d has not heard from the majority of the cluster, stepping down", request.Term)
+		c.stepDown()
+	}
+}
+
+// heartbeat sends the heartbeat to the member.
+func (c *Cluster) heartbeat(ctx context.Context, member ClusterMember, request heartbeatRequest) {
+	var response heartbeatResponse
+	if err := c.send(ctx, member.Address, "/cluster/heartbeat", request, &response); err != nil {
+		logging.Debugf("failed to send heartbeat to node %s: %s", member.Node, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.observeTerm(response.Term) {
+		return
+	}
+	if response.Success {
+		c.contacted[member.Node] = time.Now()
+	}
+}
+
+// observeTerm adopts the later term of another node, the leader steps
+// down. It reports whether the term is later, the lock must be held.
+func (c *Cluster) observeTerm(term uint64) bool {
+	if term <= c.state.Term {
+		return false
+	}
+
+	c.state.Term, c.state.Vote = term, ""
+	if err := c.store(); err != nil {
+		logging.Errorf("failed to store cluster state: %s", err)
+	}
+
+	if c.leader == c.options.Node {
+		logging.Infof("node has seen term %d, the leader steps down", term)
+		c.stepDown()
+	}
+	c.leader = ""
+
+	return true
+}
+
+// stepDown makes the leader the follower, the lock must be held.
+func (c *Cluster) stepDown() {
+	c.db.SetCommitWaiter(nil)
+	if err := c.db.Demote(""); err != nil {
+		logging.Errorf("failed to demote leader: %s", err)
+	}
+
+	c.leader, c.heard = "", time.Now()
+}
+
+// campaign starts the election when the leader has not been
+// heard from for the election timeout.
+func (c *Cluster) campaign(ctx context.Context) {
+	c.mu.Lock()
+	if _, member := c.member(c.options.Node); !member || time.Since(c.heard) < c.electionTimeout {
+		c.mu.Unlock()
+		return
+	}
+
+	c.state.Term++
+	c.state.Vote = c.options.Node
+	if err := c.store(); err != nil {
+		c.state.Term--
+		c.mu.Unlock()
+		logging.Errorf("failed to store cluster state: %s", err)
+		return
+	}
+	term := c.state.Term
+	c.leader, c.heard = "", time.Now()
+	c.resetElectionTimeout()
+	peers, quorum := c.peers(), c.quorum()
+	c.mu.Unlock()
+
+	logTerm, sequence := c.db.LogPosition()
+	request := voteRequest{Term: term, Candidate: c.options.Node, Log: clusterPosition{logTerm, sequence}}
+	logging.Infof("starting election of term %d after record %d of term %d", term, sequence, logTerm)
+
+	responses := make(chan voteResponse, len(peers))
+	for _, peer := range peers {
+		go func(peer ClusterMember) {
+			var response voteResponse
+			if err := c.send(ctx, peer.Address, "/cluster/vote", request, &response); err != nil {
+				logging.Debugf("failed to request vote of node %s: %s", peer.Node, err)
+			}
+			responses <- response
+		}(peer)
+	}
+
+	votes := 1
+	for range peers {
+		response := <-responses
+		c.mu.Lock()
+		c.observeTerm(response.Term)
+		c.mu.Unlock()
+
+		if response.Granted {
+			votes++
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state.Term != term || c.leader != "" || votes < quorum {
+		return
+	}
+
+	c.becomeLeader(term)
+}
+
+// becomeLeader makes the elected node the leader, the lock must be held.
+func (c *Cluster) becomeLeader(term uint64) {
+	c.stopFollowingLeader()
+
+	if c.db.FailoverStatus().Role == engine.RoleReplica {
+		if err := c.db.Promote(term); err != nil {
+			logging.Errorf("failed to promote node to leader of term %d: %s", term, err)
+			return
+		}
+	}
+
+	if err := c.db.StartTerm(term); err != nil {
+		logging.Errorf("failed to lead term %d: %s", term, err)
+		c.stepDown()
+		return
+	}
+
+	c.state.Followed = c.options.Node
+	if err := c.store(); err != nil {
+		logging.Errorf("failed to store cluster state: %s", err)
+	}
+
+	c.leader = c.options.Node
+	c.lastHeartbeat = time.Time{}
+	for _, peer := range c.peers() {
+		c.contacted[peer.Node] = time.Now()
+	}
+	c.db.SetCommitWaiter(c.waitCommitted)
+
+	logging.Infof("node is elected leader of term %d", term)
+}
+
+// waitCommitted waits until the majority has applied the records.
+func (c *Cluster) waitCommitted(ctx context.Context, sequence uint64) error {
+	c.mu.Lock()
+	nodes := make(map[string]bool)
+	for _, peer := range c.peers() {
+		nodes[peer.Node] = true
+	}
+	needed := c.quorum() - 1
+	if _, member := c.member(c.options.Node); !member {
+		needed++
+	}
+	c.mu.Unlock()
+
+	if needed <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clusterCommitTimeout)
+	defer cancel()
+
+	if err := c.options.Replicas.WaitAcknowledged(ctx, sequence, nodes, needed); err != nil {
+		return fmt.Errorf("%w: record %d: %s", engine.ErrNotReplicated, sequence, err)
+	}
+
+	return nil
+}
+
+// follow records the leader and replicates its archive,
+// the lock must be held.
+func (c *Cluster) follow(leader string) {
+	c.leader = leader
+	member, _ := c.member(leader)
+	c.db.SetLeader(member.HTTP)
+
+	if c.following == leader || c.ctx == nil {
+		return
+	}
+	c.stopFollowingLeader()
+
+	ctx, stop := context.WithCancel(c.ctx)
+	previous, followed := c.followed, make(chan struct{})
+	c.generation++
+	generation := c.generation
+	c.stopFollowing, c.following, c.followed = stop, leader, followed
+
+	options := ReplicationOptions{
+		Addr:     member.Replication,
+		User:     c.options.User,
+		Password: c.options.Password,
+		Node:     c.options.Node,
+		Resync:   c.state.Followed != leader,
+		Resynced: func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			if c.generation == generation {
+				c.state.Followed = leader
+				if err := c.store(); err != nil {
+					logging.Errorf("failed to store cluster state: %s", err)
+				}
+			}
+		},
+	}
+	if options.Resync {
+		logging.Infof("following leader %s, copying its snapshot", leader)
+	} else {
+		logging.Infof("following leader %s", leader)
+	}
+
+	go func() {
+		defer close(followed)
+		// the records of the former leader are not applied after the snapshot
+		if previous != nil {
+			<-previous
+		}
+		Replicate(ctx, c.db, options)
+	}()
+}
+
+// stopFollowingLeader stops the replication, the lock must be held.
+func (c *Cluster) stopFollowingLeader() {
+	if c.stopFollowing != nil {
+		c.stopFollowing()
+	}
+	c.stopFollowing, c.following = nil, ""
+}
+
+// Status returns the state of the node.
+func (c *Cluster) Status() ClusterStatus {
+	logTerm, sequence := c.db.LogPosition()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := ClusterStatus{
+		Node:    c.options.Node,
+		Term:    c.state.Term,
+		Leader:  c.leader,
+		Role:    c.db.FailoverStatus().Role,
+		Log:     clusterPosition{logTerm, sequence},
+		Members: c.state.Members,
+	}
+	if c.leader == c.options.Node {
+		status.Contacted = make(map[string]time.Time, len(c.contacted))
+		for node, contacted := range c.contacted {
+			status.Contacted[node] = contacted.UTC()
+		}
+	}
+
+	return status
+}
+
+// send posts the message to the cluster endpoint of the node.
+func (c *Cluster) send(ctx context.Context, address string, endpoint string, message interface{}, response interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	return sendCluster(ctx, c.client, c.options.Secret, strings.TrimSuffix(address, "/")+endpoint, body, response)
+}
+
+// sendCluster posts the body to the cluster endpoint and decodes the response.
+func sendCluster(ctx context.Context, client *http.Client, secret string, url string, body []byte, response interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		request.Header.Set("Authorization", "Bearer "+secret)
+	}
+
+	r, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			logging.Errorf("failed to close cluster response: %s", err)
+		}
+	}()
+
+	if r.StatusCode != http.StatusOK {
+		var clusterErr clusterError
+		content, _ := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+		if json.Unmarshal(content, &clusterErr) != nil || clusterErr.Error == "" {
+			clusterErr.Error = strings.TrimSpace(string(content))
+		}
+
+		return &clusterRequestError{status: r.Status, message: clusterErr.Error, leader: clusterErr.Leader}
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+// clusterRequestError is the failed cluster request,
+// leader is the address of the leader if it is known.
+type clusterRequestError struct {
+	status  string
+	message string
+	leader  string
+}
+
+func (e *clusterRequestError) Error() string {
+	return fmt.Sprintf("node has failed with %s: %s", e.status, e.message)
+}
+
+// JoinCluster asks the member at the address to add the node to the
+// cluster, the request is sent again to the leader if the member is not.
+func JoinCluster(ctx context.Context, address string, secret string, member ClusterMember) error {
+	body, err := json.Marshal(member)
+	if err != nil {
+		return fmt.Errorf("failed to encode member: %w", err)
+	}
+
+	client := &http.Client{Timeout: clusterCommitTimeout}
+	var members []ClusterMember
+	err = sendCluster(ctx, client, secret, strings.TrimSuffix(address, "/")+"/cluster/join", body, &members)
+
+	var requestErr *clusterRequestError
+	if errors.As(err, &requestErr) && requestErr.leader != "" {
+		err = sendCluster(ctx, client, secret, strings.TrimSuffix(requestErr.leader, "/")+"/cluster/join", body, &members)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to join cluster at %s: %w", address, err)
+	}
+
+	return nil
+}
+
+// Handler returns the handler of the cluster endpoints.
+func (c *Cluster) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster", c.statusHandler)
+	mux.HandleFunc("/cluster/vote", c.voteHandler)
+	mux.HandleFunc("/cluster/heartbeat", c.heartbeatHandler)
+	mux.HandleFunc("/cluster/join", c.joinHandler)
+	mux.HandleFunc("/cluster/leave", c.leaveHandler)
+
+	return c.authenticated(mux)
+}
+
+// authenticated requires the cluster secret.
+func (c *Cluster) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.options.Secret != "" {
+			token, ok := bearerToken(r.Header.Get("Authorization"))
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.options.Secret)) != 1 {
+				writeClusterError(w, "invalid cluster secret", "", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if r.URL.Path != "/cluster" && r.Method != http.MethodPost {
+			writeClusterError(w, "only POST is allowed", "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeClusterError(w http.ResponseWriter, message string, leader string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(clusterError{Error: message, Leader: leader}); err != nil {
+		logging.Errorf("failed to write cluster error: %s", err)
+	}
+}
+
+// decodeCluster decodes the request body, it writes the error if it fails.
+func decodeCluster(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeClusterError(w, fmt.Sprintf("invalid request: %s", err), "", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (c *Cluster) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeClusterError(w, "only GET is allowed", "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, c.Status())
+}
+
+func (c *Cluster) voteHandler(w http.ResponseWriter, r *http.Request) {
+	var request voteRequest
+	if !decodeCluster(w, r, &request) {
+		return
+	}
+
+	// the position is taken before the lock, the database
+	// is not changed by the vote
+	logTerm, sequence := c.db.LogPosition()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.observeTerm(request.Term)
+	response := voteResponse{Term: c.state.Term}
+	if request.Term == c.state.Term && (c.state.Vote == "" || c.state.Vote == request.Candidate) &&
+		request.Log.ahead(clusterPosition{logTerm, sequence}) {
+		c.state.Vote = request.Candidate
+		// the vote is stored before it is given,
+		// so it is not given twice in the term
+		if err := c.store(); err != nil {
+			c.state.Vote = ""
+			writeClusterError(w, "failed to store vote", "", http.StatusInternalServerError)
+			return
+		}
+
+		c.heard = time.Now()
+		response.Granted = true
+		logging.Infof("voted for node %s in term %d", request.Candidate, request.Term)
+	}
+
+	writeJSON(w, response)
+}
+
+func (c *Cluster) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var request heartbeatRequest
+	if !decodeCluster(w, r, &request) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.observeTerm(request.Term)
+	if request.Term < c.state.Term {
+		writeJSON(w, heartbeatResponse{Term: c.state.Term})
+		return
+	}
+
+	if !sameMembers(c.state.Members, request.Members) {
+		c.state.Members = request.Members
+		if err := c.store(); err != nil {
+			writeClusterError(w, "failed to store members", "", http.StatusInternalServerError)
+			return
+		}
+		logging.Infof("cluster members are %s", memberNames(request.Members))
+	}
+
+	c.heard = time.Now()
+	c.follow(request.Leader)
+
+	writeJSON(w, heartbeatResponse{Term: c.state.Term, Success: true})
+}
+
+// leaderError writes the error for the membership change sent to the
+// follower, it reports whether the node is not the leader.
+func (c *Cluster) leaderError(w http.ResponseWriter) bool {
+	if c.leader == c.options.Node {
+		return false
+	}
+
+	leader, _ := c.member(c.leader)
+	writeClusterError(w, "the node is not the leader of the cluster", leader.Address, http.StatusConflict)
+
+	return true
+}
+
+func (c *Cluster) joinHandler(w http.ResponseWriter, r *http.Request) {
+	var member ClusterMember
+	if !decodeCluster(w, r, &member) {
+		return
+	}
+
+	if member.Node == "" || member.Address == "" || member.Replication == "" {
+		writeClusterError(w, "node, address and replication are required", "", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leaderError(w) {
+		return
+	}
+
+	members := make([]ClusterMember, 0, len(c.state.Members)+1)
+	for _, m := range c.state.Members {
+		if m.Node != member.Node {
+			members = append(members, m)
+		}
+	}
+	members = append(members, member)
+
+	if !c.changeMembers(w, members) {
+		return
+	}
+	// the new member is not counted as gone until it is heard from
+	c.contacted[member.Node] = time.Now()
+	logging.Infof("node %s has joined the cluster", member.Node)
+
+	writeJSON(w, c.state.Members)
+}
+
+func (c *Cluster) leaveHandler(w http.ResponseWriter, r *http.Request) {
+	var request leaveRequest
+	if !decodeCluster(w, r, &request) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leaderError(w) {
+		return
+	}
+
+	removed, exists := c.member(request.Node)
+	if !exists {
+		writeClusterError(w, fmt.Sprintf("node %s is not a member", request.Node), "", http.StatusNotFound)
+		return
+	}
+
+	members := make([]ClusterMember, 0, len(c.state.Members))
+	for _, m := range c.state.Members {
+		if m.Node != request.Node {
+			members = append(members, m)
+		}
+	}
+
+	if len(members) == 0 {
+		writeClusterError(w, "the last member can not leave the cluster", "", http.StatusConflict)
+		return
+	}
+
+	if !c.changeMembers(w, members) {
+		return
+	}
+	delete(c.contacted, request.Node)
+	logging.Infof("node %s has left the cluster", request.Node)
+
+	// the removed node learns that it is not a member any more
+	// and does not start the elections
+	if removed.Node != c.options.Node {
+		heartbeat := heartbeatRequest{Term: c.state.Term, Leader: c.options.Node, Members: members}
+		go c.heartbeat(context.Background(), removed, heartbeat)
+	}
+
+	writeJSON(w, c.state.Members)
+}
+
+// changeMembers stores the members, the heartbeats send them to the
+// followers. It writes the error if it fails, the lock must be held.
+func (c *Cluster) changeMembers(w http.ResponseWriter, members []ClusterMember) bool {
+	previous := c.state.Members
+	c.state.Members = members
+	if err := c.store(); err != nil {
+		c.state.Members = previous
+		logging.Errorf("failed to store cluster state: %s", err)
+		writeClusterError(w, "failed to store members", "", http.StatusInternalServerError)
+		return false
+	}
+	c.lastHeartbeat = time.Time{}
+
+	return true
+}
+
+// sameMembers reports whether the lists have the same members.
+func sameMembers(a []ClusterMember, b []ClusterMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// memberNames returns the comma-separated names of the members.
+func memberNames(members []ClusterMember) string {
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		names = append(names, m.Node)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// Join asks the member at the address to add the node to the cluster
+// until it is added or the context is done, nothing is asked if the
+// node already knows the members.
+func (c *Cluster) Join(ctx context.Context, address string) {
+	for {
+		c.mu.Lock()
+		joined := len(c.state.Members) > 0
+		c.mu.Unlock()
+		if joined {
+			return
+		}
+
+		err := JoinCluster(ctx, address, c.options.Secret, c.self())
+		if err == nil {
+			logging.Infof("node %s has joined the cluster at %s", c.options.Node, address)
+			return
+		}
+		logging.Warnf("%s, retrying in %s", err, minElectionTimeout)
+
+		select {
+		case <-time.After(minElectionTimeout):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The responses are compressed with gzip or zstd negotiated by the
+// Accept-Encoding header, zstd is preferred when the client accepts
+// both with the same quality. The responses shorter than
+// compressMinSize are sent as they are, the compression does not pay
+// off for them. The request bodies compressed with gzip or zstd are
+// decompressed by the Content-Encoding header.
+
+// compressMinSize is the minimum size of the compressed response.
+const compressMinSize = 1024
+
+// The supported content encodings.
+const (
+	encodingGzip     = "gzip"
+	encodingZstd     = "zstd"
+	encodingIdentity = "identity"
+)
+
+// compressor is the writer of the compressed response.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+var zstdWriters = sync.Pool{New: func() interface{} {
+	// the options are valid, so the error is always nil
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+	return encoder
+}}
+
+// acceptedEncoding returns the best of the supported encodings
+// accepted by the client, the empty string if there is none.
+func acceptedEncoding(r *http.Request) string {
+	qualities := make(map[string]float64)
+	for _, accept := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(accept, ",") {
+			params := strings.Split(part, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			quality := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						quality = q
+					}
+				}
+			}
+			qualities[coding] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range []string{encodingZstd, encodingGzip} {
+		quality, exists := qualities[coding]
+		if !exists {
+			quality, exists = qualities["*"]
+		}
+		if exists && quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+
+	return best
+}
+
+// compressedWriter compresses the response once it is longer
+// than compressMinSize or flushed.
+type compressedWriter struct {
+	http.ResponseWriter
+	encoding   string
+	compressor compressor
+	// buffer has the response before the compression is decided
+	buffer  []byte
+	status  int
+	decided bool
+}
+
+func (w *compressedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressedWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.compressor != nil {
+			return w.compressor.Write(p)
+		}
+
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buffer = append(w.buffer, p...)
+	if len(w.buffer) >= compressMinSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush sends the written part of the response, the streamed
+// responses are compressed from the first flush.
+func (w *compressedWriter) Flush() {
+	if !w.decided {
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+
+	if w.compressor != nil {
+		if err := w.compressor.Flush(); err != nil {
+			return
+		}
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// start sends the header and the buffered response. The response
+// is not compressed if the handler has encoded it itself or the
+// status has no body.
+func (w *compressedWriter) start(compress bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || w.status < http.StatusOK ||
+		w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		compress = false
+	}
+
+	if compress {
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", http.DetectContentType(w.buffer))
+		}
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+
+		switch w.encoding {
+		case encodingZstd:
+			encoder := zstdWriters.Get().(*zstd.Encoder)
+			encoder.Reset(w.ResponseWriter)
+			w.compressor = encoder
+		default:
+			writer := gzipWriters.Get().(*gzip.Writer)
+			writer.Reset(w.ResponseWriter)
+			w.compressor = writer
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buffer := w.buffer
+	w.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+
+	_, err := w.Write(buffer)
+
+	return err
+}
+
+// close sends the rest of the response.
+func (w *compressedWriter) close() error {
+	if !w.decided {
+		return w.start(false)
+	}
+
+	if w.compressor == nil {
+		return nil
+	}
+
+	err := w.compressor.Close()
+	switch compressor := w.compressor.(type) {
+	case *zstd.Encoder:
+		zstdWriters.Put(compressor)
+	case *gzip.Writer:
+		gzipWriters.Put(compressor)
+	}
+	w.compressor = nil
+
+	return err
+}
+
+// decompressedBody returns the reader of the request body
+// decompressed by the content encoding.
+func decompressedBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewReader(body)
+	case encodingZstd:
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	}
+
+	return nil, errUnsupportedEncoding
+}
+
+// errUnsupportedEncoding is returned for the request body
+// compressed with an unsupported encoding.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// compressed decompresses the request bodies and compresses
+// the responses accepted compressed by the clients.
+func compressed(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding != "" && encoding != encodingIdentity {
+			body, err := decompressedBody(encoding, r.Body)
+			if err == errUnsupportedEncoding {
+				writeError(w, "unsupported content encoding "+encoding, http.StatusUnsupportedMediaType)
+				return
+			}
+			if err != nil {
+				writeError(w, "failed to decompress request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+
+		// the upgraded connections are not HTTP responses
+		if r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding = acceptedEncoding(r)
+		if encoding == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		writer := &compressedWriter{ResponseWriter: w, encoding: encoding}
+		h.ServeHTTP(writer, r)
+		if err := writer.close(); err != nil {
+			logging.FromContext(r.Context()).Debugf("failed to write compressed response: %s", err)
+		}
+	})
+}
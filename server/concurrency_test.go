@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+)
+
+// send posts the statement to the handler within the transaction
+// if its identifier is not empty.
+func send(h http.Handler, txID string, text string) (int, string) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(text))
+	r.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion3))
+	if txID != "" {
+		r.Header.Set(transactionHeader, txID)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w.Code, w.Body.String()
+}
+
+// countRows returns the number of the rows selected by the query.
+func countRows(h http.Handler, text string) (int, error) {
+	code, body := send(h, "", text)
+	if code != http.StatusOK {
+		return 0, fmt.Errorf("%s: expected status 200, got %d: %s", text, code, body)
+	}
+
+	var response struct {
+		Rows [][]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return 0, fmt.Errorf("failed to decode %s: %w", body, err)
+	}
+
+	return len(response.Rows), nil
+}
+
+// TestConcurrentRequests runs the statements of the writers and the
+// readers concurrently with the background jobs, it is meant to be
+// run with -race.
+func TestConcurrentRequests(t *testing.T) {
+	const workers, readers, iterations = 8, 4, 30
+
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := engine.Options{
+		ScrubInterval:   time.Millisecond,
+		VacuumInterval:  time.Millisecond,
+		GroupCommitSize: workers,
+		LockTimeout:     10 * time.Second,
+	}
+	db, err := engine.NewDatabase(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(db, nil)
+	query(t, h, `CREATE TABLE shared (id INTEGER, worker INTEGER, name STRING)`)
+
+	errs := make(chan error, workers+readers)
+	done := make(chan struct{})
+	var readWG sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readWG.Add(1)
+		go func() {
+			defer readWG.Done()
+			errs <- read(h, done)
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- work(h, w, iterations)
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	readWG.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if t.Failed() {
+		return
+	}
+
+	// every worker keeps a row of every iteration except
+	// the deleted one of every tenth iteration
+	expected := workers * (iterations - iterations/10)
+	if n, err := countRows(h, `SELECT id FROM shared`); err != nil || n != expected {
+		t.Fatalf("expected %d rows, got %d: %v", expected, n, err)
+	}
+
+	// the data files are consistent with the memory
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = engine.NewDatabase(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if n, err := countRows(Handler(db, nil), `SELECT id FROM shared`); err != nil || n != expected {
+		t.Fatalf("expected %d rows after reload, got %d: %v", expected, n, err)
+	}
+}
+
+// read runs the selections of the shared table and the requests
+// of the server state until done is closed.
+func read(h http.Handler, done <-chan struct{}) error {
+	statements := []string{
+		`SELECT COUNT(*) FROM shared`,
+		`SELECT id, name FROM shared WHERE name == "u"`,
+		`SELECT id FROM shared ORDER BY id DESC`,
+		`SELECT worker, COUNT(*) FROM shared GROUP BY worker`,
+	}
+	for {
+		for _, text := range statements {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+
+			if code, body := send(h, "", text); code != http.StatusOK {
+				return fmt.Errorf("%s: expected status 200, got %d: %s", text, code, body)
+			}
+		}
+
+		for _, target := range []string{"/status", "/admin/tables"} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusOK {
+				return fmt.Errorf("%s: expected status 200, got %d: %s", target, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+// work runs the statements of the worker: the changes of its rows in
+// the shared table, the transactions, the DDL of its own table and the
+// reads of the catalog. Every other worker owns a memory table.
+func work(h http.Handler, w int, iterations int) error {
+	own := "own_" + strconv.Itoa(w)
+	create := `CREATE TABLE `
+	if w%2 == 1 {
+		create = `CREATE MEMORY TABLE `
+	}
+	statements := []string{create + own + ` (id INTEGER)`}
+	for i := 0; i < iterations; i++ {
+		id := strconv.Itoa(w*iterations + i)
+		statements = append(statements,
+			`INSERT INTO shared (id, worker, name) VALUES (`+id+`, `+strconv.Itoa(w)+`, "n")`,
+			`UPDATE shared SET name = "u" WHERE id == `+id,
+			`INSERT INTO `+own+` (id) VALUES (`+id+`)`,
+			`SELECT table_name FROM information_schema_tables`,
+			`SHOW statement_timeout`,
+		)
+		if i%10 == 0 {
+			statements = append(statements, `DELETE FROM shared WHERE id == `+id)
+		}
+	}
+
+	for _, text := range statements {
+		if code, body := send(h, "", text); code != http.StatusOK {
+			return fmt.Errorf("%s: expected status 200, got %d: %s", text, code, body)
+		}
+	}
+
+	selected, err := countRows(h, `SELECT id FROM shared WHERE worker == `+strconv.Itoa(w))
+	if err != nil {
+		return err
+	}
+	if expected := iterations - iterations/10; selected != expected {
+		return fmt.Errorf("worker %d: expected %d rows, got %d", w, expected, selected)
+	}
+
+	// the transaction changes the rows of the worker only
+	code, body := send(h, "", `BEGIN`)
+	if code != http.StatusOK {
+		return fmt.Errorf("BEGIN: expected status 200, got %d: %s", code, body)
+	}
+	var begin struct {
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(body), &begin); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", body, err)
+	}
+	for _, text := range []string{
+		`UPDATE shared SET name = "tx" WHERE worker == ` + strconv.Itoa(w),
+		`DELETE FROM ` + own,
+		`COMMIT`,
+	} {
+		if code, body := send(h, begin.Result, text); code != http.StatusOK {
+			send(h, begin.Result, `ROLLBACK`)
+			return fmt.Errorf("%s: expected status 200, got %d: %s", text, code, body)
+		}
+	}
+
+	if code, body := send(h, "", `ALTER TABLE `+own+` RENAME TO `+own+`_done`); code != http.StatusOK {
+		return fmt.Errorf("RENAME TO: expected status 200, got %d: %s", code, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// csvFormField is the field of the multipart form with the CSV file.
+const csvFormField = "file"
+
+// csvHandler downloads the rows of the table as the CSV and loads the
+// uploaded CSV into the table:
+//
+//	GET /tables/{table}/csv?header=true&delimiter=;&columns=id,name
+//	POST /tables/{table}/csv?header=true
+//
+// The CSV is uploaded as the body or as the file field of the multipart form.
+func csvHandler(db *engine.Database, tableName string, w http.ResponseWriter, r *http.Request) {
+	query, err := copyQuery(tableName, r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Schema(tableName); err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	user := requestUser(r)
+	ctx, finish := db.StartQuery(r.Context(), user, requestClient(r), r.Method+" "+r.URL.Path)
+	defer finish()
+	r = r.WithContext(ctx)
+
+	switch r.Method {
+	case http.MethodGet:
+		query.To = true
+		downloadCopy(db, user, query, w, r)
+	case http.MethodPost:
+		if err := db.Authorize(user, query); err != nil {
+			if redirectToLeader(w, r, err) {
+				return
+			}
+			writeQueryError(w, err)
+			return
+		}
+
+		body, err := csvBody(r)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+
+		copied, err := db.CopyFrom(r.Context(), query, body)
+		if err != nil {
+			if redirectToLeader(w, r, err) {
+				return
+			}
+			writeQueryError(w, err)
+			return
+		}
+		logging.FromContext(r.Context()).Infof("copied %d rows into %s", copied, tableName)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, changeResultV3{copied})
+	default:
+		writeError(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parquetHandler downloads the rows of the table as the Parquet file:
+//
+//	GET /tables/{table}/parquet?columns=id,name
+func parquetHandler(db *engine.Database, tableName string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := copyQuery(tableName, r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.To, query.Format = true, engine.CopyParquet
+
+	if _, err := db.Schema(tableName); err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	user := requestUser(r)
+	ctx, finish := db.StartQuery(r.Context(), user, requestClient(r), r.Method+" "+r.URL.Path)
+	defer finish()
+
+	downloadCopy(db, user, query, w, r.WithContext(ctx))
+}
+
+// exportHandler downloads the rows of the SELECT query sent in the body:
+//
+//	POST /export?format=parquet|csv&header=true&delimiter=;
+func exportHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, fmt.Sprintf("failed to read request body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		parsed, err := db.Parse(string(body))
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		selected, ok := parsed.(*sql.Select)
+		if !ok {
+			writeError(w, "only SELECT queries are exported", http.StatusBadRequest)
+			return
+		}
+
+		query, err := copyQuery(selected.Table, r)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Columns, query.Query, query.To = selected.Columns, selected, true
+		query.Format = engine.CopyFormat(r.URL.Query().Get("format"))
+
+		if _, err := db.Schema(selected.Table); err != nil {
+			writeError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		user := requestUser(r)
+		ctx, finish := db.StartQuery(r.Context(), user, requestClient(r), string(body))
+		defer finish()
+
+		downloadCopy(db, user, query, w, r.WithContext(ctx))
+	}
+}
+
+// downloadCopy writes the rows of COPY ... TO as the attachment.
+func downloadCopy(db *engine.Database, user string, query *engine.Copy, w http.ResponseWriter, r *http.Request) {
+	if err := db.Authorize(user, query); err != nil {
+		if redirectToLeader(w, r, err) {
+			return
+		}
+		writeQueryError(w, err)
+		return
+	}
+
+	name := strings.ToLower(query.Table)
+	switch query.Format {
+	case "", engine.CopyCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		name += ".csv"
+	case engine.CopyParquet:
+		w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+		name += ".parquet"
+	default:
+		writeError(w, fmt.Sprintf("unsupported format %q", query.Format), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if _, err := db.CopyTo(r.Context(), query, w); err != nil {
+		// the status has been sent with the first written row
+		logging.FromContext(r.Context()).Errorf("failed to copy table %s: %s", query.Table, err)
+	}
+}
+
+// loadHandler loads the NDJSON or CSV stream into the table in
+// batches committed one by one:
+//
+//	POST /tables/{table}/load?format=ndjson|csv&header=true&delimiter=;&columns=id,name
+//
+// The format is taken from the content type if it is not given.
+func loadHandler(db *engine.Database, tableName string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := copyQuery(tableName, r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := engine.LoadOptions{Format: engine.LoadFormat(r.URL.Query().Get("format")), Columns: query.Columns, CSV: query.CSVOptions}
+	if options.Format == "" {
+		options.Format = engine.LoadNDJSON
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			options.Format = engine.LoadCSV
+		}
+	}
+
+	if _, err := db.Schema(tableName); err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	user := requestUser(r)
+	ctx, finish := db.StartQuery(r.Context(), user, requestClient(r), r.Method+" "+r.URL.Path)
+	defer finish()
+	r = r.WithContext(ctx)
+
+	if err := db.Authorize(user, &sql.Insert{Table: tableName}); err != nil {
+		if redirectToLeader(w, r, err) {
+			return
+		}
+		writeQueryError(w, err)
+		return
+	}
+
+	loaded, err := db.Load(r.Context(), tableName, r.Body, options)
+	if err != nil {
+		if loaded == 0 && redirectToLeader(w, r, err) {
+			return
+		}
+		writeQueryError(w, fmt.Errorf("failed after %d rows: %w", loaded, err))
+		return
+	}
+	logging.FromContext(r.Context()).Infof("loaded %d rows into %s", loaded, tableName)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, changeResultV3{loaded})
+}
+
+// copyQuery builds the copy of the table from the request parameters.
+func copyQuery(tableName string, r *http.Request) (*engine.Copy, error) {
+	params := r.URL.Query()
+	query := &engine.Copy{Table: tableName}
+
+	if columns := params.Get("columns"); columns != "" {
+		for _, column := range strings.Split(columns, ",") {
+			query.Columns = append(query.Columns, strings.TrimSpace(column))
+		}
+	}
+
+	if header := params.Get("header"); header != "" {
+		var err error
+		query.Header, err = strconv.ParseBool(header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header: %w", err)
+		}
+	}
+
+	if delimiter := params.Get("delimiter"); delimiter != "" {
+		r, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) {
+			return nil, fmt.Errorf("delimiter must be one character, but got %q", delimiter)
+		}
+		query.Delimiter = r
+	}
+
+	return query, nil
+}
+
+// csvBody returns the uploaded CSV, the file of the multipart
+// form or the body of the request.
+func csvBody(r *http.Request) (io.ReadCloser, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.Body, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart form: %w", err)
+	}
+
+	// the parts are streamed, so the file is not buffered
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s field is required", csvFormField)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart form: %w", err)
+		}
+
+		if part.FormName() == csvFormField {
+			return part, nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The SELECT results are paged for the clients that send the page size
+// header. The response has the cursor of the next page in the
+// next_cursor field of the API version 3 and in the next cursor header
+// of all the versions. The same query sent with the cursor header
+// returns the next page, the scan resumes from the position of the
+// cursor instead of skipping the rows of the previous pages.
+//
+//	X-Page-Size: 100
+//	X-Cursor: eyJxIjoiM...
+const (
+	pageSizeHeader   = "X-Page-Size"
+	cursorHeader     = "X-Cursor"
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// wantsPage reports whether the client requests the paged results.
+func wantsPage(r *http.Request) bool {
+	return r.Header.Get(pageSizeHeader) != "" || r.Header.Get(cursorHeader) != ""
+}
+
+// requestPage returns the cursor and the page size of the request,
+// the size of the cursor is used if the request has none.
+func requestPage(r *http.Request) (*engine.Cursor, int, error) {
+	var cursor *engine.Cursor
+	if token := r.Header.Get(cursorHeader); token != "" {
+		var err error
+		if cursor, err = engine.ParseCursor(token); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	size, err := pageParam(r.Header.Get(pageSizeHeader), 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid page size: %w", err)
+	}
+	if size == 0 && cursor != nil {
+		size = cursor.Size
+	}
+	if size == 0 || size > maxRowsLimit {
+		return nil, 0, fmt.Errorf("page size must be from 1 to %d, got %d", maxRowsLimit, size)
+	}
+	if cursor != nil {
+		cursor.Size = size
+	}
+
+	return cursor, size, nil
+}
+
+// pageAndWrite executes the SELECT query selecting the page of the
+// rows and records it in the query history.
+func pageAndWrite(db *engine.Database, tx *engine.Transaction, w http.ResponseWriter, r *http.Request, text string, query *sql.Select) {
+	cursor, size, err := requestPage(r)
+	var rows [][]interface{}
+	var next *engine.Cursor
+	if err == nil {
+		selectPage := db.SelectPageContext
+		if tx != nil {
+			selectPage = tx.SelectPageContext
+		}
+		rows, next, err = selectPage(r.Context(), query, cursor, size)
+	}
+
+	if historyErr := db.RecordQuery(requestClient(r), text, err); historyErr != nil {
+		logging.Errorf("failed to record query: %s", historyErr)
+	}
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	if next != nil {
+		w.Header().Set(nextCursorHeader, next.String())
+	}
+
+	if responseVersion(w) != apiVersion3 {
+		writeQueryResult(w, db, query, rows)
+		return
+	}
+
+	columns, err := db.Columns(query.Table)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	page := selectResultV3{Columns: describeColumns(columns), Rows: typedRows(columns, rows)}
+	if next != nil {
+		page.NextCursor = next.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		logging.Errorf("failed to write result: %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/krasun/gosqldb/engine"
+)
+
+// databaseHeader selects the database of the request,
+// the main one by default.
+const databaseHeader = "X-Database"
+
+// databasesPathPrefix selects the database of the request by the path,
+// /databases/<name>/tables is /tables of the database.
+const databasesPathPrefix = "/databases/"
+
+// databaseRouter passes the requests to the handlers of the databases
+// selected by the header or the path prefix.
+func databaseRouter(main *engine.Database, admission *Admission) http.Handler {
+	type route struct {
+		db      *engine.Database
+		handler http.Handler
+	}
+
+	var mu sync.Mutex
+	// the routes by the database names, the dropped and created
+	// again database gets the new handler
+	routes := map[string]route{engine.MainDatabase: {main, databaseHandler(main, admission)}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(databaseHeader)
+		if strings.HasPrefix(r.URL.Path, databasesPathPrefix) {
+			rest := strings.TrimPrefix(r.URL.Path, databasesPathPrefix)
+			i := strings.Index(rest, "/")
+			if i < 0 {
+				http.NotFound(w, r)
+				return
+			}
+
+			name = rest[:i]
+			r = r.Clone(r.Context())
+			r.URL.Path = rest[i:]
+			r.URL.RawPath = ""
+		}
+
+		name = strings.ToLower(name)
+		if name == "" {
+			name = engine.MainDatabase
+		}
+
+		db := main
+		if catalog := main.Catalog(); catalog != nil {
+			var err error
+			db, err = catalog.Database(name)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		} else if name != engine.MainDatabase {
+			writeError(w, "database "+name+" does not exist", http.StatusNotFound)
+			return
+		}
+
+		mu.Lock()
+		selected, exists := routes[name]
+		if !exists || selected.db != db {
+			selected = route{db, databaseHandler(db, admission)}
+			routes[name] = selected
+		}
+		mu.Unlock()
+
+		selected.handler.ServeHTTP(w, r)
+	})
+}
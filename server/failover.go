@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// FailoverOptions configures the leader election of the node.
+type FailoverOptions struct {
+	// Witness is the URL of the witness that grants the lease.
+	Witness string
+	Secret  string
+	// Node is the name of the node, unique within the pair.
+	Node string
+	// Address is the advertised URL of the HTTP API of the node,
+	// the clients of the other node are redirected to it.
+	Address       string
+	LeaseDuration time.Duration
+}
+
+// leaseClient requests the lease from the witness.
+type leaseClient struct {
+	options FailoverOptions
+	client  *http.Client
+}
+
+// get returns the current lease.
+func (c *leaseClient) get(ctx context.Context) (Lease, error) {
+	lease, _, err := c.do(ctx, http.MethodGet, nil)
+
+	return lease, err
+}
+
+// acquire takes or renews the lease, it returns the lease held by
+// another node and false if the witness has not granted it.
+func (c *leaseClient) acquire(ctx context.Context, term uint64) (Lease, bool, error) {
+	body, err := json.Marshal(leaseRequest{
+		Node:     c.options.Node,
+		Address:  c.options.Address,
+		Term:     term,
+		Duration: c.options.LeaseDuration.String(),
+	})
+	if err != nil {
+		return Lease{}, false, fmt.Errorf("failed to encode lease request: %w", err)
+	}
+
+	return c.do(ctx, http.MethodPost, body)
+}
+
+func (c *leaseClient) do(ctx context.Context, method string, body []byte) (Lease, bool, error) {
+	var lease Lease
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.options.Witness, "/")+"/lease", bytes.NewReader(body))
+	if err != nil {
+		return lease, false, fmt.Errorf("failed to create lease request: %w", err)
+	}
+	if c.options.Secret != "" {
+		request.Header.Set("Authorization", "Bearer "+c.options.Secret)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return lease, false, fmt.Errorf("failed to reach witness: %w", err)
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			logging.Errorf("failed to close witness response: %s", err)
+		}
+	}()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusConflict {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return lease, false, fmt.Errorf("witness has failed with %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&lease); err != nil {
+		return lease, false, fmt.Errorf("failed to decode lease: %w", err)
+	}
+
+	return lease, response.StatusCode == http.StatusOK, nil
+}
+
+// Failover holds the leader lease of the primary and promotes the
+// replica when the primary is gone, until the context is done. The
+// primary renews the lease four times per its duration and fences
+// itself when the lease may expire before the next renewal. The
+// primary that sees the lease of a later term stays fenced, its data
+// may miss the changes of the new leader, so it must be bootstrapped
+// again as the replica.
+func Failover(ctx context.Context, db *engine.Database, options FailoverOptions) {
+	interval := options.LeaseDuration / 4
+	c := &leaseClient{options: options, client: &http.Client{Timeout: interval}}
+	f := &failover{db: db, client: c, interval: interval}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if db.FailoverStatus().Role == engine.RoleReplica {
+			f.follow(ctx)
+		} else {
+			f.lead(ctx)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// failover is the leader election state of the node.
+type failover struct {
+	db       *engine.Database
+	client   *leaseClient
+	interval time.Duration
+	// validUntil is when the held lease expires at the latest
+	validUntil time.Time
+	// superseded is true when another node leads a later term
+	superseded bool
+}
+
+// lead renews the lease of the primary.
+func (f *failover) lead(ctx context.Context) {
+	if f.superseded {
+		return
+	}
+
+	status := f.db.FailoverStatus()
+	requested := time.Now()
+	lease, granted, err := f.client.acquire(ctx, status.Term)
+	switch {
+	case err != nil:
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the lease must not expire before the fence,
+		// and the next renewal may fail as well
+		if status.Role == engine.RolePrimary && !time.Now().Add(2*f.interval).Before(f.validUntil) {
+			f.db.Fence("")
+			logging.Errorf("failed to renew lease of term %d, the writes are fenced: %s", status.Term, err)
+		} else {
+			logging.Warnf("failed to renew lease of term %d: %s", status.Term, err)
+		}
+	case granted:
+		f.validUntil = requested.Add(f.client.options.LeaseDuration)
+		if err := f.db.Lead(lease.Term); err != nil {
+			f.db.Fence("")
+			logging.Errorf("failed to lead term %d, the writes are fenced: %s", lease.Term, err)
+			return
+		}
+
+		if status.Role != engine.RolePrimary || status.Term != lease.Term {
+			logging.Infof("holding lease of term %d, executing the writes", lease.Term)
+		}
+	default:
+		f.db.Fence(lease.Address)
+		if lease.Term > status.Term {
+			f.superseded = true
+			logging.Errorf("node %s at %s leads term %d after term %d of this node, the writes are fenced until the node is bootstrapped again as the replica",
+				lease.Node, lease.Address, lease.Term, status.Term)
+		} else if status.Role == engine.RolePrimary {
+			logging.Errorf("node %s at %s holds lease of term %d, the writes are fenced", lease.Node, lease.Address, lease.Term)
+		}
+	}
+}
+
+// follow records the leader of the replica and takes the expired lease
+// when the replica has not heard from the primary for the lease duration.
+func (f *failover) follow(ctx context.Context) {
+	lease, err := f.client.get(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logging.Warnf("failed to get lease: %s", err)
+		}
+		return
+	}
+
+	if lease.Node != f.client.options.Node {
+		f.db.SetLeader(lease.Address)
+	}
+
+	replica, ok := f.db.ReplicaStatus()
+	if !ok || replica.Connected || time.Since(replica.Heartbeat) < f.client.options.LeaseDuration {
+		return
+	}
+
+	requested := time.Now()
+	lease, granted, err := f.client.acquire(ctx, lease.Term)
+	if err != nil || !granted {
+		return
+	}
+
+	if err := f.db.Promote(lease.Term); err != nil {
+		logging.Errorf("failed to promote replica to primary of term %d: %s", lease.Term, err)
+		return
+	}
+	f.validUntil = requested.Add(f.client.options.LeaseDuration)
+
+	logging.Infof("primary has been gone for %s, the replica is promoted to the primary of term %d after record %d",
+		f.client.options.LeaseDuration, lease.Term, replica.Sequence)
+}
+
+// redirectToLeader redirects the request that changes the data of the node
+// that is not the leader, it reports whether the request has been redirected.
+// The requests within the transactions and the sessions are not redirected,
+// the other node does not have them.
+func redirectToLeader(w http.ResponseWriter, r *http.Request, err error) bool {
+	var notLeader *engine.NotLeaderError
+	if !errors.As(err, &notLeader) || notLeader.Leader == "" {
+		return false
+	}
+
+	if r.Header.Get(transactionHeader) != "" || r.Header.Get(sessionHeader) != "" {
+		return false
+	}
+
+	// 307 keeps the method and the body
+	http.Redirect(w, r, strings.TrimSuffix(notLeader.Leader, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+
+	return true
+}
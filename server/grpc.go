@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// The gRPC service is defined in gosqldb.proto, the generated code is
+// in gosqldb.pb.go and gosqldb_grpc.pb.go, regenerate them with:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative gosqldb.proto
+
+// grpcRowsBatch is the number of rows sent in a single
+// response of the Query stream.
+const grpcRowsBatch = 1000
+
+// grpcCodes are the gRPC status codes by the error codes,
+// the other errors are codes.Unknown.
+var grpcCodes = map[engine.ErrorCode]codes.Code{
+	engine.CodeSyntax:              codes.InvalidArgument,
+	engine.CodeQuery:               codes.InvalidArgument,
+	engine.CodeUndefinedTable:      codes.NotFound,
+	engine.CodeUndefinedColumn:     codes.NotFound,
+	engine.CodeUndefinedObject:     codes.NotFound,
+	engine.CodeDuplicateTable:      codes.AlreadyExists,
+	engine.CodeDuplicateObject:     codes.AlreadyExists,
+	engine.CodeDatatypeMismatch:    codes.InvalidArgument,
+	engine.CodeInvalidParameter:    codes.InvalidArgument,
+	engine.CodeDivisionByZero:      codes.InvalidArgument,
+	engine.CodeInvalidCursor:       codes.InvalidArgument,
+	engine.CodeLimit:               codes.ResourceExhausted,
+	engine.CodeTooManyRequests:     codes.ResourceExhausted,
+	engine.CodeSerialization:       codes.Aborted,
+	engine.CodeDeadlock:            codes.Aborted,
+	engine.CodeLockTimeout:         codes.Aborted,
+	engine.CodeVersionConflict:     codes.Aborted,
+	engine.CodePermission:          codes.PermissionDenied,
+	engine.CodeAuthentication:      codes.Unauthenticated,
+	engine.CodeReadOnly:            codes.FailedPrecondition,
+	engine.CodeReadOnlyTransaction: codes.FailedPrecondition,
+	engine.CodeNoTransaction:       codes.FailedPrecondition,
+	engine.CodeNotLeader:           codes.Unavailable,
+	engine.CodeNotReplicated:       codes.Unavailable,
+	engine.CodeQueryTimeout:        codes.DeadlineExceeded,
+	engine.CodeQueryCanceled:       codes.Canceled,
+	engine.CodeDiskFull:            codes.ResourceExhausted,
+	engine.CodeSchemaChanged:       codes.Aborted,
+}
+
+// grpcService implements the gRPC Database service.
+type grpcService struct {
+	UnimplementedDatabaseServer
+
+	db *engine.Database
+}
+
+// ListenGRPC starts serving the gRPC service on the address,
+// the calls are admitted by the admission control.
+func ListenGRPC(db *engine.Database, addr string, admission *Admission) (*grpc.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %s: %w", addr, err)
+	}
+
+	// the chained interceptors run in order: the failed authentication
+	// is logged with the request identifier and the clients are
+	// admitted by their user names
+	options := append(grpcRequestIDInterceptors(), grpcAuthInterceptors(db)...)
+	options = append(options, grpcAdmissionInterceptors(admission)...)
+	server := grpc.NewServer(options...)
+	RegisterDatabaseServer(server, &grpcService{db: db})
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logging.Errorf("gRPC server failed: %s", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// StopGRPC waits for the calls in progress until the context
+// is done, then the remaining calls are canceled.
+func StopGRPC(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+// Execute executes the statement that does not return rows.
+func (s *grpcService) Execute(ctx context.Context, request *ExecuteRequest) (*ExecuteResponse, error) {
+	tx, query, err := s.statement(ctx, request.Sql, request.Params, request.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := rowSource(s.db, tx, query); ok {
+		return nil, grpcstatus.Error(codes.InvalidArgument, "SELECT is executed by Query")
+	}
+
+	if err := s.db.Authorize(contextUser(ctx), query); err != nil {
+		s.record(ctx, request.Sql, err)
+		return nil, grpcError(err)
+	}
+
+	ctx, finish := s.db.StartQuery(ctx, contextUser(ctx), s.client(ctx), request.Sql)
+	defer finish()
+
+	var result interface{}
+	if tx != nil {
+		result, err = tx.ExecuteContext(ctx, query)
+	} else {
+		result, err = s.db.ExecuteContext(ctx, query)
+	}
+	s.record(ctx, request.Sql, err)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &ExecuteResponse{}
+	switch r := result.(type) {
+	case nil:
+	case int:
+		response.AffectedRows = int64(r)
+	case fmt.Stringer:
+		response.Result = r.String()
+	default:
+		response.Result = fmt.Sprint(r)
+	}
+
+	return response, nil
+}
+
+// Query streams the selected rows in batches.
+func (s *grpcService) Query(request *QueryRequest, stream Database_QueryServer) error {
+	tx, query, err := s.statement(stream.Context(), request.Sql, request.Params, request.TransactionId)
+	if err != nil {
+		return err
+	}
+
+	each, ok := rowSource(s.db, tx, query)
+	if !ok {
+		return grpcstatus.Error(codes.InvalidArgument, "only SELECT is executed by Query")
+	}
+
+	if err := s.db.Authorize(contextUser(stream.Context()), query); err != nil {
+		s.record(stream.Context(), request.Sql, err)
+		return grpcError(err)
+	}
+
+	columns, err := s.db.ResultColumns(query)
+	if err != nil {
+		return grpcstatus.Error(codes.NotFound, err.Error())
+	}
+
+	header := &QueryResponse{Columns: make([]*Column, len(columns))}
+	for i, column := range columns {
+		columnType := ColumnType_COLUMN_TYPE_STRING
+		if column.Type == sql.TypeInteger {
+			columnType = ColumnType_COLUMN_TYPE_INTEGER
+		}
+		header.Columns[i] = &Column{Name: engine.DisplayName(column.Name), Type: columnType}
+	}
+	if err := stream.Send(header); err != nil {
+		return err
+	}
+
+	ctx, finish := s.db.StartQuery(stream.Context(), contextUser(stream.Context()), s.client(stream.Context()), request.Sql)
+	defer finish()
+
+	batch := &QueryResponse{}
+	err = each(ctx, func(row []interface{}) error {
+		batch.Rows = append(batch.Rows, grpcRow(row))
+		if len(batch.Rows) < grpcRowsBatch {
+			return nil
+		}
+
+		err := stream.Send(batch)
+		batch = &QueryResponse{}
+
+		return err
+	})
+	if err == nil && len(batch.Rows) > 0 {
+		err = stream.Send(batch)
+	}
+	s.record(stream.Context(), request.Sql, err)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	return nil
+}
+
+// BeginTx starts the transaction.
+func (s *grpcService) BeginTx(ctx context.Context, request *BeginTxRequest) (*BeginTxResponse, error) {
+	var isolation engine.IsolationLevel
+	if request.IsolationLevel != "" {
+		var err error
+		isolation, err = engine.ParseIsolationLevel(request.IsolationLevel)
+		if err != nil {
+			return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	tx, err := s.db.Begin(isolation)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	tx.User = contextUser(ctx)
+
+	return &BeginTxResponse{TransactionId: tx.ID}, nil
+}
+
+// Commit commits the transaction.
+func (s *grpcService) Commit(ctx context.Context, request *CommitRequest) (*CommitResponse, error) {
+	tx, err := s.transaction(ctx, request.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &CommitResponse{}, nil
+}
+
+// Rollback rolls the transaction back.
+func (s *grpcService) Rollback(ctx context.Context, request *RollbackRequest) (*RollbackResponse, error) {
+	tx, err := s.transaction(ctx, request.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Rollback(); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &RollbackResponse{}, nil
+}
+
+// transaction returns the active transaction, it can be used
+// only by the user who has started it.
+func (s *grpcService) transaction(ctx context.Context, id string) (*engine.Transaction, error) {
+	tx, err := s.db.Transaction(id)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.NotFound, err.Error())
+	}
+
+	if tx.User != contextUser(ctx) {
+		return nil, grpcstatus.Errorf(codes.NotFound, "transaction %s does not exist", id)
+	}
+
+	return tx, nil
+}
+
+// statement parses the query, binds the parameters and returns
+// the transaction of the request, nil if there is none.
+func (s *grpcService) statement(ctx context.Context, text string, params []*Value, txID string) (*engine.Transaction, sql.Statement, error) {
+	var tx *engine.Transaction
+	if txID != "" {
+		var err error
+		tx, err = s.transaction(ctx, txID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(params) == 0 {
+		query, err := s.db.Parse(text)
+		if err != nil {
+			return nil, nil, grpcError(fmt.Errorf("failed to parse query: %w", err))
+		}
+
+		return tx, query, nil
+	}
+
+	prepared, err := engine.NewPreparedStatement(text)
+	if err != nil {
+		return nil, nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+	}
+
+	args := make([]interface{}, len(params))
+	for i, param := range params {
+		switch v := param.Kind.(type) {
+		case *Value_Integer:
+			args[i] = int(v.Integer)
+		case *Value_String_:
+			args[i] = v.String_
+		default:
+			return nil, nil, grpcstatus.Errorf(codes.InvalidArgument, "parameter $%d has no value", i+1)
+		}
+	}
+
+	query, err := prepared.Bind(args...)
+	if err != nil {
+		return nil, nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return tx, query, nil
+}
+
+// client describes the client of the call.
+func (s *grpcService) client(ctx context.Context) string {
+	client := "grpc"
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+	}
+
+	return clientName(contextUser(ctx), client)
+}
+
+// record records the query in the query history.
+func (s *grpcService) record(ctx context.Context, text string, err error) {
+	if historyErr := s.db.RecordQuery(s.client(ctx), text, err); historyErr != nil {
+		logging.Errorf("failed to record query: %s", historyErr)
+	}
+}
+
+// grpcRow converts the row values.
+func grpcRow(row []interface{}) *Row {
+	values := make([]*Value, len(row))
+	for i, value := range row {
+		switch v := value.(type) {
+		case int:
+			values[i] = &Value{Kind: &Value_Integer{Integer: int64(v)}}
+		case string:
+			values[i] = &Value{Kind: &Value_String_{String_: v}}
+		default:
+			values[i] = &Value{}
+		}
+	}
+
+	return &Row{Values: values}
+}
+
+// grpcError converts the query error to the status error.
+func grpcError(err error) error {
+	if _, ok := grpcstatus.FromError(err); ok {
+		return err
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return grpcstatus.Error(codes.Canceled, err.Error())
+	}
+
+	_, classified := queryErrorCode(err)
+	code, exists := grpcCodes[classified.Code]
+	if !exists {
+		code = codes.Unknown
+	}
+
+	return grpcstatus.Error(code, err.Error())
+}
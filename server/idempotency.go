@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// idempotencyKeyHeader is the header of the key the clients attach to
+// the statements they may retry, the result of the statement is kept
+// for the idempotency window and returned again to the retries with
+// the same key instead of executing the statement again.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayedHeader marks the responses returned again.
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength limits the keys sent by the clients.
+const maxIdempotencyKeyLength = 255
+
+// idempotencySweepInterval is the pause between
+// the removals of the expired results.
+const idempotencySweepInterval = time.Minute
+
+// retriedErrors are the codes of the errors that may not happen again,
+// the statements failed with them are executed again by the retries.
+var retriedErrors = map[engine.ErrorCode]bool{
+	engine.CodeTooManyRequests: true,
+	engine.CodeSerialization:   true,
+	engine.CodeDeadlock:        true,
+	engine.CodeLockTimeout:     true,
+	engine.CodeQueryTimeout:    true,
+	engine.CodeQueryCanceled:   true,
+	engine.CodeNotLeader:       true,
+	engine.CodeNotReplicated:   true,
+	engine.CodeReadOnly:        true,
+	engine.CodeDiskFull:        true,
+	engine.CodeSchemaChanged:   true,
+}
+
+// maxIdempotentResults limits the results kept within the window,
+// the result that expires first is removed to keep a new one.
+const maxIdempotentResults = 10000
+
+// idempotencyStore keeps the results of the statements of
+// a database by the users and the idempotency keys.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	results map[string]*idempotentResult
+	swept   time.Time
+}
+
+// idempotentResult is the response of the statement,
+// it is incomplete while the statement is executed.
+type idempotentResult struct {
+	// query is the hash of the statement and its parameters,
+	// the key can not be reused for another statement
+	query    [sha256.Size]byte
+	complete bool
+	status   int
+	// contentType is the only header returned again, the others
+	// are set by the handlers of every request
+	contentType string
+	body        []byte
+	// expires is the end of the window after the execution
+	expires time.Time
+}
+
+// newIdempotencyStore returns the empty store.
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{results: make(map[string]*idempotentResult)}
+}
+
+// begin returns the writer that records the response of the statement,
+// nil if the response has been written: the result returned again or
+// the error of the invalid, the reused or the concurrently used key.
+func (s *idempotencyStore) begin(w http.ResponseWriter, r *http.Request, key string, text string, params []interface{}, window time.Duration) *idempotentWriter {
+	if len(key) > maxIdempotencyKeyLength || !printable(key) {
+		writeError(w, "idempotency key must be up to 255 printable ASCII characters", http.StatusBadRequest)
+		return nil
+	}
+
+	// the keys of the users do not clash
+	key = requestUser(r) + "\x00" + key
+	query, err := statementHash(text, params)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	s.sweep(now)
+	result, exists := s.results[key]
+	if exists && result.complete && !result.expires.After(now) {
+		exists = false
+	}
+	if !exists {
+		if _, kept := s.results[key]; !kept && len(s.results) >= maxIdempotentResults && !s.evict() {
+			s.mu.Unlock()
+			writeError(w, "too many statements with idempotency keys in progress", http.StatusServiceUnavailable)
+			return nil
+		}
+		result = &idempotentResult{query: query}
+		s.results[key] = result
+	}
+	var replayed idempotentResult
+	if exists {
+		replayed = *result
+	}
+	s.mu.Unlock()
+
+	switch {
+	case !exists:
+		return &idempotentWriter{ResponseWriter: w, store: s, key: key, result: result, window: window}
+	case replayed.query != query:
+		writeError(w, "idempotency key has been used for another statement", http.StatusUnprocessableEntity)
+	case !replayed.complete:
+		writeError(w, "statement with the same idempotency key is in progress", http.StatusConflict)
+	default:
+		if replayed.contentType != "" {
+			w.Header().Set("Content-Type", replayed.contentType)
+		}
+		w.Header().Set(idempotentReplayedHeader, "true")
+		w.WriteHeader(replayed.status)
+		if _, err := w.Write(replayed.body); err != nil {
+			logging.FromContext(r.Context()).Errorf("failed to write replayed result: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// statementHash returns the hash of the statement text and
+// its bound parameters.
+func statementHash(text string, params []interface{}) ([sha256.Size]byte, error) {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to encode params: %w", err)
+	}
+
+	return sha256.Sum256([]byte(text + "\x00" + string(encoded))), nil
+}
+
+// evict removes the complete result that expires first,
+// false if all the results are incomplete.
+func (s *idempotencyStore) evict() bool {
+	var first string
+	for key, result := range s.results {
+		if result.complete && (first == "" || result.expires.Before(s.results[first].expires)) {
+			first = key
+		}
+	}
+	if first == "" {
+		return false
+	}
+	delete(s.results, first)
+
+	return true
+}
+
+// sweep removes the expired results, at most once per the interval.
+func (s *idempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < idempotencySweepInterval {
+		return
+	}
+	s.swept = now
+
+	for key, result := range s.results {
+		if result.complete && !result.expires.After(now) {
+			delete(s.results, key)
+		}
+	}
+}
+
+// idempotentWriter records the response of the statement.
+type idempotentWriter struct {
+	http.ResponseWriter
+	store  *idempotencyStore
+	key    string
+	result *idempotentResult
+	window time.Duration
+	status int
+	body   bytes.Buffer
+	// retried is set for the errors the retries
+	// execute the statement again after
+	retried bool
+}
+
+// WriteHeader records the status.
+func (w *idempotentWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body.
+func (w *idempotentWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+
+	return w.ResponseWriter.Write(b)
+}
+
+// fail marks the statement failed with the error for the retries to
+// execute it again if the error may not happen again.
+func (w *idempotentWriter) fail(err error) {
+	w.retried = retriedErrors[engine.Classify(err).Code]
+}
+
+// finish keeps the result of the executed statement, only the success
+// and the client errors that happen again are kept. The statements
+// rejected before the execution, failed by the server or by the errors
+// that may not happen again are executed again by the retries.
+func (w *idempotentWriter) finish() {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+
+	if w.retried || !keptStatus(w.status) {
+		delete(w.store.results, w.key)
+		return
+	}
+
+	w.result.complete = true
+	w.result.status = w.status
+	w.result.contentType = w.Header().Get("Content-Type")
+	w.result.body = w.body.Bytes()
+	w.result.expires = time.Now().Add(w.window)
+}
+
+// keptStatus reports whether the response with the status is returned
+// again to the retries, the statuses of the errors that may not happen
+// again are not.
+func keptStatus(status int) bool {
+	switch status {
+	case 0, http.StatusRequestTimeout, http.StatusConflict, http.StatusMisdirectedRequest, http.StatusTooManyRequests:
+		return false
+	}
+
+	return status < http.StatusInternalServerError
+}
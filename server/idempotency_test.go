@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+)
+
+func TestIdempotencyKeyWithParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := engine.NewDatabase(dir, engine.Options{IdempotencyWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h := Handler(db, nil)
+	query(t, h, `CREATE TABLE t (id INTEGER)`)
+
+	insert := func(params string) *httptest.ResponseRecorder {
+		body := `{"sql": "INSERT INTO t (id) VALUES ($1)", "params": ` + params + `}`
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion3))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(idempotencyKeyHeader, "k")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w
+	}
+
+	if w := insert(`[1]`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := insert(`[1]`); w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("expected the replayed result, got %d: %s", w.Code, w.Body)
+	}
+	if w := insert(`[2]`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 for the other params, got %d: %s", w.Code, w.Body)
+	}
+
+	if n, err := countRows(h, `SELECT id FROM t`); err != nil || n != 1 {
+		t.Errorf("expected 1 row, got %d: %v", n, err)
+	}
+}
+
+func TestIdempotencyRetriedErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+		kept   bool
+	}{
+		{http.StatusOK, nil, true},
+		{http.StatusBadRequest, nil, true},
+		{http.StatusConflict, nil, false},
+		{http.StatusRequestTimeout, nil, false},
+		{http.StatusMisdirectedRequest, nil, false},
+		{http.StatusServiceUnavailable, nil, false},
+		// the older API versions get 400 for all the query errors
+		{http.StatusBadRequest, engine.ErrDeadlock, false},
+		{http.StatusBadRequest, engine.ErrQueryTimeout, false},
+	}
+
+	for _, test := range tests {
+		s := newIdempotencyStore()
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		recorder := s.begin(httptest.NewRecorder(), r, "k", `INSERT INTO t (id) VALUES (1)`, nil, time.Hour)
+		if test.err != nil {
+			recorder.fail(test.err)
+		}
+		recorder.WriteHeader(test.status)
+		recorder.finish()
+
+		if kept := len(s.results) == 1; kept != test.kept {
+			t.Errorf("%d %v: expected kept %t, got %t", test.status, test.err, test.kept, kept)
+		}
+	}
+}
+
+func TestIdempotencyKeyWithinTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosqldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := engine.NewDatabase(dir, engine.Options{IdempotencyWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h := Handler(db, nil)
+	query(t, h, `CREATE TABLE t (id INTEGER)`)
+	var begin struct {
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal(query(t, h, `BEGIN`).Body.Bytes(), &begin); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`INSERT INTO t (id) VALUES (1)`))
+	r.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion3))
+	r.Header.Set(transactionHeader, begin.Result)
+	r.Header.Set(idempotencyKeyHeader, "k")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyStoreEvict(t *testing.T) {
+	s := newIdempotencyStore()
+	now := time.Now()
+	s.results["late"] = &idempotentResult{complete: true, expires: now.Add(time.Hour)}
+	s.results["early"] = &idempotentResult{complete: true, expires: now.Add(time.Minute)}
+	s.results["running"] = &idempotentResult{}
+
+	for _, expected := range []string{"early", "late"} {
+		if !s.evict() {
+			t.Fatalf("expected %s to be evicted", expected)
+		}
+		if _, exists := s.results[expected]; exists {
+			t.Errorf("expected %s to be evicted", expected)
+		}
+	}
+	if s.evict() {
+		t.Error("expected the incomplete result to be kept")
+	}
+}
@@ -0,0 +1,687 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The PostgreSQL wire protocol listener lets psql and the PostgreSQL
+// drivers connect to the database. It supports the version 3.0 startup
+// with the clear text password authentication, once there are users,
+// and the simple query protocol, the values are
+// sent in the text format. The extended query protocol is rejected, so
+// the drivers must be configured to use the simple protocol, for example
+// with default_query_exec_mode=simple_protocol in pgx. Every connection
+// has its own session.
+
+// Protocol codes of the startup message.
+const (
+	pgProtocolVersion = 196608
+	pgSSLRequest      = 80877103
+	pgGSSENCRequest   = 80877104
+	pgCancelRequest   = 80877102
+)
+
+// pgMaxMessageSize limits the size of the client messages.
+const pgMaxMessageSize = 1 << 24
+
+// Type OIDs of the column types.
+const (
+	pgTypeInt8 = 20
+	pgTypeText = 25
+)
+
+// pgServerVersion is reported to the clients, some of them
+// check it to choose the supported features.
+const pgServerVersion = "14.0 (gosqldb)"
+
+// PostgresServer accepts the PostgreSQL protocol connections.
+type PostgresServer struct {
+	db        *engine.Database
+	admission *Admission
+	listener  net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// ListenPostgres starts accepting the PostgreSQL protocol
+// connections on the address, the queries are admitted by
+// the admission control.
+func ListenPostgres(db *engine.Database, addr string, admission *Admission) (*PostgresServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %s: %w", addr, err)
+	}
+
+	s := &PostgresServer{db: db, admission: admission, listener: listener, conns: make(map[net.Conn]struct{})}
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *PostgresServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+
+			logging.Errorf("failed to accept PostgreSQL connection: %s", err)
+			// the descriptors may be exhausted
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			checkConnClose(conn)
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go func() {
+			err := s.handle(conn)
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				// the connection is closed by Close
+				return
+			}
+
+			if err != nil && err != io.EOF {
+				logging.Errorf("PostgreSQL connection %s failed: %s", conn.RemoteAddr(), err)
+			}
+			delete(s.conns, conn)
+			checkConnClose(conn)
+		}()
+	}
+}
+
+// Close stops accepting the connections and closes the open ones,
+// their transactions are rolled back with the sessions.
+func (s *PostgresServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		checkConnClose(conn)
+	}
+
+	return s.listener.Close()
+}
+
+func checkConnClose(conn net.Conn) {
+	if err := conn.Close(); err != nil {
+		logging.Errorf("failed to close connection %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// pgConn is the client connection.
+type pgConn struct {
+	db        *engine.Database
+	admission *Admission
+	conn      net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	session   *engine.Session
+	// user is the authenticated user name or token principal,
+	// empty without authentication
+	user string
+}
+
+// handle serves the connection until the client terminates it.
+func (s *PostgresServer) handle(conn net.Conn) error {
+	c := &pgConn{db: s.db, admission: s.admission, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	err := c.startup()
+	if err != nil || c.session == nil {
+		return err
+	}
+	defer func() {
+		if err := c.db.CloseSession(c.session.ID); err != nil {
+			logging.Debugf("failed to close session %s: %s", c.session.ID, err)
+		}
+	}()
+	logging.Debugf("PostgreSQL connection from %s, session %s", conn.RemoteAddr(), c.session.ID)
+
+	return c.serve()
+}
+
+// startup negotiates the protocol and opens the session,
+// the session is nil if the client has not started.
+func (c *pgConn) startup() error {
+	body, err := c.readStartupMessage()
+	if err != nil {
+		return err
+	}
+
+	for code := binary.BigEndian.Uint32(body); code != pgProtocolVersion; code = binary.BigEndian.Uint32(body) {
+		switch code {
+		case pgSSLRequest, pgGSSENCRequest:
+			// neither is supported, the client continues without encryption
+			if _, err := c.conn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case pgCancelRequest:
+			// the queries can not be canceled
+			return nil
+		default:
+			c.sendError("FATAL", "0A000", fmt.Sprintf("unsupported protocol version %d.%d", code>>16, code&0xffff), -1)
+			return c.w.Flush()
+		}
+
+		body, err = c.readStartupMessage()
+		if err != nil {
+			return err
+		}
+	}
+
+	params := strings.Split(string(body[4:]), "\x00")
+	userName, database := "", ""
+	for i := 0; i+1 < len(params) && params[i] != ""; i += 2 {
+		logging.Debugf("PostgreSQL startup parameter %s = %s", params[i], params[i+1])
+		switch params[i] {
+		case "user":
+			userName = params[i+1]
+		case "database":
+			database = params[i+1]
+		}
+	}
+
+	if c.db.AuthenticationRequired() {
+		authenticated, err := c.authenticate(userName)
+		if err != nil || !authenticated {
+			return err
+		}
+	}
+
+	// the clients send the user name as the database by default,
+	// so the unknown databases are the main one
+	if catalog := c.db.Catalog(); catalog != nil {
+		if db, err := catalog.Database(database); err == nil {
+			c.db = db
+		}
+	}
+
+	session, err := c.db.OpenUserSession(c.user)
+	if err != nil {
+		c.sendError("FATAL", "XX000", err.Error(), -1)
+		return c.w.Flush()
+	}
+	c.session = session
+
+	c.send('R', new(pgMessage).int32(0))
+	for _, param := range [][2]string{
+		{"server_version", pgServerVersion},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		c.send('S', new(pgMessage).string(param[0]).string(param[1]))
+	}
+
+	secret := make([]byte, 4)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("failed to generate secret key: %w", err)
+	}
+	c.send('K', new(pgMessage).int32(0).bytes(secret))
+	c.sendReady()
+
+	return c.w.Flush()
+}
+
+// authenticate asks the client for the clear text password or the
+// API token, it returns false if the password is wrong.
+func (c *pgConn) authenticate(userName string) (bool, error) {
+	c.send('R', new(pgMessage).int32(3))
+	if err := c.w.Flush(); err != nil {
+		return false, err
+	}
+
+	kind, body, err := c.readMessage()
+	if err != nil {
+		return false, err
+	}
+
+	if kind != 'p' {
+		c.sendError("FATAL", "08P01", fmt.Sprintf("expected password message, got %q", kind), -1)
+		return false, c.w.Flush()
+	}
+
+	principal, err := authenticatePassword(c.db, userName, strings.TrimSuffix(string(body), "\x00"))
+	if err != nil {
+		c.sendError("FATAL", "28P01", fmt.Sprintf("password authentication failed for user %q", userName), -1)
+		return false, c.w.Flush()
+	}
+	c.user = principal
+
+	return true, nil
+}
+
+// readStartupMessage reads the message without the type byte.
+func (c *pgConn) readStartupMessage() ([]byte, error) {
+	var size int32
+	if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	if size < 8 || size > 10000 {
+		return nil, fmt.Errorf("invalid startup message size %d", size)
+	}
+
+	body := make([]byte, size-4)
+	_, err := io.ReadFull(c.r, body)
+
+	return body, err
+}
+
+// serve executes the client queries until the client terminates.
+func (c *pgConn) serve() error {
+	// the extended protocol messages are skipped
+	// after the error until the client syncs
+	skipping := false
+	for {
+		kind, body, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case 'Q':
+			skipping = false
+			if !c.query(strings.TrimSuffix(string(body), "\x00")) {
+				return c.w.Flush()
+			}
+			c.sendReady()
+		case 'X':
+			return nil
+		case 'S':
+			skipping = false
+			c.sendReady()
+		case 'H':
+		case 'P', 'B', 'D', 'E', 'C', 'F':
+			if !skipping {
+				c.sendError("ERROR", "0A000", "extended query protocol is not supported, use simple queries", -1)
+				skipping = true
+			}
+		default:
+			c.sendError("FATAL", "08P01", fmt.Sprintf("unexpected message %q", kind), -1)
+			return c.w.Flush()
+		}
+
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *pgConn) readMessage() (byte, []byte, error) {
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size int32
+	if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+		return 0, nil, err
+	}
+
+	if size < 4 || size > pgMaxMessageSize {
+		return 0, nil, fmt.Errorf("invalid message size %d", size)
+	}
+
+	body := make([]byte, size-4)
+	_, err = io.ReadFull(c.r, body)
+
+	return kind, body, err
+}
+
+// query executes the simple query, the trailing semicolon is
+// optional as in psql. It returns false if the connection must be
+// closed.
+func (c *pgConn) query(text string) bool {
+	text = strings.TrimRight(strings.TrimSpace(text), ";")
+	if strings.TrimSpace(text) == "" {
+		c.send('I', new(pgMessage))
+		return true
+	}
+
+	// the session expires as the HTTP ones if the connection is idle
+	if _, err := c.db.Session(c.session.ID); err != nil {
+		c.sendError("FATAL", "57P01", err.Error(), -1)
+		return false
+	}
+
+	query, err := c.db.Parse(text)
+	if err != nil {
+		c.sendQueryError(text, err)
+		return true
+	}
+
+	query = c.session.Resolve(query)
+	err = c.session.Authorize(c.user, query)
+	var result interface{}
+	if err == nil {
+		result, err = c.execute(text, query)
+	}
+	if historyErr := c.db.RecordQuery(clientName(c.user, c.conn.RemoteAddr().String()), text, err); historyErr != nil {
+		logging.Errorf("failed to record query: %s", historyErr)
+	}
+	if err != nil {
+		c.sendQueryError(text, err)
+		return true
+	}
+
+	if err := c.sendResult(query, result); err != nil {
+		c.sendError("ERROR", "XX000", err.Error(), -1)
+	}
+
+	return true
+}
+
+// execute executes the admitted query within the session, the
+// cancel requests are not supported, so the query is canceled only
+// by KILL or the statement timeout.
+func (c *pgConn) execute(text string, query sql.Statement) (interface{}, error) {
+	addr := c.conn.RemoteAddr().String()
+	release, err := c.admission.admit(context.Background(), admissionClient(c.user, addr))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if use, ok := query.(*engine.UseDatabase); ok {
+		return nil, c.use(use.Name)
+	}
+
+	ctx := logging.NewContext(context.Background(), logging.With("session_id", c.session.ID))
+	ctx, finish := c.db.StartQuery(ctx, c.user, clientName(c.user, addr), text)
+	defer finish()
+
+	return c.session.ExecuteContext(ctx, nil, query)
+}
+
+// use switches the connection to the database, the session of the
+// previous database is closed with its transaction.
+func (c *pgConn) use(name string) error {
+	catalog := c.db.Catalog()
+	if catalog == nil {
+		return fmt.Errorf("database %s does not exist", name)
+	}
+
+	db, err := catalog.Database(name)
+	if err != nil {
+		return err
+	}
+
+	session, err := db.OpenUserSession(c.user)
+	if err != nil {
+		return err
+	}
+
+	if err := c.db.CloseSession(c.session.ID); err != nil {
+		logging.Errorf("failed to close session %s: %s", c.session.ID, err)
+	}
+	c.db, c.session = db, session
+
+	return nil
+}
+
+// sendResult sends the rows and the command tag of the statement.
+func (c *pgConn) sendResult(query sql.Statement, result interface{}) error {
+	switch q := query.(type) {
+	case *sql.Select, *engine.OrderedSelect, *engine.GroupedSelect, *engine.AsOfSelect:
+		columns, err := c.db.ResultColumns(q)
+		if err != nil {
+			return err
+		}
+
+		rows := result.([][]interface{})
+		c.sendRowDescription(columns)
+		for _, row := range rows {
+			c.sendDataRow(row)
+		}
+		c.sendComplete(fmt.Sprintf("SELECT %d", len(rows)))
+	case *engine.CountRows:
+		c.sendRowDescription([]engine.ColumnDef{{Name: "count", Type: sql.TypeInteger}})
+		c.sendDataRow(result.([][]interface{})[0])
+		c.sendComplete("SELECT 1")
+	case *sql.Insert:
+		c.sendComplete(fmt.Sprintf("INSERT 0 %d", result.(int)))
+	case *sql.Update, *engine.UpdateIfVersion:
+		c.sendComplete(fmt.Sprintf("UPDATE %d", result.(int)))
+	case *sql.Delete, *engine.DeleteIfVersion:
+		c.sendComplete(fmt.Sprintf("DELETE %d", result.(int)))
+	case *engine.Copy:
+		c.sendComplete(fmt.Sprintf("COPY %d", result.(int)))
+	case *engine.CreateToken:
+		c.sendRowDescription([]engine.ColumnDef{{Name: "token", Type: sql.TypeString}})
+		c.sendDataRow([]interface{}{result})
+		c.sendComplete("CREATE TOKEN")
+	case *engine.ShowIsolationLevel:
+		c.sendRowDescription([]engine.ColumnDef{{Name: "transaction_isolation", Type: sql.TypeString}})
+		c.sendDataRow([]interface{}{fmt.Sprint(result)})
+		c.sendComplete("SHOW")
+	case *engine.ShowCreateTable:
+		c.sendRowDescription([]engine.ColumnDef{{Name: "create_statement", Type: sql.TypeString}})
+		c.sendDataRow([]interface{}{result})
+		c.sendComplete("SHOW")
+	case *engine.ShowSetting:
+		c.sendRowDescription([]engine.ColumnDef{{Name: q.Name, Type: sql.TypeString}})
+		c.sendDataRow([]interface{}{result})
+		c.sendComplete("SHOW")
+	case *engine.Explain:
+		c.sendRowDescription([]engine.ColumnDef{{Name: "QUERY PLAN", Type: sql.TypeString}})
+		lines := strings.Split(strings.TrimSuffix(result.(fmt.Stringer).String(), "\n"), "\n")
+		for _, line := range lines {
+			c.sendDataRow([]interface{}{line})
+		}
+		c.sendComplete("EXPLAIN")
+	default:
+		c.sendComplete(pgCommandTag(query))
+	}
+
+	return nil
+}
+
+// pgCommandTag returns the tag of the statements without rows.
+func pgCommandTag(query sql.Statement) string {
+	switch query.(type) {
+	case *engine.Begin:
+		return "BEGIN"
+	case *engine.Commit:
+		return "COMMIT"
+	case *engine.Rollback, *engine.RollbackToSavepoint:
+		return "ROLLBACK"
+	case *engine.Savepoint:
+		return "SAVEPOINT"
+	case *engine.ReleaseSavepoint:
+		return "RELEASE"
+	case *engine.SetTransaction, *engine.SetSessionIsolation, *engine.SetReadOnly, *engine.SetSearchPath, *engine.SetSetting:
+		return "SET"
+	case *engine.CreateSchema:
+		return "CREATE SCHEMA"
+	case *engine.DropSchema:
+		return "DROP SCHEMA"
+	case *engine.CreateTrigger:
+		return "CREATE TRIGGER"
+	case *engine.DropTrigger:
+		return "DROP TRIGGER"
+	case *engine.CreateSequence:
+		return "CREATE SEQUENCE"
+	case *engine.DropSequence:
+		return "DROP SEQUENCE"
+	case *engine.CreateDatabase:
+		return "CREATE DATABASE"
+	case *engine.DropDatabase:
+		return "DROP DATABASE"
+	case *engine.UseDatabase:
+		return "USE"
+	case *sql.CreateTable, *engine.CreatePartitionedTable, *engine.CreateVersionedTable, *engine.CreateMemoryTable:
+		return "CREATE TABLE"
+	case *sql.DropTable:
+		return "DROP TABLE"
+	case *engine.DropPartition, *engine.AlterColumnMask, *engine.RenameTable:
+		return "ALTER TABLE"
+	case *engine.CreateUser:
+		return "CREATE ROLE"
+	case *engine.AlterUser:
+		return "ALTER ROLE"
+	case *engine.DropUser:
+		return "DROP ROLE"
+	case *engine.Grant:
+		return "GRANT"
+	case *engine.Revoke:
+		return "REVOKE"
+	case *engine.DropToken:
+		return "DROP TOKEN"
+	case *engine.Kill:
+		return "KILL"
+	case *engine.Backup:
+		return "BACKUP"
+	case *engine.Analyze:
+		return "ANALYZE"
+	case *engine.Flashback:
+		return "FLASHBACK"
+	case *engine.Comment:
+		return "COMMENT"
+	}
+
+	return "OK"
+}
+
+func (c *pgConn) sendRowDescription(columns []engine.ColumnDef) {
+	m := new(pgMessage).int16(len(columns))
+	for _, column := range columns {
+		oid, size := pgTypeText, -1
+		if column.Type == sql.TypeInteger {
+			oid, size = pgTypeInt8, 8
+		}
+		m.string(engine.DisplayName(column.Name)).int32(0).int16(0).int32(oid).int16(size).int32(-1).int16(0)
+	}
+	c.send('T', m)
+}
+
+func (c *pgConn) sendDataRow(row []interface{}) {
+	m := new(pgMessage).int16(len(row))
+	for _, value := range row {
+		if value == nil {
+			m.int32(-1)
+			continue
+		}
+
+		var text string
+		switch v := value.(type) {
+		case int:
+			text = strconv.Itoa(v)
+		case string:
+			text = v
+		default:
+			text = fmt.Sprint(v)
+		}
+		m.int32(len(text)).bytes([]byte(text))
+	}
+	c.send('D', m)
+}
+
+func (c *pgConn) sendComplete(tag string) {
+	c.send('C', new(pgMessage).string(tag))
+}
+
+// sendReady reports the transaction status of the session.
+func (c *pgConn) sendReady() {
+	status := byte('I')
+	if c.session != nil && c.session.Transaction() != nil {
+		status = 'T'
+	}
+	c.send('Z', new(pgMessage).bytes([]byte{status}))
+}
+
+// sendQueryError sends the error with the SQLSTATE code
+// and the position of the syntax error.
+func (c *pgConn) sendQueryError(text string, err error) {
+	_, classified := queryErrorCode(err)
+	position := classified.Position
+	if position >= 0 && position <= len(text) {
+		// the position is counted in characters from 1
+		position = utf8.RuneCountInString(text[:position]) + 1
+	} else {
+		position = -1
+	}
+	c.sendError("ERROR", classified.SQLState(), err.Error(), position)
+}
+
+func (c *pgConn) sendError(severity, code, message string, position int) {
+	m := new(pgMessage)
+	m.byte('S').string(severity).byte('V').string(severity)
+	m.byte('C').string(code).byte('M').string(message)
+	if position >= 0 {
+		m.byte('P').string(strconv.Itoa(position))
+	}
+	c.send('E', m.byte(0))
+}
+
+// send buffers the message, the buffer is flushed
+// when the client is waited for.
+func (c *pgConn) send(kind byte, m *pgMessage) {
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(*m)+4))
+	// the write errors are returned by the flush
+	_, _ = c.w.Write(header)
+	_, _ = c.w.Write(*m)
+}
+
+// pgMessage builds the message body.
+type pgMessage []byte
+
+func (m *pgMessage) byte(b byte) *pgMessage {
+	*m = append(*m, b)
+	return m
+}
+
+func (m *pgMessage) bytes(b []byte) *pgMessage {
+	*m = append(*m, b...)
+	return m
+}
+
+func (m *pgMessage) int16(n int) *pgMessage {
+	*m = append(*m, byte(n>>8), byte(n))
+	return m
+}
+
+func (m *pgMessage) int32(n int) *pgMessage {
+	*m = append(*m, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return m
+}
+
+func (m *pgMessage) string(s string) *pgMessage {
+	*m = append(*m, s...)
+	*m = append(*m, 0)
+	return m
+}
@@ -0,0 +1,536 @@
+package server
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The replication protocol is the stream of gob-encoded messages over
+// TCP. The replica sends the hello with its credentials and the sequence
+// number of the last archive record it has, or asks for the snapshot
+// first. The primary answers with the snapshot files, if asked, and then
+// streams the archive records and the heartbeats until the replica
+// disconnects. The cluster followers acknowledge the applied records.
+
+// replicationHeartbeatInterval is the pause between the heartbeats
+// of the primary, they tell the replica the primary sequence.
+const replicationHeartbeatInterval = time.Second
+
+// replicationTimeout is how long the replica waits for a message
+// before it reconnects.
+const replicationTimeout = 10 * replicationHeartbeatInterval
+
+// maxReplicationBackoff is the longest pause between the reconnects.
+const maxReplicationBackoff = 30 * time.Second
+
+// replicationHello is the first message of the replica.
+type replicationHello struct {
+	User     string
+	Password string
+	// After is the sequence number of the last record of the replica.
+	After uint64
+	// Snapshot asks for the snapshot before the records.
+	Snapshot bool
+	// Node is the name of the cluster follower, empty
+	// for the replicas that do not acknowledge the records.
+	Node string
+}
+
+// replicationAck is the message of the cluster follower, Sequence
+// is the last record it has applied.
+type replicationAck struct {
+	Sequence uint64
+}
+
+// replicationMessage is the message of the primary, only
+// one of its parts is set.
+type replicationMessage struct {
+	File *engine.SnapshotFile
+	// SnapshotEnd completes the snapshot, Sequence is the
+	// record the replica resumes after, of the archive Term.
+	SnapshotEnd bool
+	Sequence    uint64
+	Term        uint64
+	Record      *engine.ReplicationRecord
+	// Heartbeat has the last record of the primary in Sequence.
+	Heartbeat bool
+	// Error is why the primary does not stream the records.
+	Error string
+}
+
+// ReplicationServer streams the archive of the primary to the replicas.
+type ReplicationServer struct {
+	db       *engine.Database
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	// acked are the last records applied by the cluster followers,
+	// acksChanged is closed and replaced on every acknowledgement
+	acked       map[string]uint64
+	acksChanged chan struct{}
+}
+
+// ListenReplication starts accepting the replica connections
+// on the address, the database must have the archive enabled.
+func ListenReplication(db *engine.Database, addr string) (*ReplicationServer, error) {
+	if db.Options().ArchiveDir == "" {
+		return nil, engine.ErrArchiveDisabled
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %s: %w", addr, err)
+	}
+
+	s := &ReplicationServer{
+		db:          db,
+		listener:    listener,
+		conns:       make(map[net.Conn]struct{}),
+		acked:       make(map[string]uint64),
+		acksChanged: make(chan struct{}),
+	}
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *ReplicationServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+
+			logging.Errorf("failed to accept replica connection: %s", err)
+			// the descriptors may be exhausted
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			checkConnClose(conn)
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go func() {
+			err := s.handle(conn)
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				// the connection is closed by Close
+				return
+			}
+
+			if err != nil && err != io.EOF {
+				logging.Errorf("replica connection %s failed: %s", conn.RemoteAddr(), err)
+			}
+			delete(s.conns, conn)
+			checkConnClose(conn)
+		}()
+	}
+}
+
+// Close stops accepting the replicas and disconnects the connected ones.
+func (s *ReplicationServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		checkConnClose(conn)
+	}
+
+	return s.listener.Close()
+}
+
+// replicationEncoder writes the messages of the stream
+// and of the heartbeats.
+type replicationEncoder struct {
+	mu      sync.Mutex
+	encoder *gob.Encoder
+}
+
+func (e *replicationEncoder) encode(m replicationMessage) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.encoder.Encode(m)
+}
+
+// handle streams the snapshot and the records to the replica.
+func (s *ReplicationServer) handle(conn net.Conn) error {
+	var hello replicationHello
+	if err := conn.SetReadDeadline(time.Now().Add(replicationTimeout)); err != nil {
+		return err
+	}
+
+	decoder := gob.NewDecoder(conn)
+	if err := decoder.Decode(&hello); err != nil {
+		return fmt.Errorf("failed to read hello: %w", err)
+	}
+
+	e := &replicationEncoder{encoder: gob.NewEncoder(conn)}
+	if err := s.authenticate(hello); err != nil {
+		return e.encode(replicationMessage{Error: err.Error()})
+	}
+
+	// the followers of the former leader copy the snapshot of the new one
+	if hello.Node != "" && s.db.FailoverStatus().Role != engine.RolePrimary {
+		return e.encode(replicationMessage{Error: "the node is not the leader of the cluster"})
+	}
+
+	log := logging.With("replica", conn.RemoteAddr().String())
+	after := hello.After
+	if hello.Snapshot {
+		sequence, err := s.db.ReplicationSnapshot(func(f engine.SnapshotFile) error {
+			return e.encode(replicationMessage{File: &f})
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := e.encode(replicationMessage{SnapshotEnd: true, Sequence: sequence, Term: s.db.ArchiveTerm()}); err != nil {
+			return err
+		}
+		log.Infof("sent snapshot, streaming records after %d", sequence)
+		after = sequence
+	} else {
+		log.Infof("streaming records after %d", after)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the replica sends nothing but the acknowledgements after
+	// the hello, the read fails when it disconnects
+	go func() {
+		defer cancel()
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return
+		}
+
+		for {
+			var ack replicationAck
+			if err := decoder.Decode(&ack); err != nil {
+				return
+			}
+
+			if hello.Node != "" {
+				s.acknowledge(hello.Node, ack.Sequence)
+			}
+		}
+	}()
+	if hello.Node != "" {
+		defer s.acknowledge(hello.Node, 0)
+	}
+
+	go func() {
+		ticker := time.NewTicker(replicationHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := e.encode(replicationMessage{Heartbeat: true, Sequence: s.db.ArchiveSequence()}); err != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err := s.db.StreamArchive(ctx, after, func(record engine.ReplicationRecord) error {
+		return e.encode(replicationMessage{Record: &record})
+	})
+	if errors.Is(err, context.Canceled) {
+		log.Infof("replica has disconnected")
+		return nil
+	}
+
+	return err
+}
+
+// acknowledge records the last record applied by the cluster
+// follower, zero forgets the disconnected follower.
+func (s *ReplicationServer) acknowledge(node string, sequence uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sequence == 0 {
+		delete(s.acked, node)
+	} else {
+		s.acked[node] = sequence
+	}
+	close(s.acksChanged)
+	s.acksChanged = make(chan struct{})
+}
+
+// WaitAcknowledged waits until the count of the nodes have
+// applied the records up to the sequence number.
+func (s *ReplicationServer) WaitAcknowledged(ctx context.Context, sequence uint64, nodes map[string]bool, count int) error {
+	for {
+		s.mu.Lock()
+		acknowledged := 0
+		for node, acked := range s.acked {
+			if nodes[node] && acked >= sequence {
+				acknowledged++
+			}
+		}
+		changed := s.acksChanged
+		s.mu.Unlock()
+
+		if acknowledged >= count {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// authenticate requires the superuser credentials
+// if the database has the users or the tokens.
+func (s *ReplicationServer) authenticate(hello replicationHello) error {
+	if !s.db.AuthenticationRequired() {
+		return nil
+	}
+
+	principal, err := authenticatePassword(s.db, hello.User, hello.Password)
+	if err != nil {
+		return err
+	}
+
+	return s.db.AuthorizeSuperuser(principal)
+}
+
+// ReplicationOptions configures the connection of the replica.
+type ReplicationOptions struct {
+	// Addr is the replication address of the primary.
+	Addr     string
+	User     string
+	Password string
+	// Node is the name of the cluster follower, it
+	// acknowledges the applied records.
+	Node string
+	// Resync copies the snapshot of the primary over the files
+	// of the replica first, Resynced is called when it is copied.
+	Resync   bool
+	Resynced func()
+}
+
+// dialReplication connects to the primary and sends the hello.
+func dialReplication(ctx context.Context, options ReplicationOptions, hello replicationHello) (net.Conn, *gob.Decoder, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", options.Addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to primary %s: %w", options.Addr, err)
+	}
+
+	hello.User, hello.Password = options.User, options.Password
+	if err := gob.NewEncoder(conn).Encode(hello); err != nil {
+		checkConnClose(conn)
+		return nil, nil, fmt.Errorf("failed to send hello to primary %s: %w", options.Addr, err)
+	}
+
+	return conn, gob.NewDecoder(conn), nil
+}
+
+// receive reads the next message of the primary.
+func receive(conn net.Conn, decoder *gob.Decoder) (replicationMessage, error) {
+	var m replicationMessage
+	if err := conn.SetReadDeadline(time.Now().Add(replicationTimeout)); err != nil {
+		return m, err
+	}
+
+	if err := decoder.Decode(&m); err != nil {
+		return m, fmt.Errorf("failed to receive from primary: %w", err)
+	}
+
+	if m.Error != "" {
+		return m, fmt.Errorf("primary has refused: %s", m.Error)
+	}
+
+	return m, nil
+}
+
+// BootstrapReplica copies the snapshot of the primary into the empty
+// db directory, nothing is copied if the replica has been bootstrapped.
+// The database must not be opened.
+func BootstrapReplica(ctx context.Context, dbDir string, options ReplicationOptions) error {
+	bootstrapped, err := engine.ReplicaBootstrapped(dbDir)
+	if err != nil || bootstrapped {
+		return err
+	}
+
+	b, err := engine.NewReplicaBootstrap(dbDir)
+	if err != nil {
+		return err
+	}
+
+	conn, decoder, err := dialReplication(ctx, options, replicationHello{Snapshot: true})
+	if err != nil {
+		return err
+	}
+	defer checkConnClose(conn)
+
+	files := 0
+	for {
+		m, err := receive(conn, decoder)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case m.File != nil:
+			if err := b.WriteFile(*m.File); err != nil {
+				return err
+			}
+			files++
+		case m.SnapshotEnd:
+			logging.Infof("copied snapshot of %d files from primary %s, resuming after record %d", files, options.Addr, m.Sequence)
+			return b.Finish(m.Sequence)
+		}
+	}
+}
+
+// Replicate applies the records of the primary to the replica until
+// the context is done or the replica is promoted, it reconnects when
+// the connection fails.
+func Replicate(ctx context.Context, db *engine.Database, options ReplicationOptions) {
+	backoff := replicationHeartbeatInterval
+	for {
+		received, err := replicate(ctx, db, &options)
+		db.SetReplicaConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if _, replica := db.ReplicaStatus(); !replica {
+			logging.Infof("replica has been promoted, replication from primary %s is stopped", options.Addr)
+			return
+		}
+
+		if received {
+			backoff = replicationHeartbeatInterval
+		}
+		logging.Errorf("replication from primary %s failed, reconnecting in %s: %s", options.Addr, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxReplicationBackoff {
+			backoff = maxReplicationBackoff
+		}
+	}
+}
+
+// replicate applies the records until the connection fails,
+// it reports whether anything has been received. The snapshot
+// is not copied again once it has been copied.
+func replicate(ctx context.Context, db *engine.Database, options *ReplicationOptions) (bool, error) {
+	hello := replicationHello{After: db.ReplicaSequence(), Snapshot: options.Resync, Node: options.Node}
+	conn, decoder, err := dialReplication(ctx, *options, hello)
+	if err != nil {
+		return false, err
+	}
+	defer checkConnClose(conn)
+
+	encoder := gob.NewEncoder(conn)
+	acknowledge := func() error {
+		if options.Node == "" {
+			return nil
+		}
+
+		if err := encoder.Encode(replicationAck{db.ReplicaSequence()}); err != nil {
+			return fmt.Errorf("failed to acknowledge records: %w", err)
+		}
+
+		return nil
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// interrupts the receive
+			_ = conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	received := false
+	var snapshot []engine.SnapshotFile
+	for {
+		m, err := receive(conn, decoder)
+		if err != nil {
+			return received, err
+		}
+
+		if _, replica := db.ReplicaStatus(); !replica {
+			return received, nil
+		}
+
+		if !received {
+			logging.Infof("replicating from primary %s after record %d", options.Addr, db.ReplicaSequence())
+			db.SetReplicaConnected(true)
+			received = true
+		}
+
+		switch {
+		case m.File != nil:
+			snapshot = append(snapshot, *m.File)
+		case m.SnapshotEnd:
+			if err := db.ApplySnapshot(snapshot, m.Sequence, m.Term); err != nil {
+				return received, err
+			}
+			logging.Infof("copied snapshot of %d files from primary %s, resuming after record %d", len(snapshot), options.Addr, m.Sequence)
+
+			snapshot, options.Resync = nil, false
+			if options.Resynced != nil {
+				options.Resynced()
+			}
+		case m.Record != nil:
+			if err := db.ApplyReplicated(*m.Record); err != nil {
+				return received, err
+			}
+			if err := acknowledge(); err != nil {
+				return received, err
+			}
+		case m.Heartbeat:
+			db.ReplicaHeartbeat(m.Sequence)
+			if err := acknowledge(); err != nil {
+				return received, err
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/krasun/gosqldb/internal/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// requestIDHeader is the header of the request identifier, it is
+// taken from the client or generated and sent back in the response,
+// so the client errors can be found in the logs.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDMetadata is the gRPC metadata key of the request identifier.
+const requestIDMetadata = "x-request-id"
+
+// maxRequestIDLength limits the identifiers sent by the clients.
+const maxRequestIDLength = 128
+
+// requestID returns the identifier sent by the client or a new one.
+func requestID(sent string) string {
+	if sent != "" && len(sent) <= maxRequestIDLength && printable(sent) {
+		return sent
+	}
+
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(random)
+}
+
+// printable reports whether the identifier has only
+// printable ASCII characters, so it is safe to log.
+func printable(id string) bool {
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestLogging returns the context with the logger that
+// adds the request identifier to the messages.
+func requestLogging(ctx context.Context, id string) context.Context {
+	return logging.NewContext(ctx, logging.FromContext(ctx).With("request_id", id))
+}
+
+// identified assigns the identifiers to the requests.
+func identified(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r.Header.Get(requestIDHeader))
+		w.Header().Set(requestIDHeader, id)
+
+		h.ServeHTTP(w, r.WithContext(requestLogging(r.Context(), id)))
+	})
+}
+
+// grpcRequestIDInterceptors assign the identifiers to the unary
+// and the streaming calls, the identifier is sent in the header.
+func grpcRequestIDInterceptors() []grpc.ServerOption {
+	identify := func(ctx context.Context) context.Context {
+		sent := ""
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(requestIDMetadata); len(values) > 0 {
+			sent = values[0]
+		}
+
+		id := requestID(sent)
+		if err := grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, id)); err != nil {
+			logging.Debugf("failed to set request identifier header: %s", err)
+		}
+
+		return requestLogging(ctx, id)
+	}
+
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(identify(ctx), req)
+	}
+
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextStream{ss, identify(ss.Context())})
+	}
+
+	return []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream)}
+}
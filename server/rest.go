@@ -0,0 +1,456 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// The REST API works with the tables without SQL, the statements
+// are built from the path, the query string and the JSON body:
+//
+//	GET    /tables                     the table names
+//	GET    /tables/{name}/schema       the columns of the table
+//	GET    /tables/{name}/rows?id=1    the rows matched by the filters
+//	POST   /tables/{name}/rows         inserts the object or the array of objects
+//	DELETE /tables/{name}/rows?id=1    deletes the rows matched by the filters
+//
+// The filters are the column names with the values, the rows must
+// match all of them. The limit and offset parameters page the rows,
+// so the tables can not be filtered by the columns with these names.
+// The responses and the errors are in the API version 3 format, the
+// transaction and session headers are respected.
+
+// Pagination of the rows returned by the REST API.
+const (
+	defaultRowsLimit = 100
+	maxRowsLimit     = 10000
+)
+
+// restTables is the response to GET /tables.
+type restTables struct {
+	Tables []string `json:"tables"`
+}
+
+// restSchema is the response to GET /tables/{name}/schema.
+type restSchema struct {
+	Name    string     `json:"name"`
+	Columns []columnV3 `json:"columns"`
+	// Partitioning is nil for not partitioned tables.
+	Partitioning *engine.Partitioning `json:"partitioning,omitempty"`
+	RowVersion   bool                 `json:"row_version,omitempty"`
+}
+
+// restRows is the response to GET /tables/{name}/rows, the next
+// offset is set if there are more rows.
+type restRows struct {
+	selectResultV3
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// errPageFull stops the scan when the page of rows is collected.
+var errPageFull = errors.New("page is full")
+
+// tableSchema returns the description of the table, the tables
+// that are not visible to the user do not exist for them.
+func tableSchema(db *engine.Database, userName string, tableName string) (restSchema, error) {
+	if !db.TableVisible(userName, tableName) {
+		return restSchema{}, fmt.Errorf("table %s does not exist", strings.ToLower(tableName))
+	}
+
+	schema, err := db.Schema(tableName)
+	if err != nil {
+		return restSchema{}, err
+	}
+
+	columns, err := db.Columns(tableName)
+	if err != nil {
+		return restSchema{}, err
+	}
+
+	return restSchema{Name: schema.Name, Columns: describeColumns(columns), Partitioning: schema.Partitioning, RowVersion: schema.RowVersion}, nil
+}
+
+// tablesHandler serves the REST API, it is registered
+// both for /tables and for /tables/.
+func tablesHandler(db *engine.Database) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(apiVersionHeader, strconv.Itoa(apiVersion3))
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1:
+			if r.Method != http.MethodGet {
+				writeError(w, "only GET is allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			user := requestUser(r)
+			tables := make([]string, 0)
+			for _, name := range db.TableNames() {
+				if db.TableVisible(user, name) {
+					tables = append(tables, name)
+				}
+			}
+
+			writeJSON(w, restTables{tables})
+		case len(parts) == 3 && parts[2] == "schema":
+			if r.Method != http.MethodGet {
+				writeError(w, "only GET is allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			schema, err := tableSchema(db, requestUser(r), parts[1])
+			if err != nil {
+				writeError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			writeJSON(w, schema)
+		case len(parts) == 3 && parts[2] == "rows":
+			rowsHandler(db, parts[1], w, r)
+		case len(parts) == 3 && parts[2] == "csv":
+			csvHandler(db, parts[1], w, r)
+		case len(parts) == 3 && parts[2] == "parquet":
+			parquetHandler(db, parts[1], w, r)
+		case len(parts) == 3 && parts[2] == "load":
+			loadHandler(db, parts[1], w, r)
+		default:
+			writeError(w, fmt.Sprintf("%s is not found", r.URL.Path), http.StatusNotFound)
+		}
+	}
+}
+
+// rowsHandler selects, inserts and deletes the rows of the table.
+func rowsHandler(db *engine.Database, tableName string, w http.ResponseWriter, r *http.Request) {
+	session, tx, err := requestTransaction(db, r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	columns, err := db.Columns(tableName)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	user := requestUser(r)
+	ctx, finish := db.StartQuery(r.Context(), user, requestClient(r), r.Method+" "+r.URL.Path)
+	defer finish()
+	r = r.WithContext(ctx)
+
+	var result interface{}
+	switch r.Method {
+	case http.MethodGet:
+		if err = db.Authorize(user, &sql.Select{Table: tableName}); err != nil {
+			break
+		}
+
+		result, err = selectPage(db, tx, tableName, columns, r)
+	case http.MethodPost:
+		if err = db.Authorize(user, &sql.Insert{Table: tableName}); err != nil {
+			break
+		}
+
+		var affected int
+		affected, err = insertRows(db, tx, tableName, r)
+		result = changeResultV3{affected}
+	case http.MethodDelete:
+		var query sql.Statement
+		query, err = deleteQuery(tableName, columns, r)
+		if err != nil {
+			break
+		}
+
+		if err = db.Authorize(user, query); err != nil {
+			break
+		}
+
+		result, err = execute(r.Context(), db, session, tx, query)
+		if err == nil {
+			result = changeResultV3{result.(int)}
+		}
+	default:
+		writeError(w, "only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if historyErr := db.RecordQuery(requestClient(r), r.Method+" "+r.URL.RequestURI(), err); historyErr != nil {
+		logging.Errorf("failed to record query: %s", historyErr)
+	}
+	if err != nil {
+		if redirectToLeader(w, r, err) {
+			return
+		}
+		writeQueryError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeJSON(w, result)
+}
+
+// selectPage selects the page of the rows matched by the filters.
+func selectPage(db *engine.Database, tx *engine.Transaction, tableName string, columns []engine.ColumnDef, r *http.Request) (restRows, error) {
+	params := r.URL.Query()
+	limit, err := pageParam(params.Get("limit"), defaultRowsLimit)
+	if err != nil {
+		return restRows{}, fmt.Errorf("invalid limit: %w", err)
+	}
+	if limit == 0 || limit > maxRowsLimit {
+		return restRows{}, fmt.Errorf("limit must be from 1 to %d, got %d", maxRowsLimit, limit)
+	}
+
+	offset, err := pageParam(params.Get("offset"), 0)
+	if err != nil {
+		return restRows{}, fmt.Errorf("invalid offset: %w", err)
+	}
+
+	where, err := filterWhere(columns, r)
+	if err != nil {
+		return restRows{}, err
+	}
+
+	selectEach := db.SelectEachContext
+	if tx != nil {
+		selectEach = tx.SelectEachContext
+	}
+
+	page := restRows{selectResultV3: selectResultV3{Columns: describeColumns(columns), Rows: make([][]interface{}, 0)}}
+
+	skipped := 0
+	query := &sql.Select{Table: tableName, Where: where}
+	err = selectEach(r.Context(), query, func(row []interface{}) error {
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+
+		if len(page.Rows) == limit {
+			next := offset + limit
+			page.NextOffset = &next
+			return errPageFull
+		}
+
+		page.Rows = append(page.Rows, row)
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		return restRows{}, err
+	}
+
+	return page, nil
+}
+
+// pageParam parses the non-negative pagination parameter.
+func pageParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("%d is negative", n)
+	}
+
+	return n, nil
+}
+
+// deleteQuery builds DELETE of the rows matched by the filters,
+// at least one filter is required, so a mistake does not empty
+// the table.
+func deleteQuery(tableName string, columns []engine.ColumnDef, r *http.Request) (*sql.Delete, error) {
+	where, err := filterWhere(columns, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if where == nil {
+		return nil, fmt.Errorf("at least one filter is required to delete rows")
+	}
+
+	return &sql.Delete{Table: tableName, Where: where}, nil
+}
+
+// filterWhere builds the condition from the filters of the query
+// string, the values are parsed by the column types. It returns nil
+// if there are no filters.
+func filterWhere(columns []engine.ColumnDef, r *http.Request) (*sql.Where, error) {
+	types := make(map[string]sql.ColumnType, len(columns))
+	for _, column := range columns {
+		types[column.Name] = column.Type
+	}
+
+	params := r.URL.Query()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name != "limit" && name != "offset" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var expr sql.Expr
+	for _, name := range names {
+		values := params[name]
+		if len(values) > 1 {
+			return nil, fmt.Errorf("filter %s is repeated", name)
+		}
+
+		column := strings.ToLower(name)
+		columnType, exists := types[column]
+		if !exists {
+			return nil, fmt.Errorf("column %s does not exist", column)
+		}
+
+		var arg interface{} = values[0]
+		if columnType == sql.TypeInteger {
+			n, err := strconv.Atoi(values[0])
+			if err != nil {
+				return nil, fmt.Errorf("filter %s must be an integer, got %s", column, values[0])
+			}
+			arg = n
+		}
+
+		value, err := engine.ValueExpr(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %s: %w", column, err)
+		}
+
+		var condition sql.Expr = sql.ExprOperation{Left: sql.ExprIdentifier{Name: column}, Operator: sql.OperatorEquals, Right: value}
+		if expr != nil {
+			condition = sql.ExprOperation{Left: expr, Operator: sql.OperatorLogicalAnd, Right: condition}
+		}
+		expr = condition
+	}
+
+	if expr == nil {
+		return nil, nil
+	}
+
+	return &sql.Where{Expr: expr}, nil
+}
+
+// insertRows inserts the JSON object or the array of objects from the
+// request body. The array is inserted in a transaction, if the request
+// is not sent within one, so either all or none of the rows are inserted.
+func insertRows(db *engine.Database, tx *engine.Transaction, tableName string, r *http.Request) (int, error) {
+	var body interface{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode request: %w", err)
+	}
+
+	var objects []interface{}
+	switch b := body.(type) {
+	case map[string]interface{}:
+		objects = []interface{}{b}
+	case []interface{}:
+		objects = b
+	default:
+		return 0, fmt.Errorf("expected an object or an array of objects, got %T", body)
+	}
+
+	queries := make([]*sql.Insert, len(objects))
+	for i, object := range objects {
+		row, ok := object.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("row %d: expected an object, got %T", i, object)
+		}
+
+		queries[i], err = insertQuery(tableName, row)
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+
+	if len(queries) == 1 && tx == nil {
+		result, err := db.ExecuteContext(r.Context(), queries[0])
+		if err != nil {
+			return 0, err
+		}
+
+		return result.(int), nil
+	}
+
+	own := tx == nil
+	if own {
+		tx, err = db.Begin("")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	inserted := 0
+	for i, query := range queries {
+		n, err := tx.InsertContext(r.Context(), query)
+		if err != nil {
+			if own {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					logging.Errorf("failed to rollback transaction %s: %s", tx.ID, rollbackErr)
+				}
+			}
+
+			return 0, fmt.Errorf("row %d: %w", i, err)
+		}
+		inserted += n
+	}
+
+	if own {
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+
+	return inserted, nil
+}
+
+// insertQuery builds INSERT of the row given by the column names.
+func insertQuery(tableName string, row map[string]interface{}) (*sql.Insert, error) {
+	query := &sql.Insert{Table: tableName, Columns: make([]string, 0, len(row)), Values: make([]string, 0, len(row))}
+	for column := range row {
+		query.Columns = append(query.Columns, column)
+	}
+	sort.Strings(query.Columns)
+
+	for _, column := range query.Columns {
+		value, err := engine.ValueExpr(row[column])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %w", column, err)
+		}
+
+		switch v := value.(type) {
+		case sql.ExprValueInteger:
+			query.Values = append(query.Values, v.Value)
+		case sql.ExprValueString:
+			query.Values = append(query.Values, v.Value)
+		}
+	}
+
+	return query, nil
+}
+
+// writeJSON writes the successful response.
+func writeJSON(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logging.Errorf("failed to write response: %s", err)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// ndjsonContentType is accepted by the clients that want SELECT results
+// streamed as newline-delimited JSON, one row per line.
+const ndjsonContentType = "application/x-ndjson"
+
+// columnsHeader is the response header with the JSON descriptions
+// of the columns of the streamed rows, the lines have only the values.
+const columnsHeader = "X-Result-Columns"
+
+// streamFlushRows is the number of rows written between flushes
+// of the streamed response.
+const streamFlushRows = 1000
+
+// streamError is the last line of the streamed response
+// if the query has failed after some rows were written.
+type streamError struct {
+	Error string `json:"error"`
+}
+
+// wantsStream reports whether the client accepts streamed results.
+func wantsStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]) == ndjsonContentType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// rowSource returns the function that passes the rows of the SELECT
+// with or without ORDER BY, GROUP BY or AS OF to f as they are scanned, sorted
+// or aggregated, ok is false for the other statements.
+func rowSource(db *engine.Database, tx *engine.Transaction, query sql.Statement) (each func(ctx context.Context, f func(row []interface{}) error) error, ok bool) {
+	switch q := query.(type) {
+	case *sql.Select:
+		selectEach := db.SelectEachContext
+		if tx != nil {
+			selectEach = tx.SelectEachContext
+		}
+
+		return func(ctx context.Context, f func(row []interface{}) error) error {
+			return selectEach(ctx, q, f)
+		}, true
+	case *engine.OrderedSelect:
+		sortEach := db.SortEachContext
+		if tx != nil {
+			sortEach = tx.SortEachContext
+		}
+
+		return func(ctx context.Context, f func(row []interface{}) error) error {
+			return sortEach(ctx, q, f)
+		}, true
+	case *engine.GroupedSelect:
+		aggregateEach := db.AggregateEachContext
+		if tx != nil {
+			aggregateEach = tx.AggregateEachContext
+		}
+
+		return func(ctx context.Context, f func(row []interface{}) error) error {
+			return aggregateEach(ctx, q, f)
+		}, true
+	case *engine.AsOfSelect:
+		return func(ctx context.Context, f func(row []interface{}) error) error {
+			return db.AsOfEachContext(ctx, q, f)
+		}, true
+	}
+
+	return nil, false
+}
+
+// streamRows writes the selected rows as they are scanned and
+// returns the number of the written rows.
+func streamRows(ctx context.Context, db *engine.Database, tx *engine.Transaction, w http.ResponseWriter, query sql.Statement) (int, error) {
+	each, ok := rowSource(db, tx, query)
+	if !ok {
+		return 0, fmt.Errorf("only SELECT results are streamed, got %T", query)
+	}
+
+	columns, err := db.ResultColumns(query)
+	if err != nil {
+		return 0, err
+	}
+	described, err := json.Marshal(describeColumns(columns))
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode columns: %w", err)
+	}
+
+	w.Header().Set(columnsHeader, string(described))
+	w.Header().Set("Content-Type", ndjsonContentType)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	rows := 0
+	err = each(ctx, func(row []interface{}) error {
+		err := encoder.Encode(typedRows(columns, [][]interface{}{row})[0])
+		if err != nil {
+			return fmt.Errorf("failed to write row: %w", err)
+		}
+
+		rows++
+		if flusher != nil && rows%streamFlushRows == 0 {
+			flusher.Flush()
+		}
+
+		return nil
+	})
+
+	return rows, err
+}
+
+// streamAndWrite executes the SELECT query streaming the rows
+// and records it in the query history.
+func streamAndWrite(db *engine.Database, tx *engine.Transaction, w http.ResponseWriter, r *http.Request, text string, query sql.Statement) {
+	rows, err := streamRows(r.Context(), db, tx, w, query)
+	if historyErr := db.RecordQuery(requestClient(r), text, err); historyErr != nil {
+		logging.Errorf("failed to record query: %s", historyErr)
+	}
+	if err == nil {
+		return
+	}
+
+	if rows == 0 {
+		writeQueryError(w, err)
+		return
+	}
+
+	// the status has been already sent
+	err = json.NewEncoder(w).Encode(streamError{err.Error()})
+	if err != nil {
+		logging.Errorf("failed to write stream error: %s", err)
+	}
+}
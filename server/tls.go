@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSOptions configures TLS of the HTTP listener.
+type TLSOptions struct {
+	// CertFile and KeyFile are the paths to the PEM-encoded
+	// certificate chain and private key of the server.
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version: 1.0, 1.1, 1.2 or 1.3,
+	// empty means 1.2.
+	MinVersion string
+	// CipherSuites are the names of the cipher suites enabled for
+	// TLS 1.0-1.2, empty means the Go defaults. TLS 1.3 suites are
+	// not configurable.
+	CipherSuites []string
+	// ClientCAFile is the path to the PEM-encoded certificates of the
+	// authorities that sign client certificates. If set, the clients
+	// must present a certificate signed by one of them.
+	ClientCAFile string
+}
+
+// tlsVersions are the supported TLS versions by their names.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig loads the certificates and returns the TLS configuration.
+func TLSConfig(options TLSOptions) (*tls.Config, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, fmt.Errorf("both certificate and key files are required")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if options.MinVersion != "" {
+		version, exists := tlsVersions[options.MinVersion]
+		if !exists {
+			return nil, fmt.Errorf("unsupported TLS version %s, expected 1.0, 1.1, 1.2 or 1.3", options.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(options.CipherSuites) > 0 {
+		suites, err := parseCipherSuites(options.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = suites
+	}
+
+	if options.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(options.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", options.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// parseCipherSuites returns the identifiers of the cipher suites
+// by their names, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, exists := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !exists {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The web console is a single page served at /ui/ that works with the
+// public endpoints: it lists the tables with their schemas and rows,
+// runs the queries over the query channel and shows the open sessions,
+// the running queries and the metrics. The assets are compiled into the
+// binary, so the console needs no files next to it.
+
+// uiAsset is the static file of the web console.
+type uiAsset struct {
+	contentType string
+	content     string
+}
+
+// uiAssets are the files of the web console by their paths under /ui/.
+var uiAssets = map[string]uiAsset{
+	"":          {"text/html; charset=utf-8", uiIndex},
+	"app.js":    {"application/javascript; charset=utf-8", uiScript},
+	"style.css": {"text/css; charset=utf-8", uiStyle},
+}
+
+// uiHandler serves the web console.
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/ui" {
+		http.Redirect(w, r, "/ui/", http.StatusMovedPermanently)
+		return
+	}
+
+	asset, exists := uiAssets[strings.TrimPrefix(r.URL.Path, "/ui/")]
+	if !exists {
+		writeError(w, r.URL.Path+" is not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; connect-src 'self' ws: wss:")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := w.Write([]byte(asset.content)); err != nil {
+		logging.FromContext(r.Context()).Debugf("failed to write %s: %s", r.URL.Path, err)
+	}
+}
+
+const uiIndex = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>gosqldb</title>
+<link rel="stylesheet" href="style.css">
+</head>
+<body>
+<header>
+  <h1>gosqldb</h1>
+  <nav>
+    <button data-tab="query" class="active">Query</button>
+    <button data-tab="sessions">Sessions</button>
+    <button data-tab="metrics">Metrics</button>
+  </nav>
+  <span id="connection" class="status">disconnected</span>
+</header>
+<main>
+  <aside>
+    <h2>Tables <button id="refresh-tables" title="Refresh">&#x21bb;</button></h2>
+    <ul id="tables"></ul>
+  </aside>
+  <section id="query" class="tab active">
+    <textarea id="editor" spellcheck="false" placeholder="SELECT id, name FROM users"></textarea>
+    <div class="toolbar">
+      <button id="run">Run</button>
+      <button id="cancel" disabled>Cancel</button>
+      <span class="hint">Ctrl+Enter runs the query</span>
+      <span id="progress"></span>
+    </div>
+    <div id="schema"></div>
+    <div id="message"></div>
+    <div id="result" class="result"></div>
+  </section>
+  <section id="sessions" class="tab">
+    <div class="toolbar"><button id="refresh-sessions">Refresh</button></div>
+    <h2>Sessions</h2>
+    <div id="session-list" class="result"></div>
+    <h2>Running queries</h2>
+    <div id="process-list" class="result"></div>
+  </section>
+  <section id="metrics" class="tab">
+    <div class="toolbar"><label><input type="checkbox" id="auto-refresh" checked> refresh every 5 seconds</label></div>
+    <h2>Status</h2>
+    <div id="status" class="result"></div>
+    <h2>Runtime</h2>
+    <div id="runtime" class="result"></div>
+    <h2>Tables</h2>
+    <div id="table-stats" class="result"></div>
+  </section>
+</main>
+<script src="app.js"></script>
+</body>
+</html>
+`
+
+const uiScript = `"use strict";
+
+// the page size of the rows rendered at once
+const maxRenderedRows = 1000;
+
+const $ = (id) => document.getElementById(id);
+
+function element(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (className) e.className = className;
+  return e;
+}
+
+async function getJSON(path) {
+  const response = await fetch(path, {headers: {"X-API-Version": "3"}, credentials: "same-origin"});
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error && body.error.message ? body.error.message : response.statusText);
+  }
+  return body;
+}
+
+function renderTable(container, columns, rows) {
+  container.textContent = "";
+  const table = element("table");
+  const head = table.createTHead().insertRow();
+  for (const column of columns) head.appendChild(element("th", column));
+  const body = table.createTBody();
+  for (const row of rows) appendRow(body, row);
+  container.appendChild(table);
+  return body;
+}
+
+function appendRow(body, row) {
+  const tr = body.insertRow();
+  for (const value of row) {
+    const cell = tr.insertCell();
+    cell.textContent = value === null || value === undefined ? "" : typeof value === "object" ? JSON.stringify(value) : String(value);
+    if (typeof value === "number") cell.className = "number";
+  }
+}
+
+// renderObject renders the nested object as the flat key-value table.
+function renderObject(container, object) {
+  const rows = [];
+  const walk = (prefix, value) => {
+    if (value !== null && typeof value === "object" && !Array.isArray(value)) {
+      for (const key of Object.keys(value)) walk(prefix ? prefix + "." + key : key, value[key]);
+    } else {
+      rows.push([prefix, Array.isArray(value) ? JSON.stringify(value) : value]);
+    }
+  };
+  walk("", object);
+  renderTable(container, ["name", "value"], rows);
+}
+
+function showError(container, error) {
+  container.textContent = "";
+  container.appendChild(element("div", error.message || String(error), "error"));
+}
+
+// The query channel keeps the session of the console, so BEGIN and
+// COMMIT work across the runs.
+const channel = {
+  socket: null,
+  nextID: 1,
+  handlers: new Map(),
+  pending: [],
+
+  connect() {
+    const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+    const socket = new WebSocket(scheme + "//" + location.host + "/ws");
+    socket.onopen = () => {
+      $("connection").textContent = "connected";
+      $("connection").className = "status connected";
+      for (const message of this.pending) socket.send(message);
+      this.pending = [];
+    };
+    socket.onmessage = (event) => {
+      const message = JSON.parse(event.data);
+      const handler = this.handlers.get(message.id);
+      if (!handler) return;
+      if (message.type === "done" || message.type === "error") this.handlers.delete(message.id);
+      handler(message);
+    };
+    socket.onclose = () => {
+      $("connection").textContent = "disconnected";
+      $("connection").className = "status";
+      for (const handler of this.handlers.values()) {
+        handler({type: "error", error: {message: "connection is closed, the open transaction is rolled back"}});
+      }
+      this.handlers.clear();
+      this.socket = null;
+    };
+    this.socket = socket;
+  },
+
+  send(message, handler) {
+    const id = String(this.nextID++);
+    message.id = id;
+    this.handlers.set(id, handler);
+    const data = JSON.stringify(message);
+    if (!this.socket) this.connect();
+    if (this.socket.readyState === WebSocket.OPEN) {
+      this.socket.send(data);
+    } else {
+      this.pending.push(data);
+    }
+    return id;
+  },
+
+  cancel(id) {
+    if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+      this.socket.send(JSON.stringify({id: id, type: "cancel"}));
+    }
+  },
+
+  // query collects the rows of the query, for the short ones.
+  query(text) {
+    return new Promise((resolve, reject) => {
+      let columns = [];
+      const rows = [];
+      this.send({type: "query", query: text}, (message) => {
+        switch (message.type) {
+          case "columns": columns = message.columns.map((c) => c.name); break;
+          case "rows": rows.push(...message.rows); break;
+          case "done": resolve({columns, rows}); break;
+          case "error": reject(new Error(message.error.message)); break;
+        }
+      });
+    });
+  },
+};
+
+let runningID = null;
+
+function run() {
+  const text = $("editor").value.trim();
+  if (!text || runningID) return;
+
+  const result = $("result");
+  const message = $("message");
+  result.textContent = "";
+  message.textContent = "";
+  $("schema").textContent = "";
+  $("progress").textContent = "running...";
+  $("run").disabled = true;
+  $("cancel").disabled = false;
+
+  const started = performance.now();
+  let body = null;
+  let rendered = 0;
+  const finish = (text, className) => {
+    runningID = null;
+    $("run").disabled = false;
+    $("cancel").disabled = true;
+    $("progress").textContent = "";
+    message.appendChild(element("div", text, className));
+  };
+  const elapsed = () => ((performance.now() - started) / 1000).toFixed(3) + "s";
+
+  runningID = channel.send({type: "query", query: text}, (m) => {
+    switch (m.type) {
+      case "columns":
+        body = renderTable(result, m.columns.map((c) => c.name + " " + c.type), []);
+        break;
+      case "rows":
+        for (const row of m.rows) {
+          if (rendered++ < maxRenderedRows) appendRow(body, row);
+        }
+        break;
+      case "progress":
+        $("progress").textContent = "running for " + (m.elapsed_ms / 1000).toFixed(0) + "s" + (m.row_count ? ", " + m.row_count + " rows" : "");
+        break;
+      case "done":
+        if (m.row_count !== undefined) {
+          let text = m.row_count + (m.row_count === 1 ? " row" : " rows") + " in " + elapsed();
+          if (m.row_count > maxRenderedRows) text += ", the first " + maxRenderedRows + " are shown";
+          finish(text, "info");
+        } else if (m.affected_rows !== undefined) {
+          finish(m.affected_rows + (m.affected_rows === 1 ? " row" : " rows") + " affected in " + elapsed(), "info");
+          loadTables();
+        } else {
+          finish((m.result !== undefined && m.result !== null ? String(m.result) : "OK") + " in " + elapsed(), "info");
+          loadTables();
+        }
+        break;
+      case "error":
+        finish(m.error.message, "error");
+        break;
+    }
+  });
+}
+
+async function loadTables() {
+  const list = $("tables");
+  try {
+    const response = await getJSON("/tables");
+    list.textContent = "";
+    for (const name of response.tables) {
+      const item = element("li");
+      const link = element("a", name);
+      link.href = "#";
+      link.onclick = (event) => {
+        event.preventDefault();
+        showTable(name);
+      };
+      item.appendChild(link);
+      list.appendChild(item);
+    }
+  } catch (error) {
+    showError(list, error);
+  }
+}
+
+async function showTable(name) {
+  selectTab("query");
+  const schema = $("schema");
+  const result = $("result");
+  $("message").textContent = "";
+  try {
+    const described = await getJSON("/tables/" + encodeURIComponent(name) + "/schema");
+    schema.textContent = "";
+    schema.appendChild(element("h2", described.name));
+    const columns = element("div");
+    renderTable(columns, ["column", "type"], described.columns.map((c) => [c.name, c.type]));
+    schema.appendChild(columns);
+
+    const rows = await getJSON("/tables/" + encodeURIComponent(name) + "/rows?limit=100");
+    renderTable(result, rows.columns.map((c) => c.name), rows.rows);
+    const count = rows.rows.length + (rows.next_offset !== undefined ? "+" : "");
+    $("message").appendChild(element("div", "the first " + count + " rows", "info"));
+    $("editor").value = "SELECT " + described.columns.map((c) => c.name).join(", ") + " FROM " + described.name;
+  } catch (error) {
+    showError(schema, error);
+  }
+}
+
+async function loadSessions() {
+  try {
+    const sessions = await getJSON("/admin/sessions");
+    renderTable($("session-list"), ["id", "user", "opened", "last used", "transaction", "prepared"],
+      sessions.map((s) => [s.id, s.user || "", s.opened, s.last_used, s.transaction || "", s.prepared]));
+  } catch (error) {
+    showError($("session-list"), error);
+  }
+
+  try {
+    const processes = await channel.query("SHOW PROCESSLIST");
+    renderTable($("process-list"), processes.columns, processes.rows);
+  } catch (error) {
+    showError($("process-list"), error);
+  }
+}
+
+async function loadMetrics() {
+  const sections = [["/status", "status"], ["/admin/runtime", "runtime"]];
+  for (const [path, id] of sections) {
+    try {
+      renderObject($(id), await getJSON(path));
+    } catch (error) {
+      showError($(id), error);
+    }
+  }
+
+  try {
+    const tables = await getJSON("/admin/tables");
+    renderTable($("table-stats"), ["table", "rows", "size", "storage"],
+      tables.map((t) => [t.name, t.row_count, t.size_bytes, t.storage]));
+  } catch (error) {
+    showError($("table-stats"), error);
+  }
+}
+
+let activeTab = "query";
+
+function selectTab(name) {
+  activeTab = name;
+  for (const button of document.querySelectorAll("nav button")) {
+    button.classList.toggle("active", button.dataset.tab === name);
+  }
+  for (const tab of document.querySelectorAll(".tab")) {
+    tab.classList.toggle("active", tab.id === name);
+  }
+  if (name === "sessions") loadSessions();
+  if (name === "metrics") loadMetrics();
+}
+
+for (const button of document.querySelectorAll("nav button")) {
+  button.onclick = () => selectTab(button.dataset.tab);
+}
+$("run").onclick = run;
+$("cancel").onclick = () => {
+  if (runningID) channel.cancel(runningID);
+};
+$("editor").onkeydown = (event) => {
+  if (event.key === "Enter" && (event.ctrlKey || event.metaKey)) {
+    event.preventDefault();
+    run();
+  }
+};
+$("refresh-tables").onclick = loadTables;
+$("refresh-sessions").onclick = loadSessions;
+setInterval(() => {
+  if (activeTab === "metrics" && $("auto-refresh").checked) loadMetrics();
+}, 5000);
+
+channel.connect();
+loadTables();
+`
+
+const uiStyle = `* { box-sizing: border-box; }
+body { margin: 0; font: 14px/1.4 system-ui, sans-serif; color: #222; background: #fafafa; }
+header { display: flex; align-items: center; gap: 24px; padding: 8px 16px; background: #263238; color: #fff; }
+header h1 { margin: 0; font-size: 18px; }
+nav button { background: none; border: 0; color: #b0bec5; font: inherit; padding: 6px 10px; cursor: pointer; }
+nav button.active { color: #fff; border-bottom: 2px solid #4fc3f7; }
+.status { margin-left: auto; font-size: 12px; color: #ef9a9a; }
+.status.connected { color: #a5d6a7; }
+main { display: flex; height: calc(100vh - 48px); }
+aside { width: 220px; overflow: auto; padding: 8px 16px; border-right: 1px solid #ddd; background: #fff; }
+aside ul { list-style: none; margin: 0; padding: 0; }
+aside li a { display: block; padding: 3px 0; color: #0277bd; text-decoration: none; word-break: break-all; }
+aside h2 button { border: 0; background: none; cursor: pointer; font-size: 14px; }
+h2 { font-size: 14px; margin: 16px 0 6px; }
+.tab { display: none; flex: 1; overflow: auto; padding: 12px 16px; }
+.tab.active { display: block; }
+textarea { width: 100%; height: 140px; font: 13px/1.4 ui-monospace, monospace; padding: 8px; border: 1px solid #ccc; border-radius: 4px; resize: vertical; }
+.toolbar { display: flex; align-items: center; gap: 8px; margin: 8px 0; }
+.toolbar button { padding: 4px 14px; }
+.hint, #progress { color: #777; font-size: 12px; }
+.result { overflow: auto; }
+table { border-collapse: collapse; font: 13px ui-monospace, monospace; background: #fff; }
+th, td { border: 1px solid #ddd; padding: 3px 8px; text-align: left; vertical-align: top; white-space: pre; }
+th { background: #eceff1; position: sticky; top: 0; }
+td.number { text-align: right; }
+.error { color: #c62828; margin: 6px 0; white-space: pre-wrap; }
+.info { color: #555; margin: 6px 0; }
+`
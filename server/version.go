@@ -0,0 +1,382 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/krasun/gosqldb/engine"
+	"github.com/krasun/gosqldb/internal/logging"
+	sql "github.com/krasun/gosqlparser"
+)
+
+// apiVersionHeader is the request header with the API versions the
+// client supports, the server answers with the chosen version in the
+// same header.
+//
+//	X-API-Version: 2, 1
+const apiVersionHeader = "X-API-Version"
+
+// Versions of the query results format.
+const (
+	// apiVersion1 is the plain text format, it is used for the clients
+	// that do not send the version header.
+	apiVersion1 = 1
+	// apiVersion2 is the JSON format: {"result": ...} or {"error": "..."}.
+	apiVersion2 = 2
+	// apiVersion3 is the structured JSON format, see resultV3 and errorV3.
+	apiVersion3 = 3
+)
+
+// supportedAPIVersions are ordered from the oldest to the newest,
+// the newest one is the current version.
+var supportedAPIVersions = []int{apiVersion1, apiVersion2, apiVersion3}
+
+// apiVersionInfo describes the versions supported by the server.
+type apiVersionInfo struct {
+	Current   int   `json:"current"`
+	Default   int   `json:"default"`
+	Supported []int `json:"supported"`
+}
+
+// resultV2 is the successful response of the API version 2.
+type resultV2 struct {
+	Result interface{} `json:"result"`
+}
+
+// selectResultV2 is the response of the API version 2 to SELECT,
+// the columns describe the values of the result rows.
+//
+//	{"columns": [{"name": "id", "type": "integer", "nullable": false}], "result": [[1]]}
+type selectResultV2 struct {
+	Columns []columnV3      `json:"columns"`
+	Result  [][]interface{} `json:"result"`
+}
+
+// errorV2 is the error response of the API version 2.
+type errorV2 struct {
+	Error string `json:"error"`
+}
+
+// selectResultV3 is the response of the API version 3 to SELECT.
+//
+//	{"columns": [{"name": "id", "type": "integer", "nullable": false}], "rows": [[1]]}
+type selectResultV3 struct {
+	Columns []columnV3      `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	// NextCursor is the cursor of the next page of the paged
+	// selection, empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// columnV3 describes the column of the selected rows,
+// the columns are ordered as the values of the rows.
+type columnV3 struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+// describeColumns returns the descriptions of the columns
+// ordered by their positions.
+func describeColumns(columns []engine.ColumnDef) []columnV3 {
+	described := make([]columnV3, len(columns))
+	for i, column := range columns {
+		described[i] = columnV3{engine.DisplayName(column.Name), strings.ToLower(column.Type.Name()), column.Nullable()}
+	}
+
+	return described
+}
+
+// typedRows returns the rows with the integral numbers of the integer
+// columns as integers, so they are not encoded as floats. The rows are
+// copied only if they are converted, the cached rows are shared.
+func typedRows(columns []engine.ColumnDef, rows [][]interface{}) [][]interface{} {
+	typed, copied := rows, false
+	for i, row := range rows {
+		rowCopied := false
+		for position, column := range columns {
+			if position >= len(row) || column.Type != sql.TypeInteger {
+				continue
+			}
+
+			f, ok := row[position].(float64)
+			if !ok || math.Trunc(f) != f {
+				continue
+			}
+
+			if !copied {
+				typed, copied = append([][]interface{}(nil), rows...), true
+			}
+			if !rowCopied {
+				typed[i], rowCopied = append([]interface{}(nil), row...), true
+			}
+			typed[i][position] = int(f)
+		}
+	}
+
+	return typed
+}
+
+// changeResultV3 is the response of the API version 3 to INSERT,
+// UPDATE and DELETE, the other statements are answered as in the
+// version 2.
+//
+//	{"affected_rows": 3}
+type changeResultV3 struct {
+	AffectedRows int `json:"affected_rows"`
+}
+
+// errorV3 is the error response of the API version 3, the code
+// is stable and can be used to handle the error.
+//
+//	{"error": {"code": "syntax_error", "category": "syntax", "sqlstate": "42601", "message": "...", "position": 7}}
+type errorV3 struct {
+	Error errorDetailV3 `json:"error"`
+}
+
+type errorDetailV3 struct {
+	Code string `json:"code"`
+	// Category and SQLState classify the query errors,
+	// they are empty for the other errors.
+	Category string `json:"category,omitempty"`
+	SQLState string `json:"sqlstate,omitempty"`
+	Message  string `json:"message"`
+	// Position is the byte offset in the query of the syntax error.
+	Position *int `json:"position,omitempty"`
+}
+
+// errorStatuses are the statuses of the API version 3 errors by
+// their codes, the other query errors are 400 Bad Request.
+var errorStatuses = map[engine.ErrorCode]int{
+	engine.CodeLimit:           http.StatusRequestEntityTooLarge,
+	engine.CodeTooManyRequests: http.StatusTooManyRequests,
+	engine.CodeSerialization:   http.StatusConflict,
+	engine.CodeDeadlock:        http.StatusConflict,
+	engine.CodeVersionConflict: http.StatusConflict,
+	engine.CodeLockTimeout:     http.StatusConflict,
+	engine.CodePermission:      http.StatusForbidden,
+	engine.CodeAuthentication:  http.StatusUnauthorized,
+	engine.CodeQueryTimeout:    http.StatusRequestTimeout,
+	engine.CodeNotLeader:       http.StatusMisdirectedRequest,
+	engine.CodeNotReplicated:   http.StatusServiceUnavailable,
+	engine.CodeReadOnly:        http.StatusForbidden,
+	engine.CodeDiskFull:        http.StatusInsufficientStorage,
+	engine.CodeSchemaChanged:   http.StatusConflict,
+}
+
+// negotiateVersion chooses the newest version supported both by the
+// client and the server, the client versions are comma-separated.
+func negotiateVersion(r *http.Request) (int, error) {
+	header := r.Header.Get(apiVersionHeader)
+	if header == "" {
+		return apiVersion1, nil
+	}
+
+	chosen := 0
+	for _, value := range strings.Split(header, ",") {
+		version, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return 0, fmt.Errorf("invalid API version %q", value)
+		}
+
+		for _, supported := range supportedAPIVersions {
+			if version == supported && version > chosen {
+				chosen = version
+			}
+		}
+	}
+
+	if chosen == 0 {
+		return 0, fmt.Errorf("API versions %s are not supported, supported versions: %v", header, supportedAPIVersions)
+	}
+
+	return chosen, nil
+}
+
+// versioned negotiates the API version of the request and
+// rejects the requests with unsupported versions.
+func versioned(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version, err := negotiateVersion(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+
+		w.Header().Set(apiVersionHeader, strconv.Itoa(version))
+		h(w, r)
+	}
+}
+
+// responseVersion is the API version chosen by versioned.
+func responseVersion(w http.ResponseWriter) int {
+	version, err := strconv.Atoi(w.Header().Get(apiVersionHeader))
+	if err != nil {
+		return apiVersion1
+	}
+
+	return version
+}
+
+// writeResult writes the query result in the format of the API version.
+func writeResult(w http.ResponseWriter, result interface{}) {
+	if responseVersion(w) == apiVersion1 {
+		fmt.Fprintf(w, "the query has been successfully executed: %v\n", result)
+		return
+	}
+
+	if stringer, ok := result.(fmt.Stringer); ok {
+		result = stringer.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resultV2{result})
+	if err != nil {
+		logging.Errorf("failed to write result: %s", err)
+	}
+}
+
+// writeQueryResult writes the result of the query in the format
+// of the API version.
+func writeQueryResult(w http.ResponseWriter, db *engine.Database, query sql.Statement, result interface{}) {
+	version := responseVersion(w)
+	if version == apiVersion1 {
+		writeResult(w, result)
+		return
+	}
+
+	var columns []columnV3
+	var rows [][]interface{}
+	switch q := query.(type) {
+	case *sql.Select, *engine.OrderedSelect, *engine.GroupedSelect, *engine.AsOfSelect:
+		described, err := db.ResultColumns(q)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		columns, rows = describeColumns(described), typedRows(described, result.([][]interface{}))
+	case *engine.CountRows:
+		columns, rows = []columnV3{{"count", "integer", false}}, result.([][]interface{})
+	}
+
+	if version == apiVersion2 {
+		if columns == nil {
+			writeResult(w, result)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(selectResultV2{columns, rows}); err != nil {
+			logging.Errorf("failed to write result: %s", err)
+		}
+		return
+	}
+
+	var response interface{}
+	switch query.(type) {
+	case *sql.Select, *engine.OrderedSelect, *engine.GroupedSelect, *engine.AsOfSelect, *engine.CountRows:
+		response = selectResultV3{Columns: columns, Rows: rows}
+	case *sql.Insert, *sql.Update, *sql.Delete, *engine.UpdateIfVersion, *engine.DeleteIfVersion:
+		response = changeResultV3{result.(int)}
+	default:
+		if stringer, ok := result.(fmt.Stringer); ok {
+			result = stringer.String()
+		}
+		response = resultV2{result}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logging.Errorf("failed to write result: %s", err)
+	}
+}
+
+// writeError writes the error in the format of the API version.
+func writeError(w http.ResponseWriter, message string, status int) {
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	writeErrorCode(w, status, &engine.Error{Code: engine.ErrorCode(code), Message: message, Position: -1})
+}
+
+// writeQueryError writes the error of the query parsing or execution,
+// the API version 3 gets the status and the code by the error kind.
+func writeQueryError(w http.ResponseWriter, err error) {
+	status, classified := queryErrorCode(err)
+
+	// the older versions have only the limit and the access statuses
+	if responseVersion(w) != apiVersion3 && status != http.StatusRequestEntityTooLarge &&
+		status != http.StatusForbidden && status != http.StatusUnauthorized && status != http.StatusTooManyRequests {
+		status = http.StatusBadRequest
+	}
+
+	writeErrorCode(w, status, classified)
+}
+
+// queryErrorCode returns the status and the classified error.
+func queryErrorCode(err error) (int, *engine.Error) {
+	var admissionErr *AdmissionError
+	classified := engine.Classify(err)
+	if errors.As(err, &admissionErr) {
+		classified.Code = engine.CodeTooManyRequests
+	}
+
+	status, exists := errorStatuses[classified.Code]
+	if !exists {
+		status = http.StatusBadRequest
+	}
+
+	return status, classified
+}
+
+// errorDetail describes the error in the API version 3 format.
+func errorDetail(e *engine.Error) *errorDetailV3 {
+	detail := &errorDetailV3{Code: string(e.Code), Category: string(e.Category()), Message: e.Message}
+	if detail.Category != "" {
+		detail.SQLState = e.SQLState()
+	}
+	if e.Position >= 0 {
+		position := e.Position
+		detail.Position = &position
+	}
+
+	return detail
+}
+
+func writeErrorCode(w http.ResponseWriter, status int, e *engine.Error) {
+	version := responseVersion(w)
+	if version == apiVersion1 {
+		http.Error(w, e.Message, status)
+		return
+	}
+
+	var response interface{} = errorV2{e.Message}
+	if version == apiVersion3 {
+		response = errorV3{*errorDetail(e)}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logging.Errorf("failed to write error: %s", err)
+	}
+}
+
+// versionHandler describes the supported API versions.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(apiVersionInfo{
+		Current:   supportedAPIVersions[len(supportedAPIVersions)-1],
+		Default:   apiVersion1,
+		Supported: supportedAPIVersions,
+	})
+	if err != nil {
+		logging.Errorf("failed to write API versions: %s", err)
+	}
+}
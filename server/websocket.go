@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The WebSocket protocol as defined by RFC 6455, only the parts the
+// query channel needs: the text messages, the fragmented messages from
+// the clients, the pings and the closing handshake. The extensions and
+// the subprotocols are not negotiated.
+
+// webSocketGUID is appended to the key of the opening handshake.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketMaxMessageSize limits the messages sent by the clients.
+const webSocketMaxMessageSize = 16 * 1024 * 1024
+
+// the opcodes of the frames
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// the status codes of the close frames
+const (
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsCloseTooBig          = 1009
+)
+
+// errWebSocketClosed is returned when the client has closed the connection.
+var errWebSocketClosed = errors.New("WebSocket connection is closed")
+
+// webSocketError closes the connection with the status code.
+type webSocketError struct {
+	code    int
+	message string
+}
+
+func (e *webSocketError) Error() string {
+	return e.message
+}
+
+// wsConn is the server side of the WebSocket connection,
+// the messages are read by one goroutine and written by any.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// readTimeout closes the connection of the client that has
+	// sent nothing, not even a pong, for so long, 0 means never.
+	readTimeout time.Duration
+	// mu serializes the writes of the frames
+	mu     sync.Mutex
+	closed bool
+}
+
+// checkWebSocketHandshake validates the opening handshake of the client.
+// The browsers send the credentials cached for the server along with the
+// cross-origin handshakes, so the origin must be the server itself.
+func checkWebSocketHandshake(r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("only GET is allowed")
+	}
+
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return fmt.Errorf("WebSocket upgrade is expected")
+	}
+
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != "13" {
+		return fmt.Errorf("unsupported WebSocket version %q, expected 13", version)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return fmt.Errorf("invalid Sec-WebSocket-Key")
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return fmt.Errorf("cross-origin WebSocket connections are not allowed from %s", origin)
+		}
+	}
+
+	return nil
+}
+
+// headerContains reports whether the comma-separated header has the token.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// upgradeWebSocket completes the opening handshake checked by
+// checkWebSocketHandshake and takes over the connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection can not be upgraded")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade connection: %w", err)
+	}
+
+	// the deadlines of the HTTP server do not apply to the upgraded connection
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to upgrade connection: %w", err)
+	}
+
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + webSocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n" +
+		requestIDHeader + ": " + w.Header().Get(requestIDHeader) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to upgrade connection: %w", err)
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to upgrade connection: %w", err)
+	}
+
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// readMessage reads the next text message of the client, the pings
+// are answered and the close frame ends the connection with
+// errWebSocketClosed.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		final, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.close(code, "")
+
+			return nil, errWebSocketClosed
+		case wsBinary:
+			return nil, &webSocketError{wsCloseUnsupportedData, "binary messages are not supported"}
+		case wsText:
+			if fragmented {
+				return nil, &webSocketError{wsCloseProtocolError, "expected continuation frame"}
+			}
+			fragmented = true
+		case wsContinuation:
+			if !fragmented {
+				return nil, &webSocketError{wsCloseProtocolError, "unexpected continuation frame"}
+			}
+		default:
+			return nil, &webSocketError{wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode)}
+		}
+
+		if len(message)+len(payload) > webSocketMaxMessageSize {
+			return nil, &webSocketError{wsCloseTooBig, fmt.Sprintf("message is larger than %d bytes", webSocketMaxMessageSize)}
+		}
+		message = append(message, payload...)
+
+		if final {
+			if !utf8.Valid(message) {
+				return nil, &webSocketError{wsCloseInvalidPayload, "message is not valid UTF-8"}
+			}
+
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads the frame and unmasks its payload.
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	if c.readTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	final, opcode := header[0]&0x80 != 0, header[0]&0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &webSocketError{wsCloseProtocolError, "reserved bits are set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &webSocketError{wsCloseProtocolError, "client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.r, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.r, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if opcode >= wsClose && (!final || length > 125) {
+		return false, 0, nil, &webSocketError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length > webSocketMaxMessageSize {
+		return false, 0, nil, &webSocketError{wsCloseTooBig, fmt.Sprintf("message is larger than %d bytes", webSocketMaxMessageSize)}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return final, opcode, payload, nil
+}
+
+// writeMessage writes the text message as a single frame.
+func (c *wsConn) writeMessage(message []byte) error {
+	return c.writeFrame(wsText, message)
+}
+
+// ping checks that the client is still connected.
+func (c *wsConn) ping() error {
+	return c.writeFrame(wsPing, nil)
+}
+
+// writeFrame writes the unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errWebSocketClosed
+	}
+
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return fmt.Errorf("failed to write WebSocket frame: %w", err)
+	}
+
+	return nil
+}
+
+// close sends the close frame with the status code once
+// and closes the connection.
+func (c *wsConn) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	// the client may have gone away already
+	_ = c.writeFrameLocked(wsClose, payload)
+	c.conn.Close()
+}
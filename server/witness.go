@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/krasun/gosqldb/internal/logging"
+)
+
+// The witness is the third party of the failover pair that grants the
+// leader lease to one node at a time. The node that holds the lease
+// renews it before it expires. The expired lease is granted to the node
+// that has seen its term, the term grows when another node takes it:
+//
+//	POST /lease {"node": "a", "address": "http://a:8080", "term": 3, "duration": "10s"}
+//
+//	{"node": "a", "address": "http://a:8080", "term": 3, "expires": "..."}
+//
+// The lease held by another node is returned with 409 Conflict.
+
+// witnessStateFileName is the name of the file that stores the lease.
+const witnessStateFileName = "gosqldb.witness.json"
+
+// maxLeaseDuration limits the leases, so the failed
+// leader does not block the failover for long.
+const maxLeaseDuration = 5 * time.Minute
+
+// Lease is the leader lease granted by the witness.
+type Lease struct {
+	Node string `json:"node"`
+	// Address is the advertised address of the node,
+	// the clients of the other nodes are sent to it.
+	Address string    `json:"address"`
+	Term    uint64    `json:"term"`
+	Expires time.Time `json:"expires"`
+	// Duration is how long the lease is granted for.
+	Duration string `json:"duration"`
+}
+
+// expired reports whether nobody holds the lease.
+func (l Lease) expired() bool {
+	return l.Node == "" || !time.Now().Before(l.Expires)
+}
+
+// leaseRequest is the body of the request to take or renew the lease.
+type leaseRequest struct {
+	Node    string `json:"node"`
+	Address string `json:"address"`
+	// Term is the last term the node has seen.
+	Term     uint64 `json:"term"`
+	Duration string `json:"duration"`
+}
+
+// Witness grants the leader lease.
+type Witness struct {
+	filePath string
+	secret   string
+
+	mu    sync.Mutex
+	lease Lease
+}
+
+// NewWitness returns the witness with the lease stored in the directory.
+// The stored lease is extended by its duration, so its holder renews it
+// before the other nodes can take it.
+func NewWitness(dir string, secret string) (*Witness, error) {
+	w := &Witness{filePath: path.Join(dir, witnessStateFileName), secret: secret}
+
+	content, err := ioutil.ReadFile(w.filePath)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", w.filePath, err)
+	}
+
+	if err := json.Unmarshal(content, &w.lease); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON from %s: %w", w.filePath, err)
+	}
+
+	duration, err := time.ParseDuration(w.lease.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease duration in %s: %w", w.filePath, err)
+	}
+	w.lease.Expires = time.Now().Add(duration).UTC()
+
+	return w, nil
+}
+
+// store replaces the file with the lease.
+func (w *Witness) store() error {
+	content, err := json.Marshal(w.lease)
+	if err != nil {
+		return fmt.Errorf("failed to encode lease: %w", err)
+	}
+
+	if err := ioutil.WriteFile(w.filePath+".tmp", content, 0600); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", w.filePath, err)
+	}
+
+	if err := os.Rename(w.filePath+".tmp", w.filePath); err != nil {
+		return fmt.Errorf("failed to replace file %s: %w", w.filePath, err)
+	}
+
+	return nil
+}
+
+// acquire grants or renews the lease, false if another node holds it.
+func (w *Witness) acquire(request leaseRequest, duration time.Duration) (Lease, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lease := w.lease
+	switch {
+	case lease.Node == request.Node && lease.Term == request.Term:
+		// the holder renews the lease, or takes it
+		// again if nobody has taken it since
+	case lease.expired() && request.Term >= lease.Term:
+		lease.Node, lease.Term = request.Node, lease.Term+1
+	default:
+		return lease, false, nil
+	}
+	lease.Address = request.Address
+	lease.Duration = duration.String()
+	lease.Expires = time.Now().Add(duration).UTC()
+
+	changed := lease.Node != w.lease.Node || lease.Term != w.lease.Term ||
+		lease.Address != w.lease.Address || lease.Duration != w.lease.Duration
+	previous := w.lease
+	w.lease = lease
+	if changed {
+		// the lease is stored before it is granted,
+		// so the term is not granted twice
+		if err := w.store(); err != nil {
+			w.lease = previous
+			return lease, false, err
+		}
+
+		if lease.Term != previous.Term {
+			logging.Infof("node %s at %s holds the lease of term %d", lease.Node, lease.Address, lease.Term)
+		}
+	}
+
+	return lease, true, nil
+}
+
+// Handler returns the handler of the lease requests.
+func (w *Witness) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", w.leaseHandler)
+
+	return mux
+}
+
+func (w *Witness) leaseHandler(rw http.ResponseWriter, r *http.Request) {
+	if w.secret != "" {
+		token, ok := bearerToken(r.Header.Get("Authorization"))
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(w.secret)) != 1 {
+			http.Error(rw, "invalid witness secret", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.mu.Lock()
+		lease := w.lease
+		w.mu.Unlock()
+
+		writeJSON(rw, lease)
+	case http.MethodPost:
+		var request leaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid lease request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 || duration > maxLeaseDuration {
+			http.Error(rw, fmt.Sprintf("lease duration must be positive and at most %s", maxLeaseDuration), http.StatusBadRequest)
+			return
+		}
+
+		if request.Node == "" {
+			http.Error(rw, "node is required", http.StatusBadRequest)
+			return
+		}
+
+		lease, granted, err := w.acquire(request, duration)
+		if err != nil {
+			logging.Errorf("failed to grant lease: %s", err)
+			http.Error(rw, "failed to grant lease", http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if !granted {
+			rw.WriteHeader(http.StatusConflict)
+		}
+		if err := json.NewEncoder(rw).Encode(lease); err != nil {
+			logging.Errorf("failed to write lease: %s", err)
+		}
+	default:
+		http.Error(rw, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}